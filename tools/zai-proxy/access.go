@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// AccessRule allows or denies requests for which When holds. Rules are
+// checked in order, global before route, and the first match decides;
+// requests matching none are allowed.
+type AccessRule struct {
+	When    exprField `json:"when"`
+	Action  string    `json:"action"`
+	Message string    `json:"message,omitempty"`
+}
+
+func validateAccess(rules []AccessRule) error {
+	for i, a := range rules {
+		if a.When.Expr == nil {
+			return fmt.Errorf("rule %d: when is required", i)
+		}
+		if a.Action != "allow" && a.Action != "deny" {
+			return fmt.Errorf("rule %d: action must be allow or deny", i)
+		}
+	}
+	return nil
+}
+
+// checkAccess applies the access rules, returning the denial message when
+// the request is refused. A rule that fails to evaluate is logged and
+// skipped.
+func (p *proxy) checkAccess(ex *exchange, r *http.Request) (string, bool) {
+	for _, rules := range [][]AccessRule{p.cfg.Access, ex.route.Access} {
+		for _, a := range rules {
+			ok, err := a.When.Bool(p.exprEnv(ex, r))
+			if err != nil {
+				log.Printf("Error evaluating access rule: %v", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if a.Action == "allow" {
+				return "", false
+			}
+			msg := a.Message
+			if msg == "" {
+				msg = fmt.Sprintf("request denied by access rule %s", a.When)
+			}
+			return msg, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin guards operator endpoints with the configured admin token,
+// presented as a bearer token. With no token configured they are refused:
+// an open admin API would let anyone who reaches the proxy repoint its
+// upstreams and receive its keys.
+func requireAdmin(cfg *Config, h http.Handler) http.Handler {
+	token := cfg.adminToken()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, http.StatusForbidden, "admin_disabled", "the admin API is disabled; set admin.token to enable it")
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or wrong admin token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminToken is the token operator endpoints take, "" when none is set.
+func (c *Config) adminToken() string {
+	if c.Admin.Token != "" {
+		return c.Admin.Token
+	}
+	return c.AdminToken
+}
+
+// handleMutation mounts h, an endpoint that changes the proxy, only when an
+// admin token is set. Without one the pattern is still claimed, by a
+// refusal, so the call is never proxied upstream in its place.
+func handleMutation(mux *http.ServeMux, cfg *Config, pattern string, h http.Handler) {
+	if cfg.adminToken() == "" {
+		h = http.NotFoundHandler()
+	}
+	mux.Handle(pattern, requireAdmin(cfg, h))
+}
+
+// keysAPI serves virtual key and quota management under /admin.
+type keysAPI struct {
+	store   Store
+	reg     *clientRegistry
+	quotas  *quotaChecker
+	audit   *auditLog
+	history *configHistory
+}
+
+func (a *keysAPI) register(mux *http.ServeMux, cfg *Config) {
+	mutation := func(pattern string, before func(*http.Request) any, h http.HandlerFunc) {
+		handleMutation(mux, cfg, pattern, a.audit.wrap(before, h))
+	}
+	mux.Handle("GET /admin/keys", requireAdmin(cfg, http.HandlerFunc(a.list)))
+	mutation("POST /admin/keys", nil, a.create)
+	mutation("DELETE /admin/keys/{id}", a.keyBefore, a.revoke)
+	mutation("POST /admin/keys/{id}/rotate", a.keyBefore, a.rotate)
+	mux.Handle("GET /admin/quotas/{client}", requireAdmin(cfg, http.HandlerFunc(a.getQuota)))
+	mutation("PUT /admin/quotas/{client}", func(r *http.Request) any {
+		q, _ := a.quotas.Limits(r.Context(), r.PathValue("client"))
+		return q
+	}, a.setQuota)
+}
+
+// keyBefore snapshots the key a request names, for the audit log.
+func (a *keysAPI) keyBefore(r *http.Request) any {
+	if a.store == nil {
+		return nil
+	}
+	keys, _ := a.store.ListKeys(r.Context())
+	for _, k := range keys {
+		if k.ID == r.PathValue("id") {
+			return k
+		}
+	}
+	return nil
+}
+
+func (a *keysAPI) needStore(w http.ResponseWriter) bool {
+	if a.store == nil {
+		writeError(w, http.StatusNotImplemented, "not_configured", "virtual keys and quotas require persistent storage")
+		return false
+	}
+	return true
+}
+
+func (a *keysAPI) list(w http.ResponseWriter, r *http.Request) {
+	if !a.needStore(w) {
+		return
+	}
+	keys, err := a.store.ListKeys(r.Context())
+	if err != nil {
+		log.Printf("Error listing keys: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "listing keys failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (a *keysAPI) create(w http.ResponseWriter, r *http.Request) {
+	if !a.needStore(w) {
+		return
+	}
+	var req struct {
+		Client string `json:"client"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Client == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", `body must be {"client": "<name>"}`)
+		return
+	}
+	k, secret := newVirtualKey(req.Client)
+	if err := a.store.CreateKey(r.Context(), k); err != nil {
+		log.Printf("Error creating key: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "creating key failed")
+		return
+	}
+	writeJSON(w, http.StatusCreated, issuedKey{k, secret})
+}
+
+func (a *keysAPI) revoke(w http.ResponseWriter, r *http.Request) {
+	if !a.needStore(w) {
+		return
+	}
+	ok, err := a.store.RevokeKey(r.Context(), r.PathValue("id"), time.Now())
+	if err != nil {
+		log.Printf("Error revoking key: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "revoking key failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no active key with that id")
+		return
+	}
+	a.reg.Forget()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotate replaces a key with a new one for the same client.
+func (a *keysAPI) rotate(w http.ResponseWriter, r *http.Request) {
+	if !a.needStore(w) {
+		return
+	}
+	k, secret, err := rotateKey(r.Context(), a.store, r.PathValue("id"))
+	if errors.Is(err, errKeyNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error rotating key: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "rotating key failed")
+		return
+	}
+	a.reg.Forget()
+	writeJSON(w, http.StatusCreated, issuedKey{k, secret})
+}
+
+func (a *keysAPI) getQuota(w http.ResponseWriter, r *http.Request) {
+	q, err := a.quotas.Limits(r.Context(), r.PathValue("client"))
+	if err != nil {
+		log.Printf("Error reading quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "reading quota failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+func (a *keysAPI) setQuota(w http.ResponseWriter, r *http.Request) {
+	if !a.needStore(w) {
+		return
+	}
+	var q QuotaConfig
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	client := r.PathValue("client")
+	before, err := a.quotas.Limits(r.Context(), client)
+	if err == nil {
+		err = a.store.SetQuota(r.Context(), client, q)
+	}
+	if err != nil {
+		log.Printf("Error storing quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "storing quota failed")
+		return
+	}
+	a.history.recordQuota(client, before, q)
+	writeJSON(w, http.StatusOK, q)
+}
+
+// AdminConfig moves the management endpoints to their own listener, a TCP
+// address or "unix:/path/to.sock", so operational controls stay off the
+// data plane. Token, when set, replaces admin_token for them; with neither
+// set the admin API refuses every call. Journal is a file recording
+// changes made through the API so they survive restarts, along with the
+// version history they can be rolled back through; Audit is a
+// hash-chained log of who made them.
+type AdminConfig struct {
+	Listen  string `json:"listen"`
+	Token   string `json:"token"`
+	Journal string `json:"journal"`
+	Audit   string `json:"audit"`
+}
+
+// adminAPI serves operational endpoints:
+//   - the effective config and its version history;
+//   - upstream and route management;
+//   - feature flags and prompt templates;
+//   - logging and debug capture;
+//   - recent errors, firing alerts and the audit log;
+//   - experiments, evals, scheduled prompts and agents;
+//   - the drain and maintenance switch, cache control and restarts;
+//   - a web UI over them.
+type adminAPI struct {
+	cfg     *Config
+	file    string
+	sources configSources
+	proxy   *proxy
+	audit   *auditLog
+	servers *servers
+	history *configHistory
+}
+
+func (a *adminAPI) register(mux *http.ServeMux) {
+	view := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, requireAdmin(a.cfg, h))
+	}
+	mutation := func(pattern string, before func(*http.Request) any, h http.HandlerFunc) {
+		handleMutation(mux, a.cfg, pattern, a.audit.wrap(before, h))
+	}
+	upstream := func(r *http.Request) any {
+		for _, u := range a.proxy.pool.list() {
+			if u.Name == r.PathValue("name") {
+				return u
+			}
+		}
+		return nil
+	}
+	flag := func(r *http.Request) any {
+		if f, ok := a.proxy.flags.list()[r.PathValue("name")]; ok {
+			return f
+		}
+		return nil
+	}
+	view("GET /admin/config", a.config)
+	view("GET /admin/config/versions", a.configVersions)
+	view("GET /admin/config/versions/{version}", a.configVersion)
+	view("GET /admin/config/versions/{version}/diff", a.configDiff)
+	mutation("POST /admin/config/versions/{version}/rollback", func(*http.Request) any { return a.history.current() }, a.rollbackConfig)
+	view("GET /admin/upstreams", a.upstreams)
+	view("GET /admin/cluster", a.clusterPeers)
+	mutation("PUT /admin/upstreams/{name}", upstream, a.putUpstream)
+	mutation("DELETE /admin/upstreams/{name}", upstream, a.removeUpstream)
+	view("GET /admin/routes", a.routes)
+	mutation("PUT /admin/routes", func(*http.Request) any { return a.proxy.pool.overrides() }, a.setRoute)
+	view("GET /admin/errors", a.recentErrors)
+	view("GET /admin/alerts", a.listAlerts)
+	view("GET /admin/flags", a.listFlags)
+	mutation("PUT /admin/flags/{name}", flag, a.setFlag)
+	mutation("DELETE /admin/flags/{name}", flag, a.deleteFlag)
+	template := func(r *http.Request) any {
+		if versions, ok := a.proxy.templates.list()[r.PathValue("name")]; ok {
+			return versions
+		}
+		return nil
+	}
+	view("GET /admin/templates", a.listTemplates)
+	view("GET /admin/templates/{name}", a.getTemplate)
+	mutation("POST /admin/templates/{name}", template, a.addTemplateVersion)
+	mutation("DELETE /admin/templates/{name}", template, a.deleteTemplate)
+	view("GET /admin/log", a.getLog)
+	mutation("PUT /admin/log", func(*http.Request) any {
+		return logSettings{Level: strings.ToLower(logLevel.Level().String()), Debug: a.proxy.debug.active()}
+	}, a.setLog)
+	view("GET /admin/debug/captures", a.captures)
+	view("GET /admin/mode", a.getMode)
+	mutation("PUT /admin/mode", func(*http.Request) any { return map[string]string{"mode": a.proxy.mode.get()} }, a.setMode)
+	mutation("POST /admin/cache/purge", nil, a.purge)
+	mutation("POST /admin/restart", nil, a.restart)
+	view("GET /admin/audit", a.auditEntries)
+	view("GET /admin/experiments", a.listExperiments)
+	view("GET /admin/experiments/{name}", a.getExperiment)
+	mutation("DELETE /admin/experiments/{name}/results", nil, a.resetExperiment)
+	view("GET /admin/evals", a.listEvals)
+	view("GET /admin/evals/{name}", a.evalHistory)
+	mutation("POST /admin/evals/{name}/run", nil, a.runEval)
+	view("GET /admin/scheduled-prompts", a.listScheduledPrompts)
+	mutation("POST /admin/scheduled-prompts/{name}/run", nil, a.runScheduledPrompt)
+	view("GET /admin/agents", a.listAgents)
+	// The UI is static; it asks for the admin token and sends it on every
+	// API call.
+	mux.Handle("GET /admin/ui/", http.StripPrefix("/admin/ui/", adminUI()))
+	mux.Handle("GET /admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
+}
+
+// config serves the effective config, secrets masked, with the source of
+// every value. Upstreams, route targets and flags reflect admin API edits.
+func (a *adminAPI) config(w http.ResponseWriter, r *http.Request) {
+	eff := a.cfg.masked()
+	var byAdmin []string // pointers whose values the admin API set
+	if a.proxy.pool.edited() {
+		eff["upstreams"] = jsonShaped(a.proxy.pool.list())
+		byAdmin = append(byAdmin, "/upstreams")
+	}
+	routes, _ := eff["routes"].([]any)
+	for i, rt := range routes {
+		rm, _ := rt.(map[string]any)
+		if t := a.proxy.pool.routeTarget(a.cfg.Routes[i].Pattern); rm != nil && t != "" {
+			rm["target"] = t
+			byAdmin = append(byAdmin, "/routes/"+strconv.Itoa(i)+"/target")
+		}
+	}
+	flags := a.proxy.flags.list()
+	eff["flags"] = jsonShaped(flags)
+	for name, f := range flags {
+		if fc, ok := a.cfg.Flags[name]; !ok || !reflect.DeepEqual(fc, f) {
+			byAdmin = append(byAdmin, "/flags/"+strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1"))
+		}
+	}
+	sources := make(map[string]string)
+	walkJSON(any(eff), "", func(ptr string, v any) {
+		switch v.(type) {
+		case map[string]any, []any:
+			return
+		}
+		sources[ptr] = a.sources.of(ptr)
+		for _, p := range byAdmin {
+			if ptr == p || strings.HasPrefix(ptr, p+"/") {
+				sources[ptr] = "admin"
+			}
+		}
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"file": a.file, "config": eff, "sources": sources})
+}
+
+// jsonShaped converts v to the maps and slices encoding/json decodes into.
+func jsonShaped(v any) any {
+	b, _ := json.Marshal(v)
+	var out any
+	json.Unmarshal(b, &out)
+	return out
+}
+
+func (a *adminAPI) upstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"upstreams": a.proxy.pool.list(),
+		"traffic":   a.proxy.upstreams.snapshot(),
+		"circuits":  a.proxy.pool.circuits.opened(),
+		"health":    a.proxy.pool.health.report(),
+	})
+}
+
+func (a *adminAPI) clusterPeers(w http.ResponseWriter, r *http.Request) {
+	if a.proxy.cluster == nil {
+		writeError(w, http.StatusNotFound, "not_found", "this replica is not clustered")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"node": a.proxy.cluster.node, "peers": a.proxy.cluster.peers()})
+}
+
+// putUpstream adds or edits a pool member from a {"url", "weight"} body.
+func (a *adminAPI) putUpstream(w http.ResponseWriter, r *http.Request) {
+	var u UpstreamConfig
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	u.Name = r.PathValue("name")
+	if err := u.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := a.proxy.pool.put(u); err != nil {
+		log.Printf("Error journaling upstream change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording upstream change failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (a *adminAPI) removeUpstream(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.proxy.pool.remove(r.PathValue("name"))
+	if err != nil {
+		log.Printf("Error journaling upstream change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording upstream change failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no upstream with that name")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routeInfo describes a route for the admin API.
+type routeInfo struct {
+	Pattern  string   `json:"pattern"`
+	Target   string   `json:"target,omitempty"`
+	Targets  int      `json:"conditional_targets,omitempty"`
+	Override string   `json:"override,omitempty"`
+	Chain    []string `json:"chain"`
+}
+
+func (a *adminAPI) routes(w http.ResponseWriter, r *http.Request) {
+	out := make([]routeInfo, 0, len(a.cfg.Routes))
+	for i := range a.cfg.Routes {
+		rc := &a.cfg.Routes[i]
+		out = append(out, routeInfo{Pattern: rc.Pattern, Target: rc.Target, Targets: len(rc.Targets),
+			Override: a.proxy.pool.routeTarget(rc.Pattern), Chain: rc.chain()})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"routes": out})
+}
+
+// setRoute overrides a route's target from a {"pattern", "target"} body;
+// an empty target restores the configured routing.
+func (a *adminAPI) setRoute(w http.ResponseWriter, r *http.Request) {
+	var o RouteOverride
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !slices.ContainsFunc(a.cfg.Routes, func(rc RouteConfig) bool { return rc.Pattern == o.Pattern }) {
+		writeError(w, http.StatusNotFound, "not_found", "no route with that pattern")
+		return
+	}
+	if o.Target != "" {
+		if u, err := url.Parse(o.Target); err != nil || u.Scheme == "" || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "invalid_request", "target must be an absolute URL")
+			return
+		}
+	}
+	if err := a.proxy.pool.setRoute(o); err != nil {
+		log.Printf("Error journaling route change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording route change failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (a *adminAPI) recentErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"errors": a.proxy.errors.list()})
+}
+
+func (a *adminAPI) listAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"alerts": a.proxy.alerts.firingAlerts()})
+}
+
+// listFlags returns every flag, with its state for ?client= when given.
+func (a *adminAPI) listFlags(w http.ResponseWriter, r *http.Request) {
+	res := map[string]any{"flags": a.proxy.flags.list()}
+	if c := r.URL.Query().Get("client"); c != "" {
+		res["client"], res["on"] = c, a.proxy.flags.forClient(c)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *adminAPI) setFlag(w http.ResponseWriter, r *http.Request) {
+	var f FlagConfig
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := f.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := a.proxy.flags.set(r.PathValue("name"), &f); err != nil {
+		log.Printf("Error journaling flag change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording flag change failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+func (a *adminAPI) deleteFlag(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := a.proxy.flags.list()[name]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no flag with that name")
+		return
+	}
+	if err := a.proxy.flags.set(name, nil); err != nil {
+		log.Printf("Error journaling flag change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording flag change failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) listTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"templates": a.proxy.templates.list()})
+}
+
+// getTemplate returns a template's versions, or with ?version= one of them.
+func (a *adminAPI) getTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	versions, ok := a.proxy.templates.list()[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no template with that name")
+		return
+	}
+	if q := r.URL.Query().Get("version"); q != "" {
+		n, err := strconv.Atoi(q)
+		t, ok := a.proxy.templates.get(name, n)
+		if err != nil || n <= 0 || !ok {
+			writeError(w, http.StatusNotFound, "not_found", "no such version of the template")
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"name": name, "versions": versions})
+}
+
+// addTemplateVersion stores the body as the template's next version,
+// creating the template if need be.
+func (a *adminAPI) addTemplateVersion(w http.ResponseWriter, r *http.Request) {
+	var t TemplateVersion
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := t.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	t, err := a.proxy.templates.add(r.PathValue("name"), t)
+	if err != nil {
+		log.Printf("Error journaling template change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording template change failed")
+		return
+	}
+	writeJSON(w, http.StatusCreated, t)
+}
+
+func (a *adminAPI) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := a.proxy.templates.list()[name]; !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no template with that name")
+		return
+	}
+	if err := a.proxy.templates.remove(name); err != nil {
+		log.Printf("Error journaling template change: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "recording template change failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logSettings is the body of GET and PUT /admin/log.
+type logSettings struct {
+	Level string      `json:"level"`
+	Debug []DebugRule `json:"debug"`
+}
+
+func (a *adminAPI) getLog(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logSettings{Level: strings.ToLower(logLevel.Level().String()), Debug: a.proxy.debug.active()})
+}
+
+// debugTTL bounds debug rules set without an expiry, so a capture started
+// during an incident does not outlive it.
+const debugTTL = time.Hour
+
+// setLog changes the log level and, when "debug" is present, replaces the
+// debug capture rules.
+func (a *adminAPI) setLog(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string       `json:"level"`
+		Debug *[]DebugRule `json:"debug"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	lc := LogConfig{Level: req.Level}
+	if req.Debug != nil {
+		lc.Debug = *req.Debug
+	}
+	if err := lc.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.Level != "" {
+		logLevel.UnmarshalText([]byte(req.Level))
+	}
+	if req.Debug != nil {
+		for i := range lc.Debug {
+			if lc.Debug[i].Expires.IsZero() {
+				lc.Debug[i].Expires = time.Now().Add(debugTTL).UTC()
+			}
+		}
+		a.proxy.debug.setRules(lc.Debug)
+	}
+	log.Printf("Log level set to %s with %d debug rules", strings.ToLower(logLevel.Level().String()), len(a.proxy.debug.active()))
+	a.getLog(w, r)
+}
+
+func (a *adminAPI) captures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"captures": a.proxy.debug.captures.list()})
+}
+
+// auditEntries returns the newest ?limit= (default 100) audit entries and
+// whether the chain verifies.
+func (a *adminAPI) auditEntries(w http.ResponseWriter, r *http.Request) {
+	if a.audit == nil || a.audit.path == "" {
+		writeError(w, http.StatusNotImplemented, "not_configured", "no audit log configured")
+		return
+	}
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	entries, broken, err := readAudit(a.audit.path)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "reading audit log failed")
+		return
+	}
+	total := len(entries)
+	entries = entries[max(total-limit, 0):]
+	slices.Reverse(entries)
+	res := map[string]any{"total": total, "intact": broken == 0, "entries": entries}
+	if broken != 0 {
+		res["broken_at"] = broken
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *adminAPI) getMode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":      a.proxy.mode.get(),
+		"in_flight": a.proxy.mode.inFlight.Load(),
+	})
+}
+
+// setMode switches between serving, drain and maintenance from a
+// {"mode": "..."} body.
+func (a *adminAPI) setMode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := a.proxy.mode.set(req.Mode); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	infof("Operating mode set to %s", req.Mode)
+	a.getMode(w, r)
+}
+
+// purge drops cached key lookups.
+func (a *adminAPI) purge(w http.ResponseWriter, r *http.Request) {
+	a.proxy.registry.Forget()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restart hands the listeners to a new process of the executable on disk;
+// this one drains once it serves.
+func (a *adminAPI) restart(w http.ResponseWriter, r *http.Request) {
+	if err := a.servers.restart(); err != nil {
+		writeError(w, http.StatusInternalServerError, "restart_failed", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listen opens addr, which is a TCP address or "unix:" and a socket path.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
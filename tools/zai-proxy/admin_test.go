@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminMutations are endpoints that would hand the proxy, or its keys, to
+// whoever calls them.
+var adminMutations = []struct{ method, path string }{
+	{http.MethodPut, "/admin/upstreams/evil"},
+	{http.MethodDelete, "/admin/upstreams/primary"},
+	{http.MethodPut, "/admin/routes"},
+	{http.MethodPost, "/admin/restart"},
+	{http.MethodPost, "/admin/keys"},
+	{http.MethodPut, "/admin/quotas/alice"},
+}
+
+// TestAdminMutationsRefused sends the mutating admin endpoints calls
+// without the admin token. None may reach its handler, which would panic
+// here for want of a proxy behind it.
+func TestAdminMutationsRefused(t *testing.T) {
+	for _, tc := range []struct {
+		name, token, auth string
+		want              int
+	}{
+		{"no token configured", "", "", http.StatusForbidden},
+		{"no token configured, one sent", "", "Bearer guess", http.StatusForbidden},
+		{"no credentials", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer s3cre", http.StatusUnauthorized},
+		{"token without scheme", "s3cret", "s3cret!", http.StatusUnauthorized},
+	} {
+		cfg := defaultConfig()
+		cfg.Admin.Token = tc.token
+		mux := http.NewServeMux()
+		(&keysAPI{audit: &auditLog{}}).register(mux, cfg)
+		(&adminAPI{cfg: cfg, audit: &auditLog{}}).register(mux)
+		for _, m := range adminMutations {
+			req := httptest.NewRequest(m.method, m.path, strings.NewReader(`{"url":"https://attacker.example"}`))
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("%s: %s %s: status %d, want %d", tc.name, m.method, m.path, rec.Code, tc.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("%s: %s %s: Content-Type %q, want a JSON error", tc.name, m.method, m.path, ct)
+			}
+		}
+	}
+}
+
+// TestRequireAdmin checks the guard admits the configured token, from
+// admin.token over admin_token, and nothing else.
+func TestRequireAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for _, tc := range []struct {
+		name, legacy, token, auth string
+		want                      int
+	}{
+		{"admin.token", "", "s3cret", "Bearer s3cret", http.StatusNoContent},
+		{"admin_token", "old", "", "Bearer old", http.StatusNoContent},
+		{"admin.token replaces admin_token", "old", "s3cret", "Bearer old", http.StatusUnauthorized},
+		{"neither", "", "", "Bearer ", http.StatusForbidden},
+	} {
+		cfg := defaultConfig()
+		cfg.AdminToken, cfg.Admin.Token = tc.legacy, tc.token
+		req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+		req.Header.Set("Authorization", tc.auth)
+		rec := httptest.NewRecorder()
+		requireAdmin(cfg, ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
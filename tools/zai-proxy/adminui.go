@@ -0,0 +1,16 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// adminUI serves the embedded admin web UI.
+func adminUI() http.Handler {
+	sub, _ := fs.Sub(uiFiles, "ui")
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentHeader names the agent instance making a request.
+const agentHeader = "X-Ringmaster-Agent"
+
+// AgentsConfig tells apart the agents sharing a key. An agent names itself
+// in X-Ringmaster-Agent; the name is bound to the key it comes with, so
+// agents of different clients never mix. With Secret set the header must
+// read "name.signature", the signature being the hex HMAC-SHA256 of
+// "client/name" under Secret, so holders of a key can only be the agents
+// they were issued. Clients listed in Require must name an agent. Quota
+// and RequestsPerMinute limit each agent as client quotas limit clients.
+// Usage is kept in memory for the MaxAgents (default 10000) agents seen
+// most recently.
+type AgentsConfig struct {
+	Secret            string      `json:"secret,omitempty"`
+	Require           []string    `json:"require,omitempty"`
+	Quota             QuotaConfig `json:"quota"`
+	RequestsPerMinute int         `json:"requests_per_minute,omitempty"`
+	MaxAgents         int         `json:"max_agents,omitempty"`
+}
+
+func (c *AgentsConfig) validate() error {
+	if c.RequestsPerMinute < 0 || c.MaxAgents < 0 {
+		return fmt.Errorf("agents: requests_per_minute and max_agents must not be negative")
+	}
+	q := c.Quota
+	if q.DailyTokens < 0 || q.MonthlyTokens < 0 || q.DailyCostUSD < 0 || q.MonthlyCostUSD < 0 {
+		return fmt.Errorf("agents: quota limits must not be negative")
+	}
+	return nil
+}
+
+// agentSignature is what an agent's header carries after its name.
+func agentSignature(secret, client, name string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(client + "/" + name))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func validAgentName(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._:-", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// AgentStats is one agent's usage.
+type AgentStats struct {
+	Client    string      `json:"client"`
+	Agent     string      `json:"agent"`
+	FirstSeen time.Time   `json:"first_seen"`
+	LastSeen  time.Time   `json:"last_seen"`
+	Today     UsageTotals `json:"today"`
+	Month     UsageTotals `json:"month"`
+	Total     UsageTotals `json:"total"`
+}
+
+type agentKey struct{ client, agent string }
+
+type agentState struct {
+	AgentStats
+	day, month time.Time // starts of the periods Today and Month cover
+	minute     int64     // unix minute the count is for
+	count      int
+}
+
+// roll starts new periods that now has entered.
+func (s *agentState) roll(now time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !s.day.Equal(day) {
+		s.day, s.Today = day, UsageTotals{}
+	}
+	if month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC); !s.month.Equal(month) {
+		s.month, s.Month = month, UsageTotals{}
+	}
+}
+
+var agentRejections = metrics.counter("zai_proxy_agent_rejections_total", "Requests refused for their agent, by reason.", "reason")
+
+// agentTracker keeps the usage of recently seen agents.
+type agentTracker struct {
+	cfg    *AgentsConfig
+	shared rateCounter // when set, counts rates for every replica
+
+	mu    sync.Mutex
+	order *list.List // of *agentState, most recently seen first
+	byKey map[agentKey]*list.Element
+}
+
+func newAgentTracker(cfg *AgentsConfig) *agentTracker {
+	return &agentTracker{cfg: cfg, order: list.New(), byKey: map[agentKey]*list.Element{}}
+}
+
+// identify returns the agent r names for client, or "" when it names none.
+func (t *agentTracker) identify(client string, r *http.Request) (string, error) {
+	v := r.Header.Get(agentHeader)
+	if v == "" {
+		if slices.Contains(t.cfg.Require, client) {
+			return "", fmt.Errorf("requests from %s must name their agent in %s", client, agentHeader)
+		}
+		return "", nil
+	}
+	name := v
+	if t.cfg.Secret != "" {
+		var sig string
+		i := strings.LastIndexByte(v, '.')
+		if i > 0 {
+			name, sig = v[:i], v[i+1:]
+		}
+		if !hmac.Equal([]byte(sig), []byte(agentSignature(t.cfg.Secret, client, name))) {
+			return "", fmt.Errorf("%s is not signed for this key", agentHeader)
+		}
+	}
+	if !validAgentName(name) {
+		return "", fmt.Errorf("agent names are up to 128 letters, digits and . _ : -")
+	}
+	return name, nil
+}
+
+// state returns the agent's entry, adding it; callers hold mu.
+func (t *agentTracker) state(k agentKey, now time.Time) *agentState {
+	if e, ok := t.byKey[k]; ok {
+		t.order.MoveToFront(e)
+		s := e.Value.(*agentState)
+		s.roll(now)
+		return s
+	}
+	s := &agentState{AgentStats: AgentStats{Client: k.client, Agent: k.agent, FirstSeen: now.UTC()}}
+	s.roll(now)
+	t.byKey[k] = t.order.PushFront(s)
+	for t.order.Len() > cmp.Or(t.cfg.MaxAgents, 10000) {
+		old := t.order.Remove(t.order.Back()).(*agentState)
+		delete(t.byKey, agentKey{old.Client, old.Agent})
+	}
+	return s
+}
+
+// admit counts a request against the agent's rate and refuses it if the
+// agent is over its rate or quota. It returns the agent's quota windows
+// and the requests left this minute, -1 when unlimited.
+func (t *agentTracker) admit(client, agent string, now time.Time) (windows []QuotaWindow, left int, retry time.Duration, err error) {
+	limit := t.cfg.RequestsPerMinute
+	shared := t.shared != nil && limit > 0
+	windows, left, retry, err = t.admitLocal(client, agent, now, !shared)
+	if err != nil || !shared {
+		return windows, left, retry, err
+	}
+	minute := now.Unix() / 60
+	n, err := t.shared.countMinute("agent:"+client+"/"+agent, minute)
+	if err != nil {
+		log.Printf("Error counting shared rate, using this replica's: %v", err)
+		return t.admitLocal(client, agent, now, true)
+	}
+	if n > int64(limit) {
+		return windows, 0, time.Unix((minute+1)*60, 0).Sub(now), fmt.Errorf("agent %s/%s is limited to %d requests a minute", client, agent, limit)
+	}
+	return windows, limit - int(n), 0, nil
+}
+
+// admitLocal checks the agent's quota and, with rate, counts the request
+// against its rate here.
+func (t *agentTracker) admitLocal(client, agent string, now time.Time, rate bool) (windows []QuotaWindow, left int, retry time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(agentKey{client, agent}, now)
+	s.LastSeen = now.UTC()
+	q := t.cfg.Quota
+	limits := []struct {
+		period string
+		used   UsageTotals
+		reset  time.Time
+		tokens int64
+		cost   float64
+	}{
+		{"daily", s.Today, s.day.AddDate(0, 0, 1), q.DailyTokens, q.DailyCostUSD},
+		{"monthly", s.Month, s.month.AddDate(0, 1, 0), q.MonthlyTokens, q.MonthlyCostUSD},
+	}
+	for _, l := range limits {
+		if l.tokens > 0 || l.cost > 0 {
+			windows = append(windows, QuotaWindow{Period: l.period, MaxTokens: l.tokens, MaxCostUSD: l.cost,
+				UsedTokens: l.used.PromptTokens + l.used.CompletionTokens, UsedCost: l.used.CostUSD, Reset: l.reset})
+		}
+	}
+	if err := exhausted(client+"/"+agent, windows); err != nil {
+		return windows, -1, 0, err
+	}
+	left = -1
+	if limit := t.cfg.RequestsPerMinute; rate && limit > 0 {
+		minute := now.Unix() / 60
+		if s.minute != minute {
+			s.minute, s.count = minute, 0
+		}
+		if s.count >= limit {
+			return windows, 0, time.Unix((minute+1)*60, 0).Sub(now), fmt.Errorf("agent %s/%s is limited to %d requests a minute", client, agent, limit)
+		}
+		s.count++
+		left = limit - s.count
+	}
+	return windows, left, 0, nil
+}
+
+func (t *agentTracker) record(client, agent string, now time.Time, status int, u Usage, cost float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(agentKey{client, agent}, now)
+	s.LastSeen = now.UTC()
+	s.Today.add(status, u, cost)
+	s.Month.add(status, u, cost)
+	s.Total.add(status, u, cost)
+}
+
+// list returns the tracked agents, of client when it is set.
+func (t *agentTracker) list(client string, now time.Time) []AgentStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []AgentStats{}
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		s := e.Value.(*agentState)
+		if client == "" || s.Client == client {
+			s.roll(now)
+			out = append(out, s.AgentStats)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Client != out[j].Client {
+			return out[i].Client < out[j].Client
+		}
+		return out[i].Agent < out[j].Agent
+	})
+	return out
+}
+
+// checkAgent refuses requests from agents over their limits.
+func (p *proxy) checkAgent(w http.ResponseWriter, ex *exchange) bool {
+	if ex.agent == "" {
+		return true
+	}
+	windows, left, retry, err := p.agents.admit(ex.client, ex.agent, ex.start)
+	ex.rateLimits = append(ex.rateLimits, quotaRates("agent", windows, ex.start)...)
+	if left >= 0 {
+		ex.rateLimits = append(ex.rateLimits, minuteRate("agent_rate", p.agents.cfg.RequestsPerMinute, left, ex.start))
+	}
+	if err == nil {
+		return true
+	}
+	if qe, ok := err.(*QuotaError); ok {
+		agentRejections.Add(1, "quota")
+		writeLimitError(w, http.StatusTooManyRequests, "quota_exceeded", qe.Error(), quotaLimit("agent", qe), time.Until(qe.Reset))
+		return false
+	}
+	agentRejections.Add(1, "rate")
+	writeLimitError(w, http.StatusTooManyRequests, "rate_limited", err.Error(), "agent_rate", retry)
+	return false
+}
+
+// listAgents serves per-agent usage, of ?client= when given.
+func (a *adminAPI) listAgents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"agents": a.proxy.agents.list(r.URL.Query().Get("client"), time.Now())})
+}
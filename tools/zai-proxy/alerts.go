@@ -0,0 +1,414 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlertsConfig raises alerts when operational thresholds are crossed and
+// sends them to Notify. Every Interval (default 30s) the rules are checked:
+// error_rate, the share of an upstream's requests over the last Window
+// (default 5m) that failed, once it has MinRequests (default 20);
+// upstream_down, an upstream whose circuit is open or whose last
+// MinRequests (default 3) requests in the window all failed; budget, the
+// share of a client's daily or monthly quota consumed; queue, the share of
+// the background job queue in use. Without Rules these four are used, at
+// 5%, down, 90% and 90%. An alert fires once its condition has held for
+// For, is sent once, again every Repeat if set while it lasts, and a
+// resolve is sent when it clears. In a cluster the leader checks and
+// notifies, from its own view of the upstreams and the queue.
+type AlertsConfig struct {
+	Interval Duration        `json:"interval,omitempty"`
+	Window   Duration        `json:"window,omitempty"`
+	Repeat   Duration        `json:"repeat,omitempty"`
+	Rules    []AlertRule     `json:"rules,omitempty"`
+	Notify   []AlertNotifier `json:"notify,omitempty"`
+}
+
+// AlertRule is a threshold to alert on. Name defaults to Kind; Severity is
+// critical, warning (the default) or info.
+type AlertRule struct {
+	Name        string   `json:"name,omitempty"`
+	Kind        string   `json:"kind"`
+	Threshold   float64  `json:"threshold,omitempty"`
+	For         Duration `json:"for,omitempty"`
+	MinRequests int64    `json:"min_requests,omitempty"`
+	Severity    string   `json:"severity,omitempty"`
+}
+
+// AlertNotifier is where alerts go: a Slack incoming webhook, PagerDuty's
+// Events API v2 with the routing key in the environment variable
+// RoutingKeyEnv (URL defaults to PagerDuty's), or any webhook, which gets
+// the Alert as JSON. Rules, when set, limits it to those rules' alerts.
+type AlertNotifier struct {
+	Name          string   `json:"name,omitempty"`
+	Kind          string   `json:"kind"`
+	URL           string   `json:"url,omitempty"`
+	RoutingKeyEnv string   `json:"routing_key_env,omitempty"`
+	Rules         []string `json:"rules,omitempty"`
+}
+
+const pagerDutyEvents = "https://events.pagerduty.com/v2/enqueue"
+
+// defaultAlertRules are used when no rules are configured.
+var defaultAlertRules = []AlertRule{
+	{Kind: "error_rate", Threshold: 0.05},
+	{Kind: "upstream_down", Severity: "critical"},
+	{Kind: "budget", Threshold: 0.9},
+	{Kind: "queue", Threshold: 0.9},
+}
+
+func (c *AlertsConfig) validate() error {
+	if c.Interval < 0 || c.Window < 0 || c.Repeat < 0 {
+		return fmt.Errorf("alerts: interval, window and repeat must not be negative")
+	}
+	names := map[string]bool{}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		switch r.Kind {
+		case "error_rate", "budget", "queue":
+			if r.Threshold <= 0 || r.Threshold > 1 {
+				return fmt.Errorf("alerts: rules[%d]: %s needs a threshold between 0 and 1", i, r.Kind)
+			}
+		case "upstream_down":
+		default:
+			return fmt.Errorf("alerts: rules[%d]: kind must be error_rate, upstream_down, budget or queue", i)
+		}
+		switch r.Severity {
+		case "", "critical", "warning", "info":
+		default:
+			return fmt.Errorf("alerts: rules[%d]: severity must be critical, warning or info", i)
+		}
+		if r.For < 0 || r.MinRequests < 0 {
+			return fmt.Errorf("alerts: rules[%d]: for and min_requests must not be negative", i)
+		}
+		name := cmp.Or(r.Name, r.Kind)
+		if names[name] {
+			return fmt.Errorf("alerts: rule %q is defined twice", name)
+		}
+		names[name] = true
+	}
+	for i, n := range c.Notify {
+		switch n.Kind {
+		case "slack", "webhook":
+			if n.URL == "" {
+				return fmt.Errorf("alerts: notify[%d]: %s needs a url", i, n.Kind)
+			}
+		case "pagerduty":
+			if n.RoutingKeyEnv == "" || os.Getenv(n.RoutingKeyEnv) == "" {
+				return fmt.Errorf("alerts: notify[%d]: pagerduty needs routing_key_env naming a set variable", i)
+			}
+		default:
+			return fmt.Errorf("alerts: notify[%d]: kind must be slack, pagerduty or webhook", i)
+		}
+	}
+	return nil
+}
+
+// Alert is a threshold crossed, as notifiers and the admin API see it.
+// Subject is what crossed it: an upstream, a client's quota period or the
+// queue.
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Kind       string     `json:"kind"`
+	Subject    string     `json:"subject"`
+	Severity   string     `json:"severity"`
+	State      string     `json:"state"` // firing or resolved
+	Summary    string     `json:"summary"`
+	Value      float64    `json:"value"`
+	Threshold  float64    `json:"threshold,omitempty"`
+	Since      time.Time  `json:"since"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+
+	notified time.Time
+}
+
+func (a *Alert) key() string { return a.Rule + "/" + a.Subject }
+
+var (
+	alertsFiring = metrics.gauge("zai_proxy_alerts_firing", "Alerts firing now, by rule.", "rule")
+	alertsSent   = metrics.counter("zai_proxy_alert_notifications_total",
+		"Alert notifications sent, by notifier and outcome: sent or failed.", "notifier", "outcome")
+)
+
+// upstreamSample is the upstreams' request and error counts at a time.
+type upstreamSample struct {
+	at     time.Time
+	counts map[string][2]int64
+}
+
+// alerter checks the rules and notifies; nil when nothing is notified.
+type alerter struct {
+	cfg    AlertsConfig
+	rules  []AlertRule
+	proxy  *proxy
+	jobs   *jobQueue
+	client *http.Client
+
+	mu      sync.Mutex
+	samples []upstreamSample     // from an empty one at start
+	pending map[string]time.Time // conditions not yet held for their rule's For
+	active  map[string]*Alert
+}
+
+func newAlerter(cfg AlertsConfig, p *proxy, jobs *jobQueue) *alerter {
+	if len(cfg.Notify) == 0 {
+		return nil
+	}
+	rules := cfg.Rules
+	if len(rules) == 0 {
+		rules = defaultAlertRules
+	}
+	return &alerter{cfg: cfg, rules: rules, proxy: p, jobs: jobs, client: &http.Client{Timeout: 10 * time.Second},
+		samples: []upstreamSample{{at: time.Now()}}, pending: map[string]time.Time{}, active: map[string]*Alert{}}
+}
+
+// run checks the rules every interval while only reports true.
+func (a *alerter) run(ctx context.Context, only func() bool) {
+	if a == nil {
+		return
+	}
+	ticker := time.NewTicker(cmp.Or(time.Duration(a.cfg.Interval), 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if only == nil || only() {
+			a.check(ctx, time.Now())
+		}
+	}
+}
+
+// firingAlerts returns the alerts firing now, by rule and subject.
+func (a *alerter) firingAlerts() []Alert {
+	out := []Alert{}
+	if a == nil {
+		return out
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, al := range a.active {
+		out = append(out, *al)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+// check evaluates the rules once, notifying of alerts that fire, repeat
+// or resolve.
+func (a *alerter) check(ctx context.Context, now time.Time) {
+	window := a.sample(now)
+	seen := map[string]bool{}
+	var send []Alert
+	a.mu.Lock()
+	for _, rule := range a.rules {
+		for _, al := range a.conditions(ctx, rule, window, now) {
+			k := al.key()
+			seen[k] = true
+			if cur, ok := a.active[k]; ok {
+				cur.Value, cur.Summary = al.Value, al.Summary
+				if a.cfg.Repeat > 0 && now.Sub(cur.notified) >= time.Duration(a.cfg.Repeat) {
+					cur.notified = now
+					send = append(send, *cur)
+				}
+				continue
+			}
+			since, ok := a.pending[k]
+			if !ok {
+				since = now
+				a.pending[k] = now
+			}
+			if now.Sub(since) < time.Duration(rule.For) {
+				continue
+			}
+			delete(a.pending, k)
+			al.Since, al.notified = since, now
+			a.active[k] = &al
+			send = append(send, al)
+		}
+	}
+	for k := range a.pending {
+		if !seen[k] {
+			delete(a.pending, k)
+		}
+	}
+	firing := map[string]float64{}
+	for k, al := range a.active {
+		if seen[k] {
+			firing[al.Rule]++
+			continue
+		}
+		delete(a.active, k)
+		resolved := *al
+		resolved.State, resolved.ResolvedAt = "resolved", &now
+		send = append(send, resolved)
+	}
+	for _, rule := range a.rules {
+		alertsFiring.Set(firing[cmp.Or(rule.Name, rule.Kind)], cmp.Or(rule.Name, rule.Kind))
+	}
+	a.mu.Unlock()
+	for _, al := range send {
+		a.notify(ctx, al)
+	}
+}
+
+// sample records the upstreams' counts and returns, per upstream, the
+// requests and errors since the oldest sample in the window.
+func (a *alerter) sample(now time.Time) map[string][2]int64 {
+	counts := map[string][2]int64{}
+	for _, s := range a.proxy.upstreams.snapshot() {
+		counts[s.Target] = [2]int64{s.Requests, s.Errors}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	window := cmp.Or(time.Duration(a.cfg.Window), 5*time.Minute)
+	a.samples = append(a.samples, upstreamSample{at: now, counts: counts})
+	for len(a.samples) > 1 && now.Sub(a.samples[1].at) >= window {
+		a.samples = a.samples[1:]
+	}
+	oldest := a.samples[0].counts
+	delta := map[string][2]int64{}
+	for target, c := range counts {
+		o := oldest[target]
+		delta[target] = [2]int64{c[0] - o[0], c[1] - o[1]}
+	}
+	return delta
+}
+
+// conditions returns the alerts rule raises now; a.mu is held.
+func (a *alerter) conditions(ctx context.Context, rule AlertRule, window map[string][2]int64, now time.Time) []Alert {
+	alert := func(subject, summary string, value float64) Alert {
+		return Alert{Rule: cmp.Or(rule.Name, rule.Kind), Kind: rule.Kind, Subject: subject, Severity: cmp.Or(rule.Severity, "warning"),
+			State: "firing", Summary: summary, Value: value, Threshold: rule.Threshold}
+	}
+	var out []Alert
+	switch rule.Kind {
+	case "error_rate":
+		for target, c := range window {
+			if c[0] < cmp.Or(rule.MinRequests, 20) {
+				continue
+			}
+			if rate := float64(c[1]) / float64(c[0]); rate >= rule.Threshold {
+				out = append(out, alert(target, fmt.Sprintf("%s is failing %.1f%% of requests (%d of %d)", target, rate*100, c[1], c[0]), rate))
+			}
+		}
+	case "upstream_down":
+		down := map[string]bool{}
+		for member := range a.proxy.pool.circuits.opened() {
+			down[upstreamOf(member)] = true
+		}
+		for target, c := range window {
+			if c[0] >= cmp.Or(rule.MinRequests, 3) && c[1] == c[0] {
+				down[target] = true
+			}
+		}
+		for target := range down {
+			out = append(out, alert(target, target+" is down", 1))
+		}
+	case "budget":
+		for _, client := range a.budgetedClients(ctx) {
+			windows, err := a.proxy.quotas.Status(ctx, client, now)
+			if err != nil {
+				log.Printf("Error checking %s's budget for alerts: %v", client, err)
+				continue
+			}
+			for _, w := range windows {
+				used := 0.0
+				if w.MaxTokens > 0 {
+					used = float64(w.UsedTokens) / float64(w.MaxTokens)
+				}
+				if w.MaxCostUSD > 0 {
+					used = max(used, w.UsedCost/w.MaxCostUSD)
+				}
+				if used >= rule.Threshold {
+					out = append(out, alert(client+"/"+w.Period,
+						fmt.Sprintf("%s has used %.0f%% of its %s quota", client, used*100, w.Period), used))
+				}
+			}
+		}
+	case "queue":
+		if a.jobs != nil {
+			used := float64(len(a.jobs.queue)) / float64(cap(a.jobs.queue))
+			if used >= rule.Threshold {
+				out = append(out, alert("jobs", fmt.Sprintf("the job queue is %.0f%% full (%d of %d)", used*100, len(a.jobs.queue), cap(a.jobs.queue)), used))
+			}
+		}
+	}
+	return out
+}
+
+// budgetedClients returns the clients that may have quotas: those in the
+// config and those holding virtual keys.
+func (a *alerter) budgetedClients(ctx context.Context) []string {
+	var names []string
+	for name := range a.proxy.registry.clients {
+		names = append(names, name)
+	}
+	if store := a.proxy.quotas.store; store != nil {
+		keys, err := store.ListKeys(ctx)
+		if err != nil {
+			log.Printf("Error listing keys for alerts: %v", err)
+		}
+		for _, k := range keys {
+			if k.RevokedAt == nil {
+				names = append(names, k.Client)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// notify sends al to each notifier taking its rule.
+func (a *alerter) notify(ctx context.Context, al Alert) {
+	if al.State == "firing" {
+		infof("Alert %s firing: %s", al.Rule, al.Summary)
+	} else {
+		infof("Alert %s resolved: %s", al.Rule, al.Summary)
+	}
+	for _, n := range a.cfg.Notify {
+		if len(n.Rules) > 0 && !slices.Contains(n.Rules, al.Rule) {
+			continue
+		}
+		name := cmp.Or(n.Name, n.Kind)
+		if err := postJSON(ctx, a.client, cmp.Or(n.URL, pagerDutyEvents), alertPayload(n, al)); err != nil {
+			alertsSent.Add(1, name, "failed")
+			log.Printf("Error sending alert %s to %s: %v", al.Rule, name, err)
+			continue
+		}
+		alertsSent.Add(1, name, "sent")
+	}
+}
+
+// alertPayload shapes al for n's kind of receiver.
+func alertPayload(n AlertNotifier, al Alert) any {
+	switch n.Kind {
+	case "slack":
+		mark := ":rotating_light:"
+		if al.State == "resolved" {
+			mark = ":white_check_mark:"
+		}
+		return map[string]string{"text": fmt.Sprintf("%s [%s] %s: %s", mark, al.State, al.Severity, al.Summary)}
+	case "pagerduty":
+		action := "trigger"
+		if al.State == "resolved" {
+			action = "resolve"
+		}
+		source, _ := os.Hostname()
+		return map[string]any{"routing_key": os.Getenv(n.RoutingKeyEnv), "event_action": action, "dedup_key": "ringmaster/" + al.key(),
+			"payload": map[string]any{"summary": al.Summary, "source": cmp.Or(source, "ringmaster"), "severity": al.Severity,
+				"component": al.Subject, "class": al.Kind, "custom_details": al}}
+	}
+	return al
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveConfig writes every completed exchange, sanitized as captures
+// are, to Bucket on an S3-compatible store at Endpoint (path-style, so
+// MinIO and the like work too), for audit and for building datasets. A
+// streamed reply is kept reassembled, as output. Objects are named
+// prefix + date/id.json; Prefix is a template seeing client and project,
+// by default "{{ client }}/", so each tenant's archive can be granted and
+// exported alone. Credentials are read from the environment variables
+// AccessKeyEnv and SecretKeyEnv (default AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, with AWS_SESSION_TOKEN if set). Encryption asks
+// the store to encrypt them, "AES256" or "aws:kms" with KMSKeyID; with
+// SealKeyEnv naming a variable holding a base64 256-bit key they are also
+// sealed with AES-GCM before they leave, as id.json.enc. Objects older
+// than Retention are deleted, by the leader, hourly. Sample, Routes and
+// Clients narrow what is archived as for captures.
+type ArchiveConfig struct {
+	Endpoint     string         `json:"endpoint,omitempty"`
+	Bucket       string         `json:"bucket,omitempty"`
+	Region       string         `json:"region,omitempty"`
+	Prefix       promptTemplate `json:"prefix,omitempty"`
+	AccessKeyEnv string         `json:"access_key_env,omitempty"`
+	SecretKeyEnv string         `json:"secret_key_env,omitempty"`
+	Encryption   string         `json:"encryption,omitempty"`
+	KMSKeyID     string         `json:"kms_key_id,omitempty"`
+	SealKeyEnv   string         `json:"seal_key_env,omitempty"`
+	Retention    Duration       `json:"retention,omitempty"`
+	Sample       float64        `json:"sample,omitempty"`
+	Routes       []string       `json:"routes,omitempty"`
+	Clients      []string       `json:"clients,omitempty"`
+}
+
+func (c *ArchiveConfig) validate() error {
+	if c.Bucket == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("archive: endpoint must be absolute, like https://s3.us-east-1.amazonaws.com")
+	}
+	for _, env := range []string{cmp.Or(c.AccessKeyEnv, "AWS_ACCESS_KEY_ID"), cmp.Or(c.SecretKeyEnv, "AWS_SECRET_ACCESS_KEY")} {
+		if os.Getenv(env) == "" {
+			return fmt.Errorf("archive: environment variable %s is not set", env)
+		}
+	}
+	switch c.Encryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return fmt.Errorf("archive: encryption must be AES256 or aws:kms")
+	}
+	if c.SealKeyEnv != "" {
+		if _, err := c.sealKey(); err != nil {
+			return fmt.Errorf("archive: %w", err)
+		}
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("archive: sample must be between 0 and 1")
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("archive: retention must not be negative")
+	}
+	return nil
+}
+
+// sealKey returns the key objects are sealed with.
+func (c *ArchiveConfig) sealKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(os.Getenv(c.SealKeyEnv)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold a base64 256-bit key", c.SealKeyEnv)
+	}
+	return key, nil
+}
+
+// ArchiveRecord is one archived exchange.
+type ArchiveRecord struct {
+	CaptureEntry
+	Project  string `json:"project,omitempty"`
+	Agent    string `json:"agent,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"`
+	Output   string `json:"output,omitempty"` // the reply's text, a stream's reassembled
+}
+
+var (
+	archivedTotal = metrics.counter("zai_proxy_archived_total",
+		"Exchanges written to the archive, by outcome: stored, failed or dropped.", "outcome")
+	archivePruned = metrics.counter("zai_proxy_archive_pruned_total",
+		"Archived objects deleted once past the retention.")
+)
+
+// archiveSink uploads records from a queue, so the store never holds up
+// the client; when the queue is full they are dropped and counted.
+type archiveSink struct {
+	cfg   ArchiveConfig
+	s3    *s3Client
+	seal  cipher.AEAD
+	queue chan ArchiveRecord
+}
+
+func newArchiveSink(cfg ArchiveConfig) (*archiveSink, error) {
+	if cfg.Prefix.empty() {
+		cfg.Prefix.UnmarshalJSON([]byte(`"{{ client }}/"`))
+	}
+	s := &archiveSink{cfg: cfg, queue: make(chan ArchiveRecord, 256), s3: &s3Client{
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"), bucket: cfg.Bucket, region: cmp.Or(cfg.Region, "us-east-1"),
+		accessKey: os.Getenv(cmp.Or(cfg.AccessKeyEnv, "AWS_ACCESS_KEY_ID")), secretKey: os.Getenv(cmp.Or(cfg.SecretKeyEnv, "AWS_SECRET_ACCESS_KEY")),
+		token: os.Getenv("AWS_SESSION_TOKEN"), client: &http.Client{Timeout: 30 * time.Second},
+	}}
+	if cfg.SealKeyEnv != "" {
+		key, err := cfg.sealKey()
+		if err != nil {
+			return nil, err
+		}
+		block, _ := aes.NewCipher(key)
+		s.seal, _ = cipher.NewGCM(block)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *archiveSink) wants(ex *exchange) bool {
+	if len(s.cfg.Routes) > 0 && !slices.Contains(s.cfg.Routes, ex.route.Pattern) {
+		return false
+	}
+	if len(s.cfg.Clients) > 0 && !slices.Contains(s.cfg.Clients, ex.client) {
+		return false
+	}
+	return s.cfg.Sample == 0 || mrand.Float64() < s.cfg.Sample
+}
+
+func (s *archiveSink) enqueue(rec ArchiveRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		archivedTotal.Add(1, "dropped")
+	}
+}
+
+func (s *archiveSink) run() {
+	for rec := range s.queue {
+		if err := s.put(rec); err != nil {
+			archivedTotal.Add(1, "failed")
+			log.Printf("Error archiving request %s: %v", rec.ID, err)
+			continue
+		}
+		archivedTotal.Add(1, "stored")
+	}
+}
+
+// put uploads one record.
+func (s *archiveSink) put(rec ArchiveRecord) error {
+	prefix, err := s.cfg.Prefix.render(map[string]any{"client": rec.Client, "project": rec.Project})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := prefix + rec.Time.Format("2006/01/02/") + rec.ID + ".json"
+	h := http.Header{"Content-Type": {"application/json"}}
+	if s.seal != nil {
+		nonce := make([]byte, s.seal.NonceSize())
+		rand.Read(nonce)
+		body = s.seal.Seal(nonce, nonce, body, []byte(key))
+		key += ".enc"
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	if s.cfg.Encryption != "" {
+		h.Set("X-Amz-Server-Side-Encryption", s.cfg.Encryption)
+		if s.cfg.KMSKeyID != "" {
+			h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.cfg.KMSKeyID)
+		}
+	}
+	resp, err := s.s3.do(context.Background(), http.MethodPut, key, nil, body, h)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// prune deletes objects last written before cutoff, returning how many.
+// Only the part of the prefix before its first expression is listed.
+func (s *archiveSink) prune(ctx context.Context, cutoff time.Time) (int, error) {
+	listed := s.cfg.Prefix.text[0]
+	n, token := 0, ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {listed}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.s3.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return n, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return n, err
+		}
+		for _, o := range page.Contents {
+			if !o.LastModified.Before(cutoff) {
+				continue
+			}
+			resp, err := s.s3.do(ctx, http.MethodDelete, o.Key, nil, nil, nil)
+			if err != nil {
+				return n, err
+			}
+			resp.Body.Close()
+			n++
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return n, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *archiveSink) pruneLoop(ctx context.Context, only func() bool) {
+	if s.cfg.Retention == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if only == nil || only() {
+			n, err := s.prune(ctx, time.Now().Add(-time.Duration(s.cfg.Retention)))
+			archivePruned.Add(float64(n))
+			if err != nil {
+				log.Printf("Error pruning the archive: %v", err)
+			} else if n > 0 {
+				infof("Pruned %d archived exchanges older than %s", n, time.Duration(s.cfg.Retention))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// archiveStage hands completed exchanges to the archive. It sits by
+// capture and writes what capture would, the reply also as text.
+func archiveStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if p.archive == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if !p.archive.wants(ex) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ex.inspect = true
+			raw := &bodySink{limit: maxObservedBody}
+			reply := &replySink{}
+			reqHeaders := redactHeaders(r.Header)
+			start := time.Now()
+			next.ServeHTTP(teeTo(teeTo(w, raw), reply), r)
+			if ex.dryRun {
+				return
+			}
+			rec := ArchiveRecord{CaptureEntry: CaptureEntry{
+				Time: start.UTC(), ID: ex.id, Route: ex.route.Pattern, Client: ex.client,
+				Model: ex.model, Method: r.Method, URL: r.URL.RequestURI(), RequestHeaders: reqHeaders,
+				Request: captureBody(ex.body), Status: cmp.Or(raw.status, http.StatusOK),
+				ResponseHeaders: redactHeaders(w.Header()), Truncated: raw.truncated, Duration: Duration(time.Since(start)),
+			}, Project: ex.project, Agent: ex.agent, Streamed: reply.sse}
+			if ex.target != "" {
+				rec.URL = ex.target
+			}
+			if !reply.sse {
+				rec.Response = captureBody(raw.body)
+			}
+			if text, ok := reply.text(); ok {
+				rec.Output = text
+			}
+			p.archive.enqueue(rec)
+		})
+	}, nil
+}
+
+// s3Client makes path-style S3 requests signed with Signature Version 4.
+type s3Client struct {
+	endpoint, bucket, region string
+	accessKey, secretKey     string
+	token                    string
+	client                   *http.Client
+}
+
+// do sends a request for key, or for the bucket when key is "", and
+// returns the response unless it failed.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, h http.Header) (*http.Response, error) {
+	path := "/" + awsEscape(c.bucket, false)
+	if key != "" {
+		path += "/" + awsEscape(key, true)
+	}
+	u := c.endpoint + path
+	rawQuery := canonicalQuery(query)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	c.sign(req, path, rawQuery, body, time.Now().UTC())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+// sign adds the SigV4 headers to req.
+func (c *s3Client) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	creds := awsCredentials{AccessKeyID: c.accessKey, SecretAccessKey: c.secretKey, SessionToken: c.token}
+	signV4(req, creds, c.region, "s3", path, rawQuery, payload, now)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// awsEscape percent-encodes s as SigV4 wants, everything but unreserved
+// characters, and slashes too unless keepSlash.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes q sorted by key, as both the URL and the
+// signature use it.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// actorHeader names the operator behind an admin API call. The admin token
+// is shared, so this is a claim for the record, not an identity check.
+const actorHeader = "X-Ringmaster-Actor"
+
+// AuditEntry is one admin action. Each entry's Hash covers its content and
+// the previous entry's hash, so editing or dropping a line breaks the
+// chain from there on.
+type AuditEntry struct {
+	Seq    int64           `json:"seq"`
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Remote string          `json:"remote,omitempty"`
+	Source string          `json:"source"` // "api" or "cli"
+	Action string          `json:"action"`
+	Status int             `json:"status,omitempty"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	Prev   string          `json:"prev"`
+	Hash   string          `json:"hash"`
+}
+
+func (e *AuditEntry) digest() string {
+	c := *e
+	c.Hash = ""
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLog appends hash-chained entries to a JSON-lines file. A nil log or
+// one without a path records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	ips  *clientIPs // resolves callers' addresses, when serving
+}
+
+// record chains e onto the file's last entry and appends it. The tail is
+// re-read every time so a CLI writing to the same file keeps the chain
+// intact.
+func (l *auditLog) record(e AuditEntry) error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	last, err := lastLine(f)
+	if err != nil {
+		return err
+	}
+	if len(last) > 0 {
+		var prev AuditEntry
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("audit log %s: last entry: %w", l.path, err)
+		}
+		e.Seq, e.Prev = prev.Seq+1, prev.Hash
+	} else {
+		e.Seq = 1
+	}
+	e.Time = e.Time.UTC()
+	e.Hash = e.digest()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lastLine returns the final non-empty line of f.
+func lastLine(f *os.File) ([]byte, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const chunk = 64 << 10
+	var tail []byte
+	for end := st.Size(); end > 0; {
+		start := max(end-chunk, 0)
+		buf := make([]byte, end-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		if start == 0 {
+			return trimmed, nil
+		}
+		end = start
+	}
+	return nil, nil
+}
+
+// readAudit returns every entry in the file and the sequence number of the
+// first one that breaks the chain, or 0 when it is intact.
+func readAudit(path string) ([]AuditEntry, int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var out []AuditEntry
+	var broken int64
+	prev := ""
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for n := int64(1); sc.Scan(); n++ {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Seq != n || e.Prev != prev || e.digest() != e.Hash {
+			if broken == 0 {
+				broken = n
+			}
+		}
+		out = append(out, e)
+		prev = e.Hash
+	}
+	return out, broken, sc.Err()
+}
+
+// wrap audits a mutating admin handler: before snapshots the state it is
+// about to change, and the JSON the handler replies with is the after
+// state. Secrets in either are masked.
+func (l *auditLog) wrap(before func(r *http.Request) any, h http.Handler) http.Handler {
+	if l == nil || l.path == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote := r.RemoteAddr
+		if l.ips != nil {
+			remote = l.ips.resolve(r)
+		}
+		e := AuditEntry{Time: time.Now(), Actor: r.Header.Get(actorHeader), Remote: remote,
+			Source: "api", Action: r.Method + " " + r.URL.Path}
+		if e.Actor == "" {
+			e.Actor = "unknown"
+		}
+		if before != nil {
+			e.Before = auditJSON(before(r))
+		}
+		tw := &bodySink{limit: debugBodyLimit}
+		h.ServeHTTP(teeTo(w, tw), r)
+		e.Status = tw.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if json.Valid(tw.body) {
+			e.After = json.RawMessage(redactBody(tw.body))
+		}
+		if err := l.record(e); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+	})
+}
+
+// auditJSON encodes a snapshot with credential fields masked.
+func auditJSON(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(redactBody(b))
+}
+
+// cliActor names the operator running a subcommand.
+func cliActor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// runAudit implements the audit subcommand: verify checks the hash chain,
+// list prints entries as JSON lines.
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" && args[0] != "list" {
+		return fmt.Errorf("usage: %s audit verify | list [-config file] [-file audit.log]", os.Args[0])
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("audit "+sub, flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file naming the audit log")
+	file := fs.String("file", "", "audit log, overriding the config")
+	fs.Parse(args[1:])
+	path := *file
+	if path == "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		path = cfg.Admin.Audit
+	}
+	if path == "" {
+		return fmt.Errorf("no audit log configured")
+	}
+	entries, broken, err := readAudit(path)
+	if err != nil {
+		return err
+	}
+	if sub == "list" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+	}
+	if broken != 0 {
+		return fmt.Errorf("%s: chain broken at entry %d of %d", path, broken, len(entries))
+	}
+	if sub == "verify" {
+		fmt.Printf("%s: %d entries, chain intact\n", path, len(entries))
+	}
+	return nil
+}
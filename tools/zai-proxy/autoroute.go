@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AutoRouteConfig picks the model for requests that ask for Model (default
+// "auto"). Each request is classified by its prompt tokens, whether it
+// offers tools and the quality it asks for ("quality" in the body or the
+// X-Ringmaster-Quality header: low, medium or high), and goes to the
+// cheapest of the Models that can serve it, priced from the price table
+// for the prompt and max_tokens. An unstreamed answer that fails, is
+// empty, refuses, or averages a token logprob below MinLogprob is retried
+// on the next cheapest, at most Escalations (default 2) times.
+type AutoRouteConfig struct {
+	Model       string       `json:"model,omitempty"`
+	Models      []AutoTarget `json:"models,omitempty"`
+	Escalations int          `json:"escalations,omitempty"`
+	MinLogprob  float64      `json:"min_logprob,omitempty"`
+}
+
+// AutoTarget is a model the router may choose. MaxPromptTokens, when set,
+// is the longest prompt it takes; Tools says it handles tool calls;
+// Quality is the highest tier it serves, 1 to 3 (default 1, low).
+type AutoTarget struct {
+	Model           string `json:"model"`
+	MaxPromptTokens int64  `json:"max_prompt_tokens,omitempty"`
+	Tools           bool   `json:"tools,omitempty"`
+	Quality         int    `json:"quality,omitempty"`
+}
+
+const qualityHeader = "X-Ringmaster-Quality"
+
+func (c *AutoRouteConfig) validate() error {
+	for _, t := range c.Models {
+		if t.Model == "" {
+			return fmt.Errorf("auto_route: every model needs a name")
+		}
+		if t.Quality < 0 || t.Quality > 3 || t.MaxPromptTokens < 0 {
+			return fmt.Errorf("auto_route %s: quality must be 1 to 3 and max_prompt_tokens not negative", t.Model)
+		}
+	}
+	if c.Escalations < 0 {
+		return fmt.Errorf("auto_route: escalations must not be negative")
+	}
+	return nil
+}
+
+var qualityTiers = map[string]int{"low": 1, "medium": 2, "high": 3}
+
+// parseQuality reads a quality tier by name or number; empty is low.
+func parseQuality(s string) (int, error) {
+	if s == "" {
+		return 1, nil
+	}
+	if q, ok := qualityTiers[strings.ToLower(s)]; ok {
+		return q, nil
+	}
+	if q, err := strconv.Atoi(s); err == nil && q >= 1 && q <= 3 {
+		return q, nil
+	}
+	return 0, fmt.Errorf("quality must be low, medium or high")
+}
+
+// candidates returns the targets able to serve req at quality, cheapest
+// first.
+func (c *AutoRouteConfig) candidates(prices PriceTable, req *chatRequest, quality int) []string {
+	prompt := estimatePromptTokens(req)
+	tools := len(req.Tools) > 0 && string(req.Tools) != "null"
+	type cand struct {
+		model string
+		cost  float64
+	}
+	var out []cand
+	for _, t := range c.Models {
+		if t.MaxPromptTokens > 0 && prompt > t.MaxPromptTokens || tools && !t.Tools || max(t.Quality, 1) < quality {
+			continue
+		}
+		out = append(out, cand{t.Model, prices.Cost(t.Model, Usage{PromptTokens: prompt, CompletionTokens: req.MaxTokens})})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].cost < out[j].cost })
+	models := make([]string, len(out))
+	for i, c := range out {
+		models[i] = c.model
+	}
+	return models
+}
+
+// autoRouteStage chooses the model for auto requests once transform has
+// parsed the body, and escalates unsatisfying answers. Answers it
+// discards are accounted here, as observe only sees the one sent.
+func autoRouteStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	ac := &p.cfg.AutoRoute
+	alias := ac.Model
+	if alias == "" {
+		alias = "auto"
+	}
+	escalations := ac.Escalations
+	if escalations == 0 {
+		escalations = 2
+	}
+	return func(next http.Handler) http.Handler {
+		if len(ac.Models) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if ex.doc == nil || ex.model != alias {
+				next.ServeHTTP(w, r)
+				return
+			}
+			quality, err := parseQuality(r.Header.Get(qualityHeader))
+			if q, ok := ex.doc["quality"].(string); ok {
+				quality, err = parseQuality(q)
+				delete(ex.doc, "quality")
+				ex.dirty = true
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			var req chatRequest
+			if b, err := encodeJSON(ex.doc); err == nil {
+				json.Unmarshal(b, &req)
+			}
+			models := ac.candidates(p.cfg.Pricing, &req, quality)
+			if len(models) == 0 {
+				writeError(w, http.StatusBadRequest, "no_model", "no auto_route model serves this request's prompt length, tools and quality")
+				return
+			}
+			r.Header.Del(qualityHeader)
+			models = models[:min(len(models), escalations+1)]
+			for i, model := range models {
+				ex.model, ex.doc["model"], ex.dirty = model, model, true
+				w.Header().Set("X-Ringmaster-Model", model)
+				w.Header().Set("X-Ringmaster-Escalations", strconv.Itoa(i))
+				if req.Stream || i == len(models)-1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				held := &heldResponse{w: w, h: http.Header{}}
+				next.ServeHTTP(held, r)
+				if held.sent || !ac.unsatisfying(held) {
+					held.sendTo(w)
+					return
+				}
+				infof("Auto route escalating request %s from %s", ex.id, model)
+				o := newUsageObserver(held.h.Get("Content-Type"))
+				o.Write(held.body.Bytes())
+				_, u, _ := o.Finish()
+				p.record(ex, held.status, model, u)
+			}
+		})
+	}, nil
+}
+
+// unsatisfying reports whether an answer should be retried on a better
+// model.
+func (c *AutoRouteConfig) unsatisfying(h *heldResponse) bool {
+	if h.status == http.StatusTooManyRequests || h.status >= 500 {
+		return true
+	}
+	if h.status >= 300 {
+		return false
+	}
+	v, err := decodeJSON(h.body.Bytes())
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return false
+	}
+	text := responseText(doc)
+	if strings.TrimSpace(text) == "" && finishReason(doc) != "tool_calls" && finishReason(doc) != "tool_use" {
+		return true
+	}
+	if refusalStart.MatchString(text) {
+		return true
+	}
+	if lp, ok := meanLogprob(doc); ok && c.MinLogprob < 0 && lp < c.MinLogprob {
+		return true
+	}
+	return false
+}
+
+// heldResponse keeps an answer until the router decides to send it. One
+// too large to hold is sent to w as it comes and can't be escalated; its
+// header is then w's, so trailers set after the body reach the client.
+type heldResponse struct {
+	w      http.ResponseWriter
+	h      http.Header
+	status int
+	body   bytes.Buffer
+	sent   bool
+}
+
+func (h *heldResponse) Header() http.Header {
+	if h.sent {
+		return h.w.Header()
+	}
+	return h.h
+}
+
+func (h *heldResponse) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *heldResponse) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	if !h.sent && h.body.Len()+len(b) > maxObservedBody {
+		h.sendTo(h.w)
+	}
+	if h.sent {
+		return h.w.Write(b)
+	}
+	return h.body.Write(b)
+}
+
+func (h *heldResponse) sendTo(w http.ResponseWriter) {
+	if h.sent {
+		return
+	}
+	h.sent = true
+	for k, vs := range h.h {
+		w.Header()[k] = vs
+	}
+	holdTrailers(w.Header())
+	w.WriteHeader(max(h.status, http.StatusOK))
+	w.Write(h.body.Bytes())
+	h.body.Reset()
+}
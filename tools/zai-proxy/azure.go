@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// AzureConfig makes an upstream an Azure OpenAI resource. Requests are
+// sent to the deployment Deployments maps their model to, the "*" entry
+// for models it doesn't list, else one named after the model, as
+// /openai/deployments/<deployment>/chat/completions and so on, carrying
+// APIVersion (default 2024-10-21) unless they name one. Endpoints without
+// a model, such as files and batches, go under /openai. Without its own
+// auth the upstream is sent AZURE_OPENAI_API_KEY in the api-key header.
+type AzureConfig struct {
+	APIVersion  string            `json:"api_version,omitempty"`
+	Deployments map[string]string `json:"deployments,omitempty"`
+}
+
+const azureAPIVersion = "2024-10-21"
+
+// azureKeyAuth is an Azure upstream's auth when it configures none.
+var azureKeyAuth = UpstreamAuth{Scheme: "header", Header: "api-key", KeyEnv: "AZURE_OPENAI_API_KEY"}
+
+// azureDeploymentPaths are the endpoints Azure serves per deployment.
+var azureDeploymentPaths = []string{"/chat/completions", "/completions", "/embeddings", "/audio/transcriptions",
+	"/audio/translations", "/audio/speech", "/images/generations", "/images/edits"}
+
+func (c *AzureConfig) validate(auth *UpstreamAuth) error {
+	for model, d := range c.Deployments {
+		if d == "" || strings.ContainsAny(d, "/?#") {
+			return fmt.Errorf("deployments: %s: %q is not a deployment name", model, d)
+		}
+	}
+	if auth == nil && os.Getenv("AZURE_OPENAI_API_KEY") == "" {
+		return fmt.Errorf("set auth or AZURE_OPENAI_API_KEY")
+	}
+	return nil
+}
+
+// deployment is the deployment serving model.
+func (c *AzureConfig) deployment(model string) string {
+	if d, ok := c.Deployments[model]; ok {
+		return d
+	}
+	if d, ok := c.Deployments["*"]; ok {
+		return d
+	}
+	return model
+}
+
+// rewrite turns req, sent to target under base, into Azure's form for
+// model: the OpenAI path, less any /v1, under /openai/deployments/<name>
+// or /openai, with an api-version.
+func (c *AzureConfig) rewrite(req *http.Request, base, target, model string) error {
+	rest := strings.TrimPrefix(target, strings.TrimSuffix(base, "/"))
+	path, query, _ := strings.Cut(rest, "?")
+	path = strings.TrimPrefix(path, "/v1")
+	if !strings.HasPrefix(path, "/openai/") {
+		prefix := "/openai"
+		for _, p := range azureDeploymentPaths {
+			if path == p {
+				if d := c.deployment(model); d != "" {
+					prefix += "/deployments/" + url.PathEscape(d)
+				}
+				break
+			}
+		}
+		path = prefix + path
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	if q.Get("api-version") == "" {
+		q.Set("api-version", cmp.Or(c.APIVersion, azureAPIVersion))
+	}
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + path + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	req.URL, req.Host = u, u.Host
+	return nil
+}
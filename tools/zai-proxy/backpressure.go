@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// The relay copies a response through one pooled buffer and blocks on the
+// client's socket, so a client reading slower than the model generates
+// slows the upstream reads instead of growing a queue in the proxy; stages
+// that hold data back bound what they hold. stallWriter makes the waits
+// visible and, with ForwardConfig.StallTimeout, gives up on clients that
+// stop reading so their upstream streams are released.
+
+var (
+	streamStallsTotal = metrics.counter("zai_proxy_stream_stalls_total",
+		"Response writes that blocked on the client for longer than the stall threshold.", "route")
+	streamStallSeconds = metrics.counter("zai_proxy_stream_stall_seconds_total",
+		"Time response writes spent blocked on slow clients beyond the stall threshold.", "route")
+	streamStallAborts = metrics.counter("zai_proxy_stream_stall_aborts_total",
+		"Responses abandoned because the client stopped reading.", "route")
+)
+
+type stallWriter struct {
+	http.ResponseWriter
+	rc        *http.ResponseController
+	route     string
+	threshold time.Duration
+	timeout   time.Duration
+}
+
+func newStallWriter(w http.ResponseWriter, route string, cfg ForwardConfig) *stallWriter {
+	threshold := time.Duration(cfg.StallThreshold)
+	if threshold == 0 {
+		threshold = time.Second
+	}
+	return &stallWriter{ResponseWriter: w, rc: http.NewResponseController(w), route: route,
+		threshold: threshold, timeout: time.Duration(cfg.StallTimeout)}
+}
+
+// wait runs a write that may block on the client and accounts for it.
+func (w *stallWriter) wait(write func() error) error {
+	start := time.Now()
+	if w.timeout > 0 {
+		w.rc.SetWriteDeadline(start.Add(w.timeout))
+	}
+	err := write()
+	d := time.Since(start)
+	if d > w.threshold {
+		streamStallsTotal.Add(1, w.route)
+		streamStallSeconds.Add((d - w.threshold).Seconds(), w.route)
+	}
+	// Flush errors are lost in the stages' writers; a write that lasted
+	// the timeout hit the deadline.
+	if w.timeout > 0 && d >= w.timeout {
+		streamStallAborts.Add(1, w.route)
+		debugf("Abandoned response on %s: client stopped reading for %s", w.route, w.timeout)
+	}
+	return err
+}
+
+func (w *stallWriter) Write(b []byte) (n int, err error) {
+	w.wait(func() error {
+		n, err = w.ResponseWriter.Write(b)
+		return err
+	})
+	return n, err
+}
+
+func (w *stallWriter) Flush() {
+	w.wait(func() error {
+		if err := w.rc.Flush(); err != http.ErrNotSupported {
+			return err
+		}
+		return nil
+	})
+}
+
+func (w *stallWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish clears the write deadline for whatever the connection serves next.
+func (w *stallWriter) finish() {
+	if w.timeout > 0 {
+		w.rc.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchConfig runs /v1/batches: many requests sent with bounded
+// concurrency, their results collected into a JSONL file shaped like
+// OpenAI's batch output. Concurrency is the default per batch (4) and Max
+// its ceiling (16). A 429 pauses the whole batch for its Retry-After and
+// the request is retried, up to Retries (default 5) times. With Dir set,
+// batches and results are kept on disk; otherwise in memory.
+type BatchConfig struct {
+	Dir         string `json:"dir,omitempty"`
+	Concurrency int    `json:"concurrency,omitempty"`
+	Max         int    `json:"max,omitempty"`
+	Retries     int    `json:"retries,omitempty"`
+	MaxRequests int    `json:"max_requests,omitempty"`
+}
+
+const batchesPath = "/v1/batches"
+
+func (c *BatchConfig) validate() error {
+	if c.Concurrency < 0 || c.Max < 0 || c.Retries < 0 || c.MaxRequests < 0 {
+		return fmt.Errorf("batches: concurrency, max, retries and max_requests must not be negative")
+	}
+	return nil
+}
+
+// BatchLine is one request of a batch, as in an OpenAI batch input file.
+// URL is the API path; Method must be POST if set.
+type BatchLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// BatchRequest submits a batch as JSON. A body of JSON lines
+// (application/jsonl or application/x-ndjson) submits the lines alone.
+type BatchRequest struct {
+	Requests    []BatchLine `json:"requests"`
+	Concurrency int         `json:"concurrency,omitempty"`
+	Webhook     string      `json:"webhook,omitempty"`
+}
+
+// BatchResult is one line of a batch's results.
+type BatchResult struct {
+	ID       string         `json:"id"`
+	CustomID string         `json:"custom_id"`
+	Response *BatchResponse `json:"response"`
+	Error    *BatchError    `json:"error"`
+}
+
+// BatchResponse is the upstream's answer to one batch request.
+type BatchResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// BatchError is why a batch request got no response.
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchCounts tallies a batch's requests.
+type BatchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Batch is a submitted batch.
+type Batch struct {
+	ID          string      `json:"id"`
+	Client      string      `json:"client"`
+	Status      string      `json:"status"` // in_progress, completed, cancelling, cancelled or failed
+	Concurrency int         `json:"concurrency"`
+	Webhook     string      `json:"webhook,omitempty"`
+	Created     time.Time   `json:"created"`
+	Finished    *time.Time  `json:"finished,omitempty"`
+	Counts      BatchCounts `json:"request_counts"`
+	Error       string      `json:"error,omitempty"`
+	ResultsURL  string      `json:"results_url"`
+}
+
+func (b *Batch) done() bool {
+	return b.Status == "completed" || b.Status == "cancelled" || b.Status == "failed"
+}
+
+var batchRequests = metrics.counter("zai_proxy_batch_requests_total",
+	"Batch requests sent, by outcome.", "outcome")
+
+type batchState struct {
+	Batch
+	lines   []BatchLine
+	header  http.Header
+	cancel  context.CancelFunc
+	results bytes.Buffer // when there is no Dir
+	pause   time.Time    // no requests are sent before this
+}
+
+// batchRunner holds the batches and runs them through the proxy's own
+// handlers with the submitter's headers.
+type batchRunner struct {
+	cfg    BatchConfig
+	mux    *http.ServeMux
+	client *http.Client
+	// validation checks submitted requests before any is sent.
+	validation ValidationConfig
+
+	mu      sync.Mutex
+	batches map[string]*batchState
+}
+
+func newBatchRunner(cfg BatchConfig, mux *http.ServeMux) *batchRunner {
+	cfg.Concurrency = cmp.Or(cfg.Concurrency, 4)
+	cfg.Max = cmp.Or(cfg.Max, 16)
+	cfg.Retries = cmp.Or(cfg.Retries, 5)
+	cfg.MaxRequests = cmp.Or(cfg.MaxRequests, 50000)
+	b := &batchRunner{cfg: cfg, mux: mux, client: &http.Client{Timeout: 30 * time.Second}, batches: map[string]*batchState{}}
+	b.load()
+	return b
+}
+
+// load reads the batches written before a restart; any still running are
+// failed, as their credentials were never written.
+func (br *batchRunner) load() {
+	if br.cfg.Dir == "" {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(br.cfg.Dir, "*.json"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s := &batchState{}
+		if json.Unmarshal(data, &s.Batch) != nil || s.ID == "" {
+			continue
+		}
+		if !s.done() {
+			now := time.Now().UTC()
+			s.Status, s.Error, s.Finished = "failed", "interrupted by a proxy restart", &now
+			br.save(s)
+		}
+		br.batches[s.ID] = s
+	}
+}
+
+func (br *batchRunner) save(s *batchState) {
+	if br.cfg.Dir == "" {
+		return
+	}
+	b, err := json.Marshal(s.Batch)
+	if err == nil {
+		err = os.MkdirAll(br.cfg.Dir, 0o700)
+	}
+	if err == nil {
+		path := filepath.Join(br.cfg.Dir, s.ID+".json")
+		if err = os.WriteFile(path+".tmp", b, 0o600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing batch %s: %v", s.ID, err)
+	}
+}
+
+// parseBatch reads a JSON batch or JSON lines.
+func parseBatch(r *http.Request, body []byte) (BatchRequest, error) {
+	var req BatchRequest
+	ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if ct == "application/jsonl" || ct == "application/x-ndjson" {
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		sc.Buffer(make([]byte, 64<<10), len(body)+1)
+		for n := 1; sc.Scan(); n++ {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			var l BatchLine
+			if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+				return req, fmt.Errorf("line %d: %w", n, err)
+			}
+			req.Requests = append(req.Requests, l)
+		}
+		req.Concurrency, _ = strconv.Atoi(r.URL.Query().Get("concurrency"))
+		req.Webhook = r.URL.Query().Get("webhook")
+		return req, sc.Err()
+	}
+	err := json.Unmarshal(body, &req)
+	return req, err
+}
+
+func (br *batchRunner) submit(client string, req BatchRequest, header http.Header) (*Batch, error) {
+	if len(req.Requests) == 0 || len(req.Requests) > br.cfg.MaxRequests {
+		return nil, fmt.Errorf("a batch needs between 1 and %d requests", br.cfg.MaxRequests)
+	}
+	seen := map[string]bool{}
+	for i := range req.Requests {
+		l := &req.Requests[i]
+		l.URL = cmp.Or(l.URL, "/v1/chat/completions")
+		if l.CustomID == "" || seen[l.CustomID] {
+			return nil, fmt.Errorf("request %d: custom_id must be set and unique", i+1)
+		}
+		seen[l.CustomID] = true
+		if l.Method != "" && l.Method != http.MethodPost {
+			return nil, fmt.Errorf("request %s: method must be POST", l.CustomID)
+		}
+		if !strings.HasPrefix(l.URL, "/v1/") || strings.HasPrefix(l.URL, batchesPath) || strings.HasPrefix(l.URL, jobsPath) {
+			return nil, fmt.Errorf("request %s: url must be an API path under /v1/", l.CustomID)
+		}
+		v, err := decodeJSON(l.Body)
+		if _, ok := v.(map[string]any); err != nil || !ok {
+			return nil, fmt.Errorf("request %s: body must be a JSON object", l.CustomID)
+		}
+	}
+	header = header.Clone()
+	for _, h := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Accept-Encoding"} {
+		header.Del(h)
+	}
+	id := "batch_" + newRequestID()
+	s := &batchState{Batch: Batch{ID: id, Client: client, Status: "in_progress",
+		Concurrency: min(cmp.Or(req.Concurrency, br.cfg.Concurrency), br.cfg.Max), Webhook: req.Webhook,
+		Created: time.Now().UTC(), Counts: BatchCounts{Total: len(req.Requests)},
+		ResultsURL: batchesPath + "/" + id + "/results"}, lines: req.Requests, header: header}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	br.mu.Lock()
+	br.batches[id] = s
+	br.save(s)
+	out := s.Batch
+	br.mu.Unlock()
+	go br.run(ctx, s)
+	return &out, nil
+}
+
+func (br *batchRunner) run(ctx context.Context, s *batchState) {
+	var results *os.File
+	if br.cfg.Dir != "" {
+		f, err := os.OpenFile(filepath.Join(br.cfg.Dir, s.ID+".jsonl"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			log.Printf("Error opening batch results: %v", err)
+			br.finish(s, "failed", err.Error())
+			return
+		}
+		defer f.Close()
+		results = f
+	}
+	lines := make(chan BatchLine)
+	var wg sync.WaitGroup
+	for range s.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lines {
+				res := br.send(ctx, s, l)
+				b, _ := json.Marshal(res)
+				br.mu.Lock()
+				if res.Error == nil && res.Response.StatusCode < 400 {
+					s.Counts.Completed++
+				} else {
+					s.Counts.Failed++
+				}
+				if results != nil {
+					results.Write(append(b, '\n'))
+				} else {
+					s.results.Write(append(b, '\n'))
+				}
+				br.mu.Unlock()
+			}
+		}()
+	}
+	for _, l := range s.lines {
+		select {
+		case lines <- l:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(lines)
+	wg.Wait()
+	status := "completed"
+	if ctx.Err() != nil {
+		status = "cancelled"
+	}
+	br.finish(s, status, "")
+}
+
+// send runs one request, waiting out rate limits.
+func (br *batchRunner) send(ctx context.Context, s *batchState, l BatchLine) BatchResult {
+	res := BatchResult{ID: "req_" + newRequestID(), CustomID: l.CustomID}
+	v, _ := decodeJSON(l.Body)
+	doc, _ := v.(map[string]any)
+	model, _ := doc["model"].(string)
+	doc["stream"] = false
+	for attempt := 0; ; attempt++ {
+		br.mu.Lock()
+		wait := time.Until(s.pause)
+		br.mu.Unlock()
+		if sleepCtx(ctx, wait) != nil {
+			res.Error = &BatchError{Code: "batch_cancelled", Message: "the batch was cancelled"}
+			batchRequests.Add(1, "cancelled")
+			return res
+		}
+		r, _ := http.NewRequestWithContext(ctx, http.MethodPost, l.URL, nil)
+		r.Header, r.RemoteAddr = s.header, "127.0.0.1:0"
+		rec := fanoutOne(br.mux, r, l.URL, doc, 0, model, nil)
+		if rec.Status == http.StatusTooManyRequests && attempt < br.cfg.Retries {
+			d := retryAfter(rec.header, 2*time.Second<<attempt)
+			br.mu.Lock()
+			if t := time.Now().Add(d); t.After(s.pause) {
+				s.pause = t
+			}
+			br.mu.Unlock()
+			batchRequests.Add(1, "rate_limited")
+			continue
+		}
+		if rec.Error != "" && rec.Response == nil {
+			res.Error = &BatchError{Code: "request_failed", Message: rec.Error}
+			batchRequests.Add(1, "failed")
+			return res
+		}
+		res.Response = &BatchResponse{StatusCode: rec.Status, Body: rec.Response}
+		batchRequests.Add(1, map[bool]string{true: "succeeded", false: "failed"}[rec.Status < 400])
+		return res
+	}
+}
+
+// retryAfter reads a 429's Retry-After in seconds, defaulting to def, at
+// most a minute.
+func retryAfter(h http.Header, def time.Duration) time.Duration {
+	if n, err := strconv.Atoi(h.Get("Retry-After")); err == nil && n >= 0 {
+		def = time.Duration(n) * time.Second
+	}
+	return min(def, time.Minute)
+}
+
+func (br *batchRunner) finish(s *batchState, status, msg string) {
+	br.mu.Lock()
+	now := time.Now().UTC()
+	s.Status, s.Error, s.Finished = status, msg, &now
+	s.lines, s.header = nil, nil
+	br.save(s)
+	out := s.Batch
+	br.mu.Unlock()
+	infof("Batch %s %s: %d completed, %d failed of %d", out.ID, status, out.Counts.Completed, out.Counts.Failed, out.Counts.Total)
+	if out.Webhook != "" {
+		if err := postJSON(context.Background(), br.client, out.Webhook, out); err != nil {
+			log.Printf("Error delivering batch %s to its webhook: %v", out.ID, err)
+		}
+	}
+}
+
+func (br *batchRunner) get(client, id string) (*batchState, bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	s := br.batches[id]
+	return s, s != nil && s.Client == client
+}
+
+var errBatchNotFound = errors.New("no such batch")
+
+// batchesHandler serves submit, list, status, results and cancel for the
+// calling client's batches.
+func batchesHandler(br *batchRunner, self func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := self(r)
+		id := r.PathValue("id")
+		if r.Method == http.MethodPost {
+			body, err := readLimited(w, r)
+			if err != nil {
+				return
+			}
+			req, err := parseBatch(r, body)
+			if verr := br.validation.checkBatch(r, body, req); verr != nil {
+				writeSchemaError(w, verr)
+				return
+			}
+			if err == nil {
+				var b *Batch
+				if b, err = br.submit(client, req, r.Header); err == nil {
+					w.Header().Set("Location", batchesPath+"/"+b.ID)
+					writeJSON(w, http.StatusAccepted, b)
+					return
+				}
+			}
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if id == "" {
+			br.mu.Lock()
+			out := []Batch{}
+			for _, s := range br.batches {
+				if s.Client == client {
+					out = append(out, s.Batch)
+				}
+			}
+			br.mu.Unlock()
+			sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+			writeJSON(w, http.StatusOK, map[string]any{"batches": out})
+			return
+		}
+		s, ok := br.get(client, id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", errBatchNotFound.Error())
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			br.mu.Lock()
+			if !s.done() {
+				s.Status = "cancelling"
+				s.cancel()
+			}
+			br.mu.Unlock()
+		case strings.HasSuffix(r.URL.Path, "/results"):
+			// Finished results can be fetched in ranges, and resumed while they
+			// haven't changed.
+			var modified time.Time
+			br.mu.Lock()
+			data := append([]byte(nil), s.results.Bytes()...)
+			if s.Finished != nil {
+				modified = *s.Finished
+			}
+			br.mu.Unlock()
+			w.Header().Set("Content-Type", "application/jsonl")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.jsonl"`)
+			if br.cfg.Dir != "" {
+				http.ServeFile(w, r, filepath.Join(br.cfg.Dir, id+".jsonl"))
+				return
+			}
+			http.ServeContent(w, r, id+".jsonl", modified, bytes.NewReader(data))
+			return
+		}
+		br.mu.Lock()
+		out := s.Batch
+		br.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// readLimited reads a request body up to the buffered body cap, answering
+// the client itself when it can't.
+func readLimited(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxBufferedBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the proxy limit")
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid_request", "reading request body failed")
+		}
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+// hotPath are the benchmarks of the proxy's per-request work. The bench
+// command runs them in process and go test runs them as BenchmarkHotPath,
+// so the two report the same numbers.
+var hotPath = []struct {
+	name string
+	fn   func(b *testing.B)
+}{
+	{"headers", benchHeaderCopy},
+	{"relay_sse", benchRelaySSE},
+	{"usage_sse", benchUsageSSE},
+	{"rewrite_request", benchRewriteRequest},
+	{"rewrite_sse", benchRewriteSSE},
+}
+
+// benchStream is a chat completion stream of n content events and a
+// usage event.
+func benchStream(n int) []byte {
+	var b bytes.Buffer
+	for i := range n {
+		fmt.Fprintf(&b, "data: {\"id\":\"c1\",\"model\":\"glm-4.6\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"token %d \"}}]}\n\n", i)
+	}
+	b.WriteString("data: {\"id\":\"c1\",\"model\":\"glm-4.6\",\"choices\":[],\"usage\":{\"prompt_tokens\":120,\"completion_tokens\":500}}\n\ndata: [DONE]\n\n")
+	return b.Bytes()
+}
+
+var benchRequest = []byte(`{"model":"glm-4.6","stream":true,"max_tokens":1024,"messages":[` +
+	`{"role":"system","content":"You are a careful coding agent."},` +
+	`{"role":"user","content":"Refactor the parser so errors carry line numbers."}]}`)
+
+// discardWriter is a ResponseWriter that keeps nothing.
+type discardWriter struct{ h http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Flush()                      {}
+
+func benchHeaderCopy(b *testing.B) {
+	p := &proxy{cfg: &Config{}, apiKey: "upstream-key", pool: newUpstreamPool(nil, nil), ips: newClientIPs(&ClientIPConfig{})}
+	r, _ := http.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	for _, h := range []string{"Content-Type", "Accept", "User-Agent", "X-Request-Id", "Authorization",
+		"Anthropic-Version", "Accept-Encoding", "X-Stainless-Lang", "X-Stainless-Os", "X-Stainless-Runtime"} {
+		r.Header.Set(h, "value-of-"+strings.ToLower(h))
+	}
+	ex := &exchange{target: "https://api.z.ai/api/paas/v4/chat/completions", body: benchRequest}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.upstreamRequest(r, ex); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchRelaySSE relays a stream through the reverse proxy as forward does,
+// with the upstream answered from memory.
+func benchRelaySSE(b *testing.B) {
+	stream := benchStream(500)
+	p := &proxy{cfg: defaultConfig()}
+	p.relay = p.reverseProxy(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, ContentLength: -1,
+			Header: http.Header{"Content-Type": {"text/event-stream"}}, Request: req,
+			Body: io.NopCloser(bytes.NewReader(stream))}, nil
+	}))
+	rc := &RouteConfig{Pattern: "/"}
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ex := &exchange{route: rc}
+		req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), exchangeKey{}, ex),
+			http.MethodPost, "http://upstream.invalid/v1/chat/completions", nil)
+		w := newStallWriter(&discardWriter{h: http.Header{}}, rc.Pattern, p.cfg.Forward)
+		p.relay.ServeHTTP(&eventFlusher{ResponseWriter: w, boundary: true}, req)
+	}
+}
+
+func benchUsageSSE(b *testing.B) {
+	stream := benchStream(500)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		o := newUsageObserver("text/event-stream")
+		for rest := stream; len(rest) > 0; {
+			n := min(len(rest), 4096)
+			o.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if _, u, _ := o.Finish(); u.CompletionTokens != 500 {
+			b.Fatalf("parsed %d completion tokens, want 500", u.CompletionTokens)
+		}
+	}
+}
+
+func benchRewriteRequest(b *testing.B) {
+	prompts := []SystemPrompt{{Text: "Follow the operator policy."}}
+	b.SetBytes(int64(len(benchRequest)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		v, err := decodeJSON(benchRequest)
+		if err != nil {
+			b.Fatal(err)
+		}
+		doc := v.(map[string]any)
+		injectSystemPrompts(doc, false, "bench", "glm-4.6", prompts)
+		if _, err := encodeJSON(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchRewriteSSE(b *testing.B) {
+	stream := benchStream(500)
+	edit := eventEditor(func(doc map[string]any) (map[string]any, bool) {
+		doc["model"] = "ringmaster"
+		return doc, true
+	})
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := &discardWriter{h: http.Header{"Content-Type": {"text/event-stream"}}}
+		sw := &sseWriter{ResponseWriter: w, line: edit}
+		for rest := stream; len(rest) > 0; {
+			n := min(len(rest), 4096)
+			sw.Write(rest[:n])
+			rest = rest[n:]
+		}
+		sw.finish()
+	}
+}
+
+// BenchResult is one benchmark's outcome as the bench command saves it.
+type BenchResult struct {
+	Name        string  `json:"name"`
+	NsPerOp     float64 `json:"ns_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	MBPerSec    float64 `json:"mb_per_sec,omitempty"`
+}
+
+// runBench implements the bench subcommand: it runs the hot path
+// benchmarks, optionally saves the results, and with -compare prints the
+// change against an earlier run's.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	run := fs.String("run", "", "only run benchmarks matching this regexp")
+	out := fs.String("o", "", "save the results as JSON to this file")
+	compare := fs.String("compare", "", "results file of an earlier run to compare with")
+	fs.Parse(args)
+	match, err := regexp.Compile(*run)
+	if err != nil {
+		return fmt.Errorf("-run: %w", err)
+	}
+	var before map[string]BenchResult
+	if *compare != "" {
+		b, err := os.ReadFile(*compare)
+		if err != nil {
+			return err
+		}
+		var old []BenchResult
+		if err := json.Unmarshal(b, &old); err != nil {
+			return fmt.Errorf("%s: %w", *compare, err)
+		}
+		before = map[string]BenchResult{}
+		for _, r := range old {
+			before[r.Name] = r
+		}
+	}
+
+	var results []BenchResult
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if before != nil {
+		fmt.Fprintln(tw, "BENCHMARK\tOLD NS/OP\tNEW NS/OP\tDELTA\tOLD ALLOCS\tNEW ALLOCS")
+	} else {
+		fmt.Fprintln(tw, "BENCHMARK\tNS/OP\tB/OP\tALLOCS/OP\tMB/S")
+	}
+	for _, bm := range hotPath {
+		if !match.MatchString(bm.name) {
+			continue
+		}
+		r := testing.Benchmark(bm.fn)
+		res := BenchResult{Name: bm.name, NsPerOp: float64(r.T.Nanoseconds()) / float64(r.N),
+			BytesPerOp: r.AllocedBytesPerOp(), AllocsPerOp: r.AllocsPerOp()}
+		if r.Bytes > 0 && r.T > 0 {
+			res.MBPerSec = float64(r.Bytes) * float64(r.N) / 1e6 / r.T.Seconds()
+		}
+		results = append(results, res)
+		if old, ok := before[bm.name]; ok {
+			fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%+.1f%%\t%d\t%d\n", bm.name, old.NsPerOp, res.NsPerOp,
+				(res.NsPerOp-old.NsPerOp)/old.NsPerOp*100, old.AllocsPerOp, res.AllocsPerOp)
+		} else if before != nil {
+			fmt.Fprintf(tw, "%s\t-\t%.0f\t-\t-\t%d\n", bm.name, res.NsPerOp, res.AllocsPerOp)
+		} else {
+			mbs := "-"
+			if res.MBPerSec > 0 {
+				mbs = fmt.Sprintf("%.1f", res.MBPerSec)
+			}
+			fmt.Fprintf(tw, "%s\t%.0f\t%d\t%d\t%s\n", bm.name, res.NsPerOp, res.BytesPerOp, res.AllocsPerOp, mbs)
+		}
+	}
+	tw.Flush()
+	if *out != "" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*out, append(b, '\n'), 0o644)
+	}
+	return nil
+}
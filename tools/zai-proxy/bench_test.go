@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+// BenchmarkHotPath runs the bench command's suite under go test:
+//
+//	go test -run '^$' -bench HotPath -benchmem *.go
+func BenchmarkHotPath(b *testing.B) {
+	for _, bm := range hotPath {
+		b.Run(bm.name, bm.fn)
+	}
+}
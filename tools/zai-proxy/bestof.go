@@ -0,0 +1,276 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BestOfConfig serves POST /v1/best_of, which samples a chat request N
+// times through the fanout path and answers with the best sample. Scorer
+// is the default way samples are ranked:
+//
+//	heuristic  prefer complete, non-refusing, fuller answers
+//	logprob    highest mean token log probability (asks for logprobs)
+//	judge      ask JudgeModel which answer is best
+//
+// At most Max samples (default 8) are drawn.
+type BestOfConfig struct {
+	Scorer     string `json:"scorer,omitempty"`
+	JudgeModel string `json:"judge_model,omitempty"`
+	Max        int    `json:"max,omitempty"`
+}
+
+const bestOfPath = "/v1/best_of"
+
+func (c *BestOfConfig) validate() error {
+	if err := validScorer(c.Scorer, c.JudgeModel); err != nil {
+		return fmt.Errorf("best_of: %w", err)
+	}
+	if c.Max < 0 {
+		return fmt.Errorf("best_of: max must not be negative")
+	}
+	return nil
+}
+
+func validScorer(scorer, judge string) error {
+	switch scorer {
+	case "", "heuristic", "logprob":
+	case "judge":
+		if judge == "" {
+			return fmt.Errorf("the judge scorer needs a judge_model")
+		}
+	default:
+		return fmt.Errorf("unknown scorer %q (want heuristic, logprob or judge)", scorer)
+	}
+	return nil
+}
+
+// BestOfRequest is a chat request with the sampling options.
+type BestOfRequest struct {
+	N          int    `json:"n"`
+	Scorer     string `json:"scorer,omitempty"`
+	JudgeModel string `json:"judge_model,omitempty"`
+}
+
+// BestOfCandidate describes one sample in the best_of field of the answer.
+type BestOfCandidate struct {
+	Index        int      `json:"index"`
+	Status       int      `json:"status"`
+	Score        float64  `json:"score"`
+	FinishReason string   `json:"finish_reason,omitempty"`
+	Chars        int      `json:"chars"`
+	Duration     Duration `json:"duration"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// BestOf is added to the winning response as its best_of field.
+type BestOf struct {
+	Scorer     string            `json:"scorer"`
+	Winner     int               `json:"winner"`
+	Candidates []BestOfCandidate `json:"candidates"`
+}
+
+// bestOfHandler answers with the winning sample's response, unchanged but
+// for the added best_of field.
+func bestOfHandler(cfg *Config, mux *http.ServeMux) http.Handler {
+	path := cfg.Fanout.route()
+	limit := cfg.BestOf.Max
+	if limit == 0 {
+		limit = 8
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]any
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&doc); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON chat request: "+err.Error())
+			return
+		}
+		var br BestOfRequest
+		b, _ := json.Marshal(doc)
+		json.Unmarshal(b, &br)
+		br.Scorer = cmp.Or(br.Scorer, cfg.BestOf.Scorer, "heuristic")
+		br.JudgeModel = cmp.Or(br.JudgeModel, cfg.BestOf.JudgeModel)
+		if err := validScorer(br.Scorer, br.JudgeModel); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if br.N < 1 || br.N > limit {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("n must be between 1 and %d", limit))
+			return
+		}
+		model, _ := doc["model"].(string)
+		for _, k := range []string{"n", "scorer", "judge_model"} {
+			delete(doc, k)
+		}
+		doc["stream"] = false
+		if br.Scorer == "logprob" {
+			doc["logprobs"] = true
+		}
+
+		results := make([]FanoutResult, br.N)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = fanoutOne(mux, r, path, doc, i, model, nil)
+			}(i)
+		}
+		wg.Wait()
+
+		meta := BestOf{Scorer: br.Scorer, Winner: -1}
+		docs := make([]map[string]any, len(results))
+		for i, res := range results {
+			c := BestOfCandidate{Index: i, Status: res.Status, Duration: res.Duration, Error: res.Error, Score: math.Inf(-1)}
+			if res.Status < 300 {
+				if v, err := decodeJSON(res.Response); err == nil {
+					docs[i], _ = v.(map[string]any)
+				}
+			}
+			if docs[i] != nil {
+				c.FinishReason = finishReason(docs[i])
+				c.Chars = len(responseText(docs[i]))
+			}
+			meta.Candidates = append(meta.Candidates, c)
+		}
+		if br.Scorer == "judge" {
+			judgeCandidates(mux, r, path, br.JudgeModel, doc, docs, meta.Candidates)
+		} else {
+			for i, d := range docs {
+				if d != nil {
+					meta.Candidates[i].Score = scoreCandidate(br.Scorer, d)
+				}
+			}
+		}
+		for i, c := range meta.Candidates {
+			if docs[i] != nil && (meta.Winner < 0 || c.Score > meta.Candidates[meta.Winner].Score) {
+				meta.Winner = i
+			}
+		}
+		for i := range meta.Candidates {
+			if math.IsInf(meta.Candidates[i].Score, -1) {
+				meta.Candidates[i].Score = 0
+			}
+		}
+		if meta.Winner < 0 {
+			// Every sample failed; pass the first failure on.
+			first := results[0]
+			if json.Valid(first.Response) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(first.Status)
+				w.Write(first.Response)
+				return
+			}
+			writeError(w, http.StatusBadGateway, "upstream_error", "every sample failed: "+first.Error)
+			return
+		}
+		winner := docs[meta.Winner]
+		winner["best_of"] = meta
+		writeJSON(w, http.StatusOK, winner)
+	})
+}
+
+// responseText is the completion text of a response body.
+func responseText(doc map[string]any) string {
+	var b strings.Builder
+	for _, t := range textFields(doc) {
+		b.WriteString(t.get())
+	}
+	return b.String()
+}
+
+func finishReason(doc map[string]any) string {
+	if choices, ok := doc["choices"].([]any); ok && len(choices) > 0 {
+		if c, ok := choices[0].(map[string]any); ok {
+			s, _ := c["finish_reason"].(string)
+			return s
+		}
+	}
+	s, _ := doc["stop_reason"].(string)
+	return s
+}
+
+var refusalStart = regexp.MustCompile(`(?i)^\s*(i'?m sorry|sorry|i can(no|')t|i am unable|i'?m unable|as an ai)`)
+
+// scoreCandidate ranks one sample; higher is better.
+func scoreCandidate(scorer string, doc map[string]any) float64 {
+	if scorer == "logprob" {
+		if lp, ok := meanLogprob(doc); ok {
+			return lp
+		}
+		return math.Inf(-1)
+	}
+	text := responseText(doc)
+	score := 0.0
+	switch finishReason(doc) {
+	case "stop", "end_turn", "tool_calls", "tool_use":
+		score += 2
+	}
+	if strings.TrimSpace(text) == "" {
+		score -= 2
+	}
+	if refusalStart.MatchString(text) {
+		score -= 3
+	}
+	// Fuller answers win ties, with diminishing returns.
+	return score + math.Log1p(float64(len(text)))/10
+}
+
+// meanLogprob averages choices[0].logprobs.content[].logprob.
+func meanLogprob(doc map[string]any) (float64, bool) {
+	choices, _ := doc["choices"].([]any)
+	if len(choices) == 0 {
+		return 0, false
+	}
+	c, _ := choices[0].(map[string]any)
+	lp, _ := c["logprobs"].(map[string]any)
+	toks, _ := lp["content"].([]any)
+	var sum float64
+	n := 0
+	for _, t := range toks {
+		tm, _ := t.(map[string]any)
+		if v, ok := jsonNumber(tm["logprob"]); ok {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+var firstNumber = regexp.MustCompile(`\d+`)
+
+// judgeCandidates asks the judge model to pick a sample and scores the
+// pick 1, the rest 0. Failed samples are not shown to the judge.
+func judgeCandidates(mux *http.ServeMux, r *http.Request, path, judge string, req map[string]any, docs []map[string]any, cands []BestOfCandidate) {
+	var prompt strings.Builder
+	prompt.WriteString("Several answers were written for the conversation below. Reply with only the number of the best answer.\n\n")
+	if msgs, err := json.Marshal(req["messages"]); err == nil {
+		fmt.Fprintf(&prompt, "Conversation:\n%s\n\n", msgs)
+	}
+	for i, d := range docs {
+		if d != nil {
+			cands[i].Score = 0
+			fmt.Fprintf(&prompt, "Answer %d:\n%s\n\n", i+1, responseText(d))
+		}
+	}
+	jdoc := map[string]any{"stream": false, "max_tokens": 16,
+		"messages": []any{map[string]any{"role": "user", "content": prompt.String()}}}
+	res := fanoutOne(mux, r, path, jdoc, 0, judge, nil)
+	v, err := decodeJSON(res.Response)
+	d, _ := v.(map[string]any)
+	if err != nil || d == nil || res.Status >= 300 {
+		return
+	}
+	if n, err := strconv.Atoi(firstNumber.FindString(responseText(d))); err == nil && n >= 1 && n <= len(docs) && docs[n-1] != nil {
+		cands[n-1].Score = 1
+	}
+}
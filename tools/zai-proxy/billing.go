@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BillingConfig emits usage events to an external biller. BatchSize 1
+// sends each request as it completes; larger batches are flushed when full
+// or every FlushInterval. With Secret set, each POST carries an HMAC-SHA256
+// of the body in X-Ringmaster-Signature.
+type BillingConfig struct {
+	Webhook       string   `json:"webhook"`
+	Secret        string   `json:"secret"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+	Buffer        int      `json:"buffer"`
+}
+
+// BillingEvent is one metered request.
+type BillingEvent struct {
+	ID               string    `json:"id"`
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Project          string    `json:"project,omitempty"`
+	Model            string    `json:"model"`
+	Provider         string    `json:"provider"`
+	Status           int       `json:"status"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	CachedTokens     int64     `json:"cached_tokens"`
+	CacheWriteTokens int64     `json:"cache_write_tokens"`
+	CostUSD          float64   `json:"cost_usd"`
+}
+
+func billingEventOf(rec UsageRecord) BillingEvent {
+	return BillingEvent{
+		ID: rec.ID, Time: rec.Time.UTC(), Client: rec.Client, Project: rec.Project,
+		Model: rec.Model, Provider: rec.Provider, Status: rec.Status,
+		PromptTokens: rec.PromptTokens, CompletionTokens: rec.CompletionTokens,
+		CachedTokens: rec.CachedTokens, CacheWriteTokens: rec.CacheWriteTokens, CostUSD: rec.CostUSD,
+	}
+}
+
+var (
+	billingEventsSent = metrics.counter("zai_proxy_billing_events_sent_total",
+		"Usage events delivered to the billing webhook.")
+	billingEventsDropped = metrics.counter("zai_proxy_billing_events_dropped_total",
+		"Usage events dropped because the buffer was full or delivery failed.", "reason")
+)
+
+// billingEmitter buffers events and delivers them in batches off the
+// request path.
+type billingEmitter struct {
+	cfg    BillingConfig
+	client *http.Client
+	events chan BillingEvent
+}
+
+func newBillingEmitter(cfg BillingConfig) *billingEmitter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = Duration(10 * time.Second)
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 10000
+	}
+	return &billingEmitter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		events: make(chan BillingEvent, cfg.Buffer),
+	}
+}
+
+// Emit queues an event without blocking; a full buffer drops it.
+func (b *billingEmitter) Emit(ev BillingEvent) {
+	select {
+	case b.events <- ev:
+	default:
+		billingEventsDropped.Add(1, "buffer_full")
+	}
+}
+
+// Run delivers batches until ctx is cancelled, then flushes what is left.
+func (b *billingEmitter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(b.cfg.FlushInterval))
+	defer ticker.Stop()
+	batch := make([]BillingEvent, 0, b.cfg.BatchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.send(ctx, batch); err != nil {
+			log.Printf("Error delivering %d billing events: %v", len(batch), err)
+			billingEventsDropped.Add(float64(len(batch)), "delivery_failed")
+		} else {
+			billingEventsSent.Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			drain, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			for {
+				select {
+				case ev := <-b.events:
+					batch = append(batch, ev)
+					continue
+				default:
+				}
+				break
+			}
+			flush(drain)
+			cancel()
+			return
+		case ev := <-b.events:
+			batch = append(batch, ev)
+			if len(batch) >= b.cfg.BatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func (b *billingEmitter) send(ctx context.Context, batch []BillingEvent) error {
+	body, err := json.Marshal(map[string]any{"events": batch})
+	if err != nil {
+		return err
+	}
+	h := http.Header{}
+	h.Set("X-Ringmaster-Event-Count", strconv.Itoa(len(batch)))
+	if b.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(b.cfg.Secret))
+		mac.Write(body)
+		h.Set("X-Ringmaster-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return postBody(ctx, b.client, b.cfg.Webhook, body, h)
+}
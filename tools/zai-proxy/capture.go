@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CaptureConfig writes sanitized copies of proxied exchanges to files in
+// Dir, as JSON lines or HAR ("jsonl" or "har", default jsonl). Sample is
+// the fraction of requests kept, default all; Routes and Clients narrow
+// which are eligible. A file is rotated once it reaches MaxBytes (default
+// 64MB) and the Keep newest (default 10) are kept, fewer as the retention
+// policy has it.
+type CaptureConfig struct {
+	Dir      string   `json:"dir"`
+	Format   string   `json:"format,omitempty"`
+	Sample   float64  `json:"sample,omitempty"`
+	Routes   []string `json:"routes,omitempty"`
+	Clients  []string `json:"clients,omitempty"`
+	MaxBytes int64    `json:"max_bytes,omitempty"`
+	Keep     int      `json:"keep,omitempty"`
+	RetentionPolicy
+}
+
+const captureBodyLimit = 1 << 20
+
+func (c *CaptureConfig) applyDefaults() {
+	if c.Format == "" {
+		c.Format = "jsonl"
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 64 << 20
+	}
+	if c.Keep == 0 {
+		c.Keep = 10
+	}
+}
+
+func (c *CaptureConfig) validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.Format != "" && c.Format != "jsonl" && c.Format != "har" {
+		return fmt.Errorf("capture: format must be jsonl or har")
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("capture: sample must be between 0 and 1")
+	}
+	if c.MaxBytes < 0 || c.Keep < 0 {
+		return fmt.Errorf("capture: max_bytes and keep must not be negative")
+	}
+	if err := c.RetentionPolicy.validate(); err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	return nil
+}
+
+// CaptureEntry is one exchange as written to a JSONL capture file. JSON
+// bodies are kept as JSON so the files load directly as datasets.
+type CaptureEntry struct {
+	Time            time.Time   `json:"time"`
+	ID              string      `json:"id"`
+	Route           string      `json:"route"`
+	Client          string      `json:"client"`
+	Model           string      `json:"model,omitempty"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	Request         any         `json:"request,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	Response        any         `json:"response,omitempty"`
+	Truncated       bool        `json:"truncated,omitempty"`
+	Duration        Duration    `json:"duration"`
+}
+
+// captureBody returns a redacted body as JSON if it parses, else as text.
+func captureBody(b []byte) any {
+	s := redactBody(b)
+	if s == "" {
+		return nil
+	}
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	return s
+}
+
+// captureSink appends entries to the current capture file, rotating it by
+// size. Entries are written from a queue so the disk never holds up the
+// client; when the queue is full they are dropped and counted.
+type captureSink struct {
+	cfg   CaptureConfig
+	queue chan CaptureEntry
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	n    int // entries in f
+}
+
+// patterns match the capture files.
+func (s *captureSink) patterns() []string {
+	base := filepath.Join(s.cfg.Dir, "capture-*."+s.cfg.Format)
+	return []string{base, base + ".gz"}
+}
+
+// current is the file being written, if any.
+func (s *captureSink) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ""
+	}
+	return s.f.Name()
+}
+
+var captureDropped = metrics.counter("zai_proxy_capture_dropped_total",
+	"Captured exchanges dropped because the capture writer fell behind.")
+
+func newCaptureSink(cfg CaptureConfig) *captureSink {
+	cfg.applyDefaults()
+	s := &captureSink{cfg: cfg, queue: make(chan CaptureEntry, 256)}
+	go s.run()
+	return s
+}
+
+func (s *captureSink) enqueue(e CaptureEntry) {
+	select {
+	case s.queue <- e:
+	default:
+		captureDropped.Add(1)
+	}
+}
+
+func (s *captureSink) run() {
+	for e := range s.queue {
+		if err := s.write(e); err != nil {
+			log.Printf("Error writing capture: %v", err)
+		}
+	}
+}
+
+func (s *captureSink) wants(ex *exchange) bool {
+	if len(s.cfg.Routes) > 0 && !slices.Contains(s.cfg.Routes, ex.route.Pattern) {
+		return false
+	}
+	if len(s.cfg.Clients) > 0 && !slices.Contains(s.cfg.Clients, ex.client) {
+		return false
+	}
+	return s.cfg.Sample == 0 || rand.Float64() < s.cfg.Sample
+}
+
+// harFooter closes a HAR document; each entry is written over the previous
+// footer so the file is valid HAR between writes.
+const harFooter = "\n]}}\n"
+
+func (s *captureSink) write(e CaptureEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil && s.size >= s.cfg.MaxBytes {
+		s.f.Close()
+		s.f = nil
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var b []byte
+	var err error
+	if s.cfg.Format == "har" {
+		b, err = json.Marshal(harEntryOf(e))
+		if err == nil {
+			if s.n > 0 {
+				b = append([]byte(",\n"), b...)
+			}
+			b = append(b, harFooter...)
+			if _, err = s.f.Seek(-int64(len(harFooter)), io.SeekEnd); err == nil {
+				s.size -= int64(len(harFooter))
+			}
+		}
+	} else {
+		b, err = json.Marshal(e)
+		b = append(b, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	s.n++
+	return err
+}
+
+// open starts a new capture file and removes the oldest beyond Keep.
+func (s *captureSink) open() error {
+	if err := os.MkdirAll(s.cfg.Dir, 0o700); err != nil {
+		return err
+	}
+	name := filepath.Join(s.cfg.Dir, "capture-"+time.Now().UTC().Format("20060102T150405.000")+"."+s.cfg.Format)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f, s.size, s.n = f, 0, 0
+	if s.cfg.Format == "har" {
+		n, err := fmt.Fprintf(f, `{"log":{"version":"1.2","creator":{"name":"zai-proxy","version":"1"},"entries":[%s`, harFooter)
+		s.size = int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	var old []string
+	for _, pattern := range s.patterns() {
+		m, _ := filepath.Glob(pattern)
+		old = append(old, m...)
+	}
+	sort.Strings(old)
+	for len(old) > s.cfg.Keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// captureStage hands sampled exchanges to the capture sink. Like debug it
+// sits after auth, and the request body is the one sent upstream.
+func captureStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if p.capture == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if !p.capture.wants(ex) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ex.inspect = true
+			tw := &bodySink{limit: captureBodyLimit}
+			reqHeaders := redactHeaders(r.Header)
+			start := time.Now()
+			next.ServeHTTP(teeTo(w, tw), r)
+			e := CaptureEntry{
+				Time: start.UTC(), ID: ex.id, Route: ex.route.Pattern, Client: ex.client,
+				Model: ex.model, Method: r.Method, URL: r.URL.RequestURI(), RequestHeaders: reqHeaders,
+				Request: captureBody(ex.body), Status: tw.status,
+				ResponseHeaders: redactHeaders(w.Header()), Response: captureBody(tw.body),
+				Truncated: tw.truncated, Duration: Duration(time.Since(start)),
+			}
+			if ex.target != "" {
+				e.URL = ex.target
+			}
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			p.capture.enqueue(e)
+		})
+	}, nil
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func harHeaders(h http.Header) []harHeader {
+	out := []harHeader{}
+	for k, vs := range h {
+		for _, v := range vs {
+			out = append(out, harHeader{k, v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harText(v any) string {
+	switch v := v.(type) {
+	case json.RawMessage:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// harEntryOf converts a capture to a HAR 1.2 entry.
+func harEntryOf(e CaptureEntry) map[string]any {
+	ms := float64(time.Duration(e.Duration)) / float64(time.Millisecond)
+	req := map[string]any{
+		"method": e.Method, "url": e.URL, "httpVersion": "HTTP/1.1",
+		"headers": harHeaders(e.RequestHeaders), "queryString": []any{}, "cookies": []any{},
+		"headersSize": -1, "bodySize": len(harText(e.Request)),
+	}
+	if e.Request != nil {
+		req["postData"] = map[string]any{"mimeType": e.RequestHeaders.Get("Content-Type"), "text": harText(e.Request)}
+	}
+	return map[string]any{
+		"startedDateTime": e.Time.Format(time.RFC3339Nano),
+		"time":            ms,
+		"request":         req,
+		"response": map[string]any{
+			"status": e.Status, "statusText": http.StatusText(e.Status), "httpVersion": "HTTP/1.1",
+			"headers": harHeaders(e.ResponseHeaders), "cookies": []any{},
+			"content": map[string]any{
+				"size": len(harText(e.Response)), "mimeType": e.ResponseHeaders.Get("Content-Type"), "text": harText(e.Response),
+			},
+			"redirectURL": "", "headersSize": -1, "bodySize": len(harText(e.Response)),
+		},
+		"cache":   map[string]any{},
+		"timings": map[string]any{"send": 0, "wait": ms, "receive": 0},
+		"comment": e.ID,
+		"_client": e.Client,
+		"_route":  e.Route,
+		"_model":  e.Model,
+	}
+}
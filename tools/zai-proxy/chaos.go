@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChaosFault injects one failure into Percent (0-100) of a route's
+// requests, to exercise clients' retry handling. Kind is:
+//
+//	latency   hold the request for Latency before forwarding it
+//	error     answer with Status (default 500) without forwarding; 429s
+//	          carry a Retry-After
+//	drop      cut the connection after AfterBytes of the response, or
+//	          before it when zero
+//	truncate  cut JSON responses to half their length
+//
+// Each fault is drawn independently, so a request can be delayed and then
+// fail.
+type ChaosFault struct {
+	Kind       string   `json:"kind"`
+	Percent    float64  `json:"percent"`
+	Latency    Duration `json:"latency,omitempty"`
+	Status     int      `json:"status,omitempty"`
+	AfterBytes int      `json:"after_bytes,omitempty"`
+}
+
+func (f *ChaosFault) validate() error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("chaos %s: percent must be between 0 and 100", f.Kind)
+	}
+	switch f.Kind {
+	case "latency":
+		if f.Latency <= 0 {
+			return fmt.Errorf("chaos latency needs a positive latency")
+		}
+	case "error":
+		if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+			return fmt.Errorf("chaos error: status must be 4xx or 5xx")
+		}
+	case "drop":
+		if f.AfterBytes < 0 {
+			return fmt.Errorf("chaos drop: after_bytes must not be negative")
+		}
+	case "truncate":
+	default:
+		return fmt.Errorf("unknown chaos kind %q (want latency, error, drop or truncate)", f.Kind)
+	}
+	return nil
+}
+
+var chaosFaultsTotal = metrics.counter("zai_proxy_chaos_faults_total",
+	"Faults injected by the chaos stage.", "route", "kind")
+
+// chaosStage applies the route's faults. It is innermost so everything
+// outside it, accounting included, sees the failures as if the upstream
+// had produced them.
+func chaosStage(p *proxy, rc *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if len(rc.Chaos) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, f := range rc.Chaos {
+				if rand.Float64()*100 >= f.Percent {
+					continue
+				}
+				chaosFaultsTotal.Add(1, rc.Pattern, f.Kind)
+				w.Header().Set("X-Ringmaster-Chaos", f.Kind)
+				switch f.Kind {
+				case "latency":
+					if sleepCtx(r.Context(), time.Duration(f.Latency)) != nil {
+						return
+					}
+				case "error":
+					status := f.Status
+					if status == 0 {
+						status = http.StatusInternalServerError
+					}
+					typ := "server_error"
+					if status == http.StatusTooManyRequests {
+						w.Header().Set("Retry-After", "1")
+						typ = "rate_limit_error"
+					}
+					writeError(w, status, typ, "injected "+strconv.Itoa(status)+" ("+http.StatusText(status)+")")
+					return
+				case "drop":
+					if f.AfterBytes == 0 {
+						panic(http.ErrAbortHandler)
+					}
+					dw := &dropWriter{ResponseWriter: w, left: f.AfterBytes}
+					next.ServeHTTP(dw, r)
+					return
+				case "truncate":
+					exchangeOf(r).inspect = true
+					tw := &truncateWriter{ResponseWriter: w}
+					next.ServeHTTP(tw, r)
+					tw.finish()
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// dropWriter aborts the connection once left bytes have been written.
+type dropWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *dropWriter) Write(b []byte) (int, error) {
+	if len(b) < w.left {
+		w.left -= len(b)
+		return w.ResponseWriter.Write(b)
+	}
+	w.ResponseWriter.Write(b[:w.left])
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func (w *dropWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *dropWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// truncateWriter holds back a JSON response and sends only its first half;
+// other responses pass through.
+type truncateWriter struct {
+	http.ResponseWriter
+	status int
+	json   bool
+	buf    bytes.Buffer
+}
+
+func (w *truncateWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	w.json = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	if w.json {
+		w.Header().Del("Content-Length")
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *truncateWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.json && w.buf.Len()+len(b) > maxObservedBody {
+		// Too large to hold back; let it through whole.
+		w.json = false
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+	}
+	if w.json {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *truncateWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.json {
+		f.Flush()
+	}
+}
+
+func (w *truncateWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *truncateWriter) finish() {
+	if !w.json {
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes()[:w.buf.Len()/2])
+}
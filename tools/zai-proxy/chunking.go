@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// chunkParallelism bounds the calls made at once for one chunked request.
+const chunkParallelism = 8
+
+// chunkText splits text into pieces of at most n tokens of model, breaking
+// after whitespace where it can.
+func chunkText(model, text string, n int64) []string {
+	var chunks []string
+	var cur strings.Builder
+	var tokens int64
+	flush := func() {
+		if cur.Len() > 0 {
+			chunks = append(chunks, fitChunk(model, cur.String(), n)...)
+			cur.Reset()
+			tokens = 0
+		}
+	}
+	for len(text) > 0 {
+		word := text[:wordEnd(text)]
+		text = text[len(word):]
+		t := countTokens(model, word)
+		if tokens+t > n {
+			flush()
+		}
+		cur.WriteString(word)
+		tokens += t
+	}
+	flush()
+	return chunks
+}
+
+// wordEnd returns the length of s's first word with the whitespace after it.
+func wordEnd(s string) int {
+	i, space := 0, false
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsSpace(r) {
+			space = true
+		} else if space {
+			return i
+		}
+		i += size
+	}
+	return i
+}
+
+// fitChunk halves s until every piece counts at most n tokens, as a word
+// longer than that, or words that count more together than apart, need.
+func fitChunk(model, s string, n int64) []string {
+	if countTokens(model, s) <= n || utf8.RuneCountInString(s) < 2 {
+		return []string{s}
+	}
+	mid := len(s) / 2
+	for !utf8.RuneStart(s[mid]) {
+		mid--
+	}
+	if i := strings.LastIndexFunc(s[:mid], unicode.IsSpace); i > 0 {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		mid = i + size
+	}
+	return append(fitChunk(model, s[:mid], n), fitChunk(model, s[mid:], n)...)
+}
+
+// chunkCalls makes one call per doc through the proxy, a few at a time,
+// returning the results in order.
+func (p *proxy) chunkCalls(r *http.Request, model string, docs []map[string]any) []FanoutResult {
+	out := make([]FanoutResult, len(docs))
+	sem := make(chan struct{}, chunkParallelism)
+	var wg sync.WaitGroup
+	for i, doc := range docs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, doc map[string]any) {
+			defer wg.Done()
+			out[i] = fanoutOne(p.mux, r, r.URL.Path, doc, i, model, nil)
+			<-sem
+		}(i, doc)
+	}
+	wg.Wait()
+	return out
+}
+
+// chunkEmbeddings answers an embeddings request with inputs over limit by
+// embedding them in chunks, reporting whether it did. The list has an
+// embedding per chunk, in order, each naming its input_index.
+func (p *proxy) chunkEmbeddings(w http.ResponseWriter, r *http.Request, ex *exchange, limit int64) bool {
+	var inputs []string
+	switch in := ex.doc["input"].(type) {
+	case string:
+		inputs = []string{in}
+	case []any:
+		for _, v := range in {
+			s, ok := v.(string)
+			if !ok {
+				return false // token arrays are the caller's to split
+			}
+			inputs = append(inputs, s)
+		}
+	}
+	type piece struct {
+		input  int
+		text   string
+		tokens int64
+	}
+	var pieces []piece
+	over := false
+	for i, in := range inputs {
+		if countTokens(ex.model, in) <= limit {
+			pieces = append(pieces, piece{i, in, countTokens(ex.model, in)})
+			continue
+		}
+		over = true
+		for _, c := range chunkText(ex.model, in, limit) {
+			pieces = append(pieces, piece{i, c, countTokens(ex.model, c)})
+		}
+	}
+	if !over {
+		return false
+	}
+	// Pieces are packed into calls of up to limit tokens between them.
+	var docs []map[string]any
+	var owners [][]int
+	var batch []any
+	var owner []int
+	var tokens int64
+	flush := func() {
+		if len(batch) > 0 {
+			doc := make(map[string]any, len(ex.doc))
+			for k, v := range ex.doc {
+				doc[k] = v
+			}
+			doc["input"] = batch
+			docs, owners = append(docs, doc), append(owners, owner)
+			batch, owner, tokens = nil, nil, 0
+		}
+	}
+	for _, pc := range pieces {
+		if tokens+pc.tokens > limit || len(batch) == 2048 {
+			flush()
+		}
+		batch, owner = append(batch, pc.text), append(owner, pc.input)
+		tokens += pc.tokens
+	}
+	flush()
+	data := []any{}
+	var promptTokens, totalTokens int64
+	model := ex.model
+	for i, res := range p.chunkCalls(r, ex.model, docs) {
+		v, err := decodeJSON(res.Response)
+		d, _ := v.(map[string]any)
+		items, _ := d["data"].([]any)
+		if err != nil || res.Status >= 300 || len(items) != len(owners[i]) {
+			for k, vs := range res.header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(cmp.Or(res.Status, http.StatusBadGateway))
+			w.Write(res.Response)
+			return true
+		}
+		for j, item := range items {
+			if m, ok := item.(map[string]any); ok {
+				m["index"], m["input_index"] = len(data), owners[i][j]
+			}
+			data = append(data, item)
+		}
+		if u, ok := d["usage"].(map[string]any); ok {
+			pt, _ := u["prompt_tokens"].(json.Number)
+			tt, _ := u["total_tokens"].(json.Number)
+			n, _ := pt.Int64()
+			m, _ := tt.Int64()
+			promptTokens, totalTokens = promptTokens+n, totalTokens+m
+		}
+		if m, ok := d["model"].(string); ok {
+			model = m
+		}
+	}
+	contextActions.Add(1, ex.model, "chunked")
+	w.Header().Set("X-Ringmaster-Context", "chunked")
+	w.Header().Set("X-Ringmaster-Context-Chunks", strconv.Itoa(len(pieces)))
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "model": model, "data": data,
+		"usage": map[string]any{"prompt_tokens": promptTokens, "total_tokens": totalTokens}})
+	return true
+}
+
+// mapReduce fits an overlong request by its longest message: the request
+// is made on each token-bounded chunk of that message, and the message is
+// replaced by the answers, again until it fits. It returns the messages
+// and how many calls it took, or false when the rest of the request leaves
+// too little room for chunks or a call fails.
+func (p *proxy) mapReduce(r *http.Request, ex *exchange, msgs []any, req chatRequest, limit int64) ([]any, int, bool) {
+	longest, size := -1, int64(0)
+	for i, m := range msgs {
+		if t := messageTokens(ex.model, m); t > size {
+			longest, size = i, t
+		}
+	}
+	if longest < 0 {
+		return nil, 0, false
+	}
+	cm := asChatMessage(msgs[longest])
+	text := contentText(cm.Content)
+	others := estimatePromptTokens(&req) - size + perMessageTokens + countTokens(ex.model, cm.Role)
+	answer := min(cmp.Or(req.MaxTokens, 1024), limit/4)
+	// About 64 tokens go to the framing of chunks and answers.
+	room := limit - max(req.MaxTokens, answer) - others - 64
+	if room < 2*answer {
+		return nil, 0, false
+	}
+	with := func(content string) []any {
+		out := make([]any, len(msgs))
+		copy(out, msgs)
+		out[longest] = map[string]any{"role": cm.Role, "content": content}
+		return out
+	}
+	calls := 0
+	for level := 0; countTokens(ex.model, text) > room; level++ {
+		if level == 4 {
+			return nil, calls, false
+		}
+		chunks := chunkText(ex.model, text, room)
+		docs := make([]map[string]any, len(chunks))
+		for i, c := range chunks {
+			doc := make(map[string]any, len(ex.doc))
+			for k, v := range ex.doc {
+				doc[k] = v
+			}
+			doc["stream"], doc["max_tokens"] = false, answer
+			delete(doc, "stream_options")
+			doc["messages"] = with(fmt.Sprintf("(Part %d of %d of a longer text.)\n\n%s", i+1, len(chunks), c))
+			docs[i] = doc
+		}
+		var parts strings.Builder
+		fmt.Fprintf(&parts, "This text was too long to read at once, so the request was made on each of its %d parts in turn. "+
+			"Answer it for the whole text from the answers for the parts, which follow in order.\n\n", len(chunks))
+		for i, res := range p.chunkCalls(r, ex.model, docs) {
+			v, err := decodeJSON(res.Response)
+			d, _ := v.(map[string]any)
+			if err != nil || d == nil || res.Status >= 300 {
+				debugf("Map-reduce call %d for %s failed with status %d", i+1, ex.model, res.Status)
+				return nil, calls, false
+			}
+			fmt.Fprintf(&parts, "Part %d:\n%s\n\n", i+1, strings.TrimSpace(responseText(d)))
+		}
+		calls += len(chunks)
+		text = parts.String()
+	}
+	return with(text), calls, true
+}
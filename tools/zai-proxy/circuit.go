@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitConfig stops sending requests to pool members that keep failing.
+// After Failures (0 disables) transport failures or 5xx responses in a row,
+// a member's circuit opens and requests go to the other members for
+// Cooldown (default 30s). Then it is tried again: one more failure opens
+// it once more, a success closes it. When every member's circuit is open
+// they are used regardless.
+type CircuitConfig struct {
+	Failures int      `json:"failures,omitempty"`
+	Cooldown Duration `json:"cooldown,omitempty"`
+}
+
+func (c *CircuitConfig) validate() error {
+	if c.Failures < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("circuit: failures and cooldown must not be negative")
+	}
+	return nil
+}
+
+var circuitOpens = metrics.counter("zai_proxy_circuit_opens_total",
+	"Times a pool member's circuit opened, by member.", "upstream")
+
+// circuits holds the pool members' circuit breakers.
+type circuits struct {
+	cfg *CircuitConfig
+
+	mu       sync.Mutex
+	failures map[string]int
+	open     map[string]time.Time // member URL to when its circuit closes
+}
+
+func newCircuits(cfg *CircuitConfig) *circuits {
+	return &circuits{cfg: cfg, failures: map[string]int{}, open: map[string]time.Time{}}
+}
+
+// record notes an outcome of a request to member.
+func (c *circuits) record(member string, resp *http.Response, err error) {
+	if c == nil || c.cfg.Failures == 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && resp.StatusCode < 500 {
+		delete(c.failures, member)
+		return
+	}
+	c.failures[member]++
+	if c.failures[member] < c.cfg.Failures || time.Now().Before(c.open[member]) {
+		return
+	}
+	// Left at the threshold, so the first failure after the cooldown reopens it.
+	c.failures[member] = c.cfg.Failures
+	c.open[member] = time.Now().Add(cmp.Or(time.Duration(c.cfg.Cooldown), 30*time.Second))
+	circuitOpens.Add(1, member)
+	log.Printf("Circuit opened for %s after %d failures", member, c.cfg.Failures)
+}
+
+// isOpen reports whether requests should avoid member at now.
+func (c *circuits) isOpen(member string, now time.Time) bool {
+	if c == nil || c.cfg.Failures == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Before(c.open[member])
+}
+
+// opened returns the open circuits and when each closes.
+func (c *circuits) opened() map[string]time.Time {
+	out := map[string]time.Time{}
+	if c == nil {
+		return out
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for m, until := range c.open {
+		if now.Before(until) {
+			out[m] = until
+		} else if c.failures[m] == 0 {
+			delete(c.open, m)
+		}
+	}
+	return out
+}
+
+// openUntil opens member's circuit until until, as a peer has, unless it
+// is already open for longer.
+func (c *circuits) openUntil(member string, until time.Time) {
+	if c == nil || c.cfg.Failures == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until.After(c.open[member]) {
+		c.open[member] = until
+		c.failures[member] = c.cfg.Failures
+	}
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Message is a chat message. Content is a string or a list of content
+// parts.
+type Message struct {
+	Role       string `json:"role"`
+	Content    any    `json:"content"`
+	Name       string `json:"name,omitempty"`
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// ToolCalls are the tools an assistant message calls.
+	ToolCalls []json.RawMessage `json:"tool_calls,omitempty"`
+}
+
+// Text returns the message's text, its parts' joined when it has parts.
+func (m Message) Text() string {
+	switch c := m.Content.(type) {
+	case string:
+		return c
+	case []any:
+		var b strings.Builder
+		for _, p := range c {
+			if part, ok := p.(map[string]any); ok {
+				if s, ok := part["text"].(string); ok {
+					b.WriteString(s)
+				}
+			}
+		}
+		return b.String()
+	}
+	return ""
+}
+
+// ChatRequest is a chat completions request. Extra fields are sent as
+// well, for parameters this type doesn't name.
+type ChatRequest struct {
+	Model       string            `json:"model"`
+	Messages    []Message         `json:"messages"`
+	MaxTokens   int               `json:"max_tokens,omitempty"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	TopP        *float64          `json:"top_p,omitempty"`
+	Stop        []string          `json:"stop,omitempty"`
+	Tools       []json.RawMessage `json:"tools,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Stream      bool              `json:"stream,omitempty"`
+	Extra       map[string]any    `json:"-"`
+}
+
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	type plain ChatRequest
+	b, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return b, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	for k, v := range r.Extra {
+		if _, ok := doc[k]; !ok {
+			doc[k] = v
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// Usage is the tokens a completion took.
+type Usage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+// Choice is one of a completion's answers.
+type Choice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// ChatResponse is a chat completion.
+type ChatResponse struct {
+	ID      string   `json:"id"`
+	Model   string   `json:"model"`
+	Created int64    `json:"created"`
+	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+	// Header is the reply's, with the proxy's X-Ringmaster headers.
+	Header http.Header `json:"-"`
+}
+
+// Text returns the first answer's text.
+func (r *ChatResponse) Text() string {
+	if len(r.Choices) == 0 {
+		return ""
+	}
+	return r.Choices[0].Message.Text()
+}
+
+// Chat sends a chat completions request and waits for its answer.
+func (c *Client) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	req.Stream = false
+	resp, err := c.send(ctx, http.MethodPost, "/v1/chat/completions", req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out := &ChatResponse{Header: resp.Header}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("ringmaster: decoding chat completion: %w", err)
+	}
+	return out, nil
+}
+
+// ChunkChoice is one answer's part in a streamed chunk.
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Message `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// ChatChunk is one event of a streamed chat completion.
+type ChatChunk struct {
+	ID      string        `json:"id"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+}
+
+// Stream reads a streamed chat completion. Call Next until it reports
+// false, then Err; Close releases the connection early.
+//
+//	for s.Next() {
+//		fmt.Print(s.Chunk().Choices[0].Delta.Text())
+//	}
+//	err := s.Err()
+type Stream struct {
+	// Header is the reply's.
+	Header http.Header
+
+	body  io.ReadCloser
+	sc    *bufio.Scanner
+	chunk ChatChunk
+	err   error
+}
+
+// ChatStream sends a chat completions request to be streamed. Tries that
+// fail before the stream starts are retried; a stream cut short reports
+// it from Err.
+func (c *Client) ChatStream(ctx context.Context, req ChatRequest) (*Stream, error) {
+	req.Stream = true
+	resp, err := c.send(ctx, http.MethodPost, "/v1/chat/completions", req, false)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 8<<20)
+	return &Stream{Header: resp.Header, body: resp.Body, sc: sc}, nil
+}
+
+// Next reads the next chunk, reporting whether there was one.
+func (s *Stream) Next() bool {
+	if s.err != nil || s.sc == nil {
+		return false
+	}
+	var data bytes.Buffer
+	for {
+		more := s.sc.Scan()
+		line := s.sc.Bytes()
+		if v, ok := bytes.CutPrefix(line, []byte("data:")); more && ok {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(v, []byte(" ")))
+			continue
+		}
+		if more && (len(line) > 0 || data.Len() == 0) {
+			continue
+		}
+		if !more && data.Len() == 0 {
+			s.err = s.sc.Err()
+			s.Close()
+			return false
+		}
+		return s.decode(data.Bytes())
+	}
+}
+
+// decode takes one event's data as the current chunk.
+func (s *Stream) decode(data []byte) bool {
+	if bytes.Equal(data, []byte("[DONE]")) {
+		s.Close()
+		return false
+	}
+	// The proxy reports errors that start mid-stream as an event.
+	var e struct {
+		Error *struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && e.Error != nil {
+		s.err = &Error{Status: http.StatusBadGateway, Type: e.Error.Type, Message: e.Error.Message}
+		return false
+	}
+	s.chunk = ChatChunk{}
+	if err := json.Unmarshal(data, &s.chunk); err != nil {
+		s.err = fmt.Errorf("ringmaster: decoding stream chunk: %w", err)
+		return false
+	}
+	return true
+}
+
+// Chunk returns the chunk Next read.
+func (s *Stream) Chunk() ChatChunk { return s.chunk }
+
+// Err returns what ended the stream early, or nil once it finished.
+func (s *Stream) Err() error { return s.err }
+
+// Close ends the stream.
+func (s *Stream) Close() error {
+	if s.sc == nil {
+		return nil
+	}
+	s.sc = nil
+	return s.body.Close()
+}
+
+// Collect reads the rest of the stream, returning the first answer's text
+// and the usage, when the stream reported it.
+func (s *Stream) Collect() (string, *Usage, error) {
+	defer s.Close()
+	var text strings.Builder
+	var usage *Usage
+	for s.Next() {
+		ch := s.Chunk()
+		for _, c := range ch.Choices {
+			if c.Index == 0 {
+				text.WriteString(c.Delta.Text())
+			}
+		}
+		if ch.Usage != nil {
+			usage = ch.Usage
+		}
+	}
+	return text.String(), usage, s.Err()
+}
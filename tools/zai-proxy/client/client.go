@@ -0,0 +1,232 @@
+// Package client calls a ringmaster proxy's native APIs: chat completions,
+// usage, background jobs and virtual keys. A Client retries what the proxy
+// says may succeed if sent again, waiting as long as it asks, and streams
+// chat completions chunk by chunk. It is a module of its own, needing
+// nothing beyond the standard library:
+//
+//	go get github.com/jedarden/ringmaster/tools/zai-proxy/client
+//
+//	c := client.New("http://ringmaster:8080", os.Getenv("RINGMASTER_KEY"))
+//	resp, err := c.Chat(ctx, client.ChatRequest{Model: "glm-4.6",
+//		Messages: []client.Message{{Role: "user", Content: "Hello"}}})
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls one proxy with one key. Its fields may be changed before
+// first use.
+type Client struct {
+	// BaseURL is the proxy's address, such as http://ringmaster:8080.
+	BaseURL string
+	// Key is the client's key, static or virtual.
+	Key string
+	// AdminToken authorizes the /admin calls.
+	AdminToken string
+	// HTTPClient sends the requests; nil uses one without a timeout, as
+	// streams may run long. Bound calls with their contexts.
+	HTTPClient *http.Client
+	// MaxRetries is how often a failed call is sent again.
+	MaxRetries int
+	// Backoff is the first wait between tries, doubled for each after it
+	// up to 30s, unless the proxy names its own.
+	Backoff time.Duration
+}
+
+// New returns a client of the proxy at baseURL that retries three times.
+func New(baseURL, key string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Key: key, MaxRetries: 3, Backoff: 500 * time.Millisecond}
+}
+
+// Error is a reply the proxy or its upstream refused a call with.
+type Error struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+	// Retryable is whether the same call may succeed if sent again, and
+	// RetryAfter how long to wait before it does.
+	Retryable  bool
+	RetryAfter time.Duration
+	// Limit names the proxy limit that refused the call, if one did.
+	Limit string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	if e.Type != "" {
+		return fmt.Sprintf("ringmaster: %d %s: %s", e.Status, e.Type, msg)
+	}
+	return fmt.Sprintf("ringmaster: %d: %s", e.Status, msg)
+}
+
+// errorOf reads an error reply.
+func errorOf(resp *http.Response) *Error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	e := &Error{Status: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+			Param   string `json:"param"`
+			Retry   *struct {
+				Retryable bool   `json:"retryable"`
+				AfterMs   int64  `json:"after_ms"`
+				Limit     string `json:"limit"`
+			} `json:"retry"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Error.Message != "" {
+		d := body.Error
+		e.Type, e.Param, e.Message = d.Type, d.Param, d.Message
+		if d.Code != nil {
+			e.Code = fmt.Sprint(d.Code)
+		}
+		if d.Retry != nil {
+			e.Retryable, e.Limit = d.Retry.Retryable, d.Retry.Limit
+			e.RetryAfter = time.Duration(d.Retry.AfterMs) * time.Millisecond
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(b))
+		// Replies the proxy didn't write are judged by their status.
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			e.Retryable = true
+		}
+	}
+	if e.RetryAfter == 0 {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			e.RetryAfter = time.Duration(s) * time.Second
+		}
+	}
+	return e
+}
+
+// Do sends a JSON call to path and decodes its reply into out, if not nil,
+// for the APIs this package has no method for. It retries as the client's
+// methods do.
+func (c *Client) Do(ctx context.Context, method, path string, in, out any) error {
+	return c.call(ctx, method, path, in, out, false)
+}
+
+// admin is Do with the admin token.
+func (c *Client) admin(ctx context.Context, method, path string, in, out any) error {
+	return c.call(ctx, method, path, in, out, true)
+}
+
+func (c *Client) call(ctx context.Context, method, path string, in, out any, admin bool) error {
+	resp, err := c.send(ctx, method, path, in, admin)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes a call, trying again while it fails retryably, and returns
+// the successful reply for the caller to read and close. Posts carry an
+// Idempotency-Key, the same on every try, so a retry after a reply was
+// lost is answered with it rather than generated again.
+func (c *Client) send(ctx context.Context, method, path string, in any, admin bool) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	var idem string
+	if method == http.MethodPost {
+		var b [16]byte
+		crand.Read(b[:])
+		idem = hex.EncodeToString(b[:])
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	for try := 0; ; try++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if idem != "" {
+			req.Header.Set("Idempotency-Key", idem)
+		}
+		token := c.Key
+		if admin && c.AdminToken != "" {
+			token = c.AdminToken
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := hc.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			// Admin posts are not deduplicated, so one that may have
+			// arrived is not sent again.
+			if ctx.Err() != nil || admin && method == http.MethodPost {
+				return nil, err
+			}
+		case resp.StatusCode < 300:
+			return resp, nil
+		default:
+			e := errorOf(resp)
+			resp.Body.Close()
+			if !e.Retryable {
+				return nil, e
+			}
+			err, wait = e, e.RetryAfter
+		}
+		if try >= c.MaxRetries {
+			return nil, err
+		}
+		if wait == 0 {
+			wait = c.backoff(try)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, errors.Join(ctx.Err(), err)
+		case <-t.C:
+		}
+	}
+}
+
+// backoff is the wait before the try after try, with jitter so callers
+// refused together don't return together.
+func (c *Client) backoff(try int) time.Duration {
+	d := c.Backoff
+	if d <= 0 {
+		d = 500 * time.Millisecond
+	}
+	d = min(d<<min(try, 10), 30*time.Second)
+	return d/2 + rand.N(d/2+1)
+}
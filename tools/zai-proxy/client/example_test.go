@@ -0,0 +1,85 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/jedarden/ringmaster/tools/zai-proxy/client"
+)
+
+// fakeProxy stands in for a proxy: it answers chat completions, streamed
+// when asked, and refuses calls without the key "rk-test".
+func fakeProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rk-test" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":{"message":"unknown key","type":"authentication_error"}}`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, ev := range []string{
+				`{"id":"c1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+				`{"id":"c1","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+				`[DONE]`,
+			} {
+				fmt.Fprintf(w, "data: %s\n\n", ev)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"c1","model":"glm-4.6","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`)
+	}))
+}
+
+func ExampleClient_Chat() {
+	proxy := fakeProxy()
+	defer proxy.Close()
+
+	c := client.New(proxy.URL, "rk-test")
+	resp, err := c.Chat(context.Background(), client.ChatRequest{Model: "glm-4.6",
+		Messages: []client.Message{{Role: "user", Content: "Hello"}}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(resp.Text(), resp.Usage.TotalTokens)
+	// Output: Hello 11
+}
+
+func ExampleClient_ChatStream() {
+	proxy := fakeProxy()
+	defer proxy.Close()
+
+	c := client.New(proxy.URL, "rk-test")
+	s, err := c.ChatStream(context.Background(), client.ChatRequest{Model: "glm-4.6",
+		Messages: []client.Message{{Role: "user", Content: "Hello"}}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	text, usage, err := s.Collect()
+	fmt.Println(text, usage.TotalTokens, err)
+	// Output: Hello 11 <nil>
+}
+
+func ExampleError() {
+	proxy := fakeProxy()
+	defer proxy.Close()
+
+	c := client.New(proxy.URL, "rk-wrong")
+	_, err := c.Chat(context.Background(), client.ChatRequest{Model: "glm-4.6"})
+	var e *client.Error
+	if errors.As(err, &e) {
+		fmt.Println(e.Status, e.Type, e.Retryable)
+	}
+	// Output: 401 authentication_error false
+}
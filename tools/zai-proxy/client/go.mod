@@ -0,0 +1,3 @@
+module github.com/jedarden/ringmaster/tools/zai-proxy/client
+
+go 1.22
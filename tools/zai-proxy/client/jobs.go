@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Job is a background generation.
+type Job struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"` // queued, running, succeeded, failed or cancelled
+	Path     string            `json:"path"`
+	Model    string            `json:"model,omitempty"`
+	Webhook  string            `json:"webhook,omitempty"`
+	Stream   bool              `json:"stream,omitempty"`
+	Priority string            `json:"priority,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Code     int               `json:"response_status,omitempty"`
+	Response json.RawMessage   `json:"response,omitempty"`
+	Chunks   []json.RawMessage `json:"chunks,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Done reports whether the job has finished.
+func (j *Job) Done() bool {
+	return j.Status == "succeeded" || j.Status == "failed" || j.Status == "cancelled"
+}
+
+// JobRequest submits Body, a request to Path (chat completions when
+// empty), to be run in the background. Streamed jobs keep their chunks
+// for JobChunks.
+type JobRequest struct {
+	Path    string `json:"path,omitempty"`
+	Body    any    `json:"body"`
+	Webhook string `json:"webhook,omitempty"`
+	Stream  bool   `json:"stream,omitempty"`
+}
+
+// JobChunks are a streamed job's chunks from the one asked for, and where
+// the next call starts.
+type JobChunks struct {
+	ID     string            `json:"id"`
+	Status string            `json:"status"`
+	Chunks []json.RawMessage `json:"chunks"`
+	Next   int               `json:"next"`
+	Code   int               `json:"response_status,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// SubmitJob queues a job.
+func (c *Client) SubmitJob(ctx context.Context, req JobRequest) (*Job, error) {
+	var out Job
+	if err := c.Do(ctx, http.MethodPost, "/v1/jobs", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Job returns the job id.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var out Job
+	if err := c.Do(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Jobs lists the client's jobs, newest first.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var out struct {
+		Jobs []Job `json:"jobs"`
+	}
+	err := c.Do(ctx, http.MethodGet, "/v1/jobs", nil, &out)
+	return out.Jobs, err
+}
+
+// CancelJob cancels the job id.
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	var out Job
+	if err := c.Do(ctx, http.MethodDelete, "/v1/jobs/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// JobChunks waits up to wait, at most a minute, for the job's chunks from
+// the from'th, answering early once there are some or the job finishes.
+func (c *Client) JobChunks(ctx context.Context, id string, from int, wait time.Duration) (*JobChunks, error) {
+	path := fmt.Sprintf("/v1/jobs/%s/chunks?from=%d&wait=%s", url.PathEscape(id), from, wait)
+	var out JobChunks
+	if err := c.Do(ctx, http.MethodGet, path, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// WaitJob waits for the job id to finish and returns it, passing each
+// chunk of a streamed job to chunk as it arrives, if chunk is not nil.
+func (c *Client) WaitJob(ctx context.Context, id string, chunk func(json.RawMessage)) (*Job, error) {
+	from := 0
+	for {
+		ch, err := c.JobChunks(ctx, id, from, 25*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if chunk != nil {
+			for _, b := range ch.Chunks {
+				chunk(b)
+			}
+		}
+		from = ch.Next
+		if ch.Status == "succeeded" || ch.Status == "failed" || ch.Status == "cancelled" {
+			return c.Job(ctx, id)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// VirtualKey is a key issued through the proxy.
+type VirtualKey struct {
+	ID        string     `json:"id"`
+	Client    string     `json:"client"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// IssuedKey is a new key with its secret, which is shown only once.
+type IssuedKey struct {
+	VirtualKey
+	Secret string `json:"secret"`
+}
+
+// The key management calls need the client's AdminToken.
+
+// ListKeys lists the virtual keys.
+func (c *Client) ListKeys(ctx context.Context) ([]VirtualKey, error) {
+	var out struct {
+		Keys []VirtualKey `json:"keys"`
+	}
+	err := c.admin(ctx, http.MethodGet, "/admin/keys", nil, &out)
+	return out.Keys, err
+}
+
+// CreateKey issues a virtual key for the named client.
+func (c *Client) CreateKey(ctx context.Context, client string) (*IssuedKey, error) {
+	var out IssuedKey
+	if err := c.admin(ctx, http.MethodPost, "/admin/keys", map[string]string{"client": client}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RevokeKey revokes the virtual key id.
+func (c *Client) RevokeKey(ctx context.Context, id string) error {
+	return c.admin(ctx, http.MethodDelete, "/admin/keys/"+url.PathEscape(id), nil, nil)
+}
+
+// RotateKey revokes the virtual key id and issues its replacement.
+func (c *Client) RotateKey(ctx context.Context, id string) (*IssuedKey, error) {
+	var out IssuedKey
+	if err := c.admin(ctx, http.MethodPost, "/admin/keys/"+url.PathEscape(id)+"/rotate", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UsageTotals is what a set of requests took.
+type UsageTotals struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CachedTokens     int64   `json:"cached_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// UsageRow is the usage of one bucket and group.
+type UsageRow struct {
+	Start    time.Time `json:"start"`
+	Client   string    `json:"client,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	UsageTotals
+}
+
+// UsageReport is the usage between From and To.
+type UsageReport struct {
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Bucket string      `json:"bucket"`
+	Rows   []UsageRow  `json:"rows"`
+	Total  UsageTotals `json:"total"`
+}
+
+// UsageQuery selects usage. Zero fields take the proxy's defaults: the
+// last 24 hours, unbucketed and ungrouped.
+type UsageQuery struct {
+	From, To time.Time
+	Bucket   string   // hour, day or month
+	GroupBy  []string // of client, project, model and provider
+	Project  string
+	Model    string
+}
+
+func (q UsageQuery) values() url.Values {
+	v := url.Values{}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.UTC().Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.UTC().Format(time.RFC3339))
+	}
+	if q.Bucket != "" {
+		v.Set("bucket", q.Bucket)
+	}
+	if len(q.GroupBy) > 0 {
+		v.Set("group_by", strings.Join(q.GroupBy, ","))
+	}
+	if q.Project != "" {
+		v.Set("project", q.Project)
+	}
+	if q.Model != "" {
+		v.Set("model", q.Model)
+	}
+	return v
+}
+
+// Usage reports the calling client's usage.
+func (c *Client) Usage(ctx context.Context, q UsageQuery) (*UsageReport, error) {
+	var out UsageReport
+	if err := c.Do(ctx, http.MethodGet, "/usage/me?"+q.values().Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ModelUsage is a key's usage of one model.
+type ModelUsage struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+// KeyStats is what a virtual key has been used for on the replica that
+// answered.
+type KeyStats struct {
+	ID        string           `json:"id"`
+	Client    string           `json:"client"`
+	Since     time.Time        `json:"since"`
+	LastUsed  *time.Time       `json:"last_used,omitempty"`
+	Total     UsageTotals      `json:"total"`
+	Errors    map[string]int64 `json:"errors"`
+	TopModels []ModelUsage     `json:"top_models"`
+}
+
+// KeyStats reports the stats of the virtual key id, which must be the
+// client's key.
+func (c *Client) KeyStats(ctx context.Context, id string) (*KeyStats, error) {
+	var out KeyStats
+	if err := c.Do(ctx, http.MethodGet, "/keys/"+url.PathEscape(id)+"/stats", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientIPConfig sets how callers' addresses are found. TrustedProxies are
+// the addresses and CIDR ranges of proxies in front of this one: from them
+// the client is the right-most address of Forwarded, or else
+// X-Forwarded-For, that isn't itself trusted; from anyone else it is the
+// connection's peer and the headers are ignored. Requests go upstream
+// with the peer appended to the X-Forwarded-For (and Forwarded, if sent)
+// of trusted proxies, or replacing those of anyone else, and with
+// X-Forwarded-Proto and X-Forwarded-Host likewise. RequestsPerMinute, when
+// set, limits each client IP.
+type ClientIPConfig struct {
+	TrustedProxies    []string `json:"trusted_proxies,omitempty"`
+	RequestsPerMinute int      `json:"requests_per_minute,omitempty"`
+}
+
+func (c *ClientIPConfig) validate() error {
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		return fmt.Errorf("client_ip: trusted_proxies: %w", err)
+	}
+	if c.RequestsPerMinute < 0 {
+		return fmt.Errorf("client_ip: requests_per_minute must not be negative")
+	}
+	return nil
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad address %q", s)
+			}
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad prefix %q", s)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+var ipRejections = metrics.counter("zai_proxy_ip_rate_limited_total", "Requests refused for their client IP's rate.")
+
+// clientIPs resolves client addresses and counts requests per address.
+type clientIPs struct {
+	cfg     *ClientIPConfig
+	trusted []netip.Prefix
+	shared  rateCounter // when set, counts requests for every replica
+
+	mu     sync.Mutex
+	minute int64
+	counts map[netip.Addr]int
+}
+
+func newClientIPs(cfg *ClientIPConfig) *clientIPs {
+	trusted, _ := parsePrefixes(cfg.TrustedProxies)
+	return &clientIPs{cfg: cfg, trusted: trusted, counts: map[netip.Addr]int{}}
+}
+
+func (c *clientIPs) isTrusted(a netip.Addr) bool {
+	for _, p := range c.trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer is the address of r's connection.
+func peer(r *http.Request) (netip.Addr, bool) {
+	a, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Addr().Unmap(), true
+}
+
+// resolve returns the client's address for r, or "" when r has no peer.
+func (c *clientIPs) resolve(r *http.Request) string {
+	a, ok := peer(r)
+	if !ok {
+		return ""
+	}
+	if !c.isTrusted(a) {
+		return a.String()
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		h, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Trusted proxies don't write garbage; stop at what can't be believed.
+			break
+		}
+		if a = h.Unmap(); !c.isTrusted(a) {
+			break
+		}
+	}
+	return a.String()
+}
+
+// forwardedFor is the chain of addresses the request passed through,
+// oldest first, from Forwarded when present and else X-Forwarded-For.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		for _, v := range fwd {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hops = append(hops, hostOnly(strings.Trim(val, `"`)))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			hops = append(hops, hostOnly(strings.TrimSpace(s)))
+		}
+	}
+	return hops
+}
+
+// hostOnly strips a port and IPv6 brackets from a forwarded address.
+func hostOnly(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
+
+// setForwarded writes the forwarding headers of up, sent for r.
+func (c *clientIPs) setForwarded(up http.Header, r *http.Request) {
+	a, ok := peer(r)
+	trusted := ok && c.isTrusted(a)
+	if !trusted {
+		for _, k := range []string{"X-Forwarded-For", "Forwarded", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+			up.Del(k)
+		}
+	}
+	if !ok {
+		return
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if prior := up.Values("X-Forwarded-For"); len(prior) > 0 {
+		up.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+a.String())
+	} else {
+		up.Set("X-Forwarded-For", a.String())
+	}
+	if prior := up.Values("Forwarded"); len(prior) > 0 {
+		node := a.String()
+		if a.Is6() {
+			node = `"[` + node + `]"`
+		}
+		up.Set("Forwarded", strings.Join(prior, ", ")+", for="+node+";proto="+proto)
+	}
+	if up.Get("X-Forwarded-Proto") == "" {
+		up.Set("X-Forwarded-Proto", proto)
+	}
+	if up.Get("X-Forwarded-Host") == "" {
+		up.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+// allow counts a request from ip, reporting whether it is within the rate,
+// how many more it may make this minute, -1 when unlimited, and if not
+// within it how long until the next minute.
+func (c *clientIPs) allow(ip string, now time.Time) (bool, int, time.Duration) {
+	limit := c.cfg.RequestsPerMinute
+	a, err := netip.ParseAddr(ip)
+	if limit == 0 || err != nil {
+		return true, -1, 0
+	}
+	minute := now.Unix() / 60
+	if c.shared != nil {
+		n, err := c.shared.countMinute("ip:"+a.String(), minute)
+		if err == nil {
+			if n > int64(limit) {
+				return false, 0, time.Unix((minute+1)*60, 0).Sub(now)
+			}
+			return true, limit - int(n), 0
+		}
+		log.Printf("Error counting shared rate, using this replica's: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.minute != minute {
+		c.minute, c.counts = minute, map[netip.Addr]int{}
+	}
+	if c.counts[a] >= limit {
+		return false, 0, time.Unix((minute+1)*60, 0).Sub(now)
+	}
+	c.counts[a]++
+	return true, limit - c.counts[a], 0
+}
+
+// checkIP refuses requests over their client IP's rate.
+func (p *proxy) checkIP(w http.ResponseWriter, ex *exchange) bool {
+	ok, left, retry := p.ips.allow(ex.ip, ex.start)
+	if left >= 0 {
+		ex.rateLimits = append(ex.rateLimits, minuteRate("client_ip_rate", p.ips.cfg.RequestsPerMinute, left, ex.start))
+	}
+	if !ok {
+		ipRejections.Add(1)
+		writeLimitError(w, http.StatusTooManyRequests, "rate_limited", "too many requests from "+ex.ip, "client_ip_rate", retry)
+	}
+	return ok
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestClientIPResolve finds callers' addresses: the peer's unless it is a
+// trusted proxy, then the right-most forwarded address not trusted.
+func TestClientIPResolve(t *testing.T) {
+	c := newClientIPs(&ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}})
+	for _, tc := range []struct {
+		name, peer string
+		header     http.Header
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's headers ignored", "203.0.113.7:5000",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.2"}}, "203.0.113.7"},
+		{"through a trusted proxy", "10.1.2.3:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed left of a real hop", "10.1.2.3:5000",
+			http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.9.9.9"}}, "198.51.100.1"},
+		{"hops split over headers", "10.1.2.3:5000",
+			http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1"}}, "198.51.100.1"},
+		{"Forwarded over X-Forwarded-For", "10.1.2.3:5000",
+			http.Header{"Forwarded": {`for=198.51.100.2;proto=https, for="10.0.0.9"`}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.2"},
+		{"Forwarded IPv6 with port", "10.1.2.3:5000", http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"garbage stops the walk", "10.1.2.3:5000", http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}}, "10.1.2.3"},
+		{"obfuscated identifier", "10.1.2.3:5000", http.Header{"Forwarded": {"for=_hidden"}}, "10.1.2.3"},
+		{"all hops trusted", "10.1.2.3:5000", http.Header{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2"}}, "10.0.0.1"},
+		{"no headers from a trusted proxy", "10.1.2.3:5000", nil, "10.1.2.3"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:443", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"IPv4-mapped peer", "[::ffff:10.1.2.3]:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"IPv4-mapped hop", "10.1.2.3:5000", http.Header{"X-Forwarded-For": {"::ffff:198.51.100.1"}}, "198.51.100.1"},
+		{"no peer", "pipe", nil, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		for k, v := range tc.header {
+			r.Header[k] = v
+		}
+		if got := c.resolve(r); got != tc.want {
+			t.Errorf("%s: resolve = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestSetForwarded checks what upstreams are told: an untrusted caller's
+// forwarding headers are replaced, a trusted proxy's extended.
+func TestSetForwarded(t *testing.T) {
+	c := newClientIPs(&ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	for _, tc := range []struct {
+		name, peer string
+		header     http.Header
+		want       http.Header
+	}{
+		{"untrusted", "203.0.113.7:5000",
+			http.Header{"X-Forwarded-For": {"1.1.1.1"}, "Forwarded": {"for=1.1.1.1"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"evil.example"}},
+			http.Header{"X-Forwarded-For": {"203.0.113.7"}, "X-Forwarded-Proto": {"http"}, "X-Forwarded-Host": {"proxy.example"}}},
+		{"trusted", "10.1.2.3:5000",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.1"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"api.example"}},
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 10.1.2.3"}, "Forwarded": {"for=198.51.100.1, for=10.1.2.3;proto=http"},
+				"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"api.example"}}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example/", nil)
+		r.RemoteAddr = tc.peer
+		up := tc.header.Clone()
+		c.setForwarded(up, r)
+		for _, k := range []string{"X-Forwarded-For", "Forwarded", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+			if got, want := up.Get(k), tc.want.Get(k); got != want || len(up.Values(k)) > 1 {
+				t.Errorf("%s: %s = %q, want %q", tc.name, k, up.Values(k), want)
+			}
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::7]:443"
+	up := http.Header{"Forwarded": {"for=198.51.100.1"}}
+	newClientIPs(&ClientIPConfig{TrustedProxies: []string{"2001:db8::/32"}}).setForwarded(up, r)
+	if got := up.Get("Forwarded"); got != `for=198.51.100.1, for="[2001:db8::7]";proto=http` {
+		t.Errorf("IPv6 Forwarded = %q", got)
+	}
+}
+
+type fakeRateCounter struct {
+	counts map[string]int64
+	err    error
+}
+
+func (f *fakeRateCounter) countMinute(name string, minute int64) (int64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.counts[name]++
+	return f.counts[name], nil
+}
+
+// TestClientIPAllow limits each address per minute, here or across
+// replicas, falling back to this replica's counts when the shared ones
+// can't be had.
+func TestClientIPAllow(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 45, 0, time.UTC)
+	c := newClientIPs(&ClientIPConfig{RequestsPerMinute: 2})
+	for i, want := range []int{1, 0} {
+		if ok, left, _ := c.allow("198.51.100.1", now); !ok || left != want {
+			t.Errorf("request %d: allow = %v, %d left; want %d", i, ok, left, want)
+		}
+	}
+	if ok, _, retry := c.allow("198.51.100.1", now); ok || retry != 15*time.Second {
+		t.Errorf("over the rate: allow = %v, retry %v; want refused for 15s", ok, retry)
+	}
+	if ok, _, _ := c.allow("::ffff:198.51.100.2", now); !ok {
+		t.Errorf("another address was refused")
+	}
+	if ok, _, _ := c.allow("198.51.100.1", now.Add(15*time.Second)); !ok {
+		t.Errorf("refused in the next minute")
+	}
+	if ok, left, _ := c.allow("", now); !ok || left != -1 {
+		t.Errorf("no address: allow = %v, %d; want unlimited", ok, left)
+	}
+	if ok, left, _ := newClientIPs(&ClientIPConfig{}).allow("198.51.100.1", now); !ok || left != -1 {
+		t.Errorf("no limit: allow = %v, %d", ok, left)
+	}
+
+	shared := &fakeRateCounter{counts: map[string]int64{"ip:198.51.100.1": 2}}
+	c = newClientIPs(&ClientIPConfig{RequestsPerMinute: 2})
+	c.shared = shared
+	if ok, _, _ := c.allow("198.51.100.1", now); ok {
+		t.Errorf("allowed over the shared count")
+	}
+	shared.err = errors.New("redis: connection refused")
+	if ok, left, _ := c.allow("198.51.100.1", now); !ok || left != 1 {
+		t.Errorf("shared count failing: allow = %v, %d; want this replica's", ok, left)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientConfig names a consumer of the proxy. Keys are the virtual keys that
+// identify it, either in plain text or as "sha256:<hex>" digests so the
+// config file need not hold secrets.
+type ClientConfig struct {
+	Name  string      `json:"name"`
+	Keys  []string    `json:"keys"`
+	Quota QuotaConfig `json:"quota"`
+
+	// Tier and Labels are free-form attributes for config expressions.
+	Tier   string            `json:"tier,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Transforms []TransformRule `json:"transforms"`
+	Params     *ParamPolicy    `json:"params"`
+	// Models overrides the global model access list for this client.
+	Models *ModelAccess `json:"models"`
+	// Defaults fills in what this client's requests leave out.
+	Defaults *ClientDefaults `json:"defaults,omitempty"`
+	// Errors reshapes the errors the proxy sends this client.
+	Errors *ErrorTemplate `json:"errors,omitempty"`
+	// Priorities are the tiers its requests may ask for; by default
+	// normal and low.
+	Priorities []string `json:"priorities,omitempty"`
+}
+
+// VirtualKey is a client credential issued by the proxy and kept in the
+// store. Only the SHA-256 of the secret is persisted.
+type VirtualKey struct {
+	ID        string     `json:"id"`
+	Client    string     `json:"client"`
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// newVirtualKey mints a key for client, returning it with its secret.
+func newVirtualKey(client string) (VirtualKey, string) {
+	var id [6]byte
+	var secret [24]byte
+	rand.Read(id[:])
+	rand.Read(secret[:])
+	s := "rk-" + hex.EncodeToString(secret[:])
+	return VirtualKey{
+		ID:        "key_" + hex.EncodeToString(id[:]),
+		Client:    client,
+		Hash:      hashKey(s),
+		CreatedAt: time.Now().UTC(),
+	}, s
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// presentedKey extracts the caller's credential from the request.
+func presentedKey(r *http.Request) string {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" {
+		token = r.Header.Get("X-Api-Key")
+	}
+	return token
+}
+
+// keyCacheTTL bounds how long a store lookup (including a revocation) may
+// be served from memory.
+const keyCacheTTL = 30 * time.Second
+
+type cachedKey struct {
+	client  string
+	id      string // of the virtual key
+	expires time.Time
+}
+
+// clientRegistry resolves callers to client names using the static keys in
+// the config and the virtual keys in the store.
+type clientRegistry struct {
+	clients map[string]*ClientConfig
+	static  map[string]string // key hash -> client name
+	store   Store
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+}
+
+func newClientRegistry(cfg *Config, store Store) *clientRegistry {
+	reg := &clientRegistry{
+		clients: make(map[string]*ClientConfig),
+		static:  make(map[string]string),
+		store:   store,
+		cache:   make(map[string]cachedKey),
+	}
+	for i := range cfg.Clients {
+		c := &cfg.Clients[i]
+		reg.clients[c.Name] = c
+		for _, k := range c.Keys {
+			if h, ok := strings.CutPrefix(k, "sha256:"); ok {
+				reg.static[strings.ToLower(h)] = c.Name
+			} else {
+				reg.static[hashKey(k)] = c.Name
+			}
+		}
+	}
+	return reg
+}
+
+// Identify returns the client name for the request. Unrecognized
+// credentials are attributed to a short fingerprint of the key so usage is
+// still separable; requests without one are "anonymous".
+func (c *clientRegistry) Identify(r *http.Request) string {
+	token := presentedKey(r)
+	if token == "" {
+		return "anonymous"
+	}
+	h := hashKey(token)
+	if name, ok := c.static[h]; ok {
+		return name
+	}
+	if k := c.lookup(r.Context(), h); k.client != "" {
+		return k.client
+	}
+	return "key-" + h[:12]
+}
+
+// KeyID returns the ID of the live virtual key the request presents, or ""
+// when it presents a static key or none.
+func (c *clientRegistry) KeyID(r *http.Request) string {
+	token := presentedKey(r)
+	if token == "" {
+		return ""
+	}
+	h := hashKey(token)
+	if _, ok := c.static[h]; ok {
+		return ""
+	}
+	return c.lookup(r.Context(), h).id
+}
+
+func (c *clientRegistry) lookup(ctx context.Context, hash string) cachedKey {
+	if c.store == nil {
+		return cachedKey{}
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.cache[hash]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e
+	}
+	e = cachedKey{expires: now.Add(keyCacheTTL)}
+	k, err := c.store.LookupKey(ctx, hash)
+	switch {
+	case err != nil:
+		log.Printf("Error looking up virtual key: %v", err)
+		return cachedKey{}
+	case k != nil && k.RevokedAt == nil:
+		e.client, e.id = k.Client, k.ID
+	}
+	c.mu.Lock()
+	c.cache[hash] = e
+	c.mu.Unlock()
+	return e
+}
+
+// Forget drops cached lookups so revocations take effect immediately on
+// this replica.
+func (c *clientRegistry) Forget() {
+	c.mu.Lock()
+	clear(c.cache)
+	c.mu.Unlock()
+}
+
+// Client returns the configured client, or nil.
+func (c *clientRegistry) Client(name string) *ClientConfig {
+	return c.clients[name]
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterConfig joins replicas into a cluster that shares state without
+// Redis. Each listens on Listen for its peers and every Interval (default
+// 1s) exchanges with them the upstreams whose circuits it has opened,
+// which they then avoid too, and what it has seen of each upstream. With
+// RateLimits, it also exchanges its request counts for the minute, so
+// client IP and agent rates hold for the cluster rather than each replica,
+// as closely as the interval allows. Peers are found from Peers, host:port
+// addresses whose hosts may resolve to several replicas (a headless
+// service, say), and from the peers those know. Advertise is the address
+// peers reach this replica at, by default Listen's port on the address
+// they see it exchange from. Every replica needs the same Secret.
+type ClusterConfig struct {
+	Listen     string   `json:"listen,omitempty"`
+	Advertise  string   `json:"advertise,omitempty"`
+	Peers      []string `json:"peers,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Interval   Duration `json:"interval,omitempty"`
+	RateLimits bool     `json:"rate_limits,omitempty"`
+}
+
+func (c *ClusterConfig) validate(redis RedisConfig) error {
+	if c.Listen == "" {
+		if len(c.Peers) > 0 || c.RateLimits {
+			return fmt.Errorf("cluster: peers and rate_limits need a listen address")
+		}
+		return nil
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("cluster: a secret is needed")
+	}
+	for _, a := range append([]string{c.Listen}, c.Peers...) {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("cluster: %q must be host:port", a)
+		}
+	}
+	if c.Advertise != "" {
+		if _, _, err := net.SplitHostPort(c.Advertise); err != nil {
+			return fmt.Errorf("cluster: advertise must be host:port")
+		}
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("cluster: interval must not be negative")
+	}
+	if c.RateLimits && redis.RateLimits {
+		return fmt.Errorf("cluster: rate_limits is already shared through redis")
+	}
+	return nil
+}
+
+// rateCounter counts requests across replicas: Redis or the cluster.
+type rateCounter interface {
+	// countMinute counts one more request named by name in the given unix
+	// minute and returns the count.
+	countMinute(name string, minute int64) (int64, error)
+}
+
+const clusterPath = "/cluster/exchange"
+
+var clusterPeers = metrics.gauge("zai_proxy_cluster_peers", "Peers heard from recently.")
+
+// clusterState is what a replica tells its peers.
+type clusterState struct {
+	Node     string              `json:"node"`
+	Addr     string              `json:"addr"`
+	Peers    []string            `json:"peers,omitempty"`
+	Minute   int64               `json:"minute,omitempty"`
+	Counts   map[string]int64    `json:"counts,omitempty"`
+	Circuits map[string]Duration `json:"circuits,omitempty"` // open, for how much longer
+	Traffic  []UpstreamStatus    `json:"traffic,omitempty"`
+}
+
+// ClusterPeer is a peer as last heard from.
+type ClusterPeer struct {
+	Node     string              `json:"node"`
+	Addr     string              `json:"addr"`
+	Seen     time.Time           `json:"seen"`
+	Circuits map[string]Duration `json:"circuits,omitempty"`
+	Traffic  []UpstreamStatus    `json:"traffic,omitempty"`
+}
+
+// cluster is this replica's view of its peers.
+type cluster struct {
+	cfg       *ClusterConfig
+	node      string
+	circuits  *circuits
+	upstreams *upstreamTracker
+	client    *http.Client
+	started   time.Time
+
+	mu     sync.Mutex
+	minute int64
+	counts map[string]int64        // this replica's, for minute
+	addrs  map[string]time.Time    // peer addresses, by when learned or last heard from
+	self   map[string]bool         // addresses that reached this replica
+	nodes  map[string]*clusterNode // by node
+}
+
+type clusterNode struct {
+	state clusterState
+	seen  time.Time
+}
+
+// newCluster returns this replica's cluster, or nil when it joins none.
+func newCluster(cfg *ClusterConfig, c *circuits, t *upstreamTracker) *cluster {
+	if cfg.Listen == "" {
+		return nil
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &cluster{cfg: cfg, node: hex.EncodeToString(b), circuits: c, upstreams: t,
+		client: &http.Client{Timeout: 2 * time.Second}, started: time.Now(),
+		counts: map[string]int64{}, addrs: map[string]time.Time{}, self: map[string]bool{}, nodes: map[string]*clusterNode{}}
+}
+
+func (c *cluster) interval() time.Duration {
+	return cmp.Or(time.Duration(c.cfg.Interval), time.Second)
+}
+
+// forget is how long a peer is kept without being heard from.
+func (c *cluster) forget() time.Duration {
+	return max(30*c.interval(), time.Minute)
+}
+
+// live reports whether n was heard from recently enough to count; callers
+// hold mu.
+func (c *cluster) live(n *clusterNode, now time.Time) bool {
+	return now.Sub(n.seen) < 3*c.interval()+2*time.Second
+}
+
+func (c *cluster) countMinute(name string, minute int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.minute != minute {
+		c.minute, c.counts = minute, map[string]int64{}
+	}
+	c.counts[name]++
+	n := c.counts[name]
+	now := time.Now()
+	for _, nd := range c.nodes {
+		if nd.state.Minute == minute && c.live(nd, now) {
+			n += nd.state.Counts[name]
+		}
+	}
+	return n, nil
+}
+
+// state returns what to tell peers.
+func (c *cluster) state() clusterState {
+	s := clusterState{Node: c.node, Addr: cmp.Or(c.cfg.Advertise, c.cfg.Listen), Circuits: map[string]Duration{}}
+	now := time.Now()
+	for m, until := range c.circuits.opened() {
+		s.Circuits[m] = Duration(until.Sub(now))
+	}
+	s.Traffic = c.upstreams.snapshot()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Only peers heard from, so addresses gone dead aren't passed around.
+	for _, nd := range c.nodes {
+		if c.live(nd, now) {
+			s.Peers = append(s.Peers, nd.state.Addr)
+		}
+	}
+	sort.Strings(s.Peers)
+	if c.cfg.RateLimits && c.minute == now.Unix()/60 {
+		s.Minute, s.Counts = c.minute, make(map[string]int64, len(c.counts))
+		for k, v := range c.counts {
+			s.Counts[k] = v
+		}
+	}
+	return s
+}
+
+// learn takes in a peer's state, heard from addr.
+func (c *cluster) learn(addr string, s clusterState) {
+	if s.Node == c.node {
+		c.mu.Lock()
+		c.self[addr] = true
+		delete(c.addrs, addr)
+		c.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	for m, d := range s.Circuits {
+		c.circuits.openUntil(m, now.Add(time.Duration(d)))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.Addr = addr
+	c.nodes[s.Node] = &clusterNode{state: s, seen: now}
+	c.addrs[addr] = now
+	for _, a := range s.Peers {
+		if _, ok := c.addrs[a]; !ok && !c.self[a] {
+			c.addrs[a] = now
+		}
+	}
+}
+
+// seeds resolves the configured peers to addresses.
+func (c *cluster) seeds(ctx context.Context) []string {
+	var out []string
+	for _, p := range c.cfg.Peers {
+		host, port, _ := net.SplitHostPort(p)
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			debugf("Error resolving cluster peer %s: %v", p, err)
+			continue
+		}
+		for _, ip := range ips {
+			out = append(out, net.JoinHostPort(ip, port))
+		}
+	}
+	return out
+}
+
+// run exchanges state with every peer each interval until ctx is done.
+func (c *cluster) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval())
+	defer ticker.Stop()
+	for {
+		c.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *cluster) round(ctx context.Context) {
+	seeds := c.seeds(ctx)
+	body, _ := json.Marshal(c.state())
+	now := time.Now()
+	c.mu.Lock()
+	for _, a := range seeds {
+		if _, ok := c.addrs[a]; !ok && !c.self[a] {
+			c.addrs[a] = now
+		}
+	}
+	var addrs []string
+	for a, at := range c.addrs {
+		if now.Sub(at) >= c.forget() {
+			delete(c.addrs, a)
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	live := 0
+	for id, nd := range c.nodes {
+		if now.Sub(nd.seen) >= c.forget() {
+			delete(c.nodes, id)
+		} else if c.live(nd, now) {
+			live++
+		}
+	}
+	c.mu.Unlock()
+	clusterPeers.Set(float64(live))
+
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		wg.Add(1)
+		go func(a string) {
+			defer wg.Done()
+			s, err := c.exchange(ctx, a, body)
+			if err != nil {
+				debugf("Error exchanging state with cluster peer %s: %v", a, err)
+				return
+			}
+			c.learn(a, s)
+		}(a)
+	}
+	wg.Wait()
+}
+
+// exchange sends this replica's state to addr and returns addr's.
+func (c *cluster) exchange(ctx context.Context, addr string, body []byte) (clusterState, error) {
+	var s clusterState
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+clusterPath, bytes.NewReader(body))
+	if err != nil {
+		return s, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.cfg.Secret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
+
+// ServeHTTP answers a peer's exchange with this replica's state.
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.cfg.Secret)) != 1 {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid cluster secret")
+		return
+	}
+	var s clusterState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&s); err != nil || s.Node == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid cluster state")
+		return
+	}
+	addr := s.Addr
+	if host, port, err := net.SplitHostPort(addr); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+		// The peer listens on every address; it is reachable at the one
+		// it came from.
+		remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+		addr = net.JoinHostPort(remote, port)
+	}
+	c.learn(addr, s)
+	writeJSON(w, http.StatusOK, c.state())
+}
+
+// lowest reports whether this replica has the lowest node ID of the live
+// members. Until it has had time to hear from its peers, it doesn't know.
+func (c *cluster) lowest() bool {
+	now := time.Now()
+	if now.Sub(c.started) < 3*c.interval()+2*time.Second {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, nd := range c.nodes {
+		if id < c.node && c.live(nd, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// peers returns the peers heard from, by node.
+func (c *cluster) peers() []ClusterPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]ClusterPeer, 0, len(c.nodes))
+	for _, nd := range c.nodes {
+		out = append(out, ClusterPeer{Node: nd.state.Node, Addr: nd.state.Addr, Seen: nd.seen.UTC(),
+			Circuits: nd.state.Circuits, Traffic: nd.state.Traffic})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+	return out
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compressed responses pass through untouched unless a stage inspects
+// response bodies (usage, filters, stream transforms, captures): then the
+// upstream is asked for gzip, which the transport decodes, and the
+// compress stage may encode the result again for the client.
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressStage gzips unstreamed responses of at least
+// ForwardConfig.GzipMinBytes for clients that accept it. It is outermost so
+// every other stage sees plain bodies.
+func compressStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		min := p.cfg.Forward.GzipMinBytes
+		if min == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: w, min: min}
+			defer gw.finish()
+			next.ServeHTTP(gw, r)
+		})
+	}, nil
+}
+
+// gzipWriter holds back the first min bytes of a response, then compresses
+// it if there are more. Event streams, audio, already encoded bodies,
+// responses declared shorter than min and ranged ones pass through: the
+// ranges of a download being resumed are of the bytes the upstream has.
+type gzipWriter struct {
+	http.ResponseWriter
+	min    int
+	status int
+	pass   bool
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	h := w.Header()
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	ct := h.Get("Content-Type")
+	w.pass = h.Get("Content-Encoding") != "" || strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "audio/") ||
+		code < 200 || code == http.StatusNoContent || code == http.StatusNotModified || err == nil && n < w.min ||
+		code == http.StatusPartialContent || h.Get("Accept-Ranges") == "bytes"
+	if w.pass {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.pass:
+		return w.ResponseWriter.Write(b)
+	case w.gz != nil:
+		return w.gz.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.min {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) start() error {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && (w.pass || w.gz != nil) {
+		f.Flush()
+	}
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a response too short to compress, or ends the gzip stream.
+func (w *gzipWriter) finish() {
+	switch {
+	case w.status == 0 || w.pass:
+	case w.gz != nil:
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+	default:
+		holdTrailers(w.Header())
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is the proxy configuration, read from the JSON file named by
+// ZAI_PROXY_CONFIG. Every field has a usable default so the file is optional.
+type Config struct {
+	Listen      string                    `json:"listen"`
+	Target      string                    `json:"target"`
+	AdminToken  string                    `json:"admin_token"`
+	Admin       AdminConfig               `json:"admin"`
+	Listeners   []ListenerConfig          `json:"listeners,omitempty"`
+	Upstreams   []UpstreamConfig          `json:"upstreams"`
+	Maintenance MaintenanceConfig         `json:"maintenance"`
+	Flags       map[string]FlagConfig     `json:"flags"`
+	Log         LogConfig                 `json:"log"`
+	Recording   RecordingConfig           `json:"recording"`
+	Capture     CaptureConfig             `json:"capture"`
+	Archive     ArchiveConfig             `json:"archive"`
+	Alerts      AlertsConfig              `json:"alerts"`
+	Mocks       map[string]MockProfile    `json:"mocks,omitempty"`
+	Tokenizers  []TokenizerConfig         `json:"tokenizers,omitempty"`
+	Forward     ForwardConfig             `json:"forward"`
+	Circuit     CircuitConfig             `json:"circuit"`
+	Health      HealthConfig              `json:"health"`
+	Transport   TransportConfig           `json:"transport"`
+	Memory      MemoryConfig              `json:"memory"`
+	Fanout      FanoutConfig              `json:"fanout"`
+	BestOf      BestOfConfig              `json:"best_of"`
+	Consensus   ConsensusConfig           `json:"consensus"`
+	AutoRoute   AutoRouteConfig           `json:"auto_route"`
+	Experiments []ExperimentConfig        `json:"experiments,omitempty"`
+	Evals       EvalConfig                `json:"evals"`
+	Sessions    SessionConfig             `json:"sessions"`
+	Context     ContextConfig             `json:"context"`
+	Embeddings  EmbeddingsConfig          `json:"embeddings"`
+	Jobs        JobsConfig                `json:"jobs"`
+	Batches     BatchConfig               `json:"batches"`
+	Pipelines   map[string]PipelineConfig `json:"pipelines,omitempty"`
+	Tools       ToolsConfig               `json:"tools"`
+	Files       FilesConfig               `json:"files"`
+	Images      ImagesConfig              `json:"images"`
+	Speech      SpeechConfig              `json:"speech"`
+	Realtime    RealtimeConfig            `json:"realtime"`
+	Sticky      StickyConfig              `json:"sticky"`
+	Objectives  ObjectivesConfig          `json:"objectives"`
+	Priority    PriorityConfig            `json:"priority"`
+	Agents      AgentsConfig              `json:"agents"`
+	ClientIP    ClientIPConfig            `json:"client_ip"`
+	Idempotency IdempotencyConfig         `json:"idempotency"`
+	Fallback    FallbackConfig            `json:"fallback"`
+	Resume      ResumeConfig              `json:"resume"`
+	Validation  ValidationConfig          `json:"validation"`
+	JSONMode    JSONModeConfig            `json:"json_mode"`
+	Errors      ErrorTemplate             `json:"errors"`
+	// Templates are the named prompt templates, each a list of versions.
+	Templates map[string][]TemplateVersion `json:"templates,omitempty"`
+	// ScheduledPrompts run prompts and pipelines on schedules.
+	ScheduledPrompts []ScheduledPrompt `json:"scheduled_prompts,omitempty"`
+	Pricing          PriceTable        `json:"pricing"`
+	UpstreamAuth     UpstreamAuth      `json:"upstream_auth"`
+
+	Clients    []ClientConfig   `json:"clients"`
+	Projects   []string         `json:"projects"`
+	Storage    StorageConfig    `json:"storage"`
+	Redis      RedisConfig      `json:"redis"`
+	Cluster    ClusterConfig    `json:"cluster"`
+	Leader     LeaderConfig     `json:"leader"`
+	Restart    RestartConfig    `json:"restart"`
+	Snapshot   SnapshotConfig   `json:"snapshot"`
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	Reports    []ReportConfig   `json:"reports"`
+	Billing    BillingConfig    `json:"billing"`
+	Routes     []RouteConfig    `json:"routes"`
+	Plugins    []PluginConfig   `json:"plugins"`
+	Filters    []FilterConfig   `json:"filters"`
+
+	// Transforms apply to every route, before route and client rules.
+	Transforms []TransformRule `json:"transforms"`
+	// Access rules apply to every route, before the route's own.
+	Access []AccessRule `json:"access"`
+	// Models is the model access list for clients without their own.
+	Models *ModelAccess `json:"models"`
+	// Deprecations remap retired models to their successors.
+	Deprecations []ModelDeprecation `json:"deprecations,omitempty"`
+	// SystemPrompts are injected into chat requests after the transforms.
+	SystemPrompts []SystemPrompt `json:"system_prompts"`
+	// Retrieval adds retrieved passages to chat requests.
+	Retrieval []RetrievalConfig `json:"retrieval,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON strings like "720h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:  ":8080",
+		Target:  "https://api.z.ai",
+		Pricing: PriceTable{},
+		Storage: StorageConfig{
+			DSN:       "zai-proxy.db",
+			Retention: Duration(90 * 24 * time.Hour),
+		},
+		Routes:    []RouteConfig{{Pattern: "/"}},
+		Transport: defaultTransportConfig(),
+	}
+}
+
+// loadConfig reads the config file at path over the defaults, with the
+// environment applied. An empty path starts from the defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg, _, err := resolveConfig(path, nil)
+	return cfg, err
+}
+
+func (c *Config) validate() error {
+	seen := make(map[string]bool)
+	for _, cl := range c.Clients {
+		if cl.Name == "" {
+			return fmt.Errorf("clients: every client needs a name")
+		}
+		if seen[cl.Name] {
+			return fmt.Errorf("clients: duplicate name %q", cl.Name)
+		}
+		seen[cl.Name] = true
+	}
+	for _, cl := range c.Clients {
+		for i := range cl.Transforms {
+			if err := cl.Transforms[i].validate(); err != nil {
+				return fmt.Errorf("client %q: transforms: %w", cl.Name, err)
+			}
+		}
+		if cl.Params != nil {
+			if err := cl.Params.validate(); err != nil {
+				return fmt.Errorf("client %q: params: %w", cl.Name, err)
+			}
+		}
+		if cl.Defaults != nil {
+			if err := cl.Defaults.validate(); err != nil {
+				return fmt.Errorf("client %q: defaults: %w", cl.Name, err)
+			}
+		}
+		if cl.Errors != nil {
+			if err := cl.Errors.validate(); err != nil {
+				return fmt.Errorf("client %q: errors: %w", cl.Name, err)
+			}
+		}
+		if err := validPriorities(cl.Priorities); err != nil {
+			return fmt.Errorf("client %q: %w", cl.Name, err)
+		}
+	}
+	for i := range c.Transforms {
+		if err := c.Transforms[i].validate(); err != nil {
+			return fmt.Errorf("transforms: %w", err)
+		}
+	}
+	if err := c.Maintenance.validate(); err != nil {
+		return fmt.Errorf("maintenance: %w", err)
+	}
+	if err := c.ClientIP.validate(); err != nil {
+		return err
+	}
+	if err := c.Agents.validate(); err != nil {
+		return err
+	}
+	if err := c.Sticky.validate(); err != nil {
+		return err
+	}
+	if err := c.Objectives.validate(); err != nil {
+		return err
+	}
+	if err := c.Priority.validate(); err != nil {
+		return err
+	}
+	if err := c.Realtime.validate(); err != nil {
+		return err
+	}
+	if err := c.Speech.validate(); err != nil {
+		return err
+	}
+	if err := c.Images.validate(); err != nil {
+		return err
+	}
+	if err := c.Files.validate(); err != nil {
+		return err
+	}
+	if err := c.Tools.validate(); err != nil {
+		return err
+	}
+	for i := range c.Retrieval {
+		if err := c.Retrieval[i].validate(); err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{}
+	for i := range c.ScheduledPrompts {
+		s := &c.ScheduledPrompts[i]
+		if err := s.validate(c.Pipelines); err != nil {
+			return err
+		}
+		if names[s.Name] {
+			return fmt.Errorf("scheduled prompt %s: defined twice", s.Name)
+		}
+		names[s.Name] = true
+	}
+	for name, pc := range c.Pipelines {
+		if err := pc.validate(name); err != nil {
+			return err
+		}
+	}
+	if err := c.Batches.validate(); err != nil {
+		return err
+	}
+	if err := c.Jobs.validate(); err != nil {
+		return err
+	}
+	if err := c.Context.validate(); err != nil {
+		return err
+	}
+	if err := c.Embeddings.validate(); err != nil {
+		return err
+	}
+	for i := range c.Deprecations {
+		if err := c.Deprecations[i].validate(); err != nil {
+			return fmt.Errorf("deprecations[%d]: %w", i, err)
+		}
+	}
+	if err := c.Redis.validate(); err != nil {
+		return err
+	}
+	if err := c.Cluster.validate(c.Redis); err != nil {
+		return err
+	}
+	if err := c.Leader.validate(c.Redis, c.Cluster); err != nil {
+		return err
+	}
+	if err := c.Circuit.validate(); err != nil {
+		return err
+	}
+	if err := c.Health.validate(); err != nil {
+		return err
+	}
+	if err := validateListeners(c.Listeners); err != nil {
+		return err
+	}
+	if c.Listen == "" && !c.serves("proxy") {
+		return fmt.Errorf("listen: nothing serves the proxy; set listen or a proxy listener")
+	}
+	if err := c.Restart.validate(); err != nil {
+		return err
+	}
+	if err := c.Snapshot.validate(); err != nil {
+		return err
+	}
+	if err := c.Kubernetes.validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.validate(); err != nil {
+		return err
+	}
+	if err := c.Sessions.validate(c.Storage, c.Redis); err != nil {
+		return err
+	}
+	if err := c.Idempotency.validate(c.Storage, c.Redis); err != nil {
+		return err
+	}
+	if err := c.Resume.validate(); err != nil {
+		return err
+	}
+	if err := c.Fallback.validate(); err != nil {
+		return err
+	}
+	if err := c.JSONMode.validate(); err != nil {
+		return err
+	}
+	if err := c.Errors.validate(); err != nil {
+		return fmt.Errorf("errors: %w", err)
+	}
+	if err := c.Evals.validate(); err != nil {
+		return err
+	}
+	names = map[string]bool{}
+	for i := range c.Experiments {
+		if err := c.Experiments[i].validate(); err != nil {
+			return err
+		}
+		if names[c.Experiments[i].Name] {
+			return fmt.Errorf("experiment %s: defined twice", c.Experiments[i].Name)
+		}
+		names[c.Experiments[i].Name] = true
+	}
+	if err := c.AutoRoute.validate(); err != nil {
+		return err
+	}
+	if err := c.Consensus.validate(); err != nil {
+		return err
+	}
+	if err := c.BestOf.validate(); err != nil {
+		return err
+	}
+	if err := c.Fanout.validate(); err != nil {
+		return err
+	}
+	if err := c.Memory.validate(); err != nil {
+		return err
+	}
+	if err := c.Forward.validate(); err != nil {
+		return err
+	}
+	if err := c.Transport.validate(); err != nil {
+		return err
+	}
+	for _, t := range c.Tokenizers {
+		if len(t.Models) == 0 || t.File == "" {
+			return fmt.Errorf("every tokenizer needs models and a file")
+		}
+	}
+	for name, mp := range c.Mocks {
+		if err := mp.validate(name); err != nil {
+			return err
+		}
+	}
+	if err := c.Capture.validate(); err != nil {
+		return err
+	}
+	if err := c.Archive.validate(); err != nil {
+		return err
+	}
+	if err := c.Alerts.validate(); err != nil {
+		return err
+	}
+	if c.Recording.Record && c.Recording.Dir == "" {
+		return fmt.Errorf("recording: record needs a dir")
+	}
+	if c.Recording.MaxAge < 0 || c.Recording.MaxTotalBytes < 0 {
+		return fmt.Errorf("recording: max_age and max_total_bytes must not be negative")
+	}
+	if err := c.Log.validate(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	for name, f := range c.Flags {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("flags: %s: %w", name, err)
+		}
+	}
+	if err := validateTemplates(c.Templates); err != nil {
+		return err
+	}
+	if err := c.UpstreamAuth.validate(); err != nil {
+		return fmt.Errorf("upstream_auth: %w", err)
+	}
+	upstreams := make(map[string]bool)
+	for i := range c.Upstreams {
+		if err := c.Upstreams[i].validate(); err != nil {
+			return fmt.Errorf("upstreams: %w", err)
+		}
+		if upstreams[c.Upstreams[i].Name] {
+			return fmt.Errorf("upstreams: duplicate name %q", c.Upstreams[i].Name)
+		}
+		upstreams[c.Upstreams[i].Name] = true
+	}
+	plugins := make(map[string]bool)
+	for _, pc := range c.Plugins {
+		if pc.Name == "" || pc.Path == "" {
+			return fmt.Errorf("plugins: every plugin needs a name and a path")
+		}
+		if plugins[pc.Name] {
+			return fmt.Errorf("plugins: duplicate name %q", pc.Name)
+		}
+		plugins[pc.Name] = true
+	}
+	if err := validateAccess(c.Access); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	filters := make(map[string]bool)
+	for _, fc := range c.Filters {
+		if _, err := newContentFilter(fc); err != nil {
+			return fmt.Errorf("filters: %w", err)
+		}
+		if filters[fc.Name] {
+			return fmt.Errorf("filters: duplicate name %q", fc.Name)
+		}
+		filters[fc.Name] = true
+	}
+	for i := range c.SystemPrompts {
+		if err := c.SystemPrompts[i].validate(); err != nil {
+			return fmt.Errorf("system_prompts[%d]: %w", i, err)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].validate(); err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+	}
+	for model, p := range c.Pricing {
+		if p.Input < 0 || p.Output < 0 || p.CachedInput < 0 || p.CacheWrite < 0 {
+			return fmt.Errorf("pricing %q: rates must not be negative", model)
+		}
+	}
+	return nil
+}
+
+// secretMask replaces secret values in the config served to operators.
+const secretMask = "***"
+
+var dsnPassword = regexp.MustCompile(`(?i)(password=)[^\s&]*`)
+
+// masked returns the config as JSON-shaped data with secrets replaced.
+func (c *Config) masked() map[string]any {
+	b, _ := json.Marshal(c)
+	var m map[string]any
+	json.Unmarshal(b, &m)
+	mask := func(m map[string]any, key string) {
+		if s, _ := m[key].(string); s != "" {
+			m[key] = secretMask
+		}
+	}
+	// maskValues masks each value of an object such as headers, whose
+	// names are worth seeing but whose values carry credentials.
+	maskValues := func(m map[string]any, key string) {
+		vals, _ := m[key].(map[string]any)
+		for k := range vals {
+			vals[k] = secretMask
+		}
+	}
+	mask(m, "admin_token")
+	if a, ok := m["admin"].(map[string]any); ok {
+		mask(a, "token")
+	}
+	if bc, ok := m["billing"].(map[string]any); ok {
+		mask(bc, "secret")
+	}
+	if ac, ok := m["agents"].(map[string]any); ok {
+		mask(ac, "secret")
+	}
+	if rc, ok := m["redis"].(map[string]any); ok {
+		mask(rc, "password")
+	}
+	if cc, ok := m["cluster"].(map[string]any); ok {
+		mask(cc, "secret")
+	}
+	if al, ok := m["alerts"].(map[string]any); ok {
+		notify, _ := al["notify"].([]any)
+		for _, n := range notify {
+			if nm, ok := n.(map[string]any); ok {
+				if u, _ := nm["url"].(string); u != "" {
+					nm["url"] = maskURL(u)
+				}
+			}
+		}
+	}
+	listeners, _ := m["listeners"].([]any)
+	for _, l := range listeners {
+		if lm, ok := l.(map[string]any); ok {
+			mask(lm, "token")
+		}
+	}
+	if ev, ok := m["evals"].(map[string]any); ok {
+		suites, _ := ev["suites"].([]any)
+		for _, s := range suites {
+			if sm, ok := s.(map[string]any); ok {
+				mask(sm, "key")
+			}
+		}
+	}
+	prompts, _ := m["scheduled_prompts"].([]any)
+	for _, sp := range prompts {
+		if pm, ok := sp.(map[string]any); ok {
+			mask(pm, "key")
+		}
+	}
+	if tc, ok := m["tools"].(map[string]any); ok {
+		tools, _ := tc["tools"].([]any)
+		for _, te := range tools {
+			if tm, ok := te.(map[string]any); ok {
+				maskValues(tm, "headers")
+			}
+		}
+	}
+	retrieval, _ := m["retrieval"].([]any)
+	for _, rc := range retrieval {
+		if rm, ok := rc.(map[string]any); ok {
+			maskValues(rm, "headers")
+		}
+	}
+	if st, ok := m["storage"].(map[string]any); ok {
+		if dsn, _ := st["dsn"].(string); dsn != "" {
+			st["dsn"] = maskDSN(dsn)
+		}
+	}
+	clients, _ := m["clients"].([]any)
+	for _, cl := range clients {
+		cm, _ := cl.(map[string]any)
+		keys, _ := cm["keys"].([]any)
+		for i, k := range keys {
+			if s, _ := k.(string); !strings.HasPrefix(s, "sha256:") {
+				keys[i] = secretMask
+			}
+		}
+	}
+	return m
+}
+
+// maskURL hides all of a webhook URL but its scheme and host, as Slack's
+// and Discord's carry their secret in the path and others may in the
+// query or user info.
+func maskURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return secretMask
+	}
+	if u.User == nil && strings.Trim(u.Path, "/") == "" && u.RawQuery == "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return u.Scheme + "://" + u.Host + "/" + secretMask
+}
+
+// maskDSN hides the password in a URL or key=value connection string.
+func maskDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), secretMask)
+			return u.String()
+		}
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+secretMask)
+}
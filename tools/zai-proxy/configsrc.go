@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configSetting is a config value the environment or a serve flag can set
+// over the file. Flags win over the environment, which wins over the file.
+type configSetting struct {
+	path  string // JSON pointer into the config
+	env   string
+	flag  string // empty for secrets, which stay off command lines
+	usage string
+	set   func(c *Config, v string)
+}
+
+var configSettings = []configSetting{
+	{"/listen", "ZAI_PROXY_LISTEN", "listen", "data plane listen address",
+		func(c *Config, v string) { c.Listen = v }},
+	{"/target", "ZAI_PROXY_TARGET", "target", "default upstream URL",
+		func(c *Config, v string) { c.Target = v }},
+	{"/admin/listen", "ZAI_PROXY_ADMIN_LISTEN", "admin-listen", "admin API listen address or unix:/path",
+		func(c *Config, v string) { c.Admin.Listen = v }},
+	{"/log/level", "ZAI_PROXY_LOG_LEVEL", "log-level", "log level: debug, info, warn or error",
+		func(c *Config, v string) { c.Log.Level = v }},
+	{"/admin/token", "ZAI_PROXY_ADMIN_TOKEN", "", "",
+		func(c *Config, v string) { c.Admin.Token = v }},
+	{"/storage/dsn", "ZAI_PROXY_STORAGE_DSN", "", "",
+		func(c *Config, v string) { c.Storage.DSN = v }},
+}
+
+// configSources records where config values came from, keyed by JSON
+// pointer: "file:<path>", "env:<NAME>" or "flag:-<name>". Values under a
+// recorded pointer share its source; anything unrecorded is a default.
+type configSources map[string]string
+
+// of returns the source of the value at ptr.
+func (s configSources) of(ptr string) string {
+	for p := ptr; p != ""; p = p[:strings.LastIndex(p, "/")] {
+		if src, ok := s[p]; ok {
+			return src
+		}
+	}
+	return "default"
+}
+
+// serveFlags registers -config and the flag for each config setting.
+func serveFlags(fs *flag.FlagSet) (configPath *string, values map[string]*string) {
+	configPath = fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file")
+	values = make(map[string]*string)
+	for _, s := range configSettings {
+		if s.flag != "" {
+			values[s.flag] = fs.String(s.flag, "", s.usage+" (overrides the config file)")
+		}
+	}
+	return configPath, values
+}
+
+// resolveConfig loads the file at path over the defaults, applies the
+// environment and then the flags that were set, and validates the result.
+func resolveConfig(path string, flags map[string]string) (*Config, configSources, error) {
+	cfg := defaultConfig()
+	src := configSources{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		var doc any
+		json.Unmarshal(data, &doc)
+		// Objects merge over the defaults, so only their members are
+		// attributed to the file; arrays and scalars replace them whole.
+		walkJSON(doc, "", func(ptr string, v any) {
+			if _, isObj := v.(map[string]any); !isObj && ptr != "" {
+				src[ptr] = "file:" + path
+			}
+		})
+	}
+	for _, s := range configSettings {
+		if v := os.Getenv(s.env); v != "" {
+			s.set(cfg, v)
+			src[s.path] = "env:" + s.env
+		}
+		if v, ok := flags[s.flag]; ok && s.flag != "" {
+			s.set(cfg, v)
+			src[s.path] = "flag:-" + s.flag
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		if path != "" {
+			err = fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, nil, err
+	}
+	return cfg, src, nil
+}
+
+// walkJSON calls fn for v and every value beneath it with its JSON pointer.
+func walkJSON(v any, ptr string, fn func(ptr string, v any)) {
+	fn(ptr, v)
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			esc := strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+			walkJSON(v[k], ptr+"/"+esc, fn)
+		}
+	case []any:
+		for i, e := range v {
+			walkJSON(e, ptr+"/"+strconv.Itoa(i), fn)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConsensusConfig serves POST /v1/consensus, which asks several models
+// the same question through the fanout path, extracts each final answer
+// and returns the one with the most vote weight. Weights gives models a
+// vote other than 1. Answer is a regexp whose first group is the answer;
+// by default it is the text after the last "Answer:" line, else the last
+// line. The result is a consensus when its share of the weight cast
+// reaches Quorum (default more than half).
+type ConsensusConfig struct {
+	Weights map[string]float64 `json:"weights,omitempty"`
+	Answer  string             `json:"answer,omitempty"`
+	Quorum  float64            `json:"quorum,omitempty"`
+
+	answer *regexp.Regexp
+}
+
+const consensusPath = "/v1/consensus"
+
+func (c *ConsensusConfig) validate() error {
+	if c.Answer != "" {
+		re, err := regexp.Compile(c.Answer)
+		if err != nil {
+			return fmt.Errorf("consensus: answer: %w", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("consensus: answer needs a capture group")
+		}
+		c.answer = re
+	}
+	if c.Quorum < 0 || c.Quorum > 1 {
+		return fmt.Errorf("consensus: quorum must be between 0 and 1")
+	}
+	for m, w := range c.Weights {
+		if w < 0 {
+			return fmt.Errorf("consensus: weight of %q must not be negative", m)
+		}
+	}
+	return nil
+}
+
+// ConsensusVote is one model's answer.
+type ConsensusVote struct {
+	Model  string  `json:"model"`
+	Answer string  `json:"answer,omitempty"`
+	Weight float64 `json:"weight"`
+	Status int     `json:"status"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// ConsensusTally is the weight behind one distinct answer.
+type ConsensusTally struct {
+	Answer string   `json:"answer"`
+	Weight float64  `json:"weight"`
+	Models []string `json:"models"`
+}
+
+// ConsensusResult is the /v1/consensus response. Answer is empty when no
+// model answered.
+type ConsensusResult struct {
+	Answer    string           `json:"answer"`
+	Agreement float64          `json:"agreement"`
+	Consensus bool             `json:"consensus"`
+	Votes     []ConsensusVote  `json:"votes"`
+	Tally     []ConsensusTally `json:"tally"`
+}
+
+var (
+	answerLine   = regexp.MustCompile(`(?im)^\W*(?:final answer|answer)\W*[:：]\s*(.+?)\s*$`)
+	answerNoise  = regexp.MustCompile(`[\s*_` + "`" + `"'.,;:!()\[\]]+`)
+	answerSpaces = regexp.MustCompile(`\s+`)
+)
+
+// extractAnswer finds the final answer in a completion.
+func (c *ConsensusConfig) extractAnswer(text string) string {
+	if c.answer != nil {
+		if m := c.answer.FindAllStringSubmatch(text, -1); len(m) > 0 {
+			return strings.TrimSpace(m[len(m)-1][1])
+		}
+		return ""
+	}
+	if m := answerLine.FindAllStringSubmatch(text, -1); len(m) > 0 {
+		return m[len(m)-1][1]
+	}
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// normalizeAnswer makes answers that differ only in case, spacing or
+// punctuation vote together.
+func normalizeAnswer(s string) string {
+	s = answerNoise.ReplaceAllString(strings.ToLower(s), " ")
+	return strings.TrimSpace(answerSpaces.ReplaceAllString(s, " "))
+}
+
+func consensusHandler(cfg *Config, mux *http.ServeMux) http.Handler {
+	path := cfg.Fanout.route()
+	limit := cfg.Fanout.Max
+	if limit == 0 {
+		limit = 8
+	}
+	cc := &cfg.Consensus
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]any
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&doc); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON chat request: "+err.Error())
+			return
+		}
+		var fr FanoutRequest
+		b, _ := json.Marshal(doc)
+		json.Unmarshal(b, &fr)
+		models, err := cfg.Fanout.models(fr, limit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		delete(doc, "models")
+		delete(doc, "group")
+		doc["stream"] = false
+
+		results := make([]FanoutResult, len(models))
+		var wg sync.WaitGroup
+		for i, model := range models {
+			wg.Add(1)
+			go func(i int, model string) {
+				defer wg.Done()
+				results[i] = fanoutOne(mux, r, path, doc, i, model, nil)
+			}(i, model)
+		}
+		wg.Wait()
+		writeJSON(w, http.StatusOK, cc.tally(results))
+	})
+}
+
+// tally counts the votes of the models' responses.
+func (c *ConsensusConfig) tally(results []FanoutResult) ConsensusResult {
+	res := ConsensusResult{Votes: []ConsensusVote{}, Tally: []ConsensusTally{}}
+	byAnswer := map[string]*ConsensusTally{}
+	var cast float64
+	for _, fr := range results {
+		v := ConsensusVote{Model: fr.Model, Weight: 1, Status: fr.Status, Error: fr.Error}
+		if wt, ok := c.Weights[fr.Model]; ok {
+			v.Weight = wt
+		}
+		var d map[string]any
+		if fr.Status < 300 {
+			if doc, err := decodeJSON(fr.Response); err == nil {
+				d, _ = doc.(map[string]any)
+			}
+		}
+		if d != nil {
+			v.Answer = c.extractAnswer(responseText(d))
+		}
+		res.Votes = append(res.Votes, v)
+		key := normalizeAnswer(v.Answer)
+		if key == "" {
+			continue
+		}
+		t := byAnswer[key]
+		if t == nil {
+			t = &ConsensusTally{Answer: v.Answer}
+			byAnswer[key] = t
+		}
+		t.Weight += v.Weight
+		t.Models = append(t.Models, v.Model)
+		cast += v.Weight
+	}
+	for _, t := range byAnswer {
+		res.Tally = append(res.Tally, *t)
+	}
+	sort.SliceStable(res.Tally, func(i, j int) bool {
+		if res.Tally[i].Weight != res.Tally[j].Weight {
+			return res.Tally[i].Weight > res.Tally[j].Weight
+		}
+		return res.Tally[i].Answer < res.Tally[j].Answer
+	})
+	if len(res.Tally) == 0 || cast == 0 {
+		return res
+	}
+	top := res.Tally[0]
+	res.Answer, res.Agreement = top.Answer, top.Weight/cast
+	tied := len(res.Tally) > 1 && res.Tally[1].Weight == top.Weight
+	if c.Quorum > 0 {
+		res.Consensus = !tied && res.Agreement >= c.Quorum
+	} else {
+		res.Consensus = res.Agreement > 0.5
+	}
+	return res
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContextConfig keeps requests within their model's context window.
+// Limits maps models (exact names or prefixes ending in "*", as in the
+// price table) to their context size in tokens. A request whose prompt
+// plus max_tokens exceeds it is handled by Strategy:
+//
+//	reject     answer 400 with the sizes involved (the default)
+//	truncate   drop the oldest messages other than system ones until it fits
+//	summarize  replace all but the KeepRecent (default 4) newest messages
+//	           with a summary written by SummaryModel (default the
+//	           request's model), truncating if that is still too long
+//	map_reduce make the request on each token-bounded chunk of its longest
+//	           message, a document to summarize say, and then with the
+//	           answers in its place, truncating if there's no room
+//
+// With ChunkEmbeddings, embeddings inputs over their model's limit are
+// embedded in chunks, the response listing an embedding per chunk.
+type ContextConfig struct {
+	Limits          map[string]int64 `json:"limits,omitempty"`
+	Strategy        string           `json:"strategy,omitempty"`
+	SummaryModel    string           `json:"summary_model,omitempty"`
+	KeepRecent      int              `json:"keep_recent,omitempty"`
+	ChunkEmbeddings bool             `json:"chunk_embeddings,omitempty"`
+}
+
+func (c *ContextConfig) validate() error {
+	switch c.Strategy {
+	case "", "reject", "truncate", "summarize", "map_reduce":
+	default:
+		return fmt.Errorf("context: unknown strategy %q (want reject, truncate, summarize or map_reduce)", c.Strategy)
+	}
+	for model, n := range c.Limits {
+		if n <= 0 {
+			return fmt.Errorf("context limit for %q must be positive", model)
+		}
+	}
+	if c.KeepRecent < 0 {
+		return fmt.Errorf("context: keep_recent must not be negative")
+	}
+	return nil
+}
+
+// limit returns model's context size, the longest matching prefix winning.
+func (c *ContextConfig) limit(model string) (int64, bool) {
+	if n, ok := c.Limits[model]; ok {
+		return n, true
+	}
+	best, found := "", false
+	for key := range c.Limits {
+		prefix, ok := strings.CutSuffix(key, "*")
+		if ok && strings.HasPrefix(model, prefix) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	return c.Limits[best+"*"], found
+}
+
+var contextActions = metrics.counter("zai_proxy_context_overflows_total",
+	"Requests over their model's context window, by what was done.", "model", "action")
+
+// contextStage applies the context strategy once the model is final, so
+// it follows session, experiment and autoroute.
+func contextStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	cc := &p.cfg.Context
+	return func(next http.Handler) http.Handler {
+		if len(cc.Limits) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			limit, ok := cc.limit(ex.model)
+			if ok && cc.ChunkEmbeddings && strings.HasSuffix(r.URL.Path, "/embeddings") && p.chunkEmbeddings(w, r, ex, limit) {
+				return
+			}
+			msgs, isChat := ex.doc["messages"].([]any)
+			if !ok || !isChat {
+				next.ServeHTTP(w, r)
+				return
+			}
+			req := docRequest(ex.doc)
+			prompt := estimatePromptTokens(&req)
+			if prompt+req.MaxTokens <= limit {
+				next.ServeHTTP(w, r)
+				return
+			}
+			budget := limit - req.MaxTokens
+			action := cmp.Or(cc.Strategy, "reject")
+			dropped := 0
+			if action == "map_reduce" {
+				if out, calls, ok := p.mapReduce(r, ex, msgs, req, limit); ok {
+					contextActions.Add(1, ex.model, "map_reduced")
+					ex.doc["messages"], ex.dirty = out, true
+					w.Header().Set("X-Ringmaster-Context", "map_reduced")
+					w.Header().Set("X-Ringmaster-Context-Chunks", strconv.Itoa(calls))
+					next.ServeHTTP(w, r)
+					return
+				}
+				action = "truncate"
+			}
+			if action == "summarize" {
+				head, rest := splitSystem(msgs)
+				keep := cmp.Or(cc.KeepRecent, 4)
+				summary, ok := "", len(rest) > keep
+				if ok {
+					summary, ok = p.summarizeContext(r, cc, ex.model, rest[:len(rest)-keep])
+				}
+				if ok {
+					for _, m := range rest[:len(rest)-keep] {
+						prompt -= messageTokens(ex.model, m)
+					}
+					dropped, summary = len(rest)-keep, "Summary of the earlier conversation: "+summary
+					prompt += perMessageTokens + countTokens(ex.model, summary)
+					if strings.HasSuffix(r.URL.Path, "/messages") {
+						// Anthropic takes system text beside the messages.
+						if sys, _ := ex.doc["system"].(string); sys != "" {
+							summary = sys + "\n\n" + summary
+						}
+						ex.doc["system"] = summary
+						msgs = append(head, rest[len(rest)-keep:]...)
+					} else {
+						msgs = append(append(head, map[string]any{"role": "system", "content": summary}), rest[len(rest)-keep:]...)
+					}
+				} else {
+					action = "truncate"
+				}
+			}
+			if prompt > budget && action != "reject" {
+				var n int
+				msgs, n, prompt = truncateContext(ex.model, msgs, prompt, budget)
+				dropped += n
+			}
+			if action == "reject" || prompt > budget {
+				contextActions.Add(1, ex.model, "rejected")
+				writeError(w, http.StatusBadRequest, "context_length_exceeded", fmt.Sprintf(
+					"the prompt is about %d tokens and max_tokens is %d, over the %d token context of %s",
+					prompt, req.MaxTokens, limit, ex.model))
+				return
+			}
+			contextActions.Add(1, ex.model, action+"d")
+			ex.doc["messages"], ex.dirty = msgs, true
+			w.Header().Set("X-Ringmaster-Context", action+"d")
+			w.Header().Set("X-Ringmaster-Context-Dropped", strconv.Itoa(dropped))
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// docRequest reads the parts of a parsed body that count toward its
+// prompt.
+func docRequest(doc map[string]any) chatRequest {
+	var req chatRequest
+	if b, err := encodeJSON(doc); err == nil {
+		json.Unmarshal(b, &req)
+	}
+	return req
+}
+
+func asChatMessage(m any) chatMessage {
+	var cm chatMessage
+	if b, err := encodeJSON(m); err == nil {
+		json.Unmarshal(b, &cm)
+	}
+	return cm
+}
+
+// messageTokens estimates one message as estimatePromptTokens counts it.
+func messageTokens(model string, m any) int64 {
+	cm := asChatMessage(m)
+	return perMessageTokens + countTokens(model, cm.Role) + countTokens(model, contentText(cm.Content))
+}
+
+// splitSystem separates the leading system messages from the rest.
+func splitSystem(msgs []any) (head, rest []any) {
+	for i, m := range msgs {
+		if asChatMessage(m).Role != "system" {
+			return msgs[:i:i], msgs[i:]
+		}
+	}
+	return msgs, nil
+}
+
+// truncateContext drops the oldest messages that aren't system ones until
+// prompt fits budget, keeping the last message, and drops tool results
+// left without the call they answered. It returns the messages, how many
+// were dropped and the new prompt size.
+func truncateContext(model string, msgs []any, prompt, budget int64) ([]any, int, int64) {
+	head, rest := splitSystem(msgs)
+	dropped := 0
+	for len(rest) > 1 && (prompt > budget || asChatMessage(rest[0]).Role == "tool") {
+		prompt -= messageTokens(model, rest[0])
+		rest = rest[1:]
+		dropped++
+	}
+	return append(head, rest...), dropped, prompt
+}
+
+// summarizeContext has the summary model condense old messages, sent
+// through the proxy like the request itself.
+func (p *proxy) summarizeContext(r *http.Request, cc *ContextConfig, model string, old []any) (string, bool) {
+	summarizer := cmp.Or(cc.SummaryModel, model)
+	var transcript strings.Builder
+	for _, m := range old {
+		cm := asChatMessage(m)
+		fmt.Fprintf(&transcript, "%s: %s\n\n", cm.Role, contentText(cm.Content))
+	}
+	text := transcript.String()
+	answer := int64(512)
+	if limit, ok := cc.limit(summarizer); ok {
+		// The summary gets up to a quarter of the summarizer's window and
+		// the instructions about 64 tokens; the oldest text is cut to fit
+		// the rest.
+		answer = min(answer, limit/4)
+		for len(text) > 0 && countTokens(summarizer, text) > limit-answer-64 {
+			text = strings.ToValidUTF8(text[len(text)/4:], "")
+		}
+	}
+	doc := map[string]any{"stream": false, "max_tokens": answer, "messages": []any{
+		map[string]any{"role": "user", "content": "Summarize this conversation in a few sentences, keeping every fact, " +
+			"decision and open question needed to continue it.\n\n" + text},
+	}}
+	res := fanoutOne(p.mux, r, r.URL.Path, doc, 0, summarizer, nil)
+	v, err := decodeJSON(res.Response)
+	d, _ := v.(map[string]any)
+	if err != nil || d == nil || res.Status >= 300 {
+		debugf("Context summary by %s failed with status %d", summarizer, res.Status)
+		return "", false
+	}
+	summary := strings.TrimSpace(responseText(d))
+	return summary, summary != ""
+}
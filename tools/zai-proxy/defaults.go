@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ClientDefaults fills in what a client's requests leave out, so policy
+// lives in the proxy rather than in every caller. Params are body fields
+// of chat and messages requests, such as temperature or max_tokens, set
+// when a request doesn't have them; objects, such as metadata, are merged
+// key by key.
+// User is set as user, or metadata.user_id on messages, when the request
+// names none; it is a template that sees client, project and agent.
+// Headers are sent upstream with any of its requests not carrying them.
+// Body defaults apply before transforms and the client's params policy,
+// which still hold.
+type ClientDefaults struct {
+	Params  map[string]json.RawMessage `json:"params,omitempty"`
+	User    promptTemplate             `json:"user,omitempty"`
+	Headers map[string]string          `json:"headers,omitempty"`
+
+	params map[string]any
+}
+
+func (d *ClientDefaults) validate() error {
+	d.params = make(map[string]any, len(d.Params))
+	for k, raw := range d.Params {
+		v, err := decodeJSON(raw)
+		if err != nil {
+			return fmt.Errorf("params: %s: %w", k, err)
+		}
+		d.params[k] = v
+	}
+	for k := range d.Headers {
+		if http.CanonicalHeaderKey(k) == "Authorization" || http.CanonicalHeaderKey(k) == "Host" {
+			return fmt.Errorf("headers: %s can't have a default", k)
+		}
+	}
+	return nil
+}
+
+// setHeaders sets the default headers r doesn't carry.
+func (d *ClientDefaults) setHeaders(r *http.Request) {
+	for k, v := range d.Headers {
+		if r.Header.Get(k) == "" {
+			r.Header.Set(k, v)
+		}
+	}
+}
+
+// apply fills in the body fields ex's request left out, and reports
+// whether its body changed.
+func (d *ClientDefaults) apply(ex *exchange, anthropic bool) (bool, error) {
+	if _, ok := ex.doc["messages"]; !ok {
+		return false, nil
+	}
+	keys := make([]string, 0, len(d.params))
+	for k := range d.params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	changed := false
+	for _, k := range keys {
+		changed = mergeDefault(ex.doc, k, d.params[k]) || changed
+	}
+	if d.User.empty() {
+		return changed, nil
+	}
+	user, err := d.User.render(map[string]any{"client": ex.client, "project": ex.project, "agent": ex.agent})
+	if err != nil || user == "" {
+		return changed, err
+	}
+	if anthropic {
+		return mergeDefault(ex.doc, "metadata", map[string]any{"user_id": user}) || changed, nil
+	}
+	return mergeDefault(ex.doc, "user", user) || changed, nil
+}
+
+// mergeDefault sets doc[k] to v unless it is set, merging objects into
+// objects, and reports whether doc changed.
+func mergeDefault(doc map[string]any, k string, v any) bool {
+	have, ok := doc[k]
+	if !ok {
+		doc[k] = copyJSON(v)
+		return true
+	}
+	into, ok1 := have.(map[string]any)
+	from, ok2 := v.(map[string]any)
+	if !ok1 || !ok2 {
+		return false
+	}
+	changed := false
+	for fk, fv := range from {
+		changed = mergeDefault(into, fk, fv) || changed
+	}
+	return changed
+}
+
+// copyJSON deep-copies a decoded document, so defaults are never shared
+// between requests that edit them.
+func copyJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = copyJSON(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = copyJSON(e)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDefaultsBeforeValidation validates requests as they'll be
+// forwarded: a field the schema requires may come from the client's
+// defaults.
+func TestDefaultsBeforeValidation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Validation.Enabled = true
+	cfg.Clients = []ClientConfig{{Name: "alice", Defaults: &ClientDefaults{Params: map[string]json.RawMessage{"max_tokens": json.RawMessage(`1024`)}}}}
+	if err := cfg.Clients[0].Defaults.validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{cfg: cfg, registry: newClientRegistry(cfg, nil)}
+	var forwarded map[string]any
+	h := p.transform(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = exchangeOf(r).doc
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		client string
+		want   int
+	}{
+		{"alice", http.StatusNoContent},
+		{"bob", http.StatusBadRequest},
+	} {
+		forwarded = nil
+		ex := &exchange{client: tc.client, route: &RouteConfig{Pattern: "/"}}
+		r := httptest.NewRequest(http.MethodPost, "/v1/messages",
+			strings.NewReader(`{"model":"glm-4.6","messages":[{"role":"user","content":"hi"}]}`))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.client, rec.Code, tc.want, rec.Body)
+		}
+		if tc.want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "max_tokens") {
+			t.Errorf("%s: error %s doesn't name max_tokens", tc.client, rec.Body)
+		}
+		if tc.want == http.StatusNoContent && forwarded["max_tokens"] != json.Number("1024") {
+			t.Errorf("%s: forwarded max_tokens %v, want the default", tc.client, forwarded["max_tokens"])
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+// The database/sql drivers storage.driver names. Both are pure Go, so
+// builds stay CGO_ENABLED=0.
+import (
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx"
+	_ "modernc.org/sqlite"             // "sqlite"
+)
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// dryRunHeader makes the proxy run a request through its whole route chain
+// and answer with what it decided instead of contacting the upstream.
+const dryRunHeader = "X-Ringmaster-Dry-Run"
+
+// DryRun is the response to a dry-run request.
+type DryRun struct {
+	DryRun   bool             `json:"dry_run"`
+	ID       string           `json:"id"`
+	Route    string           `json:"route"`
+	Client   string           `json:"client"`
+	Project  string           `json:"project,omitempty"`
+	Agent    string           `json:"agent,omitempty"`
+	Model    string           `json:"model,omitempty"`
+	Upstream string           `json:"upstream"`
+	Request  ForwardedRequest `json:"request"`
+	Estimate *Estimate        `json:"estimate,omitempty"`
+}
+
+func isDryRun(r *http.Request) bool {
+	ok, _ := strconv.ParseBool(r.Header.Get(dryRunHeader))
+	return ok
+}
+
+// dryRun answers with the request forward would have sent. Dry runs leave
+// no usage behind.
+func (p *proxy) dryRun(w http.ResponseWriter, r *http.Request, ex *exchange, req *http.Request) {
+	d := DryRun{DryRun: true, ID: ex.id, Route: ex.route.Pattern, Client: ex.client, Project: ex.project,
+		Agent: ex.agent, Model: ex.model, Upstream: upstreamOf(ex.target), Request: p.forwardedRequestOf(ex, req, ex.body)}
+	if ex.doc != nil {
+		var cr chatRequest
+		if json.Unmarshal(ex.body, &cr) == nil {
+			est, err := estimateRequest(r.Context(), p.cfg, p.quotas, ex.client, &cr)
+			if err != nil {
+				log.Printf("Error reading quota: %v", err)
+			} else {
+				d.Estimate = &est
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// echoHeader asks for the upstream request instead of, or as well as,
+// sending it: "json" and "curl" return it without contacting the upstream,
+// "log" logs it as a curl command and forwards as usual. It is honored only
+// when log.echo is set.
+const echoHeader = "X-Ringmaster-Echo"
+
+// ForwardedRequest is the request the proxy sends upstream, with
+// credentials redacted.
+type ForwardedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers"`
+	Body    any         `json:"body,omitempty"`
+	Curl    string      `json:"curl"`
+}
+
+func (p *proxy) forwardedRequestOf(ex *exchange, req *http.Request, body []byte) ForwardedRequest {
+	fr := ForwardedRequest{Method: req.Method, URL: req.URL.String(), Headers: redactHeaders(req.Header), Body: captureBody(body)}
+	p.pool.authFor(ex.target, &p.cfg.UpstreamAuth).redact(&fr)
+	fr.Curl = curlCommand(fr.Method, fr.URL, fr.Headers, redactBody(body))
+	return fr
+}
+
+// curlCommand renders a request as a copy-pasteable shell command.
+func curlCommand(method, url string, h http.Header, body string) string {
+	var b strings.Builder
+	b.WriteString("curl -X " + method + " " + shellQuote(url))
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for _, v := range h[k] {
+			b.WriteString(" \\\n  -H " + shellQuote(k+": "+v))
+		}
+	}
+	if body != "" {
+		b.WriteString(" \\\n  --data-raw " + shellQuote(body))
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// echo answers an echo request for the upstream request req, reporting
+// whether it did; "log" mode only logs.
+func (p *proxy) echo(w http.ResponseWriter, r *http.Request, req *http.Request, body []byte) bool {
+	mode := r.Header.Get(echoHeader)
+	if mode == "" || !p.cfg.Log.Echo {
+		return false
+	}
+	if body == nil && req.Body != nil && mode != "log" {
+		body, _ = io.ReadAll(io.LimitReader(req.Body, maxBufferedBody))
+	}
+	fr := p.forwardedRequestOf(exchangeOf(r), req, body)
+	switch mode {
+	case "curl":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, fr.Curl+"\n")
+	case "log":
+		infof("Forwarding %s:\n%s", exchangeOf(r).id, fr.Curl)
+		return false
+	default:
+		writeJSON(w, http.StatusOK, fr)
+	}
+	return true
+}
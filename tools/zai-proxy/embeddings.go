@@ -0,0 +1,228 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EmbeddingsConfig gives embeddings from every upstream the same size, so
+// a vector store fed by several providers stays consistent. Vectors are
+// resized to Dimensions, or to the dimensions a request asks for, by
+// Method or the method Models gives their model (an exact name or a
+// prefix ending in "*"):
+//
+//	truncate  cut longer vectors, rescaled to unit length, and pad shorter
+//	          ones with zeros (the default); suits models trained so their
+//	          leading dimensions stand alone
+//	project   map vectors through a fixed random projection seeded by
+//	          their model, so vectors of one model stay comparable
+//
+// With Tag each vector names the model that made it, and its size there.
+type EmbeddingsConfig struct {
+	Dimensions int               `json:"dimensions,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Models     map[string]string `json:"models,omitempty"`
+	Tag        bool              `json:"tag,omitempty"`
+}
+
+func (c *EmbeddingsConfig) validate() error {
+	if c.Dimensions < 0 {
+		return fmt.Errorf("embeddings: dimensions must not be negative")
+	}
+	for model, m := range c.Models {
+		if m != "truncate" && m != "project" {
+			return fmt.Errorf("embeddings: models[%q]: method must be truncate or project", model)
+		}
+	}
+	if c.Method != "" && c.Method != "truncate" && c.Method != "project" {
+		return fmt.Errorf("embeddings: method must be truncate or project")
+	}
+	return nil
+}
+
+// method returns how vectors of model are resized.
+func (c *EmbeddingsConfig) method(model string) string {
+	if m, ok := c.Models[model]; ok {
+		return m
+	}
+	best, method := "", ""
+	for key, m := range c.Models {
+		if prefix, ok := strings.CutSuffix(key, "*"); ok && strings.HasPrefix(model, prefix) && len(prefix) >= len(best) {
+			best, method = prefix, m
+		}
+	}
+	if method != "" {
+		return method
+	}
+	if c.Method != "" {
+		return c.Method
+	}
+	return "truncate"
+}
+
+var embeddingsResized = metrics.counter("zai_proxy_embeddings_resized_total",
+	"Embedding vectors resized to the configured dimensions, by source model and method.", "model", "method")
+
+// embeddingsStage resizes and tags the vectors of embeddings responses.
+// It follows context, so chunked inputs' vectors are resized as each
+// chunk's response passes.
+func embeddingsStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	ec := &p.cfg.Embeddings
+	return func(next http.Handler) http.Handler {
+		if ec.Dimensions == 0 && !ec.Tag {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if !strings.HasSuffix(r.URL.Path, "/embeddings") || ex.doc == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			dims := ec.Dimensions
+			if n, ok := ex.doc["dimensions"].(json.Number); ok {
+				if d, err := n.Int64(); err == nil && d > 0 {
+					dims = int(d)
+				}
+			}
+			ex.inspect = true
+			held := &heldResponse{w: w, h: http.Header{}}
+			next.ServeHTTP(held, r)
+			if held.sent || held.status >= 300 {
+				held.sendTo(w)
+				return
+			}
+			v, err := decodeJSON(held.body.Bytes())
+			doc, _ := v.(map[string]any)
+			items, _ := doc["data"].([]any)
+			if err != nil || items == nil {
+				held.sendTo(w)
+				return
+			}
+			model, _ := doc["model"].(string)
+			model = cmp.Or(model, ex.model)
+			method := ec.method(model)
+			for _, it := range items {
+				item, _ := it.(map[string]any)
+				vec, encoded, ok := embeddingVector(item["embedding"])
+				if !ok {
+					continue
+				}
+				if ec.Tag {
+					item["model"], item["source_dimensions"] = model, len(vec)
+				}
+				if dims > 0 && len(vec) != dims {
+					vec = resizeVector(vec, dims, method, model)
+					embeddingsResized.Add(1, model, method)
+				}
+				if encoded {
+					item["embedding"] = encodeVector(vec)
+				} else {
+					item["embedding"] = vec
+				}
+			}
+			b, err := json.Marshal(doc)
+			if err != nil {
+				held.sendTo(w)
+				return
+			}
+			held.body.Reset()
+			held.body.Write(b)
+			held.h.Del("Content-Length")
+			if dims > 0 {
+				held.h.Set("X-Ringmaster-Embedding-Dimensions", strconv.Itoa(dims))
+			}
+			held.sendTo(w)
+		})
+	}, nil
+}
+
+// embeddingVector reads an embedding, a list of numbers or base64 of
+// little-endian float32s, reporting which.
+func embeddingVector(v any) (vec []float64, encoded, ok bool) {
+	switch e := v.(type) {
+	case []any:
+		vec = make([]float64, len(e))
+		for i, x := range e {
+			n, isNum := x.(json.Number)
+			f, err := n.Float64()
+			if !isNum || err != nil {
+				return nil, false, false
+			}
+			vec[i] = f
+		}
+		return vec, false, true
+	case string:
+		b, err := base64.StdEncoding.DecodeString(e)
+		if err != nil || len(b)%4 != 0 {
+			return nil, false, false
+		}
+		vec = make([]float64, len(b)/4)
+		for i := range vec {
+			vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:])))
+		}
+		return vec, true, true
+	}
+	return nil, false, false
+}
+
+func encodeVector(vec []float64) string {
+	b := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(float32(f)))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// resizeVector returns vec at dims dimensions by method, a projected one
+// by the projection of model.
+func resizeVector(vec []float64, dims int, method, model string) []float64 {
+	out := make([]float64, dims)
+	if method == "project" {
+		// Each entry of the projection is +1 or -1, drawn from a hash of
+		// the model and its position, so no matrix is kept.
+		h := fnv.New64a()
+		h.Write([]byte(model))
+		seed := h.Sum64()
+		for j := range out {
+			var s float64
+			for i, x := range vec {
+				if splitmix(seed^uint64(i)<<32^uint64(j))&1 == 0 {
+					s += x
+				} else {
+					s -= x
+				}
+			}
+			out[j] = s
+		}
+	} else {
+		copy(out, vec)
+		if len(vec) < dims {
+			return out
+		}
+	}
+	var norm float64
+	for _, x := range out {
+		norm += x * x
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for j := range out {
+			out[j] /= norm
+		}
+	}
+	return out
+}
+
+func splitmix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiError is the body of proxy-generated errors. It follows the OpenAI
+// error shape so clients handle it like an upstream error, and is sent
+// with errorHeader so they can tell it apart.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Message string     `json:"message"`
+	Type    string     `json:"type"`
+	Param   string     `json:"param,omitempty"`
+	Code    string     `json:"code,omitempty"`
+	Retry   *retryHint `json:"retry,omitempty"`
+	// SupportURL is set by error templates.
+	SupportURL string `json:"support_url,omitempty"`
+}
+
+// retryHint is the retry guidance every proxy-generated error carries:
+// whether the same request may succeed if sent again, how long to wait
+// before it does, and the limit that refused it, if one did. Errors the
+// upstream sends are relayed as they are.
+type retryHint struct {
+	Retryable bool   `json:"retryable"`
+	AfterMs   int64  `json:"after_ms,omitempty"`
+	Limit     string `json:"limit,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, typ, msg string) {
+	writeErrorDetail(w, status, apiErrorDetail{Message: msg, Type: typ})
+}
+
+// writeLimitError answers a request refused by limit, which admits it
+// after retry; it sets Retry-After to match.
+func writeLimitError(w http.ResponseWriter, status int, typ, msg, limit string, retry time.Duration) {
+	if retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	}
+	writeErrorDetail(w, status, apiErrorDetail{Message: msg, Type: typ,
+		Retry: &retryHint{Retryable: true, AfterMs: max(retry.Milliseconds(), 0), Limit: limit}})
+}
+
+func writeErrorDetail(w http.ResponseWriter, status int, d apiErrorDetail) {
+	if d.Retry == nil {
+		d.Retry = retryHintFor(w.Header(), status)
+	}
+	w.Header().Set(errorHeader, d.Type)
+	writeJSON(w, status, apiError{Error: d})
+}
+
+// retryHintFor is the guidance for an error without a limit: a Retry-After
+// already set says when, and errors that are passing conditions are worth
+// retrying after a second.
+func retryHintFor(h http.Header, status int) *retryHint {
+	if n, err := strconv.Atoi(h.Get("Retry-After")); err == nil && n >= 0 {
+		return &retryHint{Retryable: true, AfterMs: int64(n) * 1000}
+	}
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &retryHint{Retryable: true, AfterMs: 1000}
+	}
+	return &retryHint{}
+}
+
+// quotaLimit names the quota qe reports for retry hints, as in
+// client_daily_token.
+func quotaLimit(who string, qe *QuotaError) string {
+	return who + "_" + strings.ReplaceAll(qe.Limit, " ", "_")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errorHeader names the type of an error the proxy made, rather than the
+// upstream, on its response.
+const errorHeader = "X-Ringmaster-Error"
+
+// ErrorTemplate reshapes the errors the proxy makes for clients with API
+// conventions of their own; set globally as errors, or per client, which
+// then replaces the global one. Codes sets the code and Statuses the HTTP
+// status sent for each error type. Messages replaces a type's message by
+// language, the first of the caller's Accept-Language it has, else "*";
+// it is a template that may use {{ message }} for the proxy's own. In all
+// three, type "*" stands for the types not listed. SupportURL is added to
+// every error as support_url. Body, when set, is the JSON sent instead of
+// the OpenAI shape: a string in it that is one {{ expression }} is
+// replaced by its value, and other strings are templates. Templates see
+// status, type, code, message, param, retry, support_url, client and
+// request_id.
+type ErrorTemplate struct {
+	Codes      map[string]string                    `json:"codes,omitempty"`
+	Statuses   map[string]int                       `json:"statuses,omitempty"`
+	Messages   map[string]map[string]promptTemplate `json:"messages,omitempty"`
+	SupportURL string                               `json:"support_url,omitempty"`
+	Body       json.RawMessage                      `json:"body,omitempty"`
+
+	body any // Body, its strings compiled to *promptTemplate
+}
+
+func (t *ErrorTemplate) validate() error {
+	for typ, s := range t.Statuses {
+		if s < 400 || s > 599 {
+			return fmt.Errorf("statuses: %s: %d is not an error status", typ, s)
+		}
+	}
+	if len(t.Body) == 0 {
+		return nil
+	}
+	v, err := decodeJSON(t.Body)
+	if err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	t.body, err = compileErrorBody(v)
+	if err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	return nil
+}
+
+func (t *ErrorTemplate) empty() bool {
+	return len(t.Codes) == 0 && len(t.Statuses) == 0 && len(t.Messages) == 0 && t.SupportURL == "" && len(t.Body) == 0
+}
+
+// compileErrorBody compiles the strings in a body as templates.
+func compileErrorBody(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		var t promptTemplate
+		b, _ := json.Marshal(v)
+		if err := t.UnmarshalJSON(b); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			c, err := compileErrorBody(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = c
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			c, err := compileErrorBody(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func renderErrorBody(v any, env map[string]any) (any, error) {
+	switch v := v.(type) {
+	case *promptTemplate:
+		if len(v.exprs) == 1 && v.text[0] == "" && v.text[1] == "" {
+			return v.exprs[0].Eval(env)
+		}
+		return v.render(env)
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			r, err := renderErrorBody(e, env)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			r, err := renderErrorBody(e, env)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// hasErrorTemplates reports whether the global config or any client's
+// reshapes errors.
+func (c *Config) hasErrorTemplates() bool {
+	if !c.Errors.empty() {
+		return true
+	}
+	for _, cl := range c.Clients {
+		if cl.Errors != nil && !cl.Errors.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// errorTemplates reshapes the errors the proxy answers h's requests with,
+// by the template of the client they're for.
+func (p *proxy) errorTemplates(h http.Handler) http.Handler {
+	if !p.cfg.hasErrorTemplates() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &templatedWriter{ResponseWriter: w}
+		h.ServeHTTP(tw, r)
+		if tw.held {
+			p.writeTemplatedError(w, r, tw)
+		}
+	})
+}
+
+// templatedWriter holds back errors the proxy made, to be reshaped once
+// written; the route serving the request, if one does, leaves its exchange.
+type templatedWriter struct {
+	http.ResponseWriter
+	ex     *exchange
+	status int
+	held   bool
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (w *templatedWriter) WriteHeader(code int) {
+	if w.wrote || code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wrote = true
+	if code >= 400 && w.Header().Get(errorHeader) != "" {
+		w.held, w.status = true, code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *templatedWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *templatedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.held {
+		f.Flush()
+	}
+}
+
+func (w *templatedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// noteExchange tells the templated writer under w, if any, which request
+// it is writing for.
+func noteExchange(w http.ResponseWriter, ex *exchange) {
+	if tw, ok := w.(*templatedWriter); ok {
+		tw.ex = ex
+	}
+}
+
+func (p *proxy) writeTemplatedError(w http.ResponseWriter, r *http.Request, tw *templatedWriter) {
+	var e apiError
+	json.Unmarshal(tw.body.Bytes(), &e)
+	client, id := "", ""
+	if tw.ex != nil {
+		client, id = tw.ex.client, tw.ex.id
+	} else {
+		client = p.registry.Identify(r)
+	}
+	t := &p.cfg.Errors
+	if c := p.registry.Client(client); c != nil && c.Errors != nil {
+		t = c.Errors
+	}
+	d, status := e.Error, tw.status
+	if s := forErrorType(t.Statuses, d.Type); s != 0 {
+		status = s
+	}
+	d.Code = cmp.Or(forErrorType(t.Codes, d.Type), d.Code)
+	d.SupportURL = t.SupportURL
+	env := map[string]any{"status": float64(status), "type": d.Type, "code": d.Code, "message": d.Message, "param": d.Param,
+		"support_url": d.SupportURL, "client": client, "request_id": id}
+	if d.Retry != nil {
+		// As it would be sent, without what is unset.
+		b, _ := json.Marshal(d.Retry)
+		env["retry"], _ = decodeJSON(b)
+	}
+	if msg, ok := localizedMessage(forErrorType(t.Messages, d.Type), r.Header.Get("Accept-Language")); ok {
+		if s, err := msg.render(env); err == nil {
+			d.Message = s
+			env["message"] = s
+		} else {
+			debugf("Error rendering error message for %s: %v", d.Type, err)
+		}
+	}
+	w.Header().Del("Content-Length")
+	if t.body != nil {
+		v, err := renderErrorBody(t.body, env)
+		if err == nil {
+			writeJSON(w, status, v)
+			return
+		}
+		debugf("Error rendering error body for %s: %v", d.Type, err)
+	}
+	writeJSON(w, status, apiError{Error: d})
+}
+
+// forErrorType looks typ up in m, falling back to "*".
+func forErrorType[V any](m map[string]V, typ string) V {
+	if v, ok := m[typ]; ok {
+		return v
+	}
+	return m["*"]
+}
+
+// localizedMessage picks the message for the first language in
+// accept it has, trying each tag and then its primary language, else "*".
+func localizedMessage(byLang map[string]promptTemplate, accept string) (promptTemplate, bool) {
+	if len(byLang) == 0 {
+		return promptTemplate{}, false
+	}
+	for _, part := range strings.Split(accept, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		for _, try := range []string{tag, strings.Split(tag, "-")[0]} {
+			for lang, t := range byLang {
+				if strings.EqualFold(lang, try) {
+					return t, true
+				}
+			}
+		}
+	}
+	t, ok := byLang["*"]
+	return t, ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Estimate is the /estimate response: a local prediction of what a request
+// would cost and whether the caller's quota covers it.
+type Estimate struct {
+	Model             string        `json:"model"`
+	PromptTokens      int64         `json:"prompt_tokens"`
+	InputCostUSD      float64       `json:"estimated_input_cost_usd"`
+	MaxOutputTokens   int64         `json:"max_output_tokens,omitempty"`
+	MaxCostUSD        float64       `json:"max_cost_usd,omitempty"`
+	Priced            bool          `json:"priced"`
+	Quota             []QuotaWindow `json:"quota,omitempty"`
+	CoversInput       bool          `json:"quota_covers_input"`
+	CoversMaxResponse bool          `json:"quota_covers_max_output"`
+}
+
+// estimateHandler serves POST /estimate. The body is the request the caller
+// intends to send; nothing is forwarded upstream.
+func estimateHandler(cfg *Config, reg *clientRegistry, quotas *quotaChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 32<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON chat request: "+err.Error())
+			return
+		}
+		est, err := estimateRequest(r.Context(), cfg, quotas, reg.Identify(r), &req)
+		if err != nil {
+			log.Printf("Error reading quota: %v", err)
+			writeError(w, http.StatusInternalServerError, "storage_error", "reading quota failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, est)
+	}
+}
+
+// estimateRequest predicts the cost of req for client against its quota.
+func estimateRequest(ctx context.Context, cfg *Config, quotas *quotaChecker, client string, req *chatRequest) (Estimate, error) {
+	est := Estimate{
+		Model:           req.Model,
+		PromptTokens:    estimatePromptTokens(req),
+		MaxOutputTokens: req.MaxTokens,
+	}
+	_, est.Priced = cfg.Pricing.Lookup(req.Model)
+	est.InputCostUSD = cfg.Pricing.Cost(req.Model, Usage{PromptTokens: est.PromptTokens})
+	if req.MaxTokens > 0 {
+		est.MaxCostUSD = cfg.Pricing.Cost(req.Model, Usage{PromptTokens: est.PromptTokens, CompletionTokens: req.MaxTokens})
+	}
+
+	windows, err := quotas.Status(ctx, client, time.Now())
+	if err != nil {
+		return Estimate{}, err
+	}
+	est.Quota = windows
+	est.CoversInput = covers(windows, est.PromptTokens, est.InputCostUSD)
+	est.CoversMaxResponse = covers(windows, est.PromptTokens+req.MaxTokens, max(est.MaxCostUSD, est.InputCostUSD))
+	return est, nil
+}
+
+func covers(windows []QuotaWindow, tokens int64, cost float64) bool {
+	for _, w := range windows {
+		if t := w.RemainingTokens(); t >= 0 && tokens > t {
+			return false
+		}
+		if c := w.RemainingCost(); c >= 0 && cost > c {
+			return false
+		}
+	}
+	return true
+}
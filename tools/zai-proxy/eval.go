@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvalConfig runs suites of prompts against models through the proxy and
+// keeps their scores. Each run is appended to History (a JSONL file) when
+// set, and the Keep newest (default 100) per suite and model are served by
+// the admin API. A run scoring more than its suite's threshold below the
+// mean of the runs before it is a regression, posted to Webhook.
+type EvalConfig struct {
+	History string      `json:"history,omitempty"`
+	Keep    int         `json:"keep,omitempty"`
+	Webhook string      `json:"webhook,omitempty"`
+	Suites  []EvalSuite `json:"suites,omitempty"`
+}
+
+// EvalSuite is a set of cases run against Models on Schedule (hourly,
+// daily, weekly or a cron expression; empty runs only from the admin API). Requests go to
+// Path (default /v1/chat/completions) with Key as their bearer token so
+// they are authorized and accounted like a client's. Threshold is the
+// score drop that counts as a regression (default 0.1), against the mean
+// of the Baseline (default 5) previous runs. JudgeModel grades "judge"
+// cases.
+type EvalSuite struct {
+	Name       string     `json:"name"`
+	Schedule   string     `json:"schedule,omitempty"`
+	Models     []string   `json:"models"`
+	Path       string     `json:"path,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	Threshold  float64    `json:"threshold,omitempty"`
+	Baseline   int        `json:"baseline,omitempty"`
+	JudgeModel string     `json:"judge_model,omitempty"`
+	Cases      []EvalCase `json:"cases"`
+}
+
+// EvalCase is one prompt and how its answer is graded:
+//
+//	contains  the answer contains Expect, ignoring case (the default)
+//	exact     the answer is Expect, ignoring case and surrounding space
+//	regex     the answer matches the regular expression Expect
+//	judge     the suite's judge model says the answer agrees with Expect
+type EvalCase struct {
+	Name      string `json:"name"`
+	System    string `json:"system,omitempty"`
+	Prompt    string `json:"prompt"`
+	Expect    string `json:"expect"`
+	Grader    string `json:"grader,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (c *EvalConfig) validate() error {
+	if c.Keep < 0 {
+		return fmt.Errorf("evals: keep must not be negative")
+	}
+	names := map[string]bool{}
+	for i := range c.Suites {
+		s := &c.Suites[i]
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("evals: every suite needs a unique name")
+		}
+		names[s.Name] = true
+		if len(s.Models) == 0 || len(s.Cases) == 0 {
+			return fmt.Errorf("eval %s: needs models and cases", s.Name)
+		}
+		if s.Schedule != "" {
+			if _, err := parseSchedule(s.Schedule); err != nil {
+				return fmt.Errorf("eval %s: %w", s.Name, err)
+			}
+		}
+		if s.Threshold < 0 || s.Threshold > 1 || s.Baseline < 0 {
+			return fmt.Errorf("eval %s: threshold must be between 0 and 1 and baseline not negative", s.Name)
+		}
+		for j := range s.Cases {
+			ec := &s.Cases[j]
+			switch ec.Grader {
+			case "", "contains", "exact":
+			case "regex":
+				re, err := regexp.Compile(ec.Expect)
+				if err != nil {
+					return fmt.Errorf("eval %s case %s: %w", s.Name, ec.Name, err)
+				}
+				ec.re = re
+			case "judge":
+				if s.JudgeModel == "" {
+					return fmt.Errorf("eval %s case %s: judge grading needs the suite's judge_model", s.Name, ec.Name)
+				}
+			default:
+				return fmt.Errorf("eval %s case %s: unknown grader %q (want contains, exact, regex or judge)", s.Name, ec.Name, ec.Grader)
+			}
+		}
+	}
+	return nil
+}
+
+// EvalRun is one suite's scores for one model.
+type EvalRun struct {
+	Suite      string           `json:"suite"`
+	Model      string           `json:"model"`
+	Time       time.Time        `json:"time"`
+	Duration   Duration         `json:"duration"`
+	Score      float64          `json:"score"`
+	Passed     int              `json:"passed"`
+	Total      int              `json:"total"`
+	Baseline   *float64         `json:"baseline,omitempty"`
+	Regression bool             `json:"regression,omitempty"`
+	Cases      []EvalCaseResult `json:"cases"`
+}
+
+// EvalCaseResult is how one case fared.
+type EvalCaseResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EvalAlert is posted to the webhook when a run regresses.
+type EvalAlert struct {
+	Suite    string  `json:"suite"`
+	Model    string  `json:"model"`
+	Score    float64 `json:"score"`
+	Baseline float64 `json:"baseline"`
+	Text     string  `json:"text"`
+	Run      EvalRun `json:"run"`
+}
+
+// evalOutputKept is how much of each answer a run stores.
+const evalOutputKept = 500
+
+var (
+	evalScore = metrics.gauge("zai_proxy_eval_score",
+		"Score of the latest eval run, 0 to 1.", "suite", "model")
+	evalRegressions = metrics.counter("zai_proxy_eval_regressions_total",
+		"Eval runs scoring below their baseline.", "suite", "model")
+)
+
+// evalRunner runs suites through the proxy's own handlers and keeps their
+// history.
+type evalRunner struct {
+	cfg    EvalConfig
+	mux    *http.ServeMux
+	client *http.Client
+
+	mu   sync.Mutex
+	runs map[string][]EvalRun // by suite and model, oldest first
+	file *os.File
+}
+
+func newEvalRunner(cfg EvalConfig, mux *http.ServeMux) (*evalRunner, error) {
+	if cfg.Keep == 0 {
+		cfg.Keep = 100
+	}
+	e := &evalRunner{cfg: cfg, mux: mux, client: &http.Client{Timeout: 30 * time.Second}, runs: map[string][]EvalRun{}}
+	if cfg.History == "" {
+		return e, nil
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(cfg.History, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	e.file = f
+	return e, nil
+}
+
+func evalKey(suite, model string) string { return suite + "\x00" + model }
+
+// load reads the history file, keeping the newest runs.
+func (e *evalRunner) load() error {
+	f, err := os.Open(e.cfg.History)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var run EvalRun
+		if json.Unmarshal(sc.Bytes(), &run) == nil {
+			e.keep(run)
+		}
+	}
+	return sc.Err()
+}
+
+func (e *evalRunner) keep(run EvalRun) {
+	k := evalKey(run.Suite, run.Model)
+	runs := append(e.runs[k], run)
+	if len(runs) > e.cfg.Keep {
+		runs = runs[len(runs)-e.cfg.Keep:]
+	}
+	e.runs[k] = runs
+}
+
+func (e *evalRunner) suite(name string) *EvalSuite {
+	for i := range e.cfg.Suites {
+		if e.cfg.Suites[i].Name == name {
+			return &e.cfg.Suites[i]
+		}
+	}
+	return nil
+}
+
+// schedule adds the scheduled suites to sched.
+func (e *evalRunner) schedule(sched *Scheduler) {
+	for i := range e.cfg.Suites {
+		s := &e.cfg.Suites[i]
+		if s.Schedule == "" {
+			continue
+		}
+		every, _ := parseSchedule(s.Schedule)
+		sched.Add(Job{Name: "eval:" + s.Name, Schedule: every, Run: func(ctx context.Context, _ time.Time) error {
+			e.run(ctx, s)
+			return nil
+		}})
+	}
+}
+
+// run scores every model of the suite, records the runs and alerts on
+// regressions.
+func (e *evalRunner) run(ctx context.Context, s *EvalSuite) []EvalRun {
+	out := make([]EvalRun, 0, len(s.Models))
+	for _, model := range s.Models {
+		run := e.runModel(ctx, s, model)
+		e.record(ctx, s, &run)
+		out = append(out, run)
+	}
+	return out
+}
+
+func (e *evalRunner) runModel(ctx context.Context, s *EvalSuite, model string) EvalRun {
+	start := time.Now()
+	run := EvalRun{Suite: s.Name, Model: model, Time: start.UTC(), Total: len(s.Cases)}
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	r.RemoteAddr = "127.0.0.1:0"
+	if s.Key != "" {
+		r.Header.Set("Authorization", "Bearer "+s.Key)
+	}
+	path := cmp.Or(s.Path, "/v1/chat/completions")
+	for _, c := range s.Cases {
+		res := EvalCaseResult{Name: c.Name}
+		answer, err := e.ask(r, path, model, c.System, c.Prompt, c.MaxTokens)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Output = answer
+			if len(res.Output) > evalOutputKept {
+				res.Output = res.Output[:evalOutputKept]
+			}
+			res.Passed = e.grade(r, s, &c, answer)
+		}
+		if res.Passed {
+			run.Passed++
+		}
+		run.Cases = append(run.Cases, res)
+	}
+	run.Score = float64(run.Passed) / float64(run.Total)
+	run.Duration = Duration(time.Since(start))
+	return run
+}
+
+// ask sends one prompt and returns the answer's text.
+func (e *evalRunner) ask(r *http.Request, path, model, system, prompt string, maxTokens int) (string, error) {
+	var msgs []any
+	if system != "" {
+		msgs = append(msgs, map[string]any{"role": "system", "content": system})
+	}
+	doc := map[string]any{"stream": false,
+		"messages": append(msgs, map[string]any{"role": "user", "content": prompt})}
+	if maxTokens > 0 {
+		doc["max_tokens"] = maxTokens
+	}
+	res := fanoutOne(e.mux, r, path, doc, 0, model, nil)
+	if res.Error != "" {
+		return "", fmt.Errorf("%s", res.Error)
+	}
+	v, err := decodeJSON(res.Response)
+	d, _ := v.(map[string]any)
+	if err != nil || d == nil {
+		return "", fmt.Errorf("status %d: response is not a JSON object", res.Status)
+	}
+	if res.Status >= 300 {
+		return "", fmt.Errorf("status %d", res.Status)
+	}
+	return responseText(d), nil
+}
+
+func (e *evalRunner) grade(r *http.Request, s *EvalSuite, c *EvalCase, answer string) bool {
+	switch c.Grader {
+	case "exact":
+		return strings.EqualFold(strings.TrimSpace(answer), strings.TrimSpace(c.Expect))
+	case "regex":
+		return c.re.MatchString(answer)
+	case "judge":
+		prompt := fmt.Sprintf("Question:\n%s\n\nExpected answer:\n%s\n\nGiven answer:\n%s\n\n"+
+			"Does the given answer agree with the expected one? Reply with only yes or no.", c.Prompt, c.Expect, answer)
+		verdict, err := e.ask(r, cmp.Or(s.Path, "/v1/chat/completions"), s.JudgeModel, "", prompt, 8)
+		return err == nil && strings.HasPrefix(strings.ToLower(strings.TrimSpace(verdict)), "yes")
+	}
+	return strings.Contains(strings.ToLower(answer), strings.ToLower(c.Expect))
+}
+
+// record compares a run with its baseline and keeps it.
+func (e *evalRunner) record(ctx context.Context, s *EvalSuite, run *EvalRun) {
+	n := s.Baseline
+	if n == 0 {
+		n = 5
+	}
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = 0.1
+	}
+	e.mu.Lock()
+	prev := e.runs[evalKey(run.Suite, run.Model)]
+	prev = prev[max(len(prev)-n, 0):]
+	if len(prev) > 0 {
+		sum := 0.0
+		for _, p := range prev {
+			sum += p.Score
+		}
+		base := sum / float64(len(prev))
+		run.Baseline = &base
+		run.Regression = base-run.Score > threshold
+	}
+	e.keep(*run)
+	if e.file != nil {
+		b, _ := json.Marshal(run)
+		if _, err := e.file.Write(append(b, '\n')); err != nil {
+			log.Printf("Error writing eval history: %v", err)
+		}
+	}
+	e.mu.Unlock()
+
+	evalScore.Set(run.Score, run.Suite, run.Model)
+	infof("Eval %s on %s scored %.2f (%d/%d)", run.Suite, run.Model, run.Score, run.Passed, run.Total)
+	if !run.Regression {
+		return
+	}
+	evalRegressions.Add(1, run.Suite, run.Model)
+	text := fmt.Sprintf("Eval %s regressed on %s: %.2f against a baseline of %.2f", run.Suite, run.Model, run.Score, *run.Baseline)
+	log.Print(text)
+	if e.cfg.Webhook != "" {
+		alert := EvalAlert{Suite: run.Suite, Model: run.Model, Score: run.Score, Baseline: *run.Baseline, Text: text, Run: *run}
+		if err := postJSON(ctx, e.client, e.cfg.Webhook, alert); err != nil {
+			log.Printf("Error delivering eval alert: %v", err)
+		}
+	}
+}
+
+// history returns a suite's kept runs, newest first, for one model or all.
+func (e *evalRunner) history(s *EvalSuite, model string) []EvalRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := []EvalRun{}
+	for _, m := range s.Models {
+		if model != "" && m != model {
+			continue
+		}
+		out = append(out, e.runs[evalKey(s.Name, m)]...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	return out
+}
+
+// EvalSummary is a suite with each model's latest run.
+type EvalSummary struct {
+	Name     string             `json:"name"`
+	Schedule string             `json:"schedule,omitempty"`
+	Models   []string           `json:"models"`
+	Cases    int                `json:"cases"`
+	Latest   map[string]EvalRun `json:"latest"`
+}
+
+func (a *adminAPI) listEvals(w http.ResponseWriter, r *http.Request) {
+	e := a.proxy.evals
+	out := []EvalSummary{}
+	e.mu.Lock()
+	for _, s := range e.cfg.Suites {
+		sum := EvalSummary{Name: s.Name, Schedule: s.Schedule, Models: s.Models, Cases: len(s.Cases), Latest: map[string]EvalRun{}}
+		for _, m := range s.Models {
+			if runs := e.runs[evalKey(s.Name, m)]; len(runs) > 0 {
+				sum.Latest[m] = runs[len(runs)-1]
+			}
+		}
+		out = append(out, sum)
+	}
+	e.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"suites": out})
+}
+
+// evalHistory serves a suite's runs, for ?model= when given.
+func (a *adminAPI) evalHistory(w http.ResponseWriter, r *http.Request) {
+	s := a.proxy.evals.suite(r.PathValue("name"))
+	if s == nil {
+		writeError(w, http.StatusNotFound, "not_found", "no eval suite named "+r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"runs": a.proxy.evals.history(s, r.URL.Query().Get("model"))})
+}
+
+// runEval runs a suite now and returns its runs.
+func (a *adminAPI) runEval(w http.ResponseWriter, r *http.Request) {
+	s := a.proxy.evals.suite(r.PathValue("name"))
+	if s == nil {
+		writeError(w, http.StatusNotFound, "not_found", "no eval suite named "+r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"runs": a.proxy.evals.run(r.Context(), s)})
+}
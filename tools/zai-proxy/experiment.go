@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ExperimentConfig splits traffic between model variants. Requests from
+// Clients (default all) for Models (which may end in "*", default all)
+// go to each variant's Model for its Percent of them, drawn per request;
+// the rest are the control and keep the model they asked for. Responses
+// carry the variant in X-Ringmaster-Experiment, and the admin API reports
+// latency, cost and outcome per variant.
+type ExperimentConfig struct {
+	Name     string              `json:"name"`
+	Clients  []string            `json:"clients,omitempty"`
+	Models   []string            `json:"models,omitempty"`
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+// ExperimentVariant is one arm of an experiment.
+type ExperimentVariant struct {
+	Name    string  `json:"name"`
+	Model   string  `json:"model"`
+	Percent float64 `json:"percent"`
+}
+
+const controlVariant = "control"
+
+func (c *ExperimentConfig) validate() error {
+	if c.Name == "" || len(c.Variants) == 0 {
+		return fmt.Errorf("experiment: needs a name and variants")
+	}
+	total := 0.0
+	seen := map[string]bool{controlVariant: true}
+	for _, v := range c.Variants {
+		if v.Name == "" || v.Model == "" || seen[v.Name] {
+			return fmt.Errorf("experiment %s: every variant needs a model and a unique name other than %q", c.Name, controlVariant)
+		}
+		if v.Percent <= 0 {
+			return fmt.Errorf("experiment %s variant %s: percent must be positive", c.Name, v.Name)
+		}
+		seen[v.Name] = true
+		total += v.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("experiment %s: variant percents add up to more than 100", c.Name)
+	}
+	return nil
+}
+
+// applies reports whether a request falls in the experiment.
+func (c *ExperimentConfig) applies(client, model string) bool {
+	return (len(c.Clients) == 0 || slices.Contains(c.Clients, client)) &&
+		(len(c.Models) == 0 || matchModel(c.Models, model))
+}
+
+// draw picks a variant for one request.
+func (c *ExperimentConfig) draw() (name, model string) {
+	x := rand.Float64() * 100
+	for _, v := range c.Variants {
+		if x < v.Percent {
+			return v.Name, v.Model
+		}
+		x -= v.Percent
+	}
+	return controlVariant, ""
+}
+
+var (
+	experimentRequests = metrics.counter("zai_proxy_experiment_requests_total",
+		"Requests in experiments, by variant and outcome.", "experiment", "variant", "outcome")
+	experimentSeconds = metrics.counter("zai_proxy_experiment_seconds_total",
+		"Time spent serving experiment requests.", "experiment", "variant")
+	experimentCost = metrics.counter("zai_proxy_experiment_cost_usd_total",
+		"Estimated cost of experiment requests.", "experiment", "variant")
+)
+
+// experimentSamples is how many latencies each variant keeps for its
+// percentiles.
+const experimentSamples = 1000
+
+// VariantResult is what an experiment's variant has served so far.
+type VariantResult struct {
+	Requests         int64           `json:"requests"`
+	Errors           int64           `json:"errors"`
+	ErrorRate        float64         `json:"error_rate"`
+	Latency          LoadPercentiles `json:"latency"`
+	PromptTokens     int64           `json:"prompt_tokens"`
+	CompletionTokens int64           `json:"completion_tokens"`
+	CostUSD          float64         `json:"cost_usd"`
+	MeanCostUSD      float64         `json:"mean_cost_usd"`
+}
+
+// ExperimentResult is an experiment as the admin API reports it.
+type ExperimentResult struct {
+	ExperimentConfig
+	Since   time.Time                `json:"since"`
+	Results map[string]VariantResult `json:"results"`
+}
+
+type variantStats struct {
+	result    VariantResult
+	latencies ring[time.Duration]
+}
+
+// experimentStats are an experiment's results since it started or was
+// last reset.
+type experimentStats struct {
+	since    time.Time
+	variants map[string]*variantStats
+}
+
+// experiments keeps the results of the configured experiments.
+type experiments struct {
+	cfgs []ExperimentConfig
+
+	mu    sync.Mutex
+	stats map[string]*experimentStats
+}
+
+func newExperiments(cfgs []ExperimentConfig) *experiments {
+	e := &experiments{cfgs: cfgs, stats: map[string]*experimentStats{}}
+	for _, c := range cfgs {
+		e.reset(c.Name)
+	}
+	return e
+}
+
+func (e *experiments) record(name, variant string, status int, d time.Duration, u Usage, cost float64) {
+	outcome := "ok"
+	if status >= 400 {
+		outcome = "error"
+	}
+	experimentRequests.Add(1, name, variant, outcome)
+	experimentSeconds.Add(d.Seconds(), name, variant)
+	experimentCost.Add(cost, name, variant)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vs := e.stats[name].variants
+	s := vs[variant]
+	if s == nil {
+		s = &variantStats{latencies: ring[time.Duration]{n: experimentSamples}}
+		vs[variant] = s
+	}
+	s.result.Requests++
+	if outcome == "error" {
+		s.result.Errors++
+	}
+	s.result.PromptTokens += u.PromptTokens
+	s.result.CompletionTokens += u.CompletionTokens
+	s.result.CostUSD += cost
+	s.latencies.add(d)
+}
+
+// results reports every experiment, or the one named when name is set.
+func (e *experiments) results(name string) []ExperimentResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := []ExperimentResult{}
+	for _, c := range e.cfgs {
+		if name != "" && c.Name != name {
+			continue
+		}
+		st := e.stats[c.Name]
+		res := ExperimentResult{ExperimentConfig: c, Since: st.since, Results: map[string]VariantResult{}}
+		for variant, s := range st.variants {
+			r := s.result
+			r.Latency = percentilesOf(s.latencies.list())
+			if r.Requests > 0 {
+				r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+				r.MeanCostUSD = r.CostUSD / float64(r.Requests)
+			}
+			res.Results[variant] = r
+		}
+		out = append(out, res)
+	}
+	return out
+}
+
+// reset clears the named experiment's results.
+func (e *experiments) reset(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stats[name] = &experimentStats{since: time.Now().UTC(), variants: map[string]*variantStats{}}
+}
+
+// experimentStage puts requests in the first experiment that applies to
+// them, after transform has read the model, and accounts each variant's
+// responses. Autoroute comes after, so a variant may be "auto".
+func experimentStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if len(p.cfg.Experiments) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			i := slices.IndexFunc(p.cfg.Experiments, func(c ExperimentConfig) bool { return c.applies(ex.client, ex.model) })
+			if ex.doc == nil || ex.dryRun || i < 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c := &p.cfg.Experiments[i]
+			variant, model := c.draw()
+			if model != "" {
+				ex.model, ex.doc["model"], ex.dirty = model, model, true
+			}
+			w.Header().Set("X-Ringmaster-Experiment", c.Name+"="+variant)
+			ex.inspect = true
+			sink := &usageSink{}
+			start := time.Now()
+			next.ServeHTTP(teeTo(w, sink), r)
+			var u Usage
+			if sink.observer != nil {
+				_, u, _ = sink.observer.Finish()
+			}
+			status := sink.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			p.experiments.record(c.Name, variant, status, time.Since(start), u, p.cfg.Pricing.Cost(ex.model, u))
+		})
+	}, nil
+}
+
+func (a *adminAPI) listExperiments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"experiments": a.proxy.experiments.results("")})
+}
+
+func (a *adminAPI) getExperiment(w http.ResponseWriter, r *http.Request) {
+	res := a.proxy.experiments.results(r.PathValue("name"))
+	if len(res) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no experiment named "+r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, res[0])
+}
+
+func (a *adminAPI) resetExperiment(w http.ResponseWriter, r *http.Request) {
+	if len(a.proxy.experiments.results(r.PathValue("name"))) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no experiment named "+r.PathValue("name"))
+		return
+	}
+	a.proxy.experiments.reset(r.PathValue("name"))
+	w.WriteHeader(http.StatusNoContent)
+}
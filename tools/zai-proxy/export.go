@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var usageCSVHeader = []string{
+	"id", "time", "client", "project", "model", "provider", "status", "duration_ms",
+	"prompt_tokens", "completion_tokens", "cached_tokens", "cost_usd", "cache_write_tokens",
+}
+
+func writeUsageCSV(w io.Writer, recs []UsageRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(usageCSVHeader)
+	for _, r := range recs {
+		cw.Write([]string{
+			r.ID, r.Time.UTC().Format(time.RFC3339Nano), r.Client, r.Project, r.Model, r.Provider,
+			strconv.Itoa(r.Status), strconv.FormatInt(r.Duration.Milliseconds(), 10),
+			strconv.FormatInt(r.PromptTokens, 10), strconv.FormatInt(r.CompletionTokens, 10),
+			strconv.FormatInt(r.CachedTokens, 10), strconv.FormatFloat(r.CostUSD, 'f', -1, 64),
+			strconv.FormatInt(r.CacheWriteTokens, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeUsageParquet(w io.Writer, recs []UsageRecord) error {
+	str := func(name string, f func(UsageRecord) string) parquetColumn {
+		c := parquetColumn{Name: name, Type: parquetByteArray, UTF8: true, Strings: make([]string, len(recs))}
+		for i, r := range recs {
+			c.Strings[i] = f(r)
+		}
+		return c
+	}
+	i64 := func(name string, f func(UsageRecord) int64) parquetColumn {
+		c := parquetColumn{Name: name, Type: parquetInt64, Int64s: make([]int64, len(recs))}
+		for i, r := range recs {
+			c.Int64s[i] = f(r)
+		}
+		return c
+	}
+	ts := i64("time", func(r UsageRecord) int64 { return r.Time.UnixMilli() })
+	ts.Millis = true
+	cost := parquetColumn{Name: "cost_usd", Type: parquetDouble, Doubles: make([]float64, len(recs))}
+	for i, r := range recs {
+		cost.Doubles[i] = r.CostUSD
+	}
+	return writeParquet(w, []parquetColumn{
+		str("id", func(r UsageRecord) string { return r.ID }),
+		ts,
+		str("client", func(r UsageRecord) string { return r.Client }),
+		str("project", func(r UsageRecord) string { return r.Project }),
+		str("model", func(r UsageRecord) string { return r.Model }),
+		str("provider", func(r UsageRecord) string { return r.Provider }),
+		i64("status", func(r UsageRecord) int64 { return int64(r.Status) }),
+		i64("duration_ms", func(r UsageRecord) int64 { return r.Duration.Milliseconds() }),
+		i64("prompt_tokens", func(r UsageRecord) int64 { return r.PromptTokens }),
+		i64("completion_tokens", func(r UsageRecord) int64 { return r.CompletionTokens }),
+		i64("cached_tokens", func(r UsageRecord) int64 { return r.CachedTokens }),
+		cost,
+		i64("cache_write_tokens", func(r UsageRecord) int64 { return r.CacheWriteTokens }),
+	})
+}
+
+// writeUsageExport encodes recs in format ("csv" or "parquet").
+func writeUsageExport(w io.Writer, format string, recs []UsageRecord) error {
+	switch format {
+	case "csv":
+		return writeUsageCSV(w, recs)
+	case "parquet":
+		return writeUsageParquet(w, recs)
+	}
+	return fmt.Errorf("unknown export format %q (want csv or parquet)", format)
+}
+
+// exportDays is how far back an export without a start goes, from its end.
+const exportDays = 30
+
+// exportRange parses an export's from and to, RFC 3339 or YYYY-MM-DD;
+// to defaults to now and from to exportDays before to.
+func exportRange(from, to string, now time.Time) (start, end time.Time, err error) {
+	end = now.UTC()
+	if to != "" {
+		if end, err = parseUsageTime(to); err != nil {
+			return start, end, fmt.Errorf("to: %w", err)
+		}
+	}
+	start = end.AddDate(0, 0, -exportDays)
+	if from != "" {
+		if start, err = parseUsageTime(from); err != nil {
+			return start, end, fmt.Errorf("from: %w", err)
+		}
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("from must be before to")
+	}
+	return start, end, nil
+}
+
+// exportHandler serves GET /admin/export?from=&to=&format=csv|parquet.
+func exportHandler(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, http.StatusNotImplemented, "not_configured", "usage export requires persistent storage")
+			return
+		}
+		from, to, err := exportRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "parquet" {
+			writeError(w, http.StatusBadRequest, "invalid_request", "format must be csv or parquet")
+			return
+		}
+		recs, err := store.ListUsage(r.Context(), from, to)
+		if err != nil {
+			log.Printf("Error listing usage: %v", err)
+			writeError(w, http.StatusInternalServerError, "storage_error", "listing usage failed")
+			return
+		}
+		name := fmt.Sprintf("usage-%s-%s.%s", from.Format("20060102"), to.Format("20060102"), format)
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if err := writeUsageExport(w, format, recs); err != nil {
+			log.Printf("Error writing export: %v", err)
+		}
+	}
+}
+
+// runExport implements the export subcommand, reading the store named in
+// the config file directly.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file")
+	from := fs.String("from", "", fmt.Sprintf("start date (YYYY-MM-DD or RFC 3339), default %d days before -to", exportDays))
+	to := fs.String("to", "", "end date, exclusive; default now")
+	format := fs.String("format", "csv", "csv or parquet")
+	out := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return fmt.Errorf("no storage configured; nothing to export")
+	}
+	defer store.Close()
+
+	start, end, err := exportRange(*from, *to, time.Now())
+	if err != nil {
+		return fmt.Errorf("-%w", err)
+	}
+	recs, err := store.ListUsage(context.Background(), start, end)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeUsageExport(w, *format, recs)
+}
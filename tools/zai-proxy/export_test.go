@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExportRange checks the CLI and GET /admin/export default to the
+// same range, exportDays back from its end.
+func TestExportRange(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	day := func(s string) time.Time { d, _ := time.Parse(time.DateOnly, s); return d }
+	for _, tc := range []struct {
+		from, to   string
+		start, end time.Time
+		err        bool
+	}{
+		{"", "", now.AddDate(0, 0, -30), now, false},
+		{"", "2026-02-01", day("2026-01-02"), day("2026-02-01"), false},
+		{"2026-03-01", "", day("2026-03-01"), now, false},
+		{"2026-03-01", "2026-03-02", day("2026-03-01"), day("2026-03-02"), false},
+		{"2026-03-02", "2026-03-01", time.Time{}, time.Time{}, true},
+		{"March", "", time.Time{}, time.Time{}, true},
+	} {
+		start, end, err := exportRange(tc.from, tc.to, now)
+		if tc.err {
+			if err == nil {
+				t.Errorf("exportRange(%q, %q) accepted", tc.from, tc.to)
+			}
+			continue
+		}
+		if err != nil || !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("exportRange(%q, %q) = %v, %v, %v; want %v, %v", tc.from, tc.to, start, end, err, tc.start, tc.end)
+		}
+	}
+}
+
+// TestExportHandlerDefault exports, with no range given, a record older
+// than the usage API's week but within the export's default.
+func TestExportHandlerDefault(t *testing.T) {
+	s, err := openSQLStore("sqlite", filepath.Join(t.TempDir(), "zai-proxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, age := range map[string]int{"recent": 1, "weeks-old": 20, "too-old": 40} {
+		r := UsageRecord{ID: id, Time: time.Now().UTC().AddDate(0, 0, -age), Status: 200,
+			UsageKey: UsageKey{Client: "alice", Model: "glm-4.6", Provider: "zai"}}
+		if err := s.RecordUsage(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	exportHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/export", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "recent") || !strings.Contains(body, "weeks-old") || strings.Contains(body, "too-old") {
+		t.Errorf("export without a range =\n%s\nwant the last %d days' records", body, exportDays)
+	}
+	rec = httptest.NewRecorder()
+	exportHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/export?from=2026-03-02&to=2026-03-01", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("inverted range: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A small CEL-like expression language for config predicates and values,
+// e.g. request.body.model.startsWith("glm") && client.tier == "pro".
+//
+// Values are JSON-shaped: null, bool, number, string, list and map. Member
+// access on a missing field yields null instead of failing. Operators, from
+// lowest precedence: ?:, ||, &&, == != < <= > >= in, + -, * / %, unary ! -.
+// Functions: size(x), and the string methods startsWith, endsWith,
+// contains, matches (RE2), lower and upper.
+//
+// The grammar, in EBNF:
+//
+//	expr    = or [ "?" expr ":" expr ] .
+//	or      = and { "||" and } .
+//	and     = cmp { "&&" cmp } .
+//	cmp     = sum [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) sum ] .
+//	sum     = product { ( "+" | "-" ) product } .
+//	product = unary { ( "*" | "/" | "%" ) unary } .
+//	unary   = ( "!" | "-" ) unary | postfix .
+//	postfix = primary { "." ident [ args ] | "[" expr "]" } .
+//	primary = number | string | "true" | "false" | "null" | ident |
+//	          "size" args | "(" expr ")" | "[" [ expr { "," expr } ] "]" .
+//	args    = "(" [ expr { "," expr } ] ")" .
+//
+// Strings are quoted with " or ', escaping with \; numbers are decimal,
+// with an optional fraction and exponent. Comparisons don't chain, and
+// there are no map literals.
+//
+// Evaluation fails on operands of the wrong type rather than converting
+// them: &&, ||, ! and ?: take bools; + adds numbers or joins strings; - * /
+// and % take numbers, % truncating them to integers; < <= > >= compare two
+// numbers or two strings. == and != compare any values, null equal only to
+// null. x in y looks for x among a list's elements, a map's keys or, for
+// strings, y's substrings, and is false for a null y. Methods on null give
+// false, or null for lower and upper, and size(null) is 0.
+
+// Expr is a compiled expression.
+type Expr struct {
+	src  string
+	eval evalFn
+}
+
+type evalFn func(env map[string]any) (any, error)
+
+// compileExpr parses src.
+func compileExpr(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	fn, err := p.ternary()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return &Expr{src: src, eval: fn}, nil
+}
+
+func (e *Expr) String() string { return e.src }
+
+// Eval evaluates e against env.
+func (e *Expr) Eval(env map[string]any) (any, error) {
+	return e.eval(env)
+}
+
+// Bool evaluates e as a predicate; only true is true.
+func (e *Expr) Bool(env map[string]any) (bool, error) {
+	v, err := e.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q: result is %s, not bool", e.src, typeName(v))
+	}
+	return b, nil
+}
+
+// Text evaluates e and formats the result for use as a header value.
+func (e *Expr) Text(env map[string]any) (string, error) {
+	v, err := e.eval(env)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// exprField holds an expression in config; it is written as a JSON string.
+type exprField struct {
+	*Expr
+}
+
+func (f *exprField) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expression must be a string: %w", err)
+	}
+	e, err := compileExpr(s)
+	if err != nil {
+		return err
+	}
+	f.Expr = e
+	return nil
+}
+
+func (f exprField) MarshalJSON() ([]byte, error) {
+	if f.Expr == nil {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(f.src)
+}
+
+// Lexer
+
+type exprTok struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator
+	text string
+	num  float64
+}
+
+type exprParser struct {
+	src  string
+	toks []exprTok
+	pos  int
+}
+
+func (p *exprParser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			n, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("bad number %q", s[i:j])
+			}
+			p.toks = append(p.toks, exprTok{kind: 'n', text: s[i:j], num: n})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					switch s[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(s[j])
+					}
+					continue
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return fmt.Errorf("unterminated string")
+			}
+			p.toks = append(p.toks, exprTok{kind: 's', text: b.String()})
+			i = j + 1
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			p.toks = append(p.toks, exprTok{kind: 'i', text: s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">="} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("!<>+-*/%?:.,()[]", rune(c)) {
+					return fmt.Errorf("unexpected character %q", c)
+				}
+				op = string(c)
+			}
+			p.toks = append(p.toks, exprTok{kind: 'o', text: op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek(op string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].kind == 'o' && p.toks[p.pos].text == op
+}
+
+func (p *exprParser) accept(op string) bool {
+	if p.peek(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		if p.pos < len(p.toks) {
+			return fmt.Errorf("expected %q, found %q", op, p.toks[p.pos].text)
+		}
+		return fmt.Errorf("expected %q at end of expression", op)
+	}
+	return nil
+}
+
+// Parser: each level returns a closure evaluating its subtree.
+
+func (p *exprParser) ternary() (evalFn, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	a, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return func(env map[string]any) (any, error) {
+		c, err := cond(env)
+		if err != nil {
+			return nil, err
+		}
+		if truth, ok := c.(bool); !ok {
+			return nil, fmt.Errorf("condition is %s, not bool", typeName(c))
+		} else if truth {
+			return a(env)
+		}
+		return b(env)
+	}, nil
+}
+
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (evalFn, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range exprLevels[level] {
+			if o == "in" {
+				if p.pos < len(p.toks) && p.toks[p.pos].kind == 'i' && p.toks[p.pos].text == "in" {
+					op = o
+				}
+			} else if p.peek(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+		if level == 2 {
+			// Comparisons don't chain.
+			return left, nil
+		}
+	}
+}
+
+func binaryOp(op string, l, r evalFn) evalFn {
+	switch op {
+	case "&&", "||":
+		return func(env map[string]any) (any, error) {
+			a, err := l(env)
+			if err != nil {
+				return nil, err
+			}
+			ab, ok := a.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s needs bool operands, got %s", op, typeName(a))
+			}
+			if ab == (op == "||") {
+				return ab, nil
+			}
+			b, err := r(env)
+			if err != nil {
+				return nil, err
+			}
+			bb, ok := b.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s needs bool operands, got %s", op, typeName(b))
+			}
+			return bb, nil
+		}
+	}
+	return func(env map[string]any) (any, error) {
+		a, err := l(env)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r(env)
+		if err != nil {
+			return nil, err
+		}
+		return applyOp(op, a, b)
+	}
+}
+
+func applyOp(op string, a, b any) (any, error) {
+	switch op {
+	case "==":
+		return exprEqual(a, b), nil
+	case "!=":
+		return !exprEqual(a, b), nil
+	case "in":
+		switch c := b.(type) {
+		case []any:
+			for _, e := range c {
+				if exprEqual(a, e) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			k, ok := a.(string)
+			_, found := c[k]
+			return ok && found, nil
+		case string:
+			s, ok := a.(string)
+			return ok && strings.Contains(c, s), nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("in needs a list, map or string, got %s", typeName(b))
+	}
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to string and %s", op, typeName(b))
+		}
+		switch op {
+		case "+":
+			return as + bs, nil
+		case "<":
+			return as < bs, nil
+		case "<=":
+			return as <= bs, nil
+		case ">":
+			return as > bs, nil
+		case ">=":
+			return as >= bs, nil
+		}
+		return nil, fmt.Errorf("cannot apply %s to strings", op)
+	}
+	x, ok1 := a.(float64)
+	y, ok2 := b.(float64)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(a), typeName(b))
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "%":
+		if int64(y) == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(int64(x) % int64(y)), nil
+	case "<":
+		return x < y, nil
+	case "<=":
+		return x <= y, nil
+	case ">":
+		return x > y, nil
+	default:
+		return x >= y, nil
+	}
+}
+
+func (p *exprParser) unary() (evalFn, error) {
+	switch {
+	case p.accept("!"):
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env map[string]any) (any, error) {
+			v, err := f(env)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("! needs a bool, got %s", typeName(v))
+			}
+			return !b, nil
+		}, nil
+	case p.accept("-"):
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env map[string]any) (any, error) {
+			v, err := f(env)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("- needs a number, got %s", typeName(v))
+			}
+			return -n, nil
+		}, nil
+	}
+	return p.postfix()
+}
+
+func (p *exprParser) postfix() (evalFn, error) {
+	f, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			if p.pos >= len(p.toks) || p.toks[p.pos].kind != 'i' {
+				return nil, fmt.Errorf("expected a field name after .")
+			}
+			name := p.toks[p.pos].text
+			p.pos++
+			if p.peek("(") {
+				args, err := p.args()
+				if err != nil {
+					return nil, err
+				}
+				if f, err = method(name, f, args); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			f = member(f, func(map[string]any) (any, error) { return name, nil })
+		case p.accept("["):
+			idx, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			f = member(f, idx)
+		default:
+			return f, nil
+		}
+	}
+}
+
+func (p *exprParser) args() ([]evalFn, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []evalFn
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	return args, nil
+}
+
+func (p *exprParser) primary() (evalFn, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	constant := func(v any) evalFn { return func(map[string]any) (any, error) { return v, nil } }
+	switch t.kind {
+	case 'n':
+		return constant(t.num), nil
+	case 's':
+		return constant(t.text), nil
+	case 'i':
+		switch t.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "null":
+			return constant(nil), nil
+		case "size":
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, fmt.Errorf("size takes one argument")
+			}
+			return func(env map[string]any) (any, error) {
+				v, err := args[0](env)
+				if err != nil {
+					return nil, err
+				}
+				switch v := v.(type) {
+				case string:
+					return float64(len([]rune(v))), nil
+				case []any:
+					return float64(len(v)), nil
+				case map[string]any:
+					return float64(len(v)), nil
+				case nil:
+					return float64(0), nil
+				}
+				return nil, fmt.Errorf("size of %s", typeName(v))
+			}, nil
+		}
+		name := t.text
+		return func(env map[string]any) (any, error) { return normalizeValue(env[name]), nil }, nil
+	}
+	switch t.text {
+	case "(":
+		f, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	case "[":
+		var elems []evalFn
+		for !p.accept("]") {
+			if len(elems) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			e, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, e)
+		}
+		return func(env map[string]any) (any, error) {
+			out := make([]any, len(elems))
+			for i, e := range elems {
+				v, err := e(env)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = v
+			}
+			return out, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// member indexes a map by string or a list by number; misses yield null.
+func member(obj, key evalFn) evalFn {
+	return func(env map[string]any) (any, error) {
+		o, err := obj(env)
+		if err != nil {
+			return nil, err
+		}
+		k, err := key(env)
+		if err != nil {
+			return nil, err
+		}
+		switch o := o.(type) {
+		case map[string]any:
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key must be a string, got %s", typeName(k))
+			}
+			return normalizeValue(o[s]), nil
+		case []any:
+			n, ok := k.(float64)
+			if !ok {
+				return nil, fmt.Errorf("list index must be a number, got %s", typeName(k))
+			}
+			if i := int(n); i >= 0 && i < len(o) {
+				return normalizeValue(o[i]), nil
+			}
+			return nil, nil
+		}
+		return nil, nil
+	}
+}
+
+var exprRegexps sync.Map // pattern -> *regexp.Regexp
+
+func method(name string, recv evalFn, args []evalFn) (evalFn, error) {
+	want := map[string]int{"startsWith": 1, "endsWith": 1, "contains": 1, "matches": 1, "lower": 0, "upper": 0}
+	n, ok := want[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown method %s", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d argument(s)", name, n)
+	}
+	return func(env map[string]any) (any, error) {
+		v, err := recv(env)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			if n == 0 {
+				return nil, nil
+			}
+			return false, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s called on %s", name, typeName(v))
+		}
+		switch name {
+		case "lower":
+			return strings.ToLower(s), nil
+		case "upper":
+			return strings.ToUpper(s), nil
+		}
+		a, err := args[0](env)
+		if err != nil {
+			return nil, err
+		}
+		arg, ok := a.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a string argument, got %s", name, typeName(a))
+		}
+		switch name {
+		case "startsWith":
+			return strings.HasPrefix(s, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(s, arg), nil
+		case "contains":
+			return strings.Contains(s, arg), nil
+		}
+		re, ok := exprRegexps.Load(arg)
+		if !ok {
+			c, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			re, _ = exprRegexps.LoadOrStore(arg, c)
+		}
+		return re.(*regexp.Regexp).MatchString(s), nil
+	}, nil
+}
+
+// normalizeValue converts decoded JSON numbers to float64.
+func normalizeValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return v
+}
+
+func exprEqual(a, b any) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case bool, float64, string:
+		return a == b
+	}
+	return jsonEqual(a, b)
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// exprEnv returns the variables expressions see for a request:
+//
+//	request.method, .path, .model, .project, .agent, .ip, .headers (lower-case names,
+//	first value), .body (the decoded JSON body or null)
+//	client.name, .tier, .labels
+func (p *proxy) exprEnv(ex *exchange, r *http.Request) map[string]any {
+	if ex.env != nil {
+		return ex.env
+	}
+	headers := make(map[string]any, len(r.Header))
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			headers[strings.ToLower(k)] = v[0]
+		}
+	}
+	var body any
+	if ex.doc != nil {
+		body = ex.doc
+	}
+	client := map[string]any{"name": ex.client, "tier": "", "labels": map[string]any{}}
+	if c := p.registry.Client(ex.client); c != nil {
+		labels := make(map[string]any, len(c.Labels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		client["tier"], client["labels"] = c.Tier, labels
+	}
+	ex.env = map[string]any{
+		"request": map[string]any{
+			"method": r.Method, "path": r.URL.Path, "model": ex.model,
+			"project": ex.project, "agent": ex.agent, "ip": ex.ip, "headers": headers, "body": body,
+		},
+		"client": client,
+		"flags":  p.flags.forClient(ex.client),
+	}
+	return ex.env
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// exprTestEnv is shaped like exprEnv's, as decoded JSON.
+func exprTestEnv(t *testing.T) map[string]any {
+	var env map[string]any
+	err := json.Unmarshal([]byte(`{
+		"request": {"model": "glm-4.6", "path": "/v1/chat/completions",
+			"headers": {"x-team": "search"}, "body": {"messages": [{"role": "user"}], "max_tokens": 512}},
+		"client": {"name": "alice", "tier": "pro", "labels": {"env": "prod"}}
+	}`), &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// TestExprEval evaluates expressions for their values: precedence and
+// associativity, nulls for what is missing, and each operator and
+// function on the types it takes.
+func TestExprEval(t *testing.T) {
+	env := exprTestEnv(t)
+	for _, tc := range []struct {
+		src  string
+		want any
+	}{
+		// Precedence, loosest first: ?:, ||, &&, comparisons, + -, * / %, unary.
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`10 - 4 - 3`, 3.0},
+		{`12 / 3 / 2`, 2.0},
+		{`7 % 4 * 2`, 6.0},
+		{`-2 * 3`, -6.0},
+		{`- -2`, 2.0},
+		{`1 + 2 == 3`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`false ? 1 : true ? 2 : 3`, 2.0},
+		{`true ? false ? 1 : 2 : 3`, 2.0},
+		{`1 > 2 || 3 > 2 ? "yes" : "no"`, "yes"},
+
+		// Members and nulls.
+		{`request.model`, "glm-4.6"},
+		{`request["model"]`, "glm-4.6"},
+		{`request.body.messages[0].role`, "user"},
+		{`request.body.max_tokens / 2`, 256.0},
+		{`request.body.missing`, nil},
+		{`request.body.missing.deeper`, nil},
+		{`request.body.messages[5]`, nil},
+		{`request.body.messages[-1]`, nil},
+		{`nowhere`, nil},
+		{`nowhere == null`, true},
+		{`null == false`, false},
+		{`request.body.missing.startsWith("x")`, false},
+		{`request.body.missing.lower()`, nil},
+		{`size(request.body.missing)`, 0.0},
+		{`"x" in null`, false},
+		{`false && nowhere.size > 1`, false},
+		{`true || 1`, true},
+
+		// Operators and functions.
+		{`"glm" + "-4.6"`, "glm-4.6"},
+		{`"a" < "b"`, true},
+		{`"b" >= "b"`, true},
+		{`2 <= 2`, true},
+		{`2.5 > 3`, false},
+		{`1e3`, 1000.0},
+		{`7.9 % 4`, 3.0},
+		{`[1, "a"] == [1, "a"]`, true},
+		{`client.tier in ["pro", "enterprise"]`, true},
+		{`"env" in client.labels`, true},
+		{`"search" in request.headers["x-team"]`, true},
+		{`request.model.startsWith("glm")`, true},
+		{`request.model.endsWith(".6")`, true},
+		{`request.path.contains("/chat/")`, true},
+		{`request.model.matches("^glm-[0-9.]+$")`, true},
+		{`client.name.upper()`, "ALICE"},
+		{`"ÉTÉ".lower()`, "été"},
+		{`size("héllo")`, 5.0},
+		{`size(request.body.messages)`, 1.0},
+		{`size(client.labels)`, 1.0},
+		{`'it\'s' + "\t"`, "it's\t"},
+	} {
+		e, err := compileExpr(tc.src)
+		if err != nil {
+			t.Errorf("compile %s: %v", tc.src, err)
+			continue
+		}
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if !exprEqual(got, tc.want) {
+			t.Errorf("%s = %#v, want %#v", tc.src, got, tc.want)
+		}
+	}
+}
+
+// TestExprCompileErrors rejects expressions outside the grammar.
+func TestExprCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`1 +`,
+		`(1 + 2`,
+		`1 < 2 == true`,
+		`1 < 2 < 3`,
+		`a ? b`,
+		`[1, 2,]`,
+		`{"env": "prod"}`,
+		`"unterminated`,
+		`1 & 2`,
+		`a.`,
+		`a.1`,
+		`size(1, 2)`,
+		`request.model.trim()`,
+		`request.model.startsWith()`,
+		`1..2`,
+		`1 2`,
+	} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("compiled %q", src)
+		}
+	}
+}
+
+// TestExprTypeErrors evaluates expressions whose operands have the wrong
+// types, which fail rather than guess.
+func TestExprTypeErrors(t *testing.T) {
+	env := exprTestEnv(t)
+	for _, src := range []string{
+		`1 + "a"`,
+		`"a" + 1`,
+		`"a" - "b"`,
+		`null < 1`,
+		`null + 1`,
+		`[1] + [2]`,
+		`1 && true`,
+		`true && 1`,
+		`!1`,
+		`-"a"`,
+		`1 ? 2 : 3`,
+		`nowhere ? 2 : 3`,
+		`1 / 0`,
+		`1 % 0.5`,
+		`1 in 2`,
+		`request.body.messages["0"]`,
+		`client.labels[0]`,
+		`size(1)`,
+		`client.labels.startsWith("a")`,
+		`request.model.startsWith(1)`,
+		`request.model.matches("(")`,
+	} {
+		e, err := compileExpr(src)
+		if err != nil {
+			t.Errorf("compile %s: %v", src, err)
+			continue
+		}
+		if v, err := e.Eval(env); err == nil {
+			t.Errorf("%s = %#v, want a type error", src, v)
+		}
+	}
+}
+
+// TestExprResults checks Bool accepts only booleans and Text formats
+// values for headers.
+func TestExprResults(t *testing.T) {
+	env := exprTestEnv(t)
+	for _, tc := range []struct {
+		src, text string
+		isBool    bool
+	}{
+		{`request.model`, "glm-4.6", false},
+		{`request.body.max_tokens`, "512", false},
+		{`0.5 * 3`, "1.5", false},
+		{`client.tier == "pro"`, "true", true},
+		{`request.body.missing`, "", false},
+		{`request.body.messages[0]`, `{"role":"user"}`, false},
+	} {
+		e, err := compileExpr(tc.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := e.Text(env); err != nil || got != tc.text {
+			t.Errorf("Text(%s) = %q, %v; want %q", tc.src, got, err, tc.text)
+		}
+		if _, err := e.Bool(env); (err == nil) != tc.isBool {
+			t.Errorf("Bool(%s) error %v, want one: %v", tc.src, err, !tc.isBool)
+		}
+	}
+}
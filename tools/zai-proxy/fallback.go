@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FallbackConfig answers requests no upstream could serve, those the
+// upstream or the proxy answered 502, 503 or 504 once retries and hedges
+// were spent, in place of the error. Serve lists what to try, in order:
+// "stale" replays the last successful answer to the same client's
+// identical request, kept up to StaleFor (default 24h), at most
+// MaxEntries (default 10000) answers of MaxBytes (default 64MB) in all;
+// "canned" answers with Canned's response for the model, the "*" entry
+// for models it doesn't list; "job" queues the request as a background
+// job that runs after JobDelay (default 1m), answering 202 with the job
+// to poll at /v1/jobs/{id}. Answers served so carry X-Ringmaster-Fallback
+// naming which, and are accounted without usage.
+type FallbackConfig struct {
+	Serve      []string                  `json:"serve,omitempty"`
+	StaleFor   Duration                  `json:"stale_for,omitempty"`
+	MaxEntries int                       `json:"max_entries,omitempty"`
+	MaxBytes   int64                     `json:"max_bytes,omitempty"`
+	Canned     map[string]CannedResponse `json:"canned,omitempty"`
+	JobDelay   Duration                  `json:"job_delay,omitempty"`
+}
+
+// CannedResponse is a configured fallback answer: Body as given, else a
+// chat completion saying Content, with Status (default 200).
+type CannedResponse struct {
+	Status  int             `json:"status,omitempty"`
+	Content string          `json:"content,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+}
+
+const fallbackHeader = "X-Ringmaster-Fallback"
+
+func (c *FallbackConfig) validate() error {
+	for _, s := range c.Serve {
+		switch s {
+		case "stale", "canned", "job":
+		default:
+			return fmt.Errorf("fallback: unknown serve %q (want stale, canned or job)", s)
+		}
+		if s == "canned" && len(c.Canned) == 0 {
+			return fmt.Errorf("fallback: serve canned needs canned responses")
+		}
+	}
+	if c.StaleFor < 0 || c.MaxEntries < 0 || c.MaxBytes < 0 || c.JobDelay < 0 {
+		return fmt.Errorf("fallback: stale_for, max_entries, max_bytes and job_delay must not be negative")
+	}
+	for model, cr := range c.Canned {
+		if cr.Status != 0 && (cr.Status < 200 || cr.Status > 599) {
+			return fmt.Errorf("fallback: canned: %s: status %d is not an HTTP status", model, cr.Status)
+		}
+		if len(cr.Body) > 0 && !json.Valid(cr.Body) {
+			return fmt.Errorf("fallback: canned: %s: body is not JSON", model)
+		}
+	}
+	return nil
+}
+
+var fallbacksServed = metrics.counter("zai_proxy_fallbacks_total",
+	"Requests no upstream could serve, by the fallback answering them, none when none could.", "served")
+
+// fallbacks keeps the answers stale fallbacks replay.
+type fallbacks struct {
+	cfg *FallbackConfig
+
+	mu   sync.Mutex
+	kept *lru[string, StoredResponse]
+}
+
+// newFallbacks returns the fallback answers, or nil when none are served.
+func newFallbacks(cfg *FallbackConfig) *fallbacks {
+	if len(cfg.Serve) == 0 {
+		return nil
+	}
+	f := &fallbacks{cfg: cfg}
+	if slices.Contains(cfg.Serve, "stale") {
+		f.kept = newLRU("fallback", cmp.Or(cfg.MaxEntries, 10000), cmp.Or(cfg.MaxBytes, 64<<20),
+			func(key string, sr StoredResponse) int64 { return int64(len(key) + len(sr.Body)) })
+	}
+	return f
+}
+
+func (f *fallbacks) keep(key string, sr StoredResponse) {
+	if f.kept == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kept.put(key, sr)
+}
+
+// stale returns the answer kept for key, if it is recent enough.
+func (f *fallbacks) stale(key string) (StoredResponse, bool) {
+	if f.kept == nil {
+		return StoredResponse{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sr, ok := f.kept.get(key)
+	if !ok || time.Since(sr.At) > time.Duration(cmp.Or(f.cfg.StaleFor, Duration(24*time.Hour))) {
+		return StoredResponse{}, false
+	}
+	return sr, true
+}
+
+// unavailable reports whether a response says no upstream could serve
+// the request: a gateway error the upstream sent, or the proxy's own for
+// one it couldn't reach.
+func unavailable(status int, h http.Header) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+	switch h.Get(errorHeader) {
+	case "", "upstream_error", "upstream_timeout":
+		return true
+	}
+	return false
+}
+
+// fallbackWriter passes a response through unless it says no upstream
+// could serve the request, which it holds back for a fallback to replace.
+type fallbackWriter struct {
+	http.ResponseWriter
+	base  http.Header // the headers before the request was served
+	held  *heldResponse
+	wrote bool
+}
+
+func (w *fallbackWriter) WriteHeader(code int) {
+	if w.wrote || code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wrote = true
+	if unavailable(code, w.Header()) {
+		w.held = &heldResponse{w: w.ResponseWriter, h: w.Header().Clone(), status: code}
+		clear(w.Header())
+		for k, vs := range w.base {
+			w.Header()[k] = vs
+		}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *fallbackWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held != nil {
+		return w.held.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *fallbackWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.held == nil {
+		f.Flush()
+	}
+}
+
+func (w *fallbackWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// fallbackStage answers requests no upstream could serve with what
+// fallback.serve lists, keeping successful answers for stale ones. It
+// follows transform so requests are matched by the bodies clients sent,
+// and precedes idempotency so fallback answers are never kept as real.
+func fallbackStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if p.fallbacks == nil {
+			return next
+		}
+		cfg := p.fallbacks.cfg
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			// Fallback jobs are the fallback; they fail as they would.
+			if ex.dryRun || isWebSocket(r) || r.Header.Get(fallbackHeader) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := ex.client + "\x00" + requestFingerprint(r, ex.body)
+			fw := &fallbackWriter{ResponseWriter: w, base: w.Header().Clone()}
+			var sink *keptSink
+			var out http.ResponseWriter = fw
+			if p.fallbacks.kept != nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				sink = &keptSink{bodySink: bodySink{limit: maxObservedBody}}
+				out = teeTo(fw, sink)
+			}
+			next.ServeHTTP(out, r)
+			if fw.held == nil {
+				if sink != nil && sink.status >= 200 && sink.status < 300 && !sink.truncated && r.Context().Err() == nil {
+					p.fallbacks.keep(key, StoredResponse{Status: sink.status, Header: sink.header, Body: sink.body, At: time.Now()})
+				}
+				return
+			}
+			if r.Context().Err() != nil {
+				fw.held.sendTo(w)
+				return
+			}
+			for _, s := range cfg.Serve {
+				if p.serveFallback(w, r, ex, s, key) {
+					fallbacksServed.Add(1, s)
+					return
+				}
+			}
+			fallbacksServed.Add(1, "none")
+			fw.held.sendTo(w)
+		})
+	}, nil
+}
+
+// serveFallback answers r by how, reporting false if it can't.
+func (p *proxy) serveFallback(w http.ResponseWriter, r *http.Request, ex *exchange, how, key string) bool {
+	cfg := p.fallbacks.cfg
+	switch how {
+	case "stale":
+		sr, ok := p.fallbacks.stale(key)
+		if !ok {
+			return false
+		}
+		ex.replayed = true
+		for k, vs := range sr.Header {
+			if _, ok := w.Header()[k]; !ok {
+				w.Header()[k] = vs
+			}
+		}
+		w.Header().Set(fallbackHeader, "stale")
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(sr.At).Seconds())))
+		w.WriteHeader(sr.Status)
+		w.Write(sr.Body)
+		return true
+	case "canned":
+		cr, ok := cfg.Canned[ex.model]
+		if !ok {
+			if cr, ok = cfg.Canned["*"]; !ok {
+				return false
+			}
+		}
+		ex.replayed = true
+		w.Header().Set(fallbackHeader, "canned")
+		status := cmp.Or(cr.Status, http.StatusOK)
+		if len(cr.Body) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(cr.Body)
+			return true
+		}
+		writeJSON(w, status, map[string]any{"id": "chatcmpl-" + ex.id, "object": "chat.completion",
+			"created": time.Now().Unix(), "model": ex.model, "choices": []any{map[string]any{"index": 0,
+				"message": map[string]any{"role": "assistant", "content": cr.Content}, "finish_reason": "stop"}}})
+		return true
+	case "job":
+		if p.jobs == nil || r.Method != http.MethodPost || ex.doc == nil {
+			return false
+		}
+		stream, _ := ex.doc["stream"].(bool)
+		h := r.Header.Clone()
+		h.Set(fallbackHeader, "job")
+		j, err := p.jobs.submit(ex.client, cmp.Or(ex.priority, "normal"), AsyncJobRequest{Path: r.URL.Path, Body: ex.body,
+			Stream: stream, Delay: cmp.Or(cfg.JobDelay, Duration(time.Minute))}, h)
+		if err != nil {
+			log.Printf("Error queueing fallback job for %s: %v", ex.client, err)
+			return false
+		}
+		ex.replayed = true
+		w.Header().Set(fallbackHeader, "job")
+		w.Header().Set("Location", jobsPath+"/"+j.ID)
+		writeJSON(w, http.StatusAccepted, j)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fallbackUpstream stands in for the stages after fallback, answering
+// however the test last set it to.
+type fallbackUpstream struct {
+	status  int
+	errType string // an error the proxy made, when set
+}
+
+func (u *fallbackUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.errType != "" {
+		writeError(w, u.status, u.errType, "no upstream answered")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Upstream", "primary")
+	w.WriteHeader(u.status)
+	w.Write([]byte(`{"answer":"` + http.StatusText(u.status) + `"}`))
+}
+
+// fallbackRequest sends ex's request through the fallback stage h.
+func fallbackRequest(t *testing.T, h http.Handler, ex *exchange) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(string(ex.body)))
+	r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// TestFallbackStage replaces answers no upstream could give, and only
+// those: with the same client's last answer to the same request, else a
+// canned one for the model.
+func TestFallbackStage(t *testing.T) {
+	cfg := &FallbackConfig{Serve: []string{"job", "stale", "canned"}, Canned: map[string]CannedResponse{
+		"glm-4.6": {Content: "try again shortly"},
+		"*":       {Status: http.StatusServiceUnavailable, Body: json.RawMessage(`{"error":"down"}`)},
+	}}
+	up := &fallbackUpstream{status: http.StatusOK}
+	p := &proxy{fallbacks: newFallbacks(cfg)}
+	mw, err := fallbackStage(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(up)
+	req := func(client, model, body string) *exchange {
+		return &exchange{id: "req1", client: client, model: model, body: []byte(body)}
+	}
+	const asked = `{"model":"glm-4.6","messages":[]}`
+	if rec := fallbackRequest(t, h, req("alice", "glm-4.6", asked)); rec.Code != http.StatusOK || rec.Header().Get(fallbackHeader) != "" {
+		t.Fatalf("while up: status %d, fallback %q", rec.Code, rec.Header().Get(fallbackHeader))
+	}
+
+	for _, tc := range []struct {
+		name         string
+		status       int
+		errType      string
+		ex           *exchange
+		want         int
+		served, body string
+		upstreamLeft bool // the upstream's own headers reach the client
+		errTypeStays bool
+	}{
+		{"stale", http.StatusBadGateway, "upstream_error", req("alice", "glm-4.6", asked),
+			http.StatusOK, "stale", `{"answer":"OK"}`, true, false},
+		{"upstream's own 503", http.StatusServiceUnavailable, "", req("alice", "glm-4.6", asked),
+			http.StatusOK, "stale", `{"answer":"OK"}`, true, false},
+		{"not another client's", http.StatusGatewayTimeout, "upstream_timeout", req("bob", "glm-4.6", asked),
+			http.StatusOK, "canned", `"try again shortly"`, false, false},
+		{"not another request's", http.StatusBadGateway, "upstream_error", req("alice", "glm-4.6", `{"model":"glm-4.6","messages":[{}]}`),
+			http.StatusOK, "canned", `"try again shortly"`, false, false},
+		{"canned for other models", http.StatusBadGateway, "upstream_error", req("bob", "gpt-5", `{}`),
+			http.StatusServiceUnavailable, "canned", `{"error":"down"}`, false, false},
+		{"the proxy's own refusal", http.StatusServiceUnavailable, "overloaded", req("alice", "glm-4.6", asked),
+			http.StatusServiceUnavailable, "", `"overloaded"`, false, true},
+		{"a client error", http.StatusTooManyRequests, "", req("alice", "glm-4.6", asked),
+			http.StatusTooManyRequests, "", `{"answer":"Too Many Requests"}`, true, false},
+		{"dry run", http.StatusBadGateway, "upstream_error", &exchange{client: "alice", model: "glm-4.6", body: []byte(asked), dryRun: true},
+			http.StatusBadGateway, "", `"upstream_error"`, false, true},
+	} {
+		up.status, up.errType = tc.status, tc.errType
+		rec := fallbackRequest(t, h, tc.ex)
+		if rec.Code != tc.want || rec.Header().Get(fallbackHeader) != tc.served || !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("%s: status %d, fallback %q, body %s; want %d, %q, %s",
+				tc.name, rec.Code, rec.Header().Get(fallbackHeader), rec.Body, tc.want, tc.served, tc.body)
+		}
+		if got := rec.Header().Get("X-Upstream") != ""; got != tc.upstreamLeft {
+			t.Errorf("%s: X-Upstream sent = %v, want %v", tc.name, got, tc.upstreamLeft)
+		}
+		if got := rec.Header().Get(errorHeader) != ""; got != tc.errTypeStays {
+			t.Errorf("%s: %s = %q", tc.name, errorHeader, rec.Header().Get(errorHeader))
+		}
+		if tc.served != "" && !tc.ex.replayed {
+			t.Errorf("%s: fallback answer accounted as real", tc.name)
+		}
+	}
+}
+
+// TestFallbackNone sends the error on when no fallback can answer: a
+// stale answer too old, and no canned one.
+func TestFallbackNone(t *testing.T) {
+	p := &proxy{fallbacks: newFallbacks(&FallbackConfig{Serve: []string{"stale"}, StaleFor: Duration(time.Nanosecond)})}
+	mw, _ := fallbackStage(p, nil)
+	up := &fallbackUpstream{status: http.StatusOK}
+	h := mw(up)
+	ex := func() *exchange { return &exchange{client: "alice", model: "glm-4.6", body: []byte(`{}`)} }
+	fallbackRequest(t, h, ex())
+	time.Sleep(time.Millisecond)
+	up.status, up.errType = http.StatusBadGateway, "upstream_error"
+	rec := fallbackRequest(t, h, ex())
+	if rec.Code != http.StatusBadGateway || rec.Header().Get(errorHeader) != "upstream_error" || rec.Header().Get(fallbackHeader) != "" {
+		t.Errorf("status %d, %s %q, fallback %q; want the 502 as it was",
+			rec.Code, errorHeader, rec.Header().Get(errorHeader), rec.Header().Get(fallbackHeader))
+	}
+	if newFallbacks(&FallbackConfig{}) != nil {
+		t.Errorf("fallbacks made with none to serve")
+	}
+}
+
+// TestFallbackValidate rejects configurations fallbacks couldn't serve.
+func TestFallbackValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  FallbackConfig
+		ok   bool
+	}{
+		{"all", FallbackConfig{Serve: []string{"stale", "canned", "job"}, Canned: map[string]CannedResponse{"*": {Content: "busy"}}}, true},
+		{"unknown", FallbackConfig{Serve: []string{"cache"}}, false},
+		{"canned without responses", FallbackConfig{Serve: []string{"canned"}}, false},
+		{"negative", FallbackConfig{Serve: []string{"stale"}, StaleFor: -1}, false},
+		{"bad status", FallbackConfig{Serve: []string{"canned"}, Canned: map[string]CannedResponse{"*": {Status: 42}}}, false},
+		{"bad body", FallbackConfig{Serve: []string{"canned"}, Canned: map[string]CannedResponse{"*": {Body: json.RawMessage(`{`)}}}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: validate = %v", tc.name, err)
+		}
+	}
+}
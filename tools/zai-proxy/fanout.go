@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FanoutConfig serves POST /v1/fanout, which sends one chat request to
+// several models at once through the route serving Path (default
+// /v1/chat/completions), so each answer is authenticated, limited and
+// accounted like any other request. Groups name model lists a request can
+// pick with "group"; at most Max models (default 8) are asked at once.
+type FanoutConfig struct {
+	Groups map[string][]string `json:"groups,omitempty"`
+	Path   string              `json:"path,omitempty"`
+	Max    int                 `json:"max,omitempty"`
+}
+
+const fanoutPath = "/v1/fanout"
+
+func (c *FanoutConfig) validate() error {
+	if c.Path == fanoutPath {
+		return fmt.Errorf("fanout: path cannot be the fanout endpoint itself")
+	}
+	if c.Max < 0 {
+		return fmt.Errorf("fanout: max must not be negative")
+	}
+	for name, models := range c.Groups {
+		if len(models) == 0 {
+			return fmt.Errorf("fanout: group %q has no models", name)
+		}
+	}
+	return nil
+}
+
+// route is the path fanned out requests are sent through.
+func (c *FanoutConfig) route() string {
+	if c.Path == "" {
+		return "/v1/chat/completions"
+	}
+	return c.Path
+}
+
+// models resolves the models a request names, directly or by group.
+func (c *FanoutConfig) models(fr FanoutRequest, limit int) ([]string, error) {
+	models := fr.Models
+	if fr.Group != "" {
+		if models = c.Groups[fr.Group]; models == nil {
+			return nil, fmt.Errorf("unknown fanout group %q", fr.Group)
+		}
+	}
+	if len(models) == 0 || len(models) > limit {
+		return nil, fmt.Errorf("give between 1 and %d models or a group", limit)
+	}
+	return models, nil
+}
+
+// FanoutRequest is a chat request with the models to send it to, listed
+// or named by group, in place of "model".
+type FanoutRequest struct {
+	Models []string `json:"models,omitempty"`
+	Group  string   `json:"group,omitempty"`
+	Stream bool     `json:"stream,omitempty"`
+}
+
+// FanoutResult is one model's answer. Response is the upstream's body
+// when it is JSON; streamed answers arrive as chunk events instead.
+type FanoutResult struct {
+	Index    int             `json:"index"`
+	Model    string          `json:"model"`
+	Status   int             `json:"status"`
+	Duration Duration        `json:"duration"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+
+	header http.Header
+}
+
+// FanoutChunk is one streamed event of one model, sent as a "chunk" event.
+type FanoutChunk struct {
+	Index int             `json:"index"`
+	Model string          `json:"model"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// fanoutHandler answers with every model's response collected as JSON or,
+// for stream requests, one event stream multiplexing their chunks, each
+// model ending with a "result" event.
+func fanoutHandler(cfg *Config, mux *http.ServeMux) http.Handler {
+	path := cfg.Fanout.route()
+	limit := cfg.Fanout.Max
+	if limit == 0 {
+		limit = 8
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]any
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&doc); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON chat request: "+err.Error())
+			return
+		}
+		var fr FanoutRequest
+		b, _ := json.Marshal(doc)
+		json.Unmarshal(b, &fr)
+		models, err := cfg.Fanout.models(fr, limit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		delete(doc, "models")
+		delete(doc, "group")
+
+		var out *fanoutStream
+		if fr.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			out = &fanoutStream{w: w}
+		}
+		results := make([]FanoutResult, len(models))
+		var wg sync.WaitGroup
+		for i, model := range models {
+			wg.Add(1)
+			go func(i int, model string) {
+				defer wg.Done()
+				results[i] = fanoutOne(mux, r, path, doc, i, model, out)
+				if out != nil {
+					out.event("result", results[i])
+				}
+			}(i, model)
+		}
+		wg.Wait()
+		if out != nil {
+			out.write([]byte("data: [DONE]\n\n"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"responses": results})
+	})
+}
+
+// fanoutOne sends the request for one model through the mux, as if the
+// client had sent it.
+func fanoutOne(mux *http.ServeMux, r *http.Request, path string, doc map[string]any, i int, model string, out *fanoutStream) FanoutResult {
+	res := FanoutResult{Index: i, Model: model}
+	body := make(map[string]any, len(doc)+1)
+	for k, v := range doc {
+		body[k] = v
+	}
+	body["model"] = model
+	b, err := encodeJSON(body)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	sub, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(b))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	sub.Header = r.Header.Clone()
+	for _, h := range []string{"Content-Length", "Content-Encoding", "Accept-Encoding"} {
+		sub.Header.Del(h)
+	}
+	sub.Header.Set("Content-Type", "application/json")
+	sub.RemoteAddr, sub.Host = r.RemoteAddr, r.Host
+
+	rec := &fanoutRecorder{h: http.Header{}, out: out, index: i, model: model}
+	start := time.Now()
+	h, _ := mux.Handler(sub)
+	h.ServeHTTP(rec, sub)
+	res.Duration = Duration(time.Since(start))
+	res.Status, res.header = rec.status, rec.h
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	if !rec.sse {
+		if json.Valid(rec.body.Bytes()) {
+			res.Response = json.RawMessage(rec.body.Bytes())
+		} else if rec.body.Len() > 0 {
+			res.Error = strings.TrimSpace(rec.body.String())
+		}
+	}
+	return res
+}
+
+// fanoutStream serializes the events of all models onto one response, or
+// hands their chunks to collect.
+type fanoutStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	collect func(FanoutChunk)
+}
+
+func (s *fanoutStream) chunk(c FanoutChunk) {
+	if s.collect != nil {
+		s.collect(c)
+		return
+	}
+	s.event("chunk", c)
+}
+
+func (s *fanoutStream) write(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(b)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *fanoutStream) event(name string, v any) {
+	b, _ := json.Marshal(v)
+	s.write([]byte("event: " + name + "\ndata: " + string(b) + "\n\n"))
+}
+
+// fanoutRecorder receives one model's response: JSON bodies are kept, and
+// with a stream each complete data line is passed on as a chunk event.
+type fanoutRecorder struct {
+	h       http.Header
+	status  int
+	sse     bool
+	body    bytes.Buffer
+	partial []byte
+	out     *fanoutStream
+	index   int
+	model   string
+}
+
+func (w *fanoutRecorder) Header() http.Header { return w.h }
+
+func (w *fanoutRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.sse = w.out != nil && strings.HasPrefix(w.h.Get("Content-Type"), "text/event-stream")
+	}
+}
+
+func (w *fanoutRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sse {
+		if w.body.Len()+len(b) > maxObservedBody {
+			return 0, errLineTooLong
+		}
+		return w.body.Write(b)
+	}
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(w.partial[:i], "\r")
+		w.partial = w.partial[i+1:]
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if data = bytes.TrimSpace(data); ok && json.Valid(data) {
+			w.out.chunk(FanoutChunk{Index: w.index, Model: w.model, Data: json.RawMessage(data)})
+		}
+	}
+	if len(w.partial) > maxObservedBody {
+		return 0, errLineTooLong
+	}
+	w.partial = bytes.Clone(w.partial)
+	return len(b), nil
+}
+
+func (w *fanoutRecorder) Flush() {}
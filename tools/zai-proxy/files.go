@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// FilesConfig handles the file endpoints under Path (e.g. /v1/files);
+// empty leaves them to pass through as any other route. Uploads stream to
+// the upstream unbuffered: only the multipart head up to the file part's
+// headers (which must come within the first 64KB) is read ahead, to check
+// its type against Types ("image/*" style patterns; empty allows any).
+// Bodies over MaxSize (default 512MB) are refused. Each uploaded file gets
+// a proxy ID that is mapped back to the provider's ID in later requests,
+// in paths and bodies alike, and pins them to the upstream holding the
+// file, so IDs stay valid whichever upstream a route would otherwise pick.
+// The map is kept in Index when set.
+type FilesConfig struct {
+	Path    string   `json:"path,omitempty"`
+	MaxSize int64    `json:"max_size,omitempty"`
+	Types   []string `json:"types,omitempty"`
+	Index   string   `json:"index,omitempty"`
+}
+
+const (
+	fileIDPrefix  = "file-rm"
+	maxUploadHead = 64 << 10
+)
+
+func (c *FilesConfig) validate() error {
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("files: path must start with /")
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("files: max_size must not be negative")
+	}
+	for _, t := range c.Types {
+		if _, _, err := mime.ParseMediaType(t); err != nil && !strings.HasSuffix(t, "/*") {
+			return fmt.Errorf("files: bad type %q", t)
+		}
+	}
+	return nil
+}
+
+func (c *FilesConfig) allows(mediaType string) bool {
+	if len(c.Types) == 0 {
+		return true
+	}
+	for _, t := range c.Types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) || t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// StoredFile maps a proxy file ID to where the file lives.
+type StoredFile struct {
+	ID       string `json:"id"`
+	Upstream string `json:"upstream"`
+	Provider string `json:"provider_id"`
+	Client   string `json:"client"`
+}
+
+var fileUploads = metrics.counter("zai_proxy_file_uploads_total", "File uploads, by outcome.", "outcome")
+
+// fileIndex is the map of proxy file IDs.
+type fileIndex struct {
+	path string
+
+	mu         sync.Mutex
+	byID       map[string]StoredFile
+	byProvider map[string]string // upstream and provider ID to proxy ID
+}
+
+func openFileIndex(path string) (*fileIndex, error) {
+	fi := &fileIndex{path: path, byID: map[string]StoredFile{}, byProvider: map[string]string{}}
+	if path == "" {
+		return fi, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fi, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []StoredFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, f := range files {
+		fi.byID[f.ID], fi.byProvider[f.Upstream+" "+f.Provider] = f, f.ID
+	}
+	return fi, nil
+}
+
+// save writes the index; callers hold mu.
+func (fi *fileIndex) save() {
+	if fi.path == "" {
+		return
+	}
+	files := make([]StoredFile, 0, len(fi.byID))
+	for _, f := range fi.byID {
+		files = append(files, f)
+	}
+	b, err := json.Marshal(files)
+	if err == nil {
+		if err = os.WriteFile(fi.path+".tmp", b, 0o600); err == nil {
+			err = os.Rename(fi.path+".tmp", fi.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing file index: %v", err)
+	}
+}
+
+// add returns the proxy ID for a provider's file, minting one if needed.
+func (fi *fileIndex) add(client, upstream, provider string) string {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if id, ok := fi.byProvider[upstream+" "+provider]; ok {
+		return id
+	}
+	var b [12]byte
+	rand.Read(b[:])
+	f := StoredFile{ID: fileIDPrefix + hex.EncodeToString(b[:]), Upstream: upstream, Provider: provider, Client: client}
+	fi.byID[f.ID], fi.byProvider[upstream+" "+provider] = f, f.ID
+	fi.save()
+	return f.ID
+}
+
+// lookup returns client's file.
+func (fi *fileIndex) lookup(client, id string) (StoredFile, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	f, ok := fi.byID[id]
+	return f, ok && f.Client == client
+}
+
+func (fi *fileIndex) proxyID(upstream, provider string) (string, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	id, ok := fi.byProvider[upstream+" "+provider]
+	return id, ok
+}
+
+func (fi *fileIndex) forget(id string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if f, ok := fi.byID[id]; ok {
+		delete(fi.byID, id)
+		delete(fi.byProvider, f.Upstream+" "+f.Provider)
+		fi.save()
+	}
+}
+
+// filesStage checks uploads and swaps file IDs between the caller's and
+// the provider's. It follows transform, so request bodies are parsed, and
+// precedes route, which the files it finds pin.
+func filesStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	fc := &p.cfg.Files
+	return func(next http.Handler) http.Handler {
+		if fc.Path == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			var pinned *StoredFile
+			pin := func(id string) (string, bool) {
+				f, ok := p.files.lookup(ex.client, id)
+				if !ok || pinned != nil && pinned.Upstream != f.Upstream {
+					return id, false
+				}
+				pinned = &f
+				return f.Provider, true
+			}
+			segs := strings.Split(r.URL.Path, "/")
+			var named string
+			for i, s := range segs {
+				if strings.HasPrefix(s, fileIDPrefix) {
+					if segs[i], _ = pin(s); pinned == nil {
+						writeError(w, http.StatusNotFound, "not_found", "no such file")
+						return
+					}
+					named = s
+				}
+			}
+			r.URL.Path, r.URL.RawPath = strings.Join(segs, "/"), ""
+			if ex.doc != nil && replaceFileIDs(ex.doc, pin) {
+				ex.dirty = true
+			}
+			if pinned != nil {
+				ex.upstream = pinned.Upstream
+			}
+			if !strings.HasPrefix(r.URL.Path, fc.Path) || strings.HasSuffix(r.URL.Path, "/content") {
+				// Contents stream straight back; they hold no IDs.
+				next.ServeHTTP(w, r)
+				return
+			}
+			upload := r.Method == http.MethodPost && path.Clean(r.URL.Path) == path.Clean(fc.Path)
+			if upload {
+				if err := checkUpload(fc, w, r); err != nil {
+					fileUploads.Add(1, "rejected")
+					writeError(w, err.status, err.kind, err.msg)
+					return
+				}
+			}
+			ex.inspect = true
+			held := &heldResponse{w: w, h: http.Header{}}
+			next.ServeHTTP(held, r)
+			if upload {
+				outcome := "succeeded"
+				if held.status >= 300 {
+					outcome = "failed"
+				}
+				fileUploads.Add(1, outcome)
+			}
+			if held.sent || !strings.HasPrefix(held.h.Get("Content-Type"), "application/json") {
+				held.sendTo(w)
+				return
+			}
+			v, err := decodeJSON(held.body.Bytes())
+			if err != nil {
+				held.sendTo(w)
+				return
+			}
+			target, _, _ := strings.Cut(ex.target, "?")
+			upstream := strings.TrimSuffix(target, ex.path)
+			if upload && held.status < 300 {
+				if doc, ok := v.(map[string]any); ok {
+					if id, ok := doc["id"].(string); ok {
+						p.files.add(ex.client, upstream, id)
+					}
+				}
+			}
+			if renameFileIDs(v, upstream, p.files) {
+				if b, err := encodeJSON(v); err == nil {
+					held.body.Reset()
+					held.body.Write(b)
+					held.h.Del("Content-Length")
+				}
+			}
+			if r.Method == http.MethodDelete && named != "" && held.status < 300 {
+				p.files.forget(named)
+			}
+			held.sendTo(w)
+		})
+	}, nil
+}
+
+type uploadError struct {
+	status    int
+	kind, msg string
+}
+
+// checkUpload refuses oversized uploads and file parts of a type not
+// allowed, reading ahead only the multipart head.
+func checkUpload(fc *FilesConfig, w http.ResponseWriter, r *http.Request) *uploadError {
+	mr, uerr := peekForm(w, r, cmp.Or(fc.MaxSize, 512<<20))
+	if uerr != nil {
+		return uerr
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return &uploadError{http.StatusBadRequest, "invalid_request", "no file part in the first 64KB of the upload"}
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		ct, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if ct == "" || ct == "application/octet-stream" {
+			sniff := make([]byte, 512)
+			n, _ := io.ReadFull(part, sniff)
+			ct, _, _ = mime.ParseMediaType(http.DetectContentType(sniff[:n]))
+		}
+		if !fc.allows(ct) {
+			return &uploadError{http.StatusUnsupportedMediaType, "unsupported_file_type", fmt.Sprintf("files of type %s are not accepted", ct)}
+		}
+		return nil
+	}
+}
+
+// peekForm refuses bodies over limit and ones that aren't multipart forms,
+// and returns a reader over the form's first maxUploadHead bytes. r.Body
+// is replaced by the head followed by the rest, size-limited, so the form
+// still streams to the upstream whole.
+func peekForm(w http.ResponseWriter, r *http.Request, limit int64) (*multipart.Reader, *uploadError) {
+	if r.ContentLength > limit {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("uploads are limited to %d bytes", limit)}
+	}
+	mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" {
+		return nil, &uploadError{http.StatusBadRequest, "invalid_request", "uploads must be multipart/form-data"}
+	}
+	body := bufio.NewReaderSize(http.MaxBytesReader(w, r.Body, limit), maxUploadHead)
+	head, _ := body.Peek(maxUploadHead)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	return multipart.NewReader(bytes.NewReader(head), params["boundary"]), nil
+}
+
+// replaceFileIDs swaps every proxy file ID among doc's strings by pin's
+// answer, reporting whether any changed.
+func replaceFileIDs(v any, pin func(string) (string, bool)) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if s, ok := e.(string); ok && strings.HasPrefix(s, fileIDPrefix) {
+				if id, ok := pin(s); ok {
+					v[k], changed = id, true
+				}
+			} else if replaceFileIDs(e, pin) {
+				changed = true
+			}
+		}
+	case []any:
+		for i, e := range v {
+			if s, ok := e.(string); ok && strings.HasPrefix(s, fileIDPrefix) {
+				if id, ok := pin(s); ok {
+					v[i], changed = id, true
+				}
+			} else if replaceFileIDs(e, pin) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// renameFileIDs swaps the provider's file IDs in a response for the
+// proxy's, in "id" and "file_id" fields.
+func renameFileIDs(v any, upstream string, fi *fileIndex) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if s, ok := e.(string); ok && (k == "id" || k == "file_id") {
+				if id, ok := fi.proxyID(upstream, s); ok {
+					v[k], changed = id, true
+				}
+			} else if renameFileIDs(e, upstream, fi) {
+				changed = true
+			}
+		}
+	case []any:
+		for _, e := range v {
+			if renameFileIDs(e, upstream, fi) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
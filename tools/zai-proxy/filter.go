@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FilterConfig defines a completion content filter. A built-in filter
+// matches the regular expression Pattern; an external one POSTs the text
+// to Webhook, which answers with a filterVerdict. Action (for pattern
+// filters) is "block", "redact" (replace matches with Replacement, default
+// "[REDACTED]") or "annotate" (flag the response but pass it on).
+type FilterConfig struct {
+	Name        string   `json:"name"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Replacement string   `json:"replacement,omitempty"`
+	Webhook     string   `json:"webhook,omitempty"`
+	Timeout     Duration `json:"timeout,omitempty"`
+	// FailClosed blocks responses when the webhook can't be reached.
+	FailClosed bool `json:"fail_closed,omitempty"`
+}
+
+// filterWindow is how much streamed text is held back before release, so
+// matches up to this many bytes are caught even across chunk boundaries.
+const filterWindow = 256
+
+// annotationHeader lists the filters that flagged a response.
+const annotationHeader = "X-Ringmaster-Content-Flags"
+
+// filterInput is what a filter inspects, and the webhook request body.
+type filterInput struct {
+	Client string `json:"client"`
+	Model  string `json:"model"`
+	Text   string `json:"text"`
+	Stream bool   `json:"stream"`
+}
+
+// filterVerdict is a filter's decision. Action is "allow", "block",
+// "redact" (Text replaces the input) or "annotate".
+type filterVerdict struct {
+	Action string `json:"action"`
+	Text   string `json:"text,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// contentFilter is the hook interface content filters implement.
+type contentFilter interface {
+	Name() string
+	Check(ctx context.Context, in filterInput) (filterVerdict, error)
+}
+
+func newContentFilter(fc FilterConfig) (contentFilter, error) {
+	if fc.Name == "" {
+		return nil, fmt.Errorf("every filter needs a name")
+	}
+	switch {
+	case fc.Webhook != "" && fc.Pattern != "":
+		return nil, fmt.Errorf("filter %s: set pattern or webhook, not both", fc.Name)
+	case fc.Webhook != "":
+		timeout := time.Duration(fc.Timeout)
+		if timeout == 0 {
+			timeout = 2 * time.Second
+		}
+		return &webhookFilter{name: fc.Name, url: fc.Webhook, failClosed: fc.FailClosed,
+			client: &http.Client{Timeout: timeout}}, nil
+	case fc.Pattern != "":
+		re, err := regexp.Compile(fc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", fc.Name, err)
+		}
+		action := fc.Action
+		if action == "" {
+			action = "block"
+		}
+		if action != "block" && action != "redact" && action != "annotate" {
+			return nil, fmt.Errorf("filter %s: unknown action %q (want block, redact or annotate)", fc.Name, fc.Action)
+		}
+		repl := fc.Replacement
+		if repl == "" {
+			repl = "[REDACTED]"
+		}
+		return &patternFilter{name: fc.Name, re: re, action: action, replacement: repl}, nil
+	}
+	return nil, fmt.Errorf("filter %s: needs a pattern or a webhook", fc.Name)
+}
+
+type patternFilter struct {
+	name        string
+	re          *regexp.Regexp
+	action      string
+	replacement string
+}
+
+func (f *patternFilter) Name() string { return f.name }
+
+func (f *patternFilter) Check(_ context.Context, in filterInput) (filterVerdict, error) {
+	if !f.re.MatchString(in.Text) {
+		return filterVerdict{Action: "allow"}, nil
+	}
+	v := filterVerdict{Action: f.action, Reason: "matched filter " + f.name}
+	if f.action == "redact" {
+		v.Text = f.re.ReplaceAllString(in.Text, f.replacement)
+	}
+	return v, nil
+}
+
+type webhookFilter struct {
+	name       string
+	url        string
+	failClosed bool
+	client     *http.Client
+}
+
+func (f *webhookFilter) Name() string { return f.name }
+
+func (f *webhookFilter) Check(ctx context.Context, in filterInput) (filterVerdict, error) {
+	body, _ := json.Marshal(in)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return filterVerdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return f.failure(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return f.failure(fmt.Errorf("filter webhook returned %s", resp.Status))
+	}
+	var v filterVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return f.failure(fmt.Errorf("filter webhook: %w", err))
+	}
+	if v.Action == "" {
+		v.Action = "allow"
+	}
+	return v, nil
+}
+
+func (f *webhookFilter) failure(err error) (filterVerdict, error) {
+	if f.failClosed {
+		return filterVerdict{Action: "block", Reason: "content filter " + f.name + " unavailable"}, err
+	}
+	return filterVerdict{Action: "allow"}, err
+}
+
+// filterResult is the outcome of running every filter over one text.
+type filterResult struct {
+	text        string
+	blocked     string // reason, when blocked
+	annotations []string
+}
+
+// runFilters passes text through filters in order; redactions feed the
+// next filter and a block stops the chain.
+func runFilters(ctx context.Context, filters []contentFilter, in filterInput) filterResult {
+	res := filterResult{text: in.Text}
+	for _, f := range filters {
+		in.Text = res.text
+		v, err := f.Check(ctx, in)
+		if err != nil {
+			log.Printf("Error running content filter %s: %v", f.Name(), err)
+		}
+		switch v.Action {
+		case "block":
+			res.blocked = v.Reason
+			if res.blocked == "" {
+				res.blocked = "blocked by content filter " + f.Name()
+			}
+			return res
+		case "redact":
+			res.text = v.Text
+		case "annotate":
+			res.annotations = append(res.annotations, f.Name())
+		}
+	}
+	return res
+}
+
+// filterStage applies the route's content filters (all configured filters
+// when the route names none) to completions. Non-streaming JSON responses
+// are filtered whole; streams are filtered through a sliding window.
+func filterStage(p *proxy, rc *RouteConfig) (Middleware, error) {
+	var filters []contentFilter
+	for _, f := range p.filters {
+		if len(rc.Filters) == 0 || slices.Contains(rc.Filters, f.Name()) {
+			filters = append(filters, f)
+		}
+	}
+	for _, name := range rc.Filters {
+		if !slices.ContainsFunc(filters, func(f contentFilter) bool { return f.Name() == name }) {
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		if len(filters) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			ex.inspect = true
+			ctx := r.Context()
+			in := func(text string, stream bool) filterInput {
+				return filterInput{Client: ex.client, Model: ex.model, Text: text, Stream: stream}
+			}
+			bw := &bufferedWriter{ResponseWriter: w, edit: func(status int, body []byte) (int, []byte) {
+				return filterResponse(ctx, filters, in, w.Header(), status, body)
+			}}
+			fs := &filterStream{ctx: ctx, filters: filters, in: in, pending: make(map[int]*pendingText)}
+			sw := &sseWriter{ResponseWriter: bw, line: fs.line, end: fs.end}
+			defer bw.finish()
+			defer sw.finish()
+			next.ServeHTTP(sw, r)
+		})
+	}, nil
+}
+
+// filterResponse filters a buffered JSON response body.
+func filterResponse(ctx context.Context, filters []contentFilter, in func(string, bool) filterInput,
+	h http.Header, status int, body []byte) (int, []byte) {
+	if status >= 400 {
+		return status, body
+	}
+	v, err := decodeJSON(body)
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return status, body
+	}
+	var annotations []string
+	changed := false
+	for _, t := range textFields(doc) {
+		res := runFilters(ctx, filters, in(t.get(), false))
+		if res.blocked != "" {
+			b, _ := json.Marshal(apiError{Error: apiErrorDetail{Message: res.blocked, Type: "content_blocked", Retry: &retryHint{}}})
+			h.Set("Content-Type", "application/json")
+			return http.StatusForbidden, b
+		}
+		if res.text != t.get() {
+			t.set(res.text)
+			changed = true
+		}
+		annotations = append(annotations, res.annotations...)
+	}
+	if len(annotations) > 0 {
+		slices.Sort(annotations)
+		annotations = slices.Compact(annotations)
+		h.Set(annotationHeader, strings.Join(annotations, ","))
+	}
+	if !changed {
+		return status, body
+	}
+	out, err := encodeJSON(doc)
+	if err != nil {
+		return status, body
+	}
+	return status, out
+}
+
+// textField is one completion text inside a decoded response or event.
+type textField struct {
+	index int
+	get   func() string
+	set   func(string)
+}
+
+func stringField(index int, m map[string]any, key string) (textField, bool) {
+	if _, ok := m[key].(string); !ok {
+		return textField{}, false
+	}
+	return textField{
+		index: index,
+		get:   func() string { s, _ := m[key].(string); return s },
+		set:   func(s string) { m[key] = s },
+	}, true
+}
+
+// textFields finds the completion texts of a response body or stream
+// event: OpenAI choices[].message.content / choices[].delta.content, and
+// Anthropic content[].text / content_block_delta delta.text.
+func textFields(doc map[string]any) []textField {
+	var out []textField
+	if choices, ok := doc["choices"].([]any); ok {
+		for i, c := range choices {
+			cm, _ := c.(map[string]any)
+			idx := i
+			if n, ok := jsonNumber(cm["index"]); ok {
+				idx = int(n)
+			}
+			for _, key := range []string{"message", "delta"} {
+				if m, ok := cm[key].(map[string]any); ok {
+					if t, ok := stringField(idx, m, "content"); ok {
+						out = append(out, t)
+					}
+				}
+			}
+		}
+	}
+	if blocks, ok := doc["content"].([]any); ok {
+		for i, b := range blocks {
+			if m, ok := b.(map[string]any); ok {
+				if t, ok := stringField(i, m, "text"); ok {
+					out = append(out, t)
+				}
+			}
+		}
+	}
+	if doc["type"] == "content_block_delta" {
+		idx := 0
+		if n, ok := jsonNumber(doc["index"]); ok {
+			idx = int(n)
+		}
+		if m, ok := doc["delta"].(map[string]any); ok {
+			if t, ok := stringField(idx, m, "text"); ok {
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// errContentBlocked ends a stream that a filter blocked.
+var errContentBlocked = errors.New("stream blocked by content filter")
+
+// pendingText is streamed text held back for one choice, with the last
+// event that carried it as the template for releasing it.
+type pendingText struct {
+	text      string
+	template  map[string]any
+	eventLine []byte
+}
+
+// filterStream is an sseWriter line function that holds text deltas back
+// until more than filterWindow bytes beyond the window are pending,
+// filters the pending text, and releases all but the last filterWindow
+// bytes as one event built from the latest held one. Any other line
+// releases everything pending first, so ordering is preserved.
+type filterStream struct {
+	ctx       context.Context
+	filters   []contentFilter
+	in        func(string, bool) filterInput
+	pending   map[int]*pendingText
+	order     []int
+	eventLine []byte // an "event:" line waiting for its data
+	held      bool   // the last data line was held; swallow its blank line
+	blocked   bool
+	flagged   map[string]bool
+}
+
+func (fs *filterStream) line(line []byte) ([]byte, error) {
+	if fs.blocked {
+		return nil, errContentBlocked
+	}
+	body := bytes.TrimRight(line, "\r\n")
+	if bytes.HasPrefix(body, []byte("event:")) {
+		fs.eventLine = append(fs.eventLine[:0], line...)
+		return nil, nil
+	}
+	if len(body) == 0 && fs.held {
+		fs.held = false
+		return nil, nil
+	}
+	if data, ok := bytes.CutPrefix(body, []byte("data:")); ok {
+		v, _ := decodeJSON(bytes.TrimSpace(data))
+		if doc, ok := v.(map[string]any); ok {
+			if fields := textFields(doc); len(fields) == 1 && fields[0].get() != "" {
+				fs.hold(fields[0], doc)
+				return fs.release(false)
+			}
+		}
+	}
+	out, err := fs.release(true)
+	if err != nil {
+		return out, err
+	}
+	out = append(out, fs.eventLine...)
+	fs.eventLine = nil
+	fs.held = false
+	return append(out, line...), nil
+}
+
+func (fs *filterStream) hold(t textField, doc map[string]any) {
+	pt := fs.pending[t.index]
+	if pt == nil {
+		pt = &pendingText{}
+		fs.pending[t.index] = pt
+		fs.order = append(fs.order, t.index)
+	}
+	pt.text += t.get()
+	pt.template = doc
+	pt.eventLine = bytes.Clone(fs.eventLine)
+	fs.eventLine = nil
+	fs.held = true
+}
+
+// end releases whatever is still pending when the stream ends.
+func (fs *filterStream) end() []byte {
+	if fs.blocked {
+		return nil
+	}
+	out, _ := fs.release(true)
+	return out
+}
+
+// release filters pending text and returns the events to emit. Unless
+// final, only choices with more than two windows pending release, keeping
+// one window back.
+func (fs *filterStream) release(final bool) ([]byte, error) {
+	var out []byte
+	for _, idx := range fs.order {
+		pt := fs.pending[idx]
+		if pt.text == "" || !final && len(pt.text) < 2*filterWindow {
+			continue
+		}
+		res := runFilters(fs.ctx, fs.filters, fs.in(pt.text, true))
+		if res.blocked != "" {
+			fs.blocked = true
+			b, _ := json.Marshal(apiError{Error: apiErrorDetail{Message: res.blocked, Type: "content_blocked", Retry: &retryHint{}}})
+			out = append(out, "data: "...)
+			out = append(out, b...)
+			out = append(out, "\n\n"...)
+			return out, errContentBlocked
+		}
+		for _, a := range res.annotations {
+			if fs.flagged == nil {
+				fs.flagged = make(map[string]bool)
+			}
+			if !fs.flagged[a] {
+				fs.flagged[a] = true
+				out = append(out, ": "+annotationHeader+": "+a+"\n\n"...)
+			}
+		}
+		n := len(res.text)
+		if !final {
+			n = cutPoint(res.text, n-filterWindow)
+		}
+		release := res.text[:n]
+		pt.text = res.text[n:]
+		if release == "" {
+			continue
+		}
+		for _, t := range textFields(pt.template) {
+			t.set(release)
+		}
+		b, err := encodeJSON(pt.template)
+		if err != nil {
+			continue
+		}
+		out = append(out, pt.eventLine...)
+		out = append(out, "data: "...)
+		out = append(out, b...)
+		out = append(out, "\n\n"...)
+	}
+	return out, nil
+}
+
+// cutPoint backs n off to a UTF-8 boundary of s.
+func cutPoint(s string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	for n > 0 && n < len(s) && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FlagConfig is a runtime feature flag gating new behaviour. While
+// Enabled, the flag is on for the listed Clients and for Percent of the
+// rest, picked by a stable hash of the flag and client names so a client
+// keeps its answer as the rollout grows. With neither set it is on for
+// everyone.
+type FlagConfig struct {
+	Enabled bool     `json:"enabled"`
+	Clients []string `json:"clients,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+func (f *FlagConfig) validate() error {
+	if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// on reports whether the flag named name is on for client.
+func (f *FlagConfig) on(name, client string) bool {
+	switch {
+	case !f.Enabled:
+		return false
+	case slices.Contains(f.Clients, client):
+		return true
+	case f.Percent == nil:
+		return len(f.Clients) == 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + client))
+	return float64(h.Sum32()%10000) < *f.Percent*100
+}
+
+// flagChange is a journaled flag edit; a nil Config deletes the flag.
+type flagChange struct {
+	Name   string      `json:"name"`
+	Config *FlagConfig `json:"config,omitempty"`
+}
+
+// featureFlags holds the flags from the config and the admin API's edits.
+type featureFlags struct {
+	mu      sync.RWMutex
+	flags   map[string]FlagConfig
+	journal *journal
+}
+
+func newFeatureFlags(cfg map[string]FlagConfig, j *journal) *featureFlags {
+	flags := maps.Clone(cfg)
+	if flags == nil {
+		flags = map[string]FlagConfig{}
+	}
+	return &featureFlags{flags: flags, journal: j}
+}
+
+// enabled reports whether the named flag is on for client. Unknown flags
+// are off.
+func (ff *featureFlags) enabled(name, client string) bool {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	f, ok := ff.flags[name]
+	return ok && f.on(name, client)
+}
+
+// forClient returns every flag's state for client.
+func (ff *featureFlags) forClient(client string) map[string]any {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	out := make(map[string]any, len(ff.flags))
+	for name, f := range ff.flags {
+		out[name] = f.on(name, client)
+	}
+	return out
+}
+
+func (ff *featureFlags) list() map[string]FlagConfig {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	return maps.Clone(ff.flags)
+}
+
+// set stores a flag, or deletes it when f is nil.
+func (ff *featureFlags) set(name string, f *FlagConfig) error {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	e := journalEntry{Time: time.Now().UTC(), Op: "flag", Flag: &flagChange{Name: name, Config: f}}
+	if err := ff.journal.append(e); err != nil {
+		return err
+	}
+	ff.apply(e)
+	return nil
+}
+
+// apply makes a journaled flag edit; other entries are ignored.
+func (ff *featureFlags) apply(e journalEntry) {
+	if e.Op == "restore" && e.Restore != nil {
+		ff.flags = map[string]FlagConfig{}
+		maps.Copy(ff.flags, e.Restore.Snapshot.Flags)
+		return
+	}
+	if e.Op != "flag" || e.Flag == nil {
+		return
+	}
+	if e.Flag.Config == nil {
+		delete(ff.flags, e.Flag.Name)
+	} else {
+		ff.flags[e.Flag.Name] = *e.Flag.Config
+	}
+}
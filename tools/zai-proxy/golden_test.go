@@ -0,0 +1,126 @@
+package main
+
+// Golden tests run recorded provider payloads through the proxy's protocol
+// handling and compare the result with testdata/golden/<layer>/<name>.golden.
+// After an intended change, regenerate the goldens and review the diff:
+//
+//	go test -run Golden *.go -args -update
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files from current output")
+
+// TestGoldenUsage parses OpenAI, Anthropic and Z.AI responses, streamed
+// and not, the way the observe stage does. Streams are fed in small writes
+// so events split across reads are covered.
+func TestGoldenUsage(t *testing.T) {
+	runGolden(t, "usage", func(name string, in []byte) (any, error) {
+		ct := "application/json"
+		if strings.HasSuffix(name, ".sse") {
+			ct = "text/event-stream"
+		}
+		o := newUsageObserver(ct)
+		for len(in) > 0 {
+			n := min(len(in), 7)
+			o.Write(in[:n])
+			in = in[n:]
+		}
+		model, u, ok := o.Finish()
+		return map[string]any{"model": model, "usage": u, "seen": ok}, nil
+	})
+}
+
+// goldenPrompts exercise both system prompt modes on each request shape.
+var goldenPrompts = []SystemPrompt{
+	{Text: "Follow the operator policy."},
+	{Models: []string{"glm-*"}, Text: "You are served through the proxy.", Mode: "merge"},
+}
+
+// TestGoldenRequests rewrites OpenAI- and Anthropic-shaped requests with
+// the system prompts and counts their prompt tokens. Inputs are
+// {"path": ..., "body": ...}; the path picks the API shape.
+func TestGoldenRequests(t *testing.T) {
+	runGolden(t, "request", func(_ string, in []byte) (any, error) {
+		var c struct {
+			Path string          `json:"path"`
+			Body json.RawMessage `json:"body"`
+		}
+		if err := json.Unmarshal(in, &c); err != nil {
+			return nil, err
+		}
+		v, err := decodeJSON(c.Body)
+		if err != nil {
+			return nil, err
+		}
+		doc := v.(map[string]any)
+		model, _ := doc["model"].(string)
+		changed := injectSystemPrompts(doc, strings.HasSuffix(c.Path, "/messages"), "golden", model, goldenPrompts)
+		b, err := encodeJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		var req chatRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			return nil, err
+		}
+		return map[string]any{"changed": changed, "body": json.RawMessage(b), "prompt_tokens": estimatePromptTokens(&req)}, nil
+	})
+}
+
+// runGolden applies translate to every input of a layer and checks the
+// output against its golden file, or rewrites the file with -update.
+func runGolden(t *testing.T, layer string, translate func(name string, in []byte) (any, error)) {
+	t.Helper()
+	inputs, err := filepath.Glob(filepath.Join("testdata", "golden", layer, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := 0
+	for _, path := range inputs {
+		if strings.HasSuffix(path, ".golden") {
+			continue
+		}
+		ran++
+		name := filepath.Base(path)
+		t.Run(name, func(t *testing.T) {
+			in, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := translate(name, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(out, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			golden := strings.TrimSuffix(path, filepath.Ext(path)) + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s (run with -update if intended)\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+	if ran == 0 {
+		t.Fatalf("no inputs in testdata/golden/%s", layer)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The google scheme sends an OAuth access token for Google Cloud, renewed
+// before it expires. Tokens come from the credentials file Credentials
+// names, else GOOGLE_APPLICATION_CREDENTIALS's, else the one gcloud auth
+// application-default login writes: a service account key, whose signed
+// assertion is exchanged for a token, or a user's refresh token. Without
+// any, they come from the metadata server of the instance, GKE pod or
+// Cloud Run service the proxy runs on.
+
+const googleScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var googleTokenFetches = metrics.counter("zai_proxy_google_token_fetches_total",
+	"Google access tokens fetched for google-auth upstreams, by source and result.", "source", "result")
+
+type googleToken struct {
+	value   string
+	expires time.Time
+}
+
+// googleTokenCache holds access tokens by credentials file, "" for the
+// metadata server, until shortly before they expire. Like AWS
+// credentials, a failure to get one is remembered for awsRetryAfter.
+type googleTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]googleToken
+	failed map[string]awsFailure
+	hc     *http.Client
+}
+
+var googleTokens = &googleTokenCache{tokens: map[string]googleToken{}, failed: map[string]awsFailure{},
+	hc: &http.Client{Timeout: 10 * time.Second}}
+
+// googleCredentials is a credentials file: a service account key or an
+// authorized user's refresh token.
+type googleCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// googleCredentialsFile is the file the google scheme reads, "" for the
+// metadata server.
+func (a *UpstreamAuth) googleCredentialsFile() string {
+	if f := cmp.Or(a.Credentials, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")); f != "" {
+		return f
+	}
+	dir := os.Getenv("APPDATA")
+	if runtime.GOOS != "windows" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	if f := filepath.Join(dir, "gcloud", "application_default_credentials.json"); dir != "" {
+		if _, err := os.Stat(f); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+// authorizeGoogle puts an access token on req.
+func (a *UpstreamAuth) authorizeGoogle(req *http.Request) error {
+	token, err := googleTokens.get(req.Context(), a.googleCredentialsFile())
+	if err != nil {
+		return fmt.Errorf("google: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// get returns a token for the credentials in file. A token that fails to
+// renew is used while it lasts.
+func (c *googleTokenCache) get(ctx context.Context, file string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur, ok := c.tokens[file]
+	if ok && time.Until(cur.expires) > awsRefreshBefore {
+		return cur.value, nil
+	}
+	var fresh googleToken
+	var err error
+	if f, failed := c.failed[file]; failed && time.Now().Before(f.until) {
+		err = f.err
+	} else {
+		fresh, err = c.fetch(ctx, file)
+	}
+	if err != nil {
+		c.failed[file] = awsFailure{err, time.Now().Add(awsRetryAfter)}
+		if ok && time.Now().Before(cur.expires) {
+			log.Printf("Error renewing Google access token, using one expiring %s: %v", cur.expires.Format(time.RFC3339), err)
+			return cur.value, nil
+		}
+		return "", err
+	}
+	delete(c.failed, file)
+	c.tokens[file] = fresh
+	return fresh.value, nil
+}
+
+func (c *googleTokenCache) fetch(ctx context.Context, file string) (googleToken, error) {
+	source := "metadata"
+	var tok googleToken
+	var err error
+	if file == "" {
+		tok, err = c.metadata(ctx)
+	} else {
+		var creds googleCredentials
+		var b []byte
+		if b, err = os.ReadFile(file); err == nil {
+			err = json.Unmarshal(b, &creds)
+		}
+		switch {
+		case err != nil:
+			err = fmt.Errorf("credentials %s: %w", file, err)
+		case creds.Type == "service_account":
+			source = "service_account"
+			tok, err = c.serviceAccount(ctx, creds)
+		case creds.Type == "authorized_user":
+			source = "authorized_user"
+			tok, err = c.refresh(ctx, creds)
+		default:
+			err = fmt.Errorf("credentials %s: unsupported type %q", file, creds.Type)
+		}
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	googleTokenFetches.Add(1, source, result)
+	return tok, err
+}
+
+// serviceAccount exchanges an assertion signed with the account's key for
+// a token.
+func (c *googleTokenCache) serviceAccount(ctx context.Context, creds googleCredentials) (googleToken, error) {
+	aud := cmp.Or(creds.TokenURI, "https://oauth2.googleapis.com/token")
+	now := time.Now()
+	assertion, err := signJWT(creds, map[string]any{"iss": creds.ClientEmail, "scope": googleScope, "aud": aud,
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+	if err != nil {
+		return googleToken{}, err
+	}
+	return c.token(ctx, aud, url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}})
+}
+
+// refresh trades a user's refresh token for an access token.
+func (c *googleTokenCache) refresh(ctx context.Context, creds googleCredentials) (googleToken, error) {
+	return c.token(ctx, cmp.Or(creds.TokenURI, "https://oauth2.googleapis.com/token"), url.Values{"grant_type": {"refresh_token"},
+		"client_id": {creds.ClientID}, "client_secret": {creds.ClientSecret}, "refresh_token": {creds.RefreshToken}})
+}
+
+func (c *googleTokenCache) token(ctx context.Context, endpoint string, form url.Values) (googleToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return googleToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// metadata asks the metadata server for the default service account's token.
+func (c *googleTokenCache) metadata(ctx context.Context) (googleToken, error) {
+	host := cmp.Or(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+
+		"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(googleScope), nil)
+	if err != nil {
+		return googleToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	tok, err := c.do(req)
+	if err != nil {
+		return tok, fmt.Errorf("no credentials file and the metadata server: %w", err)
+	}
+	return tok, nil
+}
+
+// do sends a token request and reads the token it replies with.
+func (c *googleTokenCache) do(req *http.Request) (googleToken, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return googleToken{}, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return googleToken{}, fmt.Errorf("token %s: %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &t); err != nil || t.AccessToken == "" {
+		return googleToken{}, fmt.Errorf("token %s: no access token in reply", req.URL.Host)
+	}
+	return googleToken{t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)}, nil
+}
+
+// signJWT signs claims with the service account's key, RS256.
+func signJWT(creds googleCredentials, claims map[string]any) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("service account: private_key is not PEM")
+	}
+	var key *rsa.PrivateKey
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return "", errors.New("service account: private_key is not an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("service account: private_key: %w", err)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
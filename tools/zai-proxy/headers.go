@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// HeaderRule edits one header. Op is "set" (replace all values), "add",
+// "remove", or "replace", which rewrites each value matching the regular
+// expression Pattern with Value ($1 expands submatches). For set and add,
+// Expr computes the value from the request instead.
+type HeaderRule struct {
+	Op      string    `json:"op"`
+	Name    string    `json:"name"`
+	Value   string    `json:"value,omitempty"`
+	Expr    exprField `json:"expr,omitempty"`
+	Pattern string    `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// HeaderRules are applied to the request before it is forwarded and to the
+// response before it is returned.
+type HeaderRules struct {
+	Request  []HeaderRule `json:"request,omitempty"`
+	Response []HeaderRule `json:"response,omitempty"`
+}
+
+func (h *HeaderRules) compile() error {
+	for _, rules := range [][]HeaderRule{h.Request, h.Response} {
+		for i := range rules {
+			r := &rules[i]
+			if r.Name == "" {
+				return fmt.Errorf("header rule needs a name")
+			}
+			switch r.Op {
+			case "set", "add", "remove":
+			case "replace":
+				re, err := regexp.Compile(r.Pattern)
+				if err != nil {
+					return fmt.Errorf("header %s: %w", r.Name, err)
+				}
+				r.re = re
+			default:
+				return fmt.Errorf("header %s: unknown op %q (want set, add, remove or replace)", r.Name, r.Op)
+			}
+		}
+	}
+	return nil
+}
+
+func applyHeaderRules(h http.Header, rules []HeaderRule, env func() map[string]any) {
+	for i := range rules {
+		r := &rules[i]
+		value := r.Value
+		if r.Expr.Expr != nil && (r.Op == "set" || r.Op == "add") {
+			v, err := r.Expr.Text(env())
+			if err != nil {
+				log.Printf("Error evaluating header %s: %v", r.Name, err)
+				continue
+			}
+			value = v
+		}
+		switch r.Op {
+		case "set":
+			h.Set(r.Name, value)
+		case "add":
+			h.Add(r.Name, value)
+		case "remove":
+			h.Del(r.Name)
+		case "replace":
+			vals := h.Values(r.Name)
+			for j, v := range vals {
+				vals[j] = r.re.ReplaceAllString(v, r.Value)
+			}
+		}
+	}
+}
+
+// headersStage applies a route's header rules; routes without any get a
+// pass-through.
+func headersStage(p *proxy, rc *RouteConfig) (Middleware, error) {
+	if err := rc.Headers.compile(); err != nil {
+		return nil, err
+	}
+	req, resp := rc.Headers.Request, rc.Headers.Response
+	return func(next http.Handler) http.Handler {
+		if len(req) == 0 && len(resp) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			env := func() map[string]any { return p.exprEnv(exchangeOf(r), r) }
+			applyHeaderRules(r.Header, req, env)
+			if len(resp) > 0 {
+				w = &headerWriter{ResponseWriter: w, rules: resp, env: env}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// headerWriter applies response rules just before the header is sent.
+type headerWriter struct {
+	http.ResponseWriter
+	rules []HeaderRule
+	env   func() map[string]any
+	wrote bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		applyHeaderRules(w.Header(), w.rules, w.env)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
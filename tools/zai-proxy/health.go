@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthConfig scales each pool member's weight by a health score kept
+// from its recent requests, so traffic moves off a member as it degrades
+// rather than only once its circuit opens. The score is the product of
+// its success rate, counting transport failures and 5xx responses as
+// failures, its rate not rate limited, 429s being limits, and its speed
+// against the fastest member's. Signals fade with a half-life of Window
+// (default 1m), so a member recovers as it serves well again; a score
+// never drops below MinScore (default 0.05), so some traffic still
+// tells how a member is doing. Conversations kept on a member by sticky
+// routing stay there until its circuit opens.
+type HealthConfig struct {
+	Enabled  bool     `json:"enabled,omitempty"`
+	Window   Duration `json:"window,omitempty"`
+	MinScore float64  `json:"min_score,omitempty"`
+}
+
+func (c *HealthConfig) validate() error {
+	if c.Window < 0 || c.MinScore < 0 || c.MinScore > 1 {
+		return fmt.Errorf("health: window must not be negative and min_score must be between 0 and 1")
+	}
+	return nil
+}
+
+var upstreamHealthScore = metrics.gauge("zai_proxy_upstream_health",
+	"Pool members' health scores, which scale their weights.", "upstream")
+
+// UpstreamHealth is a pool member's health as the admin API reports it.
+// Requests is the faded count its rates are of.
+type UpstreamHealth struct {
+	Score       float64  `json:"score"`
+	Requests    float64  `json:"requests"`
+	ErrorRate   float64  `json:"error_rate"`
+	LimitedRate float64  `json:"limited_rate"`
+	Latency     Duration `json:"latency"`
+}
+
+// memberSignals are a member's faded request outcomes as of at.
+type memberSignals struct {
+	n, errs, limited float64
+	latency          float64 // seconds, summed over the successes
+	at               time.Time
+}
+
+// fade returns s as of now.
+func (s memberSignals) fade(halfLife time.Duration, now time.Time) memberSignals {
+	f := math.Exp2(-float64(now.Sub(s.at)) / float64(halfLife))
+	return memberSignals{n: s.n * f, errs: s.errs * f, limited: s.limited * f, latency: s.latency * f, at: now}
+}
+
+// upstreamHealth scores the pool members; nil scores them all 1.
+type upstreamHealth struct {
+	cfg *HealthConfig
+
+	mu      sync.Mutex
+	members map[string]memberSignals
+}
+
+func newUpstreamHealth(cfg *HealthConfig) *upstreamHealth {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &upstreamHealth{cfg: cfg, members: map[string]memberSignals{}}
+}
+
+func (h *upstreamHealth) halfLife() time.Duration {
+	return cmp.Or(time.Duration(h.cfg.Window), time.Minute)
+}
+
+// record notes an outcome of a request to member that took latency.
+func (h *upstreamHealth) record(member string, resp *http.Response, err error, latency time.Duration) {
+	if h == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	s := h.members[member].fade(h.halfLife(), now)
+	s.n++
+	switch {
+	case err != nil || resp.StatusCode >= 500:
+		s.errs++
+	case resp.StatusCode == http.StatusTooManyRequests:
+		s.limited++
+	default:
+		s.latency += latency.Seconds()
+	}
+	h.members[member] = s
+	upstreamHealthScore.Set(h.scoreLocked(member, now), member)
+}
+
+// score returns member's health, between the floor and 1.
+func (h *upstreamHealth) score(member string) float64 {
+	if h == nil {
+		return 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.scoreLocked(member, time.Now())
+}
+
+func (h *upstreamHealth) scoreLocked(member string, now time.Time) float64 {
+	s, ok := h.members[member]
+	if !ok {
+		return 1
+	}
+	s = s.fade(h.halfLife(), now)
+	// One in the denominator, so a member isn't written off on a single
+	// request.
+	score := (1 - s.errs/(s.n+1)) * (1 - s.limited/(s.n+1))
+	if mean := s.meanLatency(); mean > 0 {
+		fastest := mean
+		for _, o := range h.members {
+			if l := o.meanLatency(); l > 0 && l < fastest {
+				fastest = l
+			}
+		}
+		score *= fastest / mean
+	}
+	floor := h.cfg.MinScore
+	if floor == 0 {
+		floor = 0.05
+	}
+	return max(score, floor)
+}
+
+// meanLatency is the mean of the latencies of s's successful requests,
+// 0 without any.
+func (s memberSignals) meanLatency() float64 {
+	ok := s.n - s.errs - s.limited
+	if ok <= 0 || s.latency == 0 {
+		return 0
+	}
+	return s.latency / ok
+}
+
+// report returns every scored member's health.
+func (h *upstreamHealth) report() map[string]UpstreamHealth {
+	out := map[string]UpstreamHealth{}
+	if h == nil {
+		return out
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for m, s := range h.members {
+		f := s.fade(h.halfLife(), now)
+		out[m] = UpstreamHealth{Score: h.scoreLocked(m, now), Requests: f.n, ErrorRate: f.errs / max(f.n, 1),
+			LimitedRate: f.limited / max(f.n, 1), Latency: Duration(f.meanLatency() * float64(time.Second))}
+	}
+	return out
+}
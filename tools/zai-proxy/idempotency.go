@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyConfig keeps the answers to requests sent with an
+// Idempotency-Key header, so a client retrying one gets the answer it
+// missed rather than paying for another generation. Keys are the client's
+// own: clients never see each other's answers. Successful answers within
+// memory.max_response_body are kept for TTL (default 24h) in Store,
+// "memory", "storage" (the SQL store) or "redis", where replicas also
+// learn which keys the others are answering; empty disables the feature. A
+// retry while the first attempt is still running is refused with 409, and
+// one reusing a key for a different request with 422. Replays carry
+// Idempotent-Replayed: true and are accounted without usage. The memory
+// store keeps at most MaxEntries (default 10000) answers of MaxBytes
+// (default 64MB) in all, dropping those used least recently.
+type IdempotencyConfig struct {
+	Store      string   `json:"store,omitempty"`
+	TTL        Duration `json:"ttl,omitempty"`
+	MaxEntries int      `json:"max_entries,omitempty"`
+	MaxBytes   int64    `json:"max_bytes,omitempty"`
+}
+
+const idempotencyHeader = "Idempotency-Key"
+
+func (c *IdempotencyConfig) validate(storage StorageConfig, redis RedisConfig) error {
+	switch c.Store {
+	case "", "memory":
+	case "storage":
+		if storage.Driver == "" {
+			return fmt.Errorf("idempotency: store \"storage\" needs a storage driver")
+		}
+	case "redis":
+		if redis.Addr == "" {
+			return fmt.Errorf("idempotency: store \"redis\" needs a redis addr")
+		}
+	default:
+		return fmt.Errorf("idempotency: unknown store %q (want memory, storage or redis)", c.Store)
+	}
+	if c.TTL < 0 || c.MaxEntries < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("idempotency: ttl, max_entries and max_bytes must not be negative")
+	}
+	return nil
+}
+
+func (c *IdempotencyConfig) ttl() time.Duration {
+	if c.TTL == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.TTL)
+}
+
+// StoredResponse is a kept answer. Fingerprint identifies the request it
+// answered.
+type StoredResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	At          time.Time   `json:"at"`
+}
+
+// responseStore keeps answers by client and idempotency key.
+type responseStore interface {
+	// LoadResponse returns the answer kept for key, or nil.
+	LoadResponse(ctx context.Context, key string) (*StoredResponse, error)
+	SaveResponse(ctx context.Context, key string, resp StoredResponse) error
+	// PruneResponses drops answers kept before before.
+	PruneResponses(ctx context.Context, before time.Time) (int64, error)
+}
+
+// memoryResponses is the in-process response store.
+type memoryResponses struct {
+	mu sync.Mutex
+	m  *lru[string, StoredResponse]
+}
+
+func newMemoryResponses(cfg *IdempotencyConfig) *memoryResponses {
+	return &memoryResponses{m: newLRU("idempotency", cmp.Or(cfg.MaxEntries, 10000), cmp.Or(cfg.MaxBytes, 64<<20),
+		func(key string, sr StoredResponse) int64 {
+			n := len(key) + len(sr.Fingerprint) + len(sr.Body)
+			for k, vs := range sr.Header {
+				for _, v := range vs {
+					n += len(k) + len(v)
+				}
+			}
+			return int64(n)
+		})}
+}
+
+func (s *memoryResponses) LoadResponse(_ context.Context, key string) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sr, ok := s.m.get(key); ok {
+		return &sr, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryResponses) SaveResponse(_ context.Context, key string, resp StoredResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.put(key, resp)
+	return nil
+}
+
+func (s *memoryResponses) PruneResponses(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.removeIf(func(_ string, sr StoredResponse) bool { return sr.At.Before(before) }), nil
+}
+
+var idempotentRequests = metrics.counter("zai_proxy_idempotent_requests_total",
+	"Requests with an Idempotency-Key, by outcome.", "outcome")
+
+// idempotency holds the kept answers and the keys being answered now.
+type idempotency struct {
+	cfg    *IdempotencyConfig
+	store  responseStore
+	shared *redisResponses // when set, where replicas claim keys
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// openIdempotency returns the configured response keeper, or nil when the
+// feature is off.
+func openIdempotency(cfg *IdempotencyConfig, store Store, rc *redisClient) *idempotency {
+	id := &idempotency{cfg: cfg, running: map[string]bool{}}
+	switch cfg.Store {
+	case "memory":
+		id.store = newMemoryResponses(cfg)
+	case "storage":
+		s, ok := store.(responseStore)
+		if !ok {
+			return nil
+		}
+		id.store = s
+	case "redis":
+		if rc == nil {
+			return nil
+		}
+		id.shared = &redisResponses{c: rc, ttl: cfg.ttl()}
+		id.store = id.shared
+	default:
+		return nil
+	}
+	return id
+}
+
+// claim marks key as being answered, reporting false if it already is,
+// here or by another replica.
+func (id *idempotency) claim(ctx context.Context, key string) bool {
+	id.mu.Lock()
+	if id.running[key] {
+		id.mu.Unlock()
+		return false
+	}
+	id.running[key] = true
+	id.mu.Unlock()
+	if id.shared != nil {
+		// Claims lapse in case this replica dies before releasing them.
+		ok, err := id.shared.claimKey(ctx, key, 10*time.Minute)
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+		} else if !ok {
+			id.mu.Lock()
+			delete(id.running, key)
+			id.mu.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+func (id *idempotency) release(key string) {
+	id.mu.Lock()
+	delete(id.running, key)
+	id.mu.Unlock()
+	if id.shared != nil {
+		if err := id.shared.releaseKey(context.Background(), key); err != nil {
+			log.Printf("Error releasing idempotency key: %v", err)
+		}
+	}
+}
+
+// pruneLoop drops expired answers every few minutes, when only reports
+// true or is nil.
+func (id *idempotency) pruneLoop(ctx context.Context, only func() bool) {
+	ttl := id.cfg.ttl()
+	ticker := time.NewTicker(min(ttl, 5*time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if only != nil && !only() {
+			continue
+		}
+		if n, err := id.store.PruneResponses(ctx, time.Now().Add(-ttl)); err != nil {
+			log.Printf("Error pruning idempotent responses: %v", err)
+		} else if n > 0 {
+			debugf("Pruned %d idempotent responses", n)
+		}
+	}
+}
+
+// requestFingerprint identifies what a request asks for.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keptSink keeps a whole response, or notes that it outgrew
+// maxObservedBody.
+type keptSink struct {
+	bodySink
+	header http.Header
+}
+
+func (s *keptSink) begin(status int, h http.Header) {
+	s.bodySink.begin(status, h)
+	s.header = h.Clone()
+}
+
+// idempotencyStage answers retries from kept answers. It follows transform
+// so requests are told apart by their bodies, and precedes the stages that
+// keep state of their own, such as sessions, so a replay changes nothing.
+func idempotencyStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if p.idempotent == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ik := r.Header.Get(idempotencyHeader)
+			ex := exchangeOf(r)
+			if ik == "" || ex.dryRun || r.Method == http.MethodGet || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(ik) > 255 {
+				writeError(w, http.StatusBadRequest, "invalid_request", idempotencyHeader+" is limited to 255 characters")
+				return
+			}
+			key := ex.client + "\x00" + ik
+			fp := requestFingerprint(r, ex.body)
+			if !p.idempotent.claim(r.Context(), key) {
+				idempotentRequests.Add(1, "conflict")
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusConflict, "idempotency_conflict", "a request with this "+idempotencyHeader+" is still being answered")
+				return
+			}
+			defer p.idempotent.release(key)
+
+			sr, err := p.idempotent.store.LoadResponse(r.Context(), key)
+			if err != nil {
+				log.Printf("Error loading idempotent response: %v", err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "loading the kept response failed")
+				return
+			}
+			if sr != nil && time.Since(sr.At) < p.idempotent.cfg.ttl() {
+				if sr.Fingerprint != fp {
+					idempotentRequests.Add(1, "mismatch")
+					writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", idempotencyHeader+" was used for a different request")
+					return
+				}
+				idempotentRequests.Add(1, "replayed")
+				ex.replayed = true
+				for k, vs := range sr.Header {
+					// Earlier stages' headers are this request's own.
+					if _, ok := w.Header()[k]; !ok {
+						w.Header()[k] = vs
+					}
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(sr.Status)
+				w.Write(sr.Body)
+				return
+			}
+
+			sink := &keptSink{bodySink: bodySink{limit: maxObservedBody}}
+			next.ServeHTTP(teeTo(w, sink), r)
+			if sink.status < 200 || sink.status >= 300 || sink.truncated || r.Context().Err() != nil {
+				return
+			}
+			idempotentRequests.Add(1, "stored")
+			sr = &StoredResponse{Fingerprint: fp, Status: sink.status, Header: sink.header, Body: sink.body, At: time.Now()}
+			if err := p.idempotent.store.SaveResponse(context.Background(), key, *sr); err != nil {
+				log.Printf("Error saving idempotent response: %v", err)
+			}
+		})
+	}, nil
+}
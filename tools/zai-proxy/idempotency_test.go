@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentUpstream stands in for the stages after idempotency, numbering
+// its answers and holding each until hold, if set, is closed.
+type idempotentUpstream struct {
+	calls   atomic.Int32
+	status  int
+	started chan struct{}
+	hold    chan struct{}
+}
+
+func (u *idempotentUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := u.calls.Add(1)
+	if u.hold != nil {
+		u.started <- struct{}{}
+		<-u.hold
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(u.status)
+	w.Write([]byte(`{"answer":` + strconv.Itoa(int(n)) + `}`))
+}
+
+// idempotentRequest sends client's body with key through the stage h.
+func idempotentRequest(h http.Handler, client, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(idempotencyHeader, key)
+	}
+	ex := &exchange{client: client, body: []byte(body)}
+	r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func newIdempotencyTest(t *testing.T) (*proxy, *idempotentUpstream, http.Handler) {
+	t.Helper()
+	p := &proxy{idempotent: openIdempotency(&IdempotencyConfig{Store: "memory"}, nil, nil)}
+	mw, err := idempotencyStage(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &idempotentUpstream{status: http.StatusOK}
+	return p, up, mw(up)
+}
+
+// TestIdempotentReplay answers a retry with the kept answer, to the same
+// client's same request only.
+func TestIdempotentReplay(t *testing.T) {
+	_, up, h := newIdempotencyTest(t)
+	const body = `{"model":"glm-4.6"}`
+	first := idempotentRequest(h, "alice", "k1", body)
+	for _, tc := range []struct {
+		name, client, key, body string
+		want                    int
+		answer                  string
+		replayed                bool
+	}{
+		{"retry", "alice", "k1", body, http.StatusOK, `{"answer":1}`, true},
+		{"another retry", "alice", "k1", body, http.StatusOK, `{"answer":1}`, true},
+		{"another key", "alice", "k2", body, http.StatusOK, `{"answer":2}`, false},
+		{"another client", "bob", "k1", body, http.StatusOK, `{"answer":3}`, false},
+		{"no key", "alice", "", body, http.StatusOK, `{"answer":4}`, false},
+		{"another request", "alice", "k1", `{"model":"glm-4.5"}`, http.StatusUnprocessableEntity, "idempotency_key_reused", false},
+		{"key too long", "alice", strings.Repeat("k", 256), body, http.StatusBadRequest, "255 characters", false},
+	} {
+		rec := idempotentRequest(h, tc.client, tc.key, tc.body)
+		if rec.Code != tc.want || !strings.Contains(rec.Body.String(), tc.answer) {
+			t.Errorf("%s: status %d, body %s; want %d, %s", tc.name, rec.Code, rec.Body, tc.want, tc.answer)
+		}
+		if got := rec.Header().Get("Idempotent-Replayed") == "true"; got != tc.replayed {
+			t.Errorf("%s: Idempotent-Replayed = %v, want %v", tc.name, got, tc.replayed)
+		}
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" || first.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("first answer's headers = %v", first.Header())
+	}
+	if n := up.calls.Load(); n != 4 {
+		t.Errorf("upstream called %d times, want 4", n)
+	}
+
+	// Failures aren't kept, so a retry tries again.
+	up.status = http.StatusInternalServerError
+	idempotentRequest(h, "carol", "k1", body)
+	up.status = http.StatusOK
+	if rec := idempotentRequest(h, "carol", "k1", body); rec.Header().Get("Idempotent-Replayed") != "" || rec.Body.String() != `{"answer":6}` {
+		t.Errorf("retry of a failure = %s, replayed %q", rec.Body, rec.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+// TestIdempotentInFlight refuses a retry while the first attempt is still
+// being answered, and replays it once it is.
+func TestIdempotentInFlight(t *testing.T) {
+	_, up, h := newIdempotencyTest(t)
+	up.started, up.hold = make(chan struct{}), make(chan struct{})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(h, "alice", "k1", `{}`) }()
+	<-up.started
+	rec := idempotentRequest(h, "alice", "k1", `{}`)
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("retry in flight: status %d, Retry-After %q; want 409 with one", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(up.hold)
+	if first := <-done; first.Code != http.StatusOK {
+		t.Fatalf("first attempt: status %d", first.Code)
+	}
+	up.hold = nil
+	if rec := idempotentRequest(h, "alice", "k1", `{}`); rec.Header().Get("Idempotent-Replayed") != "true" || up.calls.Load() != 1 {
+		t.Errorf("retry after: replayed %q, upstream calls %d", rec.Header().Get("Idempotent-Replayed"), up.calls.Load())
+	}
+}
+
+// TestIdempotentExpiry answers a key anew once its kept answer is older
+// than the TTL, and prunes it.
+func TestIdempotentExpiry(t *testing.T) {
+	p, up, h := newIdempotencyTest(t)
+	old := StoredResponse{Fingerprint: "stale", Status: http.StatusOK, Body: []byte(`{"answer":0}`), At: time.Now().Add(-25 * time.Hour)}
+	ctx := context.Background()
+	p.idempotent.store.SaveResponse(ctx, "alice\x00k1", old)
+	rec := idempotentRequest(h, "alice", "k1", `{}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"answer":1}` || up.calls.Load() != 1 {
+		t.Errorf("after expiry: status %d, body %s; want the upstream's answer", rec.Code, rec.Body)
+	}
+	p.idempotent.store.SaveResponse(ctx, "alice\x00k2", old)
+	if n, err := p.idempotent.store.PruneResponses(ctx, time.Now().Add(-p.idempotent.cfg.ttl())); err != nil || n != 1 {
+		t.Errorf("PruneResponses = %d, %v; want the expired answer", n, err)
+	}
+	if sr, _ := p.idempotent.store.LoadResponse(ctx, "alice\x00k1"); sr == nil {
+		t.Errorf("the fresh answer was pruned")
+	}
+}
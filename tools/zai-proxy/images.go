@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ImagesConfig handles image content parts. Parts are always rewritten to
+// the shape of the API they are sent to: OpenAI image_url parts on
+// /messages requests become Anthropic image blocks and the reverse. For
+// models matching Inline (exact names or prefixes ending in "*"), whose
+// upstream takes only inline data, image URLs are fetched and sent as
+// base64. Fetched images must be one of Types (default PNG, JPEG, GIF and
+// WebP) and at most MaxBytes (default 5MB); the newest reach CacheBytes
+// (default 64MB) in total are kept for reuse. URLs resolving to loopback
+// or private addresses are refused unless AllowPrivate is set.
+type ImagesConfig struct {
+	Inline       []string `json:"inline,omitempty"`
+	Types        []string `json:"types,omitempty"`
+	MaxBytes     int64    `json:"max_bytes,omitempty"`
+	CacheBytes   int64    `json:"cache_bytes,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+	AllowPrivate bool     `json:"allow_private,omitempty"`
+}
+
+var defaultImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+func (c *ImagesConfig) validate() error {
+	if c.MaxBytes < 0 || c.CacheBytes < 0 || c.Timeout < 0 {
+		return fmt.Errorf("images: max_bytes, cache_bytes and timeout must not be negative")
+	}
+	return nil
+}
+
+var imageFetches = metrics.counter("zai_proxy_image_fetches_total", "Images fetched to inline them, by outcome.", "outcome")
+
+// inlineImage is a fetched image ready to send as data.
+type inlineImage struct {
+	mediaType string
+	data      string // base64
+}
+
+// imageFetcher fetches and caches images for inlining.
+type imageFetcher struct {
+	cfg    *ImagesConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache *lru[string, inlineImage]
+}
+
+func newImageFetcher(cfg *ImagesConfig) *imageFetcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !cfg.AllowPrivate {
+		dialer.Control = refusePrivate
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	tr := &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second}
+	return &imageFetcher{cfg: cfg, client: &http.Client{Transport: tr, Timeout: timeout},
+		cache: newLRU("images", 0, cmp.Or(cfg.CacheBytes, 64<<20), func(url string, img inlineImage) int64 {
+			return int64(len(url) + len(img.mediaType) + len(img.data))
+		})}
+}
+
+// refusePrivate stops connections to addresses inside the proxy's network,
+// checked after resolution so DNS can't smuggle them in.
+func refusePrivate(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("image host %s is a private address", ip)
+	}
+	return nil
+}
+
+func (f *imageFetcher) maxBytes() int64 {
+	if f.cfg.MaxBytes > 0 {
+		return f.cfg.MaxBytes
+	}
+	return 5 << 20
+}
+
+func (f *imageFetcher) allows(mediaType string) bool {
+	types := f.cfg.Types
+	if len(types) == 0 {
+		types = defaultImageTypes
+	}
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns url's image, from the cache when it was fetched before.
+func (f *imageFetcher) fetch(ctx context.Context, url string) (inlineImage, error) {
+	f.mu.Lock()
+	if img, ok := f.cache.get(url); ok {
+		f.mu.Unlock()
+		imageFetches.Add(1, "cached")
+		return img, nil
+	}
+	f.mu.Unlock()
+
+	img, err := f.get(ctx, url)
+	if err != nil {
+		imageFetches.Add(1, "failed")
+		return inlineImage{}, err
+	}
+	imageFetches.Add(1, "fetched")
+	f.remember(url, img)
+	return img, nil
+}
+
+func (f *imageFetcher) get(ctx context.Context, url string) (inlineImage, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return inlineImage{}, fmt.Errorf("image URL must be http or https")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return inlineImage{}, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return inlineImage{}, fmt.Errorf("fetching image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return inlineImage{}, fmt.Errorf("fetching image: %s", resp.Status)
+	}
+	limit := f.maxBytes()
+	if resp.ContentLength > limit {
+		return inlineImage{}, fmt.Errorf("image is over %d bytes", limit)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return inlineImage{}, fmt.Errorf("fetching image: %w", err)
+	}
+	if int64(len(b)) > limit {
+		return inlineImage{}, fmt.Errorf("image is over %d bytes", limit)
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !f.allows(mt) {
+		// Servers often label images loosely; trust the bytes.
+		mt, _, _ = mime.ParseMediaType(http.DetectContentType(b))
+	}
+	if !f.allows(mt) {
+		return inlineImage{}, fmt.Errorf("images of type %s are not accepted", mt)
+	}
+	return inlineImage{mediaType: mt, data: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// remember caches img, evicting the least recently used beyond the budget.
+func (f *imageFetcher) remember(url string, img inlineImage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache.put(url, img)
+}
+
+// imagePart is an image content part in either API's shape.
+type imagePart struct {
+	url       string // remote URL, or empty for inline data
+	mediaType string
+	data      string
+}
+
+// parseImagePart reads an OpenAI image_url part or an Anthropic image
+// block.
+func parseImagePart(m map[string]any) (imagePart, bool) {
+	switch m["type"] {
+	case "image_url":
+		var url string
+		switch v := m["image_url"].(type) {
+		case string:
+			url = v
+		case map[string]any:
+			url, _ = v["url"].(string)
+		}
+		if rest, ok := strings.CutPrefix(url, "data:"); ok {
+			meta, data, ok := strings.Cut(rest, ",")
+			mt, isBase64 := strings.CutSuffix(meta, ";base64")
+			if !ok || !isBase64 {
+				return imagePart{}, false
+			}
+			return imagePart{mediaType: mt, data: data}, true
+		}
+		return imagePart{url: url}, url != ""
+	case "image":
+		src, _ := m["source"].(map[string]any)
+		switch src["type"] {
+		case "base64":
+			mt, _ := src["media_type"].(string)
+			data, _ := src["data"].(string)
+			return imagePart{mediaType: mt, data: data}, data != ""
+		case "url":
+			url, _ := src["url"].(string)
+			return imagePart{url: url}, url != ""
+		}
+	}
+	return imagePart{}, false
+}
+
+// shape renders the part for the OpenAI or Anthropic API.
+func (ip imagePart) shape(anthropic bool) map[string]any {
+	if anthropic {
+		if ip.url != "" {
+			return map[string]any{"type": "image", "source": map[string]any{"type": "url", "url": ip.url}}
+		}
+		return map[string]any{"type": "image", "source": map[string]any{"type": "base64", "media_type": ip.mediaType, "data": ip.data}}
+	}
+	url := ip.url
+	if url == "" {
+		url = "data:" + ip.mediaType + ";base64," + ip.data
+	}
+	return map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}}
+}
+
+// imagesStage normalizes image parts once the model is final, so it
+// follows autoroute.
+func imagesStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	ic := &p.cfg.Images
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			msgs, ok := ex.doc["messages"].([]any)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			anthropic := strings.HasSuffix(r.URL.Path, "/messages")
+			want := "image_url"
+			if anthropic {
+				want = "image"
+			}
+			inline := matchModel(ic.Inline, ex.model)
+			for _, m := range msgs {
+				msg, _ := m.(map[string]any)
+				parts, _ := msg["content"].([]any)
+				for i, part := range parts {
+					pm, _ := part.(map[string]any)
+					ip, ok := parseImagePart(pm)
+					if !ok {
+						continue
+					}
+					// Parts already in the right shape are left as they are.
+					changed := pm["type"] != want
+					if inline && ip.url != "" {
+						img, err := p.images.fetch(r.Context(), ip.url)
+						if err != nil {
+							writeError(w, http.StatusBadRequest, "invalid_image", err.Error())
+							return
+						}
+						ip, changed = imagePart{mediaType: img.mediaType, data: img.data}, true
+					}
+					if changed {
+						parts[i], ex.dirty = ip.shape(anthropic), true
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
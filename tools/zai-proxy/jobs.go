@@ -0,0 +1,536 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobsConfig runs generations in the background for /v1/jobs. Workers
+// (default 4) jobs run at once and up to MaxQueued (default 1000) wait.
+// Jobs are written to Dir when set, so finished ones survive a restart;
+// jobs a restart interrupted are failed, as their credentials were never
+// written. Finished jobs are forgotten after Keep (default 24h). Queued
+// jobs run by priority tier, then in the order they came.
+type JobsConfig struct {
+	Dir       string   `json:"dir,omitempty"`
+	Workers   int      `json:"workers,omitempty"`
+	MaxQueued int      `json:"max_queued,omitempty"`
+	Keep      Duration `json:"keep,omitempty"`
+}
+
+const jobsPath = "/v1/jobs"
+
+func (c *JobsConfig) validate() error {
+	if c.Workers < 0 || c.MaxQueued < 0 || c.Keep < 0 {
+		return fmt.Errorf("jobs: workers, max_queued and keep must not be negative")
+	}
+	return nil
+}
+
+// AsyncJobRequest submits a job: Body is sent to Path (default
+// /v1/chat/completions) unstreamed, and the finished job is POSTed to
+// Webhook when set. With Stream the body is sent streamed instead and the
+// data of its events are kept as the job's chunks, for clients that can't
+// hold an event stream open to fetch from /v1/jobs/{id}/chunks as they
+// come. With Delay the job waits that long before it is queued to run.
+type AsyncJobRequest struct {
+	Path    string          `json:"path,omitempty"`
+	Body    json.RawMessage `json:"body"`
+	Webhook string          `json:"webhook,omitempty"`
+	Stream  bool            `json:"stream,omitempty"`
+	Delay   Duration        `json:"delay,omitempty"`
+}
+
+// AsyncJob is a background generation.
+type AsyncJob struct {
+	ID        string            `json:"id"`
+	Client    string            `json:"client"`
+	Status    string            `json:"status"` // queued, running, succeeded, failed or cancelled
+	Path      string            `json:"path"`
+	Model     string            `json:"model,omitempty"`
+	Webhook   string            `json:"webhook,omitempty"`
+	Stream    bool              `json:"stream,omitempty"`
+	Priority  string            `json:"priority,omitempty"`
+	Created   time.Time         `json:"created"`
+	NotBefore *time.Time        `json:"not_before,omitempty"`
+	Started   *time.Time        `json:"started,omitempty"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+	Request   json.RawMessage   `json:"request,omitempty"`
+	Code      int               `json:"response_status,omitempty"`
+	Response  json.RawMessage   `json:"response,omitempty"`
+	Chunks    []json.RawMessage `json:"chunks,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// JobChunks is a long-poll's answer: the chunks of a job from the one
+// asked for, and where the next poll starts.
+type JobChunks struct {
+	ID     string            `json:"id"`
+	Status string            `json:"status"`
+	Chunks []json.RawMessage `json:"chunks"`
+	Next   int               `json:"next"`
+	Code   int               `json:"response_status,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+func (j *AsyncJob) done() bool {
+	return j.Status == "succeeded" || j.Status == "failed" || j.Status == "cancelled"
+}
+
+var jobsTotal = metrics.counter("zai_proxy_jobs_total", "Background jobs finished, by status.", "status")
+
+// jobQueue holds the jobs and runs them through the proxy's own handlers
+// with the submitter's headers.
+type jobQueue struct {
+	cfg    JobsConfig
+	mux    *http.ServeMux
+	client *http.Client
+	queue  chan struct{} // one per queued job, taken by the worker to run it
+
+	// priority returns a submission's tier; nil runs every job as normal.
+	priority func(r *http.Request, client string) (string, error)
+
+	mu      sync.Mutex
+	jobs    map[string]*AsyncJob
+	waiting map[string][]string    // IDs of queued jobs by tier, oldest first
+	headers map[string]http.Header // of queued and running jobs, never written
+	cancel  map[string]context.CancelFunc
+	changed map[string]chan struct{} // of unfinished jobs, closed and replaced as chunks arrive
+}
+
+func newJobQueue(cfg JobsConfig, mux *http.ServeMux) *jobQueue {
+	cfg.Workers = cmp.Or(cfg.Workers, 4)
+	cfg.MaxQueued = cmp.Or(cfg.MaxQueued, 1000)
+	cfg.Keep = cmp.Or(cfg.Keep, Duration(24*time.Hour))
+	q := &jobQueue{cfg: cfg, mux: mux, client: &http.Client{Timeout: 30 * time.Second},
+		queue: make(chan struct{}, cfg.MaxQueued), jobs: map[string]*AsyncJob{}, waiting: map[string][]string{},
+		headers: map[string]http.Header{}, cancel: map[string]context.CancelFunc{}, changed: map[string]chan struct{}{}}
+	q.load()
+	return q
+}
+
+// load reads the jobs written before a restart.
+func (q *jobQueue) load() {
+	if q.cfg.Dir == "" {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(q.cfg.Dir, "*.json"))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var j AsyncJob
+		if err := json.Unmarshal(b, &j); err != nil || j.ID == "" {
+			continue
+		}
+		if !j.done() {
+			now := time.Now().UTC()
+			j.Status, j.Error, j.Finished = "failed", "interrupted by a proxy restart", &now
+			q.save(&j)
+		}
+		q.jobs[j.ID] = &j
+	}
+}
+
+// save writes a job to Dir; callers hold mu or own the job.
+func (q *jobQueue) save(j *AsyncJob) {
+	if q.cfg.Dir == "" {
+		return
+	}
+	b, err := json.Marshal(j)
+	if err == nil {
+		err = os.MkdirAll(q.cfg.Dir, 0o700)
+	}
+	if err == nil {
+		path := filepath.Join(q.cfg.Dir, j.ID+".json")
+		if err = os.WriteFile(path+".tmp", b, 0o600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing job %s: %v", j.ID, err)
+	}
+}
+
+func (q *jobQueue) start(ctx context.Context) {
+	for range q.cfg.Workers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.queue:
+					q.run(ctx, q.next())
+				}
+			}
+		}()
+	}
+	go q.prune(ctx)
+}
+
+// next takes the oldest queued job of the highest tier waiting.
+func (q *jobQueue) next() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, tier := range priorityTiers {
+		if ids := q.waiting[tier]; len(ids) > 0 {
+			q.waiting[tier] = ids[1:]
+			return ids[0]
+		}
+	}
+	return ""
+}
+
+func (q *jobQueue) run(ctx context.Context, id string) {
+	q.mu.Lock()
+	j := q.jobs[id]
+	if j == nil || j.Status != "queued" {
+		q.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	now := time.Now().UTC()
+	j.Status, j.Started = "running", &now
+	q.cancel[id] = cancel
+	header := q.headers[id]
+	doc, path, model := map[string]any{}, j.Path, j.Model
+	json.Unmarshal(j.Request, &doc)
+	q.save(j)
+	q.mu.Unlock()
+
+	var out *fanoutStream
+	if doc["stream"] = j.Stream; j.Stream {
+		out = &fanoutStream{collect: func(c FanoutChunk) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			j.Chunks = append(j.Chunks, c.Data)
+			q.notify(id)
+		}}
+	}
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, path, nil)
+	r.Header, r.RemoteAddr = header, "127.0.0.1:0"
+	res := fanoutOne(q.mux, r, path, doc, 0, model, out)
+
+	q.mu.Lock()
+	now = time.Now().UTC()
+	j.Finished, j.Code, j.Response = &now, res.Status, res.Response
+	switch {
+	case ctx.Err() != nil:
+		j.Status = "cancelled"
+	case res.Error != "" || res.Status >= 400:
+		j.Status, j.Error = "failed", res.Error
+	default:
+		j.Status = "succeeded"
+	}
+	if j.Status == "cancelled" {
+		j.Response = nil
+	}
+	delete(q.cancel, id)
+	delete(q.headers, id)
+	q.finish(id)
+	q.save(j)
+	done := *j
+	q.mu.Unlock()
+	q.finished(ctx, done)
+}
+
+// finished counts a job and delivers it to its webhook.
+func (q *jobQueue) finished(ctx context.Context, j AsyncJob) {
+	jobsTotal.Add(1, j.Status)
+	if j.Webhook == "" {
+		return
+	}
+	go func() {
+		if err := postJSON(context.WithoutCancel(ctx), q.client, j.Webhook, j); err != nil {
+			log.Printf("Error delivering job %s to its webhook: %v", j.ID, err)
+		}
+	}()
+}
+
+// prune forgets finished jobs older than Keep once a minute.
+func (q *jobQueue) prune(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-time.Duration(q.cfg.Keep))
+		q.mu.Lock()
+		for id, j := range q.jobs {
+			if j.done() && j.Finished != nil && j.Finished.Before(cutoff) {
+				delete(q.jobs, id)
+				if q.cfg.Dir != "" {
+					os.Remove(filepath.Join(q.cfg.Dir, id+".json"))
+				}
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// submit queues a job of tier for client.
+func (q *jobQueue) submit(client, tier string, req AsyncJobRequest, header http.Header) (*AsyncJob, error) {
+	path := cmp.Or(req.Path, "/v1/chat/completions")
+	if !strings.HasPrefix(path, "/v1/") || strings.HasPrefix(path, jobsPath) {
+		return nil, fmt.Errorf("path must be an API path under /v1/ other than %s", jobsPath)
+	}
+	v, err := decodeJSON(req.Body)
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return nil, fmt.Errorf("body must be a JSON object")
+	}
+	model, _ := doc["model"].(string)
+	header = header.Clone()
+	for _, h := range []string{"Content-Length", "Content-Encoding", "Accept-Encoding"} {
+		header.Del(h)
+	}
+	if req.Delay < 0 {
+		return nil, fmt.Errorf("delay must not be negative")
+	}
+	j := &AsyncJob{ID: newRequestID(), Client: client, Status: "queued", Path: path, Model: model,
+		Webhook: req.Webhook, Stream: req.Stream, Priority: tier, Created: time.Now().UTC(), Request: req.Body}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if req.Delay > 0 {
+		runs := j.Created.Add(time.Duration(req.Delay))
+		j.NotBefore = &runs
+		if len(q.queue) == cap(q.queue) {
+			return nil, errJobsFull
+		}
+		time.AfterFunc(time.Duration(req.Delay), func() { q.enqueue(j.ID, tier) })
+	} else {
+		select {
+		case q.queue <- struct{}{}:
+		default:
+			return nil, errJobsFull
+		}
+		q.waiting[tier] = append(q.waiting[tier], j.ID)
+	}
+	q.jobs[j.ID], q.headers[j.ID], q.changed[j.ID] = j, header, make(chan struct{})
+	q.save(j)
+	return j, nil
+}
+
+// enqueue queues a delayed job to run, unless it was cancelled while it
+// waited; one the queue has no room for then fails.
+func (q *jobQueue) enqueue(id, tier string) {
+	q.mu.Lock()
+	j := q.jobs[id]
+	if j == nil || j.Status != "queued" {
+		q.mu.Unlock()
+		return
+	}
+	select {
+	case q.queue <- struct{}{}:
+		q.waiting[tier] = append(q.waiting[tier], id)
+		q.mu.Unlock()
+		return
+	default:
+	}
+	now := time.Now().UTC()
+	j.Status, j.Error, j.Finished = "failed", errJobsFull.Error(), &now
+	delete(q.headers, id)
+	q.finish(id)
+	q.save(j)
+	done := *j
+	q.mu.Unlock()
+	q.finished(context.Background(), done)
+}
+
+var errJobsFull = errors.New("the job queue is full")
+
+// get returns a copy of client's job.
+func (q *jobQueue) get(client, id string) (AsyncJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.jobs[id]
+	if j == nil || j.Client != client {
+		return AsyncJob{}, false
+	}
+	return *j, true
+}
+
+// cancelJob stops client's job, reporting false if there is none.
+func (q *jobQueue) cancelJob(client, id string) (AsyncJob, bool) {
+	q.mu.Lock()
+	j := q.jobs[id]
+	if j == nil || j.Client != client {
+		q.mu.Unlock()
+		return AsyncJob{}, false
+	}
+	var finished bool
+	switch {
+	case j.Status == "queued":
+		now := time.Now().UTC()
+		j.Status, j.Finished = "cancelled", &now
+		delete(q.headers, id)
+		q.finish(id)
+		q.save(j)
+		finished = true
+	case j.Status == "running":
+		q.cancel[id]()
+	}
+	out := *j
+	q.mu.Unlock()
+	if finished {
+		q.finished(context.Background(), out)
+	}
+	return out, true
+}
+
+// notify wakes the long-polls of job id; callers hold mu.
+func (q *jobQueue) notify(id string) {
+	if ch, ok := q.changed[id]; ok {
+		close(ch)
+		q.changed[id] = make(chan struct{})
+	}
+}
+
+// finish wakes the long-polls of job id for the last time; callers hold mu.
+func (q *jobQueue) finish(id string) {
+	if ch, ok := q.changed[id]; ok {
+		close(ch)
+		delete(q.changed, id)
+	}
+}
+
+// chunks returns client's job's chunks from the from'th, waiting up to
+// wait for there to be any unless the job has finished.
+func (q *jobQueue) chunks(ctx context.Context, client, id string, from int, wait time.Duration) (JobChunks, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	waited := false
+	for {
+		q.mu.Lock()
+		j := q.jobs[id]
+		if j == nil || j.Client != client {
+			q.mu.Unlock()
+			return JobChunks{}, false
+		}
+		ch, running := q.changed[id]
+		if from < len(j.Chunks) || !running || waited {
+			out := JobChunks{ID: j.ID, Status: j.Status, Chunks: []json.RawMessage{}, Next: max(from, len(j.Chunks))}
+			if from < len(j.Chunks) {
+				out.Chunks = append(out.Chunks, j.Chunks[from:]...)
+			}
+			if j.done() {
+				out.Code, out.Error = j.Code, j.Error
+			}
+			q.mu.Unlock()
+			return out, true
+		}
+		q.mu.Unlock()
+		select {
+		case <-ch:
+		case <-timer.C:
+			waited = true
+		case <-ctx.Done():
+			waited = true
+		}
+	}
+}
+
+// list returns client's jobs, newest first, without their bodies.
+func (q *jobQueue) list(client string) []AsyncJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []AsyncJob{}
+	for _, j := range q.jobs {
+		if j.Client == client {
+			c := *j
+			c.Request, c.Response, c.Chunks = nil, nil, nil
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// jobsHandler serves submit, poll, long-poll, list and cancel for the
+// calling client's jobs. A long-poll of /v1/jobs/{id}/chunks?from=N
+// answers once the job has chunks from the N'th, it finishes, or wait has
+// passed (default 25s, at most 60s, short of the idle limits of most
+// middleboxes).
+func jobsHandler(q *jobQueue, self func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := self(r)
+		id := r.PathValue("id")
+		switch {
+		case r.Method == http.MethodPost:
+			var req AsyncJobRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON job request: "+err.Error())
+				return
+			}
+			tier := "normal"
+			if q.priority != nil {
+				var err error
+				if tier, err = q.priority(r, client); err != nil {
+					writePriorityError(w, err)
+					return
+				}
+			}
+			j, err := q.submit(client, tier, req, r.Header)
+			if err == errJobsFull {
+				writeLimitError(w, http.StatusServiceUnavailable, "overloaded", err.Error(), "job_queue", 5*time.Second)
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			w.Header().Set("Location", jobsPath+"/"+j.ID)
+			writeJSON(w, http.StatusAccepted, j)
+		case id == "":
+			writeJSON(w, http.StatusOK, map[string]any{"jobs": q.list(client)})
+		case strings.HasSuffix(r.URL.Path, "/chunks"):
+			from, wait, err := 0, 25*time.Second, error(nil)
+			if v := r.URL.Query().Get("from"); v != "" {
+				if from, err = strconv.Atoi(v); err != nil || from < 0 {
+					writeError(w, http.StatusBadRequest, "invalid_request", "from must be a chunk index")
+					return
+				}
+			}
+			if v := r.URL.Query().Get("wait"); v != "" {
+				if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+					writeError(w, http.StatusBadRequest, "invalid_request", "wait must be a duration such as 30s")
+					return
+				}
+			}
+			out, ok := q.chunks(r.Context(), client, id, from, min(wait, time.Minute))
+			if !ok {
+				writeError(w, http.StatusNotFound, "not_found", "no such job")
+				return
+			}
+			writeJSON(w, http.StatusOK, out)
+		default:
+			get := q.get
+			if r.Method == http.MethodDelete {
+				get = q.cancelJob
+			}
+			j, ok := get(client, id)
+			if !ok {
+				writeError(w, http.StatusNotFound, "not_found", "no such job")
+				return
+			}
+			writeJSON(w, http.StatusOK, j)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// journal is an append-only JSON-lines file of changes made through the
+// admin API. It is replayed over the config at startup so those changes
+// survive restarts. Its entries are also kept in memory as the versions
+// of the runtime config; with no path they are only kept there.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	entries []journalEntry // recorded and replayed, oldest first
+}
+
+// journalEntry is one line of the journal. Op says which field is set.
+type journalEntry struct {
+	Time     time.Time       `json:"time"`
+	Op       string          `json:"op"` // "put", "remove", "route", "flag", "template", "quota" or "restore"
+	Upstream *UpstreamConfig `json:"upstream,omitempty"`
+	Route    *RouteOverride  `json:"route,omitempty"`
+	Flag     *flagChange     `json:"flag,omitempty"`
+	Template *templateChange `json:"template,omitempty"`
+	Quota    *quotaChange    `json:"quota,omitempty"`
+	Restore  *configRestore  `json:"restore,omitempty"`
+}
+
+// append records e before it takes effect.
+func (j *journal) append(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(e); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+func (j *journal) write(e journalEntry) error {
+	if j.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay passes every recorded entry to fn, oldest first.
+func (j *journal) replay(fn func(journalEntry)) error {
+	if j.path == "" {
+		return nil
+	}
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// A crash mid-append leaves a torn last line; skip it.
+			log.Printf("Error reading journal %s line %d: %v", j.path, n, err)
+			continue
+		}
+		j.mu.Lock()
+		j.entries = append(j.entries, e)
+		j.mu.Unlock()
+		fn(e)
+	}
+	return sc.Err()
+}
+
+// list returns every entry, oldest first.
+func (j *journal) list() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSONModeConfig holds chat answers to the JSON output asked for with
+// response_format: a JSON object for json_object, a value of the given
+// schema for json_schema. An unstreamed answer that doesn't conform is,
+// with Fix, fixed up where that is safe: text and code fences around the
+// JSON are dropped, trailing commas removed and what was cut off closed.
+// With Retries, the model is then told what was wrong and asked again, up
+// to that many times. An answer still not conforming is replaced with a
+// 502 saying why, the answer given in output.
+type JSONModeConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	Fix     bool `json:"fix,omitempty"`
+	Retries int  `json:"retries,omitempty"`
+}
+
+func (c *JSONModeConfig) validate() error {
+	if c.Retries < 0 {
+		return fmt.Errorf("json_mode: retries must not be negative")
+	}
+	return nil
+}
+
+var jsonOutputs = metrics.counter("zai_proxy_json_outputs_total",
+	"Answers held to a requested JSON format, by outcome: valid, fixed, retried or failed.", "outcome")
+
+// jsonModeFailure is the answer to a request whose output never conformed.
+type jsonModeFailure struct {
+	Error  apiErrorDetail `json:"error"`
+	Output string         `json:"output"`
+}
+
+// jsonModeStage checks answers outside the tool loop, so only final
+// answers are held to the format, and a retry runs the loop again.
+func jsonModeStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	jc := &p.cfg.JSONMode
+	return func(next http.Handler) http.Handler {
+		if !jc.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			want := jsonFormatOf(ex.doc)
+			msgs, ok := ex.doc["messages"].([]any)
+			if stream, _ := ex.doc["stream"].(bool); want == nil || !ok || stream || strings.HasSuffix(r.URL.Path, "/messages") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ex.inspect = true
+			for round := 0; ; round++ {
+				held := &heldResponse{w: w, h: http.Header{}}
+				next.ServeHTTP(held, r)
+				if held.sent || held.status >= 300 {
+					held.sendTo(w)
+					return
+				}
+				doc, content, fixed, err := holdToFormat(held.body.Bytes(), want, jc.Fix)
+				if doc == nil {
+					held.sendTo(w)
+					return
+				}
+				if round > 0 {
+					held.h.Set("X-Ringmaster-JSON-Retries", strconv.Itoa(round))
+				}
+				if err == nil {
+					outcome := "valid"
+					if fixed {
+						b, _ := json.Marshal(doc)
+						held.body.Reset()
+						held.body.Write(b)
+						held.h.Del("Content-Length")
+						held.h.Set("X-Ringmaster-JSON-Fixed", "true")
+						outcome = "fixed"
+					} else if round > 0 {
+						outcome = "retried"
+					}
+					jsonOutputs.Add(1, outcome)
+					held.sendTo(w)
+					return
+				}
+				o := newUsageObserver(held.h.Get("Content-Type"))
+				o.Write(held.body.Bytes())
+				_, u, _ := o.Finish()
+				p.record(ex, held.status, ex.model, u)
+				if round >= jc.Retries {
+					jsonOutputs.Add(1, "failed")
+					debugf("Request %s got no answer in the requested JSON format: %v", ex.id, err)
+					for k, vs := range held.h {
+						if strings.HasPrefix(k, "X-Ringmaster-") {
+							w.Header()[k] = vs
+						}
+					}
+					writeJSON(w, http.StatusBadGateway, jsonModeFailure{
+						Error: apiErrorDetail{Message: "the answer is not in the requested JSON format: " + err.Error(), Type: "invalid_output",
+							Retry: &retryHint{Retryable: true}},
+						Output: content,
+					})
+					return
+				}
+				msgs = append(msgs, map[string]any{"role": "assistant", "content": content}, map[string]any{"role": "user",
+					"content": "Your reply was not in the requested JSON format: " + err.Error() + ". Reply again with only the corrected JSON."})
+				ex.doc["messages"], ex.dirty = msgs, true
+				debugf("Request %s asked again for JSON, round %d: %v", ex.id, round+1, err)
+			}
+		})
+	}, nil
+}
+
+// jsonFormatOf returns the schema a chat request's output must have, or
+// nil unless it asks for JSON.
+func jsonFormatOf(doc map[string]any) *schema {
+	rf, _ := doc["response_format"].(map[string]any)
+	switch rf["type"] {
+	case "json_object":
+		return anObject
+	case "json_schema":
+		js, _ := rf["json_schema"].(map[string]any)
+		return compileSchema(js["schema"])
+	}
+	return nil
+}
+
+// holdToFormat checks each choice of a chat answer against want, fixing
+// those it can when fix is set. It returns the answer, nil if it isn't
+// one, whether any choice was fixed, and the content and error of the
+// first that still doesn't conform.
+func holdToFormat(body []byte, want *schema, fix bool) (doc map[string]any, content string, fixed bool, err error) {
+	v, _ := decodeJSON(body)
+	doc, _ = v.(map[string]any)
+	choices, _ := doc["choices"].([]any)
+	if len(choices) == 0 {
+		return nil, "", false, nil
+	}
+	for _, c := range choices {
+		m, _ := c.(map[string]any)
+		msg, _ := m["message"].(map[string]any)
+		text, _ := msg["content"].(string)
+		cerr := conformsTo(text, want)
+		if cerr != nil && fix {
+			if repaired := fixJSON(text); repaired != text {
+				if rerr := conformsTo(repaired, want); rerr == nil {
+					msg["content"], fixed, cerr = repaired, true, nil
+				} else if json.Valid([]byte(repaired)) {
+					// Wrong rather than broken: say what's wrong with it.
+					text, cerr = repaired, rerr
+				}
+			}
+		}
+		if cerr != nil && err == nil {
+			content, err = text, cerr
+		}
+	}
+	return doc, content, fixed, err
+}
+
+// conformsTo reports why text isn't a JSON value of want, if it isn't.
+func conformsTo(text string, want *schema) error {
+	if !json.Valid([]byte(text)) {
+		return fmt.Errorf("it is not valid JSON")
+	}
+	v, _ := decodeJSON([]byte(text))
+	if err := want.check("", v); err != nil {
+		se := err.(*schemaError)
+		if se.Param == "" {
+			return fmt.Errorf("the value %s", se.Msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// fixJSON makes the repairs that are safe to make to a model's JSON: it
+// drops what comes before the first object or array and after it ends,
+// commas before a closing bracket, and closes strings, arrays and objects
+// left open at the end. Text it can't make sense of is returned as is.
+func fixJSON(text string) string {
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return text
+	}
+	var out, stack []byte
+	inString, escaped := false, false
+	trimComma := func() {
+		out = []byte(strings.TrimRight(string(out), " \t\r\n"))
+		if n := len(out); n > 0 && out[n-1] == ',' {
+			out = out[:n-1]
+		}
+	}
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			out = append(out, c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			if len(stack) == 0 || stack[len(stack)-1] != c {
+				return text
+			}
+			trimComma()
+			stack = stack[:len(stack)-1]
+			out = append(out, c)
+			if len(stack) == 0 {
+				return string(out)
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	if inString {
+		if escaped {
+			out = out[:len(out)-1]
+		}
+		out = append(out, '"')
+	}
+	trimComma()
+	for i := len(stack) - 1; i >= 0; i-- {
+		out = append(out, stack[i])
+	}
+	return string(out)
+}
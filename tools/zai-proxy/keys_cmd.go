@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// keyManager is what the keys subcommand drives: the admin API of a
+// running proxy or, with -direct, the store itself.
+type keyManager interface {
+	list(ctx context.Context) ([]VirtualKey, error)
+	create(ctx context.Context, client string) (VirtualKey, string, error)
+	revoke(ctx context.Context, id string) error
+	rotate(ctx context.Context, id string) (VirtualKey, string, error)
+}
+
+var errKeyNotFound = errors.New("no active key with that id")
+
+// rotateKey issues a replacement for the key id, for the same client, and
+// revokes the old one.
+func rotateKey(ctx context.Context, s Store, id string) (VirtualKey, string, error) {
+	keys, err := s.ListKeys(ctx)
+	if err != nil {
+		return VirtualKey{}, "", err
+	}
+	for _, old := range keys {
+		if old.ID != id || old.RevokedAt != nil {
+			continue
+		}
+		k, secret := newVirtualKey(old.Client)
+		if err := s.CreateKey(ctx, k); err != nil {
+			return VirtualKey{}, "", err
+		}
+		if _, err := s.RevokeKey(ctx, id, time.Now()); err != nil {
+			return VirtualKey{}, "", err
+		}
+		return k, secret, nil
+	}
+	return VirtualKey{}, "", errKeyNotFound
+}
+
+// runKeys implements the keys subcommand.
+func runKeys(args []string) error {
+	if len(args) == 0 {
+		return keysUsage()
+	}
+	sub, args := args[0], args[1:]
+	fs := flag.NewFlagSet("keys "+sub, flag.ExitOnError)
+	addr := fs.String("admin", envOr("ZAI_PROXY_ADMIN_URL", "http://localhost:8080"), "admin API URL, or unix:/path for a socket")
+	token := fs.String("token", os.Getenv("ZAI_PROXY_ADMIN_TOKEN"), "admin token")
+	direct := fs.Bool("direct", false, "use the store named in the config file instead of the admin API")
+	configPath := fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file, with -direct")
+	client := fs.String("client", "", "client the key identifies (create)")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	var km keyManager = newAPIKeys(*addr, *token)
+	if *direct {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg.Storage)
+		if err != nil {
+			return err
+		}
+		if store == nil {
+			return fmt.Errorf("no storage configured; virtual keys need a store")
+		}
+		defer store.Close()
+		km = storeKeys{s: store, audit: &auditLog{path: cfg.Admin.Audit}}
+	}
+
+	ctx := context.Background()
+	out := os.Stdout
+	switch sub {
+	case "list":
+		keys, err := km.list(ctx)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return json.NewEncoder(out).Encode(keys)
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCLIENT\tCREATED\tREVOKED")
+		for _, k := range keys {
+			revoked := "-"
+			if k.RevokedAt != nil {
+				revoked = k.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.ID, k.Client, k.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return tw.Flush()
+	case "create", "rotate":
+		var k VirtualKey
+		var secret string
+		var err error
+		if sub == "create" {
+			if *client == "" {
+				return fmt.Errorf("keys create: -client is required")
+			}
+			k, secret, err = km.create(ctx, *client)
+		} else {
+			if fs.NArg() != 1 {
+				return fmt.Errorf("usage: keys rotate [flags] <key-id>")
+			}
+			k, secret, err = km.rotate(ctx, fs.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return json.NewEncoder(out).Encode(struct {
+				VirtualKey
+				Secret string `json:"secret"`
+			}{k, secret})
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\n", k.ID, k.Client, secret)
+		return nil
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: keys revoke [flags] <key-id>")
+		}
+		return km.revoke(ctx, fs.Arg(0))
+	}
+	return keysUsage()
+}
+
+func keysUsage() error {
+	return fmt.Errorf("usage: %s keys create -client <name> | list | revoke <key-id> | rotate <key-id>", os.Args[0])
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// storeKeys manages keys in the store directly, auditing each change as a
+// CLI action.
+type storeKeys struct {
+	s     Store
+	audit *auditLog
+}
+
+func (k storeKeys) record(action string, before, after any) {
+	e := AuditEntry{Time: time.Now(), Actor: cliActor(), Source: "cli", Action: action,
+		Before: auditJSON(before), After: auditJSON(after)}
+	if err := k.audit.record(e); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+func (k storeKeys) find(ctx context.Context, id string) any {
+	keys, _ := k.s.ListKeys(ctx)
+	for _, vk := range keys {
+		if vk.ID == id {
+			return vk
+		}
+	}
+	return nil
+}
+
+func (k storeKeys) list(ctx context.Context) ([]VirtualKey, error) { return k.s.ListKeys(ctx) }
+
+func (k storeKeys) create(ctx context.Context, client string) (VirtualKey, string, error) {
+	vk, secret := newVirtualKey(client)
+	if err := k.s.CreateKey(ctx, vk); err != nil {
+		return vk, "", err
+	}
+	k.record("keys create", nil, vk)
+	return vk, secret, nil
+}
+
+func (k storeKeys) revoke(ctx context.Context, id string) error {
+	before := k.find(ctx, id)
+	ok, err := k.s.RevokeKey(ctx, id, time.Now())
+	if err == nil && !ok {
+		err = errKeyNotFound
+	}
+	if err == nil {
+		k.record("keys revoke "+id, before, k.find(ctx, id))
+	}
+	return err
+}
+
+func (k storeKeys) rotate(ctx context.Context, id string) (VirtualKey, string, error) {
+	before := k.find(ctx, id)
+	vk, secret, err := rotateKey(ctx, k.s, id)
+	if err == nil {
+		k.record("keys rotate "+id, before, vk)
+	}
+	return vk, secret, err
+}
+
+// apiKeys calls the /admin/keys endpoints of a running proxy.
+type apiKeys struct {
+	base  string
+	token string
+	hc    *http.Client
+}
+
+func newAPIKeys(addr, token string) *apiKeys {
+	hc := &http.Client{Timeout: 30 * time.Second}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		hc.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+		addr = "http://admin"
+	}
+	return &apiKeys{base: strings.TrimSuffix(addr, "/"), token: token, hc: hc}
+}
+
+// do sends a request and decodes a JSON reply into out, turning error
+// replies into Go errors.
+func (a *apiKeys) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	req.Header.Set(actorHeader, cliActor())
+	resp, err := a.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		var e apiError
+		if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+type issuedKey struct {
+	VirtualKey
+	Secret string `json:"secret"`
+}
+
+func (a *apiKeys) list(ctx context.Context) ([]VirtualKey, error) {
+	var res struct {
+		Keys []VirtualKey `json:"keys"`
+	}
+	err := a.do(ctx, http.MethodGet, "/admin/keys", nil, &res)
+	return res.Keys, err
+}
+
+func (a *apiKeys) create(ctx context.Context, client string) (VirtualKey, string, error) {
+	var k issuedKey
+	err := a.do(ctx, http.MethodPost, "/admin/keys", map[string]string{"client": client}, &k)
+	return k.VirtualKey, k.Secret, err
+}
+
+func (a *apiKeys) revoke(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodDelete, "/admin/keys/"+id, nil, nil)
+}
+
+func (a *apiKeys) rotate(ctx context.Context, id string) (VirtualKey, string, error) {
+	var k issuedKey
+	err := a.do(ctx, http.MethodPost, "/admin/keys/"+id+"/rotate", nil, &k)
+	return k.VirtualKey, k.Secret, err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// topKeyModels is how many models a key's stats list.
+const topKeyModels = 5
+
+// KeyStats is what one virtual key has been used for since this replica
+// started: its totals, its errors by status, the models it used most and
+// when it was last used. Each replica counts the requests it served.
+type KeyStats struct {
+	ID        string           `json:"id"`
+	Client    string           `json:"client"`
+	Since     time.Time        `json:"since"`
+	LastUsed  *time.Time       `json:"last_used,omitempty"`
+	Total     UsageTotals      `json:"total"`
+	Errors    map[string]int64 `json:"errors"`
+	TopModels []ModelUsage     `json:"top_models"`
+}
+
+// ModelUsage is a key's totals for one model.
+type ModelUsage struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+type keyState struct {
+	client   string
+	lastUsed time.Time
+	total    UsageTotals
+	errors   map[string]int64
+	models   map[string]*UsageTotals
+}
+
+// keyStats counts usage per virtual key.
+type keyStats struct {
+	since time.Time
+
+	mu   sync.Mutex
+	byID map[string]*keyState
+}
+
+func newKeyStats() *keyStats {
+	return &keyStats{since: time.Now().UTC(), byID: map[string]*keyState{}}
+}
+
+func (s *keyStats) record(id, client, model string, now time.Time, status int, u Usage, cost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.byID[id]
+	if k == nil {
+		k = &keyState{errors: map[string]int64{}, models: map[string]*UsageTotals{}}
+		s.byID[id] = k
+	}
+	k.client, k.lastUsed = client, now.UTC()
+	k.total.add(status, u, cost)
+	if status >= 400 {
+		k.errors[strconv.Itoa(status)]++
+	}
+	if model == "" {
+		return
+	}
+	m := k.models[model]
+	if m == nil {
+		m = &UsageTotals{}
+		k.models[model] = m
+	}
+	m.add(status, u, cost)
+}
+
+// get returns the stats of the key id, which belongs to client.
+func (s *keyStats) get(id, client string) KeyStats {
+	out := KeyStats{ID: id, Client: client, Since: s.since, Errors: map[string]int64{}, TopModels: []ModelUsage{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.byID[id]
+	if k == nil {
+		return out
+	}
+	last := k.lastUsed
+	out.LastUsed, out.Total = &last, k.total
+	for status, n := range k.errors {
+		out.Errors[status] = n
+	}
+	for model, t := range k.models {
+		out.TopModels = append(out.TopModels, ModelUsage{Model: model, UsageTotals: *t})
+	}
+	slices.SortFunc(out.TopModels, func(a, b ModelUsage) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Model, b.Model))
+	})
+	if len(out.TopModels) > topKeyModels {
+		out.TopModels = out.TopModels[:topKeyModels]
+	}
+	return out
+}
+
+// keyStatsHandler serves /keys/{id}/stats to the holder of that key, who
+// must present it.
+func keyStatsHandler(stats *keyStats, reg *clientRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := reg.KeyID(r)
+		switch {
+		case id == "":
+			writeError(w, http.StatusUnauthorized, "authentication_error", "present the virtual key to read its stats")
+		case id != r.PathValue("id"):
+			writeError(w, http.StatusForbidden, "permission_error", "a key can only read its own stats")
+		default:
+			writeJSON(w, http.StatusOK, stats.get(id, reg.Identify(r)))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderConfig elects one replica to run the jobs meant to run once for
+// all of them: scheduled reports, evals and prompts, and pruning usage,
+// sessions and idempotent answers from shared storage. With Backend
+// "redis", the leader holds a lease in Redis for TTL (default 15s),
+// renewing it every third of that; should it stop renewing, another takes
+// over once the lease runs out. With "cluster", the leader is the live
+// member of the cluster with the lowest node ID. Empty, every replica
+// runs the jobs, as is right for one alone.
+type LeaderConfig struct {
+	Backend string   `json:"backend,omitempty"`
+	TTL     Duration `json:"ttl,omitempty"`
+}
+
+func (c *LeaderConfig) validate(redis RedisConfig, cluster ClusterConfig) error {
+	switch c.Backend {
+	case "":
+	case "redis":
+		if redis.Addr == "" {
+			return fmt.Errorf("leader: backend \"redis\" needs a redis addr")
+		}
+	case "cluster":
+		if cluster.Listen == "" {
+			return fmt.Errorf("leader: backend \"cluster\" needs a cluster listen address")
+		}
+	default:
+		return fmt.Errorf("leader: unknown backend %q (want redis or cluster)", c.Backend)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("leader: ttl must not be negative")
+	}
+	return nil
+}
+
+var leaderGauge = metrics.gauge("zai_proxy_leader", "1 while this replica runs the cluster's singleton jobs.")
+
+// Scripts acting on the lease only while this replica holds it.
+const (
+	renewLeaseScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`
+	releaseLeaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+)
+
+// leader tracks whether this replica leads.
+type leader struct {
+	cfg     *LeaderConfig
+	node    string
+	redis   *redisClient
+	cluster *cluster
+	is      atomic.Bool
+	retired atomic.Bool // for good, the process handing over or stopping
+}
+
+// newLeader returns the configured election, or nil when there is none.
+func newLeader(cfg *LeaderConfig, rc *redisClient, c *cluster) *leader {
+	if cfg.Backend == "" {
+		return nil
+	}
+	l := &leader{cfg: cfg, redis: rc, cluster: c}
+	leaderGauge.Set(0)
+	if c != nil {
+		l.node = c.node
+	} else {
+		b := make([]byte, 8)
+		rand.Read(b)
+		l.node = hex.EncodeToString(b)
+	}
+	return l
+}
+
+// leading reports whether this replica should run singleton jobs now.
+func (l *leader) leading() bool {
+	return l == nil || l.is.Load()
+}
+
+func (l *leader) ttl() time.Duration {
+	return cmp.Or(time.Duration(l.cfg.TTL), 15*time.Second)
+}
+
+// run takes part in the election until ctx is done or the leader retires.
+func (l *leader) run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl() / 3)
+	defer ticker.Stop()
+	for !l.retired.Load() {
+		l.set(l.elect(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect reports whether this replica leads for the coming interval.
+func (l *leader) elect(ctx context.Context) bool {
+	if l.retired.Load() {
+		return false
+	}
+	if l.cfg.Backend == "cluster" {
+		return l.cluster.lowest()
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.ttl()/3)
+	defer cancel()
+	key, ms := l.redis.key("leader"), strconv.FormatInt(l.ttl().Milliseconds(), 10)
+	// The lease may be this replica's still, even if it stopped leading.
+	v, err := l.redis.do(ctx, "EVAL", renewLeaseScript, "1", key, l.node, ms)
+	if err != nil {
+		if l.is.Load() {
+			log.Printf("Error renewing the leader lease: %v", err)
+		}
+		// Others may take over once it runs out, so stop leading early.
+		return false
+	}
+	if v == int64(1) {
+		return true
+	}
+	v, err = l.redis.do(ctx, "SET", key, l.node, "NX", "PX", ms)
+	if err != nil {
+		debugf("Error taking the leader lease: %v", err)
+		return false
+	}
+	return v == "OK"
+}
+
+func (l *leader) set(leads bool) {
+	leads = leads && !l.retired.Load()
+	if l.is.Swap(leads) == leads {
+		return
+	}
+	if leads {
+		leaderGauge.Set(1)
+		infof("Leading the cluster's singleton jobs as %s", l.node)
+	} else {
+		leaderGauge.Set(0)
+		infof("No longer leading the cluster's singleton jobs")
+	}
+}
+
+// retire leaves the election for good, giving up the lease so another
+// replica takes over at once.
+func (l *leader) retire() {
+	if l == nil || l.retired.Swap(true) || !l.is.Load() {
+		return
+	}
+	l.set(false)
+	if l.cfg.Backend == "redis" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.redis.do(ctx, "EVAL", releaseLeaseScript, "1", l.redis.key("leader"), l.node); err != nil {
+			log.Printf("Error releasing the leader lease: %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// KubernetesConfig fits the proxy to a pod's lifecycle, so rolling deploys
+// don't cut generations short. With ReadyOnUpstreams, /ready fails while
+// no upstream requests would go to is healthy: each has its circuit open,
+// or failed its last request within the minute. Point the container's
+// preStop hook at GET /prestop: it switches to drain, so /ready fails,
+// waits DrainDelay (default 5s) for the pod to leave the service's
+// endpoints while still serving, then waits for the requests in flight,
+// for at most the longest a stream is permitted (transport.timeout, or
+// realtime.max_duration when longer). The SIGTERM that follows stops the
+// listeners and exits once the requests left are done or, counting from
+// the preStop hook, TerminationGrace (default 30s, set it to the pod's
+// terminationGracePeriodSeconds) less a few seconds has passed.
+type KubernetesConfig struct {
+	ReadyOnUpstreams bool     `json:"ready_on_upstreams,omitempty"`
+	DrainDelay       Duration `json:"drain_delay,omitempty"`
+	TerminationGrace Duration `json:"termination_grace,omitempty"`
+}
+
+func (c *KubernetesConfig) validate() error {
+	if c.DrainDelay < 0 || c.TerminationGrace < 0 {
+		return fmt.Errorf("kubernetes: drain_delay and termination_grace must not be negative")
+	}
+	if c.TerminationGrace > 0 && c.DrainDelay >= c.TerminationGrace {
+		return fmt.Errorf("kubernetes: drain_delay must be shorter than termination_grace")
+	}
+	return nil
+}
+
+// grace is the time from the preStop hook, or SIGTERM without one, to
+// exiting, short of the pod's grace period so the exit is clean.
+func (c *KubernetesConfig) grace() time.Duration {
+	g := cmp.Or(time.Duration(c.TerminationGrace), 30*time.Second)
+	return g - min(g/10, 5*time.Second)
+}
+
+// longestStream is the longest a response may take, or 0 when unbounded.
+func (c *Config) longestStream() time.Duration {
+	t := time.Duration(c.Transport.Timeout)
+	if t == 0 {
+		return 0
+	}
+	return max(t, cmp.Or(time.Duration(c.Realtime.MaxDuration), 30*time.Minute))
+}
+
+// upstreamHealthy reports whether any upstream requests go to by default,
+// the pool's members or else the target, can serve them.
+func (p *proxy) upstreamHealthy() bool {
+	var targets []string
+	for _, u := range p.pool.list() {
+		if u.weight() > 0 {
+			targets = append(targets, u.URL)
+		}
+	}
+	if len(targets) == 0 {
+		targets = []string{p.cfg.Target}
+	}
+	seen := map[string]UpstreamStatus{}
+	for _, s := range p.upstreams.snapshot() {
+		seen[s.Target] = s
+	}
+	now := time.Now()
+	for _, t := range targets {
+		if p.pool.circuits.isOpen(t, now) {
+			continue
+		}
+		s, ok := seen[upstreamOf(t)]
+		failed := ok && s.LastErrorAt != nil && s.LastErrorAt.Equal(s.LastAt) && now.Sub(s.LastAt) < time.Minute
+		if !failed {
+			return true
+		}
+	}
+	return false
+}
+
+// preStop drains the proxy ahead of its SIGTERM; see KubernetesConfig.
+func (p *proxy) preStop(srvs *servers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kc := &p.cfg.Kubernetes
+		deadline := srvs.stopping(kc.grace())
+		p.mode.set(modeDrain)
+		delay := cmp.Or(time.Duration(kc.DrainDelay), 5*time.Second)
+		infof("Draining for the pod's termination: %d requests in flight", p.mode.inFlight.Load())
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		if longest := p.cfg.longestStream(); longest > 0 && time.Now().Add(longest).Before(deadline) {
+			deadline = time.Now().Add(longest)
+		}
+		for p.mode.inFlight.Load() > 0 && time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		if n := p.mode.inFlight.Load(); n > 0 {
+			log.Printf("Stopping with %d requests in flight", n)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("drained"))
+	}
+}
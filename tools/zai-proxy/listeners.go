@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListenerConfig is a listener of its own, besides listen and
+// admin.listen, with its own TLS, auth and middleware. Serve is what it
+// serves: "proxy" (the routes and client endpoints, as listen does),
+// "admin" (the admin API, which then leaves listen as it does for
+// admin.listen), "health" (/health, /ready, /prestop and /metrics only) or
+// "debug" (the Go runtime's profiles under /debug/pprof/). Set listen to
+// "" to serve only on these.
+//
+// With TLS.Cert and TLS.Key the listener speaks TLS, and with
+// TLS.ClientCA it admits only clients with certificates that CA issued.
+// Allow admits only peers in the listed addresses or prefixes, as
+// connected, not as forwarded. Token is a bearer token every request must
+// carry; proxy and admin listeners authenticate their requests themselves,
+// so can't have one. Headers are response header rules, without
+// expressions, and AccessLog logs every request served. Certificates are
+// read at startup, and again on a restart.
+type ListenerConfig struct {
+	Name      string       `json:"name"`
+	Listen    string       `json:"listen"`
+	Serve     string       `json:"serve"`
+	TLS       ListenerTLS  `json:"tls,omitempty"`
+	Allow     []string     `json:"allow,omitempty"`
+	Token     string       `json:"token,omitempty"`
+	Headers   []HeaderRule `json:"headers,omitempty"`
+	AccessLog bool         `json:"access_log,omitempty"`
+}
+
+// ListenerTLS names a listener's certificate and key files, and the CA
+// file its clients' certificates must chain to, if any.
+type ListenerTLS struct {
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ClientCA string `json:"client_ca,omitempty"`
+}
+
+func (c *ListenerConfig) validate() error {
+	if c.Name == "" || c.Listen == "" {
+		return fmt.Errorf("listeners: every listener needs a name and a listen address")
+	}
+	switch c.Serve {
+	case "proxy", "admin":
+		if c.Token != "" {
+			return fmt.Errorf("listener %s: a %s listener can't have a token", c.Name, c.Serve)
+		}
+	case "health", "debug":
+	default:
+		return fmt.Errorf("listener %s: unknown serve %q (want proxy, admin, health or debug)", c.Name, c.Serve)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("listener %s: tls needs both a cert and a key", c.Name)
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return fmt.Errorf("listener %s: tls: client_ca needs a cert and a key", c.Name)
+	}
+	if _, err := parsePrefixes(c.Allow); err != nil {
+		return fmt.Errorf("listener %s: allow: %w", c.Name, err)
+	}
+	rules := HeaderRules{Response: c.Headers}
+	if err := rules.compile(); err != nil {
+		return fmt.Errorf("listener %s: headers: %w", c.Name, err)
+	}
+	for _, r := range c.Headers {
+		if r.Expr.Expr != nil {
+			return fmt.Errorf("listener %s: headers: %s: expressions are not available", c.Name, r.Name)
+		}
+	}
+	return nil
+}
+
+func validateListeners(list []ListenerConfig) error {
+	seen := map[string]bool{}
+	for i := range list {
+		l := &list[i]
+		if err := l.validate(); err != nil {
+			return err
+		}
+		if seen[l.Name] {
+			return fmt.Errorf("listeners: duplicate name %q", l.Name)
+		}
+		seen[l.Name] = true
+	}
+	return nil
+}
+
+// serves reports whether any listener serves what.
+func (c *Config) serves(what string) bool {
+	for _, l := range c.Listeners {
+		if l.Serve == what {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the listener's TLS config, or nil without TLS.
+func (c *ListenerConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLS.Cert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}, MinVersion: tls.VersionTLS12}
+	if c.TLS.ClientCA != "" {
+		pem, err := os.ReadFile(c.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no certificates", c.TLS.ClientCA)
+		}
+		tc.ClientCAs, tc.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// handler wraps h in the listener's auth and middleware.
+func (c *ListenerConfig) handler(h http.Handler) http.Handler {
+	if c.AccessLog {
+		next, name := h, c.Name
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			aw := &accessWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(aw, r)
+			log.Printf("%s: %s %s %s %d %s", name, r.RemoteAddr, r.Method, r.URL.Path, aw.status, time.Since(start).Round(time.Microsecond))
+		})
+	}
+	if len(c.Headers) > 0 {
+		next, rules := h, c.Headers
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&headerWriter{ResponseWriter: w, rules: rules, env: func() map[string]any { return nil }}, r)
+		})
+	}
+	if c.Token != "" {
+		next, want := h, []byte("Bearer "+c.Token)
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	if len(c.Allow) > 0 {
+		next, allow := h, mustPrefixes(c.Allow)
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !peerAllowed(r.RemoteAddr, allow) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h
+}
+
+func mustPrefixes(list []string) []netip.Prefix {
+	out, _ := parsePrefixes(list)
+	return out
+}
+
+// peerAllowed reports whether the connected peer is in allow. Peers on
+// unix sockets have no address and are always allowed.
+func peerAllowed(remote string, allow []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return !strings.Contains(remote, ":")
+	}
+	for _, p := range allow {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessWriter notes the status a response was sent with.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if !w.wrote && code >= 200 {
+		w.wrote, w.status = true, code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// debugMux serves the runtime's profiles.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serveListeners opens and serves the configured listeners, each on the
+// handler its serve names.
+func serveListeners(srvs *servers, list []ListenerConfig, handlers map[string]http.Handler) {
+	for i := range list {
+		lc := &list[i]
+		tc, err := lc.tlsConfig()
+		if err != nil {
+			log.Fatalf("Error loading TLS for listener %s: %v", lc.Name, err)
+		}
+		ln, err := srvs.listen("listener:"+lc.Name, lc.Listen)
+		if err != nil {
+			log.Fatalf("Error opening listener %s: %v", lc.Name, err)
+		}
+		scheme := "http"
+		if tc != nil {
+			ln, scheme = tls.NewListener(ln, tc), "https"
+		}
+		infof("Listener %s serving %s on %s://%s", lc.Name, lc.Serve, scheme, lc.Listen)
+		srvs.serve(ln, lc.handler(handlers[lc.Serve]))
+	}
+}
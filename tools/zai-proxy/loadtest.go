@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadResult is the outcome of one load test request.
+type loadResult struct {
+	stream  bool
+	status  int
+	err     string
+	latency time.Duration
+	ttft    time.Duration // time to the first generated text, 0 if none
+	tokens  int64
+}
+
+// LoadReport summarizes a load test run.
+type LoadReport struct {
+	Requests    int              `json:"requests"`
+	Streaming   int              `json:"streaming"`
+	Duration    Duration         `json:"duration"`
+	Throughput  float64          `json:"requests_per_second"`
+	TokenRate   float64          `json:"output_tokens_per_second"`
+	ErrorRate   float64          `json:"error_rate"`
+	Errors      map[string]int   `json:"errors,omitempty"`
+	Latency     LoadPercentiles  `json:"latency"`
+	FirstToken  *LoadPercentiles `json:"ttft,omitempty"`
+	OutputTotal int64            `json:"output_tokens"`
+}
+
+// LoadPercentiles are the distribution of one timing.
+type LoadPercentiles struct {
+	P50 Duration `json:"p50"`
+	P90 Duration `json:"p90"`
+	P99 Duration `json:"p99"`
+	Max Duration `json:"max"`
+}
+
+func percentilesOf(ds []time.Duration) LoadPercentiles {
+	if len(ds) == 0 {
+		return LoadPercentiles{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) Duration {
+		i := int(p*float64(len(ds))+0.999999) - 1
+		return Duration(ds[max(min(i, len(ds)-1), 0)])
+	}
+	return LoadPercentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: Duration(ds[len(ds)-1])}
+}
+
+// runLoadtest implements the loadtest subcommand: it sends -n requests, or
+// as many as fit in -duration, from -c workers and reports the timings.
+func runLoadtest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	base := fs.String("url", envOr("ZAI_PROXY_URL", "http://localhost:8080"), "proxy or upstream base URL")
+	path := fs.String("path", "/v1/chat/completions", "endpoint; paths ending in /messages get Anthropic-style bodies")
+	key := fs.String("key", os.Getenv("ZAI_API_KEY"), "bearer token sent with each request")
+	model := fs.String("model", "glm-4.6", "model requested")
+	prompt := fs.String("prompt", "Write a haiku about load testing.", "user message sent")
+	maxTokens := fs.Int("max-tokens", 128, "max_tokens requested")
+	n := fs.Int("n", 100, "requests to send")
+	duration := fs.Duration("duration", 0, "run for this long instead of -n requests")
+	concurrency := fs.Int("c", 4, "concurrent workers")
+	stream := fs.Float64("stream", 0, "fraction of requests that stream, 0 to 1")
+	timeout := fs.Duration("timeout", 5*time.Minute, "per-request timeout")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *concurrency < 1 || *stream < 0 || *stream > 1 {
+		return fmt.Errorf("loadtest: -c must be positive and -stream between 0 and 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	lt := &loadTester{
+		url: strings.TrimSuffix(*base, "/") + *path, key: *key, client: &http.Client{Timeout: *timeout},
+		anthropic: strings.HasSuffix(*path, "/messages"), model: *model, prompt: *prompt, maxTokens: *maxTokens,
+	}
+
+	jobs := make(chan bool)
+	results := make(chan loadResult)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				results <- lt.do(ctx, s)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := 0; *duration > 0 || i < *n; i++ {
+			select {
+			case jobs <- rand.Float64() < *stream:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var all []loadResult
+	for r := range results {
+		// Requests cut short by -duration or an interrupt aren't results.
+		if r.err == context.DeadlineExceeded.Error() || r.err == context.Canceled.Error() {
+			continue
+		}
+		all = append(all, r)
+	}
+	rep := loadReportOf(all, time.Since(start))
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	printLoadReport(os.Stdout, rep)
+	return nil
+}
+
+type loadTester struct {
+	url, key      string
+	client        *http.Client
+	anthropic     bool
+	model, prompt string
+	maxTokens     int
+}
+
+func (lt *loadTester) do(ctx context.Context, stream bool) loadResult {
+	res := loadResult{stream: stream}
+	body, _ := json.Marshal(map[string]any{
+		"model": lt.model, "stream": stream, "max_tokens": lt.maxTokens,
+		"messages": []any{map[string]any{"role": "user", "content": lt.prompt}},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lt.url, bytes.NewReader(body))
+	if err != nil {
+		res.err = err.Error()
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if lt.key != "" {
+		req.Header.Set("Authorization", "Bearer "+lt.key)
+	}
+	if lt.anthropic {
+		req.Header.Set("anthropic-version", "2023-06-01")
+	}
+	start := time.Now()
+	resp, err := lt.client.Do(req)
+	if err != nil {
+		res.err, res.latency = loadError(ctx, err), time.Since(start)
+		return res
+	}
+	defer resp.Body.Close()
+	res.status = resp.StatusCode
+	obs := newUsageObserver(resp.Header.Get("Content-Type"))
+	r := io.TeeReader(resp.Body, obs)
+	if stream {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for sc.Scan() {
+			data, ok := bytes.CutPrefix(sc.Bytes(), []byte("data:"))
+			if ok && res.ttft == 0 && hasGeneratedText(bytes.TrimSpace(data)) {
+				res.ttft = time.Since(start)
+			}
+		}
+		err = sc.Err()
+	} else {
+		_, err = io.Copy(io.Discard, r)
+	}
+	res.latency = time.Since(start)
+	if err != nil {
+		res.err = loadError(ctx, err)
+	}
+	_, u, _ := obs.Finish()
+	res.tokens = u.CompletionTokens
+	return res
+}
+
+func loadError(ctx context.Context, err error) string {
+	if ctx.Err() != nil {
+		return ctx.Err().Error()
+	}
+	return err.Error()
+}
+
+// hasGeneratedText reports whether a streamed event carries output text,
+// in OpenAI or Anthropic form.
+func hasGeneratedText(data []byte) bool {
+	var ev struct {
+		Type    string `json:"type"`
+		Choices []struct {
+			Delta struct {
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(data, &ev) != nil {
+		return false
+	}
+	if ev.Type == "content_block_delta" {
+		return true
+	}
+	return len(ev.Choices) > 0 && (ev.Choices[0].Delta.Content != "" || ev.Choices[0].Delta.ReasoningContent != "")
+}
+
+func loadReportOf(results []loadResult, elapsed time.Duration) LoadReport {
+	rep := LoadReport{Requests: len(results), Duration: Duration(elapsed), Errors: map[string]int{}}
+	var latencies, ttfts []time.Duration
+	failed := 0
+	for _, r := range results {
+		if r.stream {
+			rep.Streaming++
+		}
+		switch {
+		case r.err != "":
+			rep.Errors[r.err]++
+		case r.status >= 400:
+			rep.Errors[fmt.Sprintf("HTTP %d", r.status)]++
+		default:
+			latencies = append(latencies, r.latency)
+			if r.ttft > 0 {
+				ttfts = append(ttfts, r.ttft)
+			}
+			rep.OutputTotal += r.tokens
+			continue
+		}
+		failed++
+	}
+	if len(results) > 0 {
+		rep.ErrorRate = float64(failed) / float64(len(results))
+	}
+	if s := elapsed.Seconds(); s > 0 {
+		rep.Throughput = float64(len(results)) / s
+		rep.TokenRate = float64(rep.OutputTotal) / s
+	}
+	rep.Latency = percentilesOf(latencies)
+	if len(ttfts) > 0 {
+		p := percentilesOf(ttfts)
+		rep.FirstToken = &p
+	}
+	return rep
+}
+
+func printLoadReport(w io.Writer, rep LoadReport) {
+	fmt.Fprintf(w, "%d requests (%d streaming) in %s: %.1f req/s, %.1f output tokens/s, %.1f%% errors\n\n",
+		rep.Requests, rep.Streaming, time.Duration(rep.Duration).Round(time.Millisecond),
+		rep.Throughput, rep.TokenRate, rep.ErrorRate*100)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tP50\tP90\tP99\tMAX")
+	row := func(name string, p LoadPercentiles) {
+		r := func(d Duration) time.Duration { return time.Duration(d).Round(time.Millisecond) }
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, r(p.P50), r(p.P90), r(p.P99), r(p.Max))
+	}
+	row("latency", rep.Latency)
+	if rep.FirstToken != nil {
+		row("ttft", *rep.FirstToken)
+	}
+	tw.Flush()
+	if len(rep.Errors) > 0 {
+		fmt.Fprintln(w, "\nerrors:")
+		keys := make([]string, 0, len(rep.Errors))
+		for k := range rep.Errors {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %6d  %s\n", rep.Errors[k], k)
+		}
+	}
+}
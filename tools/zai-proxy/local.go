@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// LocalConfig makes an upstream a self-hosted inference server, Server
+// being "ollama", "vllm" or "llamacpp" (llama.cpp's llama-server), each
+// serving OpenAI's API under /v1. Requests are eased into what they take:
+// the model is the one Models maps theirs to, the "*" entry for models it
+// doesn't list, else the one named; developer messages go as system ones,
+// max_completion_tokens as max_tokens, and fields only OpenAI serves are
+// dropped. llama.cpp is sent content lists of text as a string. Ollama's
+// replies calling tools, which finish with "stop", finish with
+// "tool_calls". Without its own auth the upstream is sent no key; a
+// server started with --api-key takes auth of scheme bearer and a key_env.
+type LocalConfig struct {
+	Server string            `json:"server"`
+	Models map[string]string `json:"models,omitempty"`
+}
+
+// localAuth is a local upstream's auth when it configures none.
+var localAuth = UpstreamAuth{Scheme: "none"}
+
+// openAIOnly are request fields local servers reject or misread.
+var openAIOnly = []string{"store", "metadata", "service_tier", "prediction", "modalities", "audio", "web_search_options"}
+
+func (c *LocalConfig) validate() error {
+	switch c.Server {
+	case "ollama", "vllm", "llamacpp":
+	default:
+		return fmt.Errorf("unknown server %q (want ollama, vllm or llamacpp)", c.Server)
+	}
+	for model, m := range c.Models {
+		if m == "" {
+			return fmt.Errorf("models: %s: no model named", model)
+		}
+	}
+	return nil
+}
+
+// model is the server's name for model.
+func (c *LocalConfig) model(model string) string {
+	if m, ok := c.Models[model]; ok {
+		return m
+	}
+	if m, ok := c.Models["*"]; ok {
+		return m
+	}
+	return model
+}
+
+// rewrite eases the JSON body of req, a chat completion, completion or
+// embeddings request for model, into the server's form.
+func (c *LocalConfig) rewrite(req *http.Request, model string) error {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	chat := strings.HasSuffix(req.URL.Path, "/chat/completions")
+	if !chat && !strings.HasSuffix(req.URL.Path, "/completions") && !strings.HasSuffix(req.URL.Path, "/embeddings") {
+		return nil
+	}
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	v, err := decodeJSON(body)
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		// Let the server answer for it.
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+	if model != "" {
+		doc["model"] = c.model(model)
+	}
+	if n, ok := doc["max_completion_tokens"]; ok {
+		if _, has := doc["max_tokens"]; !has {
+			doc["max_tokens"] = n
+		}
+		delete(doc, "max_completion_tokens")
+	}
+	for _, k := range openAIOnly {
+		delete(doc, k)
+	}
+	msgs, _ := doc["messages"].([]any)
+	for _, m := range msgs {
+		msg, _ := m.(map[string]any)
+		if msg["role"] == "developer" {
+			msg["role"] = "system"
+		}
+		if c.Server == "llamacpp" {
+			if text, ok := textContent(msg["content"]); ok {
+				msg["content"] = text
+			}
+		}
+	}
+	if chat && c.Server == "ollama" {
+		if stream, _ := doc["stream"].(bool); !stream {
+			// localResponse reads the reply; ask only for what the transport decodes.
+			req.Header.Del("Accept-Encoding")
+		}
+	}
+	b, err := encodeJSON(doc)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
+	req.ContentLength = int64(len(b))
+	req.Header.Del("Content-Length")
+	return nil
+}
+
+// textContent joins a content list of text parts, reporting false for a
+// list with any other kind of part.
+func textContent(content any) (string, bool) {
+	parts, ok := content.([]any)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for _, e := range parts {
+		part, _ := e.(map[string]any)
+		s, isText := part["text"].(string)
+		if part["type"] != "text" || !isText {
+			return "", false
+		}
+		b.WriteString(s)
+	}
+	return b.String(), true
+}
+
+// ollamaChat reports whether req is a chat completion sent to an Ollama
+// upstream, whose reply localResponse corrects.
+func (p *proxy) ollamaChat(req *http.Request) bool {
+	if !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return false
+	}
+	_, ok := p.pool.memberFor(req.URL.String(), func(u *UpstreamConfig) bool { return u.Local != nil && u.Local.Server == "ollama" })
+	return ok
+}
+
+// localResponse corrects the finish reason of an Ollama chat completion
+// that calls tools.
+func localResponse(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	v, err := decodeJSON(b)
+	doc, _ := v.(map[string]any)
+	choices, _ := doc["choices"].([]any)
+	if err != nil {
+		return resp, nil
+	}
+	fixed := false
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		msg, _ := choice["message"].(map[string]any)
+		if calls, _ := msg["tool_calls"].([]any); len(calls) > 0 && choice["finish_reason"] == "stop" {
+			choice["finish_reason"], fixed = "tool_calls", true
+		}
+	}
+	if !fixed {
+		return resp, nil
+	}
+	if b, err = encodeJSON(doc); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(b)))
+	return resp, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel filters the proxy's informational and debug logging; errors are
+// always logged. It can be changed at runtime through the admin API.
+var logLevel slog.LevelVar
+
+func infof(format string, args ...any) {
+	if logLevel.Level() <= slog.LevelInfo {
+		log.Printf(format, args...)
+	}
+}
+
+func debugf(format string, args ...any) {
+	if logLevel.Level() <= slog.LevelDebug {
+		log.Printf(format, args...)
+	}
+}
+
+// LogConfig sets the log level ("debug", "info", "warn" or "error") and
+// any debug capture rules active from startup. Echo lets clients ask for
+// the upstream request with the X-Ringmaster-Echo header. Requests keeps
+// recent requests' metadata for the logs subcommand.
+type LogConfig struct {
+	Level    string           `json:"level,omitempty"`
+	Debug    []DebugRule      `json:"debug,omitempty"`
+	Echo     bool             `json:"echo,omitempty"`
+	Requests RequestLogConfig `json:"requests,omitempty"`
+}
+
+func (c *LogConfig) validate() error {
+	if c.Level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(c.Level)); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Debug {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	return c.Requests.validate()
+}
+
+// DebugRule captures full requests and responses from Client and/or on
+// Route (a route pattern) while it lasts. Sample is the fraction of
+// matching requests kept, default all; a zero Expires never expires.
+type DebugRule struct {
+	Client  string    `json:"client,omitempty"`
+	Route   string    `json:"route,omitempty"`
+	Sample  float64   `json:"sample,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (r *DebugRule) validate() error {
+	if r.Client == "" && r.Route == "" {
+		return fmt.Errorf("debug rules need a client or a route")
+	}
+	if r.Sample < 0 || r.Sample > 1 {
+		return fmt.Errorf("debug sample must be between 0 and 1")
+	}
+	return nil
+}
+
+func (r *DebugRule) matches(ex *exchange, now time.Time) bool {
+	if !r.Expires.IsZero() && now.After(r.Expires) {
+		return false
+	}
+	if r.Client != "" && r.Client != ex.client || r.Route != "" && r.Route != ex.route.Pattern {
+		return false
+	}
+	return r.Sample == 0 || rand.Float64() < r.Sample
+}
+
+const (
+	debugCapturesKept = 50
+	debugBodyLimit    = 64 << 10
+)
+
+// DebugCapture is one request and its response, with credentials redacted.
+type DebugCapture struct {
+	Time            time.Time   `json:"time"`
+	ID              string      `json:"id"`
+	Route           string      `json:"route"`
+	Client          string      `json:"client"`
+	Method          string      `json:"method"`
+	Path            string      `json:"path"`
+	Upstream        string      `json:"upstream,omitempty"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    string      `json:"response_body,omitempty"`
+	Truncated       bool        `json:"truncated,omitempty"`
+	Duration        Duration    `json:"duration"`
+}
+
+// debugCapture holds the active rules and the recent captures.
+type debugCapture struct {
+	mu       sync.RWMutex
+	rules    []DebugRule
+	captures ring[DebugCapture]
+}
+
+func (d *debugCapture) setRules(rules []DebugRule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = rules
+}
+
+// active returns the rules that have not expired.
+func (d *debugCapture) active() []DebugRule {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now()
+	out := []DebugRule{}
+	for _, r := range d.rules {
+		if r.Expires.IsZero() || now.Before(r.Expires) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (d *debugCapture) wants(ex *exchange) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now()
+	for i := range d.rules {
+		if d.rules[i].matches(ex, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugStage captures exchanges matching a debug rule. It sits after auth
+// so rules can name clients; the request body is the one sent upstream.
+func debugStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if !p.debug.wants(ex) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ex.inspect = true
+			tw := &bodySink{limit: debugBodyLimit}
+			reqHeaders := redactHeaders(r.Header)
+			start := time.Now()
+			next.ServeHTTP(teeTo(w, tw), r)
+			c := DebugCapture{
+				Time: start.UTC(), ID: ex.id, Route: ex.route.Pattern, Client: ex.client,
+				Method: r.Method, Path: r.URL.Path, RequestHeaders: reqHeaders,
+				RequestBody: redactBody(ex.body), Status: tw.status,
+				ResponseHeaders: redactHeaders(w.Header()), ResponseBody: redactBody(tw.body),
+				Truncated: tw.truncated, Duration: Duration(time.Since(start)),
+			}
+			if ex.target != "" {
+				c.Upstream = upstreamOf(ex.target)
+			}
+			if c.Status == 0 {
+				c.Status = http.StatusOK
+			}
+			p.debug.captures.add(c)
+			if b, err := json.Marshal(c); err == nil {
+				log.Printf("Debug capture: %s", b)
+			}
+		})
+	}, nil
+}
+
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "Api-Key", "X-Amz-Security-Token", "Cookie", "Set-Cookie"}
+
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, k := range secretHeaders {
+		if len(out.Values(k)) > 0 {
+			out.Set(k, secretMask)
+		}
+	}
+	return out
+}
+
+var secretFields = regexp.MustCompile(`(?i)("(?:api[_-]?key|password|secret|token|access[_-]?token)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactBody masks the values of JSON fields that look like credentials.
+func redactBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return secretFields.ReplaceAllString(strings.ToValidUTF8(string(b), "�"), `$1"`+secretMask+`"`)
+}
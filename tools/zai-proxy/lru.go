@@ -0,0 +1,123 @@
+package main
+
+import "container/list"
+
+var (
+	cacheEvictions = metrics.counter("zai_proxy_cache_evictions_total",
+		"Entries evicted from bounded in-memory stores to stay within their limits.", "store")
+	cacheEntries = metrics.gauge("zai_proxy_cache_entries", "Entries held in bounded in-memory stores.", "store")
+	cacheBytes   = metrics.gauge("zai_proxy_cache_bytes", "Bytes held in bounded in-memory stores, as estimated.", "store")
+)
+
+// lru is a map bounded by its number of entries and their total size,
+// evicting the least recently used beyond either; a zero limit is none.
+// Sizes are estimates from size. Callers serialize access.
+type lru[K comparable, V any] struct {
+	name       string // the store, for metrics
+	maxEntries int
+	maxBytes   int64
+	size       func(K, V) int64
+
+	order *list.List // of *lruEntry, most recently used first
+	byKey map[K]*list.Element
+	bytes int64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key  K
+	val  V
+	size int64
+}
+
+func newLRU[K comparable, V any](name string, maxEntries int, maxBytes int64, size func(K, V) int64) *lru[K, V] {
+	return &lru[K, V]{name: name, maxEntries: maxEntries, maxBytes: maxBytes, size: size,
+		order: list.New(), byKey: map[K]*list.Element{}}
+}
+
+// get returns the value under k, marking it used.
+func (c *lru[K, V]) get(k K) (V, bool) {
+	e, ok := c.byKey[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).val, true
+}
+
+// put sets the value under k, evicting what no longer fits. A value larger
+// than the whole store is not kept.
+func (c *lru[K, V]) put(k K, v V) {
+	n := c.size(k, v)
+	if e, ok := c.byKey[k]; ok {
+		c.order.MoveToFront(e)
+		ent := e.Value.(*lruEntry[K, V])
+		c.bytes += n - ent.size
+		ent.val, ent.size = v, n
+	} else {
+		c.byKey[k] = c.order.PushFront(&lruEntry[K, V]{key: k, val: v, size: n})
+		c.bytes += n
+	}
+	c.evict()
+}
+
+// resize records that the value under k has grown, or shrunk, to its size
+// now, evicting what no longer fits.
+func (c *lru[K, V]) resize(k K) {
+	e, ok := c.byKey[k]
+	if !ok {
+		return
+	}
+	ent := e.Value.(*lruEntry[K, V])
+	n := c.size(k, ent.val)
+	c.bytes += n - ent.size
+	ent.size = n
+	c.evict()
+}
+
+// remove drops k, reporting whether it was there.
+func (c *lru[K, V]) remove(k K) bool {
+	e, ok := c.byKey[k]
+	if !ok {
+		return false
+	}
+	c.drop(e)
+	c.gauges()
+	return true
+}
+
+// removeIf drops the entries drop picks and returns how many it did.
+func (c *lru[K, V]) removeIf(drop func(K, V) bool) int64 {
+	var n int64
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if ent := e.Value.(*lruEntry[K, V]); drop(ent.key, ent.val) {
+			c.drop(e)
+			n++
+		}
+		e = next
+	}
+	c.gauges()
+	return n
+}
+
+func (c *lru[K, V]) len() int { return c.order.Len() }
+
+func (c *lru[K, V]) drop(e *list.Element) {
+	ent := c.order.Remove(e).(*lruEntry[K, V])
+	delete(c.byKey, ent.key)
+	c.bytes -= ent.size
+}
+
+func (c *lru[K, V]) evict() {
+	for c.order.Len() > 0 && (c.maxEntries > 0 && c.order.Len() > c.maxEntries || c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.drop(c.order.Back())
+		cacheEvictions.Add(1, c.name)
+	}
+	c.gauges()
+}
+
+func (c *lru[K, V]) gauges() {
+	cacheEntries.Set(float64(c.order.Len()), c.name)
+	cacheBytes.Set(float64(c.bytes), c.name)
+}
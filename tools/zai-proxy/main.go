@@ -1,106 +1,387 @@
 package main
 
 import (
-	"io"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
+// usageWindow is how long hourly usage buckets are retained in memory; it
+// covers a calendar month so monthly quotas work without storage.
+const usageWindow = 31 * 24 * time.Hour
+
+// newRequestID returns a random identifier for one proxied request.
+func newRequestID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "export":
+		err = runExport(args)
+	case "keys":
+		err = runKeys(args)
+	case "audit":
+		err = runAudit(args)
+	case "loadtest":
+		err = runLoadtest(args)
+	case "bench":
+		err = runBench(args)
+	case "logs":
+		err = runLogs(args)
+	case "replay":
+		err = runReplay(args)
+	case "config":
+		err = runConfig(args)
+	case "service":
+		err = runService(args)
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [serve | export | keys | audit | loadtest | bench | service | logs | replay | config]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the proxy until a listener fails or another process has
+// taken over.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath, values := serveFlags(fs)
+	mock := fs.Bool("mock", false, "answer every request from the built-in mock upstream")
+	fs.Parse(args)
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := values[f.Name]; ok {
+			flags[f.Name] = *v
+		}
+	})
+
 	apiKey := os.Getenv("ZAI_API_KEY")
-	if apiKey == "" {
+	if apiKey == "" && !*mock {
 		log.Fatal("ZAI_API_KEY environment variable required")
 	}
 
-	target := "https://api.z.ai"
+	cfg, sources, err := resolveConfig(*configPath, flags)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if *mock {
+		cfg.Target, cfg.Upstreams, sources["/target"] = mockTarget, nil, "flag:-mock"
+		for i := range cfg.Routes {
+			cfg.Routes[i].Target, cfg.Routes[i].Targets = "", nil
+		}
+	}
 
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-		// Don't follow redirects automatically
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	logLevel.UnmarshalText([]byte(cmp.Or(cfg.Log.Level, "info")))
+	if g, longest := time.Duration(cfg.Kubernetes.TerminationGrace), cfg.longestStream(); g > 0 && (longest == 0 || g < longest) {
+		log.Printf("Streams may outlast kubernetes.termination_grace and be cut at shutdown")
+	}
+	if modelTokenizers, err = loadTokenizers(cfg.Tokenizers); err != nil {
+		log.Fatalf("Error loading tokenizers: %v", err)
+	}
+	if len(modelTokenizers) == 0 {
+		log.Printf("No tokenizers are configured; locally counted tokens are estimates")
 	}
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+	memory := newMemoryGuard(cfg.Memory)
+	if memory != nil {
+		go memory.run(context.Background(), time.Second)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Build upstream URL
-		upstreamURL := target + r.URL.Path
-		if r.URL.RawQuery != "" {
-			upstreamURL += "?" + r.URL.RawQuery
-		}
+	usage := NewUsageTracker(usageWindow)
+
+	var usageSrc usageSource = usage
+	var consumption clientUsage = usage
+	store, err := openStore(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+	if store != nil {
+		defer store.Close()
+		usageSrc, consumption = store, store
+	}
+	registry := newClientRegistry(cfg, store)
+	redis := newRedisClient(cfg.Redis)
+	var sharedUsage *redisUsage
+	if cfg.Redis.Quotas {
+		sharedUsage = &redisUsage{c: redis, local: consumption}
+		consumption = sharedUsage
+	}
+	quotas := &quotaChecker{reg: registry, store: store, usage: consumption}
+
+	transport := newUpstreamTransport(cfg.Transport)
+	transport.RegisterProtocol("mock", mockTransport{profiles: cfg.Mocks})
+	transport.RegisterProtocol("replay", &replayTransport{dir: cfg.Recording.Dir, instant: cfg.Recording.Instant})
+	var upstreamTransport http.RoundTripper = transport
+	if cfg.Recording.Record {
+		upstreamTransport = &recordingTransport{base: transport, dir: cfg.Recording.Dir}
+	}
 
-		// Create upstream request
-		upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, r.Body)
+	var sched Scheduler
+	for _, rc := range cfg.Reports {
+		job, err := reportJob(rc, usageSrc, &http.Client{Timeout: 30 * time.Second})
 		if err != nil {
-			log.Printf("Error creating request: %v", err)
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
+			log.Fatalf("Error configuring reports: %v", err)
 		}
+		sched.Add(job)
+	}
 
-		// Copy headers from original request
-		for key, values := range r.Header {
-			for _, value := range values {
-				upstreamReq.Header.Add(key, value)
-			}
-		}
+	var billing *billingEmitter
+	if cfg.Billing.Webhook != "" {
+		billing = newBillingEmitter(cfg.Billing)
+		go billing.Run(context.Background())
+	}
 
-		// Override with correct host and auth
-		upstreamReq.Header.Set("Host", "api.z.ai")
-		upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	plugins, err := loadPlugins(context.Background(), cfg.Plugins)
+	if err != nil {
+		log.Fatalf("Error loading plugins: %v", err)
+	}
 
-		// Make the request
-		resp, err := client.Do(upstreamReq)
+	var filters []contentFilter
+	for _, fc := range cfg.Filters {
+		f, err := newContentFilter(fc)
 		if err != nil {
-			log.Printf("Error forwarding request: %v", err)
-			http.Error(w, "Upstream error", http.StatusBadGateway)
-			return
+			log.Fatalf("Error configuring filters: %v", err)
 		}
-		defer resp.Body.Close()
+		filters = append(filters, f)
+	}
 
-		// Copy response headers
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
+	requests, err := openRequestLog(cfg.Log.Requests)
+	if err != nil {
+		log.Fatalf("Error opening request log: %v", err)
+	}
+
+	j := &journal{path: cfg.Admin.Journal}
+	pool := newUpstreamPool(cfg.Upstreams, j)
+	pool.circuits = newCircuits(&cfg.Circuit)
+	pool.health = newUpstreamHealth(&cfg.Health)
+	features := newFeatureFlags(cfg.Flags, j)
+	templates := newPromptTemplates(cfg.Templates, j)
+	if err := j.replay(func(e journalEntry) {
+		pool.apply(e)
+		features.apply(e)
+		templates.apply(e)
+	}); err != nil {
+		log.Fatalf("Error replaying admin journal: %v", err)
+	}
 
-		// Set status code
-		w.WriteHeader(resp.StatusCode)
-
-		// Stream the response body
-		// Use small buffer for streaming SSE responses
-		buf := make([]byte, 1024)
-		flusher, canFlush := w.(http.Flusher)
-
-		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				_, writeErr := w.Write(buf[:n])
-				if writeErr != nil {
-					log.Printf("Error writing response: %v", writeErr)
-					return
-				}
-				if canFlush {
-					flusher.Flush()
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Printf("Error reading response: %v", err)
-				return
-			}
+	p := &proxy{
+		cfg:         cfg,
+		apiKey:      apiKey,
+		usage:       usage,
+		store:       store,
+		registry:    registry,
+		quotas:      quotas,
+		billing:     billing,
+		plugins:     plugins,
+		filters:     filters,
+		pool:        pool,
+		flags:       features,
+		templates:   templates,
+		errors:      ring[RecentError]{n: recentErrorsKept},
+		requests:    requests,
+		memory:      memory,
+		experiments: newExperiments(cfg.Experiments),
+		sharedUsage: sharedUsage,
+		sessions:    openSessions(cfg.Sessions, store, redis),
+		idempotent:  openIdempotency(&cfg.Idempotency, store, redis),
+		fallbacks:   newFallbacks(&cfg.Fallback),
+		resumes:     newResumeStreams(&cfg.Resume),
+		images:      newImageFetcher(&cfg.Images),
+		agents:      newAgentTracker(&cfg.Agents),
+		keyStats:    newKeyStats(),
+		ips:         newClientIPs(&cfg.ClientIP),
+		debug:       debugCapture{rules: cfg.Log.Debug, captures: ring[DebugCapture]{n: debugCapturesKept}},
+	}
+	if cfg.Redis.RateLimits {
+		p.ips.shared, p.agents.shared = redis, redis
+	}
+	p.loadSnapshot()
+	srvs := newServers(&cfg.Restart)
+	if cfg.Snapshot.File != "" {
+		srvs.persist = p.saveSnapshot
+		go p.snapshotLoop(context.Background())
+	}
+	if p.cluster = newCluster(&cfg.Cluster, pool.circuits, &p.upstreams); p.cluster != nil {
+		if cfg.Cluster.RateLimits {
+			p.ips.shared, p.agents.shared = p.cluster, p.cluster
+		}
+		ln, err := srvs.listen("cluster", cfg.Cluster.Listen)
+		if err != nil {
+			log.Fatalf("Error opening cluster listener: %v", err)
+		}
+		peers := http.NewServeMux()
+		peers.Handle("POST "+clusterPath, p.cluster)
+		infof("Cluster listening on %s as node %s", cfg.Cluster.Listen, p.cluster.node)
+		srvs.serve(ln, peers)
+		go p.cluster.run(context.Background())
+	}
+	// Jobs on shared state run on the leader only; those on this process's
+	// own memory run everywhere.
+	elected := newLeader(&cfg.Leader, redis, p.cluster)
+	if elected != nil {
+		srvs.leaving = elected.retire
+		go elected.run(context.Background())
+	}
+	only := func(store string) func() bool {
+		if store == "memory" {
+			return nil
+		}
+		return elected.leading
+	}
+	sched.Only = elected.leading
+	if store != nil {
+		go pruneUsageLoop(context.Background(), store, time.Duration(cfg.Storage.Retention), elected.leading)
+	}
+	if cfg.Capture.Dir != "" {
+		p.capture = newCaptureSink(cfg.Capture)
+	}
+	go retentionLoop(context.Background(), keptArtifacts(cfg, p.capture))
+	if cfg.Archive.Bucket != "" {
+		if p.archive, err = newArchiveSink(cfg.Archive); err != nil {
+			log.Fatalf("Error configuring the archive: %v", err)
 		}
+		go p.archive.pruneLoop(context.Background(), elected.leading)
+	}
+	if p.files, err = openFileIndex(cfg.Files.Index); err != nil {
+		log.Fatalf("Error opening file index: %v", err)
+	}
+	if p.retrieval, err = newRetrievers(cfg.Retrieval); err != nil {
+		log.Fatalf("Error loading retrieval documents: %v", err)
+	}
+	if p.sessions != nil {
+		go pruneSessionsLoop(context.Background(), p.sessions, cfg.Sessions.ttl(), only(cfg.Sessions.Store))
+	}
+	if p.idempotent != nil {
+		go p.idempotent.pruneLoop(context.Background(), only(cfg.Idempotency.Store))
+	}
+	p.relay = p.reverseProxy(upstreamTransport)
+	if cfg.Transport.Prewarm > 0 {
+		go prewarm(context.Background(), transport, cfg.upstreamTargets(), cfg.Transport.Prewarm,
+			time.Duration(cfg.Transport.PingTimeout))
+	}
+	if cfg.Transport.PingInterval > 0 {
+		go pingIdleUpstreams(context.Background(), transport, &p.upstreams,
+			time.Duration(cfg.Transport.PingInterval), time.Duration(cfg.Transport.PingTimeout))
+	}
+	// Management endpoints share the data plane unless given their own
+	// listener.
+	mux := http.NewServeMux()
+	admin := mux
+	if cfg.Admin.Listen != "" || cfg.serves("admin") {
+		admin = http.NewServeMux()
+	}
+	if cfg.adminToken() == "" {
+		log.Printf("No admin token is set; the admin API is disabled")
+	}
+	health := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
 	})
+	p.mode.set(modeServing)
+	mux.Handle("/health", health)
+	mux.Handle("/ready", http.HandlerFunc(p.ready))
+	mux.Handle("GET /prestop", p.preStop(srvs))
+	mux.Handle("/metrics", metrics)
+	mux.Handle("GET /openapi.json", openAPIHandler())
+	mux.Handle("/usage/me", usageHandler(usageSrc, registry.Identify))
+	mux.Handle("GET /keys/{id}/stats", keyStatsHandler(p.keyStats, registry))
+	mux.Handle("POST /estimate", estimateHandler(cfg, registry, quotas))
+	mux.Handle("POST /tokenize", http.HandlerFunc(tokenizeHandler))
+	mux.Handle("POST /count_tokens", http.HandlerFunc(countTokensHandler))
+	mux.Handle("POST "+fanoutPath, fanoutHandler(cfg, mux))
+	mux.Handle("POST "+bestOfPath, bestOfHandler(cfg, mux))
+	mux.Handle("POST "+consensusPath, consensusHandler(cfg, mux))
+	mux.Handle("GET /v1/sessions/{id}", sessionHandler(p.sessions, registry.Identify))
+	mux.Handle("DELETE /v1/sessions/{id}", sessionHandler(p.sessions, registry.Identify))
+	jobs := newJobQueue(cfg.Jobs, mux)
+	jobs.priority = p.requestPriority
+	jobs.start(context.Background())
+	p.jobs = jobs
+	p.alerts = newAlerter(cfg.Alerts, p, jobs)
+	go p.alerts.run(context.Background(), elected.leading)
+	for _, pattern := range []string{"POST " + jobsPath, "GET " + jobsPath, "GET " + jobsPath + "/{id}",
+		"GET " + jobsPath + "/{id}/chunks", "DELETE " + jobsPath + "/{id}"} {
+		mux.Handle(pattern, jobsHandler(jobs, registry.Identify))
+	}
+	runner := newBatchRunner(cfg.Batches, mux)
+	runner.validation = cfg.Validation
+	batches := batchesHandler(runner, registry.Identify)
+	for _, pattern := range []string{"POST " + batchesPath, "GET " + batchesPath, "GET " + batchesPath + "/{id}",
+		"GET " + batchesPath + "/{id}/results", "DELETE " + batchesPath + "/{id}"} {
+		mux.Handle(pattern, batches)
+	}
+	pipelines := pipelinesHandler(cfg.Pipelines, mux)
+	mux.Handle("GET "+pipelinesPath, pipelines)
+	mux.Handle("POST "+pipelinesPath+"/{name}", pipelines)
+	mux.Handle("POST /v1/templates/{name}/expand", templatesHandler(templates, registry))
+	probes := http.NewServeMux()
+	probes.Handle("/health", health)
+	probes.Handle("/ready", http.HandlerFunc(p.ready))
+	probes.Handle("GET /prestop", p.preStop(srvs))
+	probes.Handle("/metrics", metrics)
+	if admin != mux {
+		admin.Handle("/", probes)
+		admin.Handle("GET /openapi.json", openAPIHandler())
+	}
+	// Evals are sent through mux like a client's requests.
+	p.evals, err = newEvalRunner(cfg.Evals, mux)
+	if err != nil {
+		log.Fatalf("Error opening eval history: %v", err)
+	}
+	p.evals.schedule(&sched)
+	p.prompts = newScheduledPrompts(cfg, mux)
+	p.prompts.schedule(&sched)
+	sched.Start(context.Background())
+	admin.Handle("/usage", requireAdmin(cfg, usageHandler(usageSrc, nil)))
+	audit := &auditLog{path: cfg.Admin.Audit, ips: p.ips}
+	history := &configHistory{cfg: cfg, journal: j, pool: pool, flags: features, templates: templates, quotas: quotas, store: store}
+	(&keysAPI{store: store, reg: registry, quotas: quotas, audit: audit, history: history}).register(admin, cfg)
+	admin.Handle("GET /admin/export", requireAdmin(cfg, exportHandler(store)))
+	(&adminAPI{cfg: cfg, file: *configPath, sources: sources, proxy: p, audit: audit, servers: srvs, history: history}).register(admin)
 
-	log.Println("Z.AI proxy listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := p.mount(mux); err != nil {
+		log.Fatalf("Error configuring routes: %v", err)
+	}
+
+	if cfg.Admin.Listen != "" {
+		ln, err := srvs.listen("admin", cfg.Admin.Listen)
+		if err != nil {
+			log.Fatalf("Error opening admin listener: %v", err)
+		}
+		infof("Admin API listening on %s", cfg.Admin.Listen)
+		srvs.serve(ln, admin)
+	}
+
+	proxied := p.errorTemplates(mux)
+	if cfg.Listen != "" {
+		ln, err := srvs.listen("proxy", cfg.Listen)
+		if err != nil {
+			log.Fatalf("Error opening listener: %v", err)
+		}
+		infof("Z.AI proxy listening on %s", cfg.Listen)
+		srvs.serve(ln, proxied)
+	}
+	serveListeners(srvs, cfg.Listeners, map[string]http.Handler{"proxy": proxied, "admin": admin, "health": probes, "debug": debugMux()})
+	srvs.started()
+	srvs.run(p.mode.inFlight.Load, cfg.Kubernetes.grace())
 }
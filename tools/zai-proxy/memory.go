@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryConfig keeps the proxy inside a memory budget. SoftLimit, in bytes,
+// is set as the Go runtime's soft memory limit, as GOMEMLIMIT would be;
+// without it a GOMEMLIMIT from the environment is used. Once memory in use
+// reaches ShedAt (default 0.9) of the limit, new proxied requests get a 503
+// until it falls back; earlier or later by their priority tier. MaxRequestBody (default 32MB) caps the request
+// bodies buffered for inspection, larger ones are refused; MaxResponseBody
+// (default 8MB) caps the response bytes any stage holds back, beyond which
+// the rest streams through unexamined.
+type MemoryConfig struct {
+	SoftLimit       int64   `json:"soft_limit,omitempty"`
+	ShedAt          float64 `json:"shed_at,omitempty"`
+	MaxRequestBody  int64   `json:"max_request_body,omitempty"`
+	MaxResponseBody int     `json:"max_response_body,omitempty"`
+}
+
+func (c *MemoryConfig) validate() error {
+	if c.SoftLimit < 0 || c.MaxRequestBody < 0 || c.MaxResponseBody < 0 {
+		return fmt.Errorf("memory: limits must not be negative")
+	}
+	if c.ShedAt < 0 || c.ShedAt > 1 {
+		return fmt.Errorf("memory: shed_at must be between 0 and 1")
+	}
+	return nil
+}
+
+// maxBufferedBody caps the request bodies the transform stage reads into
+// memory, and maxObservedBody the response bytes a stage keeps for parsing
+// or rewriting. serve sets both from MemoryConfig.
+var (
+	maxBufferedBody int64 = 32 << 20
+	maxObservedBody       = 8 << 20
+)
+
+var (
+	memoryInUse = metrics.gauge("zai_proxy_memory_bytes",
+		"Memory the Go runtime holds from the OS, less what it has released.")
+	memoryLimitBytes = metrics.gauge("zai_proxy_memory_limit_bytes",
+		"The runtime's soft memory limit, when one is set.")
+	shedTotal = metrics.counter("zai_proxy_shed_requests_total",
+		"Proxied requests refused to relieve memory pressure, by priority tier.", "priority")
+)
+
+// memoryGuard samples memory in use and reports when to shed load.
+type memoryGuard struct {
+	limit    int64
+	shedAt   float64
+	shedding atomic.Bool
+	used     atomic.Int64 // as last sampled
+}
+
+// newMemoryGuard applies the config and returns a guard, or nil when no
+// memory limit is in force.
+func newMemoryGuard(c MemoryConfig) *memoryGuard {
+	if c.MaxRequestBody > 0 {
+		maxBufferedBody = c.MaxRequestBody
+	}
+	if c.MaxResponseBody > 0 {
+		maxObservedBody = c.MaxResponseBody
+	}
+	if c.SoftLimit > 0 {
+		debug.SetMemoryLimit(c.SoftLimit)
+	}
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return nil
+	}
+	memoryLimitBytes.Set(float64(limit))
+	shedAt := c.ShedAt
+	if shedAt == 0 {
+		shedAt = 0.9
+	}
+	return &memoryGuard{limit: limit, shedAt: shedAt}
+}
+
+var memorySamples = []rtmetrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+func memoryInUseNow() int64 {
+	s := append([]rtmetrics.Sample(nil), memorySamples...)
+	rtmetrics.Read(s)
+	return int64(s[0].Value.Uint64() - s[1].Value.Uint64())
+}
+
+// run samples memory every interval until ctx is done.
+func (g *memoryGuard) run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		used := memoryInUseNow()
+		g.used.Store(used)
+		memoryInUse.Set(float64(used))
+		over := float64(used) >= g.shedAt*float64(g.limit)
+		if g.shedding.Swap(over) != over {
+			if over {
+				infof("Memory at %d of %d bytes; shedding new requests", used, g.limit)
+			} else {
+				infof("Memory back to %d of %d bytes; accepting requests", used, g.limit)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// shed answers a request of tier with 503 while memory is short for it,
+// and reports whether it did.
+func (g *memoryGuard) shed(w http.ResponseWriter, tier string, pc *PriorityConfig) bool {
+	if g == nil || float64(g.used.Load()) < pc.shedAt(tier, g.shedAt)*float64(g.limit) {
+		return false
+	}
+	shedTotal.Add(1, tier)
+	writeLimitError(w, http.StatusServiceUnavailable, "overloaded", "the proxy is low on memory; retry shortly", "memory", time.Second)
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics is the process-wide registry rendered at /metrics in the
+// Prometheus text exposition format.
+var metrics = &metricsRegistry{}
+
+type metricsRegistry struct {
+	mu   sync.Mutex
+	vecs []*metricVec
+}
+
+// metricVec is a counter or gauge family keyed by label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+}
+
+func (r *metricsRegistry) register(kind, name, help string, labels []string) *metricVec {
+	v := &metricVec{name: name, help: help, kind: kind, labels: labels, series: map[string]*metricSeries{}}
+	r.mu.Lock()
+	r.vecs = append(r.vecs, v)
+	r.mu.Unlock()
+	return v
+}
+
+func (r *metricsRegistry) counter(name, help string, labels ...string) *metricVec {
+	return r.register("counter", name, help, labels)
+}
+
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *metricVec {
+	return r.register("gauge", name, help, labels)
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s := v.series[key]
+	if s == nil {
+		s = &metricSeries{labels: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Add increments the series identified by values.
+func (v *metricVec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+// Set replaces the value of the series identified by values.
+func (v *metricVec) Set(value float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value = value
+	v.mu.Unlock()
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ServeHTTP renders every registered family.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	vecs := append([]*metricVec(nil), r.vecs...)
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, v := range vecs {
+		v.write(w)
+	}
+}
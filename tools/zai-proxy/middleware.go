@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Middleware wraps the rest of a route's chain.
+type Middleware func(next http.Handler) http.Handler
+
+// RouteConfig mounts a proxied route at a ServeMux pattern. Middleware names
+// the stages applied to it, outermost first; empty uses defaultChain.
+// Targets routes matching requests elsewhere than Target, whose provider
+// TargetProvider describes.
+type RouteConfig struct {
+	Pattern string        `json:"pattern"`
+	Target  string        `json:"target,omitempty"`
+	Targets []RouteTarget `json:"targets,omitempty"`
+	TargetProvider
+	Access     []AccessRule    `json:"access,omitempty"`
+	Middleware []string        `json:"middleware,omitempty"`
+	Transforms []TransformRule `json:"transforms,omitempty"`
+	Headers    HeaderRules     `json:"headers"`
+	// Plugins names the plugins run on this route; empty runs them all.
+	Plugins []string `json:"plugins,omitempty"`
+	// Filters names the content filters applied; empty applies them all.
+	Filters []string `json:"filters,omitempty"`
+	// StreamTransforms rewrite each server-sent event of the response.
+	StreamTransforms []TransformRule `json:"stream_transforms,omitempty"`
+	// Chaos injects faults into a share of the route's requests.
+	Chaos []ChaosFault `json:"chaos,omitempty"`
+	// Rewrite edits the path sent upstream.
+	Rewrite []PathRewrite `json:"rewrite,omitempty"`
+}
+
+// RouteTarget sends requests for which When holds to Target; the first
+// match wins.
+type RouteTarget struct {
+	When   exprField `json:"when"`
+	Target string    `json:"target"`
+	TargetProvider
+}
+
+// TargetProvider describes who serves a route target, as pool members
+// describe themselves: Provider is the name usage is recorded under
+// (default from the target's host), and Pricing what it charges, for the
+// models it lists, where that differs from the global pricing.
+type TargetProvider struct {
+	Provider string     `json:"provider,omitempty"`
+	Pricing  PriceTable `json:"pricing,omitempty"`
+}
+
+// defaultChain is the stage order used by routes that don't list their own,
+// outermost first:
+//   - compress, so every stage sees plain bodies;
+//   - filter and stream, so usage is observed before responses are
+//     rewritten and filters see the final text;
+//   - observe, so rejections are accounted too;
+//   - auth, then debug, capture and archive, so their rules can name clients;
+//   - limits, then transform, which parses the bodies later stages match or edit;
+//   - fallback, ahead of idempotency so no stage keeps its answers;
+//   - idempotency through retrieval;
+//   - context, which needs the final model and messages, then embeddings,
+//     which resizes the vectors of each chunk context sends;
+//   - json_mode and tools, whose rounds repeat only the stages after them;
+//   - plugins and route;
+//   - headers, so rewrites never change how a caller is identified;
+//   - chaos, innermost so injected faults look like the upstream's.
+var defaultChain = []string{
+	"compress",
+	"filter", "stream",
+	"observe",
+	"auth", "debug", "capture", "archive",
+	"limits", "transform",
+	"fallback",
+	"idempotency", "resume", "speech", "realtime", "files", "sticky", "session", "experiment", "autoroute", "images", "retrieval",
+	"context", "embeddings",
+	"json_mode", "tools",
+	"plugins", "route",
+	"headers",
+	"chaos",
+}
+
+// stages builds each named middleware for a route. New cross-cutting
+// features register here and are enabled per route from the config.
+var stages = map[string]func(p *proxy, rc *RouteConfig) (Middleware, error){
+	"observe":     func(p *proxy, _ *RouteConfig) (Middleware, error) { return p.observe, nil },
+	"auth":        func(p *proxy, _ *RouteConfig) (Middleware, error) { return p.auth, nil },
+	"limits":      func(p *proxy, _ *RouteConfig) (Middleware, error) { return p.limits, nil },
+	"transform":   func(p *proxy, _ *RouteConfig) (Middleware, error) { return p.transform, nil },
+	"route":       routeStage,
+	"headers":     headersStage,
+	"stream":      streamStage,
+	"plugins":     pluginsStage,
+	"filter":      filterStage,
+	"debug":       debugStage,
+	"capture":     captureStage,
+	"embeddings":  embeddingsStage,
+	"archive":     archiveStage,
+	"chaos":       chaosStage,
+	"compress":    compressStage,
+	"autoroute":   autoRouteStage,
+	"experiment":  experimentStage,
+	"session":     sessionStage,
+	"retrieval":   retrievalStage,
+	"context":     contextStage,
+	"tools":       toolsStage,
+	"files":       filesStage,
+	"images":      imagesStage,
+	"speech":      speechStage,
+	"realtime":    realtimeStage,
+	"sticky":      stickyStage,
+	"idempotency": idempotencyStage,
+	"fallback":    fallbackStage,
+	"resume":      resumeStage,
+	"json_mode":   jsonModeStage,
+}
+
+// chain returns the stage names for rc.
+func (rc *RouteConfig) chain() []string {
+	if len(rc.Middleware) == 0 {
+		return defaultChain
+	}
+	return rc.Middleware
+}
+
+func (rc *RouteConfig) validate() error {
+	if rc.Pattern == "" {
+		return fmt.Errorf("every route needs a pattern")
+	}
+	seen := make(map[string]bool)
+	for _, name := range rc.chain() {
+		if _, ok := stages[name]; !ok {
+			return fmt.Errorf("route %q: unknown middleware %q", rc.Pattern, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("route %q: middleware %q listed twice", rc.Pattern, name)
+		}
+		seen[name] = true
+	}
+	if !seen["route"] {
+		return fmt.Errorf("route %q: middleware must include route", rc.Pattern)
+	}
+	for i := range rc.Transforms {
+		if err := rc.Transforms[i].validate(); err != nil {
+			return fmt.Errorf("route %q: transforms: %w", rc.Pattern, err)
+		}
+	}
+	for _, t := range rc.Targets {
+		if t.When.Expr == nil || t.Target == "" {
+			return fmt.Errorf("route %q: every target needs when and target", rc.Pattern)
+		}
+	}
+	if err := validateAccess(rc.Access); err != nil {
+		return fmt.Errorf("route %q: access: %w", rc.Pattern, err)
+	}
+	for i := range rc.StreamTransforms {
+		if err := rc.StreamTransforms[i].validate(); err != nil {
+			return fmt.Errorf("route %q: stream_transforms: %w", rc.Pattern, err)
+		}
+	}
+	for i := range rc.Chaos {
+		if err := rc.Chaos[i].validate(); err != nil {
+			return fmt.Errorf("route %q: %w", rc.Pattern, err)
+		}
+	}
+	for i := range rc.Rewrite {
+		if err := rc.Rewrite[i].compile(); err != nil {
+			return fmt.Errorf("route %q: %w", rc.Pattern, err)
+		}
+	}
+	if err := rc.Headers.compile(); err != nil {
+		return fmt.Errorf("route %q: headers: %w", rc.Pattern, err)
+	}
+	return nil
+}
+
+// exchange is the state of one proxied request, shared by every stage of
+// its chain through the request context.
+type exchange struct {
+	id         string
+	start      time.Time
+	method     string
+	route      *RouteConfig
+	client     string
+	project    string
+	agent      string         // agent instance named by the caller, if any
+	keyID      string         // virtual key presented, if any
+	priority   string         // tier the request is served at
+	ip         string         // caller's address, found through trusted proxies
+	rateLimits []rateLimit    // limits the request counted against, for the headers
+	model      string         // requested model, when the body was parsed
+	body       []byte         // buffered request body, nil when streamed through
+	doc        map[string]any // body decoded as a JSON object, if it is one
+	dirty      bool           // doc was edited and must be re-encoded
+	env        map[string]any // expression variables, built on first use
+	target     string         // upstream URL chosen by the route stage
+	path       string         // path of target, after the route's rewrites
+	upstream   string         // upstream the request is pinned to, if any
+	estimate   Usage          // accounted when the response reports no usage
+	affinity   string         // conversation to keep on one upstream, if any
+	dryRun     bool           // answer with the decision, not the upstream's response
+	replayed   bool           // answered from a kept response, so without usage
+	inspect    bool           // a stage reads the response body, so it must arrive decoded
+}
+
+type exchangeKey struct{}
+
+// exchangeOf returns the exchange of a request inside a route chain.
+func exchangeOf(r *http.Request) *exchange {
+	ex, _ := r.Context().Value(exchangeKey{}).(*exchange)
+	return ex
+}
+
+// buildRoute composes rc's chain around the forwarding handler.
+func (p *proxy) buildRoute(rc *RouteConfig) (http.Handler, error) {
+	if err := rc.validate(); err != nil {
+		return nil, err
+	}
+	var h http.Handler = http.HandlerFunc(p.forward)
+	names := rc.chain()
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		mw, err := stages[name](p, rc)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s: %w", rc.Pattern, name, err)
+		}
+		h = mw(h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex := &exchange{id: newRequestID(), start: time.Now(), method: r.Method, route: rc, client: "anonymous", ip: p.ips.resolve(r), dryRun: isDryRun(r)}
+		noteExchange(w, ex)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)))
+	}), nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mockTarget is the upstream -mock points the proxy at.
+const mockTarget = "mock://upstream"
+
+// mockTransport answers "mock://" upstream URLs in process with canned
+// OpenAI- and Anthropic-style responses, streamed as SSE when asked, so
+// the proxy can run without a real provider or API key. The URL's host
+// names the profile shaping the responses; unknown hosts get the default.
+type mockTransport struct {
+	profiles map[string]MockProfile
+}
+
+func (t mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body map[string]any
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		json.Unmarshal(b, &body)
+	}
+	model, _ := body["model"].(string)
+	if model == "" {
+		model = "mock-model"
+	}
+	stream, _ := body["stream"].(bool)
+	mp := t.profiles[req.URL.Host]
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		reply := mp.reply(body)
+		if stream {
+			deltas, sizes := mp.deltas(reply.text)
+			return mockSSE(req, mp, openAIStream(model, reply, deltas), sizes), nil
+		}
+		return mp.delayed(req, reply, mockJSON(req, http.StatusOK, openAICompletion(model, reply)))
+	case strings.HasSuffix(path, "/messages"):
+		reply := mp.reply(body)
+		if stream {
+			deltas, sizes := mp.deltas(reply.text)
+			return mockSSE(req, mp, anthropicStream(model, reply, deltas), sizes), nil
+		}
+		return mp.delayed(req, reply, mockJSON(req, http.StatusOK, anthropicMessage(model, reply)))
+	case strings.HasSuffix(path, "/embeddings"):
+		return mockJSON(req, http.StatusOK, mockEmbeddings(model, body)), nil
+	case strings.HasSuffix(path, "/models"):
+		return mockJSON(req, http.StatusOK, map[string]any{"object": "list", "data": []any{
+			map[string]any{"id": "mock-model", "object": "model", "owned_by": "zai-proxy"}}}), nil
+	}
+	return mockJSON(req, http.StatusNotFound, apiError{Error: apiErrorDetail{
+		Message: "the mock upstream does not serve " + path, Type: "not_found"}}), nil
+}
+
+// mockCompletion is a canned reply with token counts.
+type mockCompletion struct {
+	text                 string
+	promptTokens, tokens int64
+}
+
+// mockReply echoes the last user message, so responses are deterministic
+// and show what reached the upstream.
+func mockReply(body map[string]any) mockCompletion {
+	b, _ := json.Marshal(body)
+	var req chatRequest
+	json.Unmarshal(b, &req)
+	last := ""
+	for _, m := range req.Messages {
+		if m.Role == "user" {
+			last = contentText(m.Content)
+		}
+	}
+	if len(last) > 200 {
+		last = last[:200]
+	}
+	text := "This is a mock response."
+	if last != "" {
+		text = "Mock response to: " + last
+	}
+	return mockCompletion{text: text, promptTokens: estimatePromptTokens(&req), tokens: estimateTextTokens(text)}
+}
+
+func openAICompletion(model string, c mockCompletion) any {
+	return map[string]any{
+		"id": "chatcmpl-mock", "object": "chat.completion", "created": time.Now().Unix(), "model": model,
+		"choices": []any{map[string]any{"index": 0, "finish_reason": "stop",
+			"message": map[string]any{"role": "assistant", "content": c.text}}},
+		"usage": map[string]any{"prompt_tokens": c.promptTokens, "completion_tokens": c.tokens,
+			"total_tokens": c.promptTokens + c.tokens},
+	}
+}
+
+// mockStream is a streamed reply: head events, one event per text delta,
+// then the tail. fail is the error event sent when a profile fails the
+// stream.
+type mockStream struct {
+	head, deltas, tail []string
+	fail               string
+}
+
+// openAIStream sends the deltas as chunks, then a usage chunk and [DONE].
+func openAIStream(model string, c mockCompletion, deltas []string) mockStream {
+	chunk := func(delta map[string]any, finish any) string {
+		b, _ := json.Marshal(map[string]any{"id": "chatcmpl-mock", "object": "chat.completion.chunk",
+			"model": model, "choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finish}}})
+		return "data: " + string(b) + "\n\n"
+	}
+	ms := mockStream{head: []string{chunk(map[string]any{"role": "assistant", "content": ""}, nil)}}
+	for _, d := range deltas {
+		ms.deltas = append(ms.deltas, chunk(map[string]any{"content": d}, nil))
+	}
+	b, _ := json.Marshal(map[string]any{"id": "chatcmpl-mock", "object": "chat.completion.chunk", "model": model,
+		"choices": []any{}, "usage": map[string]any{"prompt_tokens": c.promptTokens,
+			"completion_tokens": c.tokens, "total_tokens": c.promptTokens + c.tokens}})
+	ms.tail = []string{chunk(map[string]any{}, "stop"), "data: " + string(b) + "\n\n", "data: [DONE]\n\n"}
+	b, _ = json.Marshal(apiError{Error: apiErrorDetail{Message: "mock stream failure", Type: "server_error"}})
+	ms.fail = "data: " + string(b) + "\n\n"
+	return ms
+}
+
+func anthropicMessage(model string, c mockCompletion) any {
+	return map[string]any{
+		"id": "msg_mock", "type": "message", "role": "assistant", "model": model,
+		"content":     []any{map[string]any{"type": "text", "text": c.text}},
+		"stop_reason": "end_turn",
+		"usage":       map[string]any{"input_tokens": c.promptTokens, "output_tokens": c.tokens},
+	}
+}
+
+func anthropicStream(model string, c mockCompletion, deltas []string) mockStream {
+	event := func(name string, v any) string {
+		b, _ := json.Marshal(v)
+		return "event: " + name + "\ndata: " + string(b) + "\n\n"
+	}
+	ms := mockStream{head: []string{
+		event("message_start", map[string]any{"type": "message_start", "message": map[string]any{
+			"id": "msg_mock", "type": "message", "role": "assistant", "model": model, "content": []any{},
+			"usage": map[string]any{"input_tokens": c.promptTokens, "output_tokens": 0}}}),
+		event("content_block_start", map[string]any{"type": "content_block_start", "index": 0,
+			"content_block": map[string]any{"type": "text", "text": ""}}),
+	}}
+	for _, d := range deltas {
+		ms.deltas = append(ms.deltas, event("content_block_delta", map[string]any{"type": "content_block_delta",
+			"index": 0, "delta": map[string]any{"type": "text_delta", "text": d}}))
+	}
+	ms.tail = []string{
+		event("content_block_stop", map[string]any{"type": "content_block_stop", "index": 0}),
+		event("message_delta", map[string]any{"type": "message_delta",
+			"delta": map[string]any{"stop_reason": "end_turn"}, "usage": map[string]any{"output_tokens": c.tokens}}),
+		event("message_stop", map[string]any{"type": "message_stop"}),
+	}
+	ms.fail = event("error", map[string]any{"type": "error",
+		"error": map[string]any{"type": "overloaded_error", "message": "mock stream failure"}})
+	return ms
+}
+
+// mockEmbeddings returns a unit vector per input derived from its hash.
+func mockEmbeddings(model string, body map[string]any) any {
+	var inputs []string
+	switch in := body["input"].(type) {
+	case string:
+		inputs = []string{in}
+	case []any:
+		for _, v := range in {
+			inputs = append(inputs, fmt.Sprint(v))
+		}
+	}
+	dims := 16
+	if d, ok := body["dimensions"].(float64); ok && d >= 1 && d <= 4096 {
+		dims = int(d)
+	}
+	var data []any
+	var tokens int64
+	for i, in := range inputs {
+		tokens += estimateTextTokens(in)
+		data = append(data, map[string]any{"object": "embedding", "index": i, "embedding": hashVector(in, dims)})
+	}
+	return map[string]any{"object": "list", "model": model, "data": data,
+		"usage": map[string]any{"prompt_tokens": tokens, "total_tokens": tokens}}
+}
+
+func hashVector(s string, dims int) []float64 {
+	v := make([]float64, dims)
+	var norm float64
+	seed := sha256.Sum256([]byte(s))
+	for i := range v {
+		h := sha256.Sum256(append(seed[:], byte(i), byte(i>>8)))
+		v[i] = float64(int32(binary.BigEndian.Uint32(h[:4]))) / math.MaxInt32
+		norm += v[i] * v[i]
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// splitWords cuts text into words that keep their leading space, as
+// streamed deltas do.
+func splitWords(text string) []string {
+	var out []string
+	for i, w := range strings.Split(text, " ") {
+		if i > 0 {
+			w = " " + w
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+func mockJSON(req *http.Request, status int, v any) *http.Response {
+	b, _ := json.Marshal(v)
+	return &http.Response{
+		StatusCode: status, Status: fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Request: req,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}
+}
+
+// mockSSE streams ms paced by the profile.
+func mockSSE(req *http.Request, mp MockProfile, ms mockStream, sizes []int) *http.Response {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(mp.play(req.Context(), pw, ms, sizes))
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK, Status: "200 OK",
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Request: req,
+		Header:        http.Header{"Content-Type": {"text/event-stream"}, "Cache-Control": {"no-cache"}},
+		Body:          pr,
+		ContentLength: -1,
+	}
+}
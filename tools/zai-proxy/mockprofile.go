@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MockProfile shapes a mock upstream's responses so clients' streaming
+// handling can be exercised reproducibly. Replies are Tokens synthetic
+// words drawn from Seed (default: echo the prompt), streamed in chunks of
+// ChunkMin to ChunkMax words (default one) at TokensPerSecond (default
+// unpaced) after FirstToken, with extra Pauses. After FailAfter words the
+// stream fails by Fail: "disconnect" (default) cuts the connection,
+// "error" sends the provider's error event and ends the stream.
+type MockProfile struct {
+	Seed            uint64      `json:"seed,omitempty"`
+	Tokens          int         `json:"tokens,omitempty"`
+	TokensPerSecond float64     `json:"tokens_per_second,omitempty"`
+	FirstToken      Duration    `json:"first_token,omitempty"`
+	ChunkMin        int         `json:"chunk_min,omitempty"`
+	ChunkMax        int         `json:"chunk_max,omitempty"`
+	Pauses          []MockPause `json:"pauses,omitempty"`
+	FailAfter       int         `json:"fail_after,omitempty"`
+	Fail            string      `json:"fail,omitempty"`
+}
+
+// MockPause holds the stream For a while once After words have been sent.
+type MockPause struct {
+	After int      `json:"after"`
+	For   Duration `json:"for"`
+}
+
+func (mp *MockProfile) validate(name string) error {
+	switch {
+	case mp.Tokens < 0 || mp.TokensPerSecond < 0 || mp.FirstToken < 0 || mp.FailAfter < 0:
+		return fmt.Errorf("mock %q: values must not be negative", name)
+	case mp.ChunkMin < 0 || mp.ChunkMax < 0 || mp.ChunkMax > 0 && mp.ChunkMax < mp.ChunkMin:
+		return fmt.Errorf("mock %q: chunk_max must be at least chunk_min", name)
+	case mp.Fail != "" && mp.Fail != "disconnect" && mp.Fail != "error":
+		return fmt.Errorf("mock %q: fail must be disconnect or error", name)
+	}
+	for _, p := range mp.Pauses {
+		if p.After < 0 || p.For <= 0 {
+			return fmt.Errorf("mock %q: pauses need a non-negative after and a positive for", name)
+		}
+	}
+	return nil
+}
+
+var errMockDisconnect = errors.New("mock upstream dropped the connection")
+
+var mockVocabulary = strings.Fields("the proxy streams tokens to every client while upstream models " +
+	"answer questions about code tests routes quotas and usage with care")
+
+// reply returns the synthetic reply, or the echo without Tokens.
+func (mp MockProfile) reply(body map[string]any) mockCompletion {
+	c := mockReply(body)
+	if mp.Tokens == 0 {
+		return c
+	}
+	rng := rand.New(rand.NewPCG(mp.Seed, 2))
+	words := make([]string, mp.Tokens)
+	for i := range words {
+		words[i] = mockVocabulary[rng.IntN(len(mockVocabulary))]
+	}
+	c.text, c.tokens = strings.Join(words, " "), int64(mp.Tokens)
+	return c
+}
+
+// deltas cuts text into the streamed chunks and the words in each.
+func (mp MockProfile) deltas(text string) ([]string, []int) {
+	words := splitWords(text)
+	lo := max(mp.ChunkMin, 1)
+	hi := max(mp.ChunkMax, lo)
+	rng := rand.New(rand.NewPCG(mp.Seed, 1))
+	var out []string
+	var sizes []int
+	for len(words) > 0 {
+		n := min(lo+rng.IntN(hi-lo+1), len(words))
+		out = append(out, strings.Join(words[:n], ""))
+		sizes = append(sizes, n)
+		words = words[n:]
+	}
+	return out, sizes
+}
+
+// pace is how long n words take to generate.
+func (mp MockProfile) pace(n int) time.Duration {
+	if mp.TokensPerSecond == 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / mp.TokensPerSecond * float64(time.Second))
+}
+
+func (mp MockProfile) fails(sent int) bool {
+	return mp.FailAfter > 0 && sent >= mp.FailAfter
+}
+
+// play writes ms to w with the profile's timing and failure. sizes are the
+// words in each delta.
+func (mp MockProfile) play(ctx context.Context, w io.Writer, ms mockStream, sizes []int) error {
+	write := func(events ...string) error {
+		for _, e := range events {
+			if _, err := io.WriteString(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(ms.head...); err != nil {
+		return err
+	}
+	if err := sleepCtx(ctx, time.Duration(mp.FirstToken)); err != nil {
+		return err
+	}
+	pauses := slices.Clone(mp.Pauses)
+	slices.SortFunc(pauses, func(a, b MockPause) int { return a.After - b.After })
+	sent := 0
+	for i, e := range ms.deltas {
+		if mp.fails(sent) {
+			return mp.fail(w, ms)
+		}
+		if err := sleepCtx(ctx, mp.pace(sizes[i])); err != nil {
+			return err
+		}
+		if err := write(e); err != nil {
+			return err
+		}
+		sent += sizes[i]
+		for len(pauses) > 0 && pauses[0].After <= sent {
+			if err := sleepCtx(ctx, time.Duration(pauses[0].For)); err != nil {
+				return err
+			}
+			pauses = pauses[1:]
+		}
+	}
+	if mp.fails(sent) {
+		return mp.fail(w, ms)
+	}
+	return write(ms.tail...)
+}
+
+func (mp MockProfile) fail(w io.Writer, ms mockStream) error {
+	if mp.Fail == "error" {
+		_, err := io.WriteString(w, ms.fail)
+		return err
+	}
+	return errMockDisconnect
+}
+
+// delayed holds a complete response for as long as generating the reply
+// would take, failing it like the stream would.
+func (mp MockProfile) delayed(req *http.Request, c mockCompletion, resp *http.Response) (*http.Response, error) {
+	if err := sleepCtx(req.Context(), time.Duration(mp.FirstToken)+mp.pace(int(c.tokens))); err != nil {
+		return nil, err
+	}
+	if !mp.fails(int(c.tokens)) {
+		return resp, nil
+	}
+	if mp.Fail == "error" {
+		return mockJSON(req, http.StatusInternalServerError, apiError{Error: apiErrorDetail{
+			Message: "mock upstream failure", Type: "server_error"}}), nil
+	}
+	return nil, errMockDisconnect
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
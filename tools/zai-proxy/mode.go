@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Operating modes, switched at runtime through the admin API. Draining
+// keeps serving, including streams already in flight, but fails /ready so
+// load balancers stop sending new traffic. Maintenance answers every
+// proxied request with the configured 503 body and leaves readiness alone
+// so clients see that body rather than connection errors.
+const (
+	modeServing = "serving"
+	modeDrain   = "drain"
+	modeMaint   = "maintenance"
+)
+
+// MaintenanceConfig is the response served in maintenance mode. Body
+// defaults to an OpenAI-style error; RetryAfter sets the Retry-After
+// header.
+type MaintenanceConfig struct {
+	Body       json.RawMessage `json:"body,omitempty"`
+	RetryAfter Duration        `json:"retry_after,omitempty"`
+}
+
+func (m *MaintenanceConfig) validate() error {
+	if len(m.Body) > 0 && !json.Valid(m.Body) {
+		return fmt.Errorf("body must be valid JSON")
+	}
+	return nil
+}
+
+var modeGauge = metrics.gauge("zai_proxy_mode", "Current operating mode (1 for the active one).", "mode")
+
+// modeSwitch holds the operating mode and counts requests in flight so a
+// drain can be watched to completion.
+type modeSwitch struct {
+	mode     atomic.Value // string
+	inFlight atomic.Int64
+}
+
+func (s *modeSwitch) get() string {
+	if m, _ := s.mode.Load().(string); m != "" {
+		return m
+	}
+	return modeServing
+}
+
+func (s *modeSwitch) set(mode string) error {
+	switch mode {
+	case modeServing, modeDrain, modeMaint:
+	default:
+		return fmt.Errorf("unknown mode %q (want %s, %s or %s)", mode, modeServing, modeDrain, modeMaint)
+	}
+	s.mode.Store(mode)
+	for _, m := range []string{modeServing, modeDrain, modeMaint} {
+		v := 0.0
+		if m == mode {
+			v = 1
+		}
+		modeGauge.Set(v, m)
+	}
+	return nil
+}
+
+// gate wraps a proxied route: it answers with the maintenance body when
+// that mode is on, sheds the request when memory is short, and otherwise
+// counts it in flight.
+func (p *proxy) gate(next http.Handler) http.Handler {
+	body := []byte(p.cfg.Maintenance.Body)
+	retry := time.Duration(p.cfg.Maintenance.RetryAfter)
+	if len(body) == 0 {
+		body, _ = json.Marshal(apiError{Error: apiErrorDetail{
+			Message: "the service is down for maintenance", Type: "maintenance",
+			Retry: &retryHint{Retryable: true, AfterMs: retry.Milliseconds()}}})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.mode.get() == modeMaint {
+			if retry > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(body)
+			return
+		}
+		// The tier is checked against the client's once it is known; one
+		// it may not have is refused then.
+		tier := r.Header.Get(priorityHeader)
+		if !slices.Contains(priorityTiers, tier) {
+			tier = cmp.Or(p.cfg.Priority.Default, "normal")
+		}
+		if p.memory.shed(w, tier, &p.cfg.Priority) {
+			return
+		}
+		p.mode.inFlight.Add(1)
+		defer p.mode.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ready is the readiness probe: it fails while draining.
+func (p *proxy) ready(w http.ResponseWriter, r *http.Request) {
+	if p.mode.get() == modeDrain {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if p.cfg.Kubernetes.ReadyOnUpstreams && !p.upstreamHealthy() {
+		http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ModelAccess restricts which models a client may request. Entries are
+// exact names or prefixes ending in "*". An empty Allow permits every model
+// not denied; Deny wins over Allow.
+type ModelAccess struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func (a *ModelAccess) permits(model string) bool {
+	if matchModel(a.Deny, model) {
+		return false
+	}
+	return len(a.Allow) == 0 || matchModel(a.Allow, model)
+}
+
+// describe summarizes the permitted models for error messages.
+func (a *ModelAccess) describe() string {
+	var s string
+	if len(a.Allow) == 0 {
+		s = "any model"
+	} else {
+		s = strings.Join(a.Allow, ", ")
+	}
+	if len(a.Deny) > 0 {
+		s += " except " + strings.Join(a.Deny, ", ")
+	}
+	return s
+}
+
+// modelAccess returns the access list for client: its own when configured,
+// else the global default. nil means unrestricted.
+func (c *Config) modelAccess(client *ClientConfig) *ModelAccess {
+	if client != nil && client.Models != nil {
+		return client.Models
+	}
+	return c.Models
+}
+
+// checkModel returns an error naming the permitted models when client may
+// not use model.
+func (c *Config) checkModel(client *ClientConfig, name, model string) error {
+	a := c.modelAccess(client)
+	if a == nil || model == "" || a.permits(model) {
+		return nil
+	}
+	return fmt.Errorf("model %q is not available to client %s; permitted: %s", model, name, a.describe())
+}
+
+// ModelDeprecation retires Model, an exact name or a prefix ending in "*",
+// in favour of Successor. Until Sunset, a date, requests for it are served
+// as asked with a warning; from then, or always without one, they are
+// remapped to Successor, and responses name the model asked for.
+type ModelDeprecation struct {
+	Model     string `json:"model"`
+	Successor string `json:"successor"`
+	Sunset    string `json:"sunset,omitempty"`
+
+	sunset time.Time
+}
+
+func (d *ModelDeprecation) validate() error {
+	if d.Model == "" || d.Successor == "" {
+		return fmt.Errorf("model and successor are required")
+	}
+	if d.Sunset != "" {
+		t, err := parseUsageTime(d.Sunset)
+		if err != nil {
+			return fmt.Errorf("sunset: %w", err)
+		}
+		d.sunset = t
+	}
+	return nil
+}
+
+// deprecation returns the deprecation covering model, an exact entry
+// before the longest prefix, or nil.
+func (c *Config) deprecation(model string) *ModelDeprecation {
+	if model == "" {
+		return nil
+	}
+	var best *ModelDeprecation
+	longest := -1
+	for i := range c.Deprecations {
+		d := &c.Deprecations[i]
+		if d.Model == model {
+			return d
+		}
+		if prefix, ok := strings.CutSuffix(d.Model, "*"); ok && strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			best, longest = d, len(prefix)
+		}
+	}
+	return best
+}
+
+var deprecatedRequests = metrics.counter("zai_proxy_deprecated_model_requests_total",
+	"Requests for deprecated models, by model, successor and whether they were remapped or only warned.", "model", "successor", "action")
+
+// apply warns in h that ex asks for a deprecated model and, past the
+// sunset, remaps it, reporting whether it did.
+func (d *ModelDeprecation) apply(h http.Header, ex *exchange, now time.Time) bool {
+	model := ex.model
+	if !d.sunset.IsZero() {
+		h.Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+	}
+	h.Set("X-Ringmaster-Deprecated-Model", model)
+	if !d.sunset.IsZero() && now.Before(d.sunset) {
+		h.Set("Warning", fmt.Sprintf(`299 ringmaster "model %s is deprecated and will be served by %s from %s"`,
+			model, d.Successor, d.sunset.UTC().Format(time.DateOnly)))
+		deprecatedRequests.Add(1, model, d.Successor, "warned")
+		return false
+	}
+	h.Set("Warning", fmt.Sprintf(`299 ringmaster "model %s is retired; served by %s"`, model, d.Successor))
+	h.Set("X-Ringmaster-Model", d.Successor)
+	deprecatedRequests.Add(1, model, d.Successor, "remapped")
+	ex.model, ex.doc["model"] = d.Successor, d.Successor
+	return true
+}
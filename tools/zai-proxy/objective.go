@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// objectiveHeader names what a request wants its upstream chosen for.
+const objectiveHeader = "X-Ringmaster-Objective"
+
+// ObjectivesConfig lets requests ask, with X-Ringmaster-Objective, for the
+// pool member that best serves an objective in place of the weighted draw:
+// cheapest, by the price of the request's model there; fastest, by the
+// upstream's average latency of late; or balanced, scoring both against
+// the best on offer, Balance (default 0.5) being the weight of cost.
+// Members with open circuits are passed over while others are left, and
+// those yet to respond count as fast as the fastest, so they get tried.
+// Default is the objective of requests naming none. Conversations kept on
+// an upstream by sticky routing stay there.
+type ObjectivesConfig struct {
+	Default string   `json:"default,omitempty"`
+	Balance *float64 `json:"balance,omitempty"`
+}
+
+var objectives = []string{"cheapest", "fastest", "balanced"}
+
+func (c *ObjectivesConfig) validate() error {
+	if c.Default != "" && !slices.Contains(objectives, c.Default) {
+		return fmt.Errorf("objectives: default must be cheapest, fastest or balanced")
+	}
+	if c.Balance != nil && (*c.Balance < 0 || *c.Balance > 1) {
+		return fmt.Errorf("objectives: balance must be between 0 and 1")
+	}
+	return nil
+}
+
+var objectiveRequests = metrics.counter("zai_proxy_objective_requests_total",
+	"Requests routed by objective, by objective and upstream.", "objective", "upstream")
+
+// objectiveOf returns the objective r asks for, else the default.
+func (c *ObjectivesConfig) objectiveOf(r *http.Request) (string, error) {
+	o := r.Header.Get(objectiveHeader)
+	if o == "" {
+		return c.Default, nil
+	}
+	if !slices.Contains(objectives, o) {
+		return "", fmt.Errorf("%s must be cheapest, fastest or balanced", objectiveHeader)
+	}
+	return o, nil
+}
+
+// priceTable returns the table pricing model at the pool member with URL
+// member: as the member prices it, else def.
+func (p *upstreamPool) priceTable(member, model string, def PriceTable) PriceTable {
+	if member == "" {
+		return def
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.ups {
+		if p.ups[i].URL == member {
+			return p.ups[i].prices(model, def)
+		}
+	}
+	return def
+}
+
+// prices returns the table pricing model at u: its own when it prices the
+// model, else none for a local server, which costs nothing to call, else
+// def.
+func (u *UpstreamConfig) prices(model string, def PriceTable) PriceTable {
+	if _, ok := u.Pricing.Lookup(model); ok {
+		return u.Pricing
+	}
+	if u.Local != nil {
+		return nil
+	}
+	return def
+}
+
+// pickBy returns the member best meeting objective for model, by the
+// latencies seen and the prices, or "" for an empty pool.
+func (p *upstreamPool) pickBy(objective, model string, oc *ObjectivesConfig, def PriceTable, seen *upstreamTracker) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	type candidate struct {
+		url           string
+		rate, latency float64
+		known         bool
+	}
+	now := time.Now()
+	var cands []candidate
+	for _, closedOnly := range []bool{true, false} {
+		for i := range p.ups {
+			u := &p.ups[i]
+			if u.weight() == 0 || closedOnly && p.circuits.isOpen(u.URL, now) {
+				continue
+			}
+			price, _ := u.prices(model, def).Lookup(model)
+			l, known := seen.latency(upstreamOf(u.URL))
+			cands = append(cands, candidate{url: u.URL, rate: price.Input + price.Output, latency: l.Seconds(), known: known})
+		}
+		if len(cands) > 0 {
+			break
+		}
+	}
+	if len(cands) == 0 {
+		return ""
+	}
+	fastest, maxRate, maxLatency := -1.0, 0.0, 0.0
+	for _, c := range cands {
+		if c.known && (fastest < 0 || c.latency < fastest) {
+			fastest = c.latency
+		}
+		maxRate, maxLatency = max(maxRate, c.rate), max(maxLatency, c.latency)
+	}
+	for i := range cands {
+		if !cands[i].known {
+			cands[i].latency = max(fastest, 0)
+		}
+	}
+	balance := 0.5
+	if oc.Balance != nil {
+		balance = *oc.Balance
+	}
+	score := func(c candidate) (float64, float64) {
+		switch objective {
+		case "cheapest":
+			return c.rate, c.latency
+		case "fastest":
+			return c.latency, c.rate
+		}
+		var s float64
+		if maxRate > 0 {
+			s += balance * c.rate / maxRate
+		}
+		if maxLatency > 0 {
+			s += (1 - balance) * c.latency / maxLatency
+		}
+		return s, 0
+	}
+	best := cands[0]
+	for _, c := range cands[1:] {
+		s, t := score(c)
+		bs, bt := score(best)
+		// Ties go to members yet to respond, then to the other measure.
+		if s < bs || s == bs && (c.known == best.known && t < bt || !c.known && best.known) {
+			best = c
+		}
+	}
+	return best.url
+}
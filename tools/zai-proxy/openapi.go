@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiOp describes one of the proxy's own endpoints for the OpenAPI
+// document. Request and response shapes are Go values whose types are
+// turned into schemas, so the document follows the code.
+type apiOp struct {
+	method, path, summary string
+	admin                 bool
+	query                 []string
+	body                  any
+	status                int
+	resp                  any    // nil for an empty response
+	media                 string // response media type, default JSON
+}
+
+// apiObject is an ad hoc JSON object: each value's type becomes the schema
+// of that property.
+type apiObject map[string]any
+
+var usageParams = []string{"from", "to", "bucket", "group_by", "client", "project", "model"}
+
+var apiOps = []apiOp{
+	{method: "GET", path: "/health", summary: "Liveness probe", status: 200, resp: "", media: "text/plain"},
+	{method: "GET", path: "/ready", summary: "Readiness probe; fails while draining or, if so configured, without a healthy upstream", status: 200, resp: "", media: "text/plain"},
+	{method: "GET", path: "/prestop", summary: "Drain for the pod's termination; returns once requests in flight are done", status: 200, resp: "", media: "text/plain"},
+	{method: "GET", path: "/metrics", summary: "Prometheus metrics", status: 200, resp: "", media: "text/plain"},
+	{method: "GET", path: "/openapi.json", summary: "This document", status: 200, resp: apiObject{}},
+	{method: "GET", path: "/v1/sessions/{id}", summary: "The messages of one of the caller's sessions", status: 200,
+		resp: apiObject{"id": "", "messages": []any{}}},
+	{method: "DELETE", path: "/v1/sessions/{id}", summary: "Forget one of the caller's sessions", status: 204},
+	{method: "POST", path: "/v1/jobs", summary: "Submit a background generation", body: AsyncJobRequest{}, status: 202, resp: AsyncJob{}},
+	{method: "GET", path: "/v1/jobs", summary: "The caller's jobs", status: 200, resp: apiObject{"jobs": []AsyncJob{}}},
+	{method: "GET", path: "/v1/jobs/{id}", summary: "Poll a job", status: 200, resp: AsyncJob{}},
+	{method: "GET", path: "/v1/jobs/{id}/chunks", summary: "Long-poll a streamed job's chunks", status: 200, resp: JobChunks{}},
+	{method: "DELETE", path: "/v1/jobs/{id}", summary: "Cancel a job", status: 200, resp: AsyncJob{}},
+	{method: "POST", path: "/v1/batches", summary: "Submit a batch as JSON or JSON lines", body: BatchRequest{}, status: 202, resp: Batch{}},
+	{method: "GET", path: "/v1/batches", summary: "The caller's batches", status: 200, resp: apiObject{"batches": []Batch{}}},
+	{method: "GET", path: "/v1/batches/{id}", summary: "A batch's progress", status: 200, resp: Batch{}},
+	{method: "GET", path: "/v1/batches/{id}/results", summary: "Download a batch's results", status: 200, resp: "", media: "application/jsonl"},
+	{method: "DELETE", path: "/v1/batches/{id}", summary: "Cancel a batch", status: 200, resp: Batch{}},
+	{method: "GET", path: "/v1/pipelines", summary: "The configured pipelines", status: 200,
+		resp: apiObject{"pipelines": []apiObject{{"name": "", "steps": []string{}}}}},
+	{method: "POST", path: "/v1/pipelines/{name}", summary: "Run a pipeline", body: PipelineRun{}, status: 200, resp: PipelineResult{}},
+	{method: "POST", path: "/v1/templates/{name}/expand", summary: "Render a prompt template with variables", body: apiObject{"version": 0, "variables": map[string]any{}}, status: 200, resp: TemplateExpansion{}},
+	{method: "GET", path: "/usage/me", summary: "The calling client's usage", query: usageParams, status: 200, resp: UsageReport{}},
+	{method: "GET", path: "/keys/{id}/stats", summary: "The calling virtual key's stats on this replica", status: 200, resp: KeyStats{}},
+	{method: "POST", path: "/estimate", summary: "Estimate a request's cost and quota coverage", body: chatRequest{}, status: 200, resp: Estimate{}},
+	{method: "POST", path: "/tokenize", summary: "Split text into the model's tokens", body: TokenizeRequest{}, status: 200, resp: TokenizeResult{}},
+	{method: "POST", path: "/count_tokens", summary: "Count a chat request's prompt tokens", body: chatRequest{}, status: 200, resp: CountTokensResult{}},
+	{method: "POST", path: fanoutPath, summary: "Send one chat request to several models", body: FanoutRequest{}, status: 200,
+		resp: apiObject{"responses": []FanoutResult{}}},
+	{method: "POST", path: bestOfPath, summary: "Sample a chat request n times and answer with the best", body: BestOfRequest{}, status: 200,
+		resp: apiObject{"best_of": BestOf{}}},
+	{method: "POST", path: consensusPath, summary: "Ask several models and return their consensus answer", body: FanoutRequest{}, status: 200,
+		resp: ConsensusResult{}},
+
+	{method: "GET", path: "/usage", summary: "Usage across clients", admin: true, query: usageParams, status: 200, resp: UsageReport{}},
+	{method: "GET", path: "/admin/export", summary: "Export raw usage records", admin: true, query: []string{"format", "from", "to"}, status: 200, resp: "", media: "text/csv"},
+	{method: "GET", path: "/admin/keys", summary: "List virtual keys", admin: true, status: 200, resp: apiObject{"keys": []VirtualKey{}}},
+	{method: "POST", path: "/admin/keys", summary: "Issue a virtual key", admin: true, body: apiObject{"client": ""}, status: 201, resp: issuedKey{}},
+	{method: "DELETE", path: "/admin/keys/{id}", summary: "Revoke a virtual key", admin: true, status: 204},
+	{method: "POST", path: "/admin/keys/{id}/rotate", summary: "Replace a virtual key", admin: true, status: 201, resp: issuedKey{}},
+	{method: "GET", path: "/admin/quotas/{client}", summary: "A client's effective quota", admin: true, status: 200, resp: QuotaConfig{}},
+	{method: "PUT", path: "/admin/quotas/{client}", summary: "Override a client's quota", admin: true, body: QuotaConfig{}, status: 200, resp: QuotaConfig{}},
+	{method: "GET", path: "/admin/config", summary: "Effective config with value sources", admin: true, status: 200,
+		resp: apiObject{"file": "", "config": apiObject{}, "sources": map[string]string{}}},
+	{method: "GET", path: "/admin/upstreams", summary: "Upstream pool and traffic", admin: true, status: 200,
+		resp: apiObject{"upstreams": []UpstreamConfig{}, "traffic": []UpstreamStatus{}, "circuits": map[string]time.Time{},
+			"health": map[string]UpstreamHealth{}}},
+	{method: "GET", path: "/admin/cluster", summary: "This replica's cluster peers", admin: true, status: 200,
+		resp: apiObject{"node": "", "peers": []ClusterPeer{}}},
+	{method: "PUT", path: "/admin/upstreams/{name}", summary: "Add or edit an upstream", admin: true, body: UpstreamConfig{}, status: 200, resp: UpstreamConfig{}},
+	{method: "DELETE", path: "/admin/upstreams/{name}", summary: "Remove an upstream", admin: true, status: 204},
+	{method: "GET", path: "/admin/config/versions", summary: "Versions of the runtime config", admin: true, status: 200,
+		resp: apiObject{"current": 0, "versions": []ConfigVersion{}}},
+	{method: "GET", path: "/admin/config/versions/{version}", summary: "The runtime config as of a version", admin: true, status: 200,
+		resp: apiObject{"version": ConfigVersion{}, "config": configSnapshot{}}},
+	{method: "GET", path: "/admin/config/versions/{version}/diff", summary: "What changed to make a version, or from another", admin: true, query: []string{"from"}, status: 200,
+		resp: apiObject{"from": 0, "to": 0, "changes": []ConfigChange{}}},
+	{method: "POST", path: "/admin/config/versions/{version}/rollback", summary: "Restore a version's runtime config as a new version", admin: true, status: 200,
+		resp: apiObject{"version": ConfigVersion{}, "changes": []ConfigChange{}}},
+	{method: "GET", path: "/admin/routes", summary: "Routes and their overrides", admin: true, status: 200, resp: apiObject{"routes": []routeInfo{}}},
+	{method: "PUT", path: "/admin/routes", summary: "Override or restore a route's target", admin: true, body: RouteOverride{}, status: 200, resp: RouteOverride{}},
+	{method: "GET", path: "/admin/errors", summary: "Recent failed requests", admin: true, status: 200, resp: apiObject{"errors": []RecentError{}}},
+	{method: "GET", path: "/admin/alerts", summary: "Alerts firing now", admin: true, status: 200, resp: apiObject{"alerts": []Alert{}}},
+	{method: "GET", path: "/admin/flags", summary: "Feature flags", admin: true, query: []string{"client"}, status: 200,
+		resp: apiObject{"flags": map[string]FlagConfig{}, "client": "", "on": map[string]bool{}}},
+	{method: "PUT", path: "/admin/flags/{name}", summary: "Create or change a feature flag", admin: true, body: FlagConfig{}, status: 200, resp: FlagConfig{}},
+	{method: "DELETE", path: "/admin/flags/{name}", summary: "Delete a feature flag", admin: true, status: 204},
+	{method: "GET", path: "/admin/templates", summary: "Prompt templates and their versions", admin: true, status: 200,
+		resp: apiObject{"templates": map[string][]TemplateVersion{}}},
+	{method: "GET", path: "/admin/templates/{name}", summary: "A prompt template's versions, or one of them", admin: true, query: []string{"version"}, status: 200,
+		resp: apiObject{"name": "", "versions": []TemplateVersion{}}},
+	{method: "POST", path: "/admin/templates/{name}", summary: "Add a prompt template's next version", admin: true, body: TemplateVersion{}, status: 201, resp: TemplateVersion{}},
+	{method: "DELETE", path: "/admin/templates/{name}", summary: "Delete a prompt template", admin: true, status: 204},
+	{method: "GET", path: "/admin/log", summary: "Log level and debug capture rules", admin: true, status: 200, resp: logSettings{}},
+	{method: "PUT", path: "/admin/log", summary: "Change the log level or debug capture rules", admin: true, body: logSettings{}, status: 200, resp: logSettings{}},
+	{method: "GET", path: "/admin/debug/captures", summary: "Recent debug captures", admin: true, status: 200,
+		resp: apiObject{"captures": []DebugCapture{}}},
+	{method: "POST", path: "/admin/restart", summary: "Hand over to a new process of the executable on disk", admin: true, status: 204},
+	{method: "GET", path: "/admin/mode", summary: "Operating mode", admin: true, status: 200, resp: apiObject{"mode": "", "in_flight": 0}},
+	{method: "PUT", path: "/admin/mode", summary: "Switch between serving, drain and maintenance", admin: true, body: apiObject{"mode": ""}, status: 200,
+		resp: apiObject{"mode": "", "in_flight": 0}},
+	{method: "GET", path: "/admin/audit", summary: "Recent audit entries and chain status", admin: true, query: []string{"limit"}, status: 200,
+		resp: apiObject{"total": 0, "intact": true, "broken_at": 0, "entries": []AuditEntry{}}},
+	{method: "POST", path: "/admin/cache/purge", summary: "Drop cached key lookups", admin: true, status: 204},
+	{method: "GET", path: "/admin/experiments", summary: "Experiments and their results per variant", admin: true, status: 200,
+		resp: apiObject{"experiments": []ExperimentResult{}}},
+	{method: "GET", path: "/admin/experiments/{name}", summary: "An experiment's results per variant", admin: true, status: 200, resp: ExperimentResult{}},
+	{method: "DELETE", path: "/admin/experiments/{name}/results", summary: "Restart an experiment's results", admin: true, status: 204},
+	{method: "GET", path: "/admin/evals", summary: "Eval suites and each model's latest run", admin: true, status: 200,
+		resp: apiObject{"suites": []EvalSummary{}}},
+	{method: "GET", path: "/admin/evals/{name}", summary: "An eval suite's run history", admin: true, query: []string{"model"}, status: 200,
+		resp: apiObject{"runs": []EvalRun{}}},
+	{method: "POST", path: "/admin/evals/{name}/run", summary: "Run an eval suite now", admin: true, status: 200,
+		resp: apiObject{"runs": []EvalRun{}}},
+	{method: "GET", path: "/admin/scheduled-prompts", summary: "Scheduled prompts with their next and latest runs", admin: true, status: 200,
+		resp: apiObject{"prompts": []ScheduledPromptStatus{}}},
+	{method: "POST", path: "/admin/scheduled-prompts/{name}/run", summary: "Run a scheduled prompt now", admin: true, status: 200, resp: PromptRun{}},
+	{method: "GET", path: "/admin/agents", summary: "Usage of recently seen agents", admin: true, query: []string{"client"}, status: 200,
+		resp: apiObject{"agents": []AgentStats{}}},
+}
+
+// openAPIDocument builds the OpenAPI 3 description of apiOps.
+func openAPIDocument() map[string]any {
+	g := &schemaGen{defs: map[string]any{}}
+	errResp := map[string]any{"description": "Error", "content": map[string]any{
+		"application/json": map[string]any{"schema": g.of(reflect.TypeOf(apiError{}))}}}
+	paths := map[string]any{}
+	for _, op := range apiOps {
+		o := map[string]any{"summary": op.summary, "tags": []string{"proxy"}}
+		if op.admin {
+			o["tags"] = []string{"admin"}
+			o["security"] = []any{map[string]any{"adminToken": []string{}}}
+		}
+		var params []any
+		for _, seg := range strings.Split(op.path, "/") {
+			if name, ok := strings.CutPrefix(seg, "{"); ok {
+				params = append(params, map[string]any{"name": strings.TrimSuffix(name, "}"), "in": "path",
+					"required": true, "schema": map[string]any{"type": "string"}})
+			}
+		}
+		for _, q := range op.query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.body != nil {
+			o["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": g.value(op.body)}}}
+		}
+		ok := map[string]any{"description": http.StatusText(op.status)}
+		if op.resp != nil {
+			media := op.media
+			if media == "" {
+				media = "application/json"
+			}
+			ok["content"] = map[string]any{media: map[string]any{"schema": g.value(op.resp)}}
+		}
+		o["responses"] = map[string]any{strconv.Itoa(op.status): ok, "default": errResp}
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "zai-proxy",
+			"version": "1",
+			"description": "The proxy's own endpoints. Every other path is forwarded to the " +
+				"configured upstream through the route stages.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         g.defs,
+			"securitySchemes": map[string]any{"adminToken": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// openAPIHandler serves the document, built once.
+func openAPIHandler() http.HandlerFunc {
+	doc := openAPIDocument()
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
+
+// schemaGen derives JSON schemas from Go types, collecting named structs
+// under components.
+type schemaGen struct {
+	defs map[string]any
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(Duration(0))
+	rawType      = reflect.TypeOf(json.RawMessage(nil))
+	exprType     = reflect.TypeOf(exprField{})
+	templateType = reflect.TypeOf(promptTemplate{})
+)
+
+func (g *schemaGen) value(v any) map[string]any {
+	if obj, ok := v.(apiObject); ok {
+		props := map[string]any{}
+		for k, e := range obj {
+			props[k] = g.value(e)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return g.of(reflect.TypeOf(v))
+}
+
+func (g *schemaGen) of(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "string", "example": "30s"}
+	case rawType:
+		return map[string]any{}
+	case exprType:
+		return map[string]any{"type": "string", "description": "expression"}
+	case templateType:
+		return map[string]any{"type": "string", "description": "template with {{ expression }} parts"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.of(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		// Schema names are public even when the Go type is not.
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, done := g.defs[name]; !done {
+			g.defs[name] = map[string]any{} // placeholder for recursive types
+			g.defs[name] = g.object(t)
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+// object lists a struct's JSON fields, inlining embedded structs as
+// encoding/json does.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if tag == "-" || !f.IsExported() && !f.Anonymous {
+				continue
+			}
+			if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			name := tag
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.of(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	s := map[string]any{"type": "object", "properties": props}
+	if required != nil {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
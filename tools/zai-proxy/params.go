@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParamPolicy constrains a client's sampling parameters. MaxTokens caps
+// max_tokens (and max_completion_tokens), Ranges bounds numeric fields such
+// as temperature or top_p, and Forbid lists fields that may not be sent.
+// Enforce is "adjust" (the default: clamp or drop offending values) or
+// "reject" (fail the request with a description of the violation).
+type ParamPolicy struct {
+	MaxTokens int64                 `json:"max_tokens,omitempty"`
+	Ranges    map[string]ParamRange `json:"ranges,omitempty"`
+	Forbid    []string              `json:"forbid,omitempty"`
+	Enforce   string                `json:"enforce,omitempty"`
+}
+
+// ParamRange bounds a numeric parameter; a nil end is open.
+type ParamRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+func (p *ParamPolicy) validate() error {
+	if p.Enforce != "" && p.Enforce != "adjust" && p.Enforce != "reject" {
+		return fmt.Errorf("unknown enforce %q (want adjust or reject)", p.Enforce)
+	}
+	if p.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative")
+	}
+	for name, r := range p.Ranges {
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("ranges %q: min exceeds max", name)
+		}
+	}
+	return nil
+}
+
+// PolicyError lists the parameters a rejected request violated.
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return "request violates parameter policy: " + strings.Join(e.Violations, "; ")
+}
+
+// enforce checks doc against the policy, adjusting it in place or returning
+// a *PolicyError, and reports whether doc changed.
+func (p *ParamPolicy) enforce(doc map[string]any) (bool, error) {
+	reject := p.Enforce == "reject"
+	changed := false
+	var violations []string
+
+	for _, name := range p.Forbid {
+		if _, ok := doc[name]; !ok {
+			continue
+		}
+		if reject {
+			violations = append(violations, name+" is not permitted")
+		} else {
+			delete(doc, name)
+			changed = true
+		}
+	}
+
+	names := make([]string, 0, len(p.Ranges))
+	for name := range p.Ranges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := jsonNumber(doc[name])
+		if !ok {
+			continue
+		}
+		r := p.Ranges[name]
+		c := v
+		if r.Min != nil {
+			c = max(c, *r.Min)
+		}
+		if r.Max != nil {
+			c = min(c, *r.Max)
+		}
+		if c == v {
+			continue
+		}
+		if reject {
+			violations = append(violations, fmt.Sprintf("%s must be within %s", name, r))
+		} else {
+			doc[name] = c
+			changed = true
+		}
+	}
+
+	if p.MaxTokens > 0 {
+		present := false
+		for _, name := range []string{"max_tokens", "max_completion_tokens"} {
+			v, ok := jsonNumber(doc[name])
+			if !ok {
+				continue
+			}
+			present = true
+			if v <= float64(p.MaxTokens) {
+				continue
+			}
+			if reject {
+				violations = append(violations, fmt.Sprintf("%s must be at most %d", name, p.MaxTokens))
+			} else {
+				doc[name] = p.MaxTokens
+				changed = true
+			}
+		}
+		if !present {
+			doc["max_tokens"] = p.MaxTokens
+			changed = true
+		}
+	}
+
+	if len(violations) > 0 {
+		return false, &PolicyError{Violations: violations}
+	}
+	return changed, nil
+}
+
+func (r ParamRange) String() string {
+	lo, hi := "-inf", "+inf"
+	if r.Min != nil {
+		lo = fmt.Sprint(*r.Min)
+	}
+	if r.Max != nil {
+		hi = fmt.Sprint(*r.Max)
+	}
+	return "[" + lo + ", " + hi + "]"
+}
+
+func jsonNumber(v any) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
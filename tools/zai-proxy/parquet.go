@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// A minimal Parquet writer: one row group, one uncompressed PLAIN data page
+// per column, all columns REQUIRED. That is enough for flat export tables
+// and keeps the proxy free of third-party dependencies.
+
+type parquetType int32
+
+const (
+	parquetInt64     parquetType = 2
+	parquetDouble    parquetType = 5
+	parquetByteArray parquetType = 6
+)
+
+// parquetColumn is one column of values; exactly one slice is used,
+// matching Type.
+type parquetColumn struct {
+	Name    string
+	Type    parquetType
+	UTF8    bool // annotate a BYTE_ARRAY as a string
+	Millis  bool // annotate an INT64 as a millisecond timestamp
+	Int64s  []int64
+	Doubles []float64
+	Strings []string
+}
+
+func (c *parquetColumn) len() int {
+	switch c.Type {
+	case parquetInt64:
+		return len(c.Int64s)
+	case parquetDouble:
+		return len(c.Doubles)
+	default:
+		return len(c.Strings)
+	}
+}
+
+func (c *parquetColumn) plain() []byte {
+	var b bytes.Buffer
+	var n [8]byte
+	switch c.Type {
+	case parquetInt64:
+		for _, v := range c.Int64s {
+			binary.LittleEndian.PutUint64(n[:], uint64(v))
+			b.Write(n[:])
+		}
+	case parquetDouble:
+		for _, v := range c.Doubles {
+			binary.LittleEndian.PutUint64(n[:], math.Float64bits(v))
+			b.Write(n[:])
+		}
+	default:
+		for _, v := range c.Strings {
+			binary.LittleEndian.PutUint32(n[:4], uint32(len(v)))
+			b.Write(n[:4])
+			b.WriteString(v)
+		}
+	}
+	return b.Bytes()
+}
+
+// writeParquet writes cols, which must all have the same length, as a
+// Parquet file.
+func writeParquet(w io.Writer, cols []parquetColumn) error {
+	rows := 0
+	if len(cols) > 0 {
+		rows = cols[0].len()
+	}
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset int64
+		size   int64
+	}
+	chunks := make([]chunk, len(cols))
+	for i := range cols {
+		data := cols[i].plain()
+		var page thriftWriter
+		page.i32(1, 0) // DATA_PAGE
+		page.i32(2, int32(len(data)))
+		page.i32(3, int32(len(data)))
+		page.beginStruct(5)
+		page.i32(1, int32(rows))
+		page.i32(2, 0) // PLAIN
+		page.i32(3, 3) // RLE
+		page.i32(4, 3) // RLE
+		page.endStruct()
+		page.stop()
+
+		chunks[i].offset = int64(file.Len())
+		file.Write(page.buf.Bytes())
+		file.Write(data)
+		chunks[i].size = int64(file.Len()) - chunks[i].offset
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.beginList(2, thriftStruct, len(cols)+1)
+	meta.beginElem()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(cols)))
+	meta.endElem()
+	for _, c := range cols {
+		meta.beginElem()
+		meta.i32(1, int32(c.Type))
+		meta.i32(3, 0) // REQUIRED
+		meta.binary(4, c.Name)
+		switch {
+		case c.UTF8:
+			meta.i32(6, 0) // UTF8
+		case c.Millis:
+			meta.i32(6, 9) // TIMESTAMP_MILLIS
+		}
+		meta.endElem()
+	}
+	meta.i64(3, int64(rows))
+	meta.beginList(4, thriftStruct, 1)
+	meta.beginElem()
+	var total int64
+	for _, ch := range chunks {
+		total += ch.size
+	}
+	meta.beginList(1, thriftStruct, len(cols))
+	for i, c := range cols {
+		meta.beginElem()
+		meta.i64(2, chunks[i].offset)
+		meta.beginStruct(3)
+		meta.i32(1, int32(c.Type))
+		meta.beginList(2, thriftI32, 1)
+		meta.varint(0) // PLAIN
+		meta.beginList(3, thriftBinary, 1)
+		meta.rawBinary(c.Name)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(rows))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endElem()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(rows))
+	meta.endElem()
+	meta.binary(6, "zai-proxy")
+	meta.stop()
+
+	file.Write(meta.buf.Bytes())
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(meta.buf.Len()))
+	file.Write(n[:])
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// Thrift compact protocol, just the parts Parquet metadata needs.
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.rawBinary(s)
+}
+
+func (t *thriftWriter) rawBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) beginList(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
+
+// beginStruct opens a struct-typed field; beginElem opens a struct that is
+// a list element.
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElem()
+}
+
+func (t *thriftWriter) beginElem() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() { t.endElem() }
+
+func (t *thriftWriter) endElem() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
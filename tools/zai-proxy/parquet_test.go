@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestWriteParquet writes tables and reads them back the way a Parquet
+// reader would: footer, schema, and each column's page from the offset
+// its metadata gives.
+func TestWriteParquet(t *testing.T) {
+	wide := make([]parquetColumn, 16) // a schema list past the short header
+	for i := range wide {
+		wide[i] = parquetColumn{Name: "c" + strconv.Itoa(i), Type: parquetInt64, Int64s: []int64{int64(i), -int64(i)}}
+	}
+	for _, tc := range []struct {
+		name string
+		cols []parquetColumn
+	}{
+		{"mixed", []parquetColumn{
+			{Name: "id", Type: parquetByteArray, UTF8: true, Strings: []string{"r1", "", "ünïcode"}},
+			{Name: "time", Type: parquetInt64, Millis: true, Int64s: []int64{1767225600000, 0, -1}},
+			{Name: "cost", Type: parquetDouble, Doubles: []float64{0.5, math.Inf(1), -0.125}},
+			{Name: "raw", Type: parquetByteArray, Strings: []string{"\x00\xff", "b", "c"}},
+		}},
+		{"no rows", []parquetColumn{{Name: "id", Type: parquetByteArray, UTF8: true}}},
+		{"wide", wide},
+	} {
+		var buf bytes.Buffer
+		if err := writeParquet(&buf, tc.cols); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readTestParquet(buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		want := make([]parquetColumn, len(tc.cols))
+		for i, c := range tc.cols {
+			want[i] = parquetColumn{Name: c.Name, Type: c.Type, UTF8: c.UTF8, Millis: c.Millis}
+			switch c.Type {
+			case parquetInt64:
+				want[i].Int64s = append([]int64{}, c.Int64s...)
+			case parquetDouble:
+				want[i].Doubles = append([]float64{}, c.Doubles...)
+			default:
+				want[i].Strings = append([]string{}, c.Strings...)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: read back\n%+v\nwant\n%+v", tc.name, got, want)
+		}
+	}
+}
+
+// TestWriteUsageParquet exports usage records and finds each field in
+// its column.
+func TestWriteUsageParquet(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	recs := []UsageRecord{
+		{ID: "r1", Time: at, Status: 200, Duration: 1500 * time.Millisecond, CostUSD: 0.25,
+			UsageKey: UsageKey{Client: "alice", Project: "web", Model: "glm-4.6", Provider: "zai"},
+			Usage:    Usage{PromptTokens: 100, CompletionTokens: 20, CachedTokens: 10, CacheWriteTokens: 4}},
+		{ID: "r2", Time: at.Add(time.Minute), Status: 500, UsageKey: UsageKey{Client: "bob", Model: "gpt-5", Provider: "azure"}},
+	}
+	var buf bytes.Buffer
+	if err := writeUsageParquet(&buf, recs); err != nil {
+		t.Fatal(err)
+	}
+	cols, err := readTestParquet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]parquetColumn{}
+	for _, c := range cols {
+		byName[c.Name] = c
+	}
+	for name, want := range map[string]any{
+		"id":                 []string{"r1", "r2"},
+		"time":               []int64{at.UnixMilli(), at.Add(time.Minute).UnixMilli()},
+		"client":             []string{"alice", "bob"},
+		"project":            []string{"web", ""},
+		"model":              []string{"glm-4.6", "gpt-5"},
+		"provider":           []string{"zai", "azure"},
+		"status":             []int64{200, 500},
+		"duration_ms":        []int64{1500, 0},
+		"prompt_tokens":      []int64{100, 0},
+		"completion_tokens":  []int64{20, 0},
+		"cached_tokens":      []int64{10, 0},
+		"cache_write_tokens": []int64{4, 0},
+		"cost_usd":           []float64{0.25, 0},
+	} {
+		c, ok := byName[name]
+		var got any
+		switch c.Type {
+		case parquetInt64:
+			got = c.Int64s
+		case parquetDouble:
+			got = c.Doubles
+		default:
+			got = c.Strings
+		}
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("column %s = %v, want %v", name, got, want)
+		}
+	}
+	if !byName["time"].Millis || !byName["id"].UTF8 {
+		t.Errorf("time or id column lost its annotation")
+	}
+	if len(cols) != 13 {
+		t.Errorf("%d columns, want 13", len(cols))
+	}
+}
+
+// TestThriftFieldIDs checks field ids are written as deltas where they
+// fit and in full where they don't, and nested structs resume their
+// parent's numbering.
+func TestThriftFieldIDs(t *testing.T) {
+	var w thriftWriter
+	w.i32(1, -7)
+	w.beginStruct(3)
+	w.i64(20, math.MaxInt64)
+	w.endStruct()
+	w.binary(4, "x")
+	w.i32(40, math.MinInt32)
+	w.stop()
+	got, err := (&testThrift{b: w.buf.Bytes()}).structure()
+	want := map[int16]any{1: int64(-7), 3: map[int16]any{20: int64(math.MaxInt64)}, 4: "x", 40: int64(math.MinInt32)}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("read back %v, %v; want %v", got, err, want)
+	}
+}
+
+// readTestParquet decodes what writeParquet writes, checking the footer's
+// bookkeeping against the file as it goes.
+func readTestParquet(b []byte) ([]parquetColumn, error) {
+	if len(b) < 12 || string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		return nil, fmt.Errorf("no PAR1 magic")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if n > len(b)-12 {
+		return nil, fmt.Errorf("footer length %d past the file", n)
+	}
+	meta, err := (&testThrift{b: b[len(b)-8-n : len(b)-8]}).structure()
+	if err != nil {
+		return nil, fmt.Errorf("footer: %v", err)
+	}
+	schema, _ := meta[2].([]any)
+	groups, _ := meta[4].([]any)
+	rows, _ := meta[3].(int64)
+	if len(schema) == 0 || len(groups) != 1 {
+		return nil, fmt.Errorf("%d schema elements and %d row groups", len(schema), len(groups))
+	}
+	root := schema[0].(map[int16]any)
+	group := groups[0].(map[int16]any)
+	chunks, _ := group[1].([]any)
+	if root[5] != int64(len(schema)-1) || len(chunks) != len(schema)-1 || group[3] != rows {
+		return nil, fmt.Errorf("root %v and row group %v disagree with the schema", root, group)
+	}
+	var cols []parquetColumn
+	var total int64
+	for i, el := range schema[1:] {
+		el := el.(map[int16]any)
+		cm := chunks[i].(map[int16]any)[3].(map[int16]any)
+		name, _ := el[4].(string)
+		typ, _ := el[1].(int64)
+		if el[3] != int64(0) || cm[1] != typ || !reflect.DeepEqual(cm[3], []any{name}) || cm[4] != int64(0) || cm[5] != rows {
+			return nil, fmt.Errorf("column %s: schema %v and metadata %v disagree", name, el, cm)
+		}
+		c := parquetColumn{Name: name, Type: parquetType(typ), UTF8: el[6] == int64(0), Millis: el[6] == int64(9)}
+		off, size := cm[9].(int64), cm[7].(int64)
+		if off < 4 || size < 0 || off+size > int64(len(b)-8-n) || cm[6] != size {
+			return nil, fmt.Errorf("column %s: chunk of %d at %d outside the data", name, size, off)
+		}
+		total += size
+		r := &testThrift{b: b[off : off+size]}
+		page, err := r.structure()
+		if err != nil {
+			return nil, fmt.Errorf("column %s page header: %v", name, err)
+		}
+		dph, _ := page[5].(map[int16]any)
+		data := r.b
+		if page[1] != int64(0) || page[3] != int64(len(data)) || page[2] != int64(len(data)) || dph[1] != rows || dph[2] != int64(0) {
+			return nil, fmt.Errorf("column %s: page header %v for %d bytes", name, page, len(data))
+		}
+		for j := int64(0); j < rows; j++ {
+			switch c.Type {
+			case parquetInt64, parquetDouble:
+				if len(data) < 8 {
+					return nil, fmt.Errorf("column %s: short page", name)
+				}
+				v := binary.LittleEndian.Uint64(data)
+				if c.Type == parquetInt64 {
+					c.Int64s = append(c.Int64s, int64(v))
+				} else {
+					c.Doubles = append(c.Doubles, math.Float64frombits(v))
+				}
+				data = data[8:]
+			default:
+				if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+					return nil, fmt.Errorf("column %s: short page", name)
+				}
+				l := 4 + int(binary.LittleEndian.Uint32(data))
+				c.Strings = append(c.Strings, string(data[4:l]))
+				data = data[l:]
+			}
+		}
+		if len(data) != 0 {
+			return nil, fmt.Errorf("column %s: %d bytes past its values", name, len(data))
+		}
+		if rows == 0 {
+			switch c.Type {
+			case parquetInt64:
+				c.Int64s = []int64{}
+			case parquetDouble:
+				c.Doubles = []float64{}
+			default:
+				c.Strings = []string{}
+			}
+		}
+		cols = append(cols, c)
+	}
+	if group[2] != total {
+		return nil, fmt.Errorf("row group size %v, chunks add to %d", group[2], total)
+	}
+	return cols, nil
+}
+
+// testThrift reads the Thrift compact protocol: structs as maps by field
+// id, lists as slices, integers as int64 and binaries as strings.
+type testThrift struct{ b []byte }
+
+func (r *testThrift) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, fmt.Errorf("bad varint")
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *testThrift) byte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, fmt.Errorf("unexpected end")
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c, nil
+}
+
+func (r *testThrift) structure() (map[int16]any, error) {
+	m := map[int16]any{}
+	var last int16
+	for {
+		h, err := r.byte()
+		if err != nil || h == 0 {
+			return m, err
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			v, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(int64(v>>1) ^ -int64(v&1))
+		}
+		if m[id], err = r.value(h & 0x0f); err != nil {
+			return nil, fmt.Errorf("field %d: %v", id, err)
+		}
+		last = id
+	}
+}
+
+func (r *testThrift) value(typ byte) (any, error) {
+	switch typ {
+	case thriftI32, thriftI64:
+		v, err := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1), err
+	case thriftBinary:
+		n, err := r.uvarint()
+		if err != nil || n > uint64(len(r.b)) {
+			return nil, fmt.Errorf("bad binary")
+		}
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s, nil
+	case thriftList:
+		h, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(h >> 4)
+		if n == 15 {
+			if n, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		l := []any{}
+		for ; n > 0; n-- {
+			v, err := r.value(h & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, nil
+	case thriftStruct:
+		return r.structure()
+	}
+	return nil, fmt.Errorf("unexpected type %d", typ)
+}
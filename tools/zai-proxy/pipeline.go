@@ -0,0 +1,346 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PipelineConfig is a multi-call workflow run by POST /v1/pipelines/{name},
+// e.g. draft, critique, revise. Steps run in order; each sends one chat
+// request through the proxy and its answer feeds later steps. Prompts are
+// templates whose {{ }} parts are expressions over:
+//
+//	input        the caller's input text
+//	vars         the caller's variables
+//	steps.NAME   a finished step: output, status, attempts
+//	output       the current step's answer (in until and next only)
+//
+// A step whose When is false is skipped. Until is checked after each
+// answer and the step is retried, up to Retries times, while it is false or
+// the call failed. Next branches: the first entry whose When holds (or has
+// none) jumps to its Goto step, "end" finishing the run. Runs stop after
+// MaxSteps (default 20) steps so loops terminate. Output is the result
+// template, the last answer by default.
+type PipelineConfig struct {
+	Path     string         `json:"path,omitempty"`
+	Model    string         `json:"model,omitempty"`
+	MaxSteps int            `json:"max_steps,omitempty"`
+	Output   promptTemplate `json:"output,omitempty"`
+	Steps    []PipelineStep `json:"steps"`
+}
+
+// PipelineStep is one call of a pipeline; Model defaults to the
+// pipeline's.
+type PipelineStep struct {
+	Name      string           `json:"name"`
+	Model     string           `json:"model,omitempty"`
+	System    promptTemplate   `json:"system,omitempty"`
+	Prompt    promptTemplate   `json:"prompt"`
+	MaxTokens int              `json:"max_tokens,omitempty"`
+	When      exprField        `json:"when,omitempty"`
+	Until     exprField        `json:"until,omitempty"`
+	Retries   int              `json:"retries,omitempty"`
+	Next      []PipelineBranch `json:"next,omitempty"`
+}
+
+// PipelineBranch moves a run to another step.
+type PipelineBranch struct {
+	When exprField `json:"when,omitempty"`
+	Goto string    `json:"goto"`
+}
+
+const pipelinesPath = "/v1/pipelines"
+
+func (c *PipelineConfig) validate(name string) error {
+	if len(c.Steps) == 0 {
+		return fmt.Errorf("pipeline %s: steps are required", name)
+	}
+	if c.MaxSteps < 0 {
+		return fmt.Errorf("pipeline %s: max_steps must not be negative", name)
+	}
+	index := map[string]bool{}
+	for i, s := range c.Steps {
+		if s.Name == "" || s.Name == "end" || index[s.Name] {
+			return fmt.Errorf("pipeline %s: step %d needs a unique name other than \"end\"", name, i)
+		}
+		index[s.Name] = true
+		if cmp.Or(s.Model, c.Model) == "" {
+			return fmt.Errorf("pipeline %s: step %s needs a model", name, s.Name)
+		}
+		if s.Prompt.empty() {
+			return fmt.Errorf("pipeline %s: step %s needs a prompt", name, s.Name)
+		}
+		if s.Retries < 0 || s.MaxTokens < 0 {
+			return fmt.Errorf("pipeline %s: step %s: retries and max_tokens must not be negative", name, s.Name)
+		}
+	}
+	for _, s := range c.Steps {
+		for _, b := range s.Next {
+			if b.Goto != "end" && !index[b.Goto] {
+				return fmt.Errorf("pipeline %s: step %s branches to unknown step %q", name, s.Name, b.Goto)
+			}
+		}
+	}
+	return nil
+}
+
+// promptTemplate is text with {{ expression }} parts; it is written in
+// config as a JSON string.
+type promptTemplate struct {
+	src   string
+	text  []string // len(exprs)+1 literal pieces around the expressions
+	exprs []*Expr
+}
+
+func (t *promptTemplate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("template must be a string: %w", err)
+	}
+	*t = promptTemplate{src: s}
+	for {
+		open := strings.Index(s, "{{")
+		if open < 0 {
+			break
+		}
+		end := strings.Index(s[open:], "}}")
+		if end < 0 {
+			return fmt.Errorf("template %q: unclosed {{", t.src)
+		}
+		e, err := compileExpr(strings.TrimSpace(s[open+2 : open+end]))
+		if err != nil {
+			return err
+		}
+		t.text, t.exprs = append(t.text, s[:open]), append(t.exprs, e)
+		s = s[open+end+2:]
+	}
+	t.text = append(t.text, s)
+	return nil
+}
+
+func (t promptTemplate) MarshalJSON() ([]byte, error) { return json.Marshal(t.src) }
+
+func (t *promptTemplate) empty() bool { return t.src == "" }
+
+// render fills in the template's expressions from env.
+func (t *promptTemplate) render(env map[string]any) (string, error) {
+	if len(t.exprs) == 0 {
+		return t.src, nil
+	}
+	var b strings.Builder
+	for i, e := range t.exprs {
+		b.WriteString(t.text[i])
+		v, err := e.Text(env)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	b.WriteString(t.text[len(t.text)-1])
+	return b.String(), nil
+}
+
+// PipelineRun is what a caller sends to run a pipeline.
+type PipelineRun struct {
+	Input string         `json:"input"`
+	Vars  map[string]any `json:"vars,omitempty"`
+}
+
+// PipelineStepResult is one executed step; a step run again by a branch
+// appears once per run.
+type PipelineStepResult struct {
+	Name     string   `json:"name"`
+	Model    string   `json:"model,omitempty"`
+	Skipped  bool     `json:"skipped,omitempty"`
+	Status   int      `json:"status,omitempty"`
+	Attempts int      `json:"attempts,omitempty"`
+	Output   string   `json:"output,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Duration Duration `json:"duration"`
+}
+
+// PipelineResult is a finished run.
+type PipelineResult struct {
+	Pipeline string               `json:"pipeline"`
+	Output   string               `json:"output"`
+	Error    string               `json:"error,omitempty"`
+	Steps    []PipelineStepResult `json:"steps"`
+	Duration Duration             `json:"duration"`
+}
+
+// runPipeline executes c for r's caller, sending every step through mux.
+func runPipeline(mux *http.ServeMux, r *http.Request, name string, c *PipelineConfig, in PipelineRun) PipelineResult {
+	start := time.Now()
+	res := PipelineResult{Pipeline: name, Steps: []PipelineStepResult{}}
+	steps := map[string]any{}
+	env := map[string]any{"input": in.Input, "vars": in.Vars, "steps": steps}
+	index := map[string]int{}
+	for i, s := range c.Steps {
+		index[s.Name] = i
+	}
+	path := cmp.Or(c.Path, "/v1/chat/completions")
+	last := ""
+	for i, n := 0, 0; i < len(c.Steps) && res.Error == ""; n++ {
+		if limit := cmp.Or(c.MaxSteps, 20); n >= limit {
+			res.Error = fmt.Sprintf("stopped after %d steps", limit)
+			break
+		}
+		s := &c.Steps[i]
+		delete(env, "output")
+		if s.When.Expr != nil {
+			if ok, err := s.When.Bool(env); err != nil || !ok {
+				res.Steps = append(res.Steps, PipelineStepResult{Name: s.Name, Skipped: true})
+				if err != nil {
+					res.Error = fmt.Sprintf("step %s: %v", s.Name, err)
+				}
+				i++
+				continue
+			}
+		}
+		sr := runPipelineStep(mux, r, path, c, s, env)
+		res.Steps = append(res.Steps, sr)
+		if sr.Error != "" {
+			res.Error = fmt.Sprintf("step %s: %s", s.Name, sr.Error)
+			break
+		}
+		last = sr.Output
+		steps[s.Name] = map[string]any{"output": sr.Output, "status": float64(sr.Status), "attempts": float64(sr.Attempts)}
+		env["output"] = sr.Output
+		i++
+		for _, b := range s.Next {
+			ok := b.When.Expr == nil
+			if !ok {
+				var err error
+				if ok, err = b.When.Bool(env); err != nil {
+					res.Error = fmt.Sprintf("step %s: %v", s.Name, err)
+					break
+				}
+			}
+			if ok {
+				i = len(c.Steps)
+				if b.Goto != "end" {
+					i = index[b.Goto]
+				}
+				break
+			}
+		}
+	}
+	res.Output = last
+	if res.Error == "" && !c.Output.empty() {
+		delete(env, "output")
+		out, err := c.Output.render(env)
+		if err != nil {
+			res.Error = "output: " + err.Error()
+		}
+		res.Output = out
+	}
+	res.Duration = Duration(time.Since(start))
+	return res
+}
+
+// runPipelineStep sends one step, retrying failed and unsatisfying answers.
+func runPipelineStep(mux *http.ServeMux, r *http.Request, path string, c *PipelineConfig, s *PipelineStep, env map[string]any) PipelineStepResult {
+	start := time.Now()
+	sr := PipelineStepResult{Name: s.Name, Model: cmp.Or(s.Model, c.Model)}
+	defer func() { sr.Duration = Duration(time.Since(start)) }()
+	var msgs []any
+	if !s.System.empty() {
+		system, err := s.System.render(env)
+		if err != nil {
+			sr.Error = "system: " + err.Error()
+			return sr
+		}
+		msgs = append(msgs, map[string]any{"role": "system", "content": system})
+	}
+	prompt, err := s.Prompt.render(env)
+	if err != nil {
+		sr.Error = "prompt: " + err.Error()
+		return sr
+	}
+	doc := map[string]any{"stream": false, "messages": append(msgs, map[string]any{"role": "user", "content": prompt})}
+	if s.MaxTokens > 0 {
+		doc["max_tokens"] = s.MaxTokens
+	}
+	for sr.Attempts = 1; ; sr.Attempts++ {
+		if err := r.Context().Err(); err != nil {
+			sr.Error = err.Error()
+			return sr
+		}
+		sr.Error = ""
+		res := fanoutOne(mux, r, path, doc, 0, sr.Model, nil)
+		sr.Status = res.Status
+		v, _ := decodeJSON(res.Response)
+		d, _ := v.(map[string]any)
+		switch {
+		case res.Error != "":
+			sr.Error = res.Error
+		case d == nil:
+			sr.Error = fmt.Sprintf("status %d: response is not a JSON object", res.Status)
+		case res.Status >= 300:
+			sr.Error = fmt.Sprintf("status %d", res.Status)
+		}
+		if sr.Error == "" {
+			sr.Output = responseText(d)
+			if s.Until.Expr == nil {
+				return sr
+			}
+			env["output"] = sr.Output
+			ok, err := s.Until.Bool(env)
+			delete(env, "output")
+			if err != nil {
+				sr.Error = "until: " + err.Error()
+				return sr
+			}
+			if ok {
+				return sr
+			}
+		}
+		if sr.Attempts > s.Retries {
+			if sr.Error == "" {
+				sr.Error = fmt.Sprintf("until still false after %d attempts", sr.Attempts)
+			}
+			return sr
+		}
+	}
+}
+
+// pipelinesHandler lists the pipelines and runs them for the caller.
+func pipelinesHandler(pipelines map[string]PipelineConfig, mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if name == "" {
+			out := []map[string]any{}
+			for name, c := range pipelines {
+				steps := make([]string, len(c.Steps))
+				for i, s := range c.Steps {
+					steps[i] = s.Name
+				}
+				out = append(out, map[string]any{"name": name, "steps": steps})
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+			writeJSON(w, http.StatusOK, map[string]any{"pipelines": out})
+			return
+		}
+		c, ok := pipelines[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "no such pipeline")
+			return
+		}
+		var in PipelineRun
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON pipeline run: "+err.Error())
+			return
+		}
+		res := runPipeline(mux, r, name, &c, in)
+		status := http.StatusOK
+		if res.Error != "" {
+			status = http.StatusBadGateway
+		}
+		writeJSON(w, status, res)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+)
+
+// WebAssembly plugins extend the proxy without forking it. A plugin module
+// exports any of these hooks, each taking a JSON document and returning one
+// (an empty result means "no change"):
+//
+//	on_request       {"client","project","model","method","path","headers","body"}
+//	on_response      {"client","model","status","body"}  (non-streaming JSON)
+//	on_stream_event  {"client","model","event"}          (each SSE payload)
+//
+// Results are a pluginResult. An optional init export receives the
+// plugin's config once at load. How arguments cross into guest memory is up
+// to the runtime; see wazeroRuntime for the built-in one's.
+
+// PluginConfig loads one plugin module. Runtime names a registered WASM
+// runtime and defaults to "wazero", which is built in.
+type PluginConfig struct {
+	Name    string          `json:"name"`
+	Path    string          `json:"path"`
+	Runtime string          `json:"runtime,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+// wasmRuntime compiles and instantiates plugin modules. A runtime is linked
+// in by a file that calls registerWASMRuntime from an init function, as
+// plugins_wazero.go does.
+type wasmRuntime interface {
+	Load(ctx context.Context, name string, wasm []byte) (wasmModule, error)
+}
+
+// wasmModule is an instantiated plugin. Call passes input to the named
+// export and returns its output; it must be safe for concurrent use.
+type wasmModule interface {
+	Has(export string) bool
+	Call(ctx context.Context, export string, input []byte) ([]byte, error)
+	Close(ctx context.Context) error
+}
+
+var wasmRuntimes = map[string]wasmRuntime{}
+
+func registerWASMRuntime(name string, rt wasmRuntime) {
+	wasmRuntimes[name] = rt
+}
+
+// pluginResult is what a hook returns. Action is "continue" (the default),
+// "reject" (fail the request with Status and Message) or, for stream
+// events, "drop". Body or Event replaces the document passed in.
+type pluginResult struct {
+	Action     string            `json:"action,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	Event      json.RawMessage   `json:"event,omitempty"`
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+}
+
+type plugin struct {
+	name string
+	mod  wasmModule
+}
+
+// loadPlugins instantiates every configured plugin.
+func loadPlugins(ctx context.Context, cfgs []PluginConfig) ([]*plugin, error) {
+	var out []*plugin
+	for _, pc := range cfgs {
+		rtName := pc.Runtime
+		if rtName == "" {
+			rtName = "wazero"
+		}
+		rt, ok := wasmRuntimes[rtName]
+		if !ok {
+			have := make([]string, 0, len(wasmRuntimes))
+			for n := range wasmRuntimes {
+				have = append(have, n)
+			}
+			sort.Strings(have)
+			return nil, fmt.Errorf("plugin %s: wasm runtime %q is not linked into this build (have %v)", pc.Name, rtName, have)
+		}
+		wasm, err := os.ReadFile(pc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", pc.Name, err)
+		}
+		mod, err := rt.Load(ctx, pc.Name, wasm)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", pc.Name, err)
+		}
+		if mod.Has("init") {
+			conf := pc.Config
+			if len(conf) == 0 {
+				conf = json.RawMessage("{}")
+			}
+			if _, err := mod.Call(ctx, "init", conf); err != nil {
+				mod.Close(ctx)
+				return nil, fmt.Errorf("plugin %s: init: %w", pc.Name, err)
+			}
+		}
+		out = append(out, &plugin{name: pc.Name, mod: mod})
+	}
+	return out, nil
+}
+
+// call runs one hook, returning nil when the plugin lacks it or made no
+// change.
+func (pl *plugin) call(ctx context.Context, hook string, in any) (*pluginResult, error) {
+	if !pl.mod.Has(hook) {
+		return nil, nil
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	out, err := pl.mod.Call(ctx, hook, b)
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	var res pluginResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("%s returned invalid JSON: %w", hook, err)
+	}
+	return &res, nil
+}
+
+// pluginsStage runs the route's plugins (all loaded plugins when the route
+// names none) over the request, the response and each stream event. A
+// failing plugin is logged and skipped rather than failing traffic.
+func pluginsStage(p *proxy, rc *RouteConfig) (Middleware, error) {
+	var pls []*plugin
+	for _, pl := range p.plugins {
+		if len(rc.Plugins) == 0 || slices.Contains(rc.Plugins, pl.name) {
+			pls = append(pls, pl)
+		}
+	}
+	for _, name := range rc.Plugins {
+		if !slices.ContainsFunc(pls, func(pl *plugin) bool { return pl.name == name }) {
+			return nil, fmt.Errorf("unknown plugin %q", name)
+		}
+	}
+	has := func(hook string) bool {
+		return slices.ContainsFunc(pls, func(pl *plugin) bool { return pl.mod.Has(hook) })
+	}
+	onRequest, onResponse, onEvent := has("on_request"), has("on_response"), has("on_stream_event")
+
+	return func(next http.Handler) http.Handler {
+		if len(pls) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			ctx := r.Context()
+			if onRequest {
+				if res := runRequestPlugins(ctx, pls, ex, r); res != nil {
+					writeError(w, pluginStatus(res), "plugin_rejected", res.Message)
+					return
+				}
+			}
+			if onResponse {
+				bw := &bufferedWriter{ResponseWriter: w, edit: func(status int, body []byte) (int, []byte) {
+					return runResponsePlugins(ctx, pls, ex, status, body)
+				}}
+				defer bw.finish()
+				w = bw
+			}
+			if onEvent {
+				sw := &sseWriter{ResponseWriter: w, line: eventEditor(func(doc map[string]any) (map[string]any, bool) {
+					return runEventPlugins(ctx, pls, ex, doc)
+				})}
+				defer sw.finish()
+				w = sw
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func pluginStatus(res *pluginResult) int {
+	if res.Status >= 400 && res.Status <= 599 {
+		return res.Status
+	}
+	return http.StatusForbidden
+}
+
+// runRequestPlugins applies on_request hooks in order, returning the result
+// of the first plugin that rejects the request.
+func runRequestPlugins(ctx context.Context, pls []*plugin, ex *exchange, r *http.Request) *pluginResult {
+	for _, pl := range pls {
+		in := map[string]any{
+			"client": ex.client, "project": ex.project, "model": ex.model,
+			"method": r.Method, "path": r.URL.Path, "headers": r.Header, "body": ex.doc,
+		}
+		res, err := pl.call(ctx, "on_request", in)
+		if err != nil {
+			log.Printf("Error running plugin %s: %v", pl.name, err)
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		if res.Action == "reject" {
+			if res.Message == "" {
+				res.Message = "request rejected by plugin " + pl.name
+			}
+			return res
+		}
+		for k, v := range res.SetHeaders {
+			r.Header.Set(k, v)
+		}
+		if len(res.Body) > 0 && ex.doc != nil {
+			var doc map[string]any
+			if v, err := decodeJSON(res.Body); err == nil {
+				doc, _ = v.(map[string]any)
+			}
+			if doc == nil {
+				log.Printf("Error running plugin %s: on_request body must be a JSON object", pl.name)
+				continue
+			}
+			ex.doc, ex.dirty = doc, true
+			ex.model, _ = doc["model"].(string)
+		}
+	}
+	return nil
+}
+
+// runResponsePlugins applies on_response hooks to a buffered JSON body.
+func runResponsePlugins(ctx context.Context, pls []*plugin, ex *exchange, status int, body []byte) (int, []byte) {
+	if !json.Valid(body) {
+		return status, body
+	}
+	for _, pl := range pls {
+		in := map[string]any{"client": ex.client, "model": ex.model, "status": status, "body": json.RawMessage(body)}
+		res, err := pl.call(ctx, "on_response", in)
+		if err != nil {
+			log.Printf("Error running plugin %s: %v", pl.name, err)
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		if res.Action == "reject" {
+			msg := res.Message
+			if msg == "" {
+				msg = "response rejected by plugin " + pl.name
+			}
+			b, _ := json.Marshal(apiError{Error: apiErrorDetail{Message: msg, Type: "plugin_rejected", Retry: &retryHint{}}})
+			return pluginStatus(res), b
+		}
+		if len(res.Body) > 0 {
+			body = res.Body
+		}
+		if res.Status != 0 {
+			status = res.Status
+		}
+	}
+	return status, body
+}
+
+// runEventPlugins applies on_stream_event hooks to one SSE payload.
+func runEventPlugins(ctx context.Context, pls []*plugin, ex *exchange, doc map[string]any) (map[string]any, bool) {
+	changed := false
+	for _, pl := range pls {
+		res, err := pl.call(ctx, "on_stream_event", map[string]any{"client": ex.client, "model": ex.model, "event": doc})
+		if err != nil {
+			log.Printf("Error running plugin %s: %v", pl.name, err)
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		if res.Action == "drop" || res.Action == "reject" {
+			return nil, true
+		}
+		if len(res.Event) > 0 {
+			v, err := decodeJSON(res.Event)
+			if m, ok := v.(map[string]any); err == nil && ok {
+				doc, changed = m, true
+			}
+		}
+	}
+	return doc, changed
+}
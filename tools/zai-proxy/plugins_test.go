@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWazeroPlugin loads a module through the built-in runtime and calls
+// its hooks: on_request rejects with a reply kept in a data segment, and
+// on_response echoes its input, so what it returns is what it was sent.
+func TestWazeroPlugin(t *testing.T) {
+	reject := `{"action":"reject","status":451,"message":"blocked by policy"}`
+	path := filepath.Join(t.TempDir(), "policy.wasm")
+	if err := os.WriteFile(path, testPluginModule(reject), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	pls, err := loadPlugins(ctx, []PluginConfig{{Name: "policy", Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := pls[0]
+	defer pl.mod.Close(ctx)
+	if pl.mod.Has("on_stream_event") || !pl.mod.Has("on_request") {
+		t.Errorf("Has reports the wrong exports")
+	}
+	res, err := pl.call(ctx, "on_request", map[string]any{"model": "glm-4.6"})
+	if err != nil || res == nil || res.Action != "reject" || res.Status != 451 || res.Message != "blocked by policy" {
+		t.Fatalf("on_request = %+v, %v; want %s", res, err, reject)
+	}
+	res, err = pl.call(ctx, "on_response", map[string]any{"status": 201, "body": json.RawMessage(`{"id":"x"}`)})
+	if err != nil || res == nil || res.Status != 201 || string(res.Body) != `{"id":"x"}` {
+		t.Fatalf("on_response = %+v, %v; want its input back", res, err)
+	}
+
+	if _, err := loadPlugins(ctx, []PluginConfig{{Name: "other", Path: path, Runtime: "v8"}}); err == nil {
+		t.Errorf("loadPlugins accepted a runtime that isn't linked in")
+	}
+}
+
+// testPluginModule assembles a module exporting memory, alloc (always
+// 4096), on_request returning reply and on_response returning its input.
+func testPluginModule(reply string) []byte {
+	const replyAt = 2048
+	section := func(id byte, items ...[]byte) []byte {
+		body := uleb(uint64(len(items)))
+		for _, it := range items {
+			body = append(body, it...)
+		}
+		return append(append([]byte{id}, uleb(uint64(len(body)))...), body...)
+	}
+	name := func(s string) []byte { return append(uleb(uint64(len(s))), s...) }
+	code := func(expr ...byte) []byte {
+		body := append([]byte{0}, expr...) // no locals
+		return append(uleb(uint64(len(body))), body...)
+	}
+	const (
+		i32, i64                                   = 0x7f, 0x7e
+		localGet, i32Const, i64Const, end          = 0x20, 0x41, 0x42, 0x0b
+		i64ExtendI32U, i64Shl, i64Or, funcExport   = 0xad, 0x86, 0x84, 0x00
+		memExport, funcType, activeMemory, onePage = 0x02, 0x60, 0x00, 0x01
+	)
+	var m []byte
+	m = append(m, 0, 'a', 's', 'm', 1, 0, 0, 0)
+	m = append(m, section(1,
+		[]byte{funcType, 1, i32, 1, i32},
+		[]byte{funcType, 2, i32, i32, 1, i64})...)
+	m = append(m, section(3, []byte{0}, []byte{1}, []byte{1})...)
+	m = append(m, section(5, []byte{0, onePage})...)
+	m = append(m, section(7,
+		append(name("memory"), memExport, 0),
+		append(name("alloc"), funcExport, 0),
+		append(name("on_request"), funcExport, 1),
+		append(name("on_response"), funcExport, 2))...)
+	m = append(m, section(10,
+		code(append(append([]byte{i32Const}, sleb(4096)...), end)...),
+		code(append(append([]byte{i64Const}, sleb(replyAt<<32|int64(len(reply)))...), end)...),
+		code(localGet, 0, i64ExtendI32U, i64Const, 32, i64Shl, localGet, 1, i64ExtendI32U, i64Or, end))...)
+	seg := append([]byte{activeMemory, i32Const}, sleb(replyAt)...)
+	seg = append(append(seg, end), name(reply)...)
+	return append(m, section(11, seg)...)
+}
+
+func uleb(v uint64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		if v >>= 7; v != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func sleb(v int64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
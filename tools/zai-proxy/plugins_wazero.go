@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wazeroRuntime runs plugins on wazero, a WebAssembly runtime in pure Go,
+// and is the one plugins get by default. Modules are WASI reactors, their
+// _initialize run at load, that export memory and alloc(size) returning
+// where the proxy may write that many bytes. Each hook takes the address
+// and length of its JSON input and returns its output's packed as
+// address<<32 | length, 0 for none. A dealloc(addr, size) export, if
+// there is one, is handed both back after every call. A module runs one
+// call at a time.
+type wazeroRuntime struct{}
+
+func init() {
+	registerWASMRuntime("wazero", wazeroRuntime{})
+}
+
+func (wazeroRuntime) Load(ctx context.Context, name string, wasm []byte) (wasmModule, error) {
+	rt := wazero.NewRuntime(ctx)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	mod, err := rt.InstantiateWithConfig(ctx, wasm, wazero.NewModuleConfig().
+		WithName(name).WithStartFunctions("_initialize").WithStdout(os.Stderr).WithStderr(os.Stderr))
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	m := &wazeroModule{rt: rt, mod: mod, alloc: mod.ExportedFunction("alloc"), dealloc: mod.ExportedFunction("dealloc")}
+	if mod.Memory() == nil || m.alloc == nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("module exports no memory or alloc")
+	}
+	return m, nil
+}
+
+type wazeroModule struct {
+	rt             wazero.Runtime
+	alloc, dealloc api.Function
+
+	mu  sync.Mutex
+	mod api.Module
+}
+
+func (m *wazeroModule) Has(export string) bool {
+	return m.mod.ExportedFunction(export) != nil
+}
+
+func (m *wazeroModule) Call(ctx context.Context, export string, input []byte) ([]byte, error) {
+	fn := m.mod.ExportedFunction(export)
+	if fn == nil {
+		return nil, fmt.Errorf("no %s export", export)
+	}
+	if def := fn.Definition(); len(def.ParamTypes()) != 2 || len(def.ResultTypes()) > 1 {
+		return nil, fmt.Errorf("%s must take (addr, len) and return at most one value", export)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, err := m.alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	in := uint32(res[0])
+	if !m.mod.Memory().Write(in, input) {
+		return nil, fmt.Errorf("alloc returned %#x, outside memory", in)
+	}
+	res, err = fn.Call(ctx, uint64(in), uint64(len(input)))
+	m.free(ctx, in, uint32(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 || res[0] == 0 {
+		return nil, nil
+	}
+	at, n := uint32(res[0]>>32), uint32(res[0])
+	out, ok := m.mod.Memory().Read(at, n)
+	if !ok {
+		return nil, fmt.Errorf("%s returned %d bytes at %#x, outside memory", export, n, at)
+	}
+	out = bytes.Clone(out)
+	m.free(ctx, at, n)
+	return out, nil
+}
+
+func (m *wazeroModule) free(ctx context.Context, addr, size uint32) {
+	if m.dealloc != nil {
+		m.dealloc.Call(ctx, uint64(addr), uint64(size))
+	}
+}
+
+func (m *wazeroModule) Close(ctx context.Context) error {
+	return m.rt.Close(ctx)
+}
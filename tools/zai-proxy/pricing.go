@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// ModelPrice holds USD rates per million tokens. CachedInput applies to
+// prompt tokens read from the provider's prompt cache and CacheWrite to
+// those written to it; when zero, such tokens are billed at the Input rate.
+type ModelPrice struct {
+	Input       float64 `json:"input"`
+	Output      float64 `json:"output"`
+	CachedInput float64 `json:"cached_input,omitempty"`
+	CacheWrite  float64 `json:"cache_write,omitempty"`
+}
+
+// PriceTable resolves a model name to its price. Keys are exact model names
+// or prefixes ending in "*"; the longest matching prefix wins and "*" alone
+// is the fallback.
+type PriceTable map[string]ModelPrice
+
+// Lookup returns the price for model and whether one was configured.
+func (t PriceTable) Lookup(model string) (ModelPrice, bool) {
+	if p, ok := t[model]; ok {
+		return p, true
+	}
+	best, found := "", false
+	for key := range t {
+		prefix, ok := strings.CutSuffix(key, "*")
+		if !ok || !strings.HasPrefix(model, prefix) {
+			continue
+		}
+		if !found || len(prefix) > len(best) {
+			best, found = prefix, true
+		}
+	}
+	if !found {
+		return ModelPrice{}, false
+	}
+	return t[best+"*"], true
+}
+
+// Cost returns the USD cost of u for model, or zero if the model is unpriced.
+// Cache reads and writes are parts of the prompt tokens, as usage counts
+// them for every provider.
+func (t PriceTable) Cost(model string, u Usage) float64 {
+	p, ok := t.Lookup(model)
+	if !ok {
+		return 0
+	}
+	cached := min(u.CachedTokens, u.PromptTokens)
+	written := min(u.CacheWriteTokens, u.PromptTokens-cached)
+	rate := func(r float64) float64 {
+		if r == 0 {
+			return p.Input
+		}
+		return r
+	}
+	return (float64(u.PromptTokens-cached-written)*p.Input +
+		float64(cached)*rate(p.CachedInput) +
+		float64(written)*rate(p.CacheWrite) +
+		float64(u.CompletionTokens)*p.Output) / 1e6
+}
+
+// matchModel reports whether model matches any of patterns, which are exact
+// names or prefixes ending in "*" as in PriceTable.
+func matchModel(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if p == model {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
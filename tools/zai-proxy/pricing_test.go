@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// TestCost prices usage blocks as providers send them: Anthropic's input
+// tokens leave out cache reads and writes, OpenAI's prompt tokens include
+// cache reads.
+func TestCost(t *testing.T) {
+	prices := PriceTable{
+		"claude-*": {Input: 3, Output: 15, CachedInput: 0.3, CacheWrite: 3.75},
+		"gpt-*":    {Input: 2, Output: 8, CachedInput: 0.5},
+		"glm-*":    {Input: 1, Output: 4},
+	}
+	for _, tc := range []struct {
+		name, model, usage string
+		want               float64 // in millionths of a dollar
+	}{
+		{"anthropic", "claude-sonnet-4-5",
+			`{"input_tokens":20,"output_tokens":4,"cache_read_input_tokens":16,"cache_creation_input_tokens":8}`,
+			20*3 + 16*0.3 + 8*3.75 + 4*15},
+		{"anthropic without cache", "claude-sonnet-4-5", `{"input_tokens":20,"output_tokens":4}`, 20*3 + 4*15},
+		{"openai", "gpt-5", `{"prompt_tokens":100,"completion_tokens":10,"prompt_tokens_details":{"cached_tokens":60}}`,
+			40*2 + 60*0.5 + 10*8},
+		{"cache rates unset", "glm-4.6",
+			`{"input_tokens":20,"output_tokens":4,"cache_read_input_tokens":16,"cache_creation_input_tokens":8}`, 44*1 + 4*4},
+		{"unpriced", "llama3", `{"prompt_tokens":100,"completion_tokens":10}`, 0},
+	} {
+		var raw rawUsage
+		if err := json.Unmarshal([]byte(tc.usage), &raw); err != nil {
+			t.Fatal(err)
+		}
+		if got := prices.Cost(tc.model, raw.usage()) * 1e6; math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: cost %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	// Cache counts past the prompt, which no provider sends, bill nothing
+	// below zero.
+	if got := prices.Cost("claude-x", Usage{PromptTokens: 10, CachedTokens: 8, CacheWriteTokens: 8}) * 1e6; math.Abs(got-(8*0.3+2*3.75)) > 1e-9 {
+		t.Errorf("overcounted cache: cost %v", got)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// priorityHeader names the tier a request asks to be served at.
+const priorityHeader = "X-Ringmaster-Priority"
+
+// priorityTiers are the tiers, highest first.
+var priorityTiers = []string{"high", "normal", "low"}
+
+// PriorityConfig lets a request name its tier with X-Ringmaster-Priority:
+// high, normal or low, among those its client may use (its priorities,
+// by default normal and low); requests naming none are Default (normal).
+// Background jobs of a higher tier run before those queued of lower ones.
+// While memory is short, low requests are shed from ShedMargin (default
+// 0.1) below the memory config's shed_at, and high ones only at the limit.
+// Requests of HedgeTiers (default high) to a pool member that hasn't
+// answered within Hedge (0 disables) are also sent to another member, and
+// the first answer is relayed.
+type PriorityConfig struct {
+	Default    string   `json:"default,omitempty"`
+	ShedMargin *float64 `json:"shed_margin,omitempty"`
+	Hedge      Duration `json:"hedge,omitempty"`
+	HedgeTiers []string `json:"hedge_tiers,omitempty"`
+}
+
+func (c *PriorityConfig) validate() error {
+	for _, t := range append([]string{c.Default}, c.HedgeTiers...) {
+		if t != "" && !slices.Contains(priorityTiers, t) {
+			return fmt.Errorf("priority: unknown tier %q (want high, normal or low)", t)
+		}
+	}
+	if c.ShedMargin != nil && (*c.ShedMargin < 0 || *c.ShedMargin > 1) {
+		return fmt.Errorf("priority: shed_margin must be between 0 and 1")
+	}
+	if c.Hedge < 0 {
+		return fmt.Errorf("priority: hedge must not be negative")
+	}
+	return nil
+}
+
+func validPriorities(tiers []string) error {
+	for _, t := range tiers {
+		if !slices.Contains(priorityTiers, t) {
+			return fmt.Errorf("priorities: unknown tier %q (want high, normal or low)", t)
+		}
+	}
+	return nil
+}
+
+var errPriorityNotAllowed = errors.New("priority not allowed")
+
+// of returns the tier r asks for on behalf of cl, which may be nil.
+func (c *PriorityConfig) of(r *http.Request, cl *ClientConfig) (string, error) {
+	tier := r.Header.Get(priorityHeader)
+	if tier == "" {
+		if c.Default != "" {
+			return c.Default, nil
+		}
+		return "normal", nil
+	}
+	if !slices.Contains(priorityTiers, tier) {
+		return "", fmt.Errorf("%s must be high, normal or low", priorityHeader)
+	}
+	allowed := []string{"normal", "low"}
+	if cl != nil && cl.Priorities != nil {
+		allowed = cl.Priorities
+	}
+	if tier != c.Default && !slices.Contains(allowed, tier) {
+		return "", fmt.Errorf("%w: this client can't send %s requests", errPriorityNotAllowed, tier)
+	}
+	return tier, nil
+}
+
+// requestPriority returns the tier of client's request r.
+func (p *proxy) requestPriority(r *http.Request, client string) (string, error) {
+	return p.cfg.Priority.of(r, p.registry.Client(client))
+}
+
+// writePriorityError answers a request naming a tier it can't have.
+func writePriorityError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPriorityNotAllowed) {
+		writeErrorDetail(w, http.StatusForbidden, apiErrorDetail{Message: err.Error(), Type: "priority_not_allowed", Param: priorityHeader})
+		return
+	}
+	writeErrorDetail(w, http.StatusBadRequest, apiErrorDetail{Message: err.Error(), Type: "invalid_request", Param: priorityHeader})
+}
+
+// shedAt returns the share of the memory limit from which requests of
+// tier are shed, given the configured threshold.
+func (c *PriorityConfig) shedAt(tier string, at float64) float64 {
+	switch tier {
+	case "high":
+		return 1
+	case "low":
+		margin := 0.1
+		if c.ShedMargin != nil {
+			margin = *c.ShedMargin
+		}
+		return max(at-margin, 0)
+	}
+	return at
+}
+
+var hedgedRequests = metrics.counter("zai_proxy_hedged_requests_total",
+	"Requests also sent to a second pool member, by whose answer was relayed: primary or hedge.", "winner")
+
+// hedges reports whether req, for ex, may be sent to a second member.
+func (p *proxy) hedges(ex *exchange, req *http.Request) bool {
+	c := &p.cfg.Priority
+	if c.Hedge == 0 || ex == nil || req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	tiers := c.HedgeTiers
+	if len(tiers) == 0 {
+		tiers = []string{"high"}
+	}
+	return slices.Contains(tiers, ex.priority) && p.memberOf(ex) != ""
+}
+
+// attempt is the outcome of sending a request.
+type attempt struct {
+	member string
+	req    *http.Request
+	resp   *http.Response
+	err    error
+	sent   time.Time
+	cancel context.CancelFunc
+}
+
+// hedge sends req, and a copy to another pool member if it hasn't been
+// answered within the hedge delay, returning the request answered first,
+// or last when neither succeeds. The other is cancelled.
+func (p *proxy) hedge(transport http.RoundTripper, req *http.Request, ex *exchange) attempt {
+	results := make(chan attempt, 2)
+	send := func(member string, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		a := attempt{member: member, req: r, sent: time.Now(), cancel: cancel}
+		a.resp, a.err = transport.RoundTrip(r.WithContext(ctx))
+		results <- a
+	}
+	base := targetBase(ex)
+	go send(base, req)
+	timer := time.NewTimer(time.Duration(p.cfg.Priority.Hedge))
+	defer timer.Stop()
+	select {
+	case a := <-results:
+		return keepOpen(a)
+	case <-timer.C:
+	}
+	alt := p.pool.alternative([]string{base})
+	if alt == "" {
+		return keepOpen(<-results)
+	}
+	target := alt + strings.TrimPrefix(ex.target, base)
+	u, err := url.Parse(target)
+	if err != nil {
+		return keepOpen(<-results)
+	}
+	second := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if second.Body, err = req.GetBody(); err != nil {
+			return keepOpen(<-results)
+		}
+	}
+	second.URL, second.Host = u, u.Host
+	second.Header.Set("Host", u.Host)
+	if err := p.authorize(second, target, ex.model); err != nil {
+		log.Printf("Error authenticating to %s: %v", upstreamOf(target), err)
+		return keepOpen(<-results)
+	}
+	debugf("Hedging %s %s for %s at %s after %s", req.Method, ex.path, ex.client, upstreamOf(target), time.Duration(p.cfg.Priority.Hedge))
+	go send(alt, second)
+
+	first := <-results
+	if first.err != nil {
+		p.recordAttempt(first)
+		first.cancel()
+		first = <-results
+	} else {
+		// The other is cut short; its outcome says nothing of its upstream.
+		go func() {
+			a := <-results
+			a.cancel()
+			if a.resp != nil {
+				a.resp.Body.Close()
+			}
+		}()
+	}
+	winner := "primary"
+	if first.req == second {
+		winner = "hedge"
+		ex.target = target
+	}
+	hedgedRequests.Add(1, winner)
+	return keepOpen(first)
+}
+
+// recordAttempt accounts an attempt hedging gave up on.
+func (p *proxy) recordAttempt(a attempt) {
+	p.upstreams.record(upstreamOf(a.req.URL.String()), a.resp, time.Since(a.sent), a.err)
+	p.pool.circuits.record(a.member, a.resp, a.err)
+	p.pool.health.record(a.member, a.resp, a.err, time.Since(a.sent))
+}
+
+// keepOpen leaves a's request context to be cancelled once its response
+// body is closed.
+func keepOpen(a attempt) attempt {
+	if a.resp == nil {
+		a.cancel()
+		return a
+	}
+	a.resp.Body = &cancelOnClose{ReadCloser: a.resp.Body, cancel: a.cancel}
+	return a
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
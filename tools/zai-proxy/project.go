@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// projectHeader tags a request with the project it is billed to, so usage
+// on shared keys can still be attributed.
+const projectHeader = "X-Ringmaster-Project"
+
+// requestProject returns the validated project tag, or "" when the header
+// is absent. Unknown projects are an error rather than silently untagged.
+func requestProject(cfg *Config, r *http.Request) (string, error) {
+	p := r.Header.Get(projectHeader)
+	if p == "" {
+		return "", nil
+	}
+	if !slices.Contains(cfg.Projects, p) {
+		return "", fmt.Errorf("unknown project %q in %s", p, projectHeader)
+	}
+	return p, nil
+}
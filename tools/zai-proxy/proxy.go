@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxy holds what the route stages share.
+type proxy struct {
+	cfg       *Config
+	apiKey    string
+	usage     *UsageTracker
+	store     Store
+	registry  *clientRegistry
+	quotas    *quotaChecker
+	billing   *billingEmitter
+	relay     *httputil.ReverseProxy
+	plugins   []*plugin
+	filters   []contentFilter
+	pool      *upstreamPool
+	flags     *featureFlags
+	templates *promptTemplates
+
+	upstreams   upstreamTracker
+	mode        modeSwitch
+	errors      ring[RecentError]
+	requests    *requestLog // when set, the log each request's metadata is kept in
+	debug       debugCapture
+	capture     *captureSink
+	archive     *archiveSink
+	alerts      *alerter
+	memory      *memoryGuard
+	experiments *experiments
+	evals       *evalRunner
+	prompts     *scheduledPrompts
+	sharedUsage *redisUsage // when set, the replicas' usage in Redis that quotas are checked against
+	cluster     *cluster    // when set, the peers' state, which this replica shares its own with
+	sessions    sessionStore
+	idempotent  *idempotency
+	fallbacks   *fallbacks
+	jobs        *jobQueue
+	resumes     *resumeStreams
+	retrieval   []*retriever
+	files       *fileIndex
+	images      *imageFetcher
+	agents      *agentTracker
+	keyStats    *keyStats
+	ips         *clientIPs
+	mux         *http.ServeMux // for in-process sub-requests
+}
+
+// mount registers every configured route on mux.
+func (p *proxy) mount(mux *http.ServeMux) error {
+	p.mux = mux
+	for i := range p.cfg.Routes {
+		rc := &p.cfg.Routes[i]
+		h, err := p.buildRoute(rc)
+		if err != nil {
+			return err
+		}
+		mux.Handle(rc.Pattern, p.gate(h))
+	}
+	return nil
+}
+
+// auth identifies the client and project the request is attributed to.
+func (p *proxy) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex := exchangeOf(r)
+		ex.client = p.registry.Identify(r)
+		ex.keyID = p.registry.KeyID(r)
+		project, err := requestProject(p.cfg, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_project", err.Error())
+			return
+		}
+		ex.project = project
+		if ex.agent, err = p.agents.identify(ex.client, r); err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid_agent", err.Error())
+			return
+		}
+		if c := p.registry.Client(ex.client); c != nil && c.Defaults != nil {
+			c.Defaults.setHeaders(r)
+		}
+		if ex.priority, err = p.requestPriority(r, ex.client); err != nil {
+			writePriorityError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limits rejects callers over their IP's rate, clients that have used up
+// their quota, and agents their quota or rate. Responses report where the
+// caller stands against each in the rate limit headers.
+func (p *proxy) limits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex := exchangeOf(r)
+		w = teeTo(w, rateLimitHeaders{ex})
+		if !p.checkIP(w, ex) {
+			return
+		}
+		windows, err := p.quotas.Check(r.Context(), ex.client, ex.start)
+		ex.rateLimits = append(ex.rateLimits, quotaRates("client", windows, ex.start)...)
+		if err != nil {
+			var qe *QuotaError
+			if errors.As(err, &qe) {
+				writeLimitError(w, http.StatusTooManyRequests, "quota_exceeded", qe.Error(), quotaLimit("client", qe), time.Until(qe.Reset))
+				return
+			}
+			log.Printf("Error checking quota: %v", err)
+		}
+		if !p.checkAgent(w, ex) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// transform buffers JSON request bodies so this and later stages can
+// inspect and rewrite them. It applies the global, route and client
+// transform rules in that order, after the client's defaults, validates
+// the result, checks the requested model against the client's allow list
+// and the access rules, then applies the system prompt and parameter
+// policies. Other bodies stream through untouched.
+func (p *proxy) transform(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		enc := r.Header.Get("Content-Encoding")
+		if r.Body == nil || r.Body == http.NoBody || ct != "application/json" || enc != "" && enc != "gzip" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if enc == "" && r.ContentLength > maxBufferedBody {
+			// Refused unread, so a client waiting on 100 Continue sends nothing.
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the proxy limit")
+			return
+		}
+		in := r.Body
+		if enc == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request", "request body is not valid gzip")
+				return
+			}
+			in = gz
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, in, maxBufferedBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the proxy limit")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "invalid_request", "reading request body failed")
+			return
+		}
+		ex := exchangeOf(r)
+		ex.body = body
+		if v, err := decodeJSON(body); err == nil {
+			ex.doc, _ = v.(map[string]any)
+		}
+		if ex.doc != nil {
+			used, err := p.templates.expandTemplate(ex, strings.HasSuffix(r.URL.Path, "/messages"))
+			if err != nil {
+				writeSchemaError(w, err)
+				return
+			}
+			if used != "" {
+				w.Header().Set("X-Ringmaster-Template", used)
+			}
+		}
+		if c := p.registry.Client(ex.client); c != nil && c.Defaults != nil && ex.doc != nil {
+			changed, err := c.Defaults.apply(ex, strings.HasSuffix(r.URL.Path, "/messages"))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "internal_error", "client defaults: "+err.Error())
+				return
+			}
+			ex.dirty = ex.dirty || changed
+		}
+		if ex.doc != nil {
+			rules := [][]TransformRule{p.cfg.Transforms, ex.route.Transforms}
+			if c := p.registry.Client(ex.client); c != nil {
+				rules = append(rules, c.Transforms)
+			}
+			for _, rs := range rules {
+				changed, err := applyTransforms(ex.doc, rs)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid_request", "request body conflicts with transform "+err.Error())
+					return
+				}
+				ex.dirty = ex.dirty || changed
+			}
+			ex.model, _ = ex.doc["model"].(string)
+			if d := p.cfg.deprecation(ex.model); d != nil && d.apply(w.Header(), ex, time.Now()) {
+				ex.dirty = true
+			}
+		}
+		// Validated as filled in and transformed, so a field a client's
+		// defaults supply needn't be sent.
+		if err := p.cfg.Validation.check(r.URL.Path, body, ex.doc); err != nil {
+			writeSchemaError(w, err)
+			return
+		}
+		if ex.doc != nil {
+			if err := p.cfg.checkModel(p.registry.Client(ex.client), ex.client, ex.model); err != nil {
+				writeError(w, http.StatusForbidden, "model_not_allowed", err.Error())
+				return
+			}
+			if msg, denied := p.checkAccess(ex, r); denied {
+				writeError(w, http.StatusForbidden, "access_denied", msg)
+				return
+			}
+			if injectSystemPrompts(ex.doc, strings.HasSuffix(r.URL.Path, "/messages"), ex.client, ex.model, p.cfg.SystemPrompts) {
+				ex.dirty = true
+			}
+			if c := p.registry.Client(ex.client); c != nil && c.Params != nil {
+				changed, err := c.Params.enforce(ex.doc)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "policy_violation", err.Error())
+					return
+				}
+				ex.dirty = ex.dirty || changed
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeStage picks the upstream for a route: an override set through the
+// admin API, else the first conditional target that matches, else its own
+// target, else one from the upstream pool, by conversation when sticky
+// routing names one and drawn otherwise, else the global one. The path is
+// the request's after the route's rewrites.
+func routeStage(p *proxy, rc *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if _, err := p.cfg.Objectives.objectiveOf(r); err != nil {
+				writeErrorDetail(w, http.StatusBadRequest, apiErrorDetail{Message: err.Error(), Type: "invalid_request", Param: objectiveHeader})
+				return
+			}
+			target := p.pickTarget(rc, ex, r)
+			ex.path = rewritePath(rc.Rewrite, r.URL.Path)
+			u := target + ex.path
+			if r.URL.RawQuery != "" {
+				u += "?" + r.URL.RawQuery
+			}
+			ex.target = u
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func (p *proxy) pickTarget(rc *RouteConfig, ex *exchange, r *http.Request) string {
+	if ex.upstream != "" {
+		return ex.upstream
+	}
+	if t := p.pool.routeTarget(rc.Pattern); t != "" {
+		return t
+	}
+	for _, t := range rc.Targets {
+		ok, err := t.When.Bool(p.exprEnv(ex, r))
+		if err != nil {
+			log.Printf("Error evaluating route condition: %v", err)
+		}
+		if ok {
+			return t.Target
+		}
+	}
+	if rc.Target != "" {
+		return rc.Target
+	}
+	if ex.affinity != "" {
+		if t := p.pool.pickFor(ex.affinity); t != "" {
+			stickyRequests.Add(1, t)
+			return t
+		}
+	}
+	if o, _ := p.cfg.Objectives.objectiveOf(r); o != "" {
+		if t := p.pool.pickBy(o, ex.model, &p.cfg.Objectives, p.cfg.Pricing, &p.upstreams); t != "" {
+			objectiveRequests.Add(1, o, t)
+			return t
+		}
+	}
+	if t := p.pool.pick(); t != "" {
+		return t
+	}
+	return p.cfg.Target
+}
+
+// observe accounts every request that reaches it, with token usage parsed
+// from the response as it is relayed.
+func (p *proxy) observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex := exchangeOf(r)
+		ex.inspect = true
+		us := &usageSink{}
+		defer func() {
+			status := us.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			var model string
+			var u Usage
+			if us.observer != nil {
+				model, u, _ = us.observer.Finish()
+			}
+			if u.IsZero() {
+				u = ex.estimate
+			}
+			if ex.replayed {
+				u = Usage{}
+			}
+			if model == "" {
+				model = ex.model
+			}
+			p.record(ex, status, model, u)
+		}()
+		next.ServeHTTP(teeTo(w, us), r)
+	})
+}
+
+// record writes one request's accounting to the tracker, the store and the
+// billing feed, and keeps failures for the admin API.
+func (p *proxy) record(ex *exchange, status int, model string, u Usage) {
+	if ex.dryRun {
+		return
+	}
+	now := time.Now()
+	key := UsageKey{Client: ex.client, Project: ex.project, Model: model, Provider: p.providerOf(ex)}
+	cost := p.priceTableOf(ex, model).Cost(model, u)
+	p.usage.Record(now, key, status, u, cost)
+	if p.sharedUsage != nil {
+		p.sharedUsage.Record(context.Background(), now, ex.client, status, u, cost)
+	}
+	if ex.agent != "" {
+		p.agents.record(ex.client, ex.agent, now, status, u, cost)
+	}
+	if ex.keyID != "" {
+		p.keyStats.record(ex.keyID, ex.client, model, now, status, u, cost)
+	}
+	rec := UsageRecord{ID: ex.id, Time: now, Status: status,
+		Duration: now.Sub(ex.start), UsageKey: key, Usage: u, CostUSD: cost}
+	if p.store != nil {
+		if err := p.store.RecordUsage(context.Background(), rec); err != nil {
+			log.Printf("Error storing usage record: %v", err)
+		}
+	}
+	if p.billing != nil {
+		p.billing.Emit(billingEventOf(rec))
+	}
+	var upstream string
+	if ex.target != "" {
+		upstream = upstreamOf(ex.target)
+	}
+	p.requests.add(RequestLogEntry{Time: now.UTC(), ID: ex.id, Method: ex.method, Route: ex.route.Pattern, Path: ex.path,
+		Client: ex.client, Project: ex.project, Agent: ex.agent, IP: ex.ip, Model: model, Upstream: upstream,
+		Status: status, Duration: Duration(now.Sub(ex.start)), Usage: u, CostUSD: cost, Replayed: ex.replayed})
+	if status >= 400 {
+		e := RecentError{Time: now.UTC(), ID: ex.id, Route: ex.route.Pattern,
+			Client: ex.client, IP: ex.ip, Model: model, Status: status}
+		e.Upstream = upstream
+		p.errors.add(e)
+	}
+}
+
+// ForwardConfig tunes how responses are relayed. FlushInterval is how
+// often a buffered response is flushed to the client; zero flushes only at
+// the end, negative after every write. SSE responses are flushed as each
+// event completes, others of unknown length as they arrive. BufferSize is the
+// size of the pooled buffers responses are copied through, default 32KB.
+// GzipMinBytes, when set, has the compress stage gzip unstreamed responses
+// at least that long for clients that accept it. Writes blocked on the
+// client longer than StallThreshold (default 1s) count as stalls; a client
+// that accepts nothing for StallTimeout is disconnected.
+//
+// Request bodies stream upstream as they arrive, except those of at most
+// ReplayBuffer bytes (default 1MB, negative for none), which are read
+// first: they go with a Content-Length even if they came chunked, and can
+// be sent again. Retries is how many times (default none, at most 5) a
+// request that could not reach its upstream is sent again, to another pool
+// member when it was drawn from the pool. Requests that reached an
+// upstream are never repeated, as it may have acted on them.
+type ForwardConfig struct {
+	FlushInterval  Duration `json:"flush_interval,omitempty"`
+	BufferSize     int      `json:"buffer_size,omitempty"`
+	GzipMinBytes   int      `json:"gzip_min_bytes,omitempty"`
+	StallThreshold Duration `json:"stall_threshold,omitempty"`
+	StallTimeout   Duration `json:"stall_timeout,omitempty"`
+	ReplayBuffer   int64    `json:"replay_buffer,omitempty"`
+	Retries        int      `json:"retries,omitempty"`
+}
+
+func (c *ForwardConfig) validate() error {
+	if c.BufferSize < 0 || c.BufferSize > 0 && c.BufferSize < 512 {
+		return fmt.Errorf("forward: buffer_size must be at least 512 bytes")
+	}
+	if c.GzipMinBytes < 0 {
+		return fmt.Errorf("forward: gzip_min_bytes must not be negative")
+	}
+	if c.StallThreshold < 0 || c.StallTimeout < 0 {
+		return fmt.Errorf("forward: stall_threshold and stall_timeout must not be negative")
+	}
+	if c.Retries < 0 || c.Retries > 5 {
+		return fmt.Errorf("forward: retries must be between 0 and 5")
+	}
+	return nil
+}
+
+// forward sends the request to the target chosen by the route stage and
+// relays the response.
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request) {
+	ex := exchangeOf(r)
+
+	if ex.dirty {
+		b, err := encodeJSON(ex.doc)
+		if err != nil {
+			log.Printf("Error encoding request body: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "encoding request body failed")
+			return
+		}
+		ex.body, ex.dirty = b, false
+	}
+
+	ctx := r.Context()
+	if t := p.cfg.Transport.Timeout; t > 0 && !isWebSocket(r) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t))
+		defer cancel()
+	}
+	upstreamReq, err := p.upstreamRequest(r.WithContext(ctx), ex)
+	if errors.Is(err, errUpstreamAuth) {
+		log.Printf("Error authenticating to %s: %v", upstreamOf(ex.target), err)
+		writeError(w, http.StatusBadGateway, "upstream_error", "authenticating to the upstream failed")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if ex.dryRun {
+		p.dryRun(w, r, ex, upstreamReq)
+		return
+	}
+	if p.echo(w, r, upstreamReq, ex.body) {
+		return
+	}
+	if isWebSocket(r) {
+		p.relayWebSocket(w, ex, upstreamReq)
+		return
+	}
+
+	sw := newStallWriter(w, ex.route.Pattern, p.cfg.Forward)
+	defer sw.finish()
+	p.relay.ServeHTTP(&eventFlusher{ResponseWriter: sw, boundary: true}, upstreamReq)
+	if sb, ok := upstreamReq.Body.(*sentBody); ok {
+		outcome := "refused"
+		if sb.read.Load() {
+			outcome = "sent"
+		}
+		expectContinues.Add(1, outcome)
+	}
+}
+
+var expectContinues = metrics.counter("zai_proxy_expect_continue_total",
+	"Uploads sent with Expect: 100-continue, by whether the upstream took the body.", "outcome")
+
+// sentBody notes whether a body held back for the upstream's 100 Continue
+// was ever read, which is also when the client is told to send it.
+type sentBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *sentBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+// upstreamRequest builds the request forward sends for r. Bodies held in
+// memory, buffered ones and streamed ones within forward.replay_buffer,
+// can be sent again; a chunked one that fits goes with a Content-Length.
+func (p *proxy) upstreamRequest(r *http.Request, ex *exchange) (*http.Request, error) {
+	var body io.Reader = r.Body
+	length := r.ContentLength
+	limit := cmp.Or(p.cfg.Forward.ReplayBuffer, 1<<20)
+	switch {
+	case ex.body != nil:
+		body, length = bytes.NewReader(ex.body), int64(len(ex.body))
+	case r.Body == nil || r.Body == http.NoBody:
+	case strings.EqualFold(r.Header.Get("Expect"), "100-continue"):
+		// Reading it would tell the client to send it before the upstream has.
+		body = &sentBody{ReadCloser: r.Body}
+	case limit > 0 && length <= limit:
+		b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) <= limit {
+			body, length = bytes.NewReader(b), int64(len(b))
+		} else {
+			body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+		}
+	}
+
+	// Create upstream request
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, ex.target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers from original request
+	for key, values := range r.Header {
+		for _, value := range values {
+			upstreamReq.Header.Add(key, value)
+		}
+	}
+	upstreamReq.ContentLength = length
+	if ex.body != nil {
+		upstreamReq.Header.Del("Content-Length")
+		upstreamReq.Header.Del("Content-Encoding")
+		// The client has sent the body already; there is nothing to hold back.
+		upstreamReq.Header.Del("Expect")
+	}
+	if ex.inspect {
+		// Leave compression to the transport, which decodes what it asked for.
+		upstreamReq.Header.Del("Accept-Encoding")
+	}
+
+	p.ips.setForwarded(upstreamReq.Header, r)
+	upstreamReq.Header.Del(projectHeader)
+	upstreamReq.Header.Del(agentHeader)
+	upstreamReq.Header.Del(echoHeader)
+	upstreamReq.Header.Del(dryRunHeader)
+	upstreamReq.Header.Del(objectiveHeader)
+	upstreamReq.Header.Del(priorityHeader)
+	upstreamReq.Header.Del(fallbackHeader)
+
+	// Override with correct host and auth
+	upstreamReq.Header.Set("Host", upstreamReq.URL.Host)
+	if err := p.authorize(upstreamReq, ex.target, ex.model); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUpstreamAuth, err)
+	}
+	return upstreamReq, nil
+}
+
+// reverseProxy relays the requests forward prepares; the director has
+// nothing left to do.
+func (p *proxy) reverseProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:      func(*http.Request) {},
+		Transport:     roundTripperFunc(func(req *http.Request) (*http.Response, error) { return p.roundTrip(transport, req) }),
+		FlushInterval: time.Duration(p.cfg.Forward.FlushInterval),
+		BufferPool:    newBufferPool(cmp.Or(p.cfg.Forward.BufferSize, 32<<10)),
+		ErrorHandler:  p.upstreamError,
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// roundTrip sends req upstream and records how the upstream responded.
+// Requests that never reached it are sent again, forward.retries times;
+// those of a hedged tier may go to a second member at once.
+func (p *proxy) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	ex := exchangeOf(req)
+	var tried []string
+	for attempt := 0; ; attempt++ {
+		target := upstreamOf(req.URL.String())
+		sent := time.Now()
+		var resp *http.Response
+		var err error
+		if attempt == 0 && p.hedges(ex, req) {
+			a := p.hedge(transport, req, ex)
+			req, resp, err, sent = a.req, a.resp, a.err, a.sent
+			target = upstreamOf(req.URL.String())
+		} else {
+			resp, err = transport.RoundTrip(req)
+		}
+		if ex != nil {
+			if m := p.memberOf(ex); m != "" {
+				p.pool.circuits.record(m, resp, err)
+				p.pool.health.record(m, resp, err, time.Since(sent))
+			}
+		}
+		if err == nil {
+			p.upstreams.record(target, resp, time.Since(sent), nil)
+			if ex != nil {
+				debugf("Forwarded %s %s for %s at %s to %s: %d in %s", req.Method, req.URL.Path, ex.client, ex.ip, target, resp.StatusCode, time.Since(sent))
+			}
+			if vertexTranslated(ex, req) {
+				return vertexResponse(resp, ex.model)
+			}
+			if p.ollamaChat(req) {
+				return localResponse(resp)
+			}
+			return resp, nil
+		}
+		p.upstreams.record(target, nil, time.Since(sent), err)
+		if ex == nil || attempt >= p.cfg.Forward.Retries || !unsent(err) {
+			return nil, err
+		}
+		next, ok := p.retryRequest(req, ex, &tried, attempt)
+		if !ok {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// upstreamError answers requests the upstream never responded to.
+func (p *proxy) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away; there is no one to answer.
+		w.WriteHeader(http.StatusBadGateway)
+	case errors.As(err, new(*http.MaxBytesError)):
+		writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the proxy limit")
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("Error forwarding request: %v", err)
+		writeError(w, http.StatusGatewayTimeout, "upstream_timeout", "upstream did not respond in time")
+	default:
+		log.Printf("Error forwarding request: %v", err)
+		writeError(w, http.StatusBadGateway, "upstream_error", "upstream request failed")
+	}
+}
+
+// bufferPool recycles the buffers responses are copied through.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() any { return make([]byte, size) }}}
+}
+
+func (b *bufferPool) Get() []byte  { return b.pool.Get().([]byte) }
+func (b *bufferPool) Put(p []byte) { b.pool.Put(p) }
+
+// eventFlusher holds back the flushes ReverseProxy makes after every read
+// of an SSE response until the bytes written end an event, so a read that
+// splits an event costs no extra syscall and one carrying several events
+// costs one.
+type eventFlusher struct {
+	http.ResponseWriter
+	sse      bool
+	tail     []byte // last bytes written, to find boundaries split across writes
+	boundary bool
+}
+
+func (w *eventFlusher) WriteHeader(code int) {
+	w.sse = strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *eventFlusher) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if w.sse && n > 0 {
+		w.tail = append(w.tail, b[:n]...)
+		w.tail = w.tail[max(len(w.tail)-4, 0):]
+		w.boundary = bytes.HasSuffix(w.tail, []byte("\n\n")) || bytes.HasSuffix(w.tail, []byte("\r\n\r\n"))
+	}
+	return n, err
+}
+
+func (w *eventFlusher) Flush() {
+	if !w.sse || w.boundary {
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (w *eventFlusher) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QuotaConfig limits a client's consumption per UTC calendar day and month.
+// Zero means unlimited.
+type QuotaConfig struct {
+	DailyTokens    int64   `json:"daily_tokens,omitempty"`
+	DailyCostUSD   float64 `json:"daily_cost_usd,omitempty"`
+	MonthlyTokens  int64   `json:"monthly_tokens,omitempty"`
+	MonthlyCostUSD float64 `json:"monthly_cost_usd,omitempty"`
+}
+
+// IsZero reports whether no limit is set.
+func (q QuotaConfig) IsZero() bool {
+	return q == QuotaConfig{}
+}
+
+// clientUsage reports a client's consumption since a point in time.
+type clientUsage interface {
+	ClientUsageSince(ctx context.Context, client string, since time.Time) (UsageTotals, error)
+}
+
+// ClientUsageSince sums the in-memory hourly buckets for client.
+func (t *UsageTracker) ClientUsageSince(_ context.Context, client string, since time.Time) (UsageTotals, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sum UsageTotals
+	from := since.Unix() / 3600
+	for k, v := range t.hourly {
+		if k.Client == client && k.hour >= from {
+			sum.merge(v)
+		}
+	}
+	return sum, nil
+}
+
+// QuotaError describes which limit a client has exhausted.
+type QuotaError struct {
+	Client string
+	Limit  string
+	Used   float64
+	Max    float64
+	Reset  time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("client %s exceeded its %s quota (%g of %g); resets at %s",
+		e.Client, e.Limit, e.Used, e.Max, e.Reset.Format(time.RFC3339))
+}
+
+// quotaChecker enforces client quotas. Limits set in the store override the
+// ones in the config file.
+type quotaChecker struct {
+	reg   *clientRegistry
+	store Store
+	usage clientUsage
+}
+
+// Limits returns the effective quota for client.
+func (q *quotaChecker) Limits(ctx context.Context, client string) (QuotaConfig, error) {
+	if q.store != nil {
+		lim, ok, err := q.store.GetQuota(ctx, client)
+		if err != nil {
+			return QuotaConfig{}, err
+		}
+		if ok {
+			return lim, nil
+		}
+	}
+	if c := q.reg.Client(client); c != nil {
+		return c.Quota, nil
+	}
+	return QuotaConfig{}, nil
+}
+
+// QuotaWindow is the state of one quota period for a client.
+type QuotaWindow struct {
+	Period     string    `json:"period"`
+	MaxTokens  int64     `json:"max_tokens,omitempty"`
+	MaxCostUSD float64   `json:"max_cost_usd,omitempty"`
+	UsedTokens int64     `json:"used_tokens"`
+	UsedCost   float64   `json:"used_cost_usd"`
+	Reset      time.Time `json:"reset"`
+}
+
+// RemainingTokens returns the tokens left, or -1 when unlimited.
+func (w QuotaWindow) RemainingTokens() int64 {
+	if w.MaxTokens == 0 {
+		return -1
+	}
+	return max(w.MaxTokens-w.UsedTokens, 0)
+}
+
+// RemainingCost returns the budget left in USD, or -1 when unlimited.
+func (w QuotaWindow) RemainingCost() float64 {
+	if w.MaxCostUSD == 0 {
+		return -1
+	}
+	return max(w.MaxCostUSD-w.UsedCost, 0)
+}
+
+// Status returns the client's limited quota windows with current usage.
+func (q *quotaChecker) Status(ctx context.Context, client string, now time.Time) ([]QuotaWindow, error) {
+	lim, err := q.Limits(ctx, client)
+	if err != nil || lim.IsZero() {
+		return nil, err
+	}
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	periods := []struct {
+		name      string
+		start     time.Time
+		reset     time.Time
+		maxTokens int64
+		maxCost   float64
+	}{
+		{"daily", day, day.AddDate(0, 0, 1), lim.DailyTokens, lim.DailyCostUSD},
+		{"monthly", month, month.AddDate(0, 1, 0), lim.MonthlyTokens, lim.MonthlyCostUSD},
+	}
+	var windows []QuotaWindow
+	for _, p := range periods {
+		if p.maxTokens == 0 && p.maxCost == 0 {
+			continue
+		}
+		used, err := q.usage.ClientUsageSince(ctx, client, p.start)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, QuotaWindow{
+			Period:     p.name,
+			MaxTokens:  p.maxTokens,
+			MaxCostUSD: p.maxCost,
+			UsedTokens: used.PromptTokens + used.CompletionTokens,
+			UsedCost:   used.CostUSD,
+			Reset:      p.reset,
+		})
+	}
+	return windows, nil
+}
+
+// Check returns client's quota windows, with a *QuotaError if it has used
+// up any of its limits.
+func (q *quotaChecker) Check(ctx context.Context, client string, now time.Time) ([]QuotaWindow, error) {
+	windows, err := q.Status(ctx, client, now)
+	if err != nil {
+		return nil, err
+	}
+	return windows, exhausted(client, windows)
+}
+
+// exhausted returns a *QuotaError for the first of windows used up.
+func exhausted(who string, windows []QuotaWindow) error {
+	for _, w := range windows {
+		if w.RemainingTokens() == 0 {
+			return &QuotaError{Client: who, Limit: w.Period + " token",
+				Used: float64(w.UsedTokens), Max: float64(w.MaxTokens), Reset: w.Reset}
+		}
+		if w.RemainingCost() == 0 {
+			return &QuotaError{Client: who, Limit: w.Period + " cost",
+				Used: w.UsedCost, Max: w.MaxCostUSD, Reset: w.Reset}
+		}
+	}
+	return nil
+}
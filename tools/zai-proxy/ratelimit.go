@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every response past the limits stage says where its caller stands
+// against the proxy's limits, so clients can slow down before they are
+// refused: RateLimit-Policy and RateLimit as the IETF draft has them, one
+// item per limit, and X-RateLimit-Limit, -Remaining and -Reset (seconds)
+// for the one nearest exhaustion. Limits are the client IP's and the
+// agent's requests a minute, and the client's and agent's daily and
+// monthly quotas, tokens counted as such and costs in cents. They replace
+// any the upstream sent, which describe the proxy's key, not the caller.
+
+// rateLimit is where a request stands against one limit.
+type rateLimit struct {
+	policy    string
+	quota     int64
+	remaining int64
+	window    time.Duration
+	reset     time.Time
+}
+
+// minuteRate is a per-minute request limit with left requests left.
+func minuteRate(policy string, limit, left int, now time.Time) rateLimit {
+	minute := now.Unix() / 60
+	return rateLimit{policy: policy, quota: int64(limit), remaining: int64(left), window: time.Minute, reset: time.Unix((minute+1)*60, 0)}
+}
+
+// quotaRates are the limits of quota windows, named who_period_token or
+// who_period_cost.
+func quotaRates(who string, windows []QuotaWindow, now time.Time) []rateLimit {
+	var out []rateLimit
+	for _, w := range windows {
+		start := w.Reset.AddDate(0, 0, -1)
+		if w.Period == "monthly" {
+			start = w.Reset.AddDate(0, -1, 0)
+		}
+		window := w.Reset.Sub(start)
+		if w.MaxTokens > 0 {
+			out = append(out, rateLimit{policy: who + "_" + w.Period + "_token", quota: w.MaxTokens,
+				remaining: w.RemainingTokens(), window: window, reset: w.Reset})
+		}
+		if w.MaxCostUSD > 0 {
+			out = append(out, rateLimit{policy: who + "_" + w.Period + "_cost", quota: int64(math.Round(w.MaxCostUSD * 100)),
+				remaining: int64(math.Floor(w.RemainingCost() * 100)), window: window, reset: w.Reset})
+		}
+	}
+	return out
+}
+
+// rateLimitHeaders sets the headers from an exchange's limits as its
+// response starts.
+type rateLimitHeaders struct{ ex *exchange }
+
+func (s rateLimitHeaders) begin(_ int, h http.Header) {
+	for _, k := range []string{"RateLimit", "RateLimit-Policy", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+		h.Del(k)
+	}
+	limits := s.ex.rateLimits
+	if len(limits) == 0 {
+		return
+	}
+	now := time.Now()
+	var policies, states []string
+	tightest := limits[0]
+	for _, l := range limits {
+		reset := max(int64(math.Ceil(l.reset.Sub(now).Seconds())), 0)
+		policies = append(policies, fmt.Sprintf("%q;q=%d;w=%d", l.policy, l.quota, int64(l.window.Seconds())))
+		states = append(states, fmt.Sprintf("%q;r=%d;t=%d", l.policy, l.remaining, reset))
+		if l.quota > 0 && float64(l.remaining)/float64(l.quota) < float64(tightest.remaining)/float64(max(tightest.quota, 1)) {
+			tightest = l
+		}
+	}
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	h.Set("RateLimit", strings.Join(states, ", "))
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(tightest.quota, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(tightest.remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(max(int64(math.Ceil(tightest.reset.Sub(now).Seconds())), 0), 10))
+}
+
+func (rateLimitHeaders) Write(b []byte) (int, error) { return len(b), nil }
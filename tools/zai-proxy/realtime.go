@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RealtimeConfig bounds WebSocket sessions, such as those of realtime voice
+// APIs, which are relayed frame by frame with the upstream key injected in
+// the handshake. A session is closed once neither side has sent anything
+// for IdleTimeout (default 5m) or it has lasted MaxDuration (default 30m).
+// Its usage is the sum of the usage blocks of the upstream's response.done
+// events, accounted as one request when it ends.
+type RealtimeConfig struct {
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	MaxDuration Duration `json:"max_duration,omitempty"`
+}
+
+func (c *RealtimeConfig) validate() error {
+	if c.IdleTimeout < 0 || c.MaxDuration < 0 {
+		return fmt.Errorf("realtime: idle_timeout and max_duration must not be negative")
+	}
+	return nil
+}
+
+var (
+	realtimeSessions = metrics.counter("zai_proxy_realtime_sessions_total", "WebSocket sessions, by how they ended.", "outcome")
+	realtimeOpen     = metrics.gauge("zai_proxy_realtime_sessions_open", "WebSocket sessions open now.")
+)
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// realtimeStage checks the model a WebSocket session names in its query,
+// as transform does for JSON bodies.
+func realtimeStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isWebSocket(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ex := exchangeOf(r)
+			ex.model = r.URL.Query().Get("model")
+			if err := p.cfg.checkModel(p.registry.Client(ex.client), ex.client, ex.model); err != nil {
+				writeError(w, http.StatusForbidden, "model_not_allowed", err.Error())
+				return
+			}
+			if msg, denied := p.checkAccess(ex, r); denied {
+				writeError(w, http.StatusForbidden, "access_denied", msg)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// relayWebSocket completes the handshake with the upstream and, once it
+// agrees, relays frames both ways until either side closes or a limit is
+// reached.
+func (p *proxy) relayWebSocket(w http.ResponseWriter, ex *exchange, req *http.Request) {
+	// Compressed frames could not be read for usage.
+	req.Header.Del("Sec-WebSocket-Extensions")
+	resp, err := p.relay.Transport.RoundTrip(req)
+	if err != nil {
+		realtimeSessions.Add(1, "failed")
+		p.upstreamError(w, req, err)
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// A refusal is relayed like any other response.
+		defer resp.Body.Close()
+		realtimeSessions.Add(1, "refused")
+		for k, vs := range resp.Header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	defer upstream.Close()
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		realtimeSessions.Add(1, "failed")
+		log.Printf("Error taking over WebSocket connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	// The server's deadlines are for requests, not sessions.
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols))
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		realtimeSessions.Add(1, "failed")
+		return
+	}
+
+	s := &wsSession{start: time.Now(), model: ex.model}
+	s.touch()
+	realtimeOpen.Add(1)
+	defer realtimeOpen.Add(-1)
+	done := make(chan struct{}, 2)
+	go func() {
+		// Client frames go up as they are; they are only timed.
+		io.Copy(upstream, activityReader{brw.Reader, s})
+		done <- struct{}{}
+	}()
+	go func() {
+		s.pump(brw.Writer, bufio.NewReader(upstream))
+		done <- struct{}{}
+	}()
+
+	idle := cmp.Or(time.Duration(p.cfg.Realtime.IdleTimeout), 5*time.Minute)
+	expiry := time.NewTimer(cmp.Or(time.Duration(p.cfg.Realtime.MaxDuration), 30*time.Minute))
+	defer expiry.Stop()
+	tick := time.NewTicker(min(idle/4, time.Second))
+	defer tick.Stop()
+	outcome := ""
+	for outcome == "" {
+		select {
+		case <-done:
+			outcome = "closed"
+		case <-expiry.C:
+			outcome = "expired"
+		case <-tick.C:
+			if time.Since(s.lastActive()) >= idle {
+				outcome = "idle"
+			}
+		}
+	}
+	if outcome != "closed" {
+		// Stop the upstream first so the pump lets go of the client.
+		upstream.Close()
+		reason := "idle timeout"
+		if outcome == "expired" {
+			reason = "session time limit reached"
+		}
+		s.mu.Lock()
+		brw.Writer.Write(closeFrame(1008, reason))
+		brw.Writer.Flush()
+		s.mu.Unlock()
+	}
+	conn.Close()
+	realtimeSessions.Add(1, outcome)
+
+	s.mu.Lock()
+	ex.model, ex.estimate = s.model, s.usage
+	s.mu.Unlock()
+	debugf("WebSocket session %s for %s %s after %s", ex.id, ex.client, outcome, time.Since(s.start).Round(time.Millisecond))
+}
+
+// wsSession is the state of one relayed WebSocket session.
+type wsSession struct {
+	start  time.Time
+	active atomic.Int64 // unix nanoseconds of the latest frame either way
+
+	mu    sync.Mutex // held while writing to the client
+	model string
+	usage Usage
+}
+
+func (s *wsSession) touch()                { s.active.Store(time.Now().UnixNano()) }
+func (s *wsSession) lastActive() time.Time { return time.Unix(0, s.active.Load()) }
+
+type activityReader struct {
+	r io.Reader
+	s *wsSession
+}
+
+func (a activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.s.touch()
+	}
+	return n, err
+}
+
+// realtimeEvent is the subset of upstream events inspected for usage.
+type realtimeEvent struct {
+	Type    string `json:"type"`
+	Session *struct {
+		Model string `json:"model"`
+	} `json:"session"`
+	Response *struct {
+		Usage *struct {
+			InputTokens       int64 `json:"input_tokens"`
+			OutputTokens      int64 `json:"output_tokens"`
+			InputTokenDetails struct {
+				CachedTokens int64 `json:"cached_tokens"`
+			} `json:"input_token_details"`
+		} `json:"usage"`
+	} `json:"response"`
+}
+
+// pump copies the upstream's frames to the client unchanged, reading the
+// text messages among them for the session's model and usage.
+func (s *wsSession) pump(dst *bufio.Writer, src *bufio.Reader) error {
+	var msg []byte
+	text := false
+	for {
+		var head [14]byte
+		if _, err := io.ReadFull(src, head[:2]); err != nil {
+			return err
+		}
+		n := 2
+		length := uint64(head[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, head[2:4]); err != nil {
+				return err
+			}
+			n, length = 4, uint64(binary.BigEndian.Uint16(head[2:4]))
+		case 127:
+			if _, err := io.ReadFull(src, head[2:10]); err != nil {
+				return err
+			}
+			n, length = 10, binary.BigEndian.Uint64(head[2:10])
+		}
+		var mask []byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, head[n:n+4]); err != nil {
+				return err
+			}
+			mask, n = head[n:n+4], n+4
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		control := opcode >= 8 // may come between a message's fragments
+		switch {
+		case opcode == 1:
+			text, msg = true, msg[:0]
+		case opcode != 0 && !control:
+			text = false
+		}
+		keep := text && !control && uint64(len(msg))+length <= uint64(maxObservedBody)
+
+		s.mu.Lock()
+		err := func() error {
+			if _, err := dst.Write(head[:n]); err != nil {
+				return err
+			}
+			var payload io.Reader = io.LimitReader(src, int64(length))
+			if keep {
+				start := len(msg)
+				buf := bytes.NewBuffer(msg)
+				if _, err := io.Copy(dst, io.TeeReader(payload, buf)); err != nil {
+					return err
+				}
+				msg = buf.Bytes()
+				for i := start; mask != nil && i < len(msg); i++ {
+					msg[i] ^= mask[(i-start)%4]
+				}
+			} else if _, err := io.Copy(dst, payload); err != nil {
+				return err
+			}
+			return dst.Flush()
+		}()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		s.touch()
+		if control {
+			continue
+		}
+		if !keep {
+			text = false
+		}
+		if text && fin {
+			s.observe(msg)
+			text = false
+		}
+	}
+}
+
+// observe reads a complete text message from the upstream.
+func (s *wsSession) observe(msg []byte) {
+	if !bytes.Contains(msg, []byte(`"response.done"`)) && !bytes.Contains(msg, []byte(`"session.created"`)) {
+		return
+	}
+	var ev realtimeEvent
+	if json.Unmarshal(msg, &ev) != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case ev.Type == "session.created" && ev.Session != nil && ev.Session.Model != "":
+		s.model = ev.Session.Model
+	case ev.Type == "response.done" && ev.Response != nil && ev.Response.Usage != nil:
+		u := ev.Response.Usage
+		s.usage.PromptTokens += u.InputTokens
+		s.usage.CompletionTokens += u.OutputTokens
+		s.usage.CachedTokens += u.InputTokenDetails.CachedTokens
+	}
+}
+
+// closeFrame is an unmasked close frame, as servers send.
+func closeFrame(code uint16, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	return append([]byte{0x88, byte(len(payload))}, payload...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentErrorsKept is how many failed requests the admin API can show.
+const recentErrorsKept = 100
+
+// RecentError is one failed request, as shown by the admin API.
+type RecentError struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Route    string    `json:"route"`
+	Client   string    `json:"client"`
+	IP       string    `json:"ip,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Status   int       `json:"status"`
+}
+
+// ring keeps the most recent n values added to it.
+type ring[T any] struct {
+	mu   sync.Mutex
+	n    int
+	buf  []T
+	next int
+}
+
+func (l *ring[T]) add(v T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) < l.n {
+		l.buf = append(l.buf, v)
+		return
+	}
+	l.buf[l.next] = v
+	l.next = (l.next + 1) % l.n
+}
+
+// list returns the kept values, newest first.
+func (l *ring[T]) list() []T {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]T, 0, len(l.buf))
+	for i := len(l.buf) - 1; i >= 0; i-- {
+		out = append(out, l.buf[(l.next+i)%len(l.buf)])
+	}
+	return out
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordingConfig records upstream exchanges to Dir, one file per distinct
+// request, when Record is set. A "replay://" target serves those files back
+// as the upstream, keeping the recorded chunk timing unless Instant.
+// Recordings older than MaxAge, then the oldest beyond MaxTotalBytes, are
+// deleted; they are never compressed, as replay reads them as they are.
+type RecordingConfig struct {
+	Dir           string   `json:"dir"`
+	Record        bool     `json:"record"`
+	Instant       bool     `json:"instant"`
+	MaxAge        Duration `json:"max_age,omitempty"`
+	MaxTotalBytes int64    `json:"max_total_bytes,omitempty"`
+}
+
+// Recording is one upstream exchange as stored on disk.
+type Recording struct {
+	RecordedAt time.Time        `json:"recorded_at"`
+	Request    RecordedRequest  `json:"request"`
+	Response   RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Query  string          `json:"query,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status   int             `json:"status"`
+	Headers  http.Header     `json:"headers"`
+	Chunks   []RecordedChunk `json:"chunks"`
+	Trailers http.Header     `json:"trailers,omitempty"`
+}
+
+// RecordedChunk is one read of the response body, At after the headers
+// arrived. Text bodies are kept as text, anything else as base64.
+type RecordedChunk struct {
+	At   Duration `json:"at"`
+	Text string   `json:"text,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+}
+
+func (c RecordedChunk) bytes() []byte {
+	if c.Data != nil {
+		return c.Data
+	}
+	return []byte(c.Text)
+}
+
+// recordingKey identifies a request by method, path, query and body, with
+// JSON bodies compared by content rather than formatting.
+func recordingKey(method, path, query string, body []byte) string {
+	if v, err := decodeJSON(body); err == nil {
+		body, _ = json.Marshal(v)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", method, path, query)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+// recordingTransport saves every exchange that passes through it.
+type recordingTransport struct {
+	base http.RoundTripper
+	dir  string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{
+		RecordedAt: time.Now().UTC(),
+		Request:    RecordedRequest{Method: req.Method, Path: req.URL.Path, Query: req.URL.RawQuery},
+		Response:   RecordedResponse{Status: resp.StatusCode, Headers: resp.Header.Clone()},
+	}
+	if json.Valid(body) {
+		rec.Request.Body = body
+	}
+	name := filepath.Join(t.dir, recordingKey(req.Method, req.URL.Path, req.URL.RawQuery, body)+".json")
+	resp.Body = &recordingBody{ReadCloser: resp.Body, resp: resp, rec: rec, start: time.Now(), path: name}
+	return resp, nil
+}
+
+// recordingBody notes each chunk as it is read, and the trailers once it
+// has all been, and writes the recording when the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	resp  *http.Response
+	rec   *Recording
+	start time.Time
+	path  string
+	done  bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		c := RecordedChunk{At: Duration(time.Since(b.start))}
+		if utf8.Valid(p[:n]) {
+			c.Text = string(p[:n])
+		} else {
+			c.Data = append([]byte(nil), p[:n]...)
+		}
+		b.rec.Response.Chunks = append(b.rec.Response.Chunks, c)
+	}
+	if err == io.EOF && len(b.resp.Trailer) > 0 {
+		b.rec.Response.Trailers = b.resp.Trailer.Clone()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.done {
+		b.done = true
+		if werr := writeRecording(b.path, b.rec); werr != nil {
+			log.Printf("Error writing recording: %v", werr)
+		}
+	}
+	return err
+}
+
+func writeRecording(path string, rec *Recording) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// replayTransport answers "replay://" URLs from recordings.
+type replayTransport struct {
+	dir     string
+	instant bool
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	key := recordingKey(req.Method, req.URL.Path, req.URL.RawQuery, body)
+	b, err := os.ReadFile(filepath.Join(t.dir, key+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return mockJSON(req, http.StatusNotFound, apiError{Error: apiErrorDetail{
+			Message: "no recording of this request (" + key + ")", Type: "not_recorded"}}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("recording %s: %w", key, err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		start := time.Now()
+		for _, c := range rec.Response.Chunks {
+			if wait := time.Duration(c.At) - time.Since(start); wait > 0 && !t.instant {
+				select {
+				case <-time.After(wait):
+				case <-req.Context().Done():
+					pw.CloseWithError(req.Context().Err())
+					return
+				}
+			}
+			if _, err := pw.Write(c.bytes()); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	h := rec.Response.Headers.Clone()
+	h.Del("Content-Length")
+	return &http.Response{
+		StatusCode: rec.Response.Status, Status: fmt.Sprintf("%d %s", rec.Response.Status, http.StatusText(rec.Response.Status)),
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Request: req,
+		Header: h, Body: pr, ContentLength: -1, Trailer: rec.Response.Trailers.Clone(),
+	}, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisConfig connects to a Redis server whose state every replica
+// shares. Sessions and idempotency keep theirs there with store "redis";
+// RateLimits counts the requests per minute of client IPs and agents
+// there, and Quotas the daily usage quotas are checked against, so limits
+// hold across replicas rather than per replica. Keys start with Prefix
+// (default "ringmaster:"). Timeout (default 1s) bounds each command; when
+// Redis can't be reached, rate limits and quotas fall back to each
+// replica's own counts.
+type RedisConfig struct {
+	Addr       string   `json:"addr,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	DB         int      `json:"db,omitempty"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Timeout    Duration `json:"timeout,omitempty"`
+	RateLimits bool     `json:"rate_limits,omitempty"`
+	Quotas     bool     `json:"quotas,omitempty"`
+}
+
+func (c *RedisConfig) validate() error {
+	if c.Addr == "" {
+		if c.RateLimits || c.Quotas {
+			return fmt.Errorf("redis: rate_limits and quotas need an addr")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("redis: addr must be host:port")
+	}
+	if c.DB < 0 || c.Timeout < 0 {
+		return fmt.Errorf("redis: db and timeout must not be negative")
+	}
+	return nil
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient speaks RESP to one server over a small pool of connections.
+type redisClient struct {
+	cfg    RedisConfig
+	prefix string
+	idle   chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r      *bufio.Reader
+	pooled bool // it has been idle, so the server may have closed it
+}
+
+// newRedisClient returns a client for cfg, or nil when no server is set.
+// Connections are made as commands need them.
+func newRedisClient(cfg RedisConfig) *redisClient {
+	if cfg.Addr == "" {
+		return nil
+	}
+	return &redisClient{cfg: cfg, prefix: cmp.Or(cfg.Prefix, "ringmaster:"), idle: make(chan *redisConn, 16)}
+}
+
+// key names k under the prefix.
+func (c *redisClient) key(parts ...string) string {
+	k := c.prefix
+	for i, p := range parts {
+		if i > 0 {
+			k += ":"
+		}
+		k += p
+	}
+	return k
+}
+
+// conn returns an idle connection, unless fresh, or a new one.
+func (c *redisClient) conn(ctx context.Context, fresh bool) (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		if !fresh {
+			return rc, nil
+		}
+		rc.Close()
+	default:
+	}
+	d := net.Dialer{Timeout: cmp.Or(time.Duration(c.cfg.Timeout), time.Second)}
+	nc, err := d.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	var setup [][]string
+	if c.cfg.Password != "" {
+		if c.cfg.Username != "" {
+			setup = append(setup, []string{"AUTH", c.cfg.Username, c.cfg.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.cfg.Password})
+		}
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+	if len(setup) > 0 {
+		replies, _, err := c.exchange(ctx, rc, setup)
+		if err == nil {
+			err = firstError(replies)
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// pipeline sends cmds in one round trip and returns their replies, error
+// replies among them as redisErrors. Commands an idle connection, which
+// the server may have closed meanwhile, took none of are sent again on a
+// new one. Once any of them is written they are not: the server may have
+// run them, and counters would count twice.
+func (c *redisClient) pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	for attempt := 0; ; attempt++ {
+		rc, err := c.conn(ctx, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		replies, sent, err := c.exchange(ctx, rc, cmds)
+		if err == nil {
+			rc.pooled = true
+			select {
+			case c.idle <- rc:
+			default:
+				rc.Close()
+			}
+			return replies, nil
+		}
+		rc.Close()
+		if sent || !rc.pooled || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// do sends one command and returns its reply.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := firstError(replies); err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// exchange writes cmds to rc and reads their replies. sent reports whether
+// any of cmds reached the connection, failing or not.
+func (c *redisClient) exchange(ctx context.Context, rc *redisConn, cmds [][]string) (replies []any, sent bool, err error) {
+	deadline := time.Now().Add(cmp.Or(time.Duration(c.cfg.Timeout), time.Second))
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rc.SetDeadline(deadline)
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(args)), 10)
+		buf = append(buf, "\r\n"...)
+		for _, a := range args {
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(len(a)), 10)
+			buf = append(buf, "\r\n"...)
+			buf = append(buf, a...)
+			buf = append(buf, "\r\n"...)
+		}
+	}
+	if n, err := rc.Write(buf); err != nil {
+		return nil, n > 0, err
+	}
+	replies = make([]any, len(cmds))
+	for i := range replies {
+		if replies[i], err = readReply(rc.r); err != nil {
+			return nil, true, err
+		}
+	}
+	return replies, true, nil
+}
+
+// readReply reads one RESP2 reply: a string, int64, nil, []any or
+// redisError.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
+
+func firstError(replies []any) error {
+	for _, v := range replies {
+		if err, ok := v.(redisError); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves RESP on a local port. reply returns what to answer a
+// command with: a raw RESP reply, "" to never answer, or "close" to hang
+// up without one. It returns the address and the commands seen so far.
+func fakeRedis(t *testing.T, reply func(args []string) string) (string, func() [][]string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var seen [][]string
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				for {
+					v, err := readReply(r)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, a := range v.([]any) {
+						args = append(args, a.(string))
+					}
+					mu.Lock()
+					seen = append(seen, args)
+					mu.Unlock()
+					switch out := reply(args); out {
+					case "":
+					case "close":
+						return
+					default:
+						nc.Write([]byte(out))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), seen...)
+	}
+}
+
+// TestRedisPipelineNoResend checks commands that reached the server are
+// never sent again, however their reply failed, so INCR counts once.
+func TestRedisPipelineNoResend(t *testing.T) {
+	for _, tc := range []struct{ name, reply string }{
+		{"read timeout", ""},
+		{"hung up", "close"},
+	} {
+		addr, seen := fakeRedis(t, func(args []string) string {
+			if args[0] == "PING" {
+				return "+PONG\r\n"
+			}
+			return tc.reply
+		})
+		c := newRedisClient(RedisConfig{Addr: addr, Timeout: Duration(50 * time.Millisecond)})
+		// Pool a connection, as one that may have gone stale.
+		if _, err := c.do(context.Background(), "PING"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.do(context.Background(), "INCR", "k"); err == nil {
+			t.Errorf("%s: INCR succeeded", tc.name)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if got := seen(); len(got) != 2 || got[1][0] != "INCR" {
+			t.Errorf("%s: server saw %q, want PING and one INCR", tc.name, got)
+		}
+	}
+}
+
+// TestRedisPipelineRetriesUnsent checks commands an idle connection
+// couldn't take are sent on a new one.
+func TestRedisPipelineRetriesUnsent(t *testing.T) {
+	addr, seen := fakeRedis(t, func(args []string) string { return ":1\r\n" })
+	c := newRedisClient(RedisConfig{Addr: addr})
+	ctx := context.Background()
+	if _, err := c.do(ctx, "INCR", "k"); err != nil {
+		t.Fatal(err)
+	}
+	rc := <-c.idle
+	rc.Close()
+	c.idle <- rc
+	if v, err := c.do(ctx, "INCR", "k"); err != nil || v != int64(1) {
+		t.Fatalf("INCR on a closed idle connection = %v, %v; want it retried", v, err)
+	}
+	if got := seen(); len(got) != 2 {
+		t.Errorf("server saw %q, want two INCRs", got)
+	}
+	// A new connection failing is not retried.
+	c = newRedisClient(RedisConfig{Addr: "127.0.0.1:1", Timeout: Duration(50 * time.Millisecond)})
+	if _, err := c.do(ctx, "INCR", "k"); err == nil {
+		t.Errorf("INCR with no server succeeded")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// replayItem is one captured request with the reply it got.
+type replayItem struct {
+	id, source string
+	path       string
+	body       map[string]any
+	model      string
+	status     int
+	text       string
+}
+
+// ReplayResult compares a request's new reply with its original.
+type ReplayResult struct {
+	ID             string   `json:"id"`
+	Source         string   `json:"source"`
+	Path           string   `json:"path"`
+	OriginalModel  string   `json:"original_model,omitempty"`
+	Model          string   `json:"model,omitempty"`
+	OriginalStatus int      `json:"original_status"`
+	Status         int      `json:"status"`
+	Error          string   `json:"error,omitempty"`
+	Identical      bool     `json:"identical"`
+	Similarity     float64  `json:"similarity"`
+	Latency        Duration `json:"latency"`
+	Original       string   `json:"original"`
+	Replayed       string   `json:"replayed"`
+}
+
+// ReplayReport sums up a replay.
+type ReplayReport struct {
+	Requests       int            `json:"requests"`
+	Identical      int            `json:"identical"`
+	StatusChanged  int            `json:"status_changed"`
+	Errors         int            `json:"errors"`
+	MeanSimilarity float64        `json:"mean_similarity"`
+	Results        []ReplayResult `json:"results"`
+}
+
+// runReplay implements the replay subcommand: it sends the requests of
+// captures, recordings and sessions again, to -url and as -model when
+// given, and compares each reply's text with the one recorded. Requests
+// are sent unstreamed, whatever they were, so replies compare whole.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	base := fs.String("url", envOr("ZAI_PROXY_URL", "http://localhost:8080"), "proxy or upstream base URL to replay against")
+	key := fs.String("key", os.Getenv("ZAI_API_KEY"), "bearer token sent with each request")
+	model := fs.String("model", "", "model to request instead of the recorded one; sessions need it")
+	n := fs.Int("n", 0, "replay at most this many requests; 0 for all")
+	concurrency := fs.Int("c", 4, "concurrent requests")
+	timeout := fs.Duration("timeout", 5*time.Minute, "per-request timeout")
+	showDiff := fs.Bool("diff", false, "print the line diff of each changed reply")
+	asJSON := fs.Bool("json", false, "print the report, with both replies, as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [flags] <capture, HAR, recording or session file or directory>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("replay: -c must be positive")
+	}
+	var items []replayItem
+	for _, path := range fs.Args() {
+		got, err := loadReplayItems(path, *model)
+		if err != nil {
+			return err
+		}
+		items = append(items, got...)
+	}
+	if *n > 0 && len(items) > *n {
+		items = items[:*n]
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("replay: no replayable requests found")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	hc := &http.Client{Timeout: *timeout}
+	results := make([]ReplayResult, len(items))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			results[i] = replayOne(ctx, hc, strings.TrimSuffix(*base, "/"), *key, *model, &items[i])
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	rep := ReplayReport{Requests: len(results), Results: results}
+	for _, r := range results {
+		if r.Identical {
+			rep.Identical++
+		}
+		if r.Status != r.OriginalStatus {
+			rep.StatusChanged++
+		}
+		if r.Error != "" {
+			rep.Errors++
+		}
+		rep.MeanSimilarity += r.Similarity / float64(len(results))
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	printReplayReport(os.Stdout, rep, *showDiff)
+	return nil
+}
+
+func replayOne(ctx context.Context, hc *http.Client, base, key, model string, it *replayItem) ReplayResult {
+	res := ReplayResult{ID: it.id, Source: it.source, Path: it.path, OriginalModel: it.model,
+		Model: it.model, OriginalStatus: it.status, Original: it.text}
+	doc := make(map[string]any, len(it.body))
+	for k, v := range it.body {
+		doc[k] = v
+	}
+	if model != "" {
+		doc["model"], res.Model = model, model
+	}
+	if _, ok := doc["stream"]; ok {
+		doc["stream"] = false
+	}
+	delete(doc, "stream_options")
+	body, err := json.Marshal(doc)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+it.path, bytes.NewReader(body))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if strings.HasSuffix(it.path, "/messages") {
+		req.Header.Set("anthropic-version", "2023-06-01")
+	}
+	start := time.Now()
+	resp, err := hc.Do(req)
+	if err != nil {
+		res.Error, res.Latency = err.Error(), Duration(time.Since(start))
+		return res
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.Status, res.Latency = resp.StatusCode, Duration(time.Since(start))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if resp.StatusCode >= 300 {
+		var e apiError
+		if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+			res.Error = e.Error.Message
+		} else {
+			res.Error = resp.Status
+		}
+		return res
+	}
+	res.Replayed = replyText(b)
+	if v, err := decodeJSON(b); err == nil {
+		if d, ok := v.(map[string]any); ok {
+			if m, ok := d["model"].(string); ok && m != "" {
+				res.Model = m
+			}
+		}
+	}
+	res.Identical = res.Replayed == res.Original
+	res.Similarity = textSimilarity(res.Original, res.Replayed)
+	return res
+}
+
+// loadReplayItems reads the replayable requests of path, a file or a
+// directory of them, gzipped or not: capture JSON lines (archived ones too), HAR captures,
+// recordings, and sessions as /v1/sessions/{id} returns them, which replay
+// each assistant turn from the messages before it as model.
+func loadReplayItems(path, model string) ([]replayItem, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return loadReplayFile(path, model)
+	}
+	var items []replayItem
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(strings.TrimSuffix(p, ".gz")) {
+		case ".jsonl", ".json", ".har":
+			got, err := loadReplayFile(p, model)
+			if err != nil {
+				return err
+			}
+			items = append(items, got...)
+		}
+		return nil
+	})
+	return items, err
+}
+
+func loadReplayFile(path, model string) ([]replayItem, error) {
+	f, err := openMaybeGzip(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("replay: %s: %w", path, err)
+	}
+	name := filepath.Base(path)
+	var items []replayItem
+	if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".jsonl") {
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		sc.Buffer(make([]byte, 64<<10), 64<<20)
+		for line := 1; sc.Scan(); line++ {
+			var e CaptureEntry
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				return nil, fmt.Errorf("replay: %s:%d: %w", path, line, err)
+			}
+			if it, ok := captureItem(e, fmt.Sprintf("%s:%d", name, line)); ok {
+				items = append(items, it)
+			}
+		}
+		return items, sc.Err()
+	}
+	var doc struct {
+		Log *struct {
+			Entries []struct {
+				Request struct {
+					URL      string `json:"url"`
+					Method   string `json:"method"`
+					PostData *struct {
+						Text string `json:"text"`
+					} `json:"postData"`
+				} `json:"request"`
+				Response struct {
+					Status  int `json:"status"`
+					Content struct {
+						Text string `json:"text"`
+					} `json:"content"`
+				} `json:"response"`
+				Comment string `json:"comment"`
+				Model   string `json:"_model"`
+			} `json:"entries"`
+		} `json:"log"`
+		Recording
+		ID       string `json:"id"`
+		Messages []any  `json:"messages"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("replay: %s: %w", path, err)
+	}
+	switch {
+	case doc.Log != nil:
+		for i, e := range doc.Log.Entries {
+			if e.Request.Method != http.MethodPost || e.Request.PostData == nil {
+				continue
+			}
+			c := CaptureEntry{ID: e.Comment, Model: e.Model, Method: e.Request.Method, URL: e.Request.URL,
+				Request: e.Request.PostData.Text, Status: e.Response.Status, Response: e.Response.Content.Text}
+			if it, ok := captureItem(c, fmt.Sprintf("%s#%d", name, i+1)); ok {
+				items = append(items, it)
+			}
+		}
+	case doc.Request.Path != "":
+		var body bytes.Buffer
+		for _, c := range doc.Response.Chunks {
+			body.Write(c.bytes())
+		}
+		c := CaptureEntry{Method: doc.Request.Method, URL: doc.Request.Path, Request: doc.Request.Body,
+			Status: doc.Response.Status, Response: body.String()}
+		if it, ok := captureItem(c, name); ok {
+			items = append(items, it)
+		}
+	case doc.Messages != nil:
+		if model == "" {
+			return nil, fmt.Errorf("replay: %s is a session, which names no model; set -model", path)
+		}
+		for i, m := range doc.Messages {
+			cm := asChatMessage(m)
+			if cm.Role != "assistant" || i == 0 {
+				continue
+			}
+			items = append(items, replayItem{id: fmt.Sprintf("%s#%d", doc.ID, i), source: name, path: "/v1/chat/completions",
+				body: map[string]any{"model": model, "messages": doc.Messages[:i]}, status: http.StatusOK, text: contentText(cm.Content)})
+		}
+	default:
+		return nil, fmt.Errorf("replay: %s is not a capture, recording or session", path)
+	}
+	return items, nil
+}
+
+// captureItem makes an item of a captured POST with a JSON object body.
+func captureItem(e CaptureEntry, source string) (replayItem, bool) {
+	if e.Method != "" && e.Method != http.MethodPost {
+		return replayItem{}, false
+	}
+	var raw []byte
+	switch b := e.Request.(type) {
+	case string:
+		raw = []byte(b)
+	case json.RawMessage:
+		raw = b
+	case map[string]any:
+		raw, _ = json.Marshal(b)
+	}
+	v, err := decodeJSON(raw)
+	body, _ := v.(map[string]any)
+	if err != nil || body == nil {
+		return replayItem{}, false
+	}
+	path := e.URL
+	if u, err := url.Parse(e.URL); err == nil {
+		path = u.Path
+	}
+	var reply []byte
+	switch b := e.Response.(type) {
+	case string:
+		reply = []byte(b)
+	case json.RawMessage:
+		reply = b
+	case map[string]any:
+		reply, _ = json.Marshal(b)
+	}
+	model, _ := body["model"].(string)
+	return replayItem{id: cmp.Or(e.ID, source), source: source, path: path, body: body,
+		model: cmp.Or(e.Model, model), status: e.Status, text: replyText(reply)}, true
+}
+
+// replyText is the completion text of a reply, a JSON body or the events
+// of a stream.
+func replyText(b []byte) string {
+	if v, err := decodeJSON(b); err == nil {
+		d, _ := v.(map[string]any)
+		return responseText(d)
+	}
+	var text strings.Builder
+	for _, line := range strings.Split(string(b), "\n") {
+		data, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "data:")
+		if !ok {
+			continue
+		}
+		if v, err := decodeJSON([]byte(strings.TrimSpace(data))); err == nil {
+			if d, ok := v.(map[string]any); ok {
+				text.WriteString(responseText(d))
+			}
+		}
+	}
+	return text.String()
+}
+
+// textSimilarity is 1 for equal texts, else the share of their words in a
+// longest common subsequence, over at most the first 5000 of each.
+func textSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	x, y := strings.Fields(a), strings.Fields(b)
+	x, y = x[:min(len(x), 5000)], y[:min(len(y), 5000)]
+	if len(x)+len(y) == 0 {
+		return 1
+	}
+	prev, cur := make([]int, len(y)+1), make([]int, len(y)+1)
+	for i := range x {
+		for j := range y {
+			if x[i] == y[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return 2 * float64(prev[len(y)]) / float64(len(x)+len(y))
+}
+
+// lineDiff writes the lines only a has with "-" and only b has with "+",
+// in order, or notes that the texts are too long to diff.
+func lineDiff(w io.Writer, a, b string) {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(x)*len(y) > 1<<20 {
+		fmt.Fprintln(w, "    (too long to diff)")
+		return
+	}
+	// lcs[i][j] is the common subsequence length of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(w, "      %s\n", x[i])
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(w, "    - %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(w, "    + %s\n", y[j])
+			j++
+		}
+	}
+}
+
+func printReplayReport(w io.Writer, rep ReplayReport, diff bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMODEL\tSTATUS\tSIMILARITY\tLATENCY\t")
+	for _, r := range rep.Results {
+		status := fmt.Sprintf("%d", r.Status)
+		if r.Status != r.OriginalStatus {
+			status = fmt.Sprintf("%d -> %d", r.OriginalStatus, r.Status)
+		}
+		model := r.Model
+		if r.OriginalModel != "" && r.OriginalModel != r.Model {
+			model = r.OriginalModel + " -> " + r.Model
+		}
+		sim := fmt.Sprintf("%.2f", r.Similarity)
+		if r.Identical {
+			sim = "identical"
+		} else if r.Error != "" {
+			sim = "error: " + r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", r.ID, model, status, sim, time.Duration(r.Latency).Round(time.Millisecond))
+	}
+	tw.Flush()
+	if diff {
+		for _, r := range rep.Results {
+			if r.Identical || r.Error != "" {
+				continue
+			}
+			fmt.Fprintf(w, "\n%s:\n", r.ID)
+			lineDiff(w, r.Original, r.Replayed)
+		}
+	}
+	fmt.Fprintf(w, "\n%d replayed, %d identical, %d with a changed status, %d failed; mean similarity %.2f\n",
+		rep.Requests, rep.Identical, rep.StatusChanged, rep.Errors, rep.MeanSimilarity)
+}
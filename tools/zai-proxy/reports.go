@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReportConfig schedules a usage summary per client. Clients empty means
+// every client with traffic in the period. With EmailTo set, the payload is
+// shaped as an email (to/subject/text) with the report attached as JSON.
+type ReportConfig struct {
+	Name     string   `json:"name"`
+	Schedule string   `json:"schedule"`
+	Webhook  string   `json:"webhook"`
+	Clients  []string `json:"clients"`
+	EmailTo  []string `json:"email_to"`
+	TopN     int      `json:"top_models"`
+}
+
+// UsageSummary is one client's report for a period.
+type UsageSummary struct {
+	Report    string        `json:"report"`
+	Client    string        `json:"client"`
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Totals    UsageTotals   `json:"totals"`
+	ErrorRate float64       `json:"error_rate"`
+	TopModels []ModelTotals `json:"top_models"`
+}
+
+// ModelTotals is a per-model line of a summary.
+type ModelTotals struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+type emailPayload struct {
+	To      []string     `json:"to"`
+	Subject string       `json:"subject"`
+	Text    string       `json:"text"`
+	Report  UsageSummary `json:"report"`
+}
+
+// reportPeriod is the span that ended at the scheduled time.
+func reportPeriod(sched string, at time.Time) time.Time {
+	switch sched {
+	case "hourly":
+		return at.Add(-time.Hour)
+	case "weekly":
+		return at.AddDate(0, 0, -7)
+	}
+	return at.AddDate(0, 0, -1)
+}
+
+func buildSummaries(ctx context.Context, src usageSource, rc ReportConfig, from, to time.Time) ([]UsageSummary, error) {
+	rows, err := src.QueryUsage(ctx, UsageQuery{From: from, To: to, GroupBy: []string{"client", "model"}})
+	if err != nil {
+		return nil, err
+	}
+	byClient := make(map[string]*UsageSummary)
+	for _, r := range rows {
+		s := byClient[r.Client]
+		if s == nil {
+			s = &UsageSummary{Report: rc.Name, Client: r.Client, From: from, To: to}
+			byClient[r.Client] = s
+		}
+		s.Totals.merge(&r.UsageTotals)
+		s.TopModels = append(s.TopModels, ModelTotals{Model: r.Model, UsageTotals: r.UsageTotals})
+	}
+	top := rc.TopN
+	if top <= 0 {
+		top = 5
+	}
+	names := rc.Clients
+	if len(names) == 0 {
+		for name := range byClient {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	out := make([]UsageSummary, 0, len(names))
+	for _, name := range names {
+		s := byClient[name]
+		if s == nil {
+			s = &UsageSummary{Report: rc.Name, Client: name, From: from, To: to}
+		}
+		if s.Totals.Requests > 0 {
+			s.ErrorRate = float64(s.Totals.Errors) / float64(s.Totals.Requests)
+		}
+		sort.Slice(s.TopModels, func(i, j int) bool {
+			a, b := s.TopModels[i], s.TopModels[j]
+			return a.PromptTokens+a.CompletionTokens > b.PromptTokens+b.CompletionTokens
+		})
+		if len(s.TopModels) > top {
+			s.TopModels = s.TopModels[:top]
+		}
+		out = append(out, *s)
+	}
+	return out, nil
+}
+
+func (s UsageSummary) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage for %s from %s to %s\n\n", s.Client, s.From.Format(time.RFC3339), s.To.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Requests: %d (%.2f%% errors)\n", s.Totals.Requests, s.ErrorRate*100)
+	fmt.Fprintf(&b, "Tokens: %d prompt, %d completion\n", s.Totals.PromptTokens, s.Totals.CompletionTokens)
+	fmt.Fprintf(&b, "Cost: $%.4f\n", s.Totals.CostUSD)
+	if len(s.TopModels) > 0 {
+		b.WriteString("\nTop models:\n")
+		for _, m := range s.TopModels {
+			fmt.Fprintf(&b, "  %s: %d tokens, $%.4f\n", m.Model, m.PromptTokens+m.CompletionTokens, m.CostUSD)
+		}
+	}
+	return b.String()
+}
+
+// postJSON delivers v to url, retrying transient failures.
+func postJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, client, url, body, nil)
+}
+
+// postBody POSTs a JSON body with extra headers, retrying transient failures.
+func postBody(ctx context.Context, client *http.Client, url string, body []byte, header http.Header) error {
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook returned %s", resp.Status)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	return lastErr
+}
+
+// reportJob builds the scheduled job for rc.
+func reportJob(rc ReportConfig, src usageSource, client *http.Client) (Job, error) {
+	sched, err := parseSchedule(rc.Schedule)
+	if err != nil {
+		return Job{}, fmt.Errorf("report %q: %w", rc.Name, err)
+	}
+	if rc.Webhook == "" {
+		return Job{}, fmt.Errorf("report %q: webhook is required", rc.Name)
+	}
+	return Job{
+		Name:     "report:" + rc.Name,
+		Schedule: sched,
+		Run: func(ctx context.Context, at time.Time) error {
+			summaries, err := buildSummaries(ctx, src, rc, reportPeriod(rc.Schedule, at), at)
+			if err != nil {
+				return err
+			}
+			for _, s := range summaries {
+				var payload any = s
+				if len(rc.EmailTo) > 0 {
+					payload = emailPayload{
+						To:      rc.EmailTo,
+						Subject: fmt.Sprintf("[%s] Usage report for %s", rc.Name, s.Client),
+						Text:    s.text(),
+						Report:  s,
+					}
+				}
+				if err := postJSON(ctx, client, rc.Webhook, payload); err != nil {
+					return fmt.Errorf("deliver %s: %w", s.Client, err)
+				}
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// RequestLogConfig keeps what is known of each recent request, for the
+// logs subcommand to show without a logging stack. Entries hold metadata
+// only, never bodies, headers or query strings, and are appended to
+// requests.jsonl in Dir; a file reaching MaxBytes (default 16MB) is
+// rotated out under the time it was, and MaxFiles (default 8) are kept,
+// fewer as the retention policy has it.
+type RequestLogConfig struct {
+	Dir      string `json:"dir,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+	MaxFiles int    `json:"max_files,omitempty"`
+	RetentionPolicy
+}
+
+func (c *RequestLogConfig) validate() error {
+	if c.MaxBytes < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("log: requests: max_bytes and max_files must not be negative")
+	}
+	if err := c.RetentionPolicy.validate(); err != nil {
+		return fmt.Errorf("log: requests: %w", err)
+	}
+	return nil
+}
+
+// RequestLogEntry is one request as kept in the request log.
+type RequestLogEntry struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Method   string    `json:"method,omitempty"`
+	Route    string    `json:"route"`
+	Path     string    `json:"path,omitempty"`
+	Client   string    `json:"client"`
+	Project  string    `json:"project,omitempty"`
+	Agent    string    `json:"agent,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Status   int       `json:"status"`
+	Duration Duration  `json:"duration"`
+	Usage    Usage     `json:"usage"`
+	CostUSD  float64   `json:"cost_usd,omitempty"`
+	Replayed bool      `json:"replayed,omitempty"`
+}
+
+const requestLogName = "requests.jsonl"
+
+// requestLog appends entries to the current file, rotating it when full.
+type requestLog struct {
+	cfg RequestLogConfig
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRequestLog returns the configured request log, or nil when off.
+func openRequestLog(cfg RequestLogConfig) (*requestLog, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	l := &requestLog{cfg: cfg}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *requestLog) open() error {
+	f, err := os.OpenFile(filepath.Join(l.cfg.Dir, requestLogName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, st.Size()
+	return nil
+}
+
+// rotatedName is the name of a file rotated out at t. Rotated files are
+// never renamed again, so they can be compressed while others rotate.
+func rotatedName(dir string, t time.Time) string {
+	return filepath.Join(dir, "requests-"+t.UTC().Format("20060102T150405.000")+".jsonl")
+}
+
+// rotate moves the current file aside, dropping the oldest beyond
+// MaxFiles, and starts a new one; callers hold mu.
+func (l *requestLog) rotate() error {
+	l.f.Close()
+	keep := cmp.Or(l.cfg.MaxFiles, 8)
+	cur := filepath.Join(l.cfg.Dir, requestLogName)
+	if keep > 1 {
+		os.Rename(cur, rotatedName(l.cfg.Dir, time.Now()))
+	} else {
+		os.Remove(cur)
+	}
+	old := requestLogFiles(l.cfg.Dir)
+	for old = old[:len(old)-1]; len(old) > keep-1; old = old[1:] {
+		os.Remove(old[0])
+	}
+	return l.open()
+}
+
+// requestLogPatterns match the request log's files.
+func requestLogPatterns(dir string) []string {
+	return []string{filepath.Join(dir, requestLogName), filepath.Join(dir, "requests-*.jsonl"),
+		filepath.Join(dir, "requests-*.jsonl.gz"), filepath.Join(dir, "requests.*.jsonl")}
+}
+
+func (l *requestLog) add(e RequestLogEntry) {
+	if l == nil {
+		return
+	}
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(b)) > cmp.Or(l.cfg.MaxBytes, 16<<20) {
+		if err := l.rotate(); err != nil {
+			log.Printf("Error rotating request log: %v", err)
+			l.f = nil
+			return
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing request log: %v", err)
+	}
+}
+
+// requestLogFiles returns the request log's files, oldest first: any
+// numbered the way older versions rotated them, then the rotated ones by
+// time, then the current one.
+func requestLogFiles(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "requests.*.jsonl"))
+	n := func(path string) int {
+		v, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "requests."), ".jsonl"))
+		return v
+	}
+	sort.Slice(matches, func(i, j int) bool { return n(matches[i]) > n(matches[j]) })
+	var rotated []string
+	for _, pattern := range requestLogPatterns(dir)[1:3] {
+		m, _ := filepath.Glob(pattern)
+		rotated = append(rotated, m...)
+	}
+	sort.Strings(rotated)
+	return append(append(matches, rotated...), filepath.Join(dir, requestLogName))
+}
+
+// scanRequestLog calls fn with each entry, oldest first.
+func scanRequestLog(dir string, fn func(RequestLogEntry, []byte)) error {
+	for _, path := range requestLogFiles(dir) {
+		f, err := openMaybeGzip(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for sc.Scan() {
+			var e RequestLogEntry
+			if json.Unmarshal(sc.Bytes(), &e) == nil {
+				fn(e, sc.Bytes())
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLogs implements the logs subcommand.
+func runLogs(args []string) error {
+	if len(args) == 0 || args[0] != "tail" && args[0] != "grep" && args[0] != "show" {
+		return fmt.Errorf("usage: %s logs tail | grep <pattern> | show <request-id> [-config file] [-dir dir] [-n lines] [-json]", os.Args[0])
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("logs "+sub, flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file naming the request log")
+	dir := fs.String("dir", "", "request log directory, overriding the config")
+	lines := fs.Int("n", 20, "entries to show; 0 for all (tail, grep)")
+	follow := fs.Bool("f", false, "keep showing entries as they are written (tail)")
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	fs.Parse(args[1:])
+	if *dir == "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		*dir = cfg.Log.Requests.Dir
+	}
+	if *dir == "" {
+		return fmt.Errorf("no request log configured")
+	}
+
+	var arg string
+	if sub != "tail" {
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s logs %s [flags] <%s>", os.Args[0], sub, map[string]string{"grep": "pattern", "show": "request-id"}[sub])
+		}
+		arg = fs.Arg(0)
+	}
+	if sub == "show" {
+		var found []byte
+		err := scanRequestLog(*dir, func(e RequestLogEntry, b []byte) {
+			if e.ID == arg {
+				found = append(found[:0], b...)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if found == nil {
+			return fmt.Errorf("no request %s in the request log", arg)
+		}
+		var v any
+		json.Unmarshal(found, &v)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	var match func([]byte) bool
+	if sub == "grep" {
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return err
+		}
+		match = re.Match
+	}
+	var kept []RequestLogEntry
+	var raw [][]byte
+	err := scanRequestLog(*dir, func(e RequestLogEntry, b []byte) {
+		if match != nil && !match(b) {
+			return
+		}
+		kept, raw = append(kept, e), append(raw, append([]byte(nil), b...))
+		if *lines > 0 && len(kept) > *lines {
+			kept, raw = kept[1:], raw[1:]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	out := newLogPrinter(os.Stdout, *asJSON)
+	for i := range kept {
+		out.print(kept[i], raw[i])
+	}
+	out.flush()
+	if sub == "tail" && *follow {
+		return followRequestLog(*dir, out)
+	}
+	return nil
+}
+
+// logPrinter prints entries as a table or as JSON lines.
+type logPrinter struct {
+	w      io.Writer
+	tw     *tabwriter.Writer
+	asJSON bool
+	header bool
+}
+
+func newLogPrinter(w io.Writer, asJSON bool) *logPrinter {
+	return &logPrinter{w: w, tw: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0), asJSON: asJSON}
+}
+
+func (p *logPrinter) print(e RequestLogEntry, raw []byte) {
+	if p.asJSON {
+		p.w.Write(append(raw, '\n'))
+		return
+	}
+	if !p.header {
+		fmt.Fprintln(p.tw, "TIME\tID\tSTATUS\tCLIENT\tMODEL\tDURATION\tTOKENS\tROUTE")
+		p.header = true
+	}
+	fmt.Fprintf(p.tw, "%s\t%s\t%d\t%s\t%s\t%s\t%d\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.ID, e.Status,
+		e.Client, cmp.Or(e.Model, "-"), time.Duration(e.Duration).Round(time.Microsecond), e.Usage.Total(), e.Route)
+}
+
+func (p *logPrinter) flush() { p.tw.Flush() }
+
+// followRequestLog prints entries appended to the current file, starting
+// from its end, across rotations.
+func followRequestLog(dir string, out *logPrinter) error {
+	path := filepath.Join(dir, requestLogName)
+	var f *os.File
+	var r *bufio.Reader
+	var partial []byte
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if f != nil {
+				if r == nil {
+					// Only the first file is already shown.
+					f.Seek(0, io.SeekEnd)
+				}
+				r = bufio.NewReader(f)
+			}
+		}
+		if f != nil {
+			for {
+				line, err := r.ReadBytes('\n')
+				partial = append(partial, line...)
+				if err != nil {
+					break
+				}
+				var e RequestLogEntry
+				if json.Unmarshal(partial, &e) == nil {
+					out.print(e, []byte(strings.TrimSuffix(string(partial), "\n")))
+				}
+				partial = partial[:0]
+			}
+			out.flush()
+			// A new file at path means this one was rotated out.
+			if a, err1 := f.Stat(); err1 == nil {
+				if b, err2 := os.Stat(path); err2 == nil && !os.SameFile(a, b) {
+					f.Close()
+					f, partial = nil, partial[:0]
+					continue
+				}
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RestartConfig covers replacing a running proxy, say with an upgraded
+// binary or config, without refusing a connection or cutting a stream
+// short. On SIGUSR2 or POST /admin/restart the proxy starts its executable
+// again, as it is on disk now and with the same arguments, and hands the
+// new process its listening sockets. Once that one serves, this one stops accepting
+// connections and exits when the requests it has in flight are done, or
+// after DrainTimeout (default 15m). If the new process fails to start,
+// this one serves on. PIDFile, when set, holds the ID of the process
+// serving, for service managers to follow.
+type RestartConfig struct {
+	DrainTimeout Duration `json:"drain_timeout,omitempty"`
+	PIDFile      string   `json:"pid_file,omitempty"`
+}
+
+func (c *RestartConfig) validate() error {
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("restart: drain_timeout must not be negative")
+	}
+	return nil
+}
+
+// The variables listeners are handed over in: name=fd pairs, and the fd
+// the new process reports being ready on.
+const (
+	listenersEnv = "ZAI_PROXY_LISTENERS"
+	readyEnv     = "ZAI_PROXY_READY_FD"
+)
+
+// servers are the listeners this process serves, kept by name to be
+// handed over on a restart.
+type servers struct {
+	cfg       *RestartConfig
+	inherited map[string]*os.File
+	ready     *os.File
+	restarts  chan chan error
+	persist   func() // saves what the next process is to start from
+	leaving   func() // gives up what only one process may hold
+
+	mu     sync.Mutex
+	names  []string
+	lns    map[string]net.Listener
+	srvs   []*http.Server
+	stopBy time.Time // once stopping, when to exit by
+}
+
+// newServers takes in the listeners handed over by the process that
+// started this one, if any.
+func newServers(cfg *RestartConfig) *servers {
+	s := &servers{cfg: cfg, inherited: map[string]*os.File{}, lns: map[string]net.Listener{}, restarts: make(chan chan error)}
+	for _, pair := range strings.Split(os.Getenv(listenersEnv), ",") {
+		name, fd, ok := strings.Cut(pair, "=")
+		if n, err := strconv.Atoi(fd); ok && err == nil {
+			s.inherited[name] = os.NewFile(uintptr(n), name)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv(readyEnv)); err == nil {
+		s.ready = os.NewFile(uintptr(n), "ready")
+	}
+	os.Unsetenv(listenersEnv)
+	os.Unsetenv(readyEnv)
+	return s
+}
+
+// listen opens the listener named name at addr, or takes over the one
+// handed over under that name.
+func (s *servers) listen(name, addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if f := s.inherited[name]; f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+		delete(s.inherited, name)
+	} else {
+		ln, err = listen(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.names = append(s.names, name)
+	s.lns[name] = ln
+	s.mu.Unlock()
+	return ln, nil
+}
+
+// serve serves h on ln until the process is replaced.
+func (s *servers) serve(ln net.Listener, h http.Handler) {
+	srv := &http.Server{Handler: h}
+	s.mu.Lock()
+	s.srvs = append(s.srvs, srv)
+	s.mu.Unlock()
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// started tells the process that handed over the listeners, if one did,
+// that this one serves them now.
+func (s *servers) started() {
+	for name, f := range s.inherited {
+		// Listeners no longer configured.
+		f.Close()
+		delete(s.inherited, name)
+	}
+	if s.cfg.PIDFile != "" {
+		if err := os.WriteFile(s.cfg.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			log.Printf("Error writing PID file: %v", err)
+		}
+	}
+	if s.ready != nil {
+		s.ready.Write([]byte{1})
+		s.ready.Close()
+		s.ready = nil
+	}
+}
+
+// restart asks the process to replace itself, returning once the new
+// process serves or has failed to.
+func (s *servers) restart() error {
+	done := make(chan error, 1)
+	s.restarts <- done
+	return <-done
+}
+
+// stopping notes that the process is to stop within grace, unless it
+// already was, and returns when it must exit by.
+func (s *servers) stopping(grace time.Duration) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopBy.IsZero() {
+		s.stopBy = time.Now().Add(grace)
+	}
+	return s.stopBy
+}
+
+// run serves until the process has been replaced, or told to stop with
+// SIGTERM, and its requests in flight, counted by inFlight, are done.
+// SIGTERM leaves them grace to finish in.
+func (s *servers) run(inFlight func() int64, grace time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append(handOverSignals, syscall.SIGTERM)...)
+	defer serviceControl(sig, grace)()
+	for {
+		var done chan error
+		select {
+		case v := <-sig:
+			if v == syscall.SIGTERM {
+				infof("Stopping")
+				if s.leaving != nil {
+					s.leaving()
+				}
+				s.drain(inFlight, s.stopping(grace))
+				if s.persist != nil {
+					s.persist()
+				}
+				return
+			}
+		case done = <-s.restarts:
+		}
+		err := s.handOver()
+		if done != nil {
+			done <- err
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Error restarting: %v", err)
+	}
+	if s.leaving != nil {
+		s.leaving()
+	}
+	timeout := cmp.Or(time.Duration(s.cfg.DrainTimeout), 15*time.Minute)
+	infof("Handed over; draining for up to %s", timeout)
+	s.drain(inFlight, time.Now().Add(timeout))
+}
+
+// handOver starts the new process with the listeners and waits for it to
+// serve.
+func (s *servers) handOver() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if s.persist != nil {
+		s.persist()
+	}
+	s.mu.Lock()
+	var files []*os.File
+	var pairs []string
+	for _, name := range s.names {
+		ln := s.lns[name]
+		if ul, ok := ln.(*net.UnixListener); ok {
+			// The socket file stays for the new process.
+			ul.SetUnlinkOnClose(false)
+		}
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			s.mu.Unlock()
+			w.Close()
+			return err
+		}
+		defer f.Close()
+		pairs = append(pairs, name+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(pairs, ","), readyEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	infof("Started process %d to take over", cmd.Process.Pid)
+
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case ok := <-ready:
+		if ok {
+			return nil
+		}
+		return fmt.Errorf("process %d exited before serving: %v", cmd.Process.Pid, <-exited)
+	case err := <-exited:
+		return fmt.Errorf("process %d exited before serving: %v", cmd.Process.Pid, err)
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		return fmt.Errorf("process %d did not serve within a minute", cmd.Process.Pid)
+	}
+}
+
+// drain stops accepting connections and waits until deadline for those
+// open, and the requests in flight, to finish.
+func (s *servers) drain(inFlight func() int64, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	s.mu.Lock()
+	srvs := s.srvs
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+	// Shutdown leaves out hijacked connections, such as realtime sessions.
+	for inFlight() > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if n := inFlight(); n > 0 {
+		log.Printf("Drain timed out with %d requests in flight", n)
+		return
+	}
+	infof("Drained")
+}
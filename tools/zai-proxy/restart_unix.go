@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handOverSignals start a restart, as POST /admin/restart does.
+var handOverSignals = []os.Signal{syscall.SIGUSR2}
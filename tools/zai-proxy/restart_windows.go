@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// handOverSignals is empty: Windows has no SIGUSR2, so a restart there
+// comes only from POST /admin/restart.
+var handOverSignals []os.Signal
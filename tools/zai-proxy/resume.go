@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResumeConfig lets clients pick up streamed completions where they lost
+// them. Each event of a streamed response gets an ID, "<request ID>.<n>",
+// in place of any the upstream gave it, and the last Window (default 1000)
+// events are kept. A stream runs on to the end when its client goes away,
+// and is kept TTL (default 5m) longer. A request sent again with
+// Last-Event-ID set to an ID the same client was given is answered from
+// the kept events and then, if the stream is still running, its new ones,
+// without being sent upstream or accounted again. One naming events no
+// longer kept is refused with 410, so the client doesn't mistake a new
+// generation for the rest of the old one. At most MaxStreams (default
+// 1000) streams of MaxBytes (default 64MB) in all are kept, those used
+// least recently dropped first; they can no longer be resumed, but run on.
+type ResumeConfig struct {
+	Enabled    bool     `json:"enabled,omitempty"`
+	Window     int      `json:"window,omitempty"`
+	TTL        Duration `json:"ttl,omitempty"`
+	MaxStreams int      `json:"max_streams,omitempty"`
+	MaxBytes   int64    `json:"max_bytes,omitempty"`
+}
+
+func (c *ResumeConfig) validate() error {
+	if c.Window < 0 || c.TTL < 0 || c.MaxStreams < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("resume: window, ttl, max_streams and max_bytes must not be negative")
+	}
+	return nil
+}
+
+var streamResumes = metrics.counter("zai_proxy_stream_resumes_total",
+	"Reconnects naming a Last-Event-ID, by outcome.", "outcome")
+
+// sseStream is the kept tail of one event stream.
+type sseStream struct {
+	client string
+	status int
+	header http.Header
+
+	mu      sync.Mutex
+	first   int // number of events[0]; events are numbered from 1
+	events  [][]byte
+	size    int64 // of events
+	done    bool
+	changed chan struct{} // closed and replaced as events arrive
+}
+
+// resumeStreams holds the streams that can be resumed.
+type resumeStreams struct {
+	cfg *ResumeConfig
+
+	mu sync.Mutex
+	m  *lru[string, *sseStream]
+}
+
+func newResumeStreams(cfg *ResumeConfig) *resumeStreams {
+	return &resumeStreams{cfg: cfg, m: newLRU("resume", cmp.Or(cfg.MaxStreams, 1000), cmp.Or(cfg.MaxBytes, 64<<20),
+		func(id string, s *sseStream) int64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return int64(len(id)) + s.size
+		})}
+}
+
+func (rs *resumeStreams) get(id string) *sseStream {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s, _ := rs.m.get(id)
+	return s
+}
+
+// start keeps a new stream under id.
+func (rs *resumeStreams) start(id, client string, status int, h http.Header) *sseStream {
+	s := &sseStream{client: client, status: status, header: h.Clone(), first: 1, changed: make(chan struct{})}
+	rs.mu.Lock()
+	rs.m.put(id, s)
+	rs.mu.Unlock()
+	return s
+}
+
+// grew notes that id's stream has kept another event.
+func (rs *resumeStreams) grew(id string) {
+	rs.mu.Lock()
+	rs.m.resize(id)
+	rs.mu.Unlock()
+}
+
+// end marks id's stream finished and forgets it after the TTL.
+func (rs *resumeStreams) end(id string, s *sseStream) {
+	s.mu.Lock()
+	s.done = true
+	close(s.changed)
+	s.mu.Unlock()
+	time.AfterFunc(cmp.Or(time.Duration(rs.cfg.TTL), 5*time.Minute), func() {
+		rs.mu.Lock()
+		rs.m.remove(id)
+		rs.mu.Unlock()
+	})
+}
+
+// add keeps an event, dropping the oldest beyond the window, and returns
+// its number.
+func (s *sseStream) add(event []byte, window int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	s.size += int64(len(event))
+	if drop := len(s.events) - window; drop > 0 {
+		for _, e := range s.events[:drop] {
+			s.size -= int64(len(e))
+		}
+		s.events = append(s.events[:0:0], s.events[drop:]...)
+		s.first += drop
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.first + len(s.events) - 1
+}
+
+// since returns the kept events after the n'th, whether the stream has
+// ended, and a channel closed when that changes. ok is false once events
+// after n are no longer kept.
+func (s *sseStream) since(n int) (events [][]byte, done bool, changed <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.first + len(s.events) - 1
+	if n+1 < s.first || n > last {
+		return nil, s.done, s.changed, false
+	}
+	return s.events[n+1-s.first:], s.done, s.changed, true
+}
+
+// detachedWriter lets a response run on after its client has gone: what
+// can't be sent still passes the stages above, which account for it.
+type detachedWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *detachedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *detachedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.Write(b)
+	return len(b), nil
+}
+
+func (w *detachedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *detachedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// resumeStage numbers the events of streamed responses and answers
+// reconnects from them. It follows idempotency, which answers retries of
+// unstreamed requests in the same way, and precedes the stages that keep
+// state of their own, so a reconnect changes nothing.
+func resumeStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	rc := &p.cfg.Resume
+	return func(next http.Handler) http.Handler {
+		if !rc.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if last := r.Header.Get("Last-Event-ID"); last != "" {
+				if id, n, ok := strings.Cut(last, "."); ok && len(id) == len(ex.id) && !ex.dryRun {
+					p.resumeStream(w, r, ex, id, n)
+					return
+				}
+			}
+			if stream, _ := ex.doc["stream"].(bool); !stream || ex.dryRun {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var s *sseStream
+			var event []byte
+			dw := &detachedWriter{ResponseWriter: w}
+			emit := func() []byte {
+				if len(event) == 0 {
+					return nil
+				}
+				if s == nil {
+					s = p.resumes.start(ex.id, ex.client, dw.status, w.Header())
+				}
+				n := s.add(event, cmp.Or(rc.Window, 1000))
+				p.resumes.grew(ex.id)
+				out := append([]byte("id: "+ex.id+"."+strconv.Itoa(n)+"\n"), event...)
+				event = nil
+				return out
+			}
+			sw := &sseWriter{ResponseWriter: dw, line: func(line []byte) ([]byte, error) {
+				body := bytes.TrimRight(line, "\r\n")
+				switch {
+				case len(event) == 0 && (len(body) == 0 || body[0] == ':'):
+					// Keep-alive comments needn't be kept.
+					return line, nil
+				case len(body) == 0:
+					event = append(event, line...)
+					return emit(), nil
+				case bytes.Equal(body, []byte("id")) || bytes.HasPrefix(body, []byte("id:")):
+					return nil, nil
+				}
+				event = append(event, line...)
+				return nil, nil
+			}, end: func() []byte {
+				if len(event) > 0 {
+					event = append(event, '\n')
+				}
+				return emit()
+			}}
+			// The stream runs on without its client, for it to reconnect to.
+			next.ServeHTTP(sw, r.WithContext(context.WithoutCancel(r.Context())))
+			sw.finish()
+			if s != nil {
+				p.resumes.end(ex.id, s)
+			}
+		})
+	}, nil
+}
+
+// resumeStream answers a reconnect to stream id after its n'th event.
+func (p *proxy) resumeStream(w http.ResponseWriter, r *http.Request, ex *exchange, id, n string) {
+	s := p.resumes.get(id)
+	after, err := strconv.Atoi(n)
+	if s == nil || s.client != ex.client || err != nil {
+		streamResumes.Add(1, "unknown")
+		writeError(w, http.StatusGone, "stream_expired", "the stream named by Last-Event-ID is no longer kept")
+		return
+	}
+	events, done, changed, ok := s.since(after)
+	if !ok {
+		streamResumes.Add(1, "expired")
+		writeError(w, http.StatusGone, "stream_expired", "the events after Last-Event-ID are no longer kept")
+		return
+	}
+	streamResumes.Add(1, "resumed")
+	ex.replayed = true
+	for k, vs := range s.header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = vs
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(s.status)
+	rc := http.NewResponseController(w)
+	for {
+		for _, e := range events {
+			after++
+			w.Write(append([]byte("id: "+id+"."+strconv.Itoa(after)+"\n"), e...))
+		}
+		rc.Flush()
+		if done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+		if events, done, changed, ok = s.since(after); !ok {
+			// The client fell behind the window; it can't be served in order.
+			return
+		}
+	}
+}
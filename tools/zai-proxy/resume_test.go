@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumeUpstream streams events "data: 1" to "data: <events>", with the
+// upstream's own IDs for the stage to replace, stopping after stopAt, if
+// set, until hold is closed.
+type resumeUpstream struct {
+	events, stopAt int
+	started, hold  chan struct{}
+}
+
+func (u *resumeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(": keep-alive\n\n"))
+	for i := 1; i <= u.events; i++ {
+		w.Write([]byte("id: upstream-" + strconv.Itoa(i) + "\ndata: " + strconv.Itoa(i) + "\n\n"))
+		if i == u.stopAt {
+			u.started <- struct{}{}
+			<-u.hold
+		}
+	}
+}
+
+func newResumeTest(t *testing.T, up http.Handler) (*proxy, http.Handler) {
+	t.Helper()
+	p := &proxy{cfg: defaultConfig()}
+	p.cfg.Resume = ResumeConfig{Enabled: true, Window: 3}
+	p.resumes = newResumeStreams(&p.cfg.Resume)
+	mw, err := resumeStage(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, mw(up)
+}
+
+// resumeRequest sends client's streamed request id, reconnecting after
+// last if it is set.
+func resumeRequest(h http.Handler, id, client, last string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+	if last != "" {
+		r.Header.Set("Last-Event-ID", last)
+	}
+	ex := &exchange{id: id, client: client, doc: map[string]any{"stream": true}}
+	r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// TestResumeStream numbers a stream's events and answers reconnects from
+// the ones still kept, refusing with 410 those it no longer has.
+func TestResumeStream(t *testing.T) {
+	_, h := newResumeTest(t, &resumeUpstream{events: 5})
+	rec := resumeRequest(h, "req-000001", "alice", "")
+	want := ": keep-alive\n\n"
+	for i := 1; i <= 5; i++ {
+		want += "id: req-000001." + strconv.Itoa(i) + "\ndata: " + strconv.Itoa(i) + "\n\n"
+	}
+	if rec.Body.String() != want {
+		t.Fatalf("stream =\n%q\nwant\n%q", rec.Body, want)
+	}
+	for _, tc := range []struct {
+		name, client, last string
+		want               int
+		body               string
+	}{
+		{"resumed", "alice", "req-000001.3", http.StatusOK,
+			"id: req-000001.4\ndata: 4\n\nid: req-000001.5\ndata: 5\n\n"},
+		{"at the end", "alice", "req-000001.5", http.StatusOK, ""},
+		{"window's first", "alice", "req-000001.2", http.StatusOK,
+			"id: req-000001.3\ndata: 3\n\nid: req-000001.4\ndata: 4\n\nid: req-000001.5\ndata: 5\n\n"},
+		{"evicted", "alice", "req-000001.1", http.StatusGone, "stream_expired"},
+		{"past the end", "alice", "req-000001.9", http.StatusGone, "stream_expired"},
+		{"another client's", "bob", "req-000001.3", http.StatusGone, "stream_expired"},
+		{"unknown stream", "alice", "req-000009.3", http.StatusGone, "stream_expired"},
+		{"not a number", "alice", "req-000001.x", http.StatusGone, "stream_expired"},
+	} {
+		rec := resumeRequest(h, "req-000002", tc.client, tc.last)
+		if rec.Code != tc.want || (tc.want == http.StatusOK && rec.Body.String() != tc.body) || !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("%s: status %d, body %q; want %d, %q", tc.name, rec.Code, rec.Body, tc.want, tc.body)
+		}
+		if tc.want == http.StatusOK && rec.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: Content-Type %q", tc.name, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// TestResumeRunningStream reconnects to a stream that has kept only some
+// of its events, and follows it to its end.
+func TestResumeRunningStream(t *testing.T) {
+	up := &resumeUpstream{events: 3, stopAt: 2, started: make(chan struct{}), hold: make(chan struct{})}
+	_, h := newResumeTest(t, up)
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- resumeRequest(h, "req-000001", "alice", "") }()
+	<-up.started
+	resumed := make(chan *httptest.ResponseRecorder)
+	go func() { resumed <- resumeRequest(h, "req-000002", "alice", "req-000001.1") }()
+	select {
+	case rec := <-resumed:
+		t.Fatalf("reconnect ended with the stream still running: %d %q", rec.Code, rec.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(up.hold)
+	<-first
+	select {
+	case rec := <-resumed:
+		if want := "id: req-000001.2\ndata: 2\n\nid: req-000001.3\ndata: 3\n\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("reconnect: status %d, body %q; want %q", rec.Code, rec.Body, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect didn't end with the stream")
+	}
+}
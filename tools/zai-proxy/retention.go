@@ -0,0 +1,233 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy bounds the files a feature keeps on disk: files older
+// than MaxAge are deleted, then the oldest while all of them total more
+// than MaxTotalBytes, and with Compress the rest are gzipped once written.
+// The file being written is never touched.
+type RetentionPolicy struct {
+	MaxAge        Duration `json:"max_age,omitempty"`
+	MaxTotalBytes int64    `json:"max_total_bytes,omitempty"`
+	Compress      bool     `json:"compress,omitempty"`
+}
+
+func (p *RetentionPolicy) validate() error {
+	if p.MaxAge < 0 || p.MaxTotalBytes < 0 {
+		return fmt.Errorf("max_age and max_total_bytes must not be negative")
+	}
+	return nil
+}
+
+// retentionInterval is how often kept files are swept.
+const retentionInterval = 10 * time.Minute
+
+var (
+	diskBytes = metrics.gauge("zai_proxy_disk_bytes", "Bytes of files kept on disk, by artifact.", "artifact")
+	diskFiles = metrics.gauge("zai_proxy_disk_files", "Files kept on disk, by artifact.", "artifact")
+
+	retentionRemoved = metrics.counter("zai_proxy_retention_removed_total",
+		"Files deleted to keep within their retention policy, by artifact and reason (age or size).", "artifact", "reason")
+	retentionCompressed = metrics.counter("zai_proxy_retention_compressed_total",
+		"Written files compressed by their retention policy, by artifact.", "artifact")
+)
+
+// keptFiles are the files of one artifact: those matching patterns, one
+// of which active may name as being written.
+type keptFiles struct {
+	artifact string
+	patterns []string
+	active   func() string
+	policy   RetentionPolicy
+}
+
+type keptFile struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+// sweep applies the policy and reports what is left.
+func (k keptFiles) sweep(now time.Time) {
+	var files []keptFile
+	seen := map[string]bool{}
+	for _, pattern := range k.patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			st, err := os.Stat(path)
+			if err != nil || !st.Mode().IsRegular() || seen[path] {
+				continue
+			}
+			seen[path] = true
+			files = append(files, keptFile{path, st.Size(), st.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	var active string
+	if k.active != nil {
+		active = k.active()
+	}
+	kept := files[:0]
+	for _, f := range files {
+		if f.path != active && k.policy.MaxAge > 0 && now.Sub(f.mod) > time.Duration(k.policy.MaxAge) {
+			if err := os.Remove(f.path); err == nil {
+				retentionRemoved.Add(1, k.artifact, "age")
+				continue
+			}
+		}
+		if f.path != active && k.policy.Compress && !strings.HasSuffix(f.path, ".gz") {
+			if size, err := gzipFile(f.path); err != nil {
+				log.Printf("Error compressing %s: %v", f.path, err)
+			} else {
+				f.path, f.size = f.path+".gz", size
+				retentionCompressed.Add(1, k.artifact)
+			}
+		}
+		kept = append(kept, f)
+	}
+	var total int64
+	for _, f := range kept {
+		total += f.size
+	}
+	for i := 0; k.policy.MaxTotalBytes > 0 && total > k.policy.MaxTotalBytes && i < len(kept); i++ {
+		if f := kept[i]; f.path != active && os.Remove(f.path) == nil {
+			total -= f.size
+			kept[i].path = ""
+			retentionRemoved.Add(1, k.artifact, "size")
+		}
+	}
+	n := 0
+	for _, f := range kept {
+		if f.path != "" {
+			n++
+		}
+	}
+	diskBytes.Set(float64(total), k.artifact)
+	diskFiles.Set(float64(n), k.artifact)
+}
+
+// gzipFile replaces path with path.gz, keeping its modification time, and
+// returns the compressed size.
+func gzipFile(path string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Ages count from when the file was written, not compressed.
+		err = os.Chtimes(tmp, st.ModTime(), st.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	in.Close()
+	os.Remove(path)
+	zst, err := os.Stat(path + ".gz")
+	if err != nil {
+		return 0, nil
+	}
+	return zst.Size(), nil
+}
+
+// openMaybeGzip opens path, decompressing it when it ends in .gz.
+func openMaybeGzip(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return f, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// retentionLoop sweeps kinds now and every retentionInterval. Every
+// replica sweeps its own disk.
+func retentionLoop(ctx context.Context, kinds []keptFiles) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, k := range kinds {
+			k.sweep(now)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sqlitePath is the database file a SQLite DSN names, or "".
+func sqlitePath(dsn string) string {
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if path == "" || path == ":memory:" {
+		return ""
+	}
+	return path
+}
+
+// keptArtifacts are the files the proxy keeps on disk under cfg: the
+// request log, captures, recordings and a SQLite usage database, which is
+// only measured here, its records being aged out by storage.retention.
+func keptArtifacts(cfg *Config, capture *captureSink) []keptFiles {
+	var out []keptFiles
+	if rl := cfg.Log.Requests; rl.Dir != "" {
+		cur := filepath.Join(rl.Dir, requestLogName)
+		out = append(out, keptFiles{artifact: "requests", patterns: requestLogPatterns(rl.Dir),
+			active: func() string { return cur }, policy: rl.RetentionPolicy})
+	}
+	if capture != nil {
+		out = append(out, keptFiles{artifact: "captures", patterns: capture.patterns(),
+			active: capture.current, policy: capture.cfg.RetentionPolicy})
+	}
+	if rc := cfg.Recording; rc.Dir != "" {
+		out = append(out, keptFiles{artifact: "recordings", patterns: []string{filepath.Join(rc.Dir, "*.json")},
+			policy: RetentionPolicy{MaxAge: rc.MaxAge, MaxTotalBytes: rc.MaxTotalBytes}})
+	}
+	if st := cfg.Storage; st.Driver == "sqlite" || st.Driver == "sqlite3" {
+		if path := sqlitePath(st.DSN); path != "" {
+			out = append(out, keptFiles{artifact: "usage_db", patterns: []string{path, path + "-wal", path + "-shm"}})
+		}
+	}
+	return out
+}
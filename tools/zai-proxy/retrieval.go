@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetrievalConfig adds retrieved passages to chat requests before they are
+// forwarded. Clients and Models restrict it as for system prompts. The
+// last user message is the query, answered either by Endpoint, which is
+// POSTed a RetrievalQuery and answers {"passages": [...]}, or by the
+// built-in vector store: Documents is a JSON lines file of passages, their
+// "embedding" optional, and queries and passages without one are embedded
+// by EmbeddingModel through the proxy. The best TopK (default 4) passages
+// scoring at least MinScore are rendered by Template, a template as in
+// pipelines over query and passages (each text, source and score), and
+// prepended as a system prompt. A failed lookup forwards the request
+// without passages.
+type RetrievalConfig struct {
+	Clients        []string          `json:"clients,omitempty"`
+	Models         []string          `json:"models,omitempty"`
+	Endpoint       string            `json:"endpoint,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Timeout        Duration          `json:"timeout,omitempty"`
+	Documents      string            `json:"documents,omitempty"`
+	EmbeddingModel string            `json:"embedding_model,omitempty"`
+	TopK           int               `json:"top_k,omitempty"`
+	MinScore       float64           `json:"min_score,omitempty"`
+	Template       promptTemplate    `json:"template,omitempty"`
+}
+
+func (c *RetrievalConfig) validate() error {
+	if (c.Endpoint == "") == (c.Documents == "") {
+		return fmt.Errorf("retrieval: set exactly one of endpoint and documents")
+	}
+	if c.Documents != "" && c.EmbeddingModel == "" {
+		return fmt.Errorf("retrieval: documents need an embedding_model")
+	}
+	if c.TopK < 0 || c.Timeout < 0 {
+		return fmt.Errorf("retrieval: top_k and timeout must not be negative")
+	}
+	return nil
+}
+
+// RetrievalQuery is sent to a retrieval endpoint.
+type RetrievalQuery struct {
+	Query  string `json:"query"`
+	TopK   int    `json:"top_k"`
+	Client string `json:"client"`
+	Model  string `json:"model"`
+}
+
+// Passage is a retrieved piece of text.
+type Passage struct {
+	Text   string  `json:"text"`
+	Source string  `json:"source,omitempty"`
+	Score  float64 `json:"score"`
+}
+
+var defaultRetrievalTemplate = func() promptTemplate {
+	var t promptTemplate
+	t.UnmarshalJSON([]byte(`"Answer using these passages where they are relevant:\n\n{{ context }}"`))
+	return t
+}()
+
+var retrievals = metrics.counter("zai_proxy_retrieval_total", "Retrieval lookups, by outcome.", "outcome")
+
+// retriever answers queries for one RetrievalConfig.
+type retriever struct {
+	cfg    *RetrievalConfig
+	client *http.Client
+
+	mu   sync.Mutex
+	docs []storedPassage
+}
+
+type storedPassage struct {
+	Text      string    `json:"text"`
+	Source    string    `json:"source,omitempty"`
+	Embedding []float64 `json:"embedding,omitempty"`
+}
+
+// newRetrievers loads the document files of the retrieval configs.
+func newRetrievers(cfgs []RetrievalConfig) ([]*retriever, error) {
+	out := make([]*retriever, len(cfgs))
+	for i := range cfgs {
+		c := &cfgs[i]
+		rt := &retriever{cfg: c, client: &http.Client{Timeout: cmp.Or(time.Duration(c.Timeout), 5*time.Second)}}
+		if c.Documents != "" {
+			docs, err := readPassages(c.Documents)
+			if err != nil {
+				return nil, err
+			}
+			rt.docs = docs
+		}
+		out[i] = rt
+	}
+	return out, nil
+}
+
+func readPassages(path string) ([]storedPassage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var docs []storedPassage
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var d storedPassage
+		if err := json.Unmarshal(line, &d); err != nil || d.Text == "" {
+			return nil, fmt.Errorf("%s line %d: want a JSON passage with text", path, n)
+		}
+		docs = append(docs, d)
+	}
+	return docs, sc.Err()
+}
+
+func (rt *retriever) applies(client, model string) bool {
+	return (len(rt.cfg.Clients) == 0 || slices.Contains(rt.cfg.Clients, client)) &&
+		(len(rt.cfg.Models) == 0 || matchModel(rt.cfg.Models, model))
+}
+
+// retrieve returns the best passages for query, scored and filtered.
+func (rt *retriever) retrieve(r *http.Request, p *proxy, query, client, model string) ([]Passage, error) {
+	k := cmp.Or(rt.cfg.TopK, 4)
+	var found []Passage
+	var err error
+	if rt.cfg.Endpoint != "" {
+		found, err = rt.ask(r.Context(), RetrievalQuery{Query: query, TopK: k, Client: client, Model: model})
+	} else {
+		found, err = rt.search(r, p, query, k)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := found[:0]
+	for _, ps := range found {
+		if ps.Text != "" && ps.Score >= rt.cfg.MinScore {
+			out = append(out, ps)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	return out[:min(len(out), k)], nil
+}
+
+func (rt *retriever) ask(ctx context.Context, q RetrievalQuery) ([]Passage, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rt.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range rt.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("retrieval endpoint answered %s", resp.Status)
+	}
+	var out struct {
+		Passages []Passage `json:"passages"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, int64(maxObservedBody))).Decode(&out); err != nil {
+		return nil, fmt.Errorf("retrieval endpoint: %w", err)
+	}
+	return out.Passages, nil
+}
+
+// search embeds the query, and any documents not yet embedded, and ranks
+// the documents by cosine similarity.
+func (rt *retriever) search(r *http.Request, p *proxy, query string, k int) ([]Passage, error) {
+	q, err := rt.embed(r, p, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var missing []int
+	var inputs []string
+	for i, d := range rt.docs {
+		if len(d.Embedding) == 0 {
+			missing = append(missing, i)
+			inputs = append(inputs, d.Text)
+		}
+	}
+	if len(missing) > 0 {
+		vecs, err := rt.embed(r, p, inputs)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range missing {
+			rt.docs[i].Embedding = vecs[j]
+		}
+	}
+	scored := make([]Passage, len(rt.docs))
+	for i, d := range rt.docs {
+		scored[i] = Passage{Text: d.Text, Source: d.Source, Score: cosine(q[0], d.Embedding)}
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+	return scored[:min(len(scored), k)], nil
+}
+
+// embed sends inputs to the embeddings endpoint through the proxy with the
+// caller's credentials.
+func (rt *retriever) embed(r *http.Request, p *proxy, inputs []string) ([][]float64, error) {
+	doc := map[string]any{"input": inputs}
+	res := fanoutOne(p.mux, r, "/v1/embeddings", doc, 0, rt.cfg.EmbeddingModel, nil)
+	if res.Error != "" || res.Status >= 300 {
+		return nil, fmt.Errorf("embedding with %s: status %d %s", rt.cfg.EmbeddingModel, res.Status, res.Error)
+	}
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(res.Response, &out); err != nil {
+		return nil, fmt.Errorf("embedding with %s: %w", rt.cfg.EmbeddingModel, err)
+	}
+	vecs := make([][]float64, len(inputs))
+	for _, d := range out.Data {
+		if d.Index >= 0 && d.Index < len(vecs) {
+			vecs[d.Index] = d.Embedding
+		}
+	}
+	for i, v := range vecs {
+		if len(v) == 0 {
+			return nil, fmt.Errorf("embedding with %s: no vector for input %d", rt.cfg.EmbeddingModel, i)
+		}
+	}
+	return vecs, nil
+}
+
+func cosine(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot, na, nb = dot+a[i]*b[i], na+a[i]*a[i], nb+b[i]*b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// lastUserText is the text of the final user message.
+func lastUserText(msgs []any) string {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if cm := asChatMessage(msgs[i]); cm.Role == "user" {
+			return contentText(cm.Content)
+		}
+	}
+	return ""
+}
+
+// retrievalStage adds passages once the model is final and before context
+// limits are checked, so the passages count toward them.
+func retrievalStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if len(p.retrieval) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			msgs, ok := ex.doc["messages"].([]any)
+			query := lastUserText(msgs)
+			if !ok || query == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			n := 0
+			for i := len(p.retrieval) - 1; i >= 0; i-- {
+				rt := p.retrieval[i]
+				if !rt.applies(ex.client, ex.model) {
+					continue
+				}
+				found, err := rt.retrieve(r, p, query, ex.client, ex.model)
+				if err != nil {
+					retrievals.Add(1, "error")
+					log.Printf("Error retrieving passages: %v", err)
+					continue
+				}
+				if len(found) == 0 {
+					retrievals.Add(1, "empty")
+					continue
+				}
+				text, err := renderPassages(rt.cfg, query, found)
+				if err != nil {
+					retrievals.Add(1, "error")
+					log.Printf("Error rendering retrieved passages: %v", err)
+					continue
+				}
+				retrievals.Add(1, "found")
+				injectSystemPrompts(ex.doc, strings.HasSuffix(r.URL.Path, "/messages"), ex.client, ex.model,
+					[]SystemPrompt{{Text: text}})
+				ex.dirty = true
+				n += len(found)
+			}
+			if n > 0 {
+				w.Header().Set("X-Ringmaster-Retrieved", strconv.Itoa(n))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func renderPassages(c *RetrievalConfig, query string, found []Passage) (string, error) {
+	list := make([]any, len(found))
+	var context strings.Builder
+	for i, ps := range found {
+		list[i] = map[string]any{"text": ps.Text, "source": ps.Source, "score": ps.Score}
+		if i > 0 {
+			context.WriteString("\n\n")
+		}
+		if ps.Source != "" {
+			fmt.Fprintf(&context, "[%s] ", ps.Source)
+		}
+		context.WriteString(ps.Text)
+	}
+	t := &c.Template
+	if t.empty() {
+		t = &defaultRetrievalTemplate
+	}
+	return t.render(map[string]any{"query": query, "passages": list, "context": context.String()})
+}
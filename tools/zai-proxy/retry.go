@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var upstreamRetries = metrics.counter("zai_proxy_upstream_retries_total",
+	"Requests sent again after never reaching an upstream, by the upstream that failed.", "upstream")
+
+// unsent reports whether err means the request never reached the upstream,
+// so sending it again can't repeat anything the upstream did.
+func unsent(err error) bool {
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		return true
+	}
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// alternative draws a pool member other than those tried, by weight
+// scaled by health, passing over those with open circuits while others
+// are left. "" when none is left.
+func (p *upstreamPool) alternative(tried []string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	closed := func(u *UpstreamConfig) bool {
+		return !slices.Contains(tried, u.URL) && !p.circuits.isOpen(u.URL, now)
+	}
+	untried := func(u *UpstreamConfig) bool { return !slices.Contains(tried, u.URL) }
+	for _, ok := range []func(*UpstreamConfig) bool{closed, untried} {
+		total, last := 0.0, -1
+		for i := range p.ups {
+			if ok(&p.ups[i]) {
+				total += p.weightOf(&p.ups[i])
+				last = i
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		n := rand.Float64() * total
+		for i := range p.ups {
+			if !ok(&p.ups[i]) {
+				continue
+			}
+			if n -= p.weightOf(&p.ups[i]); n < 0 {
+				return p.ups[i].URL
+			}
+		}
+		// Rounding left n at zero.
+		return p.ups[last].URL
+	}
+	return ""
+}
+
+// isMember reports whether target is a pool member's URL.
+func (p *upstreamPool) isMember(target string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.ups {
+		if p.ups[i].URL == target {
+			return true
+		}
+	}
+	return false
+}
+
+// targetBase returns ex's target without the request's path and query.
+func targetBase(ex *exchange) string {
+	base, _, _ := strings.Cut(ex.target, "?")
+	return strings.TrimSuffix(base, ex.path)
+}
+
+// memberOf returns the pool member ex is sent to, or "".
+func (p *proxy) memberOf(ex *exchange) string {
+	if base := targetBase(ex); p.pool.isMember(base) {
+		return base
+	}
+	return ""
+}
+
+// providerOf returns the provider that served ex: that of the pool member
+// or route target its target falls under, else the one its host is known
+// to be, else "zai" for the global upstream and the host for others.
+// Requests never sent are the global upstream's.
+func (p *proxy) providerOf(ex *exchange) string {
+	if ex.target == "" {
+		return "zai"
+	}
+	if u, ok := p.pool.memberFor(ex.target, func(*UpstreamConfig) bool { return true }); ok {
+		return u.providerName()
+	}
+	if tp := routeTargetOf(ex); tp != nil && tp.Provider != "" {
+		return tp.Provider
+	}
+	u, err := url.Parse(ex.target)
+	if err != nil {
+		return "zai"
+	}
+	if name := hostProvider(u.Hostname()); name != "" {
+		return name
+	}
+	if under(ex.target, strings.TrimSuffix(p.cfg.Target, "/")) {
+		return "zai"
+	}
+	return u.Hostname()
+}
+
+// routeTargetOf returns the route target ex was sent to, the first of its
+// route's that its target falls under, or nil.
+func routeTargetOf(ex *exchange) *TargetProvider {
+	if ex.route == nil {
+		return nil
+	}
+	for i := range ex.route.Targets {
+		if t := &ex.route.Targets[i]; t.Target != "" && under(ex.target, strings.TrimSuffix(t.Target, "/")) {
+			return &t.TargetProvider
+		}
+	}
+	if rc := ex.route; rc.Target != "" && under(ex.target, strings.TrimSuffix(rc.Target, "/")) {
+		return &rc.TargetProvider
+	}
+	return nil
+}
+
+// priceTableOf returns the table pricing model as sent by ex: its pool
+// member's or route target's where they price it, else the global one.
+func (p *proxy) priceTableOf(ex *exchange, model string) PriceTable {
+	if member := p.memberOf(ex); member != "" {
+		return p.pool.priceTable(member, model, p.cfg.Pricing)
+	}
+	if tp := routeTargetOf(ex); tp != nil {
+		if _, ok := tp.Pricing.Lookup(model); ok {
+			return tp.Pricing
+		}
+	}
+	return p.cfg.Pricing
+}
+
+// retryRequest prepares req to be sent again after its attempt'th try
+// failed: to another pool member when it went to one, else to the same
+// target, once the backoff has passed. It reports false when req's body
+// can't be sent again or the request was given up on meanwhile.
+func (p *proxy) retryRequest(req *http.Request, ex *exchange, tried *[]string, attempt int) (*http.Request, bool) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, false
+	}
+	base := targetBase(ex)
+	upstreamRetries.Add(1, upstreamOf(base))
+	target := ex.target
+	if p.pool.isMember(base) {
+		*tried = append(*tried, base)
+		if next := p.pool.alternative(*tried); next != "" {
+			target = next + strings.TrimPrefix(ex.target, base)
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, false
+	}
+
+	t := time.NewTimer(100 * time.Millisecond << attempt)
+	defer t.Stop()
+	select {
+	case <-req.Context().Done():
+		return nil, false
+	case <-t.C:
+	}
+
+	out := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if out.Body, err = req.GetBody(); err != nil {
+			return nil, false
+		}
+	}
+	if target != ex.target {
+		debugf("Retrying %s %s for %s at %s instead of %s", req.Method, ex.path, ex.client, upstreamOf(target), upstreamOf(base))
+		ex.target = target
+		out.URL, out.Host = u, u.Host
+		out.Header.Set("Host", u.Host)
+		if err := p.authorize(out, target, ex.model); err != nil {
+			log.Printf("Error authenticating to %s: %v", upstreamOf(target), err)
+			return nil, false
+		}
+	}
+	return out, true
+}
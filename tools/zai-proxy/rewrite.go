@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite edits the path a route forwards, so clients can use clean
+// paths whatever shape the upstream's URLs take. StripPrefix removes a
+// leading prefix the path has; Pattern, a regular expression, rewrites a
+// path it matches to Replace, where $1 and ${name} expand its captures;
+// AddPrefix is put in front, as for a provider's /api/paas/v4. A rule may
+// do all three, in that order, and a route's rules apply one after another.
+type PathRewrite struct {
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replace     string `json:"replace,omitempty"`
+	AddPrefix   string `json:"add_prefix,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (pr *PathRewrite) compile() error {
+	if pr.StripPrefix == "" && pr.Pattern == "" && pr.AddPrefix == "" {
+		return fmt.Errorf("rewrite needs strip_prefix, pattern or add_prefix")
+	}
+	if pr.Replace != "" && pr.Pattern == "" {
+		return fmt.Errorf("rewrite replace needs a pattern")
+	}
+	if pr.Pattern != "" {
+		re, err := regexp.Compile(pr.Pattern)
+		if err != nil {
+			return fmt.Errorf("rewrite: %w", err)
+		}
+		pr.re = re
+	}
+	return nil
+}
+
+// rewritePath applies rules to path, which stays rooted.
+func rewritePath(rules []PathRewrite, path string) string {
+	for i := range rules {
+		pr := &rules[i]
+		if pr.StripPrefix != "" {
+			path = strings.TrimPrefix(path, pr.StripPrefix)
+		}
+		if pr.re != nil {
+			path = pr.re.ReplaceAllString(path, pr.Replace)
+		}
+		path = pr.AddPrefix + path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
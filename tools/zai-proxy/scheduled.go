@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ScheduledPrompt runs a prompt, or the named Pipeline, on Schedule
+// (hourly, daily, weekly or a cron expression) and delivers the result to
+// Webhook, File (appended as JSON lines) or both. Prompt and System are
+// templates as in pipelines; Input and Vars feed them, and vars.time is
+// the scheduled time. Requests go to Path (default /v1/chat/completions)
+// with Key as their bearer token, like eval suites.
+type ScheduledPrompt struct {
+	Name      string         `json:"name"`
+	Schedule  string         `json:"schedule"`
+	Key       string         `json:"key,omitempty"`
+	Path      string         `json:"path,omitempty"`
+	Pipeline  string         `json:"pipeline,omitempty"`
+	Model     string         `json:"model,omitempty"`
+	System    promptTemplate `json:"system,omitempty"`
+	Prompt    promptTemplate `json:"prompt,omitempty"`
+	MaxTokens int            `json:"max_tokens,omitempty"`
+	Input     string         `json:"input,omitempty"`
+	Vars      map[string]any `json:"vars,omitempty"`
+	Webhook   string         `json:"webhook,omitempty"`
+	File      string         `json:"file,omitempty"`
+}
+
+func (s *ScheduledPrompt) validate(pipelines map[string]PipelineConfig) error {
+	if s.Name == "" {
+		return fmt.Errorf("scheduled prompts: every prompt needs a name")
+	}
+	if _, err := parseSchedule(s.Schedule); err != nil {
+		return fmt.Errorf("scheduled prompt %s: %w", s.Name, err)
+	}
+	switch {
+	case s.Pipeline != "" && !s.Prompt.empty():
+		return fmt.Errorf("scheduled prompt %s: set prompt or pipeline, not both", s.Name)
+	case s.Pipeline != "":
+		if _, ok := pipelines[s.Pipeline]; !ok {
+			return fmt.Errorf("scheduled prompt %s: unknown pipeline %q", s.Name, s.Pipeline)
+		}
+	case s.Prompt.empty() || s.Model == "":
+		return fmt.Errorf("scheduled prompt %s: needs a model and prompt, or a pipeline", s.Name)
+	}
+	if s.Webhook == "" && s.File == "" {
+		return fmt.Errorf("scheduled prompt %s: needs a webhook or file to deliver to", s.Name)
+	}
+	return nil
+}
+
+// pipeline returns what the prompt runs; a lone prompt is a one-step
+// pipeline.
+func (s *ScheduledPrompt) pipeline(pipelines map[string]PipelineConfig) PipelineConfig {
+	if s.Pipeline != "" {
+		return pipelines[s.Pipeline]
+	}
+	return PipelineConfig{Path: s.Path, Model: s.Model, Steps: []PipelineStep{
+		{Name: "prompt", System: s.System, Prompt: s.Prompt, MaxTokens: s.MaxTokens},
+	}}
+}
+
+// PromptRun is a scheduled prompt's result as delivered.
+type PromptRun struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	PipelineResult
+}
+
+var promptRuns = metrics.counter("zai_proxy_scheduled_prompts_total",
+	"Scheduled prompt runs, by prompt and outcome.", "name", "outcome")
+
+// scheduledPrompts runs the scheduled prompts through the proxy's own
+// handlers and keeps each one's latest result.
+type scheduledPrompts struct {
+	prompts   []ScheduledPrompt
+	pipelines map[string]PipelineConfig
+	mux       *http.ServeMux
+	client    *http.Client
+
+	mu     sync.Mutex
+	latest map[string]PromptRun
+	file   sync.Mutex // serializes appends
+}
+
+func newScheduledPrompts(cfg *Config, mux *http.ServeMux) *scheduledPrompts {
+	return &scheduledPrompts{prompts: cfg.ScheduledPrompts, pipelines: cfg.Pipelines, mux: mux,
+		client: &http.Client{Timeout: 30 * time.Second}, latest: map[string]PromptRun{}}
+}
+
+// schedule adds the prompts to sched.
+func (sp *scheduledPrompts) schedule(sched *Scheduler) {
+	for i := range sp.prompts {
+		s := &sp.prompts[i]
+		every, _ := parseSchedule(s.Schedule)
+		sched.Add(Job{Name: "prompt:" + s.Name, Schedule: every, Run: func(ctx context.Context, at time.Time) error {
+			sp.run(ctx, s, at)
+			return nil
+		}})
+	}
+}
+
+func (sp *scheduledPrompts) get(name string) *ScheduledPrompt {
+	for i := range sp.prompts {
+		if sp.prompts[i].Name == name {
+			return &sp.prompts[i]
+		}
+	}
+	return nil
+}
+
+// run executes s for the time at and delivers the result.
+func (sp *scheduledPrompts) run(ctx context.Context, s *ScheduledPrompt, at time.Time) PromptRun {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	r.RemoteAddr = "127.0.0.1:0"
+	if s.Key != "" {
+		r.Header.Set("Authorization", "Bearer "+s.Key)
+	}
+	vars := map[string]any{}
+	for k, v := range s.Vars {
+		vars[k] = v
+	}
+	vars["time"] = at.UTC().Format(time.RFC3339)
+	c := s.pipeline(sp.pipelines)
+	c.Path = cmp.Or(s.Path, c.Path)
+	run := PromptRun{Name: s.Name, Time: at.UTC(),
+		PipelineResult: runPipeline(sp.mux, r, cmp.Or(s.Pipeline, s.Name), &c, PipelineRun{Input: s.Input, Vars: vars})}
+	outcome := "succeeded"
+	if run.Error != "" {
+		outcome = "failed"
+		log.Printf("Error running scheduled prompt %s: %s", s.Name, run.Error)
+	}
+	promptRuns.Add(1, s.Name, outcome)
+	sp.mu.Lock()
+	sp.latest[s.Name] = run
+	sp.mu.Unlock()
+
+	if s.File != "" {
+		if err := sp.appendFile(s.File, run); err != nil {
+			log.Printf("Error writing scheduled prompt %s to %s: %v", s.Name, s.File, err)
+		}
+	}
+	if s.Webhook != "" {
+		if err := postJSON(ctx, sp.client, s.Webhook, run); err != nil {
+			log.Printf("Error delivering scheduled prompt %s to its webhook: %v", s.Name, err)
+		}
+	}
+	return run
+}
+
+func (sp *scheduledPrompts) appendFile(path string, run PromptRun) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	sp.file.Lock()
+	defer sp.file.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ScheduledPromptStatus describes a scheduled prompt for the admin API.
+type ScheduledPromptStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Pipeline string     `json:"pipeline,omitempty"`
+	Next     time.Time  `json:"next"`
+	Latest   *PromptRun `json:"latest,omitempty"`
+}
+
+// listScheduledPrompts shows each prompt with its next and latest runs.
+func (a *adminAPI) listScheduledPrompts(w http.ResponseWriter, r *http.Request) {
+	sp := a.proxy.prompts
+	out := []ScheduledPromptStatus{}
+	sp.mu.Lock()
+	for _, s := range sp.prompts {
+		every, _ := parseSchedule(s.Schedule)
+		st := ScheduledPromptStatus{Name: s.Name, Schedule: s.Schedule, Pipeline: s.Pipeline, Next: every.Next(time.Now())}
+		if run, ok := sp.latest[s.Name]; ok {
+			st.Latest = &run
+		}
+		out = append(out, st)
+	}
+	sp.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"prompts": out})
+}
+
+// runScheduledPrompt runs a prompt now, delivering it as a scheduled run.
+func (a *adminAPI) runScheduledPrompt(w http.ResponseWriter, r *http.Request) {
+	s := a.proxy.prompts.get(r.PathValue("name"))
+	if s == nil {
+		writeError(w, http.StatusNotFound, "not_found", "no scheduled prompt named "+r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.prompts.run(r.Context(), s, time.Now()))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the next run time after a given instant.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// parseSchedule accepts "hourly", "daily" (00:00 UTC), "weekly" (Monday
+// 00:00 UTC) and five-field cron expressions evaluated in UTC.
+func parseSchedule(s string) (Schedule, error) {
+	switch s {
+	case "hourly":
+		return fixedSchedule(time.Hour), nil
+	case "daily":
+		return fixedSchedule(24 * time.Hour), nil
+	case "weekly":
+		return weeklySchedule{}, nil
+	}
+	if strings.ContainsAny(strings.TrimSpace(s), " \t") {
+		return parseCron(s)
+	}
+	return nil, fmt.Errorf("unknown schedule %q", s)
+}
+
+// fixedSchedule fires on multiples of its period since the Unix epoch, so
+// "daily" lands on UTC midnight.
+type fixedSchedule time.Duration
+
+func (f fixedSchedule) Next(after time.Time) time.Time {
+	return after.UTC().Truncate(time.Duration(f)).Add(time.Duration(f))
+}
+
+type weeklySchedule struct{}
+
+func (weeklySchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(24 * time.Hour)
+	days := (8 - int(t.Weekday())) % 7
+	if days == 0 {
+		days = 7
+	}
+	return t.AddDate(0, 0, days)
+}
+
+// cronSchedule is "minute hour day-of-month month day-of-week", each field
+// a "*", number, range "a-b" or comma list of them, optionally stepped
+// with "/n". As in cron, when both day fields are restricted a day
+// matching either fires.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit i set when i matches
+	anyDom, anyDow                bool
+}
+
+func parseCron(s string) (Schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule %q: want 5 fields, got %d", s, len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron schedule %q: %w", s, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 // 7 is Sunday too
+	}
+	c := &cronSchedule{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	if _, ok := c.next(time.Now()); !ok {
+		return nil, fmt.Errorf("cron schedule %q never fires", s)
+	}
+	return c, nil
+}
+
+func parseCronField(f string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step, stepped := strings.Cut(part, "/")
+		n := 1
+		if stepped {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range in %q", part)
+				}
+			} else if stepped {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += n {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t, _ := c.next(after)
+	return t
+}
+
+// next steps forward through the calendar, skipping whole months, days
+// and hours that can't match. A schedule that never fires (say February
+// 30th) gives up after five years, which covers every leap day.
+func (c *cronSchedule) next(after time.Time) (time.Time, bool) {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return t, false
+}
+
+// Job is a named unit of background work. It receives the scheduled time so
+// reports can cover the period that just ended.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Run      func(ctx context.Context, at time.Time) error
+}
+
+// Scheduler runs jobs on their schedules until its context is cancelled.
+// With Only set, jobs whose time comes while it reports false are skipped.
+type Scheduler struct {
+	jobs []Job
+	Only func() bool
+}
+
+func (s *Scheduler) Add(j Job) {
+	s.jobs = append(s.jobs, j)
+}
+
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, j Job) {
+	for {
+		next := j.Schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if s.Only != nil && !s.Only() {
+			debugf("Skipping job %s: another replica leads", j.Name)
+			continue
+		}
+		if err := j.Run(ctx, next); err != nil {
+			log.Printf("Error running job %s: %v", j.Name, err)
+		}
+	}
+}
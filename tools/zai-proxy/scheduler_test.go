@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestScheduleNext checks each kind of schedule's next run, in UTC
+// whatever the zone it's asked in.
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	east := time.FixedZone("UTC+9", 9*3600)
+	for _, tc := range []struct {
+		spec        string
+		after, want time.Time
+	}{
+		{"hourly", at("2026-03-01T12:30:00Z"), at("2026-03-01T13:00:00Z")},
+		{"hourly", at("2026-03-01T13:00:00Z"), at("2026-03-01T14:00:00Z")},
+		{"daily", at("2026-03-01T23:59:59Z"), at("2026-03-02T00:00:00Z")},
+		{"daily", at("2026-03-02T08:00:00+09:00").In(east), at("2026-03-02T00:00:00Z")},
+		{"weekly", at("2026-03-01T12:00:00Z"), at("2026-03-02T00:00:00Z")}, // a Sunday
+		{"weekly", at("2026-03-02T00:00:00Z"), at("2026-03-09T00:00:00Z")}, // a Monday
+		{"weekly", at("2026-03-04T12:00:00Z"), at("2026-03-09T00:00:00Z")},
+		{"*/15 * * * *", at("2026-03-01T12:07:30Z"), at("2026-03-01T12:15:00Z")},
+		{"*/15 * * * *", at("2026-03-01T12:45:00Z"), at("2026-03-01T13:00:00Z")},
+		{"30 9 * * 1-5", at("2026-03-06T10:00:00Z"), at("2026-03-09T09:30:00Z")}, // Friday to Monday
+		{"0 0 * * 7", at("2026-03-02T00:00:00Z"), at("2026-03-08T00:00:00Z")},    // 7 is Sunday
+		{"0 0 * * 0", at("2026-03-02T00:00:00Z"), at("2026-03-08T00:00:00Z")},
+		{"0 12 1,15 * *", at("2026-03-01T12:00:00Z"), at("2026-03-15T12:00:00Z")},
+		{"0 0 31 * *", at("2026-04-01T00:00:00Z"), at("2026-05-31T00:00:00Z")},
+		{"0 0 29 2 *", at("2026-03-01T00:00:00Z"), at("2028-02-29T00:00:00Z")},
+		{"0 0 1 1 *", at("2026-12-31T23:59:00Z"), at("2027-01-01T00:00:00Z")},
+		{"0 0 13 * 5", at("2026-03-01T00:00:00Z"), at("2026-03-06T00:00:00Z")}, // the 13th or a Friday
+		{"0 0 13 * *", at("2026-03-01T00:00:00Z"), at("2026-03-13T00:00:00Z")},
+		{"10-20/5 3 * * *", at("2026-03-01T03:16:00Z"), at("2026-03-01T03:20:00Z")},
+		{"5/20 * * * *", at("2026-03-01T03:26:00Z"), at("2026-03-01T03:45:00Z")},
+	} {
+		s, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(tc.after); !got.Equal(tc.want) || got.Location() != time.UTC {
+			t.Errorf("%q after %v = %v, want %v", tc.spec, tc.after, got, tc.want)
+		}
+	}
+}
+
+// TestParseScheduleErrors refuses schedules that are malformed or never
+// fire.
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"", "monthly", "* * * *", "* * * * * *",
+		"60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "*/x * * * *", "a * * * *", "1-b * * * *", "-1 * * * *",
+		"0 0 30 2 *", "0 0 31 4,6,9,11 *",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) accepted", spec)
+		}
+	}
+}
+
+// stepSchedule fires a fixed while after it's asked.
+type stepSchedule time.Duration
+
+func (s stepSchedule) Next(after time.Time) time.Time { return after.Add(time.Duration(s)) }
+
+// TestSchedulerRuns runs a job on its schedule, handing it the time it
+// was due, skipping it while Only says no, carrying on past its errors
+// and stopping when the context ends.
+func TestSchedulerRuns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var asked, runs atomic.Int32
+	ran := make(chan time.Time, 16)
+	s := &Scheduler{Only: func() bool { return asked.Add(1) > 2 }}
+	s.Add(Job{Name: "test", Schedule: stepSchedule(5 * time.Millisecond), Run: func(ctx context.Context, at time.Time) error {
+		ran <- at
+		if runs.Add(1) == 1 {
+			return errors.New("first run fails")
+		}
+		return nil
+	}})
+	s.Start(ctx)
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-ran:
+			if at.After(time.Now()) {
+				t.Errorf("run %d at %v, before it was due", i, at)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d never came", i)
+		}
+	}
+	if n := asked.Load(); n < 4 {
+		t.Errorf("Only asked %d times for two runs, want the two skipped as well", n)
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	before := runs.Load()
+	time.Sleep(50 * time.Millisecond)
+	if after := runs.Load(); after != before {
+		t.Errorf("%d runs after the context ended", after-before)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationConfig checks request bodies against the proxy's own schemas
+// of chat completions, messages, embeddings and batches before they go
+// upstream, answering 400 with the offending field named in the message
+// and in param, rather than relaying whatever the upstream makes of them.
+// Bodies that aren't JSON objects are refused too. Strict also refuses
+// fields the schemas don't know at the top level; nested objects may
+// always have more.
+type ValidationConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	Strict  bool `json:"strict,omitempty"`
+}
+
+var invalidRequests = metrics.counter("zai_proxy_invalid_requests_total",
+	"Requests refused for failing schema validation, by endpoint.", "endpoint")
+
+// schema is a subset of JSON Schema, enough for the API's shapes.
+type schema struct {
+	types    string // "|"-separated JSON types; empty is any
+	props    map[string]*schema
+	required []string
+	items    *schema
+	minItems int
+	maxItems int // zero is none
+	enum     []any
+	min, max *float64
+	closed   bool    // no properties but props
+	extra    *schema // what properties but props must be
+	anyOf    []*schema
+}
+
+// schemaError is a value not matching its schema; Param is the path to it,
+// as in messages[0].role.
+type schemaError struct {
+	Param string
+	Msg   string
+}
+
+func (e *schemaError) Error() string {
+	if e.Param == "" {
+		return e.Msg
+	}
+	return e.Param + ": " + e.Msg
+}
+
+func bound(v float64) *float64 { return &v }
+
+func object(required []string, props map[string]*schema) *schema {
+	return &schema{types: "object", props: props, required: required}
+}
+
+func arrayOf(items *schema, minItems int) *schema {
+	return &schema{types: "array", items: items, minItems: minItems}
+}
+
+func number(min, max *float64) *schema { return &schema{types: "number", min: min, max: max} }
+
+func integer(min *float64) *schema { return &schema{types: "integer", min: min} }
+
+func oneOf(values ...string) *schema {
+	s := &schema{types: "string"}
+	for _, v := range values {
+		s.enum = append(s.enum, v)
+	}
+	return s
+}
+
+var (
+	aString    = &schema{types: "string"}
+	aBoolean   = &schema{types: "boolean"}
+	anObject   = &schema{types: "object"}
+	stringList = &schema{types: "string|array", items: aString}
+
+	contentPart = object([]string{"type"}, map[string]*schema{"type": aString})
+	toolSchema  = object([]string{"type"}, map[string]*schema{
+		"type":     aString,
+		"function": object([]string{"name"}, map[string]*schema{"name": aString, "description": aString, "parameters": anObject}),
+	})
+
+	chatSchema = object([]string{"model", "messages"}, map[string]*schema{
+		"model": aString,
+		"messages": arrayOf(object([]string{"role"}, map[string]*schema{
+			"role":         oneOf("system", "developer", "user", "assistant", "tool", "function"),
+			"content":      {types: "string|array|null", items: contentPart},
+			"name":         aString,
+			"tool_call_id": aString,
+			"tool_calls":   arrayOf(anObject, 0),
+		}), 1),
+		"temperature":           number(bound(0), bound(2)),
+		"top_p":                 number(bound(0), bound(1)),
+		"n":                     integer(bound(1)),
+		"max_tokens":            integer(bound(1)),
+		"max_completion_tokens": integer(bound(1)),
+		"stream":                aBoolean,
+		"stream_options":        anObject,
+		"stop":                  stringList,
+		"presence_penalty":      number(bound(-2), bound(2)),
+		"frequency_penalty":     number(bound(-2), bound(2)),
+		"logit_bias":            anObject,
+		"logprobs":              aBoolean,
+		"top_logprobs":          integer(bound(0)),
+		"response_format":       object([]string{"type"}, map[string]*schema{"type": aString}),
+		"seed":                  {types: "integer"},
+		"tools":                 arrayOf(toolSchema, 0),
+		"tool_choice":           {types: "string|object"},
+		"parallel_tool_calls":   aBoolean,
+		"reasoning_effort":      aString,
+		"metadata":              anObject,
+		"store":                 aBoolean,
+		"user":                  aString,
+		// Z.ai's own
+		"thinking":   anObject,
+		"do_sample":  aBoolean,
+		"request_id": aString,
+		"user_id":    aString,
+	})
+
+	messagesSchema = object([]string{"model", "max_tokens", "messages"}, map[string]*schema{
+		"model":      aString,
+		"max_tokens": integer(bound(1)),
+		"messages": arrayOf(object([]string{"role", "content"}, map[string]*schema{
+			"role":    oneOf("user", "assistant"),
+			"content": {types: "string|array", items: contentPart},
+		}), 1),
+		"system":         {types: "string|array", items: contentPart},
+		"temperature":    number(bound(0), bound(1)),
+		"top_p":          number(bound(0), bound(1)),
+		"top_k":          integer(bound(0)),
+		"stop_sequences": arrayOf(aString, 0),
+		"stream":         aBoolean,
+		"tools":          arrayOf(object([]string{"name"}, map[string]*schema{"name": aString}), 0),
+		"tool_choice":    object([]string{"type"}, map[string]*schema{"type": aString}),
+		"metadata":       anObject,
+		"thinking":       anObject,
+		"service_tier":   aString,
+	})
+
+	embeddingsSchema = object([]string{"model", "input"}, map[string]*schema{
+		"model":           aString,
+		"input":           {types: "string|array", items: &schema{types: "string|integer|array", items: &schema{types: "integer"}}, minItems: 1},
+		"encoding_format": oneOf("float", "base64"),
+		"dimensions":      integer(bound(1)),
+		"user":            aString,
+	})
+
+	batchSchema = object([]string{"requests"}, map[string]*schema{
+		"requests": arrayOf(object([]string{"custom_id", "body"}, map[string]*schema{
+			"custom_id": aString,
+			"method":    aString,
+			"url":       aString,
+			"body":      anObject,
+		}), 1),
+		"concurrency": integer(bound(0)),
+		"webhook":     aString,
+	})
+)
+
+// requestSchemas are the schemas by the API path they end, and the
+// endpoint label they're counted under.
+var requestSchemas = []struct {
+	suffix, endpoint string
+	schema           *schema
+}{
+	{"/chat/completions", "chat", chatSchema},
+	{"/messages", "messages", messagesSchema},
+	{"/embeddings", "embeddings", embeddingsSchema},
+}
+
+func schemaFor(path string) (*schema, string) {
+	for _, s := range requestSchemas {
+		if strings.HasSuffix(path, s.suffix) {
+			return s.schema, s.endpoint
+		}
+	}
+	return nil, ""
+}
+
+// check validates the body sent to path, decoded as doc or nil when it
+// isn't a JSON object. Paths without a schema always pass.
+func (c *ValidationConfig) check(path string, body []byte, doc map[string]any) error {
+	s, endpoint := schemaFor(path)
+	if !c.Enabled || s == nil {
+		return nil
+	}
+	err := c.checkDoc(s, body, doc)
+	if err != nil {
+		invalidRequests.Add(1, endpoint)
+	}
+	return err
+}
+
+func (c *ValidationConfig) checkDoc(s *schema, body []byte, doc map[string]any) error {
+	if doc == nil {
+		if _, err := decodeJSON(body); err != nil {
+			return &schemaError{Msg: "request body is not valid JSON: " + strings.TrimPrefix(err.Error(), "json: ")}
+		}
+		return &schemaError{Msg: "request body must be a JSON object"}
+	}
+	if c.Strict {
+		var unknown []string
+		for k := range doc {
+			if _, ok := s.props[k]; !ok {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return &schemaError{Param: unknown[0], Msg: "unknown field"}
+		}
+	}
+	return s.check("", doc)
+}
+
+// checkBatch validates a batch submitted as JSON, and the body of each of
+// its requests, lines included, against the schema of its url.
+func (c *ValidationConfig) checkBatch(r *http.Request, body []byte, req BatchRequest) error {
+	if !c.Enabled {
+		return nil
+	}
+	if ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); ct != "application/jsonl" && ct != "application/x-ndjson" {
+		v, _ := decodeJSON(body)
+		doc, _ := v.(map[string]any)
+		if err := c.checkDoc(batchSchema, body, doc); err != nil {
+			invalidRequests.Add(1, "batch")
+			return err
+		}
+	}
+	for i, l := range req.Requests {
+		s, _ := schemaFor(l.URL)
+		if l.URL == "" {
+			s = chatSchema
+		}
+		if s == nil {
+			continue
+		}
+		v, _ := decodeJSON(l.Body)
+		doc, _ := v.(map[string]any)
+		if err := c.checkDoc(s, l.Body, doc); err != nil {
+			invalidRequests.Add(1, "batch")
+			se := err.(*schemaError)
+			return &schemaError{Param: joinParam("requests["+strconv.Itoa(i)+"].body", se.Param), Msg: se.Msg}
+		}
+	}
+	return nil
+}
+
+// writeSchemaError answers a request failing validation.
+func writeSchemaError(w http.ResponseWriter, err error) {
+	se, _ := err.(*schemaError)
+	if se == nil {
+		se = &schemaError{Msg: err.Error()}
+	}
+	writeErrorDetail(w, http.StatusBadRequest, apiErrorDetail{Message: se.Error(), Type: "invalid_request", Param: se.Param})
+}
+
+func joinParam(path, key string) string {
+	if path == "" || key == "" {
+		return path + key
+	}
+	return path + "." + key
+}
+
+// jsonType names the JSON type of a value decoded by decodeJSON.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		// As in JSON Schema, 1.0 is an integer.
+		if !strings.ContainsAny(string(v), ".eE") {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return ""
+}
+
+// describeTypes reads "string|array" as "a string or an array".
+func describeTypes(types string) string {
+	names := map[string]string{"object": "an object", "array": "an array", "string": "a string", "number": "a number",
+		"integer": "an integer", "boolean": "a boolean", "null": "null"}
+	list := strings.Split(types, "|")
+	for i, t := range list {
+		list[i] = names[t]
+	}
+	if len(list) == 1 {
+		return list[0]
+	}
+	return strings.Join(list[:len(list)-1], ", ") + " or " + list[len(list)-1]
+}
+
+func (s *schema) allows(t string) bool {
+	if s.types == "" {
+		return true
+	}
+	for _, want := range strings.Split(s.types, "|") {
+		if want == t || want == "number" && t == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates v, found at path.
+func (s *schema) check(path string, v any) error {
+	t := jsonType(v)
+	if !s.allows(t) {
+		return &schemaError{Param: path, Msg: "must be " + describeTypes(s.types) + ", not " + describeTypes(t)}
+	}
+	switch t {
+	case "object":
+		m := v.(map[string]any)
+		for _, k := range s.required {
+			if _, ok := m[k]; !ok {
+				return &schemaError{Param: joinParam(path, k), Msg: "is required"}
+			}
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps := s.props[k]
+			if ps == nil && s.closed {
+				return &schemaError{Param: joinParam(path, k), Msg: "unknown field"}
+			}
+			if ps = cmp.Or(ps, s.extra); ps != nil {
+				if err := ps.check(joinParam(path, k), m[k]); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		a := v.([]any)
+		if len(a) < s.minItems {
+			if s.minItems == 1 {
+				return &schemaError{Param: path, Msg: "must not be empty"}
+			}
+			return &schemaError{Param: path, Msg: "must have at least " + strconv.Itoa(s.minItems) + " items"}
+		}
+		if s.maxItems > 0 && len(a) > s.maxItems {
+			return &schemaError{Param: path, Msg: "must have at most " + strconv.Itoa(s.maxItems) + " items"}
+		}
+		if s.items != nil {
+			for i, item := range a {
+				if err := s.items.check(path+"["+strconv.Itoa(i)+"]", item); err != nil {
+					return err
+				}
+			}
+		}
+	case "number", "integer":
+		f, _ := v.(json.Number).Float64()
+		if s.min != nil && f < *s.min {
+			return &schemaError{Param: path, Msg: "must be at least " + strconv.FormatFloat(*s.min, 'g', -1, 64)}
+		}
+		if s.max != nil && f > *s.max {
+			return &schemaError{Param: path, Msg: "must be at most " + strconv.FormatFloat(*s.max, 'g', -1, 64)}
+		}
+	}
+	if len(s.enum) > 0 && !slices.ContainsFunc(s.enum, func(e any) bool { return jsonEqual(e, v) }) {
+		list := make([]string, len(s.enum))
+		for i, e := range s.enum {
+			if str, ok := e.(string); ok {
+				list[i] = str
+			} else {
+				b, _ := json.Marshal(e)
+				list[i] = string(b)
+			}
+		}
+		return &schemaError{Param: path, Msg: "must be one of " + strings.Join(list, ", ")}
+	}
+	if len(s.anyOf) > 0 {
+		var first error
+		for _, alt := range s.anyOf {
+			err := alt.check(path, v)
+			if err == nil {
+				return nil
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	return nil
+}
+
+// compileSchema reads a JSON Schema as clients send it, as far as schema
+// goes: type, properties, required, additionalProperties, items, minItems,
+// maxItems, enum, const, minimum, maximum, anyOf, oneOf and $refs within
+// it. Other keywords are ignored, so never fail a value.
+func compileSchema(doc any) *schema {
+	c := &schemaCompiler{root: doc, refs: map[string]*schema{}}
+	return c.compile(doc)
+}
+
+type schemaCompiler struct {
+	root any
+	refs map[string]*schema
+}
+
+func (c *schemaCompiler) compile(v any) *schema {
+	s := &schema{}
+	m, _ := v.(map[string]any)
+	if m == nil {
+		return s
+	}
+	if ref, ok := m["$ref"].(string); ok {
+		if r := c.refs[ref]; r != nil {
+			return r
+		}
+		// Registered first, so a schema referring to itself ends.
+		c.refs[ref] = s
+		*s = *c.compile(c.resolve(ref))
+		return s
+	}
+	switch t := m["type"].(type) {
+	case string:
+		s.types = t
+	case []any:
+		var list []string
+		for _, e := range t {
+			if str, ok := e.(string); ok {
+				list = append(list, str)
+			}
+		}
+		s.types = strings.Join(list, "|")
+	}
+	if props, ok := m["properties"].(map[string]any); ok {
+		s.props = make(map[string]*schema, len(props))
+		for k, pv := range props {
+			s.props[k] = c.compile(pv)
+		}
+	}
+	required, _ := m["required"].([]any)
+	for _, r := range required {
+		if str, ok := r.(string); ok {
+			s.required = append(s.required, str)
+		}
+	}
+	switch ap := m["additionalProperties"].(type) {
+	case bool:
+		s.closed = !ap
+	case map[string]any:
+		s.extra = c.compile(ap)
+	}
+	if items, ok := m["items"].(map[string]any); ok {
+		s.items = c.compile(items)
+	}
+	if n, ok := m["minItems"].(json.Number); ok {
+		v, _ := n.Int64()
+		s.minItems = int(v)
+	}
+	if n, ok := m["maxItems"].(json.Number); ok {
+		v, _ := n.Int64()
+		s.maxItems = int(v)
+	}
+	s.enum, _ = m["enum"].([]any)
+	if v, ok := m["const"]; ok {
+		s.enum = []any{v}
+	}
+	if n, ok := m["minimum"].(json.Number); ok {
+		v, _ := n.Float64()
+		s.min = &v
+	}
+	if n, ok := m["maximum"].(json.Number); ok {
+		v, _ := n.Float64()
+		s.max = &v
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		alts, _ := m[key].([]any)
+		for _, a := range alts {
+			s.anyOf = append(s.anyOf, c.compile(a))
+		}
+	}
+	return s
+}
+
+// resolve follows a reference within the root document, as in
+// #/$defs/item; others resolve to nothing, so accept anything.
+func (c *schemaCompiler) resolve(ref string) any {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+	v := c.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		m, _ := v.(map[string]any)
+		v = m[strings.NewReplacer("~1", "/", "~0", "~").Replace(part)]
+	}
+	return v
+}
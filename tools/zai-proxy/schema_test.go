@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestValidateRequests checks request bodies against the built-in
+// schemas, naming the offending field by its path.
+func TestValidateRequests(t *testing.T) {
+	const msgs = `"messages":[{"role":"user","content":"hi"}]`
+	for _, tc := range []struct {
+		name   string
+		s      *schema
+		strict bool
+		body   string
+		want   string // the error, empty for none
+	}{
+		{"chat", chatSchema, false, `{"model":"glm-4.6",` + msgs + `}`, ""},
+		{"integral float", chatSchema, false, `{"model":"glm-4.6","max_tokens":1.0,"n":1e1,` + msgs + `}`, ""},
+		{"nulls and parts", chatSchema, false,
+			`{"model":"m","messages":[{"role":"assistant","content":null},{"role":"user","content":[{"type":"text"}]}]}`, ""},
+		{"missing", chatSchema, false, `{` + msgs + `}`, "model: is required"},
+		{"empty", chatSchema, false, `{"model":"m","messages":[]}`, "messages: must not be empty"},
+		{"enum", chatSchema, false, `{"model":"m","messages":[{"role":"robot"}]}`,
+			"messages[0].role: must be one of system, developer, user, assistant, tool, function"},
+		{"nested required", chatSchema, false, `{"model":"m","messages":[{"role":"user","content":[{"text":"hi"}]}]}`,
+			"messages[0].content[0].type: is required"},
+		{"deep", chatSchema, false, `{"model":"m",` + msgs + `,"tools":[{"type":"function","function":{"description":"x"}}]}`,
+			"tools[0].function.name: is required"},
+		{"type", chatSchema, false, `{"model":"m",` + msgs + `,"stream":"yes"}`, "stream: must be a boolean, not a string"},
+		{"types", chatSchema, false, `{"model":"m","messages":[{"role":"user","content":5}]}`,
+			"messages[0].content: must be a string, an array or null, not an integer"},
+		{"items", chatSchema, false, `{"model":"m",` + msgs + `,"stop":["a",1]}`, "stop[1]: must be a string, not an integer"},
+		{"fraction", chatSchema, false, `{"model":"m",` + msgs + `,"max_tokens":1.5}`, "max_tokens: must be an integer, not a number"},
+		{"maximum", chatSchema, false, `{"model":"m",` + msgs + `,"temperature":2.5}`, "temperature: must be at most 2"},
+		{"minimum", chatSchema, false, `{"model":"m",` + msgs + `,"max_tokens":0}`, "max_tokens: must be at least 1"},
+		{"negative bound", chatSchema, false, `{"model":"m",` + msgs + `,"presence_penalty":-2.5}`, "presence_penalty: must be at least -2"},
+		{"not strict", chatSchema, false, `{"model":"m",` + msgs + `,"vendor_flag":true}`, ""},
+		{"strict", chatSchema, true, `{"model":"m",` + msgs + `,"zz":1,"vendor_flag":true}`, "vendor_flag: unknown field"},
+		{"strict leaves nested alone", chatSchema, true, `{"model":"m","messages":[{"role":"user","content":"hi","cache":1}]}`, ""},
+		{"messages", messagesSchema, false, `{"model":"m","max_tokens":1024,` + msgs + `}`, ""},
+		{"messages max_tokens", messagesSchema, false, `{"model":"m",` + msgs + `}`, "max_tokens: is required"},
+		{"messages role", messagesSchema, false, `{"model":"m","max_tokens":1,"messages":[{"role":"system","content":"x"}]}`,
+			"messages[0].role: must be one of user, assistant"},
+		{"embeddings tokens", embeddingsSchema, false, `{"model":"m","input":[[1,2],[3]]}`, ""},
+		{"embeddings token", embeddingsSchema, false, `{"model":"m","input":[[1,2.5]]}`, "input[0][1]: must be an integer, not a number"},
+		{"embeddings empty", embeddingsSchema, false, `{"model":"m","input":[]}`, "input: must not be empty"},
+		{"not an object", chatSchema, false, `[1]`, "request body must be a JSON object"},
+		{"not JSON", chatSchema, false, `{"model":`, "request body is not valid JSON: "},
+	} {
+		v, _ := decodeJSON([]byte(tc.body))
+		doc, _ := v.(map[string]any)
+		err := (&ValidationConfig{Enabled: true, Strict: tc.strict}).checkDoc(tc.s, []byte(tc.body), doc)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: refused: %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.want)):
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// TestCompiledSchemas checks schemas clients send, references to
+// themselves included.
+func TestCompiledSchemas(t *testing.T) {
+	doc, err := decodeJSON([]byte(`{
+		"$ref": "#/$defs/node",
+		"$defs": {"node": {
+			"type": "object", "required": ["id"], "additionalProperties": false,
+			"properties": {
+				"id": {"type": "integer", "minimum": 1, "maximum": 99},
+				"kind": {"enum": ["leaf", "branch"]},
+				"version": {"const": 2},
+				"label": {"anyOf": [{"type": "string"}, {"type": "null"}]},
+				"children": {"type": "array", "items": {"$ref": "#/$defs/node"}, "maxItems": 2}
+			}
+		}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := compileSchema(doc)
+	for _, tc := range []struct{ value, want string }{
+		{`{"id":1}`, ""},
+		{`{"id":1,"kind":"leaf","version":2,"label":null,"children":[{"id":2,"children":[{"id":3.0}]}]}`, ""},
+		{`{"id":1,"children":[{"id":2,"children":[{"id":0}]}]}`, "children[0].children[0].id: must be at least 1"},
+		{`{"id":100}`, "id: must be at most 99"},
+		{`{"id":1,"children":[{}]}`, "children[0].id: is required"},
+		{`{"id":1,"children":[{"id":2},{"id":3},{"id":4}]}`, "children: must have at most 2 items"},
+		{`{"id":1,"colour":"red"}`, "colour: unknown field"},
+		{`{"id":1,"kind":"root"}`, "kind: must be one of leaf, branch"},
+		{`{"id":1,"version":3}`, "version: must be one of 2"},
+		{`{"id":1,"label":7}`, "label: must be a string, not an integer"},
+		{`[]`, "must be an object, not an array"},
+	} {
+		v, _ := decodeJSON([]byte(tc.value))
+		err := s.check("", v)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: refused: %v", tc.value, err)
+		case tc.want != "" && (err == nil || err.Error() != tc.want):
+			t.Errorf("%s: error %v, want %q", tc.value, err, tc.want)
+		}
+	}
+}
+
+// TestWriteSchemaError names the field in the error's param.
+func TestWriteSchemaError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeSchemaError(rec, &schemaError{Param: "messages[0].role", Msg: "is required"})
+	var body struct{ Error apiErrorDetail }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusBadRequest || body.Error.Param != "messages[0].role" || body.Error.Message != "messages[0].role: is required" {
+		t.Errorf("status %d, body %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// serviceOptions are what a service definition is made from.
+type serviceOptions struct {
+	name    string
+	exe     string
+	config  string // absolute, or "" for none
+	user    bool   // the user's own service rather than the system's
+	envFile string
+	home    string
+}
+
+// serviceDefinition is how one service manager runs the proxy: the file
+// defining it and the commands driving it.
+type serviceDefinition struct {
+	file    string
+	body    []byte
+	secret  bool // body holds the API key
+	install [][]string
+	remove  [][]string
+	start   [][]string
+	stop    [][]string
+}
+
+// serveArgs is the command line the service runs.
+func (o serviceOptions) serveArgs() []string {
+	args := []string{o.exe, "serve"}
+	if o.config != "" {
+		args = append(args, "-config", o.config)
+	}
+	return args
+}
+
+// serviceControl, for service managers the proxy must answer, starts
+// answering the one running it if one is: stop requests arrive on sig as
+// SIGTERM, and drains are expected to take grace. It returns what to call
+// once the proxy has stopped.
+var serviceControl = func(sig chan<- os.Signal, grace time.Duration) (stopped func()) {
+	return func() {}
+}
+
+// systemdService is a unit restarted on failure; it reads ZAI_API_KEY and
+// any other settings from the environment file. The stop timeout leaves
+// the proxy time to drain.
+func systemdService(o serviceOptions) serviceDefinition {
+	dir, target, ctl := "/etc/systemd/system", "multi-user.target", []string{"systemctl"}
+	if o.user {
+		dir, target, ctl = filepath.Join(o.home, ".config", "systemd", "user"), "default.target", []string{"systemctl", "--user"}
+	}
+	quoted := make([]string, 0, 4)
+	for _, a := range o.serveArgs() {
+		// % starts a unit specifier.
+		a = strings.ReplaceAll(a, "%", "%%")
+		if strings.ContainsAny(a, " \t\"\\") {
+			a = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a) + `"`
+		}
+		quoted = append(quoted, a)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Unit]\nDescription=Ringmaster Z.AI proxy\nAfter=network-online.target\nWants=network-online.target\n\n")
+	fmt.Fprintf(&b, "[Service]\nExecStart=%s\nEnvironmentFile=-%s\n", strings.Join(quoted, " "), o.envFile)
+	fmt.Fprintf(&b, "Restart=on-failure\nRestartSec=2\nTimeoutStopSec=60\n")
+	if !o.user {
+		fmt.Fprintf(&b, "NoNewPrivileges=true\n")
+	}
+	fmt.Fprintf(&b, "\n[Install]\nWantedBy=%s\n", target)
+	unit := o.name + ".service"
+	cmd := func(args ...string) []string { return append(append([]string{}, ctl...), args...) }
+	return serviceDefinition{
+		file:    filepath.Join(dir, unit),
+		body:    b.Bytes(),
+		install: [][]string{cmd("daemon-reload"), cmd("enable", unit)},
+		remove:  [][]string{cmd("disable", "--now", unit), cmd("daemon-reload")},
+		start:   [][]string{cmd("start", unit)},
+		stop:    [][]string{cmd("stop", unit)},
+	}
+}
+
+// launchdService is a job started at load and restarted unless it exits
+// cleanly, as it does once stopped and drained. launchd has no environment
+// files, so ZAI_API_KEY is written into the job, readable only by its
+// owner.
+func launchdService(o serviceOptions) serviceDefinition {
+	label := "com.ringmaster." + o.name
+	dir, logs := "/Library/LaunchDaemons", "/Library/Logs"
+	if o.user {
+		dir, logs = filepath.Join(o.home, "Library", "LaunchAgents"), filepath.Join(o.home, "Library", "Logs")
+	}
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", esc(label))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, a := range o.serveArgs() {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", esc(a))
+	}
+	b.WriteString("\t</array>\n")
+	secret := false
+	if key := os.Getenv("ZAI_API_KEY"); key != "" {
+		fmt.Fprintf(&b, "\t<key>EnvironmentVariables</key>\n\t<dict>\n\t\t<key>ZAI_API_KEY</key>\n\t\t<string>%s</string>\n\t</dict>\n", esc(key))
+		secret = true
+	}
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	b.WriteString("\t<key>ExitTimeOut</key>\n\t<integer>60</integer>\n")
+	logFile := esc(filepath.Join(logs, o.name+".log"))
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", logFile, logFile)
+	b.WriteString("</dict>\n</plist>\n")
+	file := filepath.Join(dir, label+".plist")
+	return serviceDefinition{
+		file:    file,
+		body:    b.Bytes(),
+		secret:  secret,
+		install: [][]string{{"launchctl", "load", "-w", file}},
+		remove:  [][]string{{"launchctl", "unload", "-w", file}},
+		start:   [][]string{{"launchctl", "start", label}},
+		stop:    [][]string{{"launchctl", "stop", label}},
+	}
+}
+
+// windowsService is a service the service control manager starts at boot
+// and restarts when it fails. The proxy answers the manager, so stopping
+// the service drains it. It runs as LocalSystem, in whose environment
+// ZAI_API_KEY must be set; Windows has no services of a user's own. A
+// service removed while running goes once it stops.
+func windowsService(o serviceOptions) serviceDefinition {
+	quoted := make([]string, 0, 4)
+	for _, a := range o.serveArgs() {
+		if strings.ContainsAny(a, " \t") {
+			a = `"` + a + `"`
+		}
+		quoted = append(quoted, a)
+	}
+	return serviceDefinition{
+		install: [][]string{
+			{"sc.exe", "create", o.name, "binPath=", strings.Join(quoted, " "), "start=", "auto", "DisplayName=", "Ringmaster Z.AI proxy"},
+			{"sc.exe", "failure", o.name, "reset=", "86400", "actions=", "restart/2000/restart/2000/restart/2000"},
+		},
+		remove: [][]string{{"sc.exe", "delete", o.name}},
+		start:  [][]string{{"sc.exe", "start", o.name}},
+		stop:   [][]string{{"sc.exe", "stop", o.name}},
+	}
+}
+
+// runService implements the service subcommand, which registers the proxy
+// with the system's service manager and drives it there.
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install | uninstall | start | stop [-name name] [-config file] [-user] [-print]", os.Args[0])
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("service "+sub, flag.ExitOnError)
+	name := fs.String("name", "zai-proxy", "service name")
+	configPath := fs.String("config", os.Getenv("ZAI_PROXY_CONFIG"), "config file the service runs with (install)")
+	user := fs.Bool("user", false, "the current user's service rather than the system's")
+	envFile := fs.String("env-file", "", "environment file for systemd, by default /etc/<name>/env or ~/.config/<name>/env")
+	dry := fs.Bool("print", false, "print the definition and commands instead of running them")
+	fs.Parse(args[1:])
+
+	o := serviceOptions{name: *name, user: *user, envFile: *envFile}
+	var err error
+	if o.home, err = os.UserHomeDir(); err != nil && o.user {
+		return err
+	}
+	if o.exe, err = os.Executable(); err != nil {
+		return err
+	}
+	if *configPath != "" {
+		if o.config, err = filepath.Abs(*configPath); err != nil {
+			return err
+		}
+	}
+	if o.envFile == "" {
+		o.envFile = filepath.Join("/etc", o.name, "env")
+		if o.user {
+			o.envFile = filepath.Join(o.home, ".config", o.name, "env")
+		}
+	}
+	var def serviceDefinition
+	switch runtime.GOOS {
+	case "linux":
+		def = systemdService(o)
+	case "darwin":
+		def = launchdService(o)
+	case "windows":
+		if o.user {
+			return fmt.Errorf("service: windows has no per-user services; install without -user, as an administrator")
+		}
+		def = windowsService(o)
+	default:
+		return fmt.Errorf("service: no service manager known for %s", runtime.GOOS)
+	}
+
+	var cmds [][]string
+	switch sub {
+	case "install":
+		cmds = def.install
+	case "uninstall":
+		cmds = def.remove
+	case "start":
+		cmds = def.start
+	case "stop":
+		cmds = def.stop
+	default:
+		return fmt.Errorf("service: unknown command %q (want install, uninstall, start or stop)", sub)
+	}
+	if *dry {
+		if sub == "install" && def.file != "" {
+			fmt.Printf("# %s\n%s\n", def.file, def.body)
+		}
+		for _, c := range cmds {
+			fmt.Println(strings.Join(c, " "))
+		}
+		return nil
+	}
+
+	if sub == "install" && def.file != "" {
+		if err := os.MkdirAll(filepath.Dir(def.file), 0o755); err != nil {
+			return err
+		}
+		perm := os.FileMode(0o644)
+		if def.secret {
+			perm = 0o600
+		}
+		if err := writeFileMode(def.file, def.body, perm); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", def.file)
+		if runtime.GOOS == "linux" {
+			if err := writeServiceEnv(o.envFile); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range cmds {
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(c, " "), err)
+		}
+	}
+	if sub == "uninstall" && def.file != "" {
+		if err := os.Remove(def.file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Printf("Removed %s\n", def.file)
+	}
+	return nil
+}
+
+// writeServiceEnv writes ZAI_API_KEY, if set, to a new environment file
+// readable only by its owner. An existing file is left alone.
+func writeServiceEnv(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	key := os.Getenv("ZAI_API_KEY")
+	if key == "" {
+		fmt.Printf("Set ZAI_API_KEY in %s before starting the service\n", path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileMode(path, []byte("ZAI_API_KEY="+key+"\n"), 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", path)
+	return nil
+}
+
+// writeFileMode writes body to path with mode perm, which WriteFile leaves
+// as it was when the file exists.
+func writeFileMode(path string, body []byte, perm os.FileMode) error {
+	if err := os.WriteFile(path, body, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestWriteFileMode checks a service definition holding the API key is
+// left readable only by its owner when it replaces a readable one.
+func TestWriteFileMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "com.ringmaster.zai-proxy.plist")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileMode(path, []byte("ZAI_API_KEY"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+// TestWindowsService checks the proxy is installed as a service proper,
+// restarted when it fails, with its command line as one binPath.
+func TestWindowsService(t *testing.T) {
+	def := windowsService(serviceOptions{name: "zai-proxy", exe: `C:\Program Files\zai-proxy.exe`, config: `C:\zai\config.json`})
+	if len(def.install) != 2 {
+		t.Fatalf("install = %q", def.install)
+	}
+	create := def.install[0]
+	if !slices.Equal(create[:3], []string{"sc.exe", "create", "zai-proxy"}) {
+		t.Errorf("install creates with %q", create)
+	}
+	i := slices.Index(create, "binPath=")
+	if want := `"C:\Program Files\zai-proxy.exe" serve -config C:\zai\config.json`; i < 0 || create[i+1] != want {
+		t.Errorf("binPath in %q, want %s", create, want)
+	}
+	if j := slices.Index(create, "start="); j < 0 || create[j+1] != "auto" {
+		t.Errorf("install doesn't start it at boot: %q", create)
+	}
+	if failure := strings.Join(def.install[1], " "); !strings.Contains(failure, "actions= restart/") {
+		t.Errorf("install doesn't restart it on failure: %s", failure)
+	}
+	if def.file != "" {
+		t.Errorf("definition writes %s; the service manager keeps it", def.file)
+	}
+}
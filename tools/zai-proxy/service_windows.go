@@ -0,0 +1,67 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func init() {
+	serviceControl = windowsServiceControl
+}
+
+// windowsServiceControl answers the service control manager when the
+// process runs as a Windows service: it reports the proxy running, sends
+// stop and shutdown requests on sig as SIGTERM and, once stopped returns,
+// reports it stopped.
+func windowsServiceControl(sig chan<- os.Signal, grace time.Duration) (stopped func()) {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return func() {}
+	}
+	h := &serviceHandler{sig: sig, grace: grace, drained: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run("", h); err != nil {
+			log.Printf("Error answering the service control manager: %v", err)
+		}
+	}()
+	return func() {
+		close(h.drained)
+		<-done
+	}
+}
+
+// serviceHandler is the svc.Handler of the proxy's service.
+type serviceHandler struct {
+	sig     chan<- os.Signal
+	grace   time.Duration
+	drained chan struct{} // closed once the proxy has stopped
+}
+
+func (s *serviceHandler) Execute(_ []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case r := <-reqs:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((s.grace + 5*time.Second).Milliseconds())}
+				select {
+				case s.sig <- syscall.SIGTERM:
+				default:
+				}
+			}
+		case <-s.drained:
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// TestServiceHandler drives the handler as the service control manager
+// would: a stop request becomes SIGTERM, and the service reports stopped
+// only once the proxy has drained.
+func TestServiceHandler(t *testing.T) {
+	sig := make(chan os.Signal, 1)
+	h := &serviceHandler{sig: sig, grace: time.Second, drained: make(chan struct{})}
+	reqs, status := make(chan svc.ChangeRequest), make(chan svc.Status, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Execute(nil, reqs, status)
+	}()
+	if s := <-status; s.State != svc.Running || s.Accepts&svc.AcceptStop == 0 {
+		t.Fatalf("first status %+v, want running and accepting stop", s)
+	}
+	reqs <- svc.ChangeRequest{Cmd: svc.Stop}
+	if s := <-status; s.State != svc.StopPending || s.WaitHint == 0 {
+		t.Errorf("status after stop %+v, want stop pending", s)
+	}
+	if v := <-sig; v != syscall.SIGTERM {
+		t.Errorf("signal %v, want SIGTERM", v)
+	}
+	select {
+	case <-done:
+		t.Fatal("Execute returned before the proxy drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.drained)
+	<-done
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionConfig keeps conversations server-side. A request naming a
+// session (X-Ringmaster-Session, or "session_id" in the body) sends only
+// its new messages; the proxy puts the session's history before them and,
+// once the upstream answers, appends them and the reply. Store is
+// "memory", "storage" (the SQL store) or "redis"; empty disables sessions.
+// Sessions idle for TTL (default 24h) are dropped, and only the newest
+// MaxMessages (default 200) are sent. The memory store keeps only those,
+// and at most MaxSessions (default 10000) sessions of MaxBytes (default
+// 64MB) in all, dropping those used least recently.
+type SessionConfig struct {
+	Store       string   `json:"store,omitempty"`
+	TTL         Duration `json:"ttl,omitempty"`
+	MaxMessages int      `json:"max_messages,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	MaxBytes    int64    `json:"max_bytes,omitempty"`
+}
+
+const sessionHeader = "X-Ringmaster-Session"
+
+func (c *SessionConfig) validate(storage StorageConfig, redis RedisConfig) error {
+	switch c.Store {
+	case "", "memory":
+	case "storage":
+		if storage.Driver == "" {
+			return fmt.Errorf("sessions: store \"storage\" needs a storage driver")
+		}
+	case "redis":
+		if redis.Addr == "" {
+			return fmt.Errorf("sessions: store \"redis\" needs a redis addr")
+		}
+	default:
+		return fmt.Errorf("sessions: unknown store %q (want memory, storage or redis)", c.Store)
+	}
+	if c.TTL < 0 || c.MaxMessages < 0 || c.MaxSessions < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("sessions: ttl, max_messages, max_sessions and max_bytes must not be negative")
+	}
+	return nil
+}
+
+func (c *SessionConfig) ttl() time.Duration {
+	if c.TTL == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.TTL)
+}
+
+// sessionStore keeps each session's messages, oldest first. Keys are the
+// client and session ID, so clients never see each other's sessions.
+type sessionStore interface {
+	LoadSession(ctx context.Context, key string) ([]json.RawMessage, error)
+	AppendSession(ctx context.Context, key string, msgs []json.RawMessage, at time.Time) error
+	// DeleteSession removes a session, reporting whether it existed.
+	DeleteSession(ctx context.Context, key string) (bool, error)
+	// PruneSessions drops sessions last written before before.
+	PruneSessions(ctx context.Context, before time.Time) (int64, error)
+}
+
+// openSessions returns the configured session store, or nil when sessions
+// are off.
+func openSessions(cfg SessionConfig, store Store, rc *redisClient) sessionStore {
+	switch cfg.Store {
+	case "memory":
+		return newMemorySessions(&cfg)
+	case "storage":
+		if s, ok := store.(sessionStore); ok {
+			return s
+		}
+	case "redis":
+		if rc != nil {
+			return &redisSessions{c: rc, ttl: cfg.ttl()}
+		}
+	}
+	return nil
+}
+
+func sessionKey(client, id string) string { return client + "\x00" + id }
+
+type memorySession struct {
+	msgs    []json.RawMessage
+	updated time.Time
+}
+
+// memorySessions is the in-process session store.
+type memorySessions struct {
+	max int // messages kept per session
+
+	mu sync.Mutex
+	m  *lru[string, *memorySession]
+}
+
+func newMemorySessions(cfg *SessionConfig) *memorySessions {
+	return &memorySessions{max: cmp.Or(cfg.MaxMessages, 200),
+		m: newLRU("sessions", cmp.Or(cfg.MaxSessions, 10000), cmp.Or(cfg.MaxBytes, 64<<20), func(key string, ms *memorySession) int64 {
+			n := int64(len(key))
+			for _, m := range ms.msgs {
+				n += int64(len(m))
+			}
+			return n
+		})}
+}
+
+func (s *memorySessions) LoadSession(_ context.Context, key string) ([]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ms, ok := s.m.get(key); ok {
+		return append([]json.RawMessage(nil), ms.msgs...), nil
+	}
+	return nil, nil
+}
+
+// AppendSession keeps only the messages that will be sent again.
+func (s *memorySessions) AppendSession(_ context.Context, key string, msgs []json.RawMessage, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.m.get(key)
+	if !ok {
+		ms = &memorySession{}
+	}
+	ms.msgs, ms.updated = append(ms.msgs, msgs...), at
+	if drop := len(ms.msgs) - s.max; drop > 0 {
+		ms.msgs = append(ms.msgs[:0:0], ms.msgs[drop:]...)
+	}
+	s.m.put(key, ms)
+	return nil
+}
+
+func (s *memorySessions) DeleteSession(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.remove(key), nil
+}
+
+func (s *memorySessions) PruneSessions(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.removeIf(func(_ string, ms *memorySession) bool { return ms.updated.Before(before) }), nil
+}
+
+// pruneSessionsLoop drops idle sessions every few minutes, when only
+// reports true or is nil.
+func pruneSessionsLoop(ctx context.Context, s sessionStore, ttl time.Duration, only func() bool) {
+	ticker := time.NewTicker(min(ttl, 5*time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if only != nil && !only() {
+			continue
+		}
+		if n, err := s.PruneSessions(ctx, time.Now().Add(-ttl)); err != nil {
+			log.Printf("Error pruning sessions: %v", err)
+		} else if n > 0 {
+			debugf("Pruned %d idle sessions", n)
+		}
+	}
+}
+
+// sessionStage assembles a session's history into the request once
+// transform has parsed it, and records the turn when the upstream answers
+// it. It comes before the stages that pick models and check context
+// limits, so they see the whole conversation.
+func sessionStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		if p.sessions == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			id := r.Header.Get(sessionHeader)
+			if ex.doc != nil {
+				if s, ok := ex.doc["session_id"].(string); ok {
+					id = s
+					delete(ex.doc, "session_id")
+					ex.dirty = true
+				}
+			}
+			msgs, ok := ex.doc["messages"].([]any)
+			if id == "" || !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Header.Del(sessionHeader)
+			key := sessionKey(ex.client, id)
+			history, err := p.sessions.LoadSession(r.Context(), key)
+			if err != nil {
+				log.Printf("Error loading session: %v", err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "loading the session failed")
+				return
+			}
+			if n := cmp.Or(p.cfg.Sessions.MaxMessages, 200); len(history) > n {
+				history = history[len(history)-n:]
+			}
+			turn := make([]json.RawMessage, 0, len(msgs)+1)
+			for _, m := range msgs {
+				b, err := encodeJSON(m)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid_request", "messages must be JSON objects")
+					return
+				}
+				turn = append(turn, b)
+			}
+			all := make([]any, 0, len(history)+len(msgs))
+			for _, b := range history {
+				if v, err := decodeJSON(b); err == nil {
+					all = append(all, v)
+				}
+			}
+			ex.doc["messages"], ex.dirty = append(all, msgs...), true
+			w.Header().Set(sessionHeader, id)
+			w.Header().Set("X-Ringmaster-Session-Messages", strconv.Itoa(len(all)+len(msgs)))
+
+			ex.inspect = true
+			reply := &replySink{}
+			next.ServeHTTP(teeTo(w, reply), r)
+			if ex.dryRun || reply.status >= 300 {
+				return
+			}
+			text, ok := reply.text()
+			if !ok {
+				return
+			}
+			b, _ := json.Marshal(map[string]string{"role": "assistant", "content": text})
+			if err := p.sessions.AppendSession(context.Background(), key, append(turn, b), time.Now()); err != nil {
+				log.Printf("Error saving session: %v", err)
+			}
+		})
+	}, nil
+}
+
+// replySink assembles the text of a reply, streamed or not, in OpenAI or
+// Anthropic form.
+type replySink struct {
+	status int
+	sse    bool
+	body   bytes.Buffer
+	line   []byte
+	out    strings.Builder
+	over   bool
+}
+
+func (s *replySink) begin(status int, h http.Header) {
+	s.status = status
+	s.sse = strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
+}
+
+func (s *replySink) Write(b []byte) (int, error) {
+	if !s.sse {
+		if s.body.Len()+len(b) > maxObservedBody {
+			s.over = true
+		} else if !s.over {
+			s.body.Write(b)
+		}
+		return len(b), nil
+	}
+	s.line = append(s.line, b...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.event(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > maxObservedBody {
+		s.line, s.over = nil, true
+	}
+	return len(b), nil
+}
+
+func (s *replySink) event(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	v, err := decodeJSON(bytes.TrimSpace(data))
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return
+	}
+	for _, t := range textFields(doc) {
+		if t.index == 0 {
+			s.out.WriteString(t.get())
+		}
+	}
+}
+
+// text returns the reply, or false if it could not be read whole.
+func (s *replySink) text() (string, bool) {
+	if s.over {
+		return "", false
+	}
+	if s.sse {
+		return s.out.String(), true
+	}
+	v, err := decodeJSON(s.body.Bytes())
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return "", false
+	}
+	return responseText(doc), true
+}
+
+// sessionHandler serves the calling client's session history and deletes
+// sessions.
+func sessionHandler(sessions sessionStore, self func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sessions == nil {
+			writeError(w, http.StatusNotFound, "not_found", "sessions are not enabled")
+			return
+		}
+		key := sessionKey(self(r), r.PathValue("id"))
+		if r.Method == http.MethodDelete {
+			ok, err := sessions.DeleteSession(r.Context(), key)
+			switch {
+			case err != nil:
+				log.Printf("Error deleting session: %v", err)
+				writeError(w, http.StatusInternalServerError, "internal_error", "deleting the session failed")
+			case !ok:
+				writeError(w, http.StatusNotFound, "not_found", "no such session")
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		msgs, err := sessions.LoadSession(r.Context(), key)
+		if err != nil {
+			log.Printf("Error loading session: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "loading the session failed")
+			return
+		}
+		if msgs == nil {
+			writeError(w, http.StatusNotFound, "not_found", "no such session")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"id": r.PathValue("id"), "messages": msgs})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sigv4 scheme signs requests as AWS does, for Amazon Bedrock's
+// OpenAI-compatible endpoint (https://bedrock-runtime.<region>.amazonaws.com/openai)
+// or any other AWS service. Credentials come from the first of:
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (with AWS_SESSION_TOKEN),
+// a web identity role (AWS_ROLE_ARN with AWS_WEB_IDENTITY_TOKEN_FILE, as
+// on EKS), the ECS container endpoint and the EC2 instance metadata
+// service. With RoleARN those credentials assume that role.
+//
+// Region defaults to AWS_REGION, then AWS_DEFAULT_REGION, then the one in
+// the upstream's host name; Service defaults to "bedrock".
+
+var awsCredentialFetches = metrics.counter("zai_proxy_aws_credential_fetches_total",
+	"AWS credentials fetched for sigv4 upstreams, by source and result.", "source", "result")
+
+// awsCredentials are a signing identity; Expires is zero for ones that
+// don't expire.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+	source          string
+}
+
+// awsCredentialCache holds credentials by the role they assume, "" for
+// the base ones, until shortly before they expire. They are fetched
+// without the lock held, once however many requests want them, and those
+// that have credentials still valid use them meanwhile. A failure to get
+// them is remembered for awsRetryAfter, so requests don't each wait on it.
+type awsCredentialCache struct {
+	mu       sync.Mutex
+	creds    map[string]awsCredentials
+	failed   map[string]awsFailure
+	fetching map[string]*awsFetch
+	hc       *http.Client
+}
+
+type awsFailure struct {
+	err   error
+	until time.Time
+}
+
+// awsFetch is a fetch under way; done is closed once creds or err is set.
+type awsFetch struct {
+	done  chan struct{}
+	creds awsCredentials
+	err   error
+}
+
+var awsCreds = &awsCredentialCache{creds: map[string]awsCredentials{}, failed: map[string]awsFailure{},
+	fetching: map[string]*awsFetch{}, hc: &http.Client{Timeout: 5 * time.Second}}
+
+const (
+	// awsRefreshBefore is how long before they expire credentials are renewed.
+	awsRefreshBefore = 5 * time.Minute
+	awsRetryAfter    = 30 * time.Second
+)
+
+// get returns credentials, assuming role when it isn't "". Credentials
+// that fail to renew are used while they last.
+func (c *awsCredentialCache) get(ctx context.Context, role, region string) (awsCredentials, error) {
+	c.mu.Lock()
+	cur, ok := c.creds[role]
+	if ok && (cur.Expires.IsZero() || time.Until(cur.Expires) > awsRefreshBefore) {
+		c.mu.Unlock()
+		return cur, nil
+	}
+	valid := ok && time.Now().Before(cur.Expires)
+	if f, failed := c.failed[role]; failed && time.Now().Before(f.until) {
+		c.mu.Unlock()
+		if valid {
+			return cur, nil
+		}
+		return awsCredentials{}, f.err
+	}
+	f := c.fetching[role]
+	if f == nil {
+		f = &awsFetch{done: make(chan struct{})}
+		c.fetching[role] = f
+		// The fetch outlives a request giving up on it, for the others.
+		go c.renew(context.WithoutCancel(ctx), role, region, f)
+	}
+	c.mu.Unlock()
+	if valid {
+		return cur, nil
+	}
+	select {
+	case <-f.done:
+		return f.creds, f.err
+	case <-ctx.Done():
+		return awsCredentials{}, ctx.Err()
+	}
+}
+
+// renew runs f, fetching role's credentials, and caches what it gets.
+func (c *awsCredentialCache) renew(ctx context.Context, role, region string, f *awsFetch) {
+	defer close(f.done)
+	if role == "" {
+		f.creds, f.err = c.fetch(ctx, region)
+	} else if base, err := c.get(ctx, "", region); err != nil {
+		f.err = err
+	} else {
+		f.creds, f.err = c.assumeRole(ctx, base, role, region)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fetching, role)
+	if f.err != nil {
+		c.failed[role] = awsFailure{f.err, time.Now().Add(awsRetryAfter)}
+		if cur, ok := c.creds[role]; ok && time.Now().Before(cur.Expires) {
+			log.Printf("Error renewing AWS credentials, using ones expiring %s: %v", cur.Expires.Format(time.RFC3339), f.err)
+		}
+		return
+	}
+	delete(c.failed, role)
+	c.creds[role] = f.creds
+}
+
+// fetch finds the base credentials along the chain.
+func (c *awsCredentialCache) fetch(ctx context.Context, region string) (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN"), source: "env"}, nil
+	}
+	var creds awsCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		creds, err = c.webIdentity(ctx, region)
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "":
+		creds, err = c.container(ctx)
+	case !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		creds, err = c.instanceMetadata(ctx)
+	default:
+		return awsCredentials{}, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or run with a role")
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	awsCredentialFetches.Add(1, creds.source, result)
+	return creds, err
+}
+
+// stsCredentials is the Credentials element of an STS reply.
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+// sts sends an STS call and reads the credentials it replies with.
+func (c *awsCredentialCache) sts(req *http.Request, source string) (awsCredentials, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return awsCredentials{source: source}, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{source: source}, fmt.Errorf("sts %s: %s: %s", source, resp.Status, bytes.TrimSpace(b))
+	}
+	var doc struct {
+		Role        stsCredentials `xml:"AssumeRoleResult>Credentials"`
+		WebIdentity stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		return awsCredentials{source: source}, fmt.Errorf("sts %s: %w", source, err)
+	}
+	d := cmp.Or(doc.Role, doc.WebIdentity)
+	if d.AccessKeyID == "" {
+		return awsCredentials{source: source}, fmt.Errorf("sts %s: no credentials in reply", source)
+	}
+	return awsCredentials{AccessKeyID: d.AccessKeyID, SecretAccessKey: d.SecretAccessKey, SessionToken: d.SessionToken,
+		Expires: d.Expiration, source: source}, nil
+}
+
+func stsEndpoint(region string) string {
+	if region == "" {
+		return "https://sts.amazonaws.com/"
+	}
+	return "https://sts." + region + ".amazonaws.com/"
+}
+
+// webIdentity exchanges a service account token for the role's
+// credentials; the call needs no signature.
+func (c *awsCredentialCache) webIdentity(ctx context.Context, region string) (awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{source: "web_identity"}, err
+	}
+	form := url.Values{"Action": {"AssumeRoleWithWebIdentity"}, "Version": {"2011-06-15"},
+		"RoleArn": {os.Getenv("AWS_ROLE_ARN")}, "RoleSessionName": {cmp.Or(os.Getenv("AWS_ROLE_SESSION_NAME"), "ringmaster")},
+		"WebIdentityToken": {strings.TrimSpace(string(token))}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(region), strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{source: "web_identity"}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.sts(req, "web_identity")
+}
+
+// assumeRole trades base credentials for role's.
+func (c *awsCredentialCache) assumeRole(ctx context.Context, base awsCredentials, role, region string) (awsCredentials, error) {
+	form := url.Values{"Action": {"AssumeRole"}, "Version": {"2011-06-15"}, "RoleArn": {role},
+		"RoleSessionName": {"ringmaster"}, "DurationSeconds": {"3600"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(region), strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{source: "assume_role"}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body := sha256.Sum256([]byte(form.Encode()))
+	signV4(req, base, cmp.Or(region, "us-east-1"), "sts", "/", "", hex.EncodeToString(body[:]), time.Now().UTC())
+	creds, err := c.sts(req, "assume_role")
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	awsCredentialFetches.Add(1, "assume_role", result)
+	return creds, err
+}
+
+// metadataCredentials is how the container and instance endpoints reply.
+type metadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c *awsCredentialCache) metadata(req *http.Request, source string) (awsCredentials, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return awsCredentials{source: source}, err
+	}
+	defer resp.Body.Close()
+	var m metadataCredentials
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{source: source}, fmt.Errorf("%s credentials: %s", source, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil || m.AccessKeyID == "" {
+		return awsCredentials{source: source}, fmt.Errorf("%s credentials: no credentials in reply", source)
+	}
+	return awsCredentials{AccessKeyID: m.AccessKeyID, SecretAccessKey: m.SecretAccessKey, SessionToken: m.Token,
+		Expires: m.Expiration, source: source}, nil
+}
+
+// container reads the task role's credentials from the ECS endpoint.
+func (c *awsCredentialCache) container(ctx context.Context) (awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return awsCredentials{source: "container"}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if f := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return awsCredentials{source: "container"}, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return c.metadata(req, "container")
+}
+
+// instanceMetadata reads the instance role's credentials with IMDSv2.
+func (c *awsCredentialCache) instanceMetadata(ctx context.Context) (awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest/"
+	fail := func(err error) (awsCredentials, error) {
+		return awsCredentials{source: "imds"}, fmt.Errorf("instance metadata: %w", err)
+	}
+	call := func(method, path string, hdr http.Header) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, imds+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = hdr
+		resp, err := c.hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return b, nil
+	}
+	token, err := call(http.MethodPut, "api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		return fail(err)
+	}
+	hdr := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	roles, err := call(http.MethodGet, "meta-data/iam/security-credentials/", hdr)
+	if err != nil {
+		return fail(err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return fail(errors.New("the instance has no role"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imds+"meta-data/iam/security-credentials/"+role, nil)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header = hdr
+	return c.metadata(req, "imds")
+}
+
+// awsRegion is the region to sign for host in.
+func (a *UpstreamAuth) awsRegion(host string) string {
+	if r := cmp.Or(a.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")); r != "" {
+		return r
+	}
+	// Such as bedrock-runtime.us-east-1.amazonaws.com.
+	if labels := strings.Split(host, "."); len(labels) >= 4 && strings.HasSuffix(host, ".amazonaws.com") {
+		return labels[len(labels)-3]
+	}
+	return ""
+}
+
+// signAWS signs req for the upstream, reading its body into memory when
+// it isn't already, for its hash.
+func (a *UpstreamAuth) signAWS(req *http.Request) error {
+	host := cmp.Or(req.Host, req.URL.Host)
+	region := a.awsRegion(host)
+	if region == "" {
+		return fmt.Errorf("sigv4: no region for %s; set region or AWS_REGION", host)
+	}
+	creds, err := awsCreds.get(req.Context(), a.RoleARN, region)
+	if err != nil {
+		return fmt.Errorf("sigv4: %w", err)
+	}
+	payload, err := bodySHA256(req)
+	if err != nil {
+		return err
+	}
+	// Services other than S3 sign the path as sent, escaped once more.
+	path := awsEscape(cmp.Or(req.URL.EscapedPath(), "/"), true)
+	signV4(req, creds, region, cmp.Or(a.Service, "bedrock"), path, canonicalQuery(req.URL.Query()), payload, time.Now().UTC())
+	return nil
+}
+
+// bodySHA256 returns the hex SHA-256 of req's body, which is read into
+// memory unless it can be had again.
+func bodySHA256(req *http.Request) (string, error) {
+	var body []byte
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		rc, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+	default:
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		body = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
+		req.ContentLength = int64(len(b))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signV4 adds an AWS Signature Version 4 for region and service to req,
+// whose canonical path and query are given, signing host, the content
+// type and every x-amz- header.
+func signV4(req *http.Request, creds awsCredentials, region, service, path, rawQuery, payload string, now time.Time) {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	signed := map[string]string{"host": cmp.Or(req.Host, req.URL.Host)}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			signed[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, path, rawQuery, canonical.String(), signedHeaders, payload}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	reqSum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqSum[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSignV4Vectors signs requests from AWS's Signature Version 4 test
+// suite and compares the signatures with the suite's.
+func TestSignV4Vectors(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, method, url, contentType, body string
+		signedHeaders, signature             string
+	}{
+		{"get-vanilla", "GET", "https://example.amazonaws.com/", "", "",
+			"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "", "",
+			"host;x-amz-date", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"post-vanilla", "POST", "https://example.amazonaws.com/", "", "",
+			"host;x-amz-date", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-x-www-form-urlencoded", "POST", "https://example.amazonaws.com/", "application/x-www-form-urlencoded", "Param1=value1",
+			"content-type;host;x-amz-date", "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		sum := sha256.Sum256([]byte(tc.body))
+		signV4(req, creds, "us-east-1", "service", "/", canonicalQuery(req.URL.Query()), hex.EncodeToString(sum[:]), now)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=" +
+			tc.signedHeaders + ", Signature=" + tc.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date %s", tc.name, got)
+		}
+	}
+}
+
+// fakeContainerCreds serves ECS container credentials, each call waiting
+// for release to be closed, and points the credential chain at it.
+func fakeContainerCreds(t *testing.T, release <-chan struct{}, expires time.Time) *atomic.Int32 {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		<-release
+		fmt.Fprintf(w, `{"AccessKeyId":"AKID%d","SecretAccessKey":"secret","Token":"token","Expiration":%q}`, n, expires.Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+	useContainerCreds(t, srv.URL)
+	return &calls
+}
+
+// useContainerCreds makes url the only source of credentials.
+func useContainerCreds(t *testing.T, url string) {
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", url)
+}
+
+func newTestAWSCache() *awsCredentialCache {
+	return &awsCredentialCache{creds: map[string]awsCredentials{}, failed: map[string]awsFailure{},
+		fetching: map[string]*awsFetch{}, hc: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// TestAWSCredentialCacheFetchOnce checks requests wanting credentials at
+// once share one fetch, which holds up neither credentials cached for
+// other roles nor requests that give up on it.
+func TestAWSCredentialCacheFetchOnce(t *testing.T) {
+	release := make(chan struct{})
+	calls := fakeContainerCreds(t, release, time.Now().Add(time.Hour))
+	c := newTestAWSCache()
+	c.creds["arn:aws:iam::1:role/other"] = awsCredentials{AccessKeyID: "OTHER", Expires: time.Now().Add(time.Hour)}
+
+	var wg sync.WaitGroup
+	got := make([]awsCredentials, 8)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if got[i], err = c.get(context.Background(), "", "us-east-1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	other, err := c.get(context.Background(), "arn:aws:iam::1:role/other", "us-east-1")
+	if err != nil || other.AccessKeyID != "OTHER" {
+		t.Errorf("cached role during a fetch = %+v, %v", other, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.get(ctx, "", "us-east-1"); err != context.DeadlineExceeded {
+		t.Errorf("get given up on = %v, want the deadline", err)
+	}
+	close(release)
+	wg.Wait()
+	for i, cr := range got {
+		if cr.AccessKeyID != "AKID1" {
+			t.Errorf("get %d = %+v, want the one fetch's", i, cr)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+// TestAWSCredentialCacheRenew checks credentials about to expire are used
+// while they are renewed, and replaced once they are.
+func TestAWSCredentialCacheRenew(t *testing.T) {
+	release := make(chan struct{})
+	calls := fakeContainerCreds(t, release, time.Now().Add(time.Hour))
+	c := newTestAWSCache()
+	c.creds[""] = awsCredentials{AccessKeyID: "OLD", Expires: time.Now().Add(time.Minute)}
+	if cr, err := c.get(context.Background(), "", "us-east-1"); err != nil || cr.AccessKeyID != "OLD" {
+		t.Fatalf("get while renewing = %+v, %v; want the old credentials", cr, err)
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cr, err := c.get(context.Background(), "", "us-east-1")
+		if err == nil && cr.AccessKeyID == "AKID1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("credentials never renewed: %+v, %v", cr, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+// TestAWSCredentialCacheFailure checks a failed fetch is remembered, so
+// requests after it fail without fetching again.
+func TestAWSCredentialCacheFailure(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "no role", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	useContainerCreds(t, srv.URL)
+	c := newTestAWSCache()
+	for i := 0; i < 3; i++ {
+		if _, err := c.get(context.Background(), "", "us-east-1"); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("get %d = %v, want the endpoint's refusal", i, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
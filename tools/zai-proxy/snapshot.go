@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotConfig keeps the counters held in memory across restarts, so a
+// restart doesn't reset everyone's limits. Every Interval (default 1m),
+// before handing over to a new process and once stopped, the proxy writes
+// to File the usage client quotas are checked against without storage,
+// each agent's usage and rate, client IP rates and the open circuits; at
+// startup it reads them back, leaving out what has since expired.
+type SnapshotConfig struct {
+	File     string   `json:"file,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+func (c *SnapshotConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("snapshot: interval must not be negative")
+	}
+	return nil
+}
+
+// snapshot is the state written to the snapshot file.
+type snapshot struct {
+	Time     time.Time            `json:"time"`
+	Hourly   []hourlySnapshot     `json:"hourly,omitempty"`
+	Agents   []agentSnapshot      `json:"agents,omitempty"`
+	IPMinute int64                `json:"ip_minute,omitempty"`
+	IPCounts map[string]int       `json:"ip_counts,omitempty"`
+	Circuits map[string]time.Time `json:"circuits,omitempty"` // open, until when
+}
+
+type hourlySnapshot struct {
+	Hour int64 `json:"hour"`
+	UsageRow
+}
+
+type agentSnapshot struct {
+	AgentStats
+	Day    time.Time `json:"day"`
+	Month  time.Time `json:"month"`
+	Minute int64     `json:"minute,omitempty"`
+	Count  int       `json:"count,omitempty"`
+}
+
+func (t *UsageTracker) snapshot(s *snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, v := range t.hourly {
+		s.Hourly = append(s.Hourly, hourlySnapshot{Hour: k.hour, UsageRow: UsageRow{UsageKey: k.UsageKey, UsageTotals: *v}})
+	}
+}
+
+// restore adds the snapshot's buckets still in the window. Lifetime totals
+// are this process's own, so are not restored.
+func (t *UsageTracker) restore(s *snapshot, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	oldest := now.Add(-t.window).Unix() / 3600
+	for _, h := range s.Hourly {
+		if h.Hour < oldest {
+			continue
+		}
+		k := hourKey{hour: h.Hour, UsageKey: h.UsageKey}
+		ht := t.hourly[k]
+		if ht == nil {
+			ht = &UsageTotals{}
+			t.hourly[k] = ht
+		}
+		ht.merge(&h.UsageTotals)
+	}
+}
+
+func (t *agentTracker) snapshot(s *snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		a := e.Value.(*agentState)
+		s.Agents = append(s.Agents, agentSnapshot{AgentStats: a.AgentStats, Day: a.day, Month: a.month, Minute: a.minute, Count: a.count})
+	}
+}
+
+// restore takes in the snapshot's agents not seen since, most recently
+// seen first as they were kept.
+func (t *agentTracker) restore(s *snapshot, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range s.Agents {
+		k := agentKey{a.Client, a.Agent}
+		if _, ok := t.byKey[k]; ok {
+			continue
+		}
+		if t.order.Len() >= cmp.Or(t.cfg.MaxAgents, 10000) {
+			break
+		}
+		st := &agentState{AgentStats: a.AgentStats, day: a.Day, month: a.Month, minute: a.Minute, count: a.Count}
+		st.roll(now)
+		t.byKey[k] = t.order.PushBack(st)
+	}
+}
+
+func (c *clientIPs) snapshot(s *snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.IPMinute, s.IPCounts = c.minute, make(map[string]int, len(c.counts))
+	for a, n := range c.counts {
+		s.IPCounts[a.String()] = n
+	}
+}
+
+// restore takes in the snapshot's counts if they are for this minute.
+func (c *clientIPs) restore(s *snapshot, now time.Time) {
+	if s.IPMinute != now.Unix()/60 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.minute != s.IPMinute {
+		c.minute, c.counts = s.IPMinute, map[netip.Addr]int{}
+	}
+	for k, n := range s.IPCounts {
+		if a, err := netip.ParseAddr(k); err == nil {
+			c.counts[a] += n
+		}
+	}
+}
+
+// saveSnapshot writes the proxy's counters to the snapshot file.
+func (p *proxy) saveSnapshot() {
+	path := p.cfg.Snapshot.File
+	if path == "" {
+		return
+	}
+	s := &snapshot{Time: time.Now().UTC(), Circuits: p.pool.circuits.opened()}
+	p.usage.snapshot(s)
+	p.agents.snapshot(s)
+	p.ips.snapshot(s)
+	b, err := json.Marshal(s)
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+	}
+}
+
+// loadSnapshot restores the counters in the snapshot file, if there is one.
+func (p *proxy) loadSnapshot() {
+	path := p.cfg.Snapshot.File
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var s snapshot
+	if err == nil {
+		err = json.Unmarshal(b, &s)
+	}
+	if err != nil {
+		log.Printf("Error reading snapshot, starting without it: %v", err)
+		return
+	}
+	now := time.Now()
+	p.usage.restore(&s, now)
+	p.agents.restore(&s, now)
+	p.ips.restore(&s, now)
+	for m, until := range s.Circuits {
+		if until.After(now) {
+			p.pool.circuits.openUntil(m, until)
+		}
+	}
+	infof("Restored counters from the snapshot of %s", s.Time.Format(time.RFC3339))
+}
+
+// snapshotLoop saves the snapshot every interval until ctx is done.
+func (p *proxy) snapshotLoop(ctx context.Context) {
+	t := time.NewTicker(cmp.Or(time.Duration(p.cfg.Snapshot.Interval), time.Minute))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.saveSnapshot()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SpeechConfig covers the audio endpoints. Transcription and translation
+// uploads stream to the upstream as they arrive, at most MaxUpload
+// (default 25MB); only the form's head is read ahead for its model field,
+// which must precede the file, so model allow lists and access rules apply
+// as to JSON requests. Speech audio streams back unbuffered. Responses
+// without a usage block are accounted by estimate: a speech request's
+// input as prompt tokens, a transcript's text as completion tokens.
+type SpeechConfig struct {
+	MaxUpload int64 `json:"max_upload,omitempty"`
+}
+
+func (c *SpeechConfig) validate() error {
+	if c.MaxUpload < 0 {
+		return fmt.Errorf("speech: max_upload must not be negative")
+	}
+	return nil
+}
+
+var speechRequests = metrics.counter("zai_proxy_speech_requests_total", "Audio endpoint requests, by endpoint.", "endpoint")
+
+// transcriptSink keeps the start of a transcription response.
+type transcriptSink struct {
+	bodySink
+	contentType string
+}
+
+func (s *transcriptSink) begin(status int, h http.Header) {
+	s.bodySink.begin(status, h)
+	s.contentType = h.Get("Content-Type")
+}
+
+// speechStage follows transform, which parses speech requests' JSON bodies;
+// transcription forms are left to it.
+func speechStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	sc := &p.cfg.Speech
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			endpoint := path.Base(r.URL.Path)
+			if r.Method != http.MethodPost || !strings.HasSuffix(path.Dir(r.URL.Path), "/audio") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch endpoint {
+			case "speech":
+				speechRequests.Add(1, endpoint)
+				input, _ := ex.doc["input"].(string)
+				ex.estimate = Usage{PromptTokens: countTokens(ex.model, input)}
+				next.ServeHTTP(w, r)
+			case "transcriptions", "translations":
+				speechRequests.Add(1, endpoint)
+				model, uerr := formModel(w, r, cmp.Or(sc.MaxUpload, 25<<20))
+				if uerr != nil {
+					writeError(w, uerr.status, uerr.kind, uerr.msg)
+					return
+				}
+				ex.model = model
+				if err := p.cfg.checkModel(p.registry.Client(ex.client), ex.client, ex.model); err != nil {
+					writeError(w, http.StatusForbidden, "model_not_allowed", err.Error())
+					return
+				}
+				if msg, denied := p.checkAccess(ex, r); denied {
+					writeError(w, http.StatusForbidden, "access_denied", msg)
+					return
+				}
+				sink := &transcriptSink{bodySink: bodySink{limit: maxObservedBody}}
+				next.ServeHTTP(teeTo(w, sink), r)
+				if sink.status < 300 {
+					ex.estimate = Usage{CompletionTokens: countTokens(ex.model, transcriptText(sink.contentType, sink.body))}
+				}
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}, nil
+}
+
+// formModel returns the model field of a transcription upload, read from
+// the form's head.
+func formModel(w http.ResponseWriter, r *http.Request, limit int64) (string, *uploadError) {
+	mr, uerr := peekForm(w, r, limit)
+	if uerr != nil {
+		return "", uerr
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil || part.FileName() != "" {
+			return "", &uploadError{http.StatusBadRequest, "invalid_request", "the model field must come before the file"}
+		}
+		if part.FormName() == "model" {
+			b, err := io.ReadAll(io.LimitReader(part, 256))
+			if err != nil || len(b) == 0 {
+				return "", &uploadError{http.StatusBadRequest, "invalid_request", "the model field is empty"}
+			}
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+}
+
+// transcriptText is the text of a transcription response: the text field
+// of JSON answers, the body of text, SRT and VTT ones. Streams carry their
+// own usage.
+func transcriptText(contentType string, body []byte) string {
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		v, _ := decodeJSON(body)
+		doc, _ := v.(map[string]any)
+		text, _ := doc["text"].(string)
+		return text
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		return ""
+	}
+	return string(body)
+}
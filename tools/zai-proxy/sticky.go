@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StickyConfig keeps each conversation on one upstream of the pool, so
+// provider-side prompt caches and sessions aren't lost to the weighted
+// draw. A conversation is named by Header (default X-Ringmaster-Session)
+// or else the first of Fields, dotted paths into the request body, that
+// holds a string (default session_id, prompt_cache_key, conversation and
+// metadata.user_id). Named requests pick their upstream by rendezvous
+// hashing on the name, weighted as draws are: a conversation stays where
+// it is across restarts and replicas, and only those on an upstream that
+// leaves the pool move. Conditional route targets and overrides still
+// come first.
+type StickyConfig struct {
+	Enabled bool     `json:"enabled,omitempty"`
+	Header  string   `json:"header,omitempty"`
+	Fields  []string `json:"fields,omitempty"`
+}
+
+func (c *StickyConfig) validate() error {
+	for _, f := range c.Fields {
+		if f == "" || strings.Contains(f, "..") || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") {
+			return fmt.Errorf("sticky: bad field %q", f)
+		}
+	}
+	return nil
+}
+
+var defaultStickyFields = []string{"session_id", "prompt_cache_key", "conversation", "metadata.user_id"}
+
+var stickyRequests = metrics.counter("zai_proxy_sticky_requests_total", "Requests routed by conversation, by upstream.", "upstream")
+
+// affinity returns the conversation r belongs to, or "".
+func (c *StickyConfig) affinity(r *http.Request, doc map[string]any) string {
+	if id := r.Header.Get(cmp.Or(c.Header, sessionHeader)); id != "" {
+		return id
+	}
+	fields := c.Fields
+	if len(fields) == 0 {
+		fields = defaultStickyFields
+	}
+	for _, f := range fields {
+		var v any = doc
+		for _, k := range strings.Split(f, ".") {
+			m, _ := v.(map[string]any)
+			v = m[k]
+		}
+		if s, ok := v.(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// stickyStage names the request's conversation before session, which
+// takes its ID out of the request.
+func stickyStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	sc := &p.cfg.Sticky
+	return func(next http.Handler) http.Handler {
+		if !sc.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			if id := sc.affinity(r, ex.doc); id != "" {
+				ex.affinity = ex.client + "\x00" + id
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// pickFor returns the upstream key belongs on: the one scoring highest for
+// it, weighted so each gets its share of keys, among those whose circuits
+// are closed if any are. "" for an empty pool.
+func (p *upstreamPool) pickFor(key string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	best, top, closed := "", math.Inf(-1), false
+	for i := range p.ups {
+		u := &p.ups[i]
+		ok := u.weight() > 0 && !p.circuits.isOpen(u.URL, now)
+		if closed && !ok {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(u.Name))
+		x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53) // uniform in (0, 1)
+		if score := float64(u.weight()) / -math.Log(x); score > top || ok && !closed {
+			best, top, closed = u.URL, score, ok
+		}
+	}
+	return best
+}
+
+// mix64 spreads every bit of h over the result, which FNV alone leaves to
+// its low bits for keys differing at the end.
+func mix64(h uint64) uint64 {
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	return h ^ h>>31
+}
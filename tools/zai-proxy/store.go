@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// UsageRecord is the persisted accounting for one proxied request.
+type UsageRecord struct {
+	ID       string
+	Time     time.Time
+	Status   int
+	Duration time.Duration
+	UsageKey
+	Usage
+	CostUSD float64
+}
+
+// Store persists usage records, virtual keys and quota overrides so they
+// survive restarts and can be shared by replicas.
+type Store interface {
+	usageSource
+	clientUsage
+	RecordUsage(ctx context.Context, rec UsageRecord) error
+	// ListUsage returns raw records in [from, to), oldest first.
+	ListUsage(ctx context.Context, from, to time.Time) ([]UsageRecord, error)
+	// PruneUsage deletes records older than before, returning how many.
+	PruneUsage(ctx context.Context, before time.Time) (int64, error)
+
+	CreateKey(ctx context.Context, k VirtualKey) error
+	ListKeys(ctx context.Context) ([]VirtualKey, error)
+	// LookupKey returns the key with the given secret hash, or nil.
+	LookupKey(ctx context.Context, hash string) (*VirtualKey, error)
+	// RevokeKey marks a key revoked, reporting whether it existed.
+	RevokeKey(ctx context.Context, id string, at time.Time) (bool, error)
+
+	// GetQuota returns the stored quota override for client, if any.
+	GetQuota(ctx context.Context, client string) (QuotaConfig, bool, error)
+	SetQuota(ctx context.Context, client string, q QuotaConfig) error
+
+	Close() error
+}
+
+// StorageConfig selects the persistent store. The driver is "sqlite" for an
+// embedded database, DSN being its file, or "postgres"/"pgx" for a shared
+// one; empty keeps usage in memory only. Usage records are kept for
+// Retention (default 90 days), or forever when it is 0.
+type StorageConfig struct {
+	Driver    string   `json:"driver"`
+	DSN       string   `json:"dsn"`
+	Retention Duration `json:"retention"`
+}
+
+func (c *StorageConfig) validate() error {
+	switch c.Driver {
+	case "":
+		return nil
+	case "sqlite", "sqlite3", "postgres", "pgx":
+	default:
+		return fmt.Errorf("storage: unknown driver %q (want sqlite or postgres)", c.Driver)
+	}
+	if strings.TrimSpace(c.DSN) == "" {
+		return fmt.Errorf("storage: driver %s needs a dsn", c.Driver)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("storage: retention must not be negative; 0 keeps usage forever")
+	}
+	return nil
+}
+
+// openStore opens the configured store, or returns nil when none is set.
+func openStore(cfg StorageConfig) (Store, error) {
+	if cfg.Driver == "" {
+		return nil, nil
+	}
+	s, err := openSQLStore(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pruneUsageLoop deletes records older than retention once an hour, when
+// only reports true or is nil. A retention of 0 keeps them all.
+func pruneUsageLoop(ctx context.Context, s Store, retention time.Duration, only func() bool) {
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if only == nil || only() {
+			n, err := s.PruneUsage(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Error pruning usage records: %v", err)
+			} else if n > 0 {
+				infof("Pruned %d usage records older than %s", n, retention)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
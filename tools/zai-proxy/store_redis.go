@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// redisSessions keeps sessions in Redis lists that expire once idle for
+// the session TTL, so they need no pruning.
+type redisSessions struct {
+	c   *redisClient
+	ttl time.Duration
+}
+
+func (s *redisSessions) LoadSession(ctx context.Context, key string) ([]json.RawMessage, error) {
+	v, err := s.c.do(ctx, "LRANGE", s.c.key("session", key), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, _ := v.([]any)
+	msgs := make([]json.RawMessage, 0, len(items))
+	for _, it := range items {
+		if m, ok := it.(string); ok {
+			msgs = append(msgs, json.RawMessage(m))
+		}
+	}
+	return msgs, nil
+}
+
+func (s *redisSessions) AppendSession(ctx context.Context, key string, msgs []json.RawMessage, _ time.Time) error {
+	k := s.c.key("session", key)
+	var cmds [][]string
+	if len(msgs) > 0 {
+		push := []string{"RPUSH", k}
+		for _, m := range msgs {
+			push = append(push, string(m))
+		}
+		cmds = append(cmds, push)
+	}
+	cmds = append(cmds, []string{"PEXPIRE", k, strconv.FormatInt(s.ttl.Milliseconds(), 10)})
+	replies, err := s.c.pipeline(ctx, cmds...)
+	if err != nil {
+		return err
+	}
+	return firstError(replies)
+}
+
+func (s *redisSessions) DeleteSession(ctx context.Context, key string) (bool, error) {
+	v, err := s.c.do(ctx, "DEL", s.c.key("session", key))
+	n, _ := v.(int64)
+	return n > 0, err
+}
+
+func (s *redisSessions) PruneSessions(context.Context, time.Time) (int64, error) { return 0, nil }
+
+// redisResponses keeps idempotent answers in Redis until their TTL, and
+// claims keys there so replicas don't answer the same key at once.
+type redisResponses struct {
+	c   *redisClient
+	ttl time.Duration
+}
+
+func (s *redisResponses) LoadResponse(ctx context.Context, key string) (*StoredResponse, error) {
+	v, err := s.c.do(ctx, "GET", s.c.key("idempotency", key))
+	b, ok := v.(string)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var sr StoredResponse
+	if err := json.Unmarshal([]byte(b), &sr); err != nil {
+		return nil, err
+	}
+	return &sr, nil
+}
+
+func (s *redisResponses) SaveResponse(ctx context.Context, key string, resp StoredResponse) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.do(ctx, "SET", s.c.key("idempotency", key), string(b), "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s *redisResponses) PruneResponses(context.Context, time.Time) (int64, error) { return 0, nil }
+
+// claimKey marks key as being answered by this replica for at most ttl,
+// reporting false if another replica already is.
+func (s *redisResponses) claimKey(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	v, err := s.c.do(ctx, "SET", s.c.key("idempotency-running", key), "1", "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return v == "OK", err
+}
+
+func (s *redisResponses) releaseKey(ctx context.Context, key string) error {
+	_, err := s.c.do(ctx, "DEL", s.c.key("idempotency-running", key))
+	return err
+}
+
+// redisUsage counts each client's usage by UTC day in Redis hashes, for
+// quotas to be checked against every replica's usage. When Redis can't be
+// reached, local answers instead.
+type redisUsage struct {
+	c     *redisClient
+	local clientUsage
+}
+
+// usageDays is how long daily counts are kept: long enough for any month.
+const usageDays = 62
+
+func (s *redisUsage) dayKey(client string, day time.Time) string {
+	return s.c.key("usage", client, day.Format("2006-01-02"))
+}
+
+// Record adds one request to client's count for the day of at.
+func (s *redisUsage) Record(ctx context.Context, at time.Time, client string, status int, u Usage, cost float64) {
+	k := s.dayKey(client, at.UTC())
+	errs := "0"
+	if status >= 400 {
+		errs = "1"
+	}
+	_, err := s.c.pipeline(ctx,
+		[]string{"HINCRBY", k, "requests", "1"},
+		[]string{"HINCRBY", k, "errors", errs},
+		[]string{"HINCRBY", k, "prompt", strconv.FormatInt(u.PromptTokens, 10)},
+		[]string{"HINCRBY", k, "completion", strconv.FormatInt(u.CompletionTokens, 10)},
+		[]string{"HINCRBY", k, "cached", strconv.FormatInt(u.CachedTokens, 10)},
+		[]string{"HINCRBY", k, "cache_write", strconv.FormatInt(u.CacheWriteTokens, 10)},
+		[]string{"HINCRBYFLOAT", k, "cost", strconv.FormatFloat(cost, 'f', -1, 64)},
+		[]string{"EXPIRE", k, strconv.Itoa(usageDays * 24 * 3600)})
+	if err != nil {
+		log.Printf("Error recording shared usage: %v", err)
+	}
+}
+
+// ClientUsageSince sums client's days from the one holding since.
+func (s *redisUsage) ClientUsageSince(ctx context.Context, client string, since time.Time) (UsageTotals, error) {
+	var cmds [][]string
+	now := time.Now().UTC()
+	since = since.UTC()
+	for d := time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC); !d.After(now) && len(cmds) < usageDays; d = d.AddDate(0, 0, 1) {
+		cmds = append(cmds, []string{"HMGET", s.dayKey(client, d), "requests", "errors", "prompt", "completion", "cached", "cost", "cache_write"})
+	}
+	var sum UsageTotals
+	if len(cmds) == 0 {
+		return sum, nil
+	}
+	replies, err := s.c.pipeline(ctx, cmds...)
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		log.Printf("Error reading shared usage, using this replica's: %v", err)
+		return s.local.ClientUsageSince(ctx, client, since)
+	}
+	for _, r := range replies {
+		f, _ := r.([]any)
+		if len(f) != 7 {
+			continue
+		}
+		n := func(i int) int64 {
+			s, _ := f[i].(string)
+			v, _ := strconv.ParseInt(s, 10, 64)
+			return v
+		}
+		cost, _ := f[5].(string)
+		c, _ := strconv.ParseFloat(cost, 64)
+		sum.merge(&UsageTotals{Requests: n(0), Errors: n(1), PromptTokens: n(2), CompletionTokens: n(3), CachedTokens: n(4),
+			CacheWriteTokens: n(6), CostUSD: c})
+	}
+	return sum, nil
+}
+
+// countMinute counts one more request named by name in the given unix
+// minute and returns the count.
+func (c *redisClient) countMinute(name string, minute int64) (int64, error) {
+	k := c.key("rate", name, strconv.FormatInt(minute, 10))
+	replies, err := c.pipeline(context.Background(), []string{"INCR", k}, []string{"EXPIRE", k, "120"})
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, _ := replies[0].(int64)
+	return n, nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlMigrations are applied in order and recorded in schema_migrations.
+// Append new steps; never edit a released one. The DDL sticks to types both
+// SQLite and PostgreSQL accept.
+var sqlMigrations = []string{
+	`CREATE TABLE usage_records (
+		id                TEXT PRIMARY KEY,
+		ts                BIGINT NOT NULL,
+		hour              BIGINT NOT NULL,
+		client            TEXT NOT NULL,
+		model             TEXT NOT NULL,
+		provider          TEXT NOT NULL,
+		status            INTEGER NOT NULL,
+		duration_ms       BIGINT NOT NULL,
+		prompt_tokens     BIGINT NOT NULL,
+		completion_tokens BIGINT NOT NULL,
+		cached_tokens     BIGINT NOT NULL,
+		cost_usd          DOUBLE PRECISION NOT NULL
+	)`,
+	`CREATE INDEX usage_records_hour ON usage_records (hour)`,
+	`CREATE INDEX usage_records_client_ts ON usage_records (client, ts)`,
+	`CREATE TABLE virtual_keys (
+		id         TEXT PRIMARY KEY,
+		client     TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		created_at BIGINT NOT NULL,
+		revoked_at BIGINT
+	)`,
+	`CREATE TABLE quotas (
+		client           TEXT PRIMARY KEY,
+		daily_tokens     BIGINT NOT NULL,
+		daily_cost_usd   DOUBLE PRECISION NOT NULL,
+		monthly_tokens   BIGINT NOT NULL,
+		monthly_cost_usd DOUBLE PRECISION NOT NULL
+	)`,
+	`ALTER TABLE usage_records ADD COLUMN project TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE session_messages (
+		session TEXT NOT NULL,
+		seq     BIGINT NOT NULL,
+		ts      BIGINT NOT NULL,
+		message TEXT NOT NULL,
+		PRIMARY KEY (session, seq)
+	)`,
+	`CREATE TABLE idempotent_responses (
+		id       TEXT PRIMARY KEY,
+		ts       BIGINT NOT NULL,
+		response TEXT NOT NULL
+	)`,
+	`ALTER TABLE usage_records ADD COLUMN cache_write_tokens BIGINT NOT NULL DEFAULT 0`,
+}
+
+// sqlStore implements Store on database/sql, with the drivers drivers.go
+// links in.
+type sqlStore struct {
+	db *sql.DB
+	// numbered rewrites "?" placeholders to PostgreSQL's "$1" form.
+	numbered bool
+}
+
+// q adapts a query written with "?" placeholders to the dialect. A "?"
+// inside a quoted string or identifier is left as it is.
+func (s *sqlStore) q(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune // the quote of the span r is in, if any
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			// A doubled quote escapes one; it closes the span and reopens it.
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// key adapts a session or response key, which may join its parts with
+// NUL, to the dialect: PostgreSQL's text holds no NUL, so it becomes the
+// unit separator there.
+func (s *sqlStore) key(k string) string {
+	if !s.numbered {
+		return k
+	}
+	return strings.ReplaceAll(k, "\x00", "\x1f")
+}
+
+func openSQLStore(driver, dsn string) (*sqlStore, error) {
+	switch driver {
+	case "sqlite3":
+		driver = "sqlite"
+	case "postgres":
+		driver = "pgx"
+	}
+	if !slices.Contains(sql.Drivers(), driver) {
+		return nil, fmt.Errorf("storage driver %q is not linked into this build (have %v)", driver, sql.Drivers())
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		// SQLite serializes writers; a single connection avoids SQLITE_BUSY.
+		db.SetMaxOpenConns(1)
+	}
+	s := &sqlStore{db: db, numbered: driver == "pgx"}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return s, nil
+}
+
+func (s *sqlStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.q(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+			i+1, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) RecordUsage(ctx context.Context, rec UsageRecord) error {
+	_, err := s.db.ExecContext(ctx, s.q(`INSERT INTO usage_records
+		(id, ts, hour, client, project, model, provider, status, duration_ms,
+		 prompt_tokens, completion_tokens, cached_tokens, cache_write_tokens, cost_usd)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.ID, rec.Time.UnixMilli(), rec.Time.Unix()/3600, rec.Client, rec.Project, rec.Model, rec.Provider,
+		rec.Status, rec.Duration.Milliseconds(),
+		rec.PromptTokens, rec.CompletionTokens, rec.CachedTokens, rec.CacheWriteTokens, rec.CostUSD)
+	return err
+}
+
+func (s *sqlStore) ListUsage(ctx context.Context, from, to time.Time) ([]UsageRecord, error) {
+	rows, err := s.db.QueryContext(ctx, s.q(`SELECT id, ts, client, project, model, provider, status, duration_ms,
+		prompt_tokens, completion_tokens, cached_tokens, cache_write_tokens, cost_usd
+		FROM usage_records WHERE ts >= ? AND ts < ? ORDER BY ts, id`), from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recs []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		var ts, dur int64
+		if err := rows.Scan(&r.ID, &ts, &r.Client, &r.Project, &r.Model, &r.Provider, &r.Status, &dur,
+			&r.PromptTokens, &r.CompletionTokens, &r.CachedTokens, &r.CacheWriteTokens, &r.CostUSD); err != nil {
+			return nil, err
+		}
+		r.Time = time.UnixMilli(ts).UTC()
+		r.Duration = time.Duration(dur) * time.Millisecond
+		recs = append(recs, r)
+	}
+	return recs, rows.Err()
+}
+
+func (s *sqlStore) QueryUsage(ctx context.Context, q UsageQuery) ([]UsageBucket, error) {
+	// PostgreSQL sums BIGINT to NUMERIC; the casts keep scans portable.
+	rows, err := s.db.QueryContext(ctx, s.q(`SELECT hour, client, project, model, provider, COUNT(*),
+		CAST(SUM(CASE WHEN status >= 400 THEN 1 ELSE 0 END) AS BIGINT), CAST(SUM(prompt_tokens) AS BIGINT), CAST(SUM(completion_tokens) AS BIGINT),
+		CAST(SUM(cached_tokens) AS BIGINT), CAST(SUM(cache_write_tokens) AS BIGINT), SUM(cost_usd)
+		FROM usage_records WHERE hour >= ? AND hour < ?
+		GROUP BY hour, client, project, model, provider`),
+		q.From.Unix()/3600, (q.To.Unix()+3599)/3600)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hourly []hourlyUsage
+	for rows.Next() {
+		var h hourlyUsage
+		if err := rows.Scan(&h.Hour, &h.Client, &h.Project, &h.Model, &h.Provider, &h.Requests, &h.Errors,
+			&h.PromptTokens, &h.CompletionTokens, &h.CachedTokens, &h.CacheWriteTokens, &h.CostUSD); err != nil {
+			return nil, err
+		}
+		hourly = append(hourly, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groupUsage(hourly, q), nil
+}
+
+func (s *sqlStore) PruneUsage(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.q(`DELETE FROM usage_records WHERE ts < ?`), before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) ClientUsageSince(ctx context.Context, client string, since time.Time) (UsageTotals, error) {
+	var t UsageTotals
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT COUNT(*),
+		CAST(COALESCE(SUM(CASE WHEN status >= 400 THEN 1 ELSE 0 END), 0) AS BIGINT),
+		CAST(COALESCE(SUM(prompt_tokens), 0) AS BIGINT),
+		CAST(COALESCE(SUM(completion_tokens), 0) AS BIGINT), CAST(COALESCE(SUM(cached_tokens), 0) AS BIGINT),
+		CAST(COALESCE(SUM(cache_write_tokens), 0) AS BIGINT), COALESCE(SUM(cost_usd), 0)
+		FROM usage_records WHERE client = ? AND ts >= ?`), client, since.UnixMilli()).
+		Scan(&t.Requests, &t.Errors, &t.PromptTokens, &t.CompletionTokens, &t.CachedTokens, &t.CacheWriteTokens, &t.CostUSD)
+	return t, err
+}
+
+func (s *sqlStore) CreateKey(ctx context.Context, k VirtualKey) error {
+	_, err := s.db.ExecContext(ctx, s.q(`INSERT INTO virtual_keys (id, client, hash, created_at)
+		VALUES (?, ?, ?, ?)`), k.ID, k.Client, k.Hash, k.CreatedAt.Unix())
+	return err
+}
+
+func (s *sqlStore) ListKeys(ctx context.Context) ([]VirtualKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, client, hash, created_at, revoked_at
+		FROM virtual_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []VirtualKey
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) LookupKey(ctx context.Context, hash string) (*VirtualKey, error) {
+	row := s.db.QueryRowContext(ctx, s.q(`SELECT id, client, hash, created_at, revoked_at
+		FROM virtual_keys WHERE hash = ?`), hash)
+	k, err := scanKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return k, err
+}
+
+func scanKey(row interface{ Scan(...any) error }) (*VirtualKey, error) {
+	var k VirtualKey
+	var created int64
+	var revoked sql.NullInt64
+	if err := row.Scan(&k.ID, &k.Client, &k.Hash, &created, &revoked); err != nil {
+		return nil, err
+	}
+	k.CreatedAt = time.Unix(created, 0).UTC()
+	if revoked.Valid {
+		t := time.Unix(revoked.Int64, 0).UTC()
+		k.RevokedAt = &t
+	}
+	return &k, nil
+}
+
+func (s *sqlStore) RevokeKey(ctx context.Context, id string, at time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, s.q(`UPDATE virtual_keys SET revoked_at = ?
+		WHERE id = ? AND revoked_at IS NULL`), at.Unix(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) GetQuota(ctx context.Context, client string) (QuotaConfig, bool, error) {
+	var q QuotaConfig
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT daily_tokens, daily_cost_usd, monthly_tokens, monthly_cost_usd
+		FROM quotas WHERE client = ?`), client).
+		Scan(&q.DailyTokens, &q.DailyCostUSD, &q.MonthlyTokens, &q.MonthlyCostUSD)
+	if errors.Is(err, sql.ErrNoRows) {
+		return QuotaConfig{}, false, nil
+	}
+	return q, err == nil, err
+}
+
+func (s *sqlStore) SetQuota(ctx context.Context, client string, q QuotaConfig) error {
+	_, err := s.db.ExecContext(ctx, s.q(`INSERT INTO quotas
+		(client, daily_tokens, daily_cost_usd, monthly_tokens, monthly_cost_usd)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (client) DO UPDATE SET
+			daily_tokens = excluded.daily_tokens, daily_cost_usd = excluded.daily_cost_usd,
+			monthly_tokens = excluded.monthly_tokens, monthly_cost_usd = excluded.monthly_cost_usd`),
+		client, q.DailyTokens, q.DailyCostUSD, q.MonthlyTokens, q.MonthlyCostUSD)
+	return err
+}
+
+func (s *sqlStore) LoadSession(ctx context.Context, key string) ([]json.RawMessage, error) {
+	key = s.key(key)
+	rows, err := s.db.QueryContext(ctx, s.q(`SELECT message FROM session_messages WHERE session = ? ORDER BY seq`), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []json.RawMessage
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, json.RawMessage(m))
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlStore) AppendSession(ctx context.Context, key string, msgs []json.RawMessage, at time.Time) error {
+	key = s.key(key)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var next int64
+	if err := tx.QueryRowContext(ctx, s.q(`SELECT COALESCE(MAX(seq), 0) FROM session_messages WHERE session = ?`), key).
+		Scan(&next); err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		next++
+		if _, err := tx.ExecContext(ctx, s.q(`INSERT INTO session_messages (session, seq, ts, message) VALUES (?, ?, ?, ?)`),
+			key, next, at.UnixMilli(), string(m)); err != nil {
+			return err
+		}
+	}
+	// Every message carries the session's last write, which pruning uses.
+	if _, err := tx.ExecContext(ctx, s.q(`UPDATE session_messages SET ts = ? WHERE session = ?`), at.UnixMilli(), key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteSession(ctx context.Context, key string) (bool, error) {
+	key = s.key(key)
+	res, err := s.db.ExecContext(ctx, s.q(`DELETE FROM session_messages WHERE session = ?`), key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) PruneSessions(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.q(`DELETE FROM session_messages WHERE ts < ?`), before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) LoadResponse(ctx context.Context, key string) (*StoredResponse, error) {
+	key = s.key(key)
+	var b string
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT response FROM idempotent_responses WHERE id = ?`), key).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sr StoredResponse
+	if err := json.Unmarshal([]byte(b), &sr); err != nil {
+		return nil, err
+	}
+	return &sr, nil
+}
+
+func (s *sqlStore) SaveResponse(ctx context.Context, key string, resp StoredResponse) error {
+	key = s.key(key)
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.q(`INSERT INTO idempotent_responses (id, ts, response) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET ts = excluded.ts, response = excluded.response`),
+		key, resp.At.UnixMilli(), string(b))
+	return err
+}
+
+func (s *sqlStore) PruneResponses(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.q(`DELETE FROM idempotent_responses WHERE ts < ?`), before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
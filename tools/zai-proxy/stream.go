@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// streamStage rewrites the JSON payload of each server-sent event with the
+// route's stream_transforms as it passes, one line at a time, so a stream is
+// never buffered whole. Non-JSON data such as "[DONE]" and other SSE fields
+// pass through untouched.
+func streamStage(_ *proxy, rc *RouteConfig) (Middleware, error) {
+	rules := rc.StreamTransforms
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+		edit := func(doc map[string]any) (map[string]any, bool) {
+			changed, err := applyTransforms(doc, rules)
+			return doc, err == nil && changed
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			exchangeOf(r).inspect = true
+			sw := &sseWriter{ResponseWriter: w, line: eventEditor(edit)}
+			defer sw.finish()
+			next.ServeHTTP(sw, r)
+		})
+	}, nil
+}
+
+// sseWriter passes each line of an event-stream response through line,
+// and any other response through unchanged. end, if set, supplies output
+// for the end of the stream.
+type sseWriter struct {
+	http.ResponseWriter
+	line    func(line []byte) ([]byte, error)
+	end     func() []byte
+	decided bool
+	active  bool
+	partial []byte
+}
+
+func (w *sseWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decided = true
+		w.active = strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+		if w.active {
+			w.Header().Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.active {
+		return w.ResponseWriter.Write(b)
+	}
+	w.partial = append(w.partial, b...)
+	if len(w.partial) > maxObservedBody && bytes.IndexByte(w.partial, '\n') < 0 {
+		return 0, errLineTooLong
+	}
+	var out []byte
+	var lineErr error
+	for lineErr == nil {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		var l []byte
+		l, lineErr = w.line(w.partial[:i+1])
+		out = append(out, l...)
+		w.partial = w.partial[i+1:]
+	}
+	w.partial = bytes.Clone(w.partial)
+	if len(out) > 0 {
+		if _, err := w.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	if lineErr != nil {
+		return 0, lineErr
+	}
+	return len(b), nil
+}
+
+var errLineTooLong = errors.New("event stream line exceeds the proxy limit")
+
+// eventEditor adapts a JSON payload editor to an sseWriter line function.
+// edit returns the replacement payload and whether it changed; a nil
+// payload drops the data line.
+func eventEditor(edit func(map[string]any) (map[string]any, bool)) func([]byte) ([]byte, error) {
+	return func(line []byte) ([]byte, error) {
+		return rewriteEvent(line, edit), nil
+	}
+}
+
+// rewriteEvent transforms one complete line, keeping its line ending.
+func rewriteEvent(line []byte, edit func(map[string]any) (map[string]any, bool)) []byte {
+	body := bytes.TrimRight(line, "\r\n")
+	data, ok := bytes.CutPrefix(body, []byte("data:"))
+	if !ok {
+		return line
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return line
+	}
+	v, err := decodeJSON(data)
+	if err != nil {
+		return line
+	}
+	doc, ok := v.(map[string]any)
+	if !ok {
+		return line
+	}
+	doc, changed := edit(doc)
+	if !changed {
+		return line
+	}
+	if doc == nil {
+		return nil
+	}
+	enc, err := encodeJSON(doc)
+	if err != nil {
+		return line
+	}
+	out := append([]byte("data: "), enc...)
+	return append(out, line[len(body):]...)
+}
+
+// finish writes a trailing line that was never terminated, then the end
+// of stream output.
+func (w *sseWriter) finish() {
+	if !w.active {
+		return
+	}
+	var out []byte
+	if len(w.partial) > 0 {
+		out, _ = w.line(w.partial)
+		w.partial = nil
+	}
+	if w.end != nil {
+		out = append(out, w.end()...)
+	}
+	if len(out) > 0 {
+		w.ResponseWriter.Write(out)
+	}
+}
+
+func (w *sseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *sseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bufferedWriter holds back a JSON response so edit can rewrite it whole,
+// including its status. Other responses, and bodies that outgrow
+// maxObservedBody, pass straight through.
+type bufferedWriter struct {
+	http.ResponseWriter
+	edit    func(status int, body []byte) (int, []byte)
+	status  int
+	decided bool
+	active  bool
+	buf     bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.decided {
+		return
+	}
+	w.decided, w.status = true, code
+	ct := w.Header().Get("Content-Type")
+	w.active = strings.HasPrefix(ct, "application/json")
+	if !w.active {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.active {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.buf.Len()+len(b) > maxObservedBody {
+		w.active = false
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// finish sends the buffered response after passing it through edit.
+func (w *bufferedWriter) finish() {
+	if !w.active {
+		return
+	}
+	w.active = false
+	status, body := w.edit(w.status, w.buf.Bytes())
+	w.Header().Del("Content-Length")
+	holdTrailers(w.Header())
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(body)
+}
+
+func (w *bufferedWriter) Flush() {
+	if w.active {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *bufferedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// SystemPrompt is an operator prompt injected into chat requests so
+// guardrails don't depend on every client sending them. Clients and Models
+// restrict it (empty matches all; models may end in "*"). Mode "prepend"
+// adds it as its own leading system message; "merge" folds it into the
+// client's first system message, adding one if there is none.
+type SystemPrompt struct {
+	Clients []string `json:"clients,omitempty"`
+	Models  []string `json:"models,omitempty"`
+	Text    string   `json:"text"`
+	Mode    string   `json:"mode,omitempty"`
+}
+
+func (s *SystemPrompt) validate() error {
+	if s.Text == "" {
+		return fmt.Errorf("text is required")
+	}
+	if s.Mode != "" && s.Mode != "prepend" && s.Mode != "merge" {
+		return fmt.Errorf("unknown mode %q (want prepend or merge)", s.Mode)
+	}
+	return nil
+}
+
+func (s *SystemPrompt) applies(client, model string) bool {
+	return (len(s.Clients) == 0 || slices.Contains(s.Clients, client)) &&
+		(len(s.Models) == 0 || matchModel(s.Models, model))
+}
+
+// injectSystemPrompts applies every matching prompt to doc, in config order
+// so the first listed ends up outermost. anthropic selects the Messages API
+// shape, where the system prompt is a top-level field.
+func injectSystemPrompts(doc map[string]any, anthropic bool, client, model string, prompts []SystemPrompt) bool {
+	changed := false
+	for i := len(prompts) - 1; i >= 0; i-- {
+		p := &prompts[i]
+		if !p.applies(client, model) {
+			continue
+		}
+		if anthropic {
+			doc["system"] = prependText(doc["system"], p.Text)
+		} else {
+			doc["messages"] = injectSystemMessage(doc["messages"], p.Text, p.Mode == "merge")
+		}
+		changed = true
+	}
+	return changed
+}
+
+func injectSystemMessage(messages any, text string, merge bool) any {
+	msgs, _ := messages.([]any)
+	if merge && len(msgs) > 0 {
+		if m, ok := msgs[0].(map[string]any); ok && m["role"] == "system" {
+			m["content"] = prependText(m["content"], text)
+			return msgs
+		}
+	}
+	sys := map[string]any{"role": "system", "content": text}
+	return append([]any{sys}, msgs...)
+}
+
+// prependText puts text before content, which is a string or a list of
+// content blocks.
+func prependText(content any, text string) any {
+	switch c := content.(type) {
+	case string:
+		if c == "" {
+			return text
+		}
+		return text + "\n\n" + c
+	case []any:
+		return append([]any{map[string]any{"type": "text", "text": text}}, c...)
+	}
+	return text
+}
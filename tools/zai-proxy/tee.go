@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// responseSink receives a copy of a response on its way to the client:
+// usage parsing, debug and capture bodies. Write is given the bytes the
+// client was sent and must neither keep nor block on them.
+type responseSink interface {
+	begin(status int, h http.Header)
+	Write(b []byte) (int, error)
+}
+
+// sinkWriter writes a response to the client and then hands the same
+// slice to each sink, so tapping a stream adds no copy of it. Sinks get it
+// whole even if the client didn't, so a stream run on without its client
+// is still accounted. Stages tee
+// with teeTo, which joins a sinkWriter directly beneath instead of
+// stacking another.
+type sinkWriter struct {
+	http.ResponseWriter
+	sinks  []responseSink
+	status int
+}
+
+func teeTo(w http.ResponseWriter, s responseSink) http.ResponseWriter {
+	if sw, ok := w.(*sinkWriter); ok && sw.status == 0 {
+		sw.sinks = append(sw.sinks, s)
+		return sw
+	}
+	return &sinkWriter{ResponseWriter: w, sinks: []responseSink{s}}
+}
+
+func (w *sinkWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		for _, s := range w.sinks {
+			s.begin(code, w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sinkWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	for _, s := range w.sinks {
+		s.Write(b)
+	}
+	return n, err
+}
+
+func (w *sinkWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *sinkWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bodySink keeps the status and the first limit bytes of a response.
+type bodySink struct {
+	limit     int
+	status    int
+	body      []byte
+	truncated bool
+}
+
+func (s *bodySink) begin(status int, _ http.Header) { s.status = status }
+
+func (s *bodySink) Write(b []byte) (int, error) {
+	if room := s.limit - len(s.body); room < len(b) {
+		s.body = append(s.body, b[:max(room, 0)]...)
+		s.truncated = true
+	} else {
+		s.body = append(s.body, b...)
+	}
+	return len(b), nil
+}
+
+// usageSink feeds a response to a usage observer for its content type.
+type usageSink struct {
+	status   int
+	observer *usageObserver
+}
+
+func (s *usageSink) begin(status int, h http.Header) {
+	s.status, s.observer = status, newUsageObserver(h.Get("Content-Type"))
+}
+
+func (s *usageSink) Write(b []byte) (int, error) {
+	return s.observer.Write(b)
+}
+
+// holdTrailers readies a header that is only being sent after the body
+// was written, by which point the trailers it announces are set among its
+// fields: their values move to TrailerPrefix keys, so net/http sends them
+// after the body rather than as headers.
+func holdTrailers(h http.Header) {
+	for _, v := range h.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vs, ok := h[k]; ok && k != "" {
+				h[http.TrailerPrefix+k] = vs
+				delete(h, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemplateVersion is one version of a named prompt template, kept so the
+// prompts many agents share are edited, and rolled back, in one place.
+// A request naming it in a "template" field, with variables, has its
+// Messages rendered from them and put before its own; on the messages API
+// a system message goes to system instead. Required variables must be
+// given; Defaults fill in those that aren't. Model is used when the
+// request names none. Versions are numbered from 1, by their position in
+// the config when not set, and the admin API adds the next.
+type TemplateVersion struct {
+	Version  int               `json:"version"`
+	Model    string            `json:"model,omitempty"`
+	Messages []TemplateMessage `json:"messages"`
+	Required []string          `json:"required,omitempty"`
+	Defaults map[string]any    `json:"defaults,omitempty"`
+}
+
+// TemplateMessage is a message of a template; its content may use the
+// variables, client and project.
+type TemplateMessage struct {
+	Role    string         `json:"role"`
+	Content promptTemplate `json:"content"`
+}
+
+func (t *TemplateVersion) validate() error {
+	if len(t.Messages) == 0 {
+		return fmt.Errorf("needs messages")
+	}
+	for i, m := range t.Messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return fmt.Errorf("messages[%d]: role must be system, user or assistant", i)
+		}
+		if m.Content.empty() {
+			return fmt.Errorf("messages[%d]: needs content", i)
+		}
+	}
+	return nil
+}
+
+func validateTemplates(templates map[string][]TemplateVersion) error {
+	for name, versions := range templates {
+		seen := map[int]bool{}
+		for i := range versions {
+			v := &versions[i]
+			if v.Version == 0 {
+				v.Version = i + 1
+			}
+			if v.Version < 0 || seen[v.Version] {
+				return fmt.Errorf("templates: %s: version %d is negative or repeated", name, v.Version)
+			}
+			seen[v.Version] = true
+			if err := v.validate(); err != nil {
+				return fmt.Errorf("templates: %s: version %d: %w", name, v.Version, err)
+			}
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	return nil
+}
+
+// templateRef is a request's "template" field.
+type templateRef struct {
+	Name      string         `json:"name"`
+	Version   int            `json:"version,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+}
+
+// templateChange is a journaled template edit: a new version, or with a
+// nil Version the template's removal.
+type templateChange struct {
+	Name    string           `json:"name"`
+	Version *TemplateVersion `json:"version,omitempty"`
+}
+
+var templateExpansions = metrics.counter("zai_proxy_template_expansions_total",
+	"Requests expanded from a stored prompt template.", "template")
+
+// promptTemplates holds the templates from the config and the admin API's
+// edits.
+type promptTemplates struct {
+	mu        sync.RWMutex
+	templates map[string][]TemplateVersion
+	journal   *journal
+}
+
+func newPromptTemplates(cfg map[string][]TemplateVersion, j *journal) *promptTemplates {
+	templates := make(map[string][]TemplateVersion, len(cfg))
+	for name, versions := range cfg {
+		templates[name] = slices.Clone(versions)
+	}
+	return &promptTemplates{templates: templates, journal: j}
+}
+
+// get returns a template's version, or its latest when version is 0.
+func (pt *promptTemplates) get(name string, version int) (TemplateVersion, bool) {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	versions := pt.templates[name]
+	if len(versions) == 0 {
+		return TemplateVersion{}, false
+	}
+	if version == 0 {
+		return versions[len(versions)-1], true
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return TemplateVersion{}, false
+}
+
+func (pt *promptTemplates) list() map[string][]TemplateVersion {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	return maps.Clone(pt.templates)
+}
+
+// add stores v as the template's next version, which it returns.
+func (pt *promptTemplates) add(name string, v TemplateVersion) (TemplateVersion, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	v.Version = 1
+	if versions := pt.templates[name]; len(versions) > 0 {
+		v.Version = versions[len(versions)-1].Version + 1
+	}
+	e := journalEntry{Time: time.Now().UTC(), Op: "template", Template: &templateChange{Name: name, Version: &v}}
+	if err := pt.journal.append(e); err != nil {
+		return TemplateVersion{}, err
+	}
+	pt.apply(e)
+	return v, nil
+}
+
+// remove deletes a template with all its versions.
+func (pt *promptTemplates) remove(name string) error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	e := journalEntry{Time: time.Now().UTC(), Op: "template", Template: &templateChange{Name: name}}
+	if err := pt.journal.append(e); err != nil {
+		return err
+	}
+	pt.apply(e)
+	return nil
+}
+
+// apply makes a journaled template edit; other entries are ignored.
+func (pt *promptTemplates) apply(e journalEntry) {
+	if e.Op == "restore" && e.Restore != nil {
+		pt.templates = make(map[string][]TemplateVersion, len(e.Restore.Snapshot.Templates))
+		for name, versions := range e.Restore.Snapshot.Templates {
+			pt.templates[name] = slices.Clone(versions)
+		}
+		return
+	}
+	if e.Op != "template" || e.Template == nil {
+		return
+	}
+	if e.Template.Version == nil {
+		delete(pt.templates, e.Template.Name)
+		return
+	}
+	// A new slice, so lists handed out earlier don't change.
+	versions := slices.Clone(pt.templates[e.Template.Name])
+	pt.templates[e.Template.Name] = append(versions, *e.Template.Version)
+}
+
+// expand renders a reference's template for client and project.
+func (pt *promptTemplates) expand(ref templateRef, client, project string) (TemplateVersion, []map[string]any, error) {
+	if ref.Name == "" {
+		return TemplateVersion{}, nil, &schemaError{Param: "template.name", Msg: "is required"}
+	}
+	t, ok := pt.get(ref.Name, ref.Version)
+	if !ok {
+		if ref.Version != 0 {
+			return TemplateVersion{}, nil, &schemaError{Param: "template.version", Msg: fmt.Sprintf("template %s has no version %d", ref.Name, ref.Version)}
+		}
+		return TemplateVersion{}, nil, &schemaError{Param: "template.name", Msg: "no template named " + ref.Name}
+	}
+	env := map[string]any{"client": client, "project": project}
+	maps.Copy(env, t.Defaults)
+	maps.Copy(env, ref.Variables)
+	for _, name := range t.Required {
+		if _, ok := env[name]; !ok {
+			return TemplateVersion{}, nil, &schemaError{Param: "template.variables." + name, Msg: "is required"}
+		}
+	}
+	msgs := make([]map[string]any, len(t.Messages))
+	for i, m := range t.Messages {
+		text, err := m.Content.render(env)
+		if err != nil {
+			return TemplateVersion{}, nil, &schemaError{Param: "template", Msg: fmt.Sprintf("rendering message %d: %v", i, err)}
+		}
+		msgs[i] = map[string]any{"role": m.Role, "content": text}
+	}
+	return t, msgs, nil
+}
+
+// expandTemplate replaces the template a chat or messages request names
+// with its messages, and returns the name and version used, as
+// name/version; "" when it names none.
+func (pt *promptTemplates) expandTemplate(ex *exchange, anthropic bool) (string, error) {
+	raw, ok := ex.doc["template"]
+	if !ok {
+		return "", nil
+	}
+	var ref templateRef
+	b, _ := json.Marshal(raw)
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return "", &schemaError{Param: "template", Msg: "must be an object with a name: " + strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	t, msgs, err := pt.expand(ref, ex.client, ex.project)
+	if err != nil {
+		return "", err
+	}
+	have, _ := ex.doc["messages"].([]any)
+	var system []string
+	out := make([]any, 0, len(msgs)+len(have))
+	for _, m := range msgs {
+		if anthropic && m["role"] == "system" {
+			system = append(system, m["content"].(string))
+			continue
+		}
+		out = append(out, m)
+	}
+	if len(system) > 0 {
+		ex.doc["system"] = prependText(ex.doc["system"], strings.Join(system, "\n\n"))
+	}
+	ex.doc["messages"] = append(out, have...)
+	if _, ok := ex.doc["model"]; !ok && t.Model != "" {
+		ex.doc["model"] = t.Model
+	}
+	delete(ex.doc, "template")
+	ex.dirty = true
+	templateExpansions.Add(1, ref.Name)
+	return ref.Name + "/" + strconv.Itoa(t.Version), nil
+}
+
+// TemplateExpansion is what POST /v1/templates/{name}/expand answers: the
+// messages a request naming the template would start with.
+type TemplateExpansion struct {
+	Name     string           `json:"name"`
+	Version  int              `json:"version"`
+	Model    string           `json:"model,omitempty"`
+	Messages []map[string]any `json:"messages"`
+}
+
+// templatesHandler serves POST /v1/templates/{name}/expand, for callers
+// checking a template's output before using it. The body names the
+// version, 0 or none for the latest, and the variables.
+func templatesHandler(pt *promptTemplates, registry *clientRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ref templateRef
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&ref); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "body must be an object with variables: "+err.Error())
+			return
+		}
+		ref.Name = r.PathValue("name")
+		if _, ok := pt.get(ref.Name, 0); !ok {
+			writeError(w, http.StatusNotFound, "not_found", "no such template")
+			return
+		}
+		client := registry.Identify(r)
+		t, msgs, err := pt.expand(ref, client, r.Header.Get(projectHeader))
+		if err != nil {
+			writeSchemaError(w, err)
+			return
+		}
+		w.Header().Set("X-Ringmaster-Template", ref.Name+"/"+strconv.Itoa(t.Version))
+		writeJSON(w, http.StatusOK, TemplateExpansion{Name: ref.Name, Version: t.Version, Model: t.Model, Messages: msgs})
+	}
+}
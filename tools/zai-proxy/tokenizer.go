@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TokenizerConfig counts tokens for Models (which may end in "*") with the
+// BPE vocabulary in File, in tiktoken's format: one base64 token and its
+// rank per line. No vocabulary is bundled, GLM's included: models without
+// one fall back to estimateTextTokens, so the counts behind estimates,
+// context windows and /tokenize are approximate for them, as
+// zai_proxy_counted_tokens_total shows by tokenizer "estimate".
+type TokenizerConfig struct {
+	Models []string `json:"models"`
+	File   string   `json:"file"`
+}
+
+// Token is one vocabulary entry of tokenized text.
+type Token struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+// tokenizer counts, and if it is exact splits, text into model tokens.
+type tokenizer interface {
+	name() string
+	exact() bool
+	count(text string) int64
+	tokenize(text string) []Token
+}
+
+// modelTokenizers maps models to tokenizers; serve loads it from the
+// config so every token count in the process agrees.
+var modelTokenizers tokenizerSet
+
+type tokenizerSet []struct {
+	models []string
+	tok    tokenizer
+}
+
+func loadTokenizers(cfgs []TokenizerConfig) (tokenizerSet, error) {
+	var set tokenizerSet
+	for _, c := range cfgs {
+		tok, err := loadBPE(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer %s: %w", c.File, err)
+		}
+		set = append(set, struct {
+			models []string
+			tok    tokenizer
+		}{c.Models, tok})
+	}
+	return set, nil
+}
+
+func (s tokenizerSet) forModel(model string) tokenizer {
+	for _, t := range s {
+		if matchModel(t.models, model) {
+			return t.tok
+		}
+	}
+	return estimator{}
+}
+
+var countedTokens = metrics.counter("zai_proxy_counted_tokens_total",
+	"Tokens the proxy counted itself, by tokenizer; \"estimate\" ones are approximate.", "tokenizer")
+
+// countTokens counts text as model's tokenizer does.
+func countTokens(model, text string) int64 {
+	if text == "" {
+		return 0
+	}
+	tok := modelTokenizers.forModel(model)
+	n := tok.count(text)
+	countedTokens.Add(float64(n), tok.name())
+	return n
+}
+
+// estimator is the fallback for models without a vocabulary.
+type estimator struct{}
+
+func (estimator) name() string                 { return "estimate" }
+func (estimator) exact() bool                  { return false }
+func (estimator) count(text string) int64      { return estimateTextTokens(text) }
+func (estimator) tokenize(text string) []Token { return nil }
+
+// bpeTokenizer is a byte-level BPE tokenizer with cl100k-style
+// pre-tokenization.
+type bpeTokenizer struct {
+	vocab string
+	ranks map[string]int
+	byID  map[int]string
+}
+
+func loadBPE(path string) (*bpeTokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &bpeTokenizer{vocab: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		ranks: map[string]int{}, byID: map[int]string{}}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		tok, rank, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(tok)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t.ranks[string(b)], t.byID[id] = id, string(b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.ranks) == 0 {
+		return nil, fmt.Errorf("no tokens")
+	}
+	return t, nil
+}
+
+func (t *bpeTokenizer) name() string { return t.vocab }
+func (t *bpeTokenizer) exact() bool  { return true }
+
+func (t *bpeTokenizer) count(text string) int64 {
+	var n int64
+	for _, piece := range pretokenize(text) {
+		n += int64(len(t.encode(piece)))
+	}
+	return n
+}
+
+func (t *bpeTokenizer) tokenize(text string) []Token {
+	out := []Token{}
+	for _, piece := range pretokenize(text) {
+		for _, id := range t.encode(piece) {
+			out = append(out, Token{ID: id, Text: t.byID[id]})
+		}
+	}
+	return out
+}
+
+// encode merges the piece's bytes, lowest ranked pair first, as tiktoken
+// does. Bytes missing from the vocabulary are dropped.
+func (t *bpeTokenizer) encode(piece string) []int {
+	if id, ok := t.ranks[piece]; ok {
+		return []int{id}
+	}
+	parts := make([]string, len(piece))
+	for i := range parts {
+		parts[i] = piece[i : i+1]
+	}
+	for len(parts) > 1 {
+		best, at := -1, -1
+		for i := 0; i+1 < len(parts); i++ {
+			if r, ok := t.ranks[parts[i]+parts[i+1]]; ok && (best < 0 || r < best) {
+				best, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		parts[at] += parts[at+1]
+		parts = append(parts[:at+1], parts[at+2:]...)
+	}
+	ids := make([]int, 0, len(parts))
+	for _, p := range parts {
+		if id, ok := t.ranks[p]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func isLetter(r rune) bool { return unicode.IsLetter(r) }
+func isNumber(r rune) bool { return unicode.IsNumber(r) }
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
+
+// pretokenize splits text as cl100k's pattern does:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Go's regexp has no lookahead, so it is spelled out by hand.
+func pretokenize(s string) []string {
+	var out []string
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		n := pieceLen(rs[i:])
+		out = append(out, string(rs[i:i+n]))
+		i += n
+	}
+	return out
+}
+
+func pieceLen(rs []rune) int {
+	at := func(i int) rune {
+		if i < len(rs) {
+			return rs[i]
+		}
+		return utf8.RuneError
+	}
+	run := func(from int, ok func(rune) bool) int {
+		i := from
+		for i < len(rs) && ok(rs[i]) {
+			i++
+		}
+		return i
+	}
+	r := rs[0]
+	if r == '\'' {
+		for _, c := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if len(rs) > len(c) && strings.EqualFold(string(rs[1:1+len(c)]), c) {
+				return 1 + len(c)
+			}
+		}
+	}
+	if isLetter(r) {
+		return run(1, isLetter)
+	}
+	if !isNewline(r) && !isNumber(r) && isLetter(at(1)) {
+		return run(2, isLetter)
+	}
+	if isNumber(r) {
+		return min(run(1, isNumber), 3)
+	}
+	punct := func(r rune) bool { return !unicode.IsSpace(r) && !isLetter(r) && !isNumber(r) }
+	start := 0
+	if r == ' ' && punct(at(1)) {
+		start = 1
+	}
+	if punct(at(start)) {
+		return run(run(start, punct), isNewline)
+	}
+	// Whitespace: through its last newline if it has one, else all of it
+	// but the space before the next word.
+	end := run(0, unicode.IsSpace)
+	for i := end - 1; i >= 0; i-- {
+		if isNewline(rs[i]) {
+			return i + 1
+		}
+	}
+	if end < len(rs) && end > 1 {
+		return end - 1
+	}
+	return end
+}
+
+// TokenizeResult is the /tokenize response. Tokens is present when the
+// model's tokenizer is exact.
+type TokenizeResult struct {
+	Model     string  `json:"model"`
+	Tokenizer string  `json:"tokenizer"`
+	Exact     bool    `json:"exact"`
+	Count     int64   `json:"count"`
+	Tokens    []Token `json:"tokens,omitempty"`
+}
+
+// TokenizeRequest is the /tokenize body.
+type TokenizeRequest struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+}
+
+// CountTokensResult is the /count_tokens response: the prompt tokens of a
+// chat request, counted as the proxy counts them for quotas.
+type CountTokensResult struct {
+	Model       string `json:"model"`
+	Tokenizer   string `json:"tokenizer"`
+	Exact       bool   `json:"exact"`
+	InputTokens int64  `json:"input_tokens"`
+}
+
+func tokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req TokenizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "body must be JSON with model and text: "+err.Error())
+		return
+	}
+	tok := modelTokenizers.forModel(req.Model)
+	writeJSON(w, http.StatusOK, TokenizeResult{Model: req.Model, Tokenizer: tok.name(), Exact: tok.exact(),
+		Count: tok.count(req.Text), Tokens: tok.tokenize(req.Text)})
+}
+
+func countTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var req chatRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBufferedBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON chat request: "+err.Error())
+		return
+	}
+	tok := modelTokenizers.forModel(req.Model)
+	writeJSON(w, http.StatusOK, CountTokensResult{Model: req.Model, Tokenizer: tok.name(), Exact: tok.exact(),
+		InputTokens: estimatePromptTokens(&req)})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPretokenize splits text into the pieces cl100k's pattern matches,
+// as tiktoken does.
+func TestPretokenize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"tiktoken is great!", []string{"tiktoken", " is", " great", "!"}},
+		// contractions, in either case, and apostrophes that aren't
+		{"I'm here, they're not. DON'T", []string{"I", "'m", " here", ",", " they", "'re", " not", ".", " DON", "'T"}},
+		{"'llama 'hello", []string{"'ll", "ama", " '", "hello"}},
+		// digits, three at most to a piece
+		{"1234567", []string{"123", "456", "7"}},
+		{"3.14159", []string{"3", ".", "141", "59"}},
+		{"x1000y", []string{"x", "100", "0", "y"}},
+		{"٣٤٥٦", []string{"٣٤٥", "٦"}},
+		// whitespace: a space goes with the word after it, newlines end a run
+		{"a  b", []string{"a", " ", " b"}},
+		{"a   \n\n  b", []string{"a", "   \n\n", " ", " b"}},
+		{"a  12", []string{"a", " ", " ", "12"}},
+		{"end   ", []string{"end", "   "}},
+		{"x\ty", []string{"x", "\ty"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+		{"a b", []string{"a", " b"}},
+		// punctuation, with a space before and newlines after
+		{"ok.\n\nNext", []string{"ok", ".\n\n", "Next"}},
+		{" ...wait", []string{" ...", "wait"}},
+		{"!hello", []string{"!hello"}},
+		// non-ASCII
+		{"café au lait", []string{"café", " au", " lait"}},
+		{"cafe\u0301", []string{"cafe", "\u0301"}}, // a combining accent
+		{"日本語のテキスト", []string{"日本語のテキスト"}},
+		{"你好 世界", []string{"你好", " 世界"}},
+		{"€100", []string{"€", "100"}},
+		{"hi 🙂!", []string{"hi", " 🙂!"}},
+		{"", nil},
+	} {
+		if got := pretokenize(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("pretokenize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestBPEEncode merges a piece's bytes lowest ranked pair first, the
+// leftmost of equals, as tiktoken does.
+func TestBPEEncode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiny.tiktoken")
+	// a b c, then "bc" ranked before "ab", then "aa"
+	vocab := "YQ== 0\nYg== 1\nYw== 2\nYmM= 3\nYWI= 4\nYWE= 5\n"
+	if err := os.WriteFile(path, []byte(vocab), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := loadBPE(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.name() != "tiny" || !tok.exact() {
+		t.Errorf("name %q, exact %v", tok.name(), tok.exact())
+	}
+	for _, tc := range []struct {
+		in   string
+		want []int
+	}{
+		{"ab", []int{4}},
+		{"abc", []int{0, 3}}, // not ab c: bc ranks first
+		{"aaa", []int{5, 0}},
+		{"abz", []int{4}}, // z isn't in the vocabulary
+	} {
+		if got := tok.encode(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("encode(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+	if got := tok.tokenize("abc"); !reflect.DeepEqual(got, []Token{{0, "a"}, {3, "bc"}}) || tok.count("abc") != 2 {
+		t.Errorf("tokenize(abc) = %v, count %d", got, tok.count("abc"))
+	}
+	for _, bad := range []string{"", "not base64! 0\n", "YQ== zero\n"} {
+		os.WriteFile(path, []byte(bad), 0o600)
+		if _, err := loadBPE(path); err == nil {
+			t.Errorf("loadBPE accepted %q", bad)
+		}
+	}
+}
+
+// TestCL100K compares counts and tokens with tiktoken's for cl100k_base,
+// given its vocabulary (cl100k_base.tiktoken, as tiktoken downloads it):
+//
+//	ZAI_PROXY_TEST_CL100K=/path/to/cl100k_base.tiktoken go test -run CL100K ./...
+func TestCL100K(t *testing.T) {
+	path := os.Getenv("ZAI_PROXY_TEST_CL100K")
+	if path == "" {
+		t.Skip("set ZAI_PROXY_TEST_CL100K to cl100k_base.tiktoken to run")
+	}
+	tok, err := loadBPE(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		in  string
+		ids []int
+	}{
+		{"tiktoken is great!", []int{83, 1609, 5963, 374, 2294, 0}},
+		{"hello world", []int{15339, 1917}},
+		{"Hello world", []int{9906, 1917}},
+		{"!", []int{0}},
+	} {
+		var ids []int
+		for _, tk := range tok.tokenize(tc.in) {
+			ids = append(ids, tk.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("tokenize(%q) = %v, want %v", tc.in, ids, tc.ids)
+		}
+	}
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"1234567", 3},
+		{"I'm", 2},
+		{"they're", 2},
+		{"hello   world", 3},
+	} {
+		if got := tok.count(tc.in); got != tc.want {
+			t.Errorf("count(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+	// Every byte is in the vocabulary, so tokens spell the text out.
+	for _, in := range []string{"café au lait", "日本語のテキスト", "hi 🙂!", "cafe\u0301\n\n  x"} {
+		toks := tok.tokenize(in)
+		var b strings.Builder
+		for _, tk := range toks {
+			b.WriteString(tk.Text)
+		}
+		if b.String() != in || tok.count(in) != int64(len(toks)) {
+			t.Errorf("tokenize(%q) spells %q in %d tokens, counted %d", in, b.String(), len(toks), tok.count(in))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// estimateTextTokens approximates a BPE token count without a vocabulary:
+// roughly four bytes of Latin text per token, one token per CJK character,
+// and one per punctuation run, which tracks cl100k-style tokenizers to
+// within a few percent on English prose and code.
+func estimateTextTokens(s string) int64 {
+	var tokens, latin float64
+	flush := func() {
+		if latin > 0 {
+			tokens += max(1, latin/4)
+			latin = 0
+		}
+	}
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+			unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens++
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			flush()
+			tokens += 0.5
+		default:
+			latin += float64(size)
+		}
+	}
+	flush()
+	return int64(tokens + 0.5)
+}
+
+// chatRequest is the subset of OpenAI- and Anthropic-style chat requests the
+// proxy inspects.
+type chatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []chatMessage   `json:"messages"`
+	System    json.RawMessage `json:"system"`
+	Tools     json.RawMessage `json:"tools"`
+	Prompt    json.RawMessage `json:"prompt"`
+	Input     json.RawMessage `json:"input"`
+	MaxTokens int64           `json:"max_tokens"`
+	Stream    bool            `json:"stream"`
+}
+
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// perMessageTokens is the framing overhead chat formats add per message.
+const perMessageTokens = 4
+
+// contentText flattens a content value that is either a string or a list of
+// parts with text fields.
+func contentText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) == nil {
+		var out string
+		for _, p := range parts {
+			out += p.Text
+		}
+		return out
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		var out string
+		for _, p := range list {
+			out += p + "\n"
+		}
+		return out
+	}
+	return ""
+}
+
+// estimatePromptTokens counts the prompt side of a chat, completion or
+// embeddings request with the model's tokenizer.
+func estimatePromptTokens(req *chatRequest) int64 {
+	var n int64
+	for _, m := range req.Messages {
+		n += perMessageTokens + countTokens(req.Model, m.Role) + countTokens(req.Model, contentText(m.Content))
+	}
+	if len(req.Messages) > 0 {
+		n += 3 // assistant reply priming
+	}
+	if t := contentText(req.System); t != "" {
+		n += perMessageTokens + countTokens(req.Model, t)
+	}
+	if len(req.Tools) > 0 {
+		n += countTokens(req.Model, string(req.Tools))
+	}
+	n += countTokens(req.Model, contentText(req.Prompt))
+	n += countTokens(req.Model, contentText(req.Input))
+	return n
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ToolsConfig runs tool calls for clients that don't. When an unstreamed
+// chat answer asks only for tools registered here, and the caller may use
+// all of them, the proxy POSTs each call to its tool's URL, appends the
+// results to the conversation and asks again, up to MaxRounds (default 5)
+// times; the caller gets the final answer. Answers naming any other tool
+// go back to the caller as they are. With Inject, the definitions of the
+// tools a caller may use are added to its requests.
+type ToolsConfig struct {
+	MaxRounds int            `json:"max_rounds,omitempty"`
+	Inject    bool           `json:"inject,omitempty"`
+	Tools     []ToolEndpoint `json:"tools,omitempty"`
+}
+
+// ToolEndpoint is a tool served over HTTP. It receives a ToolCall and its
+// response body, up to 64KB, is the result. Clients restrict who may use it
+// (empty allows every client); Timeout defaults to 10s.
+type ToolEndpoint struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Parameters  json.RawMessage   `json:"parameters,omitempty"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Timeout     Duration          `json:"timeout,omitempty"`
+	Clients     []string          `json:"clients,omitempty"`
+}
+
+const maxToolResult = 64 << 10
+
+func (c *ToolsConfig) validate() error {
+	seen := map[string]bool{}
+	for _, t := range c.Tools {
+		if t.Name == "" || t.URL == "" {
+			return fmt.Errorf("tools: every tool needs a name and url")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tools: %s is defined twice", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Parameters) > 0 && !json.Valid(t.Parameters) {
+			return fmt.Errorf("tools: %s: parameters must be a JSON schema", t.Name)
+		}
+	}
+	if c.MaxRounds < 0 {
+		return fmt.Errorf("tools: max_rounds must not be negative")
+	}
+	return nil
+}
+
+// allowed returns the tools client may use, by name.
+func (c *ToolsConfig) allowed(client string) map[string]*ToolEndpoint {
+	out := map[string]*ToolEndpoint{}
+	for i := range c.Tools {
+		t := &c.Tools[i]
+		if len(t.Clients) == 0 || slices.Contains(t.Clients, client) {
+			out[t.Name] = t
+		}
+	}
+	return out
+}
+
+// ToolCall is what a tool endpoint receives.
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments any    `json:"arguments"`
+	Client    string `json:"client"`
+	RequestID string `json:"request_id"`
+}
+
+type pendingCall struct {
+	id, name string
+	args     any
+	result   string
+	failed   bool
+}
+
+var toolCalls = metrics.counter("zai_proxy_tool_calls_total", "Tool calls run by the proxy, by tool and outcome.", "tool", "outcome")
+
+// toolsStage runs the tool loop inside the stages that edit the request
+// once, so each round only repeats the forwarding.
+func toolsStage(p *proxy, _ *RouteConfig) (Middleware, error) {
+	tc := &p.cfg.Tools
+	rounds := cmp.Or(tc.MaxRounds, 5)
+	return func(next http.Handler) http.Handler {
+		if len(tc.Tools) == 0 {
+			return next
+		}
+		client := &http.Client{}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ex := exchangeOf(r)
+			anthropic := strings.HasSuffix(r.URL.Path, "/messages")
+			msgs, ok := ex.doc["messages"].([]any)
+			tools := tc.allowed(ex.client)
+			if stream, _ := ex.doc["stream"].(bool); !ok || stream || len(tools) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if tc.Inject {
+				injectTools(ex.doc, tools, anthropic)
+				ex.dirty = true
+			}
+			ex.inspect = true
+			for round := 0; ; round++ {
+				held := &heldResponse{w: w, h: http.Header{}}
+				next.ServeHTTP(held, r)
+				var calls []*pendingCall
+				var reply any
+				if !held.sent && held.status < 300 && round < rounds {
+					calls, reply = toolCallsOf(held.body.Bytes(), anthropic, tools)
+				}
+				if len(calls) == 0 {
+					if round > 0 {
+						held.h.Set("X-Ringmaster-Tool-Rounds", strconv.Itoa(round))
+					}
+					held.sendTo(w)
+					return
+				}
+				o := newUsageObserver(held.h.Get("Content-Type"))
+				o.Write(held.body.Bytes())
+				_, u, _ := o.Finish()
+				p.record(ex, held.status, ex.model, u)
+
+				var wg sync.WaitGroup
+				for _, c := range calls {
+					wg.Add(1)
+					go func(c *pendingCall) {
+						defer wg.Done()
+						runTool(r.Context(), client, tools[c.name], c, ex)
+					}(c)
+				}
+				wg.Wait()
+				msgs = append(msgs, toolResults(reply, calls, anthropic)...)
+				ex.doc["messages"], ex.dirty = msgs, true
+				debugf("Request %s ran %d tool calls in round %d", ex.id, len(calls), round+1)
+			}
+		})
+	}, nil
+}
+
+// injectTools adds the definitions of tools the request doesn't already
+// offer.
+func injectTools(doc map[string]any, tools map[string]*ToolEndpoint, anthropic bool) {
+	list, _ := doc["tools"].([]any)
+	have := map[string]bool{}
+	for _, t := range list {
+		m, _ := t.(map[string]any)
+		if f, ok := m["function"].(map[string]any); ok {
+			m = f
+		}
+		if name, ok := m["name"].(string); ok {
+			have[name] = true
+		}
+	}
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if have[name] {
+			continue
+		}
+		t := tools[name]
+		schema := any(map[string]any{"type": "object", "properties": map[string]any{}})
+		if len(t.Parameters) > 0 {
+			schema, _ = decodeJSON(t.Parameters)
+		}
+		if anthropic {
+			list = append(list, map[string]any{"name": name, "description": t.Description, "input_schema": schema})
+		} else {
+			list = append(list, map[string]any{"type": "function", "function": map[string]any{
+				"name": name, "description": t.Description, "parameters": schema}})
+		}
+	}
+	doc["tools"] = list
+}
+
+// toolCallsOf returns an answer's tool calls and the assistant message
+// that made them, or none unless every call is to one of tools.
+func toolCallsOf(body []byte, anthropic bool, tools map[string]*ToolEndpoint) ([]*pendingCall, any) {
+	v, err := decodeJSON(body)
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return nil, nil
+	}
+	var calls []*pendingCall
+	var reply any
+	if anthropic {
+		blocks, _ := doc["content"].([]any)
+		for _, b := range blocks {
+			m, _ := b.(map[string]any)
+			if m["type"] == "tool_use" {
+				id, _ := m["id"].(string)
+				name, _ := m["name"].(string)
+				calls = append(calls, &pendingCall{id: id, name: name, args: m["input"]})
+			}
+		}
+		reply = map[string]any{"role": "assistant", "content": blocks}
+	} else {
+		choices, _ := doc["choices"].([]any)
+		if len(choices) == 0 {
+			return nil, nil
+		}
+		c, _ := choices[0].(map[string]any)
+		msg, _ := c["message"].(map[string]any)
+		list, _ := msg["tool_calls"].([]any)
+		for _, tc := range list {
+			m, _ := tc.(map[string]any)
+			f, _ := m["function"].(map[string]any)
+			id, _ := m["id"].(string)
+			name, _ := f["name"].(string)
+			var args any
+			if s, ok := f["arguments"].(string); ok {
+				if args, err = decodeJSON([]byte(s)); err != nil {
+					args = s
+				}
+			}
+			calls = append(calls, &pendingCall{id: id, name: name, args: args})
+		}
+		reply = msg
+	}
+	for _, c := range calls {
+		if tools[c.name] == nil {
+			return nil, nil
+		}
+	}
+	return calls, reply
+}
+
+// runTool calls c's endpoint, leaving its result or error text in c.
+func runTool(ctx context.Context, client *http.Client, t *ToolEndpoint, c *pendingCall, ex *exchange) {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(time.Duration(t.Timeout), 10*time.Second))
+	defer cancel()
+	err := func() error {
+		body, err := json.Marshal(ToolCall{Name: c.name, Arguments: c.args, Client: ex.client, RequestID: ex.id})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range t.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxToolResult))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+		}
+		c.result = string(b)
+		return nil
+	}()
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
+		c.result, c.failed = "error: "+err.Error(), true
+		debugf("Tool %s failed for request %s: %v", c.name, ex.id, err)
+	}
+	toolCalls.Add(1, c.name, outcome)
+}
+
+// toolResults are the messages that answer calls: the assistant's turn
+// followed by one result per call.
+func toolResults(reply any, calls []*pendingCall, anthropic bool) []any {
+	out := []any{reply}
+	if anthropic {
+		blocks := make([]any, len(calls))
+		for i, c := range calls {
+			blocks[i] = map[string]any{"type": "tool_result", "tool_use_id": c.id, "content": c.result, "is_error": c.failed}
+		}
+		return append(out, map[string]any{"role": "user", "content": blocks})
+	}
+	for _, c := range calls {
+		out = append(out, map[string]any{"role": "tool", "tool_call_id": c.id, "content": c.result})
+	}
+	return out
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TransformRule edits a JSON document: a request body before it is
+// forwarded, or a streamed response event. Paths are JSON Pointers
+// (RFC 6901). Op is "set" (creating missing parents), "remove", "rename"
+// (move From to Path) or "redact", which replaces matches of the regular
+// expression Pattern in the string at Path with Value (default
+// "[REDACTED]"). The JSON Patch names "add", "replace" and "move" are
+// accepted as aliases. When limits the rule to documents whose pointers
+// hold the given values.
+type TransformRule struct {
+	Op      string                     `json:"op"`
+	Path    string                     `json:"path"`
+	From    string                     `json:"from,omitempty"`
+	Value   json.RawMessage            `json:"value,omitempty"`
+	Pattern string                     `json:"pattern,omitempty"`
+	When    map[string]json.RawMessage `json:"when,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (t *TransformRule) op() string {
+	switch t.Op {
+	case "add", "replace":
+		return "set"
+	case "move":
+		return "rename"
+	}
+	return t.Op
+}
+
+func (t *TransformRule) validate() error {
+	if _, err := pointerTokens(t.Path); err != nil {
+		return err
+	}
+	for p := range t.When {
+		if _, err := pointerTokens(p); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+	}
+	switch t.op() {
+	case "set":
+		if len(t.Value) == 0 {
+			return fmt.Errorf("set %s: value is required", t.Path)
+		}
+		if _, err := decodeJSON(t.Value); err != nil {
+			return fmt.Errorf("set %s: %w", t.Path, err)
+		}
+	case "remove":
+	case "rename":
+		if _, err := pointerTokens(t.From); err != nil {
+			return fmt.Errorf("rename: from: %w", err)
+		}
+	case "redact":
+		re, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return fmt.Errorf("redact %s: %w", t.Path, err)
+		}
+		if len(t.Value) > 0 {
+			var s string
+			if err := json.Unmarshal(t.Value, &s); err != nil {
+				return fmt.Errorf("redact %s: value must be a string", t.Path)
+			}
+		}
+		t.re = re
+	default:
+		return fmt.Errorf("unknown op %q (want set, remove, rename or redact)", t.Op)
+	}
+	return nil
+}
+
+// apply edits doc, reporting whether it changed.
+func (t *TransformRule) apply(doc map[string]any) (bool, error) {
+	for p, want := range t.When {
+		got, ok := getPointer(doc, mustTokens(p))
+		w, _ := decodeJSON(want)
+		if !ok || !jsonEqual(got, w) {
+			return false, nil
+		}
+	}
+	path := mustTokens(t.Path)
+	switch t.op() {
+	case "set":
+		v, _ := decodeJSON(t.Value)
+		if got, ok := getPointer(doc, path); ok && jsonEqual(got, v) {
+			return false, nil
+		}
+		_, err := setPointer(doc, path, v)
+		return err == nil, err
+	case "remove":
+		_, ok := removePointer(doc, path)
+		return ok, nil
+	case "redact":
+		v, ok := getPointer(doc, path)
+		str, isStr := v.(string)
+		if !ok || !isStr {
+			return false, nil
+		}
+		repl := "[REDACTED]"
+		if len(t.Value) > 0 {
+			json.Unmarshal(t.Value, &repl)
+		}
+		out := t.re.ReplaceAllString(str, repl)
+		if out == str {
+			return false, nil
+		}
+		_, err := setPointer(doc, path, out)
+		return true, err
+	default:
+		v, ok := removePointer(doc, mustTokens(t.From))
+		if !ok {
+			return false, nil
+		}
+		_, err := setPointer(doc, path, v)
+		return true, err
+	}
+}
+
+// applyTransforms runs rules over doc in order.
+func applyTransforms(doc map[string]any, rules []TransformRule) (bool, error) {
+	changed := false
+	for i := range rules {
+		c, err := rules[i].apply(doc)
+		if err != nil {
+			return changed, fmt.Errorf("%s %s: %w", rules[i].Op, rules[i].Path, err)
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// decodeJSON decodes b keeping numbers exact, so untouched fields are
+// re-encoded as the client sent them.
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// jsonEqual compares decoded values, treating numbers by value so 1.5
+// matches 1.50.
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(numbersAsFloats(a), numbersAsFloats(b))
+}
+
+func numbersAsFloats(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = numbersAsFloats(e)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, e := range v {
+			s[i] = numbersAsFloats(e)
+		}
+		return s
+	}
+	return v
+}
+
+// encodeJSON is json.Marshal without HTML escaping.
+func encodeJSON(v any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func pointerTokens(p string) ([]string, error) {
+	if p == "" || p[0] != '/' {
+		return nil, fmt.Errorf("path %q must be a JSON pointer starting with /", p)
+	}
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return toks, nil
+}
+
+// mustTokens parses a pointer already checked by validate.
+func mustTokens(p string) []string {
+	toks, _ := pointerTokens(p)
+	return toks
+}
+
+func getPointer(node any, toks []string) (any, bool) {
+	for _, t := range toks {
+		switch n := node.(type) {
+		case map[string]any:
+			v, ok := n[t]
+			if !ok {
+				return nil, false
+			}
+			node = v
+		case []any:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// setPointer stores v at toks under node, creating objects for missing
+// parents, and returns the (possibly reallocated) node. "-" appends to an
+// array.
+func setPointer(node any, toks []string, v any) (any, error) {
+	if len(toks) == 0 {
+		return v, nil
+	}
+	t, rest := toks[0], toks[1:]
+	switch n := node.(type) {
+	case nil:
+		child, err := setPointer(nil, rest, v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{t: child}, nil
+	case map[string]any:
+		child, err := setPointer(n[t], rest, v)
+		if err != nil {
+			return nil, err
+		}
+		n[t] = child
+		return n, nil
+	case []any:
+		if t == "-" {
+			child, err := setPointer(nil, rest, v)
+			if err != nil {
+				return nil, err
+			}
+			return append(n, child), nil
+		}
+		i, err := strconv.Atoi(t)
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("array index %q out of range", t)
+		}
+		child, err := setPointer(n[i], rest, v)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot descend into %T at %q", node, t)
+}
+
+// removePointer deletes and returns the value at toks.
+func removePointer(doc map[string]any, toks []string) (any, bool) {
+	parent, ok := getPointer(doc, toks[:len(toks)-1])
+	if !ok {
+		return nil, false
+	}
+	last := toks[len(toks)-1]
+	switch n := parent.(type) {
+	case map[string]any:
+		v, ok := n[last]
+		delete(n, last)
+		return v, ok
+	case []any:
+		i, err := strconv.Atoi(last)
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, false
+		}
+		v := n[i]
+		setPointer(doc, toks[:len(toks)-1], append(n[:i:i], n[i+1:]...))
+		return v, true
+	}
+	return nil, false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportConfig tunes the connections to upstreams. The defaults keep
+// enough idle connections per host for many concurrent agents, where Go's
+// own keeps two. Timeout bounds a whole exchange, streamed body included;
+// ResponseHeaderTimeout, off by default, bounds the wait for the status line,
+// which for unstreamed completions arrives only once generation is done.
+// Zero durations and limits mean none.
+//
+// TLS upstreams are spoken to over HTTP/2 when they offer it, so concurrent
+// streams share a few connections; DisableHTTP2 keeps to HTTP/1.1. Go's
+// bundled HTTP/2 client has no setting for PING frames, so PingInterval
+// instead sends a HEAD to each upstream that has been idle that long. If one
+// fails within PingTimeout (default 15s) the idle connections are closed,
+// and the next request dials afresh rather than writing into a dead one.
+//
+// DNSCacheTTL, when set, caches upstream resolutions for that long. Prewarm
+// opens that many connections to each configured upstream at startup, so
+// the first requests skip the TLS handshake.
+//
+// Uploads sent with Expect: 100-continue are passed on with it, and the
+// client is only told to send the body once the upstream has said to, so
+// one the upstream refuses is never uploaded. ExpectContinueTimeout
+// (default 1s) is how long to wait for an upstream that says nothing
+// before sending the body anyway.
+type TransportConfig struct {
+	Timeout               Duration `json:"timeout,omitempty"`
+	DialTimeout           Duration `json:"dial_timeout,omitempty"`
+	KeepAlive             Duration `json:"keep_alive,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout,omitempty"`
+	MaxIdleConns          int      `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost       int      `json:"max_conns_per_host,omitempty"`
+	DisableHTTP2          bool     `json:"disable_http2,omitempty"`
+	PingInterval          Duration `json:"ping_interval,omitempty"`
+	PingTimeout           Duration `json:"ping_timeout,omitempty"`
+	DNSCacheTTL           Duration `json:"dns_cache_ttl,omitempty"`
+	Prewarm               int      `json:"prewarm,omitempty"`
+	ExpectContinueTimeout Duration `json:"expect_continue_timeout,omitempty"`
+}
+
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		Timeout:               Duration(5 * time.Minute),
+		DialTimeout:           Duration(10 * time.Second),
+		KeepAlive:             Duration(30 * time.Second),
+		TLSHandshakeTimeout:   Duration(10 * time.Second),
+		IdleConnTimeout:       Duration(90 * time.Second),
+		MaxIdleConns:          1024,
+		MaxIdleConnsPerHost:   256,
+		PingTimeout:           Duration(15 * time.Second),
+		ExpectContinueTimeout: Duration(time.Second),
+	}
+}
+
+func (c *TransportConfig) validate() error {
+	for _, d := range []Duration{c.Timeout, c.DialTimeout, c.KeepAlive, c.TLSHandshakeTimeout, c.ResponseHeaderTimeout, c.IdleConnTimeout, c.PingInterval, c.PingTimeout, c.DNSCacheTTL, c.ExpectContinueTimeout} {
+		if d < 0 {
+			return fmt.Errorf("transport: timeouts must not be negative")
+		}
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 || c.Prewarm < 0 {
+		return fmt.Errorf("transport: connection limits must not be negative")
+	}
+	return nil
+}
+
+// newUpstreamTransport returns the transport for upstream requests.
+func newUpstreamTransport(c TransportConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: time.Duration(c.DialTimeout), KeepAlive: time.Duration(c.KeepAlive)}).DialContext
+	if c.DNSCacheTTL > 0 {
+		t.DialContext = newDNSCache(time.Duration(c.DNSCacheTTL)).dialContext(t.DialContext)
+	}
+	t.TLSHandshakeTimeout = time.Duration(c.TLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = time.Duration(c.ResponseHeaderTimeout)
+	t.IdleConnTimeout = time.Duration(c.IdleConnTimeout)
+	t.ExpectContinueTimeout = time.Duration(c.ExpectContinueTimeout)
+	t.MaxIdleConns = c.MaxIdleConns
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	if c.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// pingIdleUpstreams checks the connections to idle upstreams every
+// interval until ctx is done. Any response proves the connection.
+func pingIdleUpstreams(ctx context.Context, t *http.Transport, upstreams *upstreamTracker, interval, timeout time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for _, target := range upstreams.idle(interval) {
+			if err := pingUpstream(ctx, t, target, timeout); err != nil {
+				log.Printf("Error pinging %s, closing idle connections: %v", target, err)
+				t.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+func pingUpstream(ctx context.Context, t *http.Transport, target string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	debugf("Pinged %s over %s: %d", target, resp.Proto, resp.StatusCode)
+	return nil
+}
+
+// upstreamTargets returns the HTTP(S) upstreams the config sends requests
+// to.
+func (c *Config) upstreamTargets() []string {
+	var out []string
+	add := func(target string) {
+		if u := upstreamOf(target); strings.HasPrefix(u, "http") && !slices.Contains(out, u) {
+			out = append(out, u)
+		}
+	}
+	add(c.Target)
+	for _, rc := range c.Routes {
+		add(rc.Target)
+		for _, t := range rc.Targets {
+			add(t.Target)
+		}
+	}
+	for _, u := range c.Upstreams {
+		add(u.URL)
+	}
+	return out
+}
+
+// prewarm opens n connections to each target with concurrent HEAD requests,
+// leaving them idle in the transport's pool.
+func prewarm(ctx context.Context, t *http.Transport, targets []string, n int, timeout time.Duration) {
+	for _, target := range targets {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		warmed := 0
+		start := time.Now()
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := pingUpstream(ctx, t, target, timeout); err != nil {
+					log.Printf("Error pre-warming %s: %v", target, err)
+					return
+				}
+				mu.Lock()
+				warmed++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		infof("Pre-warmed %d connections to %s in %s", warmed, target, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamStatus is what the proxy has observed of one upstream target.
+type UpstreamStatus struct {
+	Target      string     `json:"target"`
+	Requests    int64      `json:"requests"`
+	Errors      int64      `json:"errors"`
+	Protocol    string     `json:"protocol,omitempty"`
+	LastStatus  int        `json:"last_status,omitempty"`
+	LastLatency Duration   `json:"last_latency"`
+	AvgLatency  Duration   `json:"avg_latency"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastAt      time.Time  `json:"last_at"`
+}
+
+// upstreamTracker records outcomes per upstream. Transport failures and
+// 5xx responses count as errors.
+type upstreamTracker struct {
+	mu sync.Mutex
+	m  map[string]*UpstreamStatus
+}
+
+func (t *upstreamTracker) record(target string, resp *http.Response, latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[string]*UpstreamStatus)
+	}
+	s := t.m[target]
+	if s == nil {
+		s = &UpstreamStatus{Target: target}
+		t.m[target] = s
+	}
+	status := 0
+	if resp != nil {
+		status, s.Protocol = resp.StatusCode, resp.Proto
+	}
+	now := time.Now().UTC()
+	s.Requests++
+	s.LastStatus, s.LastLatency, s.LastAt = status, Duration(latency), now
+	if resp != nil {
+		if s.AvgLatency == 0 {
+			s.AvgLatency = Duration(latency)
+		} else {
+			s.AvgLatency += Duration(float64(latency-time.Duration(s.AvgLatency)) * latencyDecay)
+		}
+	}
+	if err != nil || status >= 500 {
+		s.Errors++
+		s.LastErrorAt = &now
+		if err != nil {
+			s.LastError = err.Error()
+		} else {
+			s.LastError = http.StatusText(status)
+		}
+	}
+}
+
+// latencyDecay is the weight of the newest response in an upstream's
+// average latency.
+const latencyDecay = 0.2
+
+// latency returns the average time target takes to respond, and whether
+// it has responded yet.
+func (t *upstreamTracker) latency(target string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.m[target]
+	if s == nil || s.AvgLatency == 0 {
+		return 0, false
+	}
+	return time.Duration(s.AvgLatency), true
+}
+
+func (t *upstreamTracker) snapshot() []UpstreamStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]UpstreamStatus, 0, len(t.m))
+	for _, s := range t.m {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out
+}
+
+// idle returns the HTTP(S) upstreams without a request for d.
+func (t *upstreamTracker) idle(d time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []string
+	for target, s := range t.m {
+		if strings.HasPrefix(target, "http") && time.Since(s.LastAt) >= d {
+			out = append(out, target)
+		}
+	}
+	return out
+}
+
+// upstreamOf returns the scheme and host of a target URL.
+func upstreamOf(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// UpstreamConfig is one provider in the upstream pool. Routes without a
+// target of their own send each request to a pool member drawn by Weight
+// (default 1). Auth, when set, is how requests under URL are authenticated,
+// route targets included, in place of the global upstream_auth. Pricing is
+// what the provider charges, for the models it lists, where that differs
+// from the global pricing; requests it serves are costed by it, and a
+// local server's models it doesn't list cost nothing. Azure
+// makes it an Azure OpenAI resource, Vertex Gemini on Google's Vertex AI
+// and Local a self-hosted server such as Ollama or vLLM. Provider is what
+// usage it serves is recorded under, by default "azure" or "vertex" for
+// those upstreams, a local one's server and "zai" otherwise.
+type UpstreamConfig struct {
+	Name     string        `json:"name"`
+	URL      string        `json:"url"`
+	Provider string        `json:"provider,omitempty"`
+	Weight   int           `json:"weight,omitempty"`
+	Auth     *UpstreamAuth `json:"auth,omitempty"`
+	Pricing  PriceTable    `json:"pricing,omitempty"`
+	Azure    *AzureConfig  `json:"azure,omitempty"`
+	Vertex   *VertexConfig `json:"vertex,omitempty"`
+	Local    *LocalConfig  `json:"local,omitempty"`
+}
+
+func (u *UpstreamConfig) validate() error {
+	if u.Name == "" {
+		return errors.New("every upstream needs a name")
+	}
+	if pu, err := url.Parse(u.URL); err != nil || pu.Scheme == "" || pu.Host == "" {
+		return fmt.Errorf("upstream %q: url must be absolute, like https://api.z.ai", u.Name)
+	}
+	if u.Weight < 0 {
+		return fmt.Errorf("upstream %q: weight must not be negative", u.Name)
+	}
+	for model, p := range u.Pricing {
+		if p.Input < 0 || p.Output < 0 || p.CachedInput < 0 || p.CacheWrite < 0 {
+			return fmt.Errorf("upstream %q: pricing: %s: rates must not be negative", u.Name, model)
+		}
+	}
+	if u.Auth != nil {
+		if err := u.Auth.validate(); err != nil {
+			return fmt.Errorf("upstream %q: auth: %w", u.Name, err)
+		}
+	}
+	if u.Azure != nil {
+		if err := u.Azure.validate(u.Auth); err != nil {
+			return fmt.Errorf("upstream %q: azure: %w", u.Name, err)
+		}
+	}
+	if u.Vertex != nil {
+		if err := u.Vertex.validate(); err != nil {
+			return fmt.Errorf("upstream %q: vertex: %w", u.Name, err)
+		}
+	}
+	if u.Local != nil {
+		if err := u.Local.validate(); err != nil {
+			return fmt.Errorf("upstream %q: local: %w", u.Name, err)
+		}
+	}
+	n := 0
+	for _, set := range []bool{u.Azure != nil, u.Vertex != nil, u.Local != nil} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("upstream %q: azure, vertex and local are exclusive", u.Name)
+	}
+	return nil
+}
+
+// provider reports whether u is an Azure, Vertex or local upstream, whose
+// requests authorize rewrites.
+func (u *UpstreamConfig) provider() bool {
+	return u.Azure != nil || u.Vertex != nil || u.Local != nil
+}
+
+// providerName is the provider u's usage is recorded under.
+func (u *UpstreamConfig) providerName() string {
+	switch {
+	case u.Provider != "":
+		return u.Provider
+	case u.Azure != nil:
+		return "azure"
+	case u.Vertex != nil:
+		return "vertex"
+	case u.Local != nil:
+		return u.Local.Server
+	}
+	return "zai"
+}
+
+// providerHosts are the providers known by their API hosts.
+var providerHosts = map[string]string{
+	"api.z.ai":                          "zai",
+	"open.bigmodel.cn":                  "zai",
+	"api.openai.com":                    "openai",
+	"api.anthropic.com":                 "anthropic",
+	"generativelanguage.googleapis.com": "google",
+	"api.mistral.ai":                    "mistral",
+	"api.deepseek.com":                  "deepseek",
+	"api.groq.com":                      "groq",
+	"api.together.xyz":                  "together",
+	"api.x.ai":                          "xai",
+	"openrouter.ai":                     "openrouter",
+}
+
+// hostProvider names the provider whose API host is host, or "".
+func hostProvider(host string) string {
+	switch {
+	case strings.HasSuffix(host, ".openai.azure.com"):
+		return "azure"
+	case strings.HasSuffix(host, "aiplatform.googleapis.com"):
+		return "vertex"
+	}
+	return providerHosts[host]
+}
+
+func (u *UpstreamConfig) weight() int {
+	if u.Weight == 0 {
+		return 1
+	}
+	return u.Weight
+}
+
+// weightOf returns u's weight scaled by its health.
+func (p *upstreamPool) weightOf(u *UpstreamConfig) float64 {
+	return float64(u.weight()) * p.health.score(u.URL)
+}
+
+// upstreamPool holds the configured upstreams, the route target overrides
+// and the edits made to them through the admin API.
+type upstreamPool struct {
+	mu      sync.RWMutex
+	ups     []UpstreamConfig
+	routes  map[string]string // route pattern to target override
+	journal *journal
+	changed bool
+
+	circuits *circuits       // members to avoid while they fail
+	health   *upstreamHealth // scales members' weights
+}
+
+// RouteOverride sends a route to Target regardless of its configured
+// targets. An empty Target clears the override.
+type RouteOverride struct {
+	Pattern string `json:"pattern"`
+	Target  string `json:"target"`
+}
+
+func newUpstreamPool(cfgs []UpstreamConfig, j *journal) *upstreamPool {
+	return &upstreamPool{ups: append([]UpstreamConfig(nil), cfgs...), routes: map[string]string{}, journal: j}
+}
+
+// apply makes the edit in memory; other journal entries are ignored.
+func (p *upstreamPool) apply(e journalEntry) {
+	if e.Op == "restore" && e.Restore != nil {
+		s := e.Restore.Snapshot
+		p.ups = make([]UpstreamConfig, 0, len(s.Upstreams))
+		for _, u := range s.Upstreams {
+			p.ups = append(p.ups, u)
+		}
+		sort.Slice(p.ups, func(i, j int) bool { return p.ups[i].Name < p.ups[j].Name })
+		p.routes = map[string]string{}
+		maps.Copy(p.routes, s.Routes)
+		p.changed = true
+		return
+	}
+	if e.Op == "route" && e.Route != nil {
+		if e.Route.Target == "" {
+			delete(p.routes, e.Route.Pattern)
+		} else {
+			p.routes[e.Route.Pattern] = e.Route.Target
+		}
+		return
+	}
+	if e.Upstream == nil {
+		return
+	}
+	i := slices.IndexFunc(p.ups, func(u UpstreamConfig) bool { return u.Name == e.Upstream.Name })
+	p.changed = true
+	switch {
+	case e.Op == "remove" && i >= 0:
+		p.ups = append(p.ups[:i], p.ups[i+1:]...)
+	case e.Op == "put" && i >= 0:
+		p.ups[i] = *e.Upstream
+	case e.Op == "put":
+		p.ups = append(p.ups, *e.Upstream)
+	}
+}
+
+// list returns the pool sorted by name.
+func (p *upstreamPool) list() []UpstreamConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := append([]UpstreamConfig{}, p.ups...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// edited reports whether the pool differs from the config file's.
+func (p *upstreamPool) edited() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.changed
+}
+
+// pick draws an upstream URL by weight, or returns "" for an empty pool.
+func (p *upstreamPool) pick() string {
+	return p.alternative(nil)
+}
+
+// put adds or replaces an upstream.
+func (p *upstreamPool) put(u UpstreamConfig) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := journalEntry{Time: time.Now().UTC(), Op: "put", Upstream: &u}
+	if err := p.journal.append(e); err != nil {
+		return err
+	}
+	p.apply(e)
+	return nil
+}
+
+// remove deletes an upstream, reporting whether it existed.
+func (p *upstreamPool) remove(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !slices.ContainsFunc(p.ups, func(u UpstreamConfig) bool { return u.Name == name }) {
+		return false, nil
+	}
+	e := journalEntry{Time: time.Now().UTC(), Op: "remove", Upstream: &UpstreamConfig{Name: name}}
+	if err := p.journal.append(e); err != nil {
+		return false, err
+	}
+	p.apply(e)
+	return true, nil
+}
+
+// routeTarget returns the override for the route pattern, if any.
+func (p *upstreamPool) routeTarget(pattern string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.routes[pattern]
+}
+
+// overrides returns the route target overrides by pattern.
+func (p *upstreamPool) overrides() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return maps.Clone(p.routes)
+}
+
+// setRoute overrides a route's target, or clears the override.
+func (p *upstreamPool) setRoute(o RouteOverride) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := journalEntry{Time: time.Now().UTC(), Op: "route", Route: &o}
+	if err := p.journal.append(e); err != nil {
+		return err
+	}
+	p.apply(e)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestProviderOf records usage under the provider of the pool member or
+// route target that served it, whichever path under its URL the request
+// went to, else of its host.
+func TestProviderOf(t *testing.T) {
+	rc := &RouteConfig{Pattern: "/v1/", Target: "https://llm.internal.example/v1",
+		TargetProvider: TargetProvider{Provider: "vllm"},
+		Targets: []RouteTarget{
+			{Target: "https://claude.example", TargetProvider: TargetProvider{Provider: "anthropic"}},
+			{Target: "https://api.mistral.ai"},
+		}}
+	p := &proxy{cfg: defaultConfig(), pool: newUpstreamPool([]UpstreamConfig{
+		{Name: "primary", URL: "https://api.z.ai"},
+		{Name: "openai", URL: "https://api.openai.com/v1", Provider: "openai"},
+		{Name: "gateway", URL: "https://gateway.example/v1", Provider: "openai"},
+		{Name: "azure", URL: "https://acme.openai.azure.com", Azure: &AzureConfig{}},
+		{Name: "gemini", URL: "https://europe-west4-aiplatform.googleapis.com", Vertex: &VertexConfig{}},
+		{Name: "box", URL: "http://gpu-box:11434", Local: &LocalConfig{Server: "ollama"}},
+	}, nil)}
+	for _, tc := range []struct{ target, want string }{
+		{"https://api.z.ai/api/paas/v4/chat/completions", "zai"},
+		{"https://api.openai.com/v1/chat/completions?stream=true", "openai"},
+		{"https://gateway.example/v10/chat/completions", "gateway.example"},
+		{"https://acme.openai.azure.com/v1/chat/completions", "azure"},
+		{"https://europe-west4-aiplatform.googleapis.com/v1/chat/completions", "vertex"},
+		{"http://gpu-box:11434/v1/chat/completions", "ollama"},
+		{"https://llm.internal.example/v1/chat/completions", "vllm"},
+		{"https://claude.example/v1/messages", "anthropic"},
+		{"https://api.mistral.ai/v1/chat/completions", "mistral"},
+		{"https://api.anthropic.com/v1/messages", "anthropic"},
+		{"https://other.openai.azure.com/openai/deployments/x", "azure"},
+		{"https://elsewhere.example/v1/chat/completions", "elsewhere.example"},
+		{"", "zai"},
+	} {
+		if got := p.providerOf(&exchange{target: tc.target, route: rc}); got != tc.want {
+			t.Errorf("providerOf(%s) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+// TestLocalPricing costs a local server's requests at nothing unless its
+// own pricing lists the model, whatever the global pricing says.
+func TestLocalPricing(t *testing.T) {
+	def := PriceTable{"*": {Input: 1, Output: 2}}
+	pool := newUpstreamPool([]UpstreamConfig{
+		{Name: "box", URL: "http://gpu-box:11434", Local: &LocalConfig{Server: "vllm"},
+			Pricing: PriceTable{"qwen-*": {Input: 0.1, Output: 0.1}}},
+		{Name: "primary", URL: "https://api.z.ai"},
+	}, nil)
+	u := Usage{PromptTokens: 1000, CompletionTokens: 1000}
+	for _, tc := range []struct {
+		member, model string
+		want          float64
+	}{
+		{"http://gpu-box:11434", "llama3", 0},
+		{"http://gpu-box:11434", "qwen-2.5", 0.0002},
+		{"https://api.z.ai", "glm-4.6", 0.003},
+		{"", "glm-4.6", 0.003},
+	} {
+		if got := pool.priceTable(tc.member, tc.model, def).Cost(tc.model, u); math.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("%s %s: cost %v, want %v", tc.member, tc.model, got, tc.want)
+		}
+	}
+}
+
+// TestRouteTargetPricing costs requests sent to a route target by its own
+// pricing for the models it lists, else by the global pricing.
+func TestRouteTargetPricing(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Pricing = PriceTable{"*": {Input: 1, Output: 2}}
+	p := &proxy{cfg: cfg, pool: newUpstreamPool(nil, nil)}
+	rc := &RouteConfig{Pattern: "/v1/", Targets: []RouteTarget{{Target: "https://api.openai.com/v1",
+		TargetProvider: TargetProvider{Pricing: PriceTable{"gpt-*": {Input: 5, Output: 10}}}}}}
+	u := Usage{PromptTokens: 1000, CompletionTokens: 1000}
+	for _, tc := range []struct {
+		target, model string
+		want          float64
+	}{
+		{"https://api.openai.com/v1/chat/completions", "gpt-5", 0.015},
+		{"https://api.openai.com/v1/chat/completions", "o3", 0.003},
+		{"https://api.z.ai/api/paas/v4/chat/completions", "gpt-5", 0.003},
+	} {
+		ex := &exchange{target: tc.target, route: rc}
+		if got := p.priceTableOf(ex, tc.model).Cost(tc.model, u); math.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("%s %s: cost %v, want %v", tc.target, tc.model, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// UpstreamAuth is how an upstream is given its key. Scheme "bearer", the
+// default, sends it as Authorization: Bearer; "header" sends it in Header,
+// such as x-api-key, after Prefix; "query" adds it as the query parameter
+// Param; "sigv4" signs requests with AWS credentials, for Region and
+// Service, optionally as RoleARN; "google" sends a Google Cloud access
+// token, from the credentials file Credentials when set; "none" sends no
+// key. The key is the value of the environment variable KeyEnv, else
+// ZAI_API_KEY's. Whatever credentials the client presented are never
+// passed on.
+type UpstreamAuth struct {
+	Scheme      string `json:"scheme,omitempty"`
+	Header      string `json:"header,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	Param       string `json:"param,omitempty"`
+	KeyEnv      string `json:"key_env,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Service     string `json:"service,omitempty"`
+	RoleARN     string `json:"role_arn,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+}
+
+func (a *UpstreamAuth) validate() error {
+	switch a.Scheme {
+	case "", "bearer", "none":
+	case "sigv4":
+		if a.RoleARN != "" && !strings.HasPrefix(a.RoleARN, "arn:") {
+			return fmt.Errorf("role_arn %q is not an ARN", a.RoleARN)
+		}
+	case "google":
+		if a.Credentials != "" {
+			if _, err := os.Stat(a.Credentials); err != nil {
+				return fmt.Errorf("credentials: %w", err)
+			}
+		}
+	case "header":
+		if a.Header == "" {
+			return fmt.Errorf("the header scheme needs a header")
+		}
+	case "query":
+		if a.Param == "" {
+			return fmt.Errorf("the query scheme needs a param")
+		}
+	default:
+		return fmt.Errorf("unknown scheme %q (want bearer, header, query, sigv4, google or none)", a.Scheme)
+	}
+	if a.KeyEnv != "" && os.Getenv(a.KeyEnv) == "" {
+		return fmt.Errorf("environment variable %s is not set", a.KeyEnv)
+	}
+	return nil
+}
+
+var errUpstreamAuth = errors.New("upstream auth")
+
+// apply puts the upstream key on req, key being the default one, or signs
+// it. It fails only for want of AWS or Google credentials.
+func (a *UpstreamAuth) apply(req *http.Request, key string) error {
+	req.Header.Del("Authorization")
+	req.Header.Del("X-Api-Key")
+	req.Header.Del("Api-Key")
+	req.Header.Del("X-Amz-Security-Token")
+	if a.KeyEnv != "" {
+		key = os.Getenv(a.KeyEnv)
+	}
+	switch a.Scheme {
+	case "", "bearer":
+		req.Header.Set("Authorization", "Bearer "+key)
+	case "header":
+		req.Header.Set(a.Header, a.Prefix+key)
+	case "query":
+		q := req.URL.Query()
+		q.Set(a.Param, key)
+		req.URL.RawQuery = q.Encode()
+	case "sigv4":
+		return a.signAWS(req)
+	case "google":
+		return a.authorizeGoogle(req)
+	}
+	return nil
+}
+
+// redact masks the key a put in fr.
+func (a *UpstreamAuth) redact(fr *ForwardedRequest) {
+	switch a.Scheme {
+	case "header":
+		if fr.Headers.Get(a.Header) != "" {
+			fr.Headers.Set(a.Header, secretMask)
+		}
+	case "query":
+		if u, err := url.Parse(fr.URL); err == nil {
+			q := u.Query()
+			q.Set(a.Param, secretMask)
+			u.RawQuery = q.Encode()
+			fr.URL = u.String()
+		}
+	}
+}
+
+// under reports whether target is the URL base or one beneath it.
+func under(target, base string) bool {
+	if !strings.HasPrefix(target, base) {
+		return false
+	}
+	rest := target[len(base):]
+	return rest == "" || strings.ContainsRune("/?", rune(rest[0]))
+}
+
+// memberFor returns the pool member whose URL target falls under, the
+// longest if several do, of those has reports true for.
+func (p *upstreamPool) memberFor(target string, has func(*UpstreamConfig) bool) (UpstreamConfig, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var best UpstreamConfig
+	n := 0
+	for i := range p.ups {
+		u := &p.ups[i]
+		base := strings.TrimSuffix(u.URL, "/")
+		if has(u) && len(base) > n && under(target, base) {
+			best, n = *u, len(base)
+		}
+	}
+	return best, n > 0
+}
+
+// authFor returns how to authenticate to target: as the pool member it
+// falls under says, else def.
+func (p *upstreamPool) authFor(target string, def *UpstreamAuth) *UpstreamAuth {
+	u, ok := p.memberFor(target, func(u *UpstreamConfig) bool { return u.Auth != nil || u.provider() })
+	switch {
+	case !ok:
+		return def
+	case u.Auth == nil && u.Vertex != nil:
+		return &vertexAuth
+	case u.Auth == nil && u.Local != nil:
+		return &localAuth
+	case u.Auth == nil:
+		return &azureKeyAuth
+	}
+	return u.Auth
+}
+
+// authorize readies req, addressed to target, for the upstream: in the
+// form of the Azure, Vertex or local server it is, then authenticated.
+func (p *proxy) authorize(req *http.Request, target, model string) error {
+	if u, ok := p.pool.memberFor(target, (*UpstreamConfig).provider); ok {
+		var err error
+		switch {
+		case u.Azure != nil:
+			err = u.Azure.rewrite(req, u.URL, target, model)
+		case u.Vertex != nil:
+			err = u.Vertex.rewrite(req, u.URL, target, model)
+		default:
+			err = u.Local.rewrite(req, model)
+		}
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Host", req.URL.Host)
+	}
+	return p.pool.authFor(target, &p.cfg.UpstreamAuth).apply(req, p.apiKey)
+}
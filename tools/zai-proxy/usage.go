@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is the token accounting for a single upstream response. Prompt
+// tokens count every input token, as OpenAI's do; CachedTokens of them
+// were read from the provider's prompt cache and CacheWriteTokens written
+// to it.
+type Usage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	CachedTokens     int64 `json:"cached_tokens,omitempty"`
+	CacheWriteTokens int64 `json:"cache_write_tokens,omitempty"`
+}
+
+// Total returns prompt plus completion tokens.
+func (u Usage) Total() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// IsZero reports whether no tokens were recorded.
+func (u Usage) IsZero() bool {
+	return u.PromptTokens == 0 && u.CompletionTokens == 0 && u.CachedTokens == 0 && u.CacheWriteTokens == 0
+}
+
+// rawUsage covers both the OpenAI-style and Anthropic-style usage blocks.
+// Anthropic's input_tokens leave out the tokens read from or written to
+// the cache, which OpenAI's prompt_tokens include.
+type rawUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	InputTokens         int64 `json:"input_tokens"`
+	OutputTokens        int64 `json:"output_tokens"`
+	CacheReadTokens     int64 `json:"cache_read_input_tokens"`
+	CacheCreationTokens int64 `json:"cache_creation_input_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+func (r *rawUsage) usage() Usage {
+	u := Usage{
+		PromptTokens:     r.PromptTokens + r.InputTokens + r.CacheReadTokens + r.CacheCreationTokens,
+		CompletionTokens: r.CompletionTokens + r.OutputTokens,
+		CachedTokens:     r.CacheReadTokens,
+		CacheWriteTokens: r.CacheCreationTokens,
+	}
+	if r.PromptTokensDetails != nil {
+		u.CachedTokens += r.PromptTokensDetails.CachedTokens
+	}
+	return u
+}
+
+// usageEnvelope is the subset of a response body or SSE event we inspect.
+// Anthropic streams carry the model and input tokens inside message_start.
+type usageEnvelope struct {
+	Model   string    `json:"model"`
+	Usage   *rawUsage `json:"usage"`
+	Message *struct {
+		Model string    `json:"model"`
+		Usage *rawUsage `json:"usage"`
+	} `json:"message"`
+}
+
+// usageObserver receives a copy of the response body as it is streamed to
+// the client and extracts the model and token usage from it.
+type usageObserver struct {
+	stream bool
+	limit  int
+	buf    bytes.Buffer
+	model  string
+	usage  Usage
+	seen   bool
+}
+
+func newUsageObserver(contentType string) *usageObserver {
+	o := &usageObserver{
+		stream: strings.HasPrefix(contentType, "text/event-stream"),
+		limit:  maxObservedBody,
+	}
+	// Audio carries no usage; don't hold on to it.
+	if strings.HasPrefix(contentType, "audio/") || strings.HasPrefix(contentType, "application/octet-stream") {
+		o.limit = 0
+	}
+	return o
+}
+
+func (o *usageObserver) Write(p []byte) (int, error) {
+	if !o.stream {
+		if o.buf.Len()+len(p) <= o.limit {
+			o.buf.Write(p)
+		}
+		return len(p), nil
+	}
+	o.buf.Write(p)
+	for {
+		line, ok := o.nextLine()
+		if !ok {
+			break
+		}
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			o.parse(bytes.TrimSpace(data))
+		}
+	}
+	// A single unterminated line should never grow without bound.
+	if o.buf.Len() > o.limit {
+		o.buf.Reset()
+	}
+	return len(p), nil
+}
+
+func (o *usageObserver) nextLine() ([]byte, bool) {
+	i := bytes.IndexByte(o.buf.Bytes(), '\n')
+	if i < 0 {
+		return nil, false
+	}
+	line := bytes.TrimRight(o.buf.Next(i+1), "\r\n")
+	return line, true
+}
+
+// Finish parses any buffered non-streaming body and returns the result.
+func (o *usageObserver) Finish() (model string, usage Usage, ok bool) {
+	if !o.stream && o.buf.Len() > 0 {
+		o.parse(o.buf.Bytes())
+	}
+	return o.model, o.usage, o.seen
+}
+
+func (o *usageObserver) parse(data []byte) {
+	if len(data) == 0 || data[0] != '{' {
+		return
+	}
+	var env usageEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return
+	}
+	if env.Model != "" {
+		o.model = env.Model
+	}
+	if env.Message != nil {
+		if env.Message.Model != "" {
+			o.model = env.Message.Model
+		}
+		if env.Message.Usage != nil {
+			o.merge(env.Message.Usage.usage())
+		}
+	}
+	if env.Usage != nil {
+		o.merge(env.Usage.usage())
+	}
+}
+
+// merge keeps the largest value seen for each counter. OpenAI streams send a
+// single final usage block while Anthropic splits input and output tokens
+// across message_start and message_delta, each cumulative.
+func (o *usageObserver) merge(u Usage) {
+	o.usage.PromptTokens = max(o.usage.PromptTokens, u.PromptTokens)
+	o.usage.CompletionTokens = max(o.usage.CompletionTokens, u.CompletionTokens)
+	o.usage.CachedTokens = max(o.usage.CachedTokens, u.CachedTokens)
+	o.usage.CacheWriteTokens = max(o.usage.CacheWriteTokens, u.CacheWriteTokens)
+	o.seen = true
+}
+
+// UsageKey identifies one aggregation bucket. Project is the optional
+// X-Ringmaster-Project tag.
+type UsageKey struct {
+	Client   string `json:"client,omitempty"`
+	Project  string `json:"project,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+func (k UsageKey) less(o UsageKey) bool {
+	if k.Client != o.Client {
+		return k.Client < o.Client
+	}
+	if k.Project != o.Project {
+		return k.Project < o.Project
+	}
+	if k.Model != o.Model {
+		return k.Model < o.Model
+	}
+	return k.Provider < o.Provider
+}
+
+// UsageTotals accumulates usage across requests.
+type UsageTotals struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CachedTokens     int64   `json:"cached_tokens"`
+	CacheWriteTokens int64   `json:"cache_write_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+func (t *UsageTotals) add(status int, u Usage, cost float64) {
+	t.Requests++
+	if status >= 400 {
+		t.Errors++
+	}
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.CachedTokens += u.CachedTokens
+	t.CacheWriteTokens += u.CacheWriteTokens
+	t.CostUSD += cost
+}
+
+func (t *UsageTotals) merge(o *UsageTotals) {
+	t.Requests += o.Requests
+	t.Errors += o.Errors
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.CachedTokens += o.CachedTokens
+	t.CacheWriteTokens += o.CacheWriteTokens
+	t.CostUSD += o.CostUSD
+}
+
+// UsageRow is a snapshot of totals for one key.
+type UsageRow struct {
+	UsageKey
+	UsageTotals
+}
+
+type hourKey struct {
+	hour int64
+	UsageKey
+}
+
+// UsageTracker keeps lifetime totals and hourly buckets for a rolling window.
+type UsageTracker struct {
+	mu       sync.Mutex
+	window   time.Duration
+	lifetime map[UsageKey]*UsageTotals
+	hourly   map[hourKey]*UsageTotals
+	pruned   int64
+}
+
+func NewUsageTracker(window time.Duration) *UsageTracker {
+	return &UsageTracker{
+		window:   window,
+		lifetime: make(map[UsageKey]*UsageTotals),
+		hourly:   make(map[hourKey]*UsageTotals),
+	}
+}
+
+var (
+	usageRequestsTotal = metrics.counter("zai_proxy_usage_requests_total",
+		"Completed proxied requests.", "client", "project", "model", "provider")
+	usageErrorsTotal = metrics.counter("zai_proxy_usage_errors_total",
+		"Completed proxied requests with a 4xx or 5xx status.", "client", "project", "model", "provider")
+	usageTokensTotal = metrics.counter("zai_proxy_usage_tokens_total",
+		"Tokens consumed, by type (prompt, completion, and cached and cache_write of the prompt's).", "client", "project", "model", "provider", "type")
+	usageCostTotal = metrics.counter("zai_proxy_usage_cost_usd_total",
+		"Computed cost in USD from the pricing table.", "client", "project", "model", "provider")
+)
+
+// Record adds one completed request at the given time.
+func (t *UsageTracker) Record(at time.Time, key UsageKey, status int, u Usage, cost float64) {
+	usageRequestsTotal.Add(1, key.Client, key.Project, key.Model, key.Provider)
+	if status >= 400 {
+		usageErrorsTotal.Add(1, key.Client, key.Project, key.Model, key.Provider)
+	}
+	usageTokensTotal.Add(float64(u.PromptTokens), key.Client, key.Project, key.Model, key.Provider, "prompt")
+	usageTokensTotal.Add(float64(u.CompletionTokens), key.Client, key.Project, key.Model, key.Provider, "completion")
+	usageTokensTotal.Add(float64(u.CachedTokens), key.Client, key.Project, key.Model, key.Provider, "cached")
+	usageTokensTotal.Add(float64(u.CacheWriteTokens), key.Client, key.Project, key.Model, key.Provider, "cache_write")
+	usageCostTotal.Add(cost, key.Client, key.Project, key.Model, key.Provider)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lt := t.lifetime[key]
+	if lt == nil {
+		lt = &UsageTotals{}
+		t.lifetime[key] = lt
+	}
+	lt.add(status, u, cost)
+
+	hk := hourKey{hour: at.Unix() / 3600, UsageKey: key}
+	ht := t.hourly[hk]
+	if ht == nil {
+		ht = &UsageTotals{}
+		t.hourly[hk] = ht
+	}
+	ht.add(status, u, cost)
+	t.prune(at)
+}
+
+func (t *UsageTracker) prune(now time.Time) {
+	oldest := now.Add(-t.window).Unix() / 3600
+	if oldest == t.pruned {
+		return
+	}
+	t.pruned = oldest
+	for k := range t.hourly {
+		if k.hour < oldest {
+			delete(t.hourly, k)
+		}
+	}
+}
+
+// Lifetime returns totals since process start, sorted by key.
+func (t *UsageTracker) Lifetime() []UsageRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows := make([]UsageRow, 0, len(t.lifetime))
+	for k, v := range t.lifetime {
+		rows = append(rows, UsageRow{UsageKey: k, UsageTotals: *v})
+	}
+	sortUsageRows(rows)
+	return rows
+}
+
+// Rolling returns totals for the trailing window, sorted by key.
+func (t *UsageTracker) Rolling() []UsageRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sums := make(map[UsageKey]*UsageTotals)
+	for k, v := range t.hourly {
+		s := sums[k.UsageKey]
+		if s == nil {
+			s = &UsageTotals{}
+			sums[k.UsageKey] = s
+		}
+		s.merge(v)
+	}
+	rows := make([]UsageRow, 0, len(sums))
+	for k, v := range sums {
+		rows = append(rows, UsageRow{UsageKey: k, UsageTotals: *v})
+	}
+	sortUsageRows(rows)
+	return rows
+}
+
+func sortUsageRows(rows []UsageRow) {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].UsageKey.less(rows[j].UsageKey) })
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UsageQuery selects and groups usage records.
+type UsageQuery struct {
+	From    time.Time
+	To      time.Time
+	Bucket  time.Duration // zero collapses the whole range into one bucket
+	Client  string
+	Project string
+	Model   string
+	GroupBy []string // any of "client", "project", "model", "provider"
+}
+
+// UsageBucket is one row of a usage report.
+type UsageBucket struct {
+	Start time.Time `json:"start"`
+	UsageKey
+	UsageTotals
+}
+
+// UsageReport is the /usage response body.
+type UsageReport struct {
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Bucket string        `json:"bucket"`
+	Rows   []UsageBucket `json:"rows"`
+	Total  UsageTotals   `json:"total"`
+}
+
+// usageSource answers usage queries; the in-memory tracker and the
+// persistent stores both implement it.
+type usageSource interface {
+	QueryUsage(ctx context.Context, q UsageQuery) ([]UsageBucket, error)
+}
+
+// hourlyUsage is the unit both sources aggregate from.
+type hourlyUsage struct {
+	Hour int64 // unix hours
+	UsageKey
+	UsageTotals
+}
+
+// QueryUsage aggregates the in-memory hourly buckets in [q.From, q.To).
+func (t *UsageTracker) QueryUsage(_ context.Context, q UsageQuery) ([]UsageBucket, error) {
+	t.mu.Lock()
+	var rows []hourlyUsage
+	for k, v := range t.hourly {
+		rows = append(rows, hourlyUsage{Hour: k.hour, UsageKey: k.UsageKey, UsageTotals: *v})
+	}
+	t.mu.Unlock()
+	return groupUsage(rows, q), nil
+}
+
+// groupUsage filters hourly rows by q and folds them into report buckets.
+func groupUsage(hourly []hourlyUsage, q UsageQuery) []UsageBucket {
+	groups := make(map[UsageBucket]*UsageTotals)
+	for _, h := range hourly {
+		at := time.Unix(h.Hour*3600, 0).UTC()
+		if at.Before(q.From) || !at.Before(q.To) {
+			continue
+		}
+		if (q.Client != "" && h.Client != q.Client) || (q.Model != "" && h.Model != q.Model) ||
+			(q.Project != "" && h.Project != q.Project) {
+			continue
+		}
+		g := UsageBucket{Start: q.From, UsageKey: groupKey(h.UsageKey, q.GroupBy)}
+		if q.Bucket > 0 {
+			g.Start = at.Truncate(q.Bucket)
+		}
+		s := groups[g]
+		if s == nil {
+			s = &UsageTotals{}
+			groups[g] = s
+		}
+		s.merge(&h.UsageTotals)
+	}
+	rows := make([]UsageBucket, 0, len(groups))
+	for g, s := range groups {
+		g.UsageTotals = *s
+		rows = append(rows, g)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Start.Equal(rows[j].Start) {
+			return rows[i].Start.Before(rows[j].Start)
+		}
+		return rows[i].UsageKey.less(rows[j].UsageKey)
+	})
+	return rows
+}
+
+func groupKey(k UsageKey, by []string) UsageKey {
+	var g UsageKey
+	for _, dim := range by {
+		switch dim {
+		case "client":
+			g.Client = k.Client
+		case "model":
+			g.Model = k.Model
+		case "provider":
+			g.Provider = k.Provider
+		case "project":
+			g.Project = k.Project
+		}
+	}
+	return g
+}
+
+// parseUsageQuery reads from, to, bucket, client, project, model and group_by
+// from the query string. Dates are RFC 3339 or YYYY-MM-DD; the default range is the
+// last seven days in daily buckets grouped by client and model.
+func parseUsageQuery(r *http.Request, now time.Time) (UsageQuery, string, error) {
+	v := r.URL.Query()
+	q := UsageQuery{
+		To:      now.UTC(),
+		From:    now.UTC().Add(-7 * 24 * time.Hour),
+		Client:  v.Get("client"),
+		Project: v.Get("project"),
+		Model:   v.Get("model"),
+		GroupBy: []string{"client", "model"},
+	}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.From, err = parseUsageTime(s); err != nil {
+			return q, "", fmt.Errorf("from: %w", err)
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.To, err = parseUsageTime(s); err != nil {
+			return q, "", fmt.Errorf("to: %w", err)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, "", fmt.Errorf("from must be before to")
+	}
+	bucket := v.Get("bucket")
+	switch bucket {
+	case "", "day":
+		bucket, q.Bucket = "day", 24*time.Hour
+	case "hour":
+		q.Bucket = time.Hour
+	case "none":
+		q.Bucket = 0
+	default:
+		return q, "", fmt.Errorf("bucket must be hour, day or none")
+	}
+	if s, ok := v["group_by"]; ok {
+		q.GroupBy = nil
+		for _, dim := range strings.Split(strings.Join(s, ","), ",") {
+			switch dim = strings.TrimSpace(dim); dim {
+			case "":
+			case "client", "project", "model", "provider":
+				q.GroupBy = append(q.GroupBy, dim)
+			default:
+				return q, "", fmt.Errorf("group_by: unknown dimension %q", dim)
+			}
+		}
+	}
+	return q, bucket, nil
+}
+
+func parseUsageTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// usageHandler serves /usage. When self is set the report is restricted to
+// the caller's own client identity regardless of the client parameter.
+func usageHandler(src usageSource, self func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, bucket, err := parseUsageQuery(r, time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if self != nil {
+			q.Client = self(r)
+		}
+		rows, err := src.QueryUsage(r.Context(), q)
+		if err != nil {
+			log.Printf("Error querying usage: %v", err)
+			writeError(w, http.StatusInternalServerError, "storage_error", "usage query failed")
+			return
+		}
+		report := UsageReport{From: q.From, To: q.To, Bucket: bucket, Rows: rows}
+		for i := range report.Rows {
+			report.Total.merge(&report.Rows[i].UsageTotals)
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type failingUsage struct{}
+
+func (failingUsage) QueryUsage(context.Context, UsageQuery) ([]UsageBucket, error) {
+	return nil, errors.New("database is locked")
+}
+
+// TestUsageHandlerErrors checks /usage refuses bad queries, and reports
+// failed ones, with the proxy's JSON errors.
+func TestUsageHandlerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		want     int
+		wantType string
+	}{
+		{"?bucket=week", http.StatusBadRequest, "invalid_request"},
+		{"?from=2026-03-02&to=2026-03-01", http.StatusBadRequest, "invalid_request"},
+		{"?group_by=colour", http.StatusBadRequest, "invalid_request"},
+		{"", http.StatusInternalServerError, "storage_error"},
+	} {
+		rec := httptest.NewRecorder()
+		usageHandler(failingUsage{}, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage"+tc.query, nil))
+		var e apiError
+		if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+			t.Errorf("%q: body %q is not a JSON error", tc.query, rec.Body)
+			continue
+		}
+		if rec.Code != tc.want || e.Error.Type != tc.wantType || e.Error.Message == "" {
+			t.Errorf("%q: %d %+v, want %d %s", tc.query, rec.Code, e.Error, tc.want, tc.wantType)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// configSnapshot is the runtime config the admin API edits as of one
+// version: the upstream pool by name, route target overrides, feature
+// flags, prompt templates and the quotas set through the API. Virtual keys
+// are not part of it, so a rollback never revives a revoked key or revokes
+// an issued one.
+type configSnapshot struct {
+	Upstreams map[string]UpstreamConfig    `json:"upstreams"`
+	Routes    map[string]string            `json:"routes"`
+	Flags     map[string]FlagConfig        `json:"flags"`
+	Templates map[string][]TemplateVersion `json:"templates"`
+	Quotas    map[string]QuotaConfig       `json:"quotas"`
+}
+
+// configRestore is a journaled rollback: Snapshot, the state of Version,
+// replaces the runtime config.
+type configRestore struct {
+	Version  int            `json:"version"`
+	Snapshot configSnapshot `json:"snapshot"`
+}
+
+// quotaChange is a journaled quota edit. The store holds the quota; the
+// journal keeps what it replaced so it can be rolled back.
+type quotaChange struct {
+	Client string      `json:"client"`
+	Before QuotaConfig `json:"before"`
+	Limits QuotaConfig `json:"limits"`
+}
+
+// ConfigVersion is one version of the runtime config. Version 0 is the
+// config file's; each change through the admin API makes the next.
+type ConfigVersion struct {
+	Version int        `json:"version"`
+	Time    *time.Time `json:"time,omitempty"`
+	Change  string     `json:"change"`
+}
+
+// ConfigChange is a value that differs between two versions, by JSON
+// pointer into their snapshots. Before or After is missing for a value
+// only one of them has.
+type ConfigChange struct {
+	Path   string `json:"path"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+var errNoVersion = errors.New("no such config version")
+
+// configHistory numbers the admin journal's entries as versions of the
+// runtime config and rolls it back to any of them.
+type configHistory struct {
+	mu        sync.Mutex // serializes rollbacks
+	cfg       *Config
+	journal   *journal
+	pool      *upstreamPool
+	flags     *featureFlags
+	templates *promptTemplates
+	quotas    *quotaChecker
+	store     Store
+}
+
+// describe summarizes the change e made.
+func describe(e journalEntry) string {
+	switch {
+	case e.Upstream != nil:
+		return e.Op + " upstream " + e.Upstream.Name
+	case e.Route != nil && e.Route.Target == "":
+		return "clear route override " + e.Route.Pattern
+	case e.Route != nil:
+		return fmt.Sprintf("route %s to %s", e.Route.Pattern, e.Route.Target)
+	case e.Flag != nil && e.Flag.Config == nil:
+		return "delete flag " + e.Flag.Name
+	case e.Flag != nil:
+		return "set flag " + e.Flag.Name
+	case e.Template != nil && e.Template.Version == nil:
+		return "delete template " + e.Template.Name
+	case e.Template != nil:
+		return fmt.Sprintf("add template %s version %d", e.Template.Name, e.Template.Version.Version)
+	case e.Quota != nil:
+		return "set quota of " + e.Quota.Client
+	case e.Restore != nil:
+		return fmt.Sprintf("roll back to version %d", e.Restore.Version)
+	}
+	return e.Op
+}
+
+func (h *configHistory) versions() []ConfigVersion {
+	entries := h.journal.list()
+	out := make([]ConfigVersion, 0, len(entries)+1)
+	out = append(out, ConfigVersion{Change: "config file"})
+	for i, e := range entries {
+		t := e.Time
+		out = append(out, ConfigVersion{Version: i + 1, Time: &t, Change: describe(e)})
+	}
+	return out
+}
+
+// snapshot returns the state after the first n entries, replayed over the
+// config file's.
+func (h *configHistory) snapshot(entries []journalEntry, n int) configSnapshot {
+	pool := newUpstreamPool(h.cfg.Upstreams, nil)
+	flags := newFeatureFlags(h.cfg.Flags, nil)
+	templates := newPromptTemplates(h.cfg.Templates, nil)
+	quotas := map[string]QuotaConfig{}
+	for _, e := range entries[:n] {
+		pool.apply(e)
+		flags.apply(e)
+		templates.apply(e)
+		switch {
+		case e.Quota != nil:
+			quotas[e.Quota.Client] = e.Quota.Limits
+		case e.Restore != nil:
+			quotas = map[string]QuotaConfig{}
+			for c, q := range e.Restore.Snapshot.Quotas {
+				quotas[c] = q
+			}
+		}
+	}
+	// A quota first set later was then what that change replaced.
+	for _, e := range entries[n:] {
+		if e.Quota != nil {
+			if _, ok := quotas[e.Quota.Client]; !ok {
+				quotas[e.Quota.Client] = e.Quota.Before
+			}
+		}
+	}
+	s := configSnapshot{Upstreams: map[string]UpstreamConfig{}, Routes: pool.routes,
+		Flags: flags.flags, Templates: templates.templates, Quotas: quotas}
+	for _, u := range pool.ups {
+		s.Upstreams[u.Name] = u
+	}
+	return s
+}
+
+// at returns the snapshot of version n.
+func (h *configHistory) at(n int) (configSnapshot, error) {
+	entries := h.journal.list()
+	if n < 0 || n > len(entries) {
+		return configSnapshot{}, errNoVersion
+	}
+	return h.snapshot(entries, n), nil
+}
+
+// current returns the snapshot of the current version.
+func (h *configHistory) current() configSnapshot {
+	entries := h.journal.list()
+	return h.snapshot(entries, len(entries))
+}
+
+// recordQuota journals a quota the store now holds. A nil history records
+// nothing.
+func (h *configHistory) recordQuota(client string, before, limits QuotaConfig) {
+	if h == nil {
+		return
+	}
+	e := journalEntry{Time: time.Now().UTC(), Op: "quota", Quota: &quotaChange{Client: client, Before: before, Limits: limits}}
+	if err := h.journal.append(e); err != nil {
+		log.Printf("Error journaling quota change: %v", err)
+	}
+}
+
+// rollback makes version n's state current again, as a new version whose
+// number it returns.
+func (h *configHistory) rollback(ctx context.Context, n int) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, err := h.at(n)
+	if err != nil {
+		return 0, err
+	}
+	// Quotas live in the store, shared with other replicas, so only the
+	// ones that differ are written back.
+	for client, q := range s.Quotas {
+		cur, err := h.quotas.Limits(ctx, client)
+		if err != nil {
+			return 0, err
+		}
+		if cur != q && h.store != nil {
+			if err := h.store.SetQuota(ctx, client, q); err != nil {
+				return 0, err
+			}
+		}
+	}
+	e := journalEntry{Time: time.Now().UTC(), Op: "restore", Restore: &configRestore{Version: n, Snapshot: s}}
+	if err := h.journal.append(e); err != nil {
+		return 0, err
+	}
+	h.pool.mu.Lock()
+	h.pool.apply(e)
+	h.pool.mu.Unlock()
+	h.flags.mu.Lock()
+	h.flags.apply(e)
+	h.flags.mu.Unlock()
+	h.templates.mu.Lock()
+	h.templates.apply(e)
+	h.templates.mu.Unlock()
+	return len(h.journal.list()), nil
+}
+
+// maskedSnapshot is s as JSON values, secrets masked.
+func maskedSnapshot(s configSnapshot) any {
+	var v any
+	json.Unmarshal(auditJSON(s), &v)
+	return v
+}
+
+// diffSnapshots lists the values that differ from a to b.
+func diffSnapshots(a, b configSnapshot) []ConfigChange {
+	leaves := func(s configSnapshot) map[string]any {
+		out := map[string]any{}
+		walkJSON(maskedSnapshot(s), "", func(ptr string, v any) {
+			switch v.(type) {
+			case map[string]any, []any:
+				return
+			}
+			out[ptr] = v
+		})
+		return out
+	}
+	before, after := leaves(a), leaves(b)
+	paths := make([]string, 0, len(before)+len(after))
+	for p := range before {
+		paths = append(paths, p)
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	out := []ConfigChange{}
+	for _, p := range paths {
+		x, inBefore := before[p]
+		y, inAfter := after[p]
+		if inBefore != inAfter || x != y {
+			out = append(out, ConfigChange{Path: p, Before: x, After: y})
+		}
+	}
+	return out
+}
+
+// parse reads a version number, or "current".
+func (h *configHistory) parse(v string) (int, error) {
+	cur := len(h.journal.list())
+	if v == "current" {
+		return cur, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > cur {
+		return 0, errNoVersion
+	}
+	return n, nil
+}
+
+// pathVersion parses the request's {version}, replying 404 to a bad one.
+func (a *adminAPI) pathVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	n, err := a.history.parse(r.PathValue("version"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return 0, false
+	}
+	return n, true
+}
+
+func (a *adminAPI) configVersions(w http.ResponseWriter, r *http.Request) {
+	versions := a.history.versions()
+	writeJSON(w, http.StatusOK, map[string]any{"current": len(versions) - 1, "versions": versions})
+}
+
+// configVersion serves a version's snapshot, secrets masked.
+func (a *adminAPI) configVersion(w http.ResponseWriter, r *http.Request) {
+	n, ok := a.pathVersion(w, r)
+	if !ok {
+		return
+	}
+	s, _ := a.history.at(n)
+	writeJSON(w, http.StatusOK, map[string]any{"version": a.history.versions()[n], "config": maskedSnapshot(s)})
+}
+
+// configDiff lists what changed from ?from= (default the version before)
+// to the version; from=current shows what rolling back to it would change.
+func (a *adminAPI) configDiff(w http.ResponseWriter, r *http.Request) {
+	n, ok := a.pathVersion(w, r)
+	if !ok {
+		return
+	}
+	from := max(n-1, 0)
+	if q := r.URL.Query().Get("from"); q != "" {
+		var err error
+		if from, err = a.history.parse(q); err != nil {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+	}
+	before, _ := a.history.at(from)
+	after, _ := a.history.at(n)
+	writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": n, "changes": diffSnapshots(before, after)})
+}
+
+// rollbackConfig restores a version's state as a new version.
+func (a *adminAPI) rollbackConfig(w http.ResponseWriter, r *http.Request) {
+	n, ok := a.pathVersion(w, r)
+	if !ok {
+		return
+	}
+	cur := a.history.current()
+	v, err := a.history.rollback(r.Context(), n)
+	if err != nil {
+		log.Printf("Error rolling back config: %v", err)
+		writeError(w, http.StatusInternalServerError, "storage_error", "rolling back the config failed")
+		return
+	}
+	after, _ := a.history.at(v)
+	writeJSON(w, http.StatusOK, map[string]any{"version": a.history.versions()[v], "changes": diffSnapshots(cur, after)})
+}
+
+// runConfig implements the config subcommand against a running proxy's
+// admin API.
+func runConfig(args []string) error {
+	usage := fmt.Errorf("usage: %s config versions | show <version> | diff <version> [-from version] | rollback <version> [-admin url] [-token token] [-json]", os.Args[0])
+	if len(args) == 0 {
+		return usage
+	}
+	sub, args := args[0], args[1:]
+	var version string
+	if sub != "versions" {
+		if len(args) == 0 || len(args[0]) > 0 && args[0][0] == '-' {
+			return usage
+		}
+		version, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("config "+sub, flag.ExitOnError)
+	addr := fs.String("admin", envOr("ZAI_PROXY_ADMIN_URL", "http://localhost:8080"), "admin API URL, or unix:/path for a socket")
+	token := fs.String("token", os.Getenv("ZAI_PROXY_ADMIN_TOKEN"), "admin token")
+	from := fs.String("from", "", "version to diff from (diff); default the one before, or current")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	api := newAPIKeys(*addr, *token)
+	ctx := context.Background()
+	var res map[string]json.RawMessage
+	var err error
+	switch sub {
+	case "versions":
+		err = api.do(ctx, http.MethodGet, "/admin/config/versions", nil, &res)
+	case "show":
+		err = api.do(ctx, http.MethodGet, "/admin/config/versions/"+version, nil, &res)
+	case "diff":
+		path := "/admin/config/versions/" + version + "/diff"
+		if *from != "" {
+			path += "?from=" + *from
+		}
+		err = api.do(ctx, http.MethodGet, path, nil, &res)
+	case "rollback":
+		err = api.do(ctx, http.MethodPost, "/admin/config/versions/"+version+"/rollback", nil, &res)
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+	if *asJSON || sub == "show" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	if sub == "versions" {
+		var current int
+		var versions []ConfigVersion
+		json.Unmarshal(res["current"], &current)
+		json.Unmarshal(res["versions"], &versions)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tTIME\tCHANGE")
+		for _, v := range versions {
+			mark, at := " ", "-"
+			if v.Version == current {
+				mark = "*"
+			}
+			if v.Time != nil {
+				at = v.Time.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%s%d\t%s\t%s\n", mark, v.Version, at, v.Change)
+		}
+		return tw.Flush()
+	}
+	if sub == "rollback" {
+		var v ConfigVersion
+		json.Unmarshal(res["version"], &v)
+		fmt.Printf("%s, now version %d\n", v.Change, v.Version)
+	}
+	var changes []ConfigChange
+	json.Unmarshal(res["changes"], &changes)
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+	}
+	for _, c := range changes {
+		before, _ := json.Marshal(c.Before)
+		after, _ := json.Marshal(c.After)
+		switch {
+		case c.Before == nil:
+			fmt.Printf("+ %s: %s\n", c.Path, after)
+		case c.After == nil:
+			fmt.Printf("- %s: %s\n", c.Path, before)
+		default:
+			fmt.Printf("~ %s: %s -> %s\n", c.Path, before, after)
+		}
+	}
+	return nil
+}
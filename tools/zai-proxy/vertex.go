@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// VertexConfig makes an upstream Google's Gemini models on Vertex AI, in
+// Project (default GOOGLE_CLOUD_PROJECT) and Region (default
+// GOOGLE_CLOUD_LOCATION, else us-central1). Chat completions are
+// translated to generateContent calls, streamed ones to
+// streamGenerateContent, for the model Models maps theirs to, the "*"
+// entry for models it doesn't list, else the one named, and the replies
+// back to OpenAI's form. Other OpenAI endpoints go to Vertex's
+// OpenAI-compatible one, and paths already under /v1/projects as sent.
+// An upstream URL of https://aiplatform.googleapis.com is sent to
+// Region's endpoint, global's being that one; any other, such as a
+// Private Service Connect endpoint, is used as given. Without its own
+// auth the upstream is sent access tokens by the google scheme.
+type VertexConfig struct {
+	Project string            `json:"project,omitempty"`
+	Region  string            `json:"region,omitempty"`
+	Models  map[string]string `json:"models,omitempty"`
+}
+
+// vertexAuth is a Vertex upstream's auth when it configures none.
+var vertexAuth = UpstreamAuth{Scheme: "google"}
+
+func (c *VertexConfig) validate() error {
+	if c.project() == "" {
+		return errors.New("set project or GOOGLE_CLOUD_PROJECT")
+	}
+	if strings.ContainsAny(c.region(), "/?#.") {
+		return fmt.Errorf("region %q is not a location, like us-central1", c.region())
+	}
+	for model, m := range c.Models {
+		if m == "" || strings.ContainsAny(m, "/?#:") {
+			return fmt.Errorf("models: %s: %q is not a model name", model, m)
+		}
+	}
+	return nil
+}
+
+func (c *VertexConfig) project() string {
+	return cmp.Or(c.Project, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+}
+
+func (c *VertexConfig) region() string {
+	return cmp.Or(c.Region, os.Getenv("GOOGLE_CLOUD_LOCATION"), "us-central1")
+}
+
+// model is the Gemini model serving model.
+func (c *VertexConfig) model(model string) string {
+	if m, ok := c.Models[model]; ok {
+		return m
+	}
+	if m, ok := c.Models["*"]; ok {
+		return m
+	}
+	return strings.TrimPrefix(model, "google/")
+}
+
+// endpoint is where requests to the upstream at base are sent.
+func (c *VertexConfig) endpoint(base string) string {
+	u, err := url.Parse(base)
+	if err != nil || u.Host != "aiplatform.googleapis.com" {
+		return strings.TrimSuffix(base, "/")
+	}
+	if r := c.region(); r != "global" {
+		u.Host = r + "-" + u.Host
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// rewrite turns req, sent to target under base, into Vertex's form for
+// model, a chat completion's body into a generateContent request.
+func (c *VertexConfig) rewrite(req *http.Request, base, target, model string) error {
+	rest := strings.TrimPrefix(target, strings.TrimSuffix(base, "/"))
+	p, query, _ := strings.Cut(rest, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	location := "/v1/projects/" + url.PathEscape(c.project()) + "/locations/" + url.PathEscape(c.region())
+	switch {
+	case strings.HasPrefix(p, "/v1/projects/"), strings.HasPrefix(p, "/v1beta1/projects/"):
+	case strings.TrimPrefix(p, "/v1") == "/chat/completions" && req.Method == http.MethodPost:
+		body, err := requestBody(req)
+		if err != nil {
+			return err
+		}
+		v, err := decodeJSON(body)
+		doc, _ := v.(map[string]any)
+		if err != nil || doc == nil {
+			return fmt.Errorf("vertex: chat completion body is not a JSON object")
+		}
+		gen, stream := geminiRequest(doc)
+		method := ":generateContent"
+		if stream {
+			method = ":streamGenerateContent"
+			q.Set("alt", "sse")
+		}
+		p = location + "/publishers/google/models/" + url.PathEscape(c.model(model)) + method
+		b, err := encodeJSON(gen)
+		if err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
+		req.ContentLength = int64(len(b))
+		req.Header.Del("Content-Length")
+		req.Header.Set("Content-Type", "application/json")
+		// The reply is rewritten, so leave decoding it to the transport.
+		req.Header.Del("Accept-Encoding")
+	default:
+		p = location + "/endpoints/openapi" + strings.TrimPrefix(p, "/v1")
+	}
+	u, err := url.Parse(c.endpoint(base) + p)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = q.Encode()
+	req.URL, req.Host = u, u.Host
+	return nil
+}
+
+// requestBody returns req's body, which is read into memory unless it
+// can be had again.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
+
+// geminiRequest translates a chat completion request, reporting whether
+// it streams.
+func geminiRequest(doc map[string]any) (map[string]any, bool) {
+	var system, contents []any
+	names := map[string]string{} // tool call ID to function name
+	msgs, _ := doc["messages"].([]any)
+	for _, m := range msgs {
+		msg, _ := m.(map[string]any)
+		role, _ := msg["role"].(string)
+		var parts []any
+		switch role {
+		case "system", "developer":
+			system = append(system, geminiParts(msg["content"])...)
+			continue
+		case "assistant":
+			role, parts = "model", geminiParts(msg["content"])
+			calls, _ := msg["tool_calls"].([]any)
+			for _, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				name, _ := fn["name"].(string)
+				if id, ok := call["id"].(string); ok {
+					names[id] = name
+				}
+				args := map[string]any{}
+				if s, _ := fn["arguments"].(string); s != "" {
+					if v, err := decodeJSON([]byte(s)); err == nil {
+						if a, ok := v.(map[string]any); ok {
+							args = a
+						}
+					}
+				}
+				parts = append(parts, map[string]any{"functionCall": map[string]any{"name": name, "args": args}})
+			}
+		case "tool":
+			id, _ := msg["tool_call_id"].(string)
+			name, _ := msg["name"].(string)
+			role = "user"
+			parts = []any{map[string]any{"functionResponse": map[string]any{
+				"name": cmp.Or(names[id], name, id), "response": toolResponse(msg["content"])}}}
+		default:
+			role, parts = "user", geminiParts(msg["content"])
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		// Gemini takes turns; consecutive messages of a role are one.
+		if n := len(contents); n > 0 && contents[n-1].(map[string]any)["role"] == role {
+			last := contents[n-1].(map[string]any)
+			last["parts"] = append(last["parts"].([]any), parts...)
+			continue
+		}
+		contents = append(contents, map[string]any{"role": role, "parts": parts})
+	}
+	if contents == nil {
+		contents = []any{}
+	}
+	out := map[string]any{"contents": contents}
+	if len(system) > 0 {
+		out["systemInstruction"] = map[string]any{"parts": system}
+	}
+
+	gc := map[string]any{}
+	for _, f := range [][2]string{{"temperature", "temperature"}, {"top_p", "topP"}, {"max_tokens", "maxOutputTokens"},
+		{"max_completion_tokens", "maxOutputTokens"}, {"n", "candidateCount"}, {"seed", "seed"},
+		{"presence_penalty", "presencePenalty"}, {"frequency_penalty", "frequencyPenalty"}} {
+		if v, ok := doc[f[0]]; ok && v != nil {
+			gc[f[1]] = v
+		}
+	}
+	switch stop := doc["stop"].(type) {
+	case string:
+		gc["stopSequences"] = []any{stop}
+	case []any:
+		gc["stopSequences"] = stop
+	}
+	if rf, _ := doc["response_format"].(map[string]any); rf != nil {
+		switch rf["type"] {
+		case "json_object":
+			gc["responseMimeType"] = "application/json"
+		case "json_schema":
+			gc["responseMimeType"] = "application/json"
+			if js, _ := rf["json_schema"].(map[string]any); js["schema"] != nil {
+				gc["responseSchema"] = js["schema"]
+			}
+		}
+	}
+	if len(gc) > 0 {
+		out["generationConfig"] = gc
+	}
+
+	var decls []any
+	tools, _ := doc["tools"].([]any)
+	for _, t := range tools {
+		tool, _ := t.(map[string]any)
+		fn, _ := tool["function"].(map[string]any)
+		if tool["type"] != "function" || fn == nil {
+			continue
+		}
+		decl := map[string]any{"name": fn["name"]}
+		for _, k := range []string{"description", "parameters"} {
+			if fn[k] != nil {
+				decl[k] = fn[k]
+			}
+		}
+		decls = append(decls, decl)
+	}
+	if len(decls) > 0 {
+		out["tools"] = []any{map[string]any{"functionDeclarations": decls}}
+	}
+	fc := map[string]any{}
+	switch choice := doc["tool_choice"].(type) {
+	case string:
+		fc["mode"] = map[string]string{"none": "NONE", "auto": "AUTO", "required": "ANY"}[choice]
+	case map[string]any:
+		fn, _ := choice["function"].(map[string]any)
+		fc["mode"], fc["allowedFunctionNames"] = "ANY", []any{fn["name"]}
+	}
+	if fc["mode"] != nil && fc["mode"] != "" {
+		out["toolConfig"] = map[string]any{"functionCallingConfig": fc}
+	}
+	stream, _ := doc["stream"].(bool)
+	return out, stream
+}
+
+// geminiParts translates message content, a string or a list of parts.
+func geminiParts(content any) []any {
+	switch c := content.(type) {
+	case string:
+		if c == "" {
+			return nil
+		}
+		return []any{map[string]any{"text": c}}
+	case []any:
+		var parts []any
+		for _, e := range c {
+			part, _ := e.(map[string]any)
+			switch part["type"] {
+			case "text":
+				parts = append(parts, map[string]any{"text": part["text"]})
+			case "image_url":
+				ref, _ := part["image_url"].(map[string]any)
+				u, _ := ref["url"].(string)
+				if u == "" {
+					u, _ = part["image_url"].(string)
+				}
+				if data, ok := strings.CutPrefix(u, "data:"); ok {
+					meta, b64, _ := strings.Cut(data, ",")
+					parts = append(parts, map[string]any{"inlineData": map[string]any{
+						"mimeType": strings.TrimSuffix(meta, ";base64"), "data": b64}})
+					continue
+				}
+				pu, _ := url.Parse(u)
+				typ := "image/jpeg"
+				if pu != nil {
+					typ = cmp.Or(mime.TypeByExtension(path.Ext(pu.Path)), typ)
+				}
+				parts = append(parts, map[string]any{"fileData": map[string]any{"mimeType": typ, "fileUri": u}})
+			case "input_audio":
+				audio, _ := part["input_audio"].(map[string]any)
+				format, _ := audio["format"].(string)
+				parts = append(parts, map[string]any{"inlineData": map[string]any{
+					"mimeType": "audio/" + cmp.Or(format, "wav"), "data": audio["data"]}})
+			}
+		}
+		return parts
+	}
+	return nil
+}
+
+// toolResponse is a tool message's content as a functionResponse's
+// response, which must be an object.
+func toolResponse(content any) map[string]any {
+	text, _ := content.(string)
+	if parts, ok := content.([]any); ok {
+		var b strings.Builder
+		for _, e := range parts {
+			part, _ := e.(map[string]any)
+			s, _ := part["text"].(string)
+			b.WriteString(s)
+		}
+		text = b.String()
+	}
+	if v, err := decodeJSON([]byte(text)); err == nil {
+		if obj, ok := v.(map[string]any); ok {
+			return obj
+		}
+	}
+	return map[string]any{"content": text}
+}
+
+// vertexTranslated reports whether req is a chat completion rewrite
+// turned into a Gemini call, whose reply is to be turned back.
+func vertexTranslated(ex *exchange, req *http.Request) bool {
+	return ex != nil && strings.HasSuffix(ex.path, "/chat/completions") &&
+		(strings.HasSuffix(req.URL.Path, ":generateContent") || strings.HasSuffix(req.URL.Path, ":streamGenerateContent"))
+}
+
+// vertexResponse turns a Gemini reply into a chat completion, a stream of
+// chunks for a streamed one, or an OpenAI-style error.
+func vertexResponse(resp *http.Response, model string) (*http.Response, error) {
+	created := time.Now().Unix()
+	if resp.StatusCode < 300 && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = &geminiStream{src: bufio.NewReader(resp.Body), body: resp.Body, model: model, created: created,
+			calls: map[int]int{}, started: map[int]bool{}}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp, nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	v, _ := decodeJSON(b)
+	if list, ok := v.([]any); ok && len(list) > 0 {
+		v = list[0]
+	}
+	doc, _ := v.(map[string]any)
+	var out any
+	if resp.StatusCode >= 300 {
+		e, _ := doc["error"].(map[string]any)
+		msg, _ := e["message"].(string)
+		status, _ := e["status"].(string)
+		out = apiError{Error: apiErrorDetail{Message: cmp.Or(msg, strings.TrimSpace(string(b)), resp.Status),
+			Type: cmp.Or(strings.ToLower(status), "upstream_error")}}
+	} else {
+		out = geminiCompletion(doc, model, created)
+	}
+	if b, err = encodeJSON(out); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(b)))
+	resp.Header.Set("Content-Type", "application/json")
+	return resp, nil
+}
+
+// geminiCompletion translates a generateContent reply.
+func geminiCompletion(doc map[string]any, model string, created int64) map[string]any {
+	var choices []any
+	n := 0
+	cands, _ := doc["candidates"].([]any)
+	for i, c := range cands {
+		cand, _ := c.(map[string]any)
+		text, reasoning, calls := geminiContent(cand, &n)
+		msg := map[string]any{"role": "assistant", "content": text}
+		if reasoning != "" {
+			msg["reasoning_content"] = reasoning
+		}
+		if len(calls) > 0 {
+			msg["tool_calls"] = calls
+		}
+		reason, _ := cand["finishReason"].(string)
+		choices = append(choices, map[string]any{"index": cmp.Or(candidateIndex(cand), i), "message": msg,
+			"finish_reason": cmp.Or(openAIFinish(reason, len(calls) > 0), "stop")})
+	}
+	if len(choices) == 0 {
+		// The prompt itself was blocked.
+		choices = []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": ""},
+			"finish_reason": "content_filter"}}
+	}
+	out := map[string]any{"id": geminiID(doc), "object": "chat.completion", "created": created,
+		"model": geminiModel(doc, model), "choices": choices}
+	if m, _ := doc["usageMetadata"].(map[string]any); m != nil {
+		out["usage"] = openAIUsage(m)
+	}
+	return out
+}
+
+// geminiContent reads a candidate's text, thoughts and function calls,
+// numbering the calls from *n.
+func geminiContent(cand map[string]any, n *int) (text, reasoning string, calls []any) {
+	content, _ := cand["content"].(map[string]any)
+	parts, _ := content["parts"].([]any)
+	for _, p := range parts {
+		part, _ := p.(map[string]any)
+		if fc, _ := part["functionCall"].(map[string]any); fc != nil {
+			args := []byte("{}")
+			if fc["args"] != nil {
+				if b, err := encodeJSON(fc["args"]); err == nil {
+					args = b
+				}
+			}
+			id, _ := fc["id"].(string)
+			calls = append(calls, map[string]any{"id": cmp.Or(id, fmt.Sprintf("call_%d", *n)), "type": "function",
+				"function": map[string]any{"name": fc["name"], "arguments": string(args)}})
+			*n++
+			continue
+		}
+		s, _ := part["text"].(string)
+		if thought, _ := part["thought"].(bool); thought {
+			reasoning += s
+		} else {
+			text += s
+		}
+	}
+	return text, reasoning, calls
+}
+
+func candidateIndex(cand map[string]any) int {
+	n, _ := cand["index"].(json.Number)
+	i, _ := n.Int64()
+	return int(i)
+}
+
+func geminiID(doc map[string]any) string {
+	if id, _ := doc["responseId"].(string); id != "" {
+		return "chatcmpl-" + id
+	}
+	return "chatcmpl-" + newRequestID()
+}
+
+func geminiModel(doc map[string]any, model string) string {
+	v, _ := doc["modelVersion"].(string)
+	return cmp.Or(v, model)
+}
+
+// openAIFinish maps a Gemini finish reason, "" while a candidate goes on.
+func openAIFinish(reason string, calls bool) string {
+	switch reason {
+	case "":
+		return ""
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if calls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func openAIUsage(m map[string]any) map[string]any {
+	count := func(k string) int64 {
+		n, _ := m[k].(json.Number)
+		v, _ := n.Int64()
+		return v
+	}
+	prompt, thoughts := count("promptTokenCount"), count("thoughtsTokenCount")
+	completion := count("candidatesTokenCount") + thoughts
+	u := map[string]any{"prompt_tokens": prompt, "completion_tokens": completion,
+		"total_tokens": cmp.Or(count("totalTokenCount"), prompt+completion)}
+	if c := count("cachedContentTokenCount"); c > 0 {
+		u["prompt_tokens_details"] = map[string]any{"cached_tokens": c}
+	}
+	if thoughts > 0 {
+		u["completion_tokens_details"] = map[string]any{"reasoning_tokens": thoughts}
+	}
+	return u
+}
+
+// geminiStream reads a streamGenerateContent reply as chat completion
+// chunks, ending with [DONE]. The chunk finishing the reply carries its
+// usage.
+type geminiStream struct {
+	src     *bufio.Reader
+	body    io.Closer
+	model   string
+	created int64
+	id      string
+	out     []byte
+	done    bool
+	n       int          // function calls so far
+	calls   map[int]int  // function calls so far by candidate, for the finish reason
+	started map[int]bool // candidates whose role has been sent
+}
+
+func (s *geminiStream) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		line, err := s.src.ReadBytes('\n')
+		if data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok {
+			s.event(bytes.TrimSpace(data))
+		}
+		if err == io.EOF {
+			s.out, s.done = append(s.out, "data: [DONE]\n\n"...), true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *geminiStream) Close() error { return s.body.Close() }
+
+// event translates one streamed reply.
+func (s *geminiStream) event(data []byte) {
+	v, err := decodeJSON(data)
+	doc, _ := v.(map[string]any)
+	if err != nil || doc == nil {
+		return
+	}
+	if s.id == "" {
+		s.id = geminiID(doc)
+	}
+	var choices []any
+	finished := false
+	cands, _ := doc["candidates"].([]any)
+	for i, c := range cands {
+		cand, _ := c.(map[string]any)
+		idx := cmp.Or(candidateIndex(cand), i)
+		text, reasoning, calls := geminiContent(cand, &s.n)
+		delta := map[string]any{}
+		if !s.started[idx] {
+			delta["role"], s.started[idx] = "assistant", true
+		}
+		if text != "" {
+			delta["content"] = text
+		}
+		if reasoning != "" {
+			delta["reasoning_content"] = reasoning
+		}
+		for _, call := range calls {
+			call.(map[string]any)["index"] = s.calls[idx]
+			s.calls[idx]++
+		}
+		if len(calls) > 0 {
+			delta["tool_calls"] = calls
+		}
+		reason, _ := cand["finishReason"].(string)
+		choice := map[string]any{"index": idx, "delta": delta, "finish_reason": nil}
+		if f := openAIFinish(reason, s.calls[idx] > 0); f != "" {
+			choice["finish_reason"], finished = f, true
+		}
+		choices = append(choices, choice)
+	}
+	if len(cands) == 0 {
+		if fb, _ := doc["promptFeedback"].(map[string]any); fb["blockReason"] != nil {
+			choices = []any{map[string]any{"index": 0, "delta": map[string]any{"role": "assistant"}, "finish_reason": "content_filter"}}
+			finished = true
+		}
+	}
+	if len(choices) == 0 {
+		return
+	}
+	chunk := map[string]any{"id": s.id, "object": "chat.completion.chunk", "created": s.created,
+		"model": geminiModel(doc, s.model), "choices": choices}
+	if m, _ := doc["usageMetadata"].(map[string]any); m != nil && finished {
+		chunk["usage"] = openAIUsage(m)
+	}
+	b, err := encodeJSON(chunk)
+	if err != nil {
+		return
+	}
+	s.out = append(append(append(s.out, "data: "...), b...), "\n\n"...)
+}